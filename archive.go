@@ -0,0 +1,328 @@
+package irma
+
+import (
+	"crypto/sha256"
+	"encoding/pem"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/gabi/revocation"
+	"github.com/privacybydesign/gabi/signed"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+const LDContextSignatureArchive = "https://irma.app/ld/signature-archive/v1"
+
+// SignatureArchive is an attribute-based signature along with the evidence required to verify it
+// using VerifyArchive(), even after the schemes involved have been updated: the scheme files and
+// signed scheme index as they were at signing time, and the latest revocation state of the
+// credential types involved. Its timestamp should be created by an RFC 3161 TSA (see SchemeTSA),
+// whose timestamps include the certificate chain of the TSA so that no server needs to be contacted.
+type SignatureArchive struct {
+	LDContext     string                                          `json:"@context"`
+	SignedMessage *SignedMessage                                  `json:"signature"`
+	Schemes       []*ArchivedScheme                               `json:"schemes"`
+	Revocation    map[CredentialTypeIdentifier]*revocation.Update `json:"revocation,omitempty"`
+	Archived      Timestamp                                       `json:"archived"`
+}
+
+// ArchivedScheme contains the files of a scheme required to verify an archived signature, along
+// with the scheme index and its signature by the scheme public key.
+type ArchivedScheme struct {
+	ID        SchemeManagerIdentifier `json:"id"`
+	PublicKey []byte                  `json:"pk"`       // PEM-encoded public key of the scheme (pk.pem)
+	Index     []byte                  `json:"index"`    // index of the scheme files
+	IndexSig  []byte                  `json:"indexsig"` // signature over the index (index.sig)
+	Files     map[string][]byte       `json:"files"`    // by path relative to the scheme folder
+}
+
+// Validate checks that the @context of the archive is that of signature archives.
+func (a *SignatureArchive) Validate() error {
+	if err := ValidateLDContext(a.LDContext, nil, "", LDContextSignatureArchive); err != nil {
+		return err
+	}
+	if a.SignedMessage == nil {
+		return errors.New("signature archive contains no signature")
+	}
+	return nil
+}
+
+// Archive returns a SignatureArchive of the signed message, containing the scheme files from the
+// configuration that are required to verify it, and the latest revocation updates of the
+// credential types involved that are present in the revocation storage of the configuration.
+// The signed message should be verified before it is archived.
+func (sm *SignedMessage) Archive(conf *Configuration) (*SignatureArchive, error) {
+	archive := &SignatureArchive{
+		LDContext:     LDContextSignatureArchive,
+		SignedMessage: sm,
+		Archived:      Timestamp(conf.now()),
+	}
+
+	files := map[SchemeManagerIdentifier]map[string]struct{}{}
+	for _, proof := range sm.Signature {
+		proofd, ok := proof.(*gabi.ProofD)
+		if !ok {
+			return nil, errors.New("signature contains a proof that is not a disclosure proof")
+		}
+		meta := MetadataFromInt(proofd.ADisclosed[1], conf)
+		credtype := meta.CredentialType()
+		if credtype == nil {
+			return nil, errors.New("signature contains attributes from unknown credential type")
+		}
+		id := credtype.Identifier()
+		issuer := credtype.IssuerIdentifier()
+		schemeID := issuer.SchemeManagerIdentifier()
+		if files[schemeID] == nil {
+			files[schemeID] = map[string]struct{}{"description.xml": {}}
+		}
+		files[schemeID][path.Join(issuer.Name(), "description.xml")] = struct{}{}
+		files[schemeID][path.Join(issuer.Name(), "Issues", id.Name(), "description.xml")] = struct{}{}
+		files[schemeID][path.Join(issuer.Name(), "PublicKeys", strconv.Itoa(int(meta.KeyCounter()))+".xml")] = struct{}{}
+
+		if proofd.HasNonRevocationProof() && conf.Revocation != nil && conf.Revocation.recordStorage != nil {
+			pkCounter := proofd.NonRevocationProof.SignedAccumulator.PKCounter
+			updates, err := conf.Revocation.LatestUpdates(id, 1, &pkCounter)
+			if err == nil && updates[pkCounter] != nil {
+				if archive.Revocation == nil {
+					archive.Revocation = map[CredentialTypeIdentifier]*revocation.Update{}
+				}
+				archive.Revocation[id] = updates[pkCounter]
+			}
+		}
+	}
+
+	for schemeID, paths := range files {
+		scheme := conf.SchemeManagers[schemeID]
+		archived := &ArchivedScheme{ID: schemeID, Files: map[string][]byte{}}
+		var err error
+		if archived.PublicKey, err = os.ReadFile(filepath.Join(scheme.path(), "pk.pem")); err != nil {
+			return nil, err
+		}
+		if archived.Index, err = os.ReadFile(filepath.Join(scheme.path(), "index")); err != nil {
+			return nil, err
+		}
+		if archived.IndexSig, err = os.ReadFile(filepath.Join(scheme.path(), "index.sig")); err != nil {
+			return nil, err
+		}
+		for p := range paths {
+			bts, found, err := conf.readSignedFile(scheme.index, scheme.path(), filepath.FromSlash(p))
+			if err != nil {
+				return nil, err
+			}
+			if !found {
+				return nil, errors.Errorf("file %s not present in index of scheme %s", p, schemeID)
+			}
+			archived.Files[p] = bts
+		}
+		archive.Schemes = append(archive.Schemes, archived)
+	}
+
+	return archive, nil
+}
+
+// VerifyArchive verifies the archived signature like SignedMessage.Verify(), using the scheme
+// files and revocation updates contained in the archive instead of the configuration. The public
+// key of each scheme in the archive must be either the current public key of the scheme in the
+// configuration, or one of the public keys pinned for the scheme (see PinSchemePublicKeys()), so
+// that signatures remain verifiable after the key of a scheme is rotated by pinning its former keys.
+// If an archived scheme does not specify a TSA, then the TSA root certificates of the scheme in the
+// configuration, if any, are used to verify the timestamp of the signature.
+func (a *SignatureArchive) VerifyArchive(conf *Configuration, request *SignatureRequest) ([][]*DisclosedAttribute, ProofStatus, error) {
+	archiveConf, err := a.configuration(conf)
+	if err != nil {
+		return nil, ProofStatusInvalid, err
+	}
+	list, status, err := a.SignedMessage.Verify(archiveConf, request)
+	if err != nil || status != ProofStatusValid && status != ProofStatusMissingAttributes {
+		return list, status, err
+	}
+	a.confirmNonRevocation(archiveConf, list)
+	return list, status, nil
+}
+
+// configuration returns a configuration containing the credential types, issuers and public keys
+// from the scheme files of the archive, after verifying these against the scheme indices.
+func (a *SignatureArchive) configuration(conf *Configuration) (*Configuration, error) {
+	archiveConf := &Configuration{}
+	archiveConf.clear()
+	archiveConf.Revocation = &RevocationStorage{conf: archiveConf, settings: RevocationSettings{}}
+	archiveConf.Revocation.Keys = RevocationKeys{Conf: archiveConf}
+
+	for _, archived := range a.Schemes {
+		if err := archived.verify(conf); err != nil {
+			return nil, err
+		}
+		scheme := &SchemeManager{}
+		if err := archived.unmarshal("description.xml", scheme); err != nil {
+			return nil, err
+		}
+		if scheme.Identifier() != archived.ID {
+			return nil, errors.Errorf("archived scheme %s has wrong description", archived.ID)
+		}
+		// The TSA root certificates of the archived scheme may be supplemented by the verifier
+		if current := conf.SchemeManagers[archived.ID]; scheme.TSA == nil && current != nil {
+			scheme.TSA = current.TSA
+		}
+		if scheme.TSA != nil {
+			if _, err := scheme.TSA.Roots(); err != nil {
+				return nil, err
+			}
+		}
+		scheme.Status = SchemeManagerStatusValid
+		archiveConf.SchemeManagers[archived.ID] = scheme
+
+		for p, bts := range archived.Files {
+			dir, file := path.Split(p)
+			parts := splitPath(dir)
+			switch {
+			case len(parts) == 1 && file == "description.xml":
+				issuer := &Issuer{}
+				if err := archived.unmarshal(p, issuer); err != nil {
+					return nil, err
+				}
+				archiveConf.Issuers[issuer.Identifier()] = issuer
+			case len(parts) == 3 && parts[1] == "Issues" && file == "description.xml":
+				cred := &CredentialType{}
+				if err := archived.unmarshal(p, cred); err != nil {
+					return nil, err
+				}
+				credid := cred.Identifier()
+				archiveConf.CredentialTypes[credid] = cred
+				archiveConf.addReverseHash(credid)
+				for index, attr := range cred.AttributeTypes {
+					attr.Index = index
+					attr.SchemeManagerID = cred.SchemeManagerID
+					attr.IssuerID = cred.IssuerID
+					attr.CredentialTypeID = cred.ID
+					archiveConf.AttributeTypes[attr.GetAttributeTypeIdentifier()] = attr
+				}
+			case len(parts) == 2 && parts[1] == "PublicKeys":
+				issuerid := NewIssuerIdentifier(archived.ID.Name() + "." + parts[0])
+				key, err := gabikeys.NewPublicKeyFromBytes(bts)
+				if err != nil {
+					return nil, err
+				}
+				key.Issuer = issuerid.String()
+				archiveConf.publicKeys.Set(PublicKeyIdentifier{issuerid, key.Counter}, key)
+			}
+		}
+	}
+	archiveConf.initialized = true
+	return archiveConf, nil
+}
+
+// verify verifies the index of the archived scheme against its public key, which must be trusted
+// by the configuration, and the archived files against the index.
+func (archived *ArchivedScheme) verify(conf *Configuration) error {
+	// signed.UnmarshalPemPublicKey() panics on invalid PEM
+	if block, _ := pem.Decode(archived.PublicKey); block == nil {
+		return errors.Errorf("public key of archived scheme %s is not PEM-encoded", archived.ID)
+	}
+	pk, err := signed.UnmarshalPemPublicKey(archived.PublicKey)
+	if err != nil {
+		return err
+	}
+	_, pinned := conf.pinnedSchemeKeys[archived.ID.String()]
+	trusted := pinned && conf.checkSchemePublicKey(archived.ID.String(), pk) == nil
+	if scheme := conf.SchemeManagers[archived.ID]; !trusted && scheme != nil {
+		current, err := conf.schemePublicKey(scheme.path())
+		trusted = err == nil && current.Equal(pk)
+	}
+	if !trusted {
+		return errors.Errorf("public key of archived scheme %s is not trusted", archived.ID)
+	}
+	if err = signed.Verify(pk, archived.Index, archived.IndexSig); err != nil {
+		return errors.Errorf("index of archived scheme %s has invalid signature", archived.ID)
+	}
+
+	index := SchemeManagerIndex{}
+	if err = index.FromString(string(archived.Index)); err != nil {
+		return err
+	}
+	for p, bts := range archived.Files {
+		hash := sha256.Sum256(bts)
+		if !index[index.Scheme()+"/"+p].Equal(hash[:]) {
+			return errors.Errorf("archived file %s does not match index of scheme %s", p, archived.ID)
+		}
+	}
+	return nil
+}
+
+func (archived *ArchivedScheme) unmarshal(p string, description interface{}) error {
+	bts, ok := archived.Files[p]
+	if !ok {
+		return errors.Errorf("archived scheme %s does not contain %s", archived.ID, p)
+	}
+	return common.Unmarshal(path.Base(p), bts, description)
+}
+
+// confirmNonRevocation uses the archived revocation updates to improve the time up to which the
+// disclosed attributes are known not to be revoked: if an archived accumulator is newer than the
+// accumulator used in the nonrevocation proof of a credential but has the same index, then no
+// credential was revoked in between.
+func (a *SignatureArchive) confirmNonRevocation(conf *Configuration, list [][]*DisclosedAttribute) {
+	confirmed := map[CredentialTypeIdentifier]time.Time{}
+	for _, proof := range a.SignedMessage.Signature {
+		proofd := proof.(*gabi.ProofD)
+		if !proofd.HasNonRevocationProof() {
+			continue
+		}
+		id := MetadataFromInt(proofd.ADisclosed[1], conf).CredentialType().Identifier()
+		update := a.Revocation[id]
+		sacc := proofd.NonRevocationProof.SignedAccumulator
+		if update == nil || update.SignedAccumulator.PKCounter != sacc.PKCounter {
+			continue
+		}
+		pk, err := RevocationKeys{conf}.PublicKey(id.IssuerIdentifier(), sacc.PKCounter)
+		if err != nil {
+			continue
+		}
+		theirs, err := sacc.UnmarshalVerify(pk)
+		if err != nil {
+			continue
+		}
+		ours, err := update.SignedAccumulator.UnmarshalVerify(pk)
+		if err != nil || ours.Index != theirs.Index || ours.Time <= theirs.Time {
+			continue
+		}
+		confirmed[id] = time.Unix(ours.Time, 0)
+	}
+
+	var signedAt time.Time
+	if ts := a.SignedMessage.SignatureTimestamp(); ts != nil {
+		signedAt = ts.Time()
+	}
+	for _, attrs := range list {
+		for _, attr := range attrs {
+			if attr == nil || attr.NotRevokedBefore == nil {
+				continue
+			}
+			id := attr.Identifier.CredentialTypeIdentifier()
+			t, ok := confirmed[id]
+			if !ok || !t.After(time.Time(*attr.NotRevokedBefore)) {
+				continue
+			}
+			tolerance := time.Duration(conf.Revocation.settings.Get(id).Tolerance) * time.Second
+			if !signedAt.IsZero() && signedAt.Sub(t) <= tolerance {
+				attr.NotRevokedBefore = nil
+			} else {
+				attr.NotRevokedBefore = (*Timestamp)(&t)
+			}
+		}
+	}
+}
+
+// splitPath returns the folders of the slash-separated path of an archived scheme file.
+func splitPath(dir string) []string {
+	var parts []string
+	for dir = path.Clean(dir); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		parts = append([]string{path.Base(dir)}, parts...)
+	}
+	return parts
+}
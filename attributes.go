@@ -98,7 +98,7 @@ func (al *AttributeList) EqualsExceptMetadata(ol *AttributeList) bool {
 
 func (al *AttributeList) Hash() string {
 	if al.h == "" {
-		bytes := []byte{}
+		hash := sha256.New()
 		for _, i := range al.Ints {
 			// A CredentialInfo created from a CredentialRequest may contain attributes that are nil,
 			// since random blind attributes have no value yet at that point. Do not include these
@@ -106,10 +106,11 @@ func (al *AttributeList) Hash() string {
 			if i == nil {
 				continue
 			}
-			bytes = append(bytes, i.Bytes()...)
+			buf := intBytes(i)
+			hash.Write(*buf)
+			putBuf(buf)
 		}
-		shasum := sha256.Sum256(bytes)
-		al.h = hex.EncodeToString(shasum[:])
+		al.h = hex.EncodeToString(hash.Sum(nil))
 	}
 	return al.h
 }
@@ -178,14 +179,17 @@ func (al *AttributeList) decode(i int) *string {
 
 // Decode attribute value into string according to metadataVersion
 func decodeAttribute(attr *big.Int, metadataVersion byte) *string {
-	bi := new(big.Int).Set(attr)
+	bi := attr
 	if metadataVersion >= 3 {
 		if bi.Bit(0) == 0 { // attribute does not exist
 			return nil
 		}
-		bi.Rsh(bi, 1)
+		bi = getInt().Rsh(attr, 1)
+		defer putInt(bi)
 	}
-	str := string(bi.Bytes())
+	buf := intBytes(bi)
+	str := string(*buf)
+	putBuf(buf)
 	return &str
 }
 
@@ -194,6 +198,9 @@ func (al *AttributeList) UntranslatedAttribute(identifier AttributeTypeIdentifie
 	if al.CredentialType().Identifier() != identifier.CredentialTypeIdentifier() {
 		return nil
 	}
+	if identifier.IsMetadataAttribute() {
+		return al.MetadataAttribute.PseudoAttribute(identifier.Name())
+	}
 	for i, desc := range al.CredentialType().AttributeTypes {
 		if desc.ID == string(identifier.Name()) {
 			return al.decode(i)
@@ -259,11 +266,17 @@ func NewMetadataAttribute(version byte) *MetadataAttribute {
 // Bytes returns this metadata attribute as a byte slice.
 // Bigint's Bytes() method returns a big-endian byte slice, so add padding at begin.
 func (attr *MetadataAttribute) Bytes() []byte {
-	bytes := attr.Int.Bytes()
-	if len(bytes) < metadataLength {
-		bytes = append(make([]byte, metadataLength-len(bytes)), bytes...)
+	var buf [metadataLength]byte
+	return append([]byte(nil), attr.fill(&buf)...)
+}
+
+// fill writes this metadata attribute into buf, and returns buf as a slice, or a longer slice
+// if the metadata attribute does not fit (which only happens for invalid ones).
+func (attr *MetadataAttribute) fill(buf *[metadataLength]byte) []byte {
+	if attr.Int.BitLen() > 8*metadataLength {
+		return attr.Int.Bytes()
 	}
-	return bytes
+	return attr.Int.Go().FillBytes(buf[:])
 }
 
 // PublicKey extracts identifier of the Idemix public key with which this instance was signed,
@@ -281,12 +294,14 @@ func (attr *MetadataAttribute) PublicKey() (*gabikeys.PublicKey, error) {
 
 // Version returns the metadata version of this instance
 func (attr *MetadataAttribute) Version() byte {
-	return attr.field(versionField)[0]
+	var buf [metadataLength]byte
+	return attr.readField(versionField, &buf)[0]
 }
 
 // SigningDate returns the time at which this instance was signed
 func (attr *MetadataAttribute) SigningDate() time.Time {
-	bytes := attr.field(signingDateField)
+	var buf [metadataLength]byte
+	bytes := attr.readField(signingDateField, &buf)
 	bytes = bytes[1:] // The signing date field is one byte too long
 	timestamp := int64(binary.BigEndian.Uint16(bytes)) * ExpiryFactor
 	return time.Unix(timestamp, 0)
@@ -298,7 +313,8 @@ func (attr *MetadataAttribute) setSigningDate(issuedAt time.Time) {
 
 // KeyCounter return the public key counter of the metadata attribute
 func (attr *MetadataAttribute) KeyCounter() uint {
-	return uint(binary.BigEndian.Uint16(attr.field(keyCounterField)))
+	var buf [metadataLength]byte
+	return uint(binary.BigEndian.Uint16(attr.readField(keyCounterField, &buf)))
 }
 
 func (attr *MetadataAttribute) setKeyCounter(i uint) {
@@ -307,7 +323,8 @@ func (attr *MetadataAttribute) setKeyCounter(i uint) {
 
 // ValidityDuration returns the amount of epochs during which this instance is valid
 func (attr *MetadataAttribute) ValidityDuration() int {
-	return int(binary.BigEndian.Uint16(attr.field(validityField)))
+	var buf [metadataLength]byte
+	return int(binary.BigEndian.Uint16(attr.readField(validityField, &buf)))
 }
 
 func (attr *MetadataAttribute) setValidityDuration(weeks uint) {
@@ -339,7 +356,8 @@ func (attr *MetadataAttribute) setExpiryDate(timestamp *Timestamp) error {
 // CredentialType returns the credential type of the current instance
 // using the Configuration.
 func (attr *MetadataAttribute) CredentialType() *CredentialType {
-	return attr.Conf.hashToCredentialType(attr.field(credentialID))
+	var buf [metadataLength]byte
+	return attr.Conf.hashToCredentialType(attr.readField(credentialID, &buf))
 }
 
 func (attr *MetadataAttribute) setCredentialTypeIdentifier(id string) {
@@ -357,6 +375,22 @@ func (attr *MetadataAttribute) Expiry() time.Time {
 	return time.Unix(expiry, 0)
 }
 
+// PseudoAttribute returns the value of the specified metadata pseudo-attribute (see
+// MetadataAttributeExpiry and MetadataAttributeIssuanceDate), or nil if the name is unknown.
+func (attr *MetadataAttribute) PseudoAttribute(name string) *string {
+	var t time.Time
+	switch name {
+	case MetadataAttributeExpiry:
+		t = attr.Expiry()
+	case MetadataAttributeIssuanceDate:
+		t = attr.SigningDate()
+	default:
+		return nil
+	}
+	value := t.UTC().Format(AttributeDateLayout)
+	return &value
+}
+
 // IsValidOn returns whether this instance is still valid at the given time
 func (attr *MetadataAttribute) IsValidOn(t time.Time) bool {
 	return attr.Expiry().After(t)
@@ -378,6 +412,12 @@ func (attr *MetadataAttribute) field(field metadataField) []byte {
 	return attr.Bytes()[field.offset : field.offset+field.length]
 }
 
+// readField is like field(), but uses buf as scratch space so that the field can be read
+// without allocating.
+func (attr *MetadataAttribute) readField(field metadataField, buf *[metadataLength]byte) []byte {
+	return attr.fill(buf)[field.offset : field.offset+field.length]
+}
+
 func (attr *MetadataAttribute) setField(field metadataField, value []byte) {
 	if len(value) > field.length {
 		panic("Specified metadata field too large")
@@ -0,0 +1,156 @@
+package irma
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// ConDisConBuilder constructs an AttributeConDisCon, one disjunction at a time. For example:
+//
+//	cdc, err := irma.NewConDisConBuilder().
+//		With(irma.NewAttributeRequest("pbdf.pbdf.email.email")).
+//		Or(
+//			irma.And(irma.NewAttributeRequest("pbdf.gemeente.address.street"), irma.NewAttributeRequest("pbdf.gemeente.address.city")),
+//			irma.And(irma.NewAttributeRequest("pbdf.pbdf.idin.address"), irma.NewAttributeRequest("pbdf.pbdf.idin.city")),
+//		).
+//		Optional(irma.And(irma.NewAttributeRequest("pbdf.pbdf.mobilenumber.mobilenumber").WithNotNull())).
+//		BuildFor(conf)
+//
+// The first error encountered while adding disjunctions is returned by Build() and BuildFor().
+type ConDisConBuilder struct {
+	cdc AttributeConDisCon
+	err error
+}
+
+// NewConDisConBuilder returns a builder for an empty AttributeConDisCon.
+func NewConDisConBuilder() *ConDisConBuilder {
+	return &ConDisConBuilder{cdc: AttributeConDisCon{}}
+}
+
+// And returns the conjunction of the attribute requests.
+func And(attrs ...AttributeRequest) AttributeCon {
+	return AttributeCon(attrs)
+}
+
+// WithValue returns a copy of the attribute request that requires the attribute to have the value.
+func (ar AttributeRequest) WithValue(value string) AttributeRequest {
+	ar.Value = &value
+	return ar
+}
+
+// WithNotNull returns a copy of the attribute request that requires the attribute to be non-empty.
+func (ar AttributeRequest) WithNotNull() AttributeRequest {
+	ar.NotNull = true
+	return ar
+}
+
+// With adds a disjunction requiring all of the attributes.
+func (b *ConDisConBuilder) With(attrs ...AttributeRequest) *ConDisConBuilder {
+	if len(attrs) == 0 {
+		b.fail(errors.New("With() requires at least one attribute"))
+		return b
+	}
+	return b.add(AttributeDisCon{And(attrs...)})
+}
+
+// Or adds a disjunction requiring any one of the conjunctions.
+func (b *ConDisConBuilder) Or(cons ...AttributeCon) *ConDisConBuilder {
+	if len(cons) == 0 {
+		b.fail(errors.New("Or() requires at least one conjunction"))
+		return b
+	}
+	for _, con := range cons {
+		if len(con) == 0 {
+			b.fail(errors.New("Or() does not accept empty conjunctions, use Optional() instead"))
+			return b
+		}
+	}
+	return b.add(AttributeDisCon(cons))
+}
+
+// Optional adds a disjunction of the conjunctions that the user may also choose not to satisfy,
+// by preceding them with an empty conjunction.
+func (b *ConDisConBuilder) Optional(cons ...AttributeCon) *ConDisConBuilder {
+	if b.Or(cons...).err != nil {
+		return b
+	}
+	discon := b.cdc[len(b.cdc)-1]
+	b.cdc[len(b.cdc)-1] = append(AttributeDisCon{AttributeCon{}}, discon...)
+	return b
+}
+
+func (b *ConDisConBuilder) add(discon AttributeDisCon) *ConDisConBuilder {
+	if b.err != nil {
+		return b
+	}
+	if err := discon.Validate(); err != nil {
+		b.fail(errors.WrapPrefix(err, "invalid disjunction", 0))
+		return b
+	}
+	b.cdc = append(b.cdc, discon)
+	return b
+}
+
+func (b *ConDisConBuilder) fail(err error) {
+	if b.err == nil {
+		b.err = err
+	}
+}
+
+// Build returns the constructed AttributeConDisCon, or the first error encountered while
+// constructing it.
+func (b *ConDisConBuilder) Build() (AttributeConDisCon, error) {
+	if b.err != nil {
+		return nil, b.err
+	}
+	if len(b.cdc) == 0 {
+		return nil, errors.New("no disjunctions added")
+	}
+	return b.cdc, nil
+}
+
+// BuildFor returns the constructed AttributeConDisCon like Build(), after validating it against
+// the configuration: the requested attribute and credential types must exist, the required values
+// must be valid for the datatypes of the attributes, and each conjunction must contain at most one
+// non-singleton credential type.
+func (b *ConDisConBuilder) BuildFor(conf *Configuration) (AttributeConDisCon, error) {
+	cdc, err := b.Build()
+	if err != nil {
+		return nil, err
+	}
+	err = cdc.Iterate(func(attr *AttributeRequest) error {
+		credid := attr.Type.CredentialTypeIdentifier()
+		if !conf.ContainsCredentialType(credid) {
+			return errors.Errorf("unknown credential type %s", credid)
+		}
+		if attr.Type.IsCredential() {
+			if attr.Value != nil {
+				return errors.Errorf("cannot require a value for credential type %s", credid)
+			}
+			return nil
+		}
+		if attr.Type.IsMetadataAttribute() {
+			if attr.Value != nil {
+				if err := AttributeDataTypeDate.Validate(*attr.Value); err != nil {
+					return errors.WrapPrefix(err, "invalid value for "+attr.Type.String(), 0)
+				}
+			}
+			return nil
+		}
+		if !conf.ContainsAttributeType(attr.Type) {
+			return errors.Errorf("unknown attribute type %s", attr.Type)
+		}
+		if attr.Value != nil {
+			if err := conf.AttributeTypes[attr.Type].DataType.Validate(*attr.Value); err != nil {
+				return errors.WrapPrefix(err, "invalid value for "+attr.Type.String(), 0)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err = cdc.Validate(conf); err != nil {
+		return nil, err
+	}
+	return cdc, nil
+}
@@ -0,0 +1,119 @@
+package irma
+
+import (
+	"math/big"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// AttributeDataType is the datatype of the values of an attribute type, as declared in its
+// credential type description with the type XML attribute. Attribute values are always encoded
+// as strings; the datatype specifies the format of the string and how to parse it.
+type AttributeDataType string
+
+const (
+	AttributeDataTypeString  AttributeDataType = ""        // Any string (default)
+	AttributeDataTypeDate    AttributeDataType = "date"    // A date in the format yyyy-MM-dd
+	AttributeDataTypeInteger AttributeDataType = "integer" // An integer in decimal notation, of arbitrary size
+	AttributeDataTypeBoolean AttributeDataType = "boolean" // Either "true" or "false"
+)
+
+// AttributeDateLayout is the layout of the values of date attributes as issued.
+const AttributeDateLayout = "2006-01-02"
+
+// Date layouts that are also accepted when parsing the values of date attributes, as these occur
+// in credentials that were issued before the attribute type declared its datatype.
+var attributeDateLayouts = []string{AttributeDateLayout, "02-01-2006", "2006/01/02", "02/01/2006"}
+
+// Known reports whether the datatype is one of the datatypes defined above.
+func (t AttributeDataType) Known() bool {
+	switch t {
+	case AttributeDataTypeString, AttributeDataTypeDate, AttributeDataTypeInteger, AttributeDataTypeBoolean:
+		return true
+	default:
+		return false
+	}
+}
+
+// Validate checks that the value is in the format of the datatype in which it must be issued.
+func (t AttributeDataType) Validate(value string) error {
+	var err error
+	switch t {
+	case AttributeDataTypeDate:
+		_, err = time.Parse(AttributeDateLayout, value)
+	case AttributeDataTypeInteger:
+		if _, ok := new(big.Int).SetString(value, 10); !ok {
+			err = errors.Errorf("%s is not an integer", value)
+		}
+	case AttributeDataTypeBoolean:
+		if value != "true" && value != "false" {
+			err = errors.Errorf("%s is not true or false", value)
+		}
+	case AttributeDataTypeString:
+	default:
+		err = errors.Errorf("unknown attribute datatype %s", t)
+	}
+	if err != nil {
+		return errors.WrapPrefix(err, "invalid "+string(t)+" attribute value", 0)
+	}
+	return nil
+}
+
+// Parse parses the value according to the datatype, returning a time.Time for dates, a *big.Int
+// for integers, a bool for booleans, and the value itself for strings. For dates and booleans,
+// some formats other than the one enforced at issuance are accepted as well.
+func (t AttributeDataType) Parse(value string) (interface{}, error) {
+	switch t {
+	case AttributeDataTypeString:
+		return value, nil
+	case AttributeDataTypeDate:
+		for _, layout := range attributeDateLayouts {
+			if date, err := time.Parse(layout, value); err == nil {
+				return date, nil
+			}
+		}
+		return nil, errors.Errorf("invalid date attribute value %s", value)
+	case AttributeDataTypeInteger:
+		i, ok := new(big.Int).SetString(value, 10)
+		if !ok {
+			return nil, errors.Errorf("invalid integer attribute value %s", value)
+		}
+		return i, nil
+	case AttributeDataTypeBoolean:
+		switch strings.ToLower(value) {
+		case "true", "yes":
+			return true, nil
+		case "false", "no":
+			return false, nil
+		}
+		return nil, errors.Errorf("invalid boolean attribute value %s", value)
+	default:
+		return nil, errors.Errorf("unknown attribute datatype %s", t)
+	}
+}
+
+// TypedValue returns the value of the disclosed attribute parsed according to the datatype of its
+// attribute type (see AttributeDataType.Parse), or nil if the attribute was not disclosed.
+func (da *DisclosedAttribute) TypedValue() (interface{}, error) {
+	if da.RawValue == nil {
+		return nil, nil
+	}
+	return da.DataType.Parse(*da.RawValue)
+}
+
+// DateValue returns the value of the disclosed date attribute.
+func (da *DisclosedAttribute) DateValue() (time.Time, error) {
+	if da.DataType != AttributeDataTypeDate {
+		return time.Time{}, errors.Errorf("attribute %s is not a date attribute", da.Identifier)
+	}
+	if da.RawValue == nil {
+		return time.Time{}, errors.Errorf("attribute %s was not disclosed", da.Identifier)
+	}
+	date, err := da.DataType.Parse(*da.RawValue)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return date.(time.Time), nil
+}
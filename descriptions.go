@@ -7,6 +7,7 @@ import (
 	"regexp"
 	"sort"
 	"strings"
+	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/irmago/internal/common"
@@ -28,6 +29,7 @@ type SchemeManager struct {
 	KeyshareWebsite   string
 	KeyshareAttribute string
 	TimestampServer   string
+	TSA               *SchemeTSA
 	Languages         []string `xml:"Languages>Language"`
 	XMLVersion        int      `xml:"version,attr"`
 	XMLName           xml.Name `xml:"SchemeManager"`
@@ -78,6 +80,10 @@ type CredentialType struct {
 	IsULIssueURL bool              `xml:"IsULIssueURL"`
 
 	DeprecatedSince Timestamp
+	// After this date, IRMA servers refuse to issue or verify the credential type, unless overridden
+	SunsetDate Timestamp
+	// Credential type replacing this credential type, to which users and requestors should migrate
+	ReplacedBy *CredentialTypeIdentifier `xml:"ReplacedBy"`
 
 	Dependencies CredentialDependencies
 
@@ -103,6 +109,8 @@ type AttributeType struct {
 
 	RandomBlind bool `xml:"randomblind,attr,omitempty" json:",omitempty"`
 
+	DataType AttributeDataType `xml:"type,attr" json:",omitempty"`
+
 	Index        int    `xml:"-"`
 	DisplayIndex *int   `xml:"displayIndex,attr" json:",omitempty"`
 	DisplayHint  string `xml:"displayHint,attr"  json:",omitempty"`
@@ -648,6 +656,16 @@ func (ct *CredentialType) RandomBlindAttributeNames() []string {
 	return ct.attributeTypeIdentifiers(ct.RandomBlindAttributeIndices())
 }
 
+// IsDeprecated returns whether the credential type is deprecated (or sunset) at the specified time.
+func (ct *CredentialType) IsDeprecated(now time.Time) bool {
+	return (!ct.DeprecatedSince.IsZero() && !ct.DeprecatedSince.After(Timestamp(now))) || ct.IsSunset(now)
+}
+
+// IsSunset returns whether the sunset date of the credential type has passed at the specified time.
+func (ct *CredentialType) IsSunset(now time.Time) bool {
+	return !ct.SunsetDate.IsZero() && !ct.SunsetDate.After(Timestamp(now))
+}
+
 func (ct *CredentialType) RevocationSupported() bool {
 	return len(ct.RevocationServers) > 0
 }
@@ -0,0 +1,87 @@
+package irma
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+// Seeds of the fuzz targets below. Besides these, inputs that caused failures are stored by
+// go test in testdata/fuzz, and are run along with the seeds on each go test.
+var (
+	fuzzSessionRequestSeeds = []string{
+		`{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"MtILupG0g0J23GNR1YtupQ==","disclose":[[["irma-demo.MijnOverheid.ageLimits.over18","irma-demo.MijnOverheid.ageLimits.over21"]],[[{"type":"irma-demo.MijnOverheid.fullName.firstname","value":"hello"}]]],"labels":{"0":{"en":"Age limit","nl":"Age limit"}}}`,
+		`{"@context":"https://irma.app/ld/request/signature/v2","context":"AQ==","nonce":"MtILupG0g0J23GNR1YtupQ==","message":"message to be signed","disclose":[[["irma-demo.MijnOverheid.ageLimits.over18"]]]}`,
+		`{"@context":"https://irma.app/ld/request/issuance/v2","context":"AQ==","nonce":"wrmq+QY8r86nbGTI+mMAzg==","credentials":[{"validity":2000000000,"keyCounter":2,"credential":"irma-demo.RU.studentCard","attributes":{"level":"42","studentCardNumber":"31415927","studentID":"s1234567","university":"Radboud"}}],"disclose":[[[{"type":"test.test.email.email","value":"example@example.com"}]]]}`,
+		`{"type":"disclosing","content":[{"label":"Age limit","attributes":["irma-demo.MijnOverheid.ageLimits.over18"]}]}`,
+	}
+	fuzzDisclosureSeeds = []string{
+		`{"proofs":[],"indices":[]}`,
+		`{"proofs":[{"c":"1","A":"2","e_response":"3","v_response":"4","a_responses":{"0":"5"},"a_disclosed":{"1":"6","2":"7"}}],"indices":[[{"cred":0,"attr":2}]]}`,
+	}
+	fuzzIssueCommitmentSeeds = []string{
+		`{"n_2":"1","combinedProofs":[]}`,
+		`{"U":"1","n_2":"2","combinedProofs":[{"U":"3","c":"4","v_prime_response":"5","s_response":"6"}],"proofPJwts":{"test":"jwt"},"indices":[[{"cred":0,"attr":2}]]}`,
+	}
+	fuzzQrSeeds = []string{
+		`{"u":"https://example.com/irma/session/1234","irmaqr":"disclosing"}`,
+		`{"u":"https://example.com/irma/session/1234","irmaqr":"redirect","jwt":"abc"}`,
+	}
+	fuzzProtocolVersionSeeds = []string{`"2.8"`, `2.8`, `"1"`, `"a.b"`}
+)
+
+func FuzzUnmarshalDisclosureRequest(f *testing.F) {
+	fuzzUnmarshal(f, fuzzSessionRequestSeeds, func() interface{} { return &DisclosureRequest{} })
+}
+
+func FuzzUnmarshalSignatureRequest(f *testing.F) {
+	fuzzUnmarshal(f, fuzzSessionRequestSeeds, func() interface{} { return &SignatureRequest{} })
+}
+
+func FuzzUnmarshalIssuanceRequest(f *testing.F) {
+	fuzzUnmarshal(f, fuzzSessionRequestSeeds, func() interface{} { return &IssuanceRequest{} })
+}
+
+func FuzzUnmarshalDisclosure(f *testing.F) {
+	fuzzUnmarshal(f, fuzzDisclosureSeeds, func() interface{} { return &Disclosure{} })
+}
+
+func FuzzUnmarshalIssueCommitmentMessage(f *testing.F) {
+	fuzzUnmarshal(f, fuzzIssueCommitmentSeeds, func() interface{} { return &IssueCommitmentMessage{} })
+}
+
+func FuzzUnmarshalQr(f *testing.F) {
+	fuzzUnmarshal(f, fuzzQrSeeds, func() interface{} { return &Qr{} })
+}
+
+func FuzzUnmarshalProtocolVersion(f *testing.F) {
+	fuzzUnmarshal(f, fuzzProtocolVersionSeeds, func() interface{} { return &ProtocolVersion{} })
+}
+
+// fuzzUnmarshal fuzzes UnmarshalValidate and UnmarshalValidateBinary into fresh instances of
+// a message type, seeded with the JSON seeds and their binary (CBOR) encodings. Messages that
+// are parsed successfully must be marshalable again.
+func fuzzUnmarshal(f *testing.F, seeds []string, newMessage func() interface{}) {
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+		msg := newMessage()
+		if err := json.Unmarshal([]byte(seed), msg); err != nil {
+			continue
+		}
+		if bts, err := MarshalBinary(msg); err == nil {
+			f.Add(bts)
+		}
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		if msg := newMessage(); UnmarshalValidate(data, msg) == nil {
+			if _, err := json.Marshal(msg); err != nil {
+				t.Fatalf("failed to marshal parsed message to JSON: %v", err)
+			}
+		}
+		if msg := newMessage(); UnmarshalValidateBinary(data, msg) == nil {
+			if _, err := MarshalBinary(msg); err != nil {
+				t.Fatalf("failed to marshal parsed message to binary: %v", err)
+			}
+		}
+	})
+}
@@ -206,6 +206,24 @@ func (id AttributeTypeIdentifier) IsCredential() bool {
 	return strings.Count(id.String(), ".") == 2
 }
 
+// Names of the pseudo-attributes with which the expiry and issuance date of a credential, which
+// are contained in its metadata attribute, can be requested and disclosed like other attributes
+// (e.g. irma-demo.RU.studentCard.@expiry). Their values are dates (see AttributeDataTypeDate).
+const (
+	MetadataAttributeExpiry       = "@expiry"
+	MetadataAttributeIssuanceDate = "@issuancedate"
+)
+
+// IsMetadataAttribute returns true if this attribute is a pseudo-attribute of the metadata of its
+// containing credential (see MetadataAttributeExpiry and MetadataAttributeIssuanceDate).
+func (id AttributeTypeIdentifier) IsMetadataAttribute() bool {
+	if strings.Count(id.String(), ".") != 3 {
+		return false
+	}
+	name := id.Name()
+	return name == MetadataAttributeExpiry || name == MetadataAttributeIssuanceDate
+}
+
 // CredentialIdentifier returns the credential identifier of this attribute.
 func (ai *AttributeIdentifier) CredentialIdentifier() CredentialIdentifier {
 	return CredentialIdentifier{Type: ai.Type.CredentialTypeIdentifier(), Hash: ai.CredentialHash}
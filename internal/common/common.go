@@ -9,6 +9,7 @@ import (
 	"fmt"
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
 	"github.com/sirupsen/logrus"
 	"io"
 	"os"
@@ -27,9 +28,12 @@ var ForceHTTPS = true
 const (
 	AlphanumericChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
 	NumericChars      = "0123456789"
+	// Characters used in codes that users read and compare, omitting easily confused ones (e.g. 0 and O)
+	BindingCodeChars = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
 
 	sessionTokenLength = 20 // duplicated in SessionTokenRegex as strconv.Itoa cannot be used in const block
 	pairingCodeLength  = 4
+	bindingCodeLength  = 6
 
 	SessionTokenRegex = "[" + AlphanumericChars + "]{20}"
 )
@@ -270,26 +274,61 @@ func WalkDir(path string, handler func(string, os.FileInfo) error) error {
 }
 
 func RandomBigInt(limit *big.Int) *big.Int {
-	res, err := big.RandInt(rand.Reader, limit)
+	return RandomBigIntFrom(rand.Reader, limit)
+}
+
+// RandomBigIntFrom returns a random integer in [0, limit) using the randomness read from r.
+func RandomBigIntFrom(r io.Reader, limit *big.Int) *big.Int {
+	res, err := big.RandInt(r, limit)
 	if err != nil {
 		panic(fmt.Sprintf("big.RandInt failed: %v", err))
 	}
 	return res
 }
 
+// NewNonce returns a session nonce like gabi.GenerateNonce, using the randomness read from r.
+func NewNonce(r io.Reader) *big.Int {
+	return RandomBigIntFrom(r, new(big.Int).Lsh(big.NewInt(1), gabikeys.DefaultSystemParameters[2048].Lstatzk))
+}
+
 type SSECtx struct {
 	Component, Arg string
 }
 
-func NewSessionToken() string {
-	return NewRandomString(sessionTokenLength, AlphanumericChars)
+func NewSessionToken() (string, error) {
+	return NewSessionTokenFrom(rand.Reader)
+}
+
+func NewPairingCode() (string, error) {
+	return NewPairingCodeFrom(rand.Reader)
+}
+
+func NewBindingCode() (string, error) {
+	return NewBindingCodeFrom(rand.Reader)
+}
+
+func NewRandomString(count int, characterSet string) (string, error) {
+	return NewRandomStringFrom(rand.Reader, count, characterSet)
+}
+
+// NewSessionTokenFrom is like NewSessionToken, but uses the randomness read from r.
+func NewSessionTokenFrom(r io.Reader) (string, error) {
+	return NewRandomStringFrom(r, sessionTokenLength, AlphanumericChars)
+}
+
+// NewPairingCodeFrom is like NewPairingCode, but uses the randomness read from r.
+func NewPairingCodeFrom(r io.Reader) (string, error) {
+	return NewRandomStringFrom(r, pairingCodeLength, NumericChars)
 }
 
-func NewPairingCode() string {
-	return NewRandomString(pairingCodeLength, NumericChars)
+// NewBindingCodeFrom is like NewBindingCode, but uses the randomness read from r.
+func NewBindingCodeFrom(r io.Reader) (string, error) {
+	return NewRandomStringFrom(r, bindingCodeLength, BindingCodeChars)
 }
 
-func NewRandomString(count int, characterSet string) string {
+// NewRandomStringFrom is like NewRandomString, but uses the randomness read from r instead of
+// crypto/rand (e.g. to make tests reproducible). It returns an error if reading from r fails.
+func NewRandomStringFrom(r io.Reader, count int, characterSet string) (string, error) {
 	// We read bytes (0-255) from the secure random number generator.
 	// If the character set length is smaller than and not a divider of 256, we should only consider the random numbers
 	// smaller than the character set length minus the remainder after division. This ensures an even distribution.
@@ -302,9 +341,9 @@ func NewRandomString(count int, characterSet string) string {
 	i := 0
 	for bufferIndex := 0; i < len(b); bufferIndex = (bufferIndex + 1) % len(randomnessBuffer) {
 		if bufferIndex == 0 {
-			_, err := rand.Read(randomnessBuffer)
+			_, err := io.ReadFull(r, randomnessBuffer)
 			if err != nil {
-				panic(err)
+				return "", errors.WrapPrefix(err, "failed to read randomness", 0)
 			}
 		}
 		byteValue := randomnessBuffer[bufferIndex]
@@ -316,7 +355,7 @@ func NewRandomString(count int, characterSet string) string {
 			i++
 		}
 	}
-	return string(b)
+	return string(b), nil
 }
 
 func IsIrmaconfDir(dir string) (bool, error) {
@@ -62,3 +62,14 @@ func (cm ConcMap[K, V]) Iterate(f func(K, V)) {
 		f(key, val)
 	}
 }
+
+// Clone returns a new map containing the same elements, that can be modified independently.
+func (cm ConcMap[K, V]) Clone() ConcMap[K, V] {
+	cm.RLock()
+	defer cm.RUnlock()
+	clone := New[K, V]()
+	for key, val := range cm.m {
+		clone.m[key] = val
+	}
+	return clone
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/rsa"
 	"sync"
 
+	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
 	irma "github.com/privacybydesign/irmago"
@@ -31,8 +32,13 @@ type (
 		jwtIssuer    string
 		jwtPinExpiry int
 
+		pinHashParameters PinHashParameters
+
+		// Holds the second shares of keyshare secrets, if configured
+		cosigner Cosigner
+
 		// Commit values generated in first step of keyshare protocol
-		commitmentData  map[uint64]*big.Int
+		commitmentData  map[uint64]*commitment
 		commitmentMutex sync.Mutex
 
 		// authorization challenges
@@ -55,13 +61,30 @@ type (
 
 		JWTIssuer    string
 		JWTPinExpiry int // in seconds
+
+		// Parameters with which PINs are hashed (PinHashParametersDefault if zero). The PIN hashes
+		// of existing users are upgraded to these parameters when they next enter their PIN.
+		PinHashParameters PinHashParameters
+
+		// If set, the keyshare secrets of new users are split between this keyshare server and
+		// the cosigner (see cosigner.go)
+		Cosigner Cosigner
+	}
+
+	// commitment contains the randomizer generated in the first step of the keyshare protocol, and
+	// for users whose keyshare secret is split, the commitments of the cosigner per public key and
+	// the identifier of its randomizer.
+	commitment struct {
+		randomizer          *big.Int
+		cosignerCommitID    uint64
+		cosignerCommitments map[irma.PublicKeyIdentifier]*gabi.ProofPCommitment
 	}
 )
 
 func NewKeyshareCore(conf *Configuration) *Core {
 	c := &Core{
 		decryptionKeys: map[uint32]AESKey{},
-		commitmentData: map[uint64]*big.Int{},
+		commitmentData: map[uint64]*commitment{},
 		trustedKeys:    map[irma.PublicKeyIdentifier]*gabikeys.PublicKey{},
 		authChallenges: map[string][]byte{},
 	}
@@ -77,6 +100,11 @@ func NewKeyshareCore(conf *Configuration) *Core {
 	if c.jwtPinExpiry == 0 {
 		c.jwtPinExpiry = JWTPinExpiryDefault
 	}
+	c.cosigner = conf.Cosigner
+	c.pinHashParameters = conf.PinHashParameters
+	if c.pinHashParameters == (PinHashParameters{}) {
+		c.pinHashParameters = PinHashParametersDefault
+	}
 
 	return c
 }
@@ -108,6 +136,11 @@ func (c *Core) setJWTPrivateKey(id uint32, key *rsa.PrivateKey) {
 	c.jwtPrivateKeyID = id
 }
 
+// JWTPublicKey returns the ID and public key of the key used to sign keyshare protocol messages.
+func (c *Core) JWTPublicKey() (uint32, *rsa.PublicKey) {
+	return c.jwtPrivateKeyID, &c.jwtPrivateKey.PublicKey
+}
+
 // DangerousAddTrustedPublicKey adds a public key as trusted by keysharecore.
 // Calling this on incorrectly generated key material WILL compromise keyshare secrets!
 func (c *Core) DangerousAddTrustedPublicKey(keyID irma.PublicKeyIdentifier, key *gabikeys.PublicKey) {
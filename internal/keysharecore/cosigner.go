@@ -0,0 +1,395 @@
+package keysharecore
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/binary"
+	"time"
+
+	"github.com/fxamacker/cbor"
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/gabi/signed"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+type (
+	// Cosigner holds the second shares of the keyshare secrets of users, and computes their
+	// contributions to the keyshare protocol. If configured, the keyshare secret of each new user
+	// having a device key is the sum of a share kept in the user secrets and a share of the cosigner,
+	// whose contributions the keyshare server aggregates into its own. The cosigner does not trust the
+	// keyshare server to have authenticated the user: each share contains the public key of the
+	// user's device, and the cosigner only contributes using an access token that it hands out after
+	// the device signed a challenge of the cosigner (see irma.KeyshareCosignerAuthClaims).
+	Cosigner interface {
+		// NewShare generates a new share of a keyshare secret, bound to the public key of the user's device.
+		NewShare(pk *ecdsa.PublicKey) (CosignerShare, error)
+		// Challenge returns a new challenge for the user to sign with the key of the share.
+		Challenge(share CosignerShare) ([]byte, error)
+		// Authorize verifies the user's signature over the last challenge of the share, contained in
+		// a JWT with irma.KeyshareCosignerAuthClaims, and returns an access token for the share.
+		Authorize(share CosignerShare, jwt string) (string, error)
+		// Ps returns R_0^share for each of the specified public keys.
+		Ps(share CosignerShare, token string, keyIDs []irma.PublicKeyIdentifier) ([]*big.Int, error)
+		// Commitments returns the P and commitment of the share for each of the specified public
+		// keys, along with an identifier of the randomizer, to be passed to Response().
+		Commitments(share CosignerShare, token string, keyIDs []irma.PublicKeyIdentifier) ([]*gabi.ProofPCommitment, uint64, error)
+		// Response returns randomizer + challenge*share.
+		Response(share CosignerShare, token string, commitID uint64, challenge *big.Int) (*big.Int, error)
+	}
+
+	// CosignerShare is a share of a keyshare secret, encrypted with the storage key of the cosigner.
+	// The keyshare server stores it in the user secrets and sends it along with each request to the
+	// cosigner, which stores nothing itself.
+	CosignerShare []byte
+
+	unencryptedCosignerShare struct {
+		Secret    []byte
+		ID        []byte
+		PublicKey []byte
+	}
+)
+
+var (
+	ErrInvalidCosignerShare = errors.New("invalid cosigner share")
+	ErrNoCosigner           = errors.New("keyshare secret is split with a cosigner, but no cosigner is configured")
+)
+
+// Additional data with which cosigner shares are encrypted, so that they cannot be confused with
+// user secrets encrypted with the same storage key.
+var cosignerShareAdditionalData = []byte("cosigner share")
+
+// newKeyshareSecretShare generates a share of a keyshare secret. As the keyshare secret is the sum of
+// two shares, each is one bit shorter than keyshare secrets generated by gabi.NewKeyshareSecret().
+func newKeyshareSecretShare() *big.Int {
+	return common.RandomBigInt(new(big.Int).Lsh(big.NewInt(1), gabikeys.DefaultSystemParameters[1024].Lm-2))
+}
+
+// NewCosignerShare generates a new share of a keyshare secret, for use by a cosigner, bound to the
+// public key of the user's device.
+func (c *Core) NewCosignerShare(pk *ecdsa.PublicKey) (CosignerShare, error) {
+	if pk == nil {
+		return nil, ErrKeyNotFound
+	}
+	pkBts, err := signed.MarshalPublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	id := make([]byte, 32)
+	if _, err = rand.Read(id); err != nil {
+		return nil, err
+	}
+	bts, err := cbor.Marshal(unencryptedCosignerShare{
+		Secret:    newKeyshareSecretShare().Bytes(),
+		ID:        id,
+		PublicKey: pkBts,
+	}, cbor.EncOptions{})
+	if err != nil {
+		return nil, err
+	}
+
+	share := make(CosignerShare, 16, 256)
+	binary.LittleEndian.PutUint32(share[0:], c.decryptionKeyID)
+	if _, err = rand.Read(share[4:16]); err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(c.decryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return gcm.Seal(share[:16], share[4:16], bts, cosignerShareAdditionalData), nil
+}
+
+func (c *Core) decryptCosignerShare(share CosignerShare) (unencryptedCosignerShare, error) {
+	if len(share) < 16 {
+		return unencryptedCosignerShare{}, ErrInvalidCosignerShare
+	}
+	key, ok := c.decryptionKeys[binary.LittleEndian.Uint32(share[0:])]
+	if !ok {
+		return unencryptedCosignerShare{}, ErrNoSuchKey
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return unencryptedCosignerShare{}, err
+	}
+	bts, err := gcm.Open(nil, share[4:16], share[16:], cosignerShareAdditionalData)
+	if err != nil {
+		return unencryptedCosignerShare{}, ErrInvalidCosignerShare
+	}
+	var s unencryptedCosignerShare
+	if err = cbor.Unmarshal(bts, &s); err != nil || len(s.ID) == 0 || len(s.PublicKey) == 0 {
+		return unencryptedCosignerShare{}, ErrInvalidCosignerShare
+	}
+	return s, nil
+}
+
+// CosignerChallenge generates a challenge that the user must sign with the key of the share, for
+// CosignerAuthorize(). Only the last challenge of each share is valid.
+func (c *Core) CosignerChallenge(share CosignerShare) ([]byte, error) {
+	s, err := c.decryptCosignerShare(share)
+	if err != nil {
+		return nil, err
+	}
+	challenge := make([]byte, 32)
+	if _, err = rand.Read(challenge); err != nil {
+		return nil, err
+	}
+	c.authChallengesMutex.Lock()
+	defer c.authChallengesMutex.Unlock()
+	c.authChallenges[string(s.ID)] = challenge
+	return challenge, nil
+}
+
+// CosignerAuthorize checks that the JWT is signed with the key of the share over the last challenge
+// of CosignerChallenge(), and returns an access token for the other cosigner operations on the share.
+func (c *Core) CosignerAuthorize(share CosignerShare, jwtt string) (string, error) {
+	s, err := c.decryptCosignerShare(share)
+	if err != nil {
+		return "", err
+	}
+	challenge := c.consumeChallenge(s.ID)
+	if challenge == nil {
+		return "", ErrChallengeResponseRequired
+	}
+	pk, err := signed.UnmarshalPublicKey(s.PublicKey)
+	if err != nil {
+		return "", ErrInvalidCosignerShare
+	}
+
+	claims := &irma.KeyshareCosignerAuthClaims{}
+	_, err = jwt.ParseWithClaims(jwtt, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodECDSA); !ok {
+			return nil, ErrInvalidJWT
+		}
+		return pk, nil
+	})
+	if err != nil {
+		return "", ErrInvalidJWT
+	}
+	if subtle.ConstantTimeCompare(challenge, claims.Challenge) != 1 {
+		return "", ErrWrongChallenge
+	}
+
+	t := time.Now()
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"iss":      c.jwtIssuer,
+		"sub":      cosignerTokenSubject,
+		"iat":      t.Unix(),
+		"exp":      t.Add(time.Duration(c.jwtPinExpiry) * time.Second).Unix(),
+		"token_id": base64.StdEncoding.EncodeToString(s.ID),
+	})
+	token.Header["kid"] = c.jwtPrivateKeyID
+	return token.SignedString(c.jwtPrivateKey)
+}
+
+// Subject of the access tokens of CosignerAuthorize(), distinguishing them from the access tokens
+// of the users of the cosigner itself, which are signed with the same key.
+const cosignerTokenSubject = "cosigner_tok"
+
+// verifyCosignerAccess checks that the access token was handed out by CosignerAuthorize() for the
+// share and has not expired, and if so, returns the secret of the share.
+func (c *Core) verifyCosignerAccess(share CosignerShare, token string) (*big.Int, error) {
+	s, err := c.decryptCosignerShare(share)
+	if err != nil {
+		return nil, err
+	}
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(token *jwt.Token) (interface{}, error) {
+		if token.Method != jwt.SigningMethodRS256 {
+			return nil, ErrInvalidJWT
+		}
+		return &c.jwtPrivateKey.PublicKey, nil
+	})
+	if err != nil {
+		return nil, ErrInvalidJWT
+	}
+	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
+		return nil, ErrExpiredJWT
+	}
+	if sub, _ := claims["sub"].(string); sub != cosignerTokenSubject {
+		return nil, ErrInvalidJWT
+	}
+	tokenID, _ := claims["token_id"].(string)
+	if subtle.ConstantTimeCompare([]byte(tokenID), []byte(base64.StdEncoding.EncodeToString(s.ID))) != 1 {
+		return nil, ErrInvalidJWT
+	}
+	return new(big.Int).SetBytes(s.Secret), nil
+}
+
+// CosignerPs computes the contribution of a cosigner to GeneratePs().
+func (c *Core) CosignerPs(share CosignerShare, token string, keyIDs []irma.PublicKeyIdentifier) ([]*big.Int, error) {
+	keys, err := c.publicKeys(keyIDs)
+	if err != nil {
+		return nil, err
+	}
+	secret, err := c.verifyCosignerAccess(share, token)
+	if err != nil {
+		return nil, err
+	}
+	ps := make([]*big.Int, 0, len(keys))
+	for _, key := range keys {
+		ps = append(ps, new(big.Int).Exp(key.R[0], secret, key.N))
+	}
+	return ps, nil
+}
+
+// CosignerCommitments computes the contribution of a cosigner to GenerateCommitments().
+func (c *Core) CosignerCommitments(share CosignerShare, token string, keyIDs []irma.PublicKeyIdentifier) ([]*gabi.ProofPCommitment, uint64, error) {
+	keys, err := c.publicKeys(keyIDs)
+	if err != nil {
+		return nil, 0, err
+	}
+	secret, err := c.verifyCosignerAccess(share, token)
+	if err != nil {
+		return nil, 0, err
+	}
+	randomizer, commitments, err := gabi.NewKeyshareCommitments(secret, keys)
+	if err != nil {
+		return nil, 0, err
+	}
+	commitID, err := c.storeCommitment(&commitment{randomizer: randomizer})
+	if err != nil {
+		return nil, 0, err
+	}
+	return commitments, commitID, nil
+}
+
+// CosignerResponse computes the contribution of a cosigner to the response of the keyshare server.
+func (c *Core) CosignerResponse(share CosignerShare, token string, commitID uint64, challenge *big.Int) (*big.Int, error) {
+	if uint(challenge.BitLen()) > gabikeys.DefaultSystemParameters[1024].Lh || challenge.Sign() < 0 {
+		return nil, ErrInvalidChallenge
+	}
+	secret, err := c.verifyCosignerAccess(share, token)
+	if err != nil {
+		return nil, err
+	}
+	commit, ok := c.consumeCommitment(commitID)
+	if !ok {
+		return nil, ErrUnknownCommit
+	}
+	return new(big.Int).Add(commit.randomizer, new(big.Int).Mul(challenge, secret)), nil
+}
+
+// GenerateCosignerChallenge returns a challenge of the cosigner that the user must sign along with
+// authenticating (see ValidateAuth()), if the keyshare secret of the user is split; otherwise nil.
+func (c *Core) GenerateCosignerChallenge(secrets UserSecrets) ([]byte, error) {
+	s, err := c.decryptUserSecrets(secrets)
+	if err != nil {
+		return nil, err
+	}
+	if s.CosignerShare == nil {
+		return nil, nil
+	}
+	if c.cosigner == nil {
+		return nil, ErrNoCosigner
+	}
+	return c.cosigner.Challenge(s.CosignerShare)
+}
+
+// authorizeCosigner obtains an access token of the cosigner for the share of the user, using the
+// JWT with which the user signed the challenge of GenerateCosignerChallenge().
+func (c *Core) authorizeCosigner(s unencryptedUserSecrets, jwtt string) (string, error) {
+	if s.CosignerShare == nil {
+		return "", nil
+	}
+	if c.cosigner == nil {
+		return "", ErrNoCosigner
+	}
+	if jwtt == "" {
+		return "", ErrChallengeResponseRequired
+	}
+	return c.cosigner.Authorize(s.CosignerShare, jwtt)
+}
+
+// cosignedCommitments adds the contributions of the cosigner to the commitments of the keyshare
+// server, and stores these in the commitment.
+func (c *Core) cosignedCommitments(
+	s unencryptedUserSecrets,
+	cosignerToken string,
+	keyIDs []irma.PublicKeyIdentifier,
+	keys []*gabikeys.PublicKey,
+	commitments []*gabi.ProofPCommitment,
+	commit *commitment,
+) error {
+	if c.cosigner == nil {
+		return ErrNoCosigner
+	}
+	cosignerCommitments, cosignerCommitID, err := c.cosigner.Commitments(s.CosignerShare, cosignerToken, keyIDs)
+	if err != nil {
+		return err
+	}
+	if len(cosignerCommitments) != len(keys) {
+		return errors.New("cosigner returned wrong amount of commitments")
+	}
+	commit.cosignerCommitID = cosignerCommitID
+	commit.cosignerCommitments = make(map[irma.PublicKeyIdentifier]*gabi.ProofPCommitment, len(keys))
+	for i, key := range keys {
+		commit.cosignerCommitments[keyIDs[i]] = cosignerCommitments[i]
+		commitments[i].P = mulMod(commitments[i].P, cosignerCommitments[i].P, key.N)
+		commitments[i].Pcommit = mulMod(commitments[i].Pcommit, cosignerCommitments[i].Pcommit, key.N)
+	}
+	return nil
+}
+
+// cosignedResponseRequest returns a commitment request and response request in which the
+// contributions of the cosigner are added to the commitments of the user, so that passing these
+// to gabi.KeyshareResponse() results in the challenge over the aggregated commitments of the
+// user, the keyshare server and the cosigner.
+func cosignedResponseRequest(
+	commRequest gabi.KeyshareCommitmentRequest,
+	responseRequest gabi.KeyshareResponseRequest[irma.PublicKeyIdentifier],
+	keys map[irma.PublicKeyIdentifier]*gabikeys.PublicKey,
+	commit *commitment,
+) (gabi.KeyshareCommitmentRequest, gabi.KeyshareResponseRequest[irma.PublicKeyIdentifier], error) {
+	// The commitment hash is checked here, as it is computed over the commitments of the user only
+	hash, err := userCommitmentsHash(responseRequest.UserChallengeInput)
+	if err != nil {
+		return gabi.KeyshareCommitmentRequest{}, gabi.KeyshareResponseRequest[irma.PublicKeyIdentifier]{}, err
+	}
+	if subtle.ConstantTimeCompare(hash, commRequest.HashedUserCommitments) != 1 {
+		return gabi.KeyshareCommitmentRequest{}, gabi.KeyshareResponseRequest[irma.PublicKeyIdentifier]{},
+			errors.New("incorrect commitment hash sent in commitment request")
+	}
+
+	input := make([]gabi.KeyshareUserChallengeInput[irma.PublicKeyIdentifier], len(responseRequest.UserChallengeInput))
+	for i, data := range responseRequest.UserChallengeInput {
+		input[i] = data
+		if data.KeyID == nil {
+			continue
+		}
+		key, cosignerCommitment := keys[*data.KeyID], commit.cosignerCommitments[*data.KeyID]
+		if key == nil || cosignerCommitment == nil {
+			return gabi.KeyshareCommitmentRequest{}, gabi.KeyshareResponseRequest[irma.PublicKeyIdentifier]{}, ErrKeyNotFound
+		}
+		input[i].Commitment = mulMod(data.Commitment, cosignerCommitment.Pcommit, key.N)
+	}
+	responseRequest.UserChallengeInput = input
+
+	hash, err = userCommitmentsHash(input)
+	if err != nil {
+		return gabi.KeyshareCommitmentRequest{}, gabi.KeyshareResponseRequest[irma.PublicKeyIdentifier]{}, err
+	}
+	return gabi.KeyshareCommitmentRequest{HashedUserCommitments: hash}, responseRequest, nil
+}
+
+// userCommitmentsHash computes the hash of the user's commitments like gabi does.
+func userCommitmentsHash(input []gabi.KeyshareUserChallengeInput[irma.PublicKeyIdentifier]) ([]byte, error) {
+	bts, err := cbor.Marshal(input, cbor.EncOptions{})
+	if err != nil {
+		return nil, err
+	}
+	h := sha256.Sum256(bts)
+	return h[:], nil
+}
+
+func mulMod(a, b, n *big.Int) *big.Int {
+	r := new(big.Int).Mul(a, b)
+	return r.Mod(r, n)
+}
@@ -0,0 +1,297 @@
+package keysharecore
+
+import (
+	"crypto/ecdsa"
+	"crypto/rand"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// coreCosigner uses a Core as cosigner directly, instead of over HTTP.
+type coreCosigner struct {
+	*Core
+}
+
+func (c coreCosigner) NewShare(pk *ecdsa.PublicKey) (CosignerShare, error) {
+	return c.NewCosignerShare(pk)
+}
+
+func (c coreCosigner) Challenge(share CosignerShare) ([]byte, error) {
+	return c.CosignerChallenge(share)
+}
+
+func (c coreCosigner) Authorize(share CosignerShare, jwt string) (string, error) {
+	return c.CosignerAuthorize(share, jwt)
+}
+
+func (c coreCosigner) Ps(share CosignerShare, token string, keyIDs []irma.PublicKeyIdentifier) ([]*big.Int, error) {
+	return c.CosignerPs(share, token, keyIDs)
+}
+
+func (c coreCosigner) Commitments(share CosignerShare, token string, keyIDs []irma.PublicKeyIdentifier) ([]*gabi.ProofPCommitment, uint64, error) {
+	return c.CosignerCommitments(share, token, keyIDs)
+}
+
+func (c coreCosigner) Response(share CosignerShare, token string, commitID uint64, challenge *big.Int) (*big.Int, error) {
+	return c.CosignerResponse(share, token, commitID, challenge)
+}
+
+func newCosignedCores(t *testing.T) (*Core, *Core) {
+	var key1, key2 AESKey
+	_, err := rand.Read(key1[:])
+	require.NoError(t, err)
+	_, err = rand.Read(key2[:])
+	require.NoError(t, err)
+
+	cosigner := NewKeyshareCore(&Configuration{DecryptionKeyID: 2, DecryptionKey: key2, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+	cosigner.DangerousAddTrustedPublicKey(testKeyID, testPubK1)
+	c := NewKeyshareCore(&Configuration{
+		DecryptionKeyID: 1, DecryptionKey: key1, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey,
+		Cosigner: coreCosigner{cosigner},
+	})
+	c.DangerousAddTrustedPublicKey(testKeyID, testPubK1)
+	return c, cosigner
+}
+
+var testKeyID = irma.PublicKeyIdentifier{Issuer: irma.NewIssuerIdentifier("test"), Counter: 1}
+
+func TestCosignedUserSecrets(t *testing.T) {
+	c, cosigner := newCosignedCores(t)
+	signer := test.NewSigner(t)
+
+	pin := generatePin()
+	secrets, err := c.NewUserSecrets(pin, signerPublicKey(t, signer))
+	require.NoError(t, err)
+	s, err := c.decryptUserSecrets(secrets)
+	require.NoError(t, err)
+	require.NotNil(t, s.CosignerShare)
+
+	// The keyshare server cannot decrypt the share of the cosigner
+	_, err = c.decryptCosignerShare(s.CosignerShare)
+	assert.Error(t, err)
+	share, err := cosigner.decryptCosignerShare(s.CosignerShare)
+	require.NoError(t, err)
+
+	// P is computed over the sum of both shares
+	jwtt, err := validateAuth(t, c, signer, secrets, pin)
+	require.NoError(t, err)
+	ps, err := c.GeneratePs(secrets, jwtt, []irma.PublicKeyIdentifier{testKeyID})
+	require.NoError(t, err)
+	secret := new(big.Int).Add(s.KeyshareSecret, new(big.Int).SetBytes(share.Secret))
+	assert.Equal(t, 0, new(big.Int).Exp(testPubK1.R[0], secret, testPubK1.N).Cmp(ps[0]))
+
+	// Tampered shares are rejected by the cosigner
+	s.CosignerShare[len(s.CosignerShare)-1] ^= 1
+	_, err = cosigner.CosignerChallenge(s.CosignerShare)
+	assert.ErrorIs(t, err, ErrInvalidCosignerShare)
+
+	// Without a cosigner, split keyshare secrets cannot be used
+	c.cosigner = nil
+	_, err = c.GeneratePs(secrets, jwtt, []irma.PublicKeyIdentifier{testKeyID})
+	assert.ErrorIs(t, err, ErrNoCosigner)
+
+	// Keyshare secrets of users without device key, who cannot authorize the cosigner, are not split
+	c, _ = newCosignedCores(t)
+	secrets, err = c.NewUserSecrets(pin, nil)
+	require.NoError(t, err)
+	s, err = c.decryptUserSecrets(secrets)
+	require.NoError(t, err)
+	assert.Nil(t, s.CosignerShare)
+}
+
+func TestCosignerRequiresUserAuthorization(t *testing.T) {
+	c, cosigner := newCosignedCores(t)
+	signer := test.NewSigner(t)
+	keyIDs := []irma.PublicKeyIdentifier{testKeyID}
+
+	pin := generatePin()
+	secrets, err := c.NewUserSecrets(pin, signerPublicKey(t, signer))
+	require.NoError(t, err)
+	s, err := c.decryptUserSecrets(secrets)
+	require.NoError(t, err)
+	share := s.CosignerShare
+
+	// Without a token of the cosigner, the keyshare server obtains no contributions of the cosigner,
+	// also not using its own access tokens (which in this test are signed with the same key)
+	jwtt, err := c.authJWT(&s, "")
+	require.NoError(t, err)
+	for _, token := range []string{"", jwtt} {
+		_, err = cosigner.CosignerPs(share, token, keyIDs)
+		assert.ErrorIs(t, err, ErrInvalidJWT)
+		_, _, err = cosigner.CosignerCommitments(share, token, keyIDs)
+		assert.ErrorIs(t, err, ErrInvalidJWT)
+		_, err = cosigner.CosignerResponse(share, token, 0, big.NewInt(12345))
+		assert.ErrorIs(t, err, ErrInvalidJWT)
+	}
+	_, err = c.GeneratePs(secrets, jwtt, keyIDs)
+	assert.ErrorIs(t, err, ErrInvalidJWT)
+
+	// The cosigner hands out no token without a signature of the user's device over its challenge
+	challenge, err := cosigner.CosignerChallenge(share)
+	require.NoError(t, err)
+	_, err = cosigner.CosignerAuthorize(share, cosignerAuthJWT(t, test.NewSigner(t), challenge))
+	assert.ErrorIs(t, err, ErrInvalidJWT)
+	_, err = cosigner.CosignerAuthorize(share, cosignerAuthJWT(t, signer, challenge))
+	assert.ErrorIs(t, err, ErrChallengeResponseRequired, "challenges are used only once")
+	_, err = cosigner.CosignerChallenge(share)
+	require.NoError(t, err)
+	_, err = cosigner.CosignerAuthorize(share, cosignerAuthJWT(t, signer, challenge))
+	assert.ErrorIs(t, err, ErrWrongChallenge)
+
+	// Authentication at the keyshare server fails without authorizing the cosigner
+	authRequest, err := irmaclient.SignerCreateJWT(signer, "", irma.KeyshareAuthRequestClaims{
+		RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(3 * time.Minute))},
+	})
+	require.NoError(t, err)
+	keyshareChallenge, err := c.GenerateChallenge(secrets, authRequest)
+	require.NoError(t, err)
+	authResponse, err := irmaclient.SignerCreateJWT(signer, "", irma.KeyshareAuthResponseClaims{
+		KeyshareAuthResponseData: irma.KeyshareAuthResponseData{Pin: pin, Challenge: keyshareChallenge},
+	})
+	require.NoError(t, err)
+	_, _, err = c.ValidateAuth(secrets, authResponse)
+	assert.ErrorIs(t, err, ErrChallengeResponseRequired)
+
+	// A token is bound to the share for which the user authorized the cosigner
+	jwtt, err = validateAuth(t, c, signer, secrets, pin)
+	require.NoError(t, err)
+	_, token, err := c.verifyAccessWithCosignerToken(secrets, jwtt)
+	require.NoError(t, err)
+	_, err = cosigner.CosignerPs(share, token, keyIDs)
+	require.NoError(t, err)
+	otherSecrets, err := c.NewUserSecrets(pin, signerPublicKey(t, signer))
+	require.NoError(t, err)
+	other, err := c.decryptUserSecrets(otherSecrets)
+	require.NoError(t, err)
+	_, err = cosigner.CosignerPs(other.CosignerShare, token, keyIDs)
+	assert.ErrorIs(t, err, ErrInvalidJWT)
+}
+
+func TestCosignedProofFunctionality(t *testing.T) {
+	c, _ := newCosignedCores(t)
+
+	signer := test.NewSigner(t)
+	pin := generatePin()
+	secrets, err := c.NewUserSecrets(pin, signerPublicKey(t, signer))
+	require.NoError(t, err)
+	jwtt, err := validateAuth(t, c, signer, secrets, pin)
+	require.NoError(t, err)
+	keyIDs := []irma.PublicKeyIdentifier{testKeyID}
+
+	ps, err := c.GeneratePs(secrets, jwtt, keyIDs)
+	require.NoError(t, err)
+	W, commitID, err := c.GenerateCommitments(secrets, jwtt, keyIDs)
+	require.NoError(t, err)
+	assert.Equal(t, 0, ps[0].Cmp(W[0].P))
+
+	Rjwt, err := c.GenerateResponse(secrets, jwtt, commitID, big.NewInt(12345), testKeyID)
+	require.NoError(t, err)
+	proofP := parseProofP(t, c, Rjwt)
+
+	assert.Equal(t, 0, proofP.P.Cmp(ps[0]))
+	assert.Equal(t, 0, new(big.Int).Exp(testPubK1.R[0], proofP.SResponse, testPubK1.N).Cmp(
+		mulMod(W[0].Pcommit, new(big.Int).Exp(W[0].P, big.NewInt(12345), testPubK1.N), testPubK1.N)), "Crypto result off")
+
+	// The commitment of the cosigner is used only once
+	_, err = c.GenerateResponse(secrets, jwtt, commitID, big.NewInt(12345), testKeyID)
+	assert.ErrorIs(t, err, ErrUnknownCommit)
+}
+
+func TestCosignedProofFunctionalityV2(t *testing.T) {
+	c, _ := newCosignedCores(t)
+	N, R0 := testPubK1.N, testPubK1.R[0]
+
+	signer := test.NewSigner(t)
+	pin := generatePin()
+	secrets, err := c.NewUserSecrets(pin, signerPublicKey(t, signer))
+	require.NoError(t, err)
+	jwtt, err := validateAuth(t, c, signer, secrets, pin)
+	require.NoError(t, err)
+	keyIDs := []irma.PublicKeyIdentifier{testKeyID}
+
+	ps, err := c.GeneratePs(secrets, jwtt, keyIDs)
+	require.NoError(t, err)
+
+	for _, linkable := range []bool{false, true} {
+		W, commitID, err := c.GenerateCommitments(secrets, jwtt, keyIDs)
+		require.NoError(t, err)
+
+		// User side of the protocol
+		userSecret, userRandomizer := common.RandomBigInt(N), common.RandomBigInt(N)
+		userP := new(big.Int).Exp(R0, userSecret, N)
+		keyID := testKeyID
+		input := []gabi.KeyshareUserChallengeInput[irma.PublicKeyIdentifier]{{
+			KeyID:      &keyID,
+			Value:      mulMod(userP, ps[0], N),
+			Commitment: new(big.Int).Exp(R0, userRandomizer, N),
+		}}
+		hash, err := userCommitmentsHash(input)
+		require.NoError(t, err)
+		nonce := big.NewInt(42)
+
+		// Compute the challenge that the verifier computes, over the total commitment
+		totalInput := []gabi.KeyshareUserChallengeInput[irma.PublicKeyIdentifier]{input[0]}
+		totalInput[0].Commitment = mulMod(input[0].Commitment, W[0].Pcommit, N)
+		totalHash, err := userCommitmentsHash(totalInput)
+		require.NoError(t, err)
+		expected, err := gabi.KeyshareResponse(big.NewInt(0), big.NewInt(0),
+			gabi.KeyshareCommitmentRequest{HashedUserCommitments: totalHash},
+			gabi.KeyshareResponseRequest[irma.PublicKeyIdentifier]{
+				Context: big.NewInt(1), Nonce: nonce, UserResponse: big.NewInt(0), UserChallengeInput: totalInput,
+			},
+			map[irma.PublicKeyIdentifier]*gabikeys.PublicKey{testKeyID: testPubK1},
+		)
+		require.NoError(t, err)
+		userResponse := new(big.Int).Add(userRandomizer, new(big.Int).Mul(expected.C, userSecret))
+
+		Rjwt, err := c.GenerateResponseV2(secrets, jwtt, commitID,
+			gabi.KeyshareCommitmentRequest{HashedUserCommitments: hash},
+			gabi.KeyshareResponseRequest[irma.PublicKeyIdentifier]{
+				Context: big.NewInt(1), Nonce: nonce, UserResponse: userResponse, UserChallengeInput: input,
+			},
+			testKeyID, linkable)
+		require.NoError(t, err)
+		proofP := parseProofP(t, c, Rjwt)
+		assert.Equal(t, 0, expected.C.Cmp(proofP.C))
+
+		if linkable {
+			// Only the response and P of the keyshare server and cosigner
+			assert.Equal(t, 0, proofP.P.Cmp(ps[0]))
+			assert.Equal(t, 0, new(big.Int).Exp(R0, proofP.SResponse, N).Cmp(
+				mulMod(W[0].Pcommit, new(big.Int).Exp(ps[0], proofP.C, N), N)))
+		} else {
+			totalP := mulMod(userP, ps[0], N)
+			assert.Equal(t, 0, new(big.Int).Exp(R0, proofP.SResponse, N).Cmp(
+				mulMod(totalInput[0].Commitment, new(big.Int).Exp(totalP, proofP.C, N), N)))
+		}
+	}
+}
+
+func parseProofP(t *testing.T, c *Core, token string) *gabi.ProofP {
+	claims := &struct {
+		jwt.StandardClaims
+		ProofP *gabi.ProofP
+	}{}
+	_, err := jwt.ParseWithClaims(token, claims, func(tok *jwt.Token) (interface{}, error) {
+		return &c.jwtPrivateKey.PublicKey, nil
+	})
+	require.NoError(t, err)
+	return claims.ProofP
+}
+
+func cosignerAuthJWT(t *testing.T, signer irmaclient.Signer, challenge []byte) string {
+	jwtt, err := irmaclient.SignerCreateJWT(signer, "", irma.KeyshareCosignerAuthClaims{Challenge: challenge})
+	require.NoError(t, err)
+	return jwtt
+}
@@ -23,7 +23,7 @@ func (c *Core) ChangePinLegacy(secrets UserSecrets, oldpinRaw, newpinRaw string)
 	if err != nil {
 		return nil, err
 	}
-	if err = s.setPin(newpinRaw); err != nil {
+	if err = c.setPin(&s, newpinRaw); err != nil {
 		return nil, err
 	}
 	if err = s.setID(id); err != nil {
@@ -32,16 +32,17 @@ func (c *Core) ChangePinLegacy(secrets UserSecrets, oldpinRaw, newpinRaw string)
 	return c.encryptUserSecrets(s)
 }
 
-// ValidateAuthLegacy checks pin for validity and generates JWT for future access.
-func (c *Core) ValidateAuthLegacy(secrets UserSecrets, pin string) (string, error) {
+// ValidateAuthLegacy checks pin for validity and generates JWT for future access. Like ValidateAuth(),
+// it also returns the updated user secrets if the PIN hash was upgraded.
+func (c *Core) ValidateAuthLegacy(secrets UserSecrets, pin string) (string, UserSecrets, error) {
 	s, err := c.decryptUserSecretsIfPinOK(secrets, pin)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
 	if s.PublicKey != nil {
-		return "", ErrChallengeResponseRequired
+		return "", nil, ErrChallengeResponseRequired
 	}
 
-	return c.authJWT(&s)
+	return c.authJWTUpgradingPinHash(&s, pin, "")
 }
@@ -0,0 +1,67 @@
+package keysharecore
+
+import (
+	"encoding/binary"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+// MigrationKey is an AES key shared between the operators of two keyshare servers, with which user
+// secrets are encrypted while migrating users from one keyshare server to the other.
+type MigrationKey struct {
+	ID  uint32
+	Key AESKey
+}
+
+var (
+	ErrInvalidMigration = errors.New("invalid migrated user secrets")
+	ErrMigrationExpired = errors.New("migrated user secrets expired")
+)
+
+// ExportUserSecrets returns the user secrets encrypted with the migration key, so that they can be
+// imported by another keyshare server having the same migration key until the expiry. The username
+// and expiry are authenticated along with the secrets, so that they can only be imported under the
+// same username and not after the expiry. Exporting requires a valid access token, i.e. the user must
+// have recently entered their PIN.
+func (c *Core) ExportUserSecrets(secrets UserSecrets, accessToken string, username string, expiry time.Time, key MigrationKey) ([]byte, error) {
+	s, err := c.verifyAccess(secrets, accessToken)
+	if err != nil {
+		return nil, err
+	}
+	return encryptUserSecretsWithData(s, key.ID, key.Key, migrationAdditionalData(username, expiry))
+}
+
+// ImportUserSecrets decrypts user secrets exported by another keyshare server with the migration key
+// for the user with the specified username and expiry, and encrypts them with our current storage key.
+// The PIN and keyshare secret of the user are unchanged, so that the user can keep using their PIN
+// and credentials.
+func (c *Core) ImportUserSecrets(exported []byte, username string, expiry time.Time, key MigrationKey) (UserSecrets, error) {
+	if len(exported) < 16 || binary.LittleEndian.Uint32(exported[0:]) != key.ID {
+		return nil, ErrInvalidMigration
+	}
+	s, err := decryptUserSecretsWithData(exported, key.Key, migrationAdditionalData(username, expiry))
+	if err != nil {
+		return nil, ErrInvalidMigration
+	}
+	if s.KeyshareSecret == nil || s.KeyshareSecret.Sign() == 0 || len(s.Pin) == 0 || len(s.ID) == 0 {
+		return nil, ErrInvalidMigration
+	}
+	if time.Now().After(expiry) {
+		return nil, ErrMigrationExpired
+	}
+	return c.encryptUserSecrets(s)
+}
+
+// VerifyPin checks that the PIN is that of the user secrets, without generating an access token.
+func (c *Core) VerifyPin(secrets UserSecrets, pin string) error {
+	_, err := c.decryptUserSecretsIfPinOK(secrets, pin)
+	return err
+}
+
+// migrationAdditionalData returns the additional data with which the exported user secrets of the
+// user with the specified username are encrypted.
+func migrationAdditionalData(username string, expiry time.Time) []byte {
+	return []byte("migration " + strconv.FormatInt(expiry.Unix(), 10) + " " + username)
+}
@@ -33,10 +33,21 @@ var (
 // GenerateChallenge() (i.e. /users/verify_start) are authenticated.
 const ChallengeJWTMaxExpiry = 6 * time.Minute
 
-// NewUserSecrets generates a new keyshare secret, secured with the given pin.
+// NewUserSecrets generates a new keyshare secret, secured with the given pin. If a cosigner is
+// configured and the user has a device key (with which the user authorizes the cosigner), the
+// keyshare secret is split between this keyshare server and the cosigner.
 func (c *Core) NewUserSecrets(pin string, pk *ecdsa.PublicKey) (UserSecrets, error) {
-	secret, err := gabi.NewKeyshareSecret()
-	if err != nil {
+	var (
+		secret *big.Int
+		share  CosignerShare
+		err    error
+	)
+	if c.cosigner != nil && pk != nil {
+		secret = newKeyshareSecretShare()
+		if share, err = c.cosigner.NewShare(pk); err != nil {
+			return nil, err
+		}
+	} else if secret, err = gabi.NewKeyshareSecret(); err != nil {
 		return nil, err
 	}
 
@@ -48,7 +59,7 @@ func (c *Core) NewUserSecrets(pin string, pk *ecdsa.PublicKey) (UserSecrets, err
 
 	// Build unencrypted secrets
 	var s unencryptedUserSecrets
-	if err = s.setPin(pin); err != nil {
+	if err = c.setPin(&s, pin); err != nil {
 		return nil, err
 	}
 	if err = s.setKeyshareSecret(secret); err != nil {
@@ -58,58 +69,90 @@ func (c *Core) NewUserSecrets(pin string, pk *ecdsa.PublicKey) (UserSecrets, err
 		return nil, err
 	}
 	s.PublicKey = pk
+	s.CosignerShare = share
 
 	// And encrypt
 	return c.encryptUserSecrets(s)
 }
 
-// ValidateAuth checks pin for validity and generates JWT for future access.
-func (c *Core) ValidateAuth(secrets UserSecrets, jwtt string) (string, error) {
+// ValidateAuth checks pin for validity and generates JWT for future access. If the keyshare secret
+// of the user is split, the cosigner is authorized using the cosigner JWT contained in the JWT, and
+// its access token is included in the generated JWT. If the PIN hash of the user was upgraded to the
+// current PinHashParameters, the updated user secrets are returned as well, which must then be
+// stored instead of the old ones; otherwise these are nil.
+func (c *Core) ValidateAuth(secrets UserSecrets, jwtt string) (string, UserSecrets, error) {
 	s, err := c.decryptUserSecrets(secrets)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	pin, err := c.verifyChallengeResponse(s, jwtt)
+	claims, err := c.verifyChallengeResponse(s, jwtt)
 	if err != nil {
-		return "", err
+		return "", nil, err
 	}
 
-	if err = s.verifyPin(pin); err != nil {
-		return "", err
+	if err = s.verifyPin(claims.Pin); err != nil {
+		return "", nil, err
+	}
+
+	cosignerToken, err := c.authorizeCosigner(s, claims.CosignerAuthJWT)
+	if err != nil {
+		return "", nil, err
 	}
 
-	return c.authJWT(&s)
+	return c.authJWTUpgradingPinHash(&s, claims.Pin, cosignerToken)
+}
+
+func (c *Core) authJWTUpgradingPinHash(s *unencryptedUserSecrets, pin, cosignerToken string) (string, UserSecrets, error) {
+	jwtt, err := c.authJWT(s, cosignerToken)
+	if err != nil {
+		return "", nil, err
+	}
+	upgraded, err := c.upgradePinHash(s, pin)
+	if err != nil || !upgraded {
+		return jwtt, nil, err
+	}
+	secrets, err := c.encryptUserSecrets(*s)
+	if err != nil {
+		return "", nil, err
+	}
+	return jwtt, secrets, nil
 }
 
-func (c *Core) authJWT(s *unencryptedUserSecrets) (string, error) {
+// authJWT generates an access token for the user. For users whose keyshare secret is split, it
+// includes the access token of the cosigner, which the user thus passes along with each request.
+func (c *Core) authJWT(s *unencryptedUserSecrets, cosignerToken string) (string, error) {
 	t := time.Now()
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+	claims := jwt.MapClaims{
 		"iss":      c.jwtIssuer,
 		"sub":      "auth_tok",
 		"iat":      t.Unix(),
 		"exp":      t.Add(time.Duration(c.jwtPinExpiry) * time.Second).Unix(),
 		"token_id": base64.StdEncoding.EncodeToString(s.ID),
-	})
+	}
+	if cosignerToken != "" {
+		claims["cosigner_token"] = cosignerToken
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
 	token.Header["kid"] = c.jwtPrivateKeyID
 	return token.SignedString(c.jwtPrivateKey)
 }
 
-func (c *Core) verifyChallengeResponse(s unencryptedUserSecrets, jwtt string) (string, error) {
+func (c *Core) verifyChallengeResponse(s unencryptedUserSecrets, jwtt string) (*irma.KeyshareAuthResponseClaims, error) {
 	challenge := c.consumeChallenge(s.ID)
 	if challenge == nil {
-		return "", ErrChallengeResponseRequired
+		return nil, ErrChallengeResponseRequired
 	}
 
 	claims := &irma.KeyshareAuthResponseClaims{}
 	if _, err := jwt.ParseWithClaims(jwtt, claims, s.publicKey); err != nil {
-		return "", err
+		return nil, err
 	}
 	if subtle.ConstantTimeCompare(challenge, claims.Challenge) != 1 {
-		return "", ErrWrongChallenge
+		return nil, ErrWrongChallenge
 	}
 
-	return claims.Pin, nil
+	return claims, nil
 }
 
 // ValidateJWT checks whether the given JWT is currently valid as an access token for operations
@@ -142,7 +185,7 @@ func (c *Core) ChangePin(secrets UserSecrets, jwtt string) (UserSecrets, error)
 	if err != nil {
 		return nil, err
 	}
-	if err = s.setPin(claims.NewPin); err != nil {
+	if err = c.setPin(&s, claims.NewPin); err != nil {
 		return nil, err
 	}
 	if err = s.setID(id); err != nil {
@@ -154,6 +197,13 @@ func (c *Core) ChangePin(secrets UserSecrets, jwtt string) (UserSecrets, error)
 // verifyAccess checks that a given access jwt is valid, and if so, return decrypted keyshare user secrets.
 // Note: Although this is an internal function, it is tested directly
 func (c *Core) verifyAccess(secrets UserSecrets, jwtToken string) (unencryptedUserSecrets, error) {
+	s, _, err := c.verifyAccessWithCosignerToken(secrets, jwtToken)
+	return s, err
+}
+
+// verifyAccessWithCosignerToken is like verifyAccess(), but also returns the access token of the
+// cosigner included in the access jwt, if any.
+func (c *Core) verifyAccessWithCosignerToken(secrets UserSecrets, jwtToken string) (unencryptedUserSecrets, string, error) {
 	// Verify token validity
 	token, err := jwt.Parse(jwtToken, func(token *jwt.Token) (interface{}, error) {
 		if token.Method != jwt.SigningMethodRS256 {
@@ -163,55 +213,52 @@ func (c *Core) verifyAccess(secrets UserSecrets, jwtToken string) (unencryptedUs
 		return &c.jwtPrivateKey.PublicKey, nil
 	})
 	if err != nil {
-		return unencryptedUserSecrets{}, ErrInvalidJWT
+		return unencryptedUserSecrets{}, "", ErrInvalidJWT
 	}
 
 	claims, ok := token.Claims.(jwt.MapClaims)
 	if !ok || claims.Valid() != nil {
-		return unencryptedUserSecrets{}, ErrInvalidJWT
+		return unencryptedUserSecrets{}, "", ErrInvalidJWT
 	}
 	if !claims.VerifyExpiresAt(time.Now().Unix(), true) {
-		return unencryptedUserSecrets{}, ErrExpiredJWT
+		return unencryptedUserSecrets{}, "", ErrExpiredJWT
 	}
 	if _, present := claims["token_id"]; !present {
-		return unencryptedUserSecrets{}, ErrInvalidJWT
+		return unencryptedUserSecrets{}, "", ErrInvalidJWT
 	}
 	tokenIDB64, ok := claims["token_id"].(string)
 	if !ok {
-		return unencryptedUserSecrets{}, ErrInvalidJWT
+		return unencryptedUserSecrets{}, "", ErrInvalidJWT
 	}
 	tokenID, err := base64.StdEncoding.DecodeString(tokenIDB64)
 	if err != nil {
-		return unencryptedUserSecrets{}, ErrInvalidJWT
+		return unencryptedUserSecrets{}, "", ErrInvalidJWT
 	}
 
 	s, err := c.decryptUserSecrets(secrets)
 	if err != nil {
-		return unencryptedUserSecrets{}, err
+		return unencryptedUserSecrets{}, "", err
 	}
 
 	if subtle.ConstantTimeCompare(s.ID, tokenID) != 1 {
-		return unencryptedUserSecrets{}, ErrInvalidJWT
+		return unencryptedUserSecrets{}, "", ErrInvalidJWT
 	}
 
-	return s, nil
+	cosignerToken, _ := claims["cosigner_token"].(string)
+	return s, cosignerToken, nil
 }
 
 // GeneratePs generates a list of keyshare server P's, i.e. a list of R_0^keyshareSecret.
 func (c *Core) GeneratePs(secrets UserSecrets, accessToken string, keyIDs []irma.PublicKeyIdentifier) ([]*big.Int, error) {
 	// Validate input request and build key list
-	var keyList []*gabikeys.PublicKey
-	for _, keyID := range keyIDs {
-		key, ok := c.trustedKeys[keyID]
-		if !ok {
-			return nil, ErrKeyNotFound
-		}
-		keyList = append(keyList, key)
+	keyList, err := c.publicKeys(keyIDs)
+	if err != nil {
+		return nil, err
 	}
 
 	// Use verifyAccess to get the decrypted secrets. The access has already been verified in the
 	// middleware. We use the call merely to fetch the unencryptedUserSecrets here.
-	s, err := c.verifyAccess(secrets, accessToken)
+	s, cosignerToken, err := c.verifyAccessWithCosignerToken(secrets, accessToken)
 	if err != nil {
 		return nil, err
 	}
@@ -223,24 +270,36 @@ func (c *Core) GeneratePs(secrets UserSecrets, accessToken string, keyIDs []irma
 			new(big.Int).Exp(key.R[0], s.KeyshareSecret, key.N))
 	}
 
+	if s.CosignerShare != nil {
+		if c.cosigner == nil {
+			return nil, ErrNoCosigner
+		}
+		cosignerPs, err := c.cosigner.Ps(s.CosignerShare, cosignerToken, keyIDs)
+		if err != nil {
+			return nil, err
+		}
+		if len(cosignerPs) != len(ps) {
+			return nil, errors.New("cosigner returned wrong amount of Ps")
+		}
+		for i, key := range keyList {
+			ps[i] = mulMod(ps[i], cosignerPs[i], key.N)
+		}
+	}
+
 	return ps, nil
 }
 
 // GenerateCommitments generates keyshare commitments using the specified Idemix public key(s).
 func (c *Core) GenerateCommitments(secrets UserSecrets, accessToken string, keyIDs []irma.PublicKeyIdentifier) ([]*gabi.ProofPCommitment, uint64, error) {
 	// Validate input request and build key list
-	var keyList []*gabikeys.PublicKey
-	for _, keyID := range keyIDs {
-		key, ok := c.trustedKeys[keyID]
-		if !ok {
-			return nil, 0, ErrKeyNotFound
-		}
-		keyList = append(keyList, key)
+	keyList, err := c.publicKeys(keyIDs)
+	if err != nil {
+		return nil, 0, err
 	}
 
 	// Use verifyAccess to get the decrypted secrets. The access has already been verified in the
 	// middleware. We use the call merely to fetch the unencryptedUserSecrets here.
-	s, err := c.verifyAccess(secrets, accessToken)
+	s, cosignerToken, err := c.verifyAccessWithCosignerToken(secrets, accessToken)
 	if err != nil {
 		return nil, 0, err
 	}
@@ -250,20 +309,55 @@ func (c *Core) GenerateCommitments(secrets UserSecrets, accessToken string, keyI
 	if err != nil {
 		return nil, 0, err
 	}
+	commit := &commitment{randomizer: commitSecret}
+	if s.CosignerShare != nil {
+		if err = c.cosignedCommitments(s, cosignerToken, keyIDs, keyList, commitments, commit); err != nil {
+			return nil, 0, err
+		}
+	}
 
-	// Generate commitment id
-	var commitID uint64
-	err = binary.Read(rand.Reader, binary.LittleEndian, &commitID)
+	// Store commit in backing storage
+	commitID, err := c.storeCommitment(commit)
 	if err != nil {
 		return nil, 0, err
 	}
 
-	// Store commit in backing storage
+	return commitments, commitID, nil
+}
+
+// publicKeys returns the trusted public keys having the specified identifiers.
+func (c *Core) publicKeys(keyIDs []irma.PublicKeyIdentifier) ([]*gabikeys.PublicKey, error) {
+	var keyList []*gabikeys.PublicKey
+	for _, keyID := range keyIDs {
+		key, ok := c.trustedKeys[keyID]
+		if !ok {
+			return nil, ErrKeyNotFound
+		}
+		keyList = append(keyList, key)
+	}
+	return keyList, nil
+}
+
+// storeCommitment stores the commitment under a new random identifier, which it returns.
+func (c *Core) storeCommitment(commit *commitment) (uint64, error) {
+	var commitID uint64
+	if err := binary.Read(rand.Reader, binary.LittleEndian, &commitID); err != nil {
+		return 0, err
+	}
 	c.commitmentMutex.Lock()
-	c.commitmentData[commitID] = commitSecret
+	c.commitmentData[commitID] = commit
 	c.commitmentMutex.Unlock()
+	return commitID, nil
+}
 
-	return commitments, commitID, nil
+// consumeCommitment returns and removes the commitment having the specified identifier, so that
+// each commitment is used only once.
+func (c *Core) consumeCommitment(commitID uint64) (*commitment, bool) {
+	c.commitmentMutex.Lock()
+	defer c.commitmentMutex.Unlock()
+	commit, ok := c.commitmentData[commitID]
+	delete(c.commitmentData, commitID)
+	return commit, ok
 }
 
 // GenerateResponse generates the response of a zero-knowledge proof of the keyshare secret, for a given previous commit and challenge.
@@ -279,23 +373,34 @@ func (c *Core) GenerateResponse(secrets UserSecrets, accessToken string, commitI
 
 	// Use verifyAccess to get the decrypted secrets. The access has already been verified in the
 	// middleware. We use the call merely to fetch the unencryptedUserSecrets here.
-	s, err := c.verifyAccess(secrets, accessToken)
+	s, cosignerToken, err := c.verifyAccessWithCosignerToken(secrets, accessToken)
 	if err != nil {
 		return "", err
 	}
 
 	// Fetch commit
-	c.commitmentMutex.Lock()
-	commit, ok := c.commitmentData[commitID]
-	delete(c.commitmentData, commitID)
-	c.commitmentMutex.Unlock()
+	commit, ok := c.consumeCommitment(commitID)
 	if !ok {
 		return "", ErrUnknownCommit
 	}
 
+	proofP := gabi.KeyshareResponseLegacy(s.KeyshareSecret, commit.randomizer, challenge, key)
+	if s.CosignerShare != nil {
+		cosignerCommitment := commit.cosignerCommitments[keyID]
+		if cosignerCommitment == nil {
+			return "", ErrKeyNotFound
+		}
+		cosignerResponse, err := c.cosigner.Response(s.CosignerShare, cosignerToken, commit.cosignerCommitID, challenge)
+		if err != nil {
+			return "", err
+		}
+		proofP.P = mulMod(proofP.P, cosignerCommitment.P, key.N)
+		proofP.SResponse.Add(proofP.SResponse, cosignerResponse)
+	}
+
 	// Generate response
 	token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
-		"ProofP": gabi.KeyshareResponseLegacy(s.KeyshareSecret, commit, challenge, key),
+		"ProofP": proofP,
 		"iat":    time.Now().Unix(),
 		"sub":    "ProofP",
 		"iss":    c.jwtIssuer,
@@ -323,21 +428,25 @@ func (c *Core) GenerateResponseV2(
 
 	// Use verifyAccess to get the decrypted secrets. The access has already been verified in the
 	// middleware. We use the call merely to fetch the unencryptedUserSecrets here.
-	s, err := c.verifyAccess(secrets, accessToken)
+	s, cosignerToken, err := c.verifyAccessWithCosignerToken(secrets, accessToken)
 	if err != nil {
 		return "", err
 	}
 
 	// Fetch commit
-	c.commitmentMutex.Lock()
-	commit, ok := c.commitmentData[commitID]
-	delete(c.commitmentData, commitID)
-	c.commitmentMutex.Unlock()
+	commit, ok := c.consumeCommitment(commitID)
 	if !ok {
 		return "", ErrUnknownCommit
 	}
 
-	proofP, err := gabi.KeyshareResponse(s.KeyshareSecret, commit, hashedComms, req, c.trustedKeys)
+	if s.CosignerShare != nil {
+		hashedComms, req, err = cosignedResponseRequest(hashedComms, req, c.trustedKeys, commit)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	proofP, err := gabi.KeyshareResponse(s.KeyshareSecret, commit.randomizer, hashedComms, req, c.trustedKeys)
 	if err != nil {
 		return "", err
 	}
@@ -346,6 +455,20 @@ func (c *Core) GenerateResponseV2(
 		return "", ErrInvalidChallenge
 	}
 
+	var cosignerP *big.Int
+	if s.CosignerShare != nil {
+		cosignerCommitment := commit.cosignerCommitments[keyID]
+		if cosignerCommitment == nil {
+			return "", ErrKeyNotFound
+		}
+		cosignerResponse, err := c.cosigner.Response(s.CosignerShare, cosignerToken, commit.cosignerCommitID, proofP.C)
+		if err != nil {
+			return "", err
+		}
+		proofP.SResponse.Add(proofP.SResponse, cosignerResponse)
+		cosignerP = cosignerCommitment.P
+	}
+
 	// If the session involves a legacy issuer that doesn't understand the new keyshare protocol,
 	// return a legacy ProofP of the old keyshare protocol, differing as follows to a normal ProofP:
 	// - Includes P = R_0^userSecret in the Proof.P field (making the ProofP linkable)
@@ -353,6 +476,9 @@ func (c *Core) GenerateResponseV2(
 	//   as done by added earlier in `gabi.KeyshareResponse()` above, so we subtract the user's response from it.
 	if linkable {
 		proofP.P = new(big.Int).Exp(key.R[0], s.KeyshareSecret, key.N)
+		if cosignerP != nil {
+			proofP.P = mulMod(proofP.P, cosignerP, key.N)
+		}
 		proofP.SResponse.Sub(proofP.SResponse, req.UserResponse)
 	}
 
@@ -418,11 +544,14 @@ func (c *Core) SetUserPublicKey(secrets UserSecrets, pin string, pk *ecdsa.Publi
 	}
 
 	s.PublicKey = pk
+	if _, err = c.upgradePinHash(&s, pin); err != nil {
+		return "", nil, err
+	}
 	secrets, err = c.encryptUserSecrets(s)
 	if err != nil {
 		return "", nil, err
 	}
-	jwtt, err := c.authJWT(&s)
+	jwtt, err := c.authJWT(&s, "")
 	if err != nil {
 		return "", nil, err
 	}
@@ -215,6 +215,65 @@ func TestProofFunctionality(t *testing.T) {
 	}
 }
 
+func TestMigrateUserSecrets(t *testing.T) {
+	// Setup keys for test: two keyshare servers sharing a migration key
+	var key1, key2, migrationKey AESKey
+	for _, k := range []*AESKey{&key1, &key2, &migrationKey} {
+		_, err := rand.Read(k[:])
+		require.NoError(t, err)
+	}
+	c1 := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key1, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+	c2 := NewKeyshareCore(&Configuration{DecryptionKeyID: 2, DecryptionKey: key2, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+	mk := MigrationKey{ID: 7, Key: migrationKey}
+
+	signer := test.NewSigner(t)
+	pin := generatePin()
+	secrets, err := c1.NewUserSecrets(pin, signerPublicKey(t, signer))
+	require.NoError(t, err)
+
+	// Exporting requires a valid access token
+	expiry := time.Unix(time.Now().Add(time.Hour).Unix(), 0)
+	_, err = c1.ExportUserSecrets(secrets, "", "username", expiry, mk)
+	require.Error(t, err)
+	jwtt, err := validateAuth(t, c1, signer, secrets, pin)
+	require.NoError(t, err)
+	exported, err := c1.ExportUserSecrets(secrets, jwtt, "username", expiry, mk)
+	require.NoError(t, err)
+
+	// Importing requires the same migration key, username and expiry, and is refused after the expiry
+	_, err = c2.ImportUserSecrets(exported, "username", expiry.Add(time.Hour), mk)
+	require.Equal(t, ErrInvalidMigration, err)
+	expired := time.Unix(time.Now().Add(-time.Minute).Unix(), 0)
+	exportedExpired, err := c1.ExportUserSecrets(secrets, jwtt, "username", expired, mk)
+	require.NoError(t, err)
+	_, err = c2.ImportUserSecrets(exportedExpired, "username", expired, mk)
+	require.Equal(t, ErrMigrationExpired, err)
+	_, err = c2.ImportUserSecrets(exported, "username", expiry, MigrationKey{ID: 7, Key: key1})
+	require.Equal(t, ErrInvalidMigration, err)
+	_, err = c2.ImportUserSecrets(exported, "username", expiry, MigrationKey{ID: 8, Key: migrationKey})
+	require.Equal(t, ErrInvalidMigration, err)
+	_, err = c2.ImportUserSecrets(exported[:10], "username", expiry, mk)
+	require.Equal(t, ErrInvalidMigration, err)
+	_, err = c2.ImportUserSecrets(exported, "otherusername", expiry, mk)
+	require.Equal(t, ErrInvalidMigration, err)
+	imported, err := c2.ImportUserSecrets(exported, "username", expiry, mk)
+	require.NoError(t, err)
+	require.Equal(t, ErrInvalidPin, c2.VerifyPin(imported, generatePin()))
+	require.NoError(t, c2.VerifyPin(imported, pin))
+
+	// The imported secrets are encrypted with the storage key of the second server,
+	// and contain the same PIN and keyshare secret
+	_, err = c1.decryptUserSecrets(imported)
+	require.Equal(t, ErrNoSuchKey, err)
+	s1, err := c1.decryptUserSecrets(secrets)
+	require.NoError(t, err)
+	s2, err := c2.decryptUserSecrets(imported)
+	require.NoError(t, err)
+	require.Equal(t, 0, s1.KeyshareSecret.Cmp(s2.KeyshareSecret))
+	_, err = validateAuth(t, c2, signer, imported, pin)
+	require.NoError(t, err)
+}
+
 func TestCorruptedUserSecrets(t *testing.T) {
 	// Setup keys for test
 	var key AESKey
@@ -243,7 +302,7 @@ func TestCorruptedUserSecrets(t *testing.T) {
 		// Try to verify pin. Skip challenge-response here because that would fail on our
 		// corrupted user secrets. ValidateAuthLegacy should fail on the corrupted user anyway
 		// before it notices that challenge-response is required
-		_, err = c.ValidateAuthLegacy(secrets, pin)
+		_, _, err = c.ValidateAuthLegacy(secrets, pin)
 		assert.Error(t, err, "ValidateAuth accepts corrupted keyshare user secrets")
 
 		// Change pin
@@ -500,6 +559,11 @@ func setupParameters() error {
 }
 
 func validateAuth(t *testing.T, c *Core, signer irmaclient.Signer, secrets UserSecrets, pin string) (string, error) {
+	jwtt, _, err := validateAuthUpgrading(t, c, signer, secrets, pin)
+	return jwtt, err
+}
+
+func validateAuthUpgrading(t *testing.T, c *Core, signer irmaclient.Signer, secrets UserSecrets, pin string) (string, UserSecrets, error) {
 	if signer == nil {
 		return c.ValidateAuthLegacy(secrets, pin)
 	} else {
@@ -518,11 +582,18 @@ func doChallengeResponse(t *testing.T, c *Core, signer irmaclient.Signer, secret
 	require.NoError(t, err)
 	challenge, err := c.GenerateChallenge(secrets, jwtt)
 	require.NoError(t, err)
+	cosignerChallenge, err := c.GenerateCosignerChallenge(secrets)
+	require.NoError(t, err)
+	var cosignerJWT string
+	if cosignerChallenge != nil {
+		cosignerJWT = cosignerAuthJWT(t, signer, cosignerChallenge)
+	}
 
 	jwtt, err = irmaclient.SignerCreateJWT(signer, "", irma.KeyshareAuthResponseClaims{
 		KeyshareAuthResponseData: irma.KeyshareAuthResponseData{
-			Pin:       pin,
-			Challenge: challenge,
+			Pin:             pin,
+			Challenge:       challenge,
+			CosignerAuthJWT: cosignerJWT,
 		},
 	})
 	require.NoError(t, err)
@@ -563,7 +634,11 @@ func signerPublicKey(t *testing.T, signer irmaclient.Signer) *ecdsa.PublicKey {
 }
 
 func generatePin() string {
-	return common.NewRandomString(64, common.AlphanumericChars)
+	pin, err := common.NewRandomString(64, common.AlphanumericChars)
+	if err != nil {
+		panic(err)
+	}
+	return pin
 }
 
 func TestMain(m *testing.M) {
@@ -0,0 +1,91 @@
+package keysharecore
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+
+	"github.com/go-errors/errors"
+	"golang.org/x/crypto/argon2"
+)
+
+// PinHashParameters are the Argon2id parameters with which PINs are hashed.
+type PinHashParameters struct {
+	Memory      uint32 // in KiB
+	Iterations  uint32
+	Parallelism uint8
+}
+
+const (
+	pinMaxLength  = 64
+	pinSaltLength = 16
+	pinHashLength = 32
+)
+
+// PinHashParametersDefault are the Argon2id parameters recommended by OWASP.
+var PinHashParametersDefault = PinHashParameters{
+	Memory:      19 * 1024,
+	Iterations:  2,
+	Parallelism: 1,
+}
+
+// Validate checks that the parameters are accepted by Argon2id.
+func (p PinHashParameters) Validate() error {
+	if p.Iterations < 1 || p.Parallelism < 1 {
+		return errors.New("Argon2 iterations and parallelism must be at least 1")
+	}
+	if p.Memory < 8*uint32(p.Parallelism) {
+		return errors.New("Argon2 memory must be at least 8 KiB per thread")
+	}
+	return nil
+}
+
+func hashPin(pin string, salt []byte, params PinHashParameters) []byte {
+	return argon2.IDKey([]byte(pin), salt, params.Iterations, params.Memory, params.Parallelism, pinHashLength)
+}
+
+// setPin sets the PIN of the user to the specified new PIN, hashed using the current PinHashParameters.
+func (c *Core) setPin(s *unencryptedUserSecrets, pin string) error {
+	if len(pin) > pinMaxLength {
+		return ErrPinTooLong
+	}
+	return s.setPin(pin, c.pinHashParameters)
+}
+
+// upgradePinHash hashes the PIN of the user again using the current PinHashParameters, if its hash
+// was computed with other parameters or if the PIN was stored before PINs were hashed. It returns
+// whether it did so. The PIN must have been verified by the caller.
+func (c *Core) upgradePinHash(s *unencryptedUserSecrets, pin string) (bool, error) {
+	if s.PinSalt != nil && s.PinHashParameters == c.pinHashParameters {
+		return false, nil
+	}
+	return true, s.setPin(pin, c.pinHashParameters)
+}
+
+func (s *unencryptedUserSecrets) setPin(pin string, params PinHashParameters) error {
+	salt := make([]byte, pinSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return err
+	}
+	s.Pin = hashPin(pin, salt, params)
+	s.PinSalt = salt
+	s.PinHashParameters = params
+	return nil
+}
+
+func (s *unencryptedUserSecrets) verifyPin(pin string) error {
+	var expected []byte
+	if s.PinSalt == nil {
+		// Stored before PINs were hashed: the PIN itself, padded to 64 bytes
+		paddedPin, err := padBytes([]byte(pin), 64)
+		if err != nil {
+			return err
+		}
+		expected = paddedPin
+	} else {
+		expected = hashPin(pin, s.PinSalt, s.PinHashParameters)
+	}
+	if subtle.ConstantTimeCompare(s.Pin, expected) != 1 {
+		return ErrInvalidPin
+	}
+	return nil
+}
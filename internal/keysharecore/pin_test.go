@@ -0,0 +1,91 @@
+package keysharecore
+
+import (
+	"crypto/rand"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/irmaclient"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPinTooLong(t *testing.T) {
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	c := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+
+	_, err = c.NewUserSecrets(strings.Repeat("1", pinMaxLength+1), nil)
+	assert.ErrorIs(t, err, ErrPinTooLong)
+	secrets, err := c.NewUserSecrets(strings.Repeat("1", pinMaxLength), nil)
+	require.NoError(t, err)
+	_, err = c.ChangePinLegacy(secrets, strings.Repeat("1", pinMaxLength), strings.Repeat("2", pinMaxLength+1))
+	assert.ErrorIs(t, err, ErrPinTooLong)
+}
+
+func TestPinHashParametersValidate(t *testing.T) {
+	assert.NoError(t, PinHashParametersDefault.Validate())
+	assert.Error(t, PinHashParameters{Memory: 1024, Iterations: 0, Parallelism: 1}.Validate())
+	assert.Error(t, PinHashParameters{Memory: 1024, Iterations: 1, Parallelism: 0}.Validate())
+	assert.Error(t, PinHashParameters{Memory: 15, Iterations: 1, Parallelism: 2}.Validate())
+}
+
+func TestUpgradePinHash(t *testing.T) {
+	var key AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	c := NewKeyshareCore(&Configuration{DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey})
+
+	for _, signer := range []irmaclient.Signer{nil, test.NewSigner(t)} {
+		pin := generatePin()
+		secrets, err := c.NewUserSecrets(pin, signerPublicKey(t, signer))
+		require.NoError(t, err)
+
+		// Replace the PIN hash by the padded PIN, as stored before PINs were hashed
+		s, err := c.decryptUserSecrets(secrets)
+		require.NoError(t, err)
+		s.Pin, err = padBytes([]byte(pin), 64)
+		require.NoError(t, err)
+		s.PinSalt = nil
+		s.PinHashParameters = PinHashParameters{}
+		secrets, err = c.encryptUserSecrets(s)
+		require.NoError(t, err)
+
+		// Wrong PIN does not upgrade
+		_, upgraded, err := validateAuthUpgrading(t, c, signer, secrets, generatePin())
+		assert.Error(t, err)
+		assert.Nil(t, upgraded)
+
+		// Correct PIN upgrades to a hash
+		_, upgraded, err = validateAuthUpgrading(t, c, signer, secrets, pin)
+		require.NoError(t, err)
+		require.NotNil(t, upgraded)
+		s, err = c.decryptUserSecrets(upgraded)
+		require.NoError(t, err)
+		assert.NotNil(t, s.PinSalt)
+		assert.Equal(t, PinHashParametersDefault, s.PinHashParameters)
+
+		// Already upgraded
+		_, again, err := validateAuthUpgrading(t, c, signer, upgraded, pin)
+		require.NoError(t, err)
+		assert.Nil(t, again)
+
+		// Changing the hash parameters upgrades again
+		params := PinHashParameters{Memory: 8 * 1024, Iterations: 3, Parallelism: 1}
+		c2 := NewKeyshareCore(&Configuration{
+			DecryptionKeyID: 1, DecryptionKey: key, JWTPrivateKeyID: 1, JWTPrivateKey: jwtTestKey,
+			PinHashParameters: params,
+		})
+		_, again, err = validateAuthUpgrading(t, c2, signer, upgraded, pin)
+		require.NoError(t, err)
+		require.NotNil(t, again)
+		s, err = c2.decryptUserSecrets(again)
+		require.NoError(t, err)
+		assert.Equal(t, params, s.PinHashParameters)
+		_, err = validateAuth(t, c2, signer, again, pin)
+		assert.NoError(t, err)
+	}
+}
@@ -5,7 +5,6 @@ import (
 	"crypto/cipher"
 	"crypto/ecdsa"
 	"crypto/rand"
-	"crypto/subtle"
 	"encoding/binary"
 
 	"github.com/fxamacker/cbor"
@@ -17,10 +16,16 @@ import (
 
 type (
 	unencryptedUserSecrets struct {
-		Pin            []byte
-		KeyshareSecret *big.Int
-		ID             []byte
-		PublicKey      *ecdsa.PublicKey
+		// Argon2id hash of the PIN, or if PinSalt is nil, the PIN itself padded to 64 bytes
+		// (for users whose PIN has not been hashed yet)
+		Pin               []byte
+		PinSalt           []byte
+		PinHashParameters PinHashParameters
+		KeyshareSecret    *big.Int
+		ID                []byte
+		PublicKey         *ecdsa.PublicKey
+		// If present, KeyshareSecret is one share of the keyshare secret and this is the other
+		CosignerShare CosignerShare
 	}
 
 	// UserSecrets contains the encrypted data of a keyshare user.
@@ -33,19 +38,6 @@ var (
 	ErrNoSuchKey              = errors.New("Key identifier unknown")
 )
 
-func (s *unencryptedUserSecrets) setPin(pin string) error {
-	if len(pin) > 64 {
-		// padBytes also checks the length, but we want to return a specific error in this case
-		return ErrPinTooLong
-	}
-	paddedPin, err := padBytes([]byte(pin), 64)
-	if err != nil {
-		return err
-	}
-	s.Pin = paddedPin
-	return nil
-}
-
 func (s *unencryptedUserSecrets) setKeyshareSecret(val *big.Int) error {
 	if val.Sign() == -1 {
 		return ErrKeyshareSecretNegative
@@ -70,22 +62,18 @@ func (s *unencryptedUserSecrets) setID(id []byte) error {
 	return nil
 }
 
-func (s *unencryptedUserSecrets) verifyPin(pin string) error {
-	paddedPin, err := padBytes([]byte(pin), 64)
-	if err != nil {
-		return err
-	}
-	if subtle.ConstantTimeCompare(s.Pin, paddedPin) != 1 {
-		return ErrInvalidPin
-	}
-	return nil
-}
-
 type marshaledUserSecrets struct {
 	Pin            []byte
 	KeyshareSecret []byte
 	ID             []byte
 	PublicKey      []byte
+
+	// Absent in user secrets stored before PINs were hashed
+	PinSalt           []byte
+	PinHashParameters PinHashParameters
+
+	// Absent in user secrets whose keyshare secret is not split
+	CosignerShare []byte
 }
 
 // MarshalCBOR implements cbor.Marshaler to ensure that all fields have a constant size, to minimize
@@ -103,7 +91,7 @@ func (s *unencryptedUserSecrets) MarshalCBOR() ([]byte, error) {
 		}
 	}
 	return cbor.Marshal(marshaledUserSecrets{
-		s.Pin, secretBts, s.ID, pkBts,
+		s.Pin, secretBts, s.ID, pkBts, s.PinSalt, s.PinHashParameters, s.CosignerShare,
 	}, cbor.EncOptions{})
 }
 
@@ -114,9 +102,12 @@ func (s *unencryptedUserSecrets) UnmarshalCBOR(bytes []byte) error {
 		return err
 	}
 	*s = unencryptedUserSecrets{
-		Pin:            raw.Pin,
-		KeyshareSecret: new(big.Int).SetBytes(raw.KeyshareSecret),
-		ID:             raw.ID,
+		Pin:               raw.Pin,
+		PinSalt:           raw.PinSalt,
+		PinHashParameters: raw.PinHashParameters,
+		KeyshareSecret:    new(big.Int).SetBytes(raw.KeyshareSecret),
+		ID:                raw.ID,
+		CosignerShare:     raw.CosignerShare,
 	}
 	if len(raw.PublicKey) > 0 {
 		s.PublicKey, err = signed.UnmarshalPublicKey(raw.PublicKey)
@@ -136,6 +127,15 @@ func (s *unencryptedUserSecrets) publicKey(_ *jwt.Token) (interface{}, error) {
 }
 
 func (c *Core) encryptUserSecrets(secrets unencryptedUserSecrets) (UserSecrets, error) {
+	return encryptUserSecrets(secrets, c.decryptionKeyID, c.decryptionKey)
+}
+
+func encryptUserSecrets(secrets unencryptedUserSecrets, keyID uint32, key AESKey) (UserSecrets, error) {
+	return encryptUserSecretsWithData(secrets, keyID, key, nil)
+}
+
+// encryptUserSecretsWithData encrypts the user secrets, authenticating the specified additional data along with them.
+func encryptUserSecretsWithData(secrets unencryptedUserSecrets, keyID uint32, key AESKey, additionalData []byte) (UserSecrets, error) {
 	encSecrets := make(UserSecrets, 16, 256)
 
 	bts, err := cbor.Marshal(secrets, cbor.EncOptions{})
@@ -144,7 +144,7 @@ func (c *Core) encryptUserSecrets(secrets unencryptedUserSecrets) (UserSecrets,
 	}
 
 	// Store key id
-	binary.LittleEndian.PutUint32(encSecrets[0:], c.decryptionKeyID)
+	binary.LittleEndian.PutUint32(encSecrets[0:], keyID)
 
 	// Generate and store nonce
 	_, err = rand.Read(encSecrets[4:16])
@@ -153,11 +153,11 @@ func (c *Core) encryptUserSecrets(secrets unencryptedUserSecrets) (UserSecrets,
 	}
 
 	// Encrypt secrets
-	gcm, err := newGCM(c.decryptionKey)
+	gcm, err := newGCM(key)
 	if err != nil {
 		return nil, err
 	}
-	return gcm.Seal(encSecrets[:16], encSecrets[4:16], bts, nil), nil
+	return gcm.Seal(encSecrets[:16], encSecrets[4:16], bts, additionalData), nil
 }
 
 func (c *Core) decryptUserSecrets(secrets UserSecrets) (unencryptedUserSecrets, error) {
@@ -170,13 +170,22 @@ func (c *Core) decryptUserSecrets(secrets UserSecrets) (unencryptedUserSecrets,
 		return unencryptedUserSecrets{}, ErrNoSuchKey
 	}
 
+	return decryptUserSecrets(secrets, key)
+}
+
+func decryptUserSecrets(secrets UserSecrets, key AESKey) (unencryptedUserSecrets, error) {
+	return decryptUserSecretsWithData(secrets, key, nil)
+}
+
+// decryptUserSecretsWithData decrypts the user secrets, checking the additional data with which they were encrypted.
+func decryptUserSecretsWithData(secrets UserSecrets, key AESKey, additionalData []byte) (unencryptedUserSecrets, error) {
 	// try and decrypt secrets
 	gcm, err := newGCM(key)
 	if err != nil {
 		return unencryptedUserSecrets{}, err
 	}
 
-	bts, err := gcm.Open(nil, secrets[4:16], secrets[16:], nil)
+	bts, err := gcm.Open(nil, secrets[4:16], secrets[16:], additionalData)
 	if err != nil {
 		return unencryptedUserSecrets{}, err
 	}
@@ -16,10 +16,11 @@ func TestUserSecretsAccess(t *testing.T) {
 	require.NoError(t, err)
 
 	var p unencryptedUserSecrets
-	require.NoError(t, p.setPin(string(testPassword)))
+	require.NoError(t, p.setPin(string(testPassword), PinHashParametersDefault))
 	err = p.setKeyshareSecret(testSecret)
 	require.NoError(t, err)
-	assert.Equal(t, testPassword, p.Pin, "password doesn't match")
+	assert.NotEqual(t, testPassword, p.Pin, "password stored in plain")
+	assert.NoError(t, p.verifyPin(string(testPassword)), "password doesn't match")
 	assert.Equal(t, 0, p.KeyshareSecret.Cmp(testSecret), "keyshare secret doesn't match")
 }
 
@@ -38,7 +39,7 @@ func TestUserSecretsEncryptDecrypt(t *testing.T) {
 
 	// Create and encrypt user secrets
 	var p_before unencryptedUserSecrets
-	require.NoError(t, p_before.setPin(string(testPassword)))
+	require.NoError(t, p_before.setPin(string(testPassword), PinHashParametersDefault))
 	err = p_before.setKeyshareSecret(testSecret)
 	require.NoError(t, err)
 	p_encypted, err := c.encryptUserSecrets(p_before)
@@ -47,7 +48,10 @@ func TestUserSecretsEncryptDecrypt(t *testing.T) {
 	// Decrypt and test values
 	p_after, err := c.decryptUserSecrets(p_encypted)
 	require.NoError(t, err)
-	assert.Equal(t, testPassword, p_after.Pin, "passwords don't match")
+	assert.Equal(t, p_before.Pin, p_after.Pin, "passwords don't match")
+	assert.Equal(t, p_before.PinSalt, p_after.PinSalt, "password salts don't match")
+	assert.Equal(t, p_before.PinHashParameters, p_after.PinHashParameters, "password hash parameters don't match")
+	assert.NoError(t, p_after.verifyPin(string(testPassword)), "password doesn't match")
 	assert.Equal(t, 0, p_after.KeyshareSecret.Cmp(testSecret), "keyshare secrets don't match")
 }
 
@@ -66,7 +70,7 @@ func TestUserSecretsAuthentication(t *testing.T) {
 
 	// Create and encrypt user secrets
 	var p_before unencryptedUserSecrets
-	require.NoError(t, p_before.setPin(string(testPassword)))
+	require.NoError(t, p_before.setPin(string(testPassword), PinHashParametersDefault))
 	err = p_before.setKeyshareSecret(testSecret)
 	require.NoError(t, err)
 	p_encrypted, err := c.encryptUserSecrets(p_before)
@@ -97,7 +101,7 @@ func TestMultiKey(t *testing.T) {
 
 	// Create user secrets
 	var p_before unencryptedUserSecrets
-	require.NoError(t, p_before.setPin(string(testPassword)))
+	require.NoError(t, p_before.setPin(string(testPassword), PinHashParametersDefault))
 	err = p_before.setKeyshareSecret(testSecret)
 	require.NoError(t, err)
 
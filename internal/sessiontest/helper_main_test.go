@@ -155,6 +155,10 @@ func extractClientTransport(dismisser irmaclient.SessionDismisser) *irma.HTTPTra
 	return extractPrivateField(dismisser, "transport").(*irma.HTTPTransport)
 }
 
+func extractClientMinVersion(client *irmaclient.Client) *irma.ProtocolVersion {
+	return extractPrivateField(client, "minVersion").(*irma.ProtocolVersion)
+}
+
 func extractClientMaxVersion(client *irmaclient.Client) *irma.ProtocolVersion {
 	return extractPrivateField(client, "maxVersion").(*irma.ProtocolVersion)
 }
@@ -30,6 +30,18 @@ func TestIssuanceKeyshareSession(t *testing.T) {
 	doIssuanceSession(t, true, nil, nil)
 }
 
+func TestIssuanceKeyshareSessionProtocol29(t *testing.T) {
+	keyshareServer := testkeyshare.StartKeyshareServer(t, logger, irma.NewSchemeManagerIdentifier("test"))
+	defer keyshareServer.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// In protocol version 2.9 the ProofU of the client already includes the keyshare server's P
+	*extractClientMinVersion(client) = irma.ProtocolVersion{Major: 2, Minor: 9}
+	*extractClientMaxVersion(client) = irma.ProtocolVersion{Major: 2, Minor: 9}
+	doIssuanceSession(t, true, client, nil)
+}
+
 func TestKeyshareRegister(t *testing.T) {
 	keyshareServer := testkeyshare.StartKeyshareServer(t, logger, irma.NewSchemeManagerIdentifier("test"))
 	defer keyshareServer.Stop()
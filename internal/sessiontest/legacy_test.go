@@ -72,3 +72,39 @@ func TestWithoutPairingSupport(t *testing.T) {
 
 	t.Run("StaticQRSession", apply(testStaticQRSession, nil, optionPrePairingClient))
 }
+
+func TestLegacyApiServerEndpoints(t *testing.T) {
+	conf := RequestorServerConfiguration()
+	conf.LegacyApi = true
+	rs := StartRequestorServer(t, conf)
+	defer rs.Stop()
+
+	request := getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	transport := irma.NewHTTPTransport(requestorServerURL+"/api/v2/verification/", false)
+	var qr struct {
+		URL                string      `json:"u"`
+		ProtocolVersion    string      `json:"v"`
+		ProtocolMaxVersion string      `json:"vmax"`
+		Type               irma.Action `json:"irmaqr"`
+	}
+	require.NoError(t, transport.Post("", &qr, request))
+	require.Equal(t, irma.ActionDisclosing, qr.Type)
+	require.NotEmpty(t, qr.ProtocolVersion)
+	require.NotEmpty(t, qr.ProtocolMaxVersion)
+	_, err := irma.ParseClientToken(qr.URL)
+	require.NoError(t, err)
+
+	// The session type of the request must match that of the endpoint
+	err = irma.NewHTTPTransport(requestorServerURL+"/api/v2/issue/", false).Post("", &qr, request)
+	require.Error(t, err)
+
+	transport.Server += qr.URL + "/"
+	var status irma.ServerStatus
+	require.NoError(t, transport.Get("status", &status))
+	require.Equal(t, irma.ServerStatusInitialized, status)
+
+	// Requests meant for the IRMA app are forwarded to the session
+	require.NoError(t, transport.Delete())
+	require.NoError(t, transport.Get("status", &status))
+	require.Equal(t, irma.ServerStatusCancelled, status)
+}
@@ -0,0 +1,262 @@
+package sessiontest
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+
+	"github.com/fxamacker/cbor"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+const mdocNameSpace = "org.iso.18013.5.1"
+
+// mdocIssuer issues mdocs signed by a document signer certificate under its root certificate.
+type mdocIssuer struct {
+	root   *x509.Certificate
+	dsKey  *ecdsa.PrivateKey
+	dsCert []byte
+}
+
+func newMdocIssuer(t *testing.T) *mdocIssuer {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	rootTemplate := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test IACA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, rootTemplate, rootTemplate, &rootKey.PublicKey, rootKey)
+	require.NoError(t, err)
+	root, err := x509.ParseCertificate(rootDER)
+	require.NoError(t, err)
+
+	dsKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	dsCert, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test document signer"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+	}, root, &dsKey.PublicKey, rootKey)
+	require.NoError(t, err)
+
+	return &mdocIssuer{root: root, dsKey: dsKey, dsCert: dsCert}
+}
+
+func mdocRaw(t *testing.T, v interface{}) cbor.RawMessage {
+	bts, err := cbor.Marshal(v, cbor.EncOptions{})
+	require.NoError(t, err)
+	return bts
+}
+
+func mdocSign(t *testing.T, key *ecdsa.PrivateKey, payload []byte, detached bool, unprotected map[int]cbor.RawMessage) *irma.CoseSign1 {
+	s := &irma.CoseSign1{Protected: mdocRaw(t, map[int]int{1: -7}), Unprotected: unprotected}
+	var tbs []byte
+	var err error
+	if detached {
+		tbs, err = s.ToBeSigned(payload)
+	} else {
+		s.Payload = payload
+		tbs, err = s.ToBeSigned(nil)
+	}
+	require.NoError(t, err)
+	hash := sha256.Sum256(tbs)
+	r, ss, err := ecdsa.Sign(rand.Reader, key, hash[:])
+	require.NoError(t, err)
+	s.Signature = append(r.FillBytes(make([]byte, 32)), ss.FillBytes(make([]byte, 32))...)
+	return s
+}
+
+// deviceResponse returns a device response presenting the specified data elements of a mobile
+// driving licence in the session with the specified client token.
+func (issuer *mdocIssuer) deviceResponse(t *testing.T, elements map[string]interface{}, token irma.ClientToken) *irma.MdocDeviceResponse {
+	var items []cbor.RawMessage
+	digests := map[uint][]byte{}
+	for name, value := range elements {
+		random := make([]byte, 16)
+		_, err := rand.Read(random)
+		require.NoError(t, err)
+		item, err := irma.MdocEmbeddedCBOR(&irma.MdocIssuerSignedItem{
+			DigestID: uint(len(items)), Random: random, ElementIdentifier: name, ElementValue: value,
+		})
+		require.NoError(t, err)
+		digest := sha256.Sum256(item)
+		digests[uint(len(items))] = digest[:]
+		items = append(items, item)
+	}
+
+	deviceKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	now := time.Now().UTC()
+	mso, err := irma.MdocEmbeddedCBOR(&irma.MobileSecurityObject{
+		Version:         irma.MdocVersion,
+		DigestAlgorithm: "SHA-256",
+		ValueDigests:    map[string]map[uint][]byte{mdocNameSpace: digests},
+		DeviceKeyInfo: irma.MdocDeviceKeyInfo{DeviceKey: map[int]cbor.RawMessage{
+			1:  mdocRaw(t, 2),
+			-1: mdocRaw(t, 1),
+			-2: mdocRaw(t, deviceKey.X.FillBytes(make([]byte, 32))),
+			-3: mdocRaw(t, deviceKey.Y.FillBytes(make([]byte, 32))),
+		}},
+		DocType: irma.MdocDocTypeMDL,
+		ValidityInfo: irma.MdocValidityInfo{
+			Signed:     now.Format(time.RFC3339),
+			ValidFrom:  now.Add(-time.Hour).Format(time.RFC3339),
+			ValidUntil: now.AddDate(1, 0, 0).Format(time.RFC3339),
+		},
+	})
+	require.NoError(t, err)
+
+	deviceNameSpaces, err := irma.MdocEmbeddedCBOR(map[string]interface{}{})
+	require.NoError(t, err)
+	transcript, err := irma.MdocSessionTranscript(token)
+	require.NoError(t, err)
+	deviceAuth, err := irma.MdocDeviceAuthenticationBytes(transcript, irma.MdocDocTypeMDL, deviceNameSpaces)
+	require.NoError(t, err)
+
+	return &irma.MdocDeviceResponse{
+		Version: irma.MdocVersion,
+		Documents: []*irma.MdocDocument{{
+			DocType: irma.MdocDocTypeMDL,
+			IssuerSigned: irma.MdocIssuerSigned{
+				NameSpaces: map[string][]cbor.RawMessage{mdocNameSpace: items},
+				IssuerAuth: *mdocSign(t, issuer.dsKey, mso, false, map[int]cbor.RawMessage{33: mdocRaw(t, issuer.dsCert)}),
+			},
+			DeviceSigned: irma.MdocDeviceSigned{
+				NameSpaces: deviceNameSpaces,
+				DeviceAuth: irma.MdocDeviceAuth{DeviceSignature: mdocSign(t, deviceKey, deviceAuth, true, map[int]cbor.RawMessage{})},
+			},
+		}},
+	}
+}
+
+// mdocRequest sends a request of an mdoc reader to the session at the specified URL.
+func mdocRequest(handler http.Handler, method, url string, body []byte) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest(method, url+"/mdoc", bytes.NewReader(body)))
+	return w
+}
+
+func postMdocResponse(t *testing.T, handler http.Handler, url string, response *irma.MdocDeviceResponse) int {
+	bts, err := irma.MarshalBinary(response)
+	require.NoError(t, err)
+	return mdocRequest(handler, http.MethodPost, url, bts).Code
+}
+
+func TestMdocSession(t *testing.T) {
+	issuer := newMdocIssuer(t)
+	conf := IrmaServerConfiguration()
+	conf.MdocIssuerCertificates = []*x509.Certificate{issuer.root}
+	conf.MdocMapping = server.MdocMapping{
+		{Attribute: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"), DocType: irma.MdocDocTypeMDL, NameSpace: mdocNameSpace, Element: "given_name"},
+		{Attribute: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname"), DocType: irma.MdocDocTypeMDL, NameSpace: mdocNameSpace, Element: "family_name"},
+	}
+	irmaServer := StartIrmaServer(t, conf)
+	defer irmaServer.Stop()
+	handler := irmaServer.irma.HandlerFunc()
+
+	request := &irma.ServiceProviderRequest{
+		Request: irma.NewDisclosureRequest(
+			irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"),
+			irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname"),
+		),
+		RequestorBaseRequest: irma.RequestorBaseRequest{Mdoc: true},
+	}
+	elements := map[string]interface{}{"given_name": "Alice", "family_name": "Doe", "age_over_18": true}
+
+	t.Run("Valid", func(t *testing.T) {
+		qr, token, _, err := irmaServer.irma.StartSession(request, nil)
+		require.NoError(t, err)
+
+		// The mdoc reader retrieves the device request
+		res := mdocRequest(handler, http.MethodGet, qr.URL, nil)
+		require.Equal(t, http.StatusOK, res.Code)
+		require.Equal(t, irma.MdocContentType, res.Header().Get("Content-Type"))
+		deviceRequest := &irma.MdocDeviceRequest{}
+		require.NoError(t, irma.UnmarshalBinary(res.Body.Bytes(), deviceRequest))
+		require.Len(t, deviceRequest.DocRequests, 1)
+		var itemsbts []byte
+		require.NoError(t, cbor.Unmarshal(deviceRequest.DocRequests[0].ItemsRequest, &itemsbts))
+		items := &irma.MdocItemsRequest{}
+		require.NoError(t, cbor.Unmarshal(itemsbts, items))
+		require.Equal(t, irma.MdocDocTypeMDL, items.DocType)
+		require.Len(t, items.NameSpaces[mdocNameSpace], 2)
+
+		result, err := irmaServer.irma.GetSessionResult(token)
+		require.NoError(t, err)
+		require.Equal(t, irma.ServerStatusConnected, result.Status)
+
+		status := postMdocResponse(t, handler, qr.URL, issuer.deviceResponse(t, elements, irma.ClientToken(path.Base(qr.URL))))
+		require.Equal(t, http.StatusOK, status)
+
+		result, err = irmaServer.irma.GetSessionResult(token)
+		require.NoError(t, err)
+		require.Equal(t, irma.ServerStatusDone, result.Status)
+		require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+		require.Len(t, result.Disclosed, 2)
+		require.Equal(t, "Alice", *result.Disclosed[0][0].RawValue)
+		require.Equal(t, "Doe", *result.Disclosed[1][0].RawValue)
+		require.Len(t, result.Mdoc, 1)
+		require.Equal(t, "CN=Test document signer", result.Mdoc[0].Issuer)
+	})
+
+	t.Run("OtherSession", func(t *testing.T) {
+		qr, token, _, err := irmaServer.irma.StartSession(request, nil)
+		require.NoError(t, err)
+		status := postMdocResponse(t, handler, qr.URL, issuer.deviceResponse(t, elements, "othersession"))
+		require.Equal(t, server.ErrorInvalidProofs.Status, status)
+		result, err := irmaServer.irma.GetSessionResult(token)
+		require.NoError(t, err)
+		require.Equal(t, irma.ServerStatusCancelled, result.Status)
+	})
+
+	t.Run("TamperedElement", func(t *testing.T) {
+		qr, _, _, err := irmaServer.irma.StartSession(request, nil)
+		require.NoError(t, err)
+		response := issuer.deviceResponse(t, map[string]interface{}{"given_name": "Alice"}, irma.ClientToken(path.Base(qr.URL)))
+		item, err := irma.MdocEmbeddedCBOR(&irma.MdocIssuerSignedItem{ElementIdentifier: "given_name", ElementValue: "Bob"})
+		require.NoError(t, err)
+		response.Documents[0].IssuerSigned.NameSpaces[mdocNameSpace][0] = item
+		status := postMdocResponse(t, handler, qr.URL, response)
+		require.Equal(t, server.ErrorInvalidProofs.Status, status)
+	})
+
+	t.Run("UntrustedIssuer", func(t *testing.T) {
+		qr, _, _, err := irmaServer.irma.StartSession(request, nil)
+		require.NoError(t, err)
+		status := postMdocResponse(t, handler, qr.URL, newMdocIssuer(t).deviceResponse(t, elements, irma.ClientToken(path.Base(qr.URL))))
+		require.Equal(t, server.ErrorInvalidProofs.Status, status)
+	})
+
+	t.Run("NotEnabled", func(t *testing.T) {
+		qr, _, _, err := irmaServer.irma.StartSession(request.Request, nil)
+		require.NoError(t, err)
+		status := postMdocResponse(t, handler, qr.URL, issuer.deviceResponse(t, elements, irma.ClientToken(path.Base(qr.URL))))
+		require.Equal(t, server.ErrorUnsupported.Status, status)
+	})
+
+	// Attributes that are not mapped to data elements cannot be presented as mdoc
+	_, _, _, err := irmaServer.irma.StartSession(&irma.ServiceProviderRequest{
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+		RequestorBaseRequest: irma.RequestorBaseRequest{Mdoc: true},
+	}, nil)
+	require.Error(t, err)
+}
@@ -96,14 +96,14 @@ func (lb *DummyLoadBalancer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	require.NoError(lb.t, err)
 
 	// Write the IRMA server response to our response writer
-	w.WriteHeader(relayResp.StatusCode)
-	_, err = io.Copy(w, relayResp.Body)
-	require.NoError(lb.t, err)
 	for key, values := range relayResp.Header {
 		for _, value := range values {
 			w.Header().Add(key, value)
 		}
 	}
+	w.WriteHeader(relayResp.StatusCode)
+	_, err = io.Copy(w, relayResp.Body)
+	require.NoError(lb.t, err)
 
 	err = relayResp.Body.Close()
 	require.NoError(lb.t, err)
@@ -190,6 +190,40 @@ func TestRedisWithoutTLS(t *testing.T) {
 	t.Run("DisclosureSession", apply(testDisclosureSession, redisConfigDecorator(mr, "", "", IrmaServerConfiguration)))
 }
 
+func TestRedisOpenSessions(t *testing.T) {
+	mr, cert := startRedis(t, true)
+	defer mr.Close()
+
+	testRequestorOpenSessions(t, redisRequestorConfigDecorator(mr, cert, "", RequestorServerAuthConfiguration)())
+
+	// The indices of the sessions of the requestors expire together with their last session
+	for _, requestor := range []string{"requestor1", "requestor2"} {
+		require.True(t, mr.Exists("requestor-sessions:"+requestor))
+		require.Greater(t, mr.TTL("requestor-sessions:"+requestor), time.Duration(0))
+	}
+}
+
+func TestRedisKeyPrefix(t *testing.T) {
+	mr, _ := startRedis(t, false)
+	defer mr.Close()
+
+	conf := redisConfigDecorator(mr, "", "", IrmaServerConfiguration)()
+	conf.RedisSettings.KeyPrefix = "env1"
+	irmaServer := StartIrmaServer(t, conf)
+	defer irmaServer.Stop()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	_, token, _, err := irmaServer.irma.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+
+	keys := mr.Keys()
+	require.NotEmpty(t, keys)
+	for _, key := range keys {
+		require.True(t, strings.HasPrefix(key, "env1:"), key)
+	}
+	require.True(t, mr.Exists("env1:token:"+string(token)))
+}
+
 func checkErrorInternal(t *testing.T, err error) {
 	serr, ok := err.(*irma.SessionError)
 	require.True(t, ok)
@@ -208,6 +242,7 @@ func TestRedisRedundancy(t *testing.T) {
 	for i, port := range ports {
 		c := redisRequestorConfigDecorator(mr, cert, "", RequestorServerAuthConfiguration)()
 		c.Configuration.URL = fmt.Sprintf("http://localhost:%d/irma", requestorServerPort)
+		c.Configuration.RotateClientAuth = true
 		c.Port = port
 		rs := StartRequestorServer(t, c)
 		servers[i] = rs
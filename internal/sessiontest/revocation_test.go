@@ -149,6 +149,37 @@ func testRevocationAll(t *testing.T, dbType string) {
 		require.NotEmpty(t, result.Missing)
 	})
 
+	t.Run("MultipleIssuanceRecords", func(t *testing.T) {
+		revServer := startRevocationServer(t, true, dbType)
+		defer revServer.Stop()
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+
+		// issue two revocable credentials and a non-revocable one in a single session
+		request := revocationIssuanceRequest(t, revocationTestCred)
+		second := *request.Credentials[0]
+		second.RevocationKey = "secondkey"
+		request.Credentials = append(request.Credentials, &second, &irma.CredentialRequest{
+			CredentialTypeID: irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+			Attributes: map[string]string{
+				"university":        "Radboud",
+				"studentCardNumber": "31415927",
+				"studentID":         "s1234567",
+				"level":             "42",
+			},
+		})
+		result := doSession(t, request, client, revServer, nil, nil, nil)
+		require.Nil(t, result.Err)
+
+		// the issuance records of both revocable credentials have been stored
+		rs := revServer.conf.IrmaConfiguration.Revocation
+		for _, key := range []string{"key", "secondkey"} {
+			records, err := rs.IssuanceRecords(revocationTestCred, key, time.Time{})
+			require.NoError(t, err)
+			require.Len(t, records, 1)
+		}
+	})
+
 	t.Run("MixRevocationNonRevocation", func(t *testing.T) {
 		revServer, client, handler := revocationSetup(t, nil, dbType)
 		defer test.ClearTestStorage(t, client, handler.storage)
@@ -567,6 +598,56 @@ func testRevocationAll(t *testing.T, dbType string) {
 		require.Equal(t, irma.ErrUnknownRevocationKey, err)
 	})
 
+	t.Run("DeleteIssuanceRecordsAfterRetention", func(t *testing.T) {
+		revServer := startRevocationServer(t, true, dbType)
+		defer revServer.Stop()
+		revServer.conf.RevocationSettings[revocationTestCred].Retention = 1
+
+		// Insert a valid issuance record issued before the retention period, and one after
+		rev := revServer.conf.IrmaConfiguration.Revocation
+		for key, issued := range map[string]time.Time{"old": time.Now().AddDate(0, 0, -2), "new": time.Now()} {
+			require.NoError(t, rev.AddIssuanceRecord(&irma.IssuanceRecord{
+				Key:        key,
+				CredType:   revocationTestCred,
+				PKCounter:  &revocationPkCounter,
+				Attr:       (*irma.RevocationAttribute)(big.NewInt(42)),
+				Issued:     issued.UnixNano(),
+				ValidUntil: time.Now().Add(1 * time.Hour).UnixNano(),
+			}))
+		}
+
+		// Run jobs, triggering DELETE
+		runAllSchedulerJobs(revServer.conf.IrmaConfiguration.Scheduler)
+
+		_, err := rev.IssuanceRecords(revocationTestCred, "old", time.Time{})
+		require.Equal(t, irma.ErrUnknownRevocationKey, err)
+		rec, err := rev.IssuanceRecords(revocationTestCred, "new", time.Time{})
+		require.NoError(t, err)
+		require.NotEmpty(t, rec)
+	})
+
+	t.Run("PurgeIssuanceRecords", func(t *testing.T) {
+		revServer := startRevocationServer(t, true, dbType)
+		defer revServer.Stop()
+		client, handler := parseStorage(t)
+		defer test.ClearTestStorage(t, client, handler.storage)
+
+		request := revocationIssuanceRequest(t, revocationTestCred)
+		result := doSession(t, request, client, revServer, nil, nil, nil)
+		require.Nil(t, result.Err)
+		key := request.Credentials[0].RevocationKey
+
+		require.NoError(t, revServer.irma.PurgeIssuanceRecords(revocationTestCred, key))
+		_, err := revServer.conf.IrmaConfiguration.Revocation.IssuanceRecords(revocationTestCred, key, time.Time{})
+		require.Equal(t, irma.ErrUnknownRevocationKey, err)
+
+		// Purged credentials can no longer be revoked, and the revocation state is unaffected
+		require.Equal(t, irma.ErrUnknownRevocationKey, revServer.irma.Revoke(revocationTestCred, key, time.Time{}))
+		require.Equal(t, irma.ErrUnknownRevocationKey, revServer.irma.PurgeIssuanceRecords(revocationTestCred, key))
+		result = revocationSession(t, client, nil, revServer)
+		require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	})
+
 	t.Run("RevokeMany", func(t *testing.T) {
 		revServer := startRevocationServer(t, true, dbType)
 		defer revServer.Stop()
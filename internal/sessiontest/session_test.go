@@ -20,8 +20,10 @@ import (
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/irmaclient"
+	"github.com/privacybydesign/irmago/proximity"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/requestorserver"
 	sseclient "github.com/sietseringers/go-sse"
 	"github.com/stretchr/testify/require"
 )
@@ -54,6 +56,8 @@ func TestRequestorServer(t *testing.T) {
 	t.Run("IssuanceSameAttributesNotSingleton", apply(testIssuanceSameAttributesNotSingleton, RequestorServerConfiguration))
 	t.Run("IssuancePairing", apply(testIssuancePairing, RequestorServerConfiguration))
 	t.Run("PairingRejected", apply(testPairingRejected, RequestorServerConfiguration))
+	t.Run("PairingRequired", apply(testPairingRequired, RequestorServerConfiguration))
+	t.Run("SessionFeatures", apply(testSessionFeatures, RequestorServerConfiguration))
 	t.Run("LargeAttribute", apply(testLargeAttribute, RequestorServerConfiguration))
 	t.Run("IssuanceSingletonCredential", apply(testIssuanceSingletonCredential, RequestorServerConfiguration))
 	t.Run("UnsatisfiableDisclosureSession", apply(testUnsatisfiableDisclosureSession, RequestorServerConfiguration))
@@ -78,12 +82,15 @@ func TestIrmaServer(t *testing.T) {
 	// Tests also run against the requestor server
 	t.Run("DisclosureSession", apply(testDisclosureSession, IrmaServerConfiguration))
 	t.Run("NoAttributeDisclosureSession", apply(testNoAttributeDisclosureSession, IrmaServerConfiguration))
+	t.Run("MetadataAttributeDisclosureSession", apply(testMetadataAttributeDisclosureSession, IrmaServerConfiguration))
 	t.Run("EmptyDisclosure", apply(testEmptyDisclosure, IrmaServerConfiguration))
 	t.Run("SigningSession", apply(testSigningSession, IrmaServerConfiguration))
 	t.Run("IssuanceSession", apply(testIssuanceSession, IrmaServerConfiguration))
 	t.Run("MultipleIssuanceSession", apply(testMultipleIssuanceSession, IrmaServerConfiguration))
 	t.Run("IssuancePairing", apply(testIssuancePairing, IrmaServerConfiguration))
 	t.Run("PairingRejected", apply(testPairingRejected, IrmaServerConfiguration))
+	t.Run("PairingRequired", apply(testPairingRequired, IrmaServerConfiguration))
+	t.Run("SessionFeatures", apply(testSessionFeatures, IrmaServerConfiguration))
 	t.Run("DisablePairing", apply(testDisablePairing, IrmaServerConfiguration))
 	t.Run("UnsatisfiableDisclosureSession", apply(testUnsatisfiableDisclosureSession, IrmaServerConfiguration))
 
@@ -96,6 +103,27 @@ func testNoAttributeDisclosureSession(t *testing.T, conf interface{}, opts ...op
 	doSession(t, request, nil, nil, nil, nil, conf, opts...)
 }
 
+func testMetadataAttributeDisclosureSession(t *testing.T, conf interface{}, opts ...option) {
+	request := irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.@expiry"),
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.@issuancedate"),
+	)
+	res := doSession(t, request, nil, nil, nil, nil, conf, opts...)
+	require.Nil(t, res.Err)
+	require.Len(t, res.SessionResult.Disclosed, 3)
+
+	for i, name := range []string{irma.MetadataAttributeExpiry, irma.MetadataAttributeIssuanceDate} {
+		attr := res.SessionResult.Disclosed[i+1][0]
+		require.Equal(t, "irma-demo.RU.studentCard."+name, attr.Identifier.String())
+		require.Equal(t, irma.AttributeProofStatusPresent, attr.Status)
+		require.Equal(t, irma.AttributeDataTypeDate, attr.DataType)
+		require.NotNil(t, attr.RawValue)
+		_, err := time.Parse(irma.AttributeDateLayout, *attr.RawValue)
+		require.NoError(t, err)
+	}
+}
+
 func testEmptyDisclosure(t *testing.T, conf interface{}, opts ...option) {
 	// Disclosure request asking for an attribute value that the client doesn't have,
 	// and an empty conjunction as first option, which is always chosen by the test session handler
@@ -234,6 +262,57 @@ func testPairingRejected(t *testing.T, conf interface{}, opts ...option) {
 	require.Equal(t, err.WrappedError(), "")
 }
 
+func testPairingRequired(t *testing.T, conf interface{}, opts ...option) {
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := &irma.IdentityProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{RequirePairing: true},
+		Request:              getCombinedIssuanceRequest(id),
+	}
+
+	var pairingCode string
+	frontendOptionsHandler := func(handler *TestHandler) {
+		// The frontend cannot disable pairing
+		pairingCode = setPairingMethod(irma.PairingMethodNone, handler)
+		require.NotEmpty(t, pairingCode)
+	}
+	pairingHandler := func(handler *TestHandler) {
+		require.Equal(t, pairingCode, <-handler.pairingCodeChan)
+		err := handler.frontendTransport.Post("frontend/pairingcompleted", nil, nil)
+		require.NoError(t, err)
+	}
+	doSession(t, request, nil, nil, frontendOptionsHandler, pairingHandler, conf, opts...)
+}
+
+func testSessionFeatures(t *testing.T, conf interface{}, opts ...option) {
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getCombinedIssuanceRequest(id)
+
+	frontendOptionsHandler := func(handler *TestHandler) {
+		options := &irma.SessionOptions{}
+		require.NoError(t, handler.frontendTransport.Get("frontend/options", options))
+		require.NotNil(t, options.Features)
+		require.Equal(t, []irma.PairingMethod{irma.PairingMethodNone, irma.PairingMethodPin}, options.Features.PairingMethods)
+		require.False(t, options.Features.ChainedSession)
+		require.Equal(t,
+			[]irma.ServerStatus{irma.ServerStatusInitialized, irma.ServerStatusConnected, irma.ServerStatusDone},
+			options.Features.ExpectedStatuses,
+		)
+
+		// Enabling pairing adds the pairing status to the expected statuses
+		optionsRequest := irma.NewFrontendOptionsRequest()
+		optionsRequest.PairingMethod = irma.PairingMethodPin
+		require.NoError(t, handler.frontendTransport.Post("frontend/options", options, optionsRequest))
+		require.Equal(t,
+			[]irma.ServerStatus{irma.ServerStatusInitialized, irma.ServerStatusPairing, irma.ServerStatusConnected, irma.ServerStatusDone},
+			options.Features.ExpectedStatuses,
+		)
+
+		// Disable pairing again so that the session can proceed without it
+		setPairingMethod(irma.PairingMethodNone, handler)
+	}
+	doSession(t, request, nil, nil, frontendOptionsHandler, nil, conf, opts...)
+}
+
 func testLargeAttribute(t *testing.T, conf interface{}, opts ...option) {
 	client, handler := parseStorage(t, opts...)
 	defer test.ClearTestStorage(t, client, handler.storage)
@@ -1237,10 +1316,14 @@ func TestParallelSessionsWithPairing(t *testing.T) {
 	doSession(t, request, client, irmaServer, frontendOptionsHandler, pairingHandler, nil)
 }
 
+// expireKey expires the public key both in the configuration and in its current snapshot, which is
+// used by sessions and which parses its own copy of keys that were not yet parsed when it was made.
 func expireKey(t *testing.T, conf *irma.Configuration) {
-	pk, err := conf.PublicKey(irma.NewIssuerIdentifier("irma-demo.RU"), 2)
-	require.NoError(t, err)
-	pk.ExpiryDate = 1500000000
+	for _, c := range []*irma.Configuration{conf, conf.Snapshot()} {
+		pk, err := c.PublicKey(irma.NewIssuerIdentifier("irma-demo.RU"), 2)
+		require.NoError(t, err)
+		pk.ExpiryDate = 1500000000
+	}
 }
 
 func TestIssueExpiredKey(t *testing.T) {
@@ -1320,7 +1403,11 @@ func TestRequestorHostPermissions(t *testing.T) {
 	request.Base().Host = "127.0.0.1:48682"
 	err := irma.NewHTTPTransport(requestorServerURL, false).Post("session", &server.SessionPackage{}, signSessionRequest(t, request))
 	require.Error(t, err)
-	require.Contains(t, err.Error(), "requestor not allowed to use the requested host")
+	serr, ok := err.(*irma.SessionError)
+	require.True(t, ok)
+	require.Equal(t, []*irma.PermissionDenial{
+		{Identifier: "127.0.0.1:48682", Permission: "host_perms", Reason: irma.PermissionDenialNotPermitted},
+	}, serr.RemoteError.PermissionDenials)
 
 	// Start a new session using the allowed host.
 	request.Base().Host = "localhost:48682"
@@ -1344,6 +1431,94 @@ func TestRequestorHostPermissions(t *testing.T) {
 	require.Nil(t, result)
 }
 
+func TestRequestorOpenSessions(t *testing.T) {
+	testRequestorOpenSessions(t, RequestorServerAuthConfiguration())
+}
+
+func TestRequestorOpenSessionsNoAuth(t *testing.T) {
+	rs := StartRequestorServer(t, RequestorServerConfiguration())
+	defer rs.Stop()
+
+	// Without requestor authentication, the sessions of all requestors would be listed
+	transport := irma.NewHTTPTransport(requestorServerURL, false)
+	for _, endpoint := range []string{"session", "session/callbacks"} {
+		err := transport.Get(endpoint, &struct{}{})
+		require.Error(t, err)
+		serr, ok := err.(*irma.SessionError)
+		require.True(t, ok)
+		require.Equal(t, server.ErrorUnsupported.Status, serr.RemoteError.Status)
+	}
+}
+
+func testRequestorOpenSessions(t *testing.T, conf *requestorserver.Configuration) {
+	rs := StartRequestorServer(t, conf)
+	defer rs.Stop()
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getDisclosureRequest(id)
+	request.Base().Host = "localhost:48682"
+
+	// requestor1 starts two sessions, requestor2 one
+	jwtTransport := irma.NewHTTPTransport(requestorServerURL, false)
+	var tokens []irma.RequestorToken
+	for i := 0; i < 2; i++ {
+		sesPkg := &server.SessionPackage{}
+		require.NoError(t, jwtTransport.Post("session", sesPkg, signSessionRequest(t, request)))
+		tokens = append(tokens, sesPkg.Token)
+	}
+	tokenTransport := irma.NewHTTPTransport(requestorServerURL, false)
+	tokenTransport.SetHeader("Authorization", TokenAuthenticationKey)
+	require.NoError(t, tokenTransport.Post("session", &server.SessionPackage{}, request))
+
+	// Listing with a session list JWT only returns the sessions of requestor1
+	skbts, err := os.ReadFile(filepath.Join(testdata, "jwtkeys", "requestor1-sk.pem"))
+	require.NoError(t, err)
+	sk, err := jwt.ParseRSAPrivateKeyFromPEM(skbts)
+	require.NoError(t, err)
+	signList := func(subject string) string {
+		j, err := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.StandardClaims{
+			Issuer:   "requestor1",
+			Subject:  subject,
+			IssuedAt: time.Now().Unix(),
+		}).SignedString(sk)
+		require.NoError(t, err)
+		return j
+	}
+	jwtTransport.SetHeader("Authorization", "Bearer "+signList("session_list"))
+	list := &server.SessionList{}
+	require.NoError(t, jwtTransport.Get("session", list))
+	require.Equal(t, 2, list.Total)
+	require.Len(t, list.Sessions, 2)
+	require.Equal(t, tokens[0], list.Sessions[0].Token)
+	require.Equal(t, tokens[1], list.Sessions[1].Token)
+	require.Equal(t, irma.ServerStatusInitialized, list.Sessions[0].Status)
+	require.Equal(t, irma.ActionDisclosing, list.Sessions[0].Type)
+
+	// Pagination and filtering
+	require.NoError(t, jwtTransport.Get("session?offset=1&limit=1", list))
+	require.Equal(t, 2, list.Total)
+	require.Len(t, list.Sessions, 1)
+	require.Equal(t, tokens[1], list.Sessions[0].Token)
+	require.NoError(t, jwtTransport.Get("session?status=CONNECTED", list))
+	require.Equal(t, 0, list.Total)
+	require.Empty(t, list.Sessions)
+	require.Error(t, jwtTransport.Get("session?limit=-1", list))
+
+	// Cancelled sessions are no longer open
+	require.NoError(t, irma.NewHTTPTransport(requestorServerURL+"/session/"+string(tokens[0]), false).Delete())
+	require.NoError(t, jwtTransport.Get("session", list))
+	require.Equal(t, 1, list.Total)
+
+	// Listing with the token of requestor2 only returns its own session
+	require.NoError(t, tokenTransport.Get("session", list))
+	require.Equal(t, 1, list.Total)
+
+	// Session request JWTs and unauthenticated requests are not accepted
+	jwtTransport.SetHeader("Authorization", "Bearer "+signList("verification_request"))
+	require.Error(t, jwtTransport.Get("session", list))
+	require.Error(t, irma.NewHTTPTransport(requestorServerURL, false).Get("session", list))
+}
+
 func signSessionRequest(t *testing.T, req irma.SessionRequest) string {
 	skbts, err := os.ReadFile(filepath.Join(testdata, "jwtkeys", "requestor1-sk.pem"))
 	require.NoError(t, err)
@@ -1353,3 +1528,351 @@ func signSessionRequest(t *testing.T, req irma.SessionRequest) string {
 	require.NoError(t, err)
 	return j
 }
+
+func TestOfflineDisclosure(t *testing.T) {
+	irmaServer := StartIrmaServer(t, IrmaServerConfiguration())
+	defer irmaServer.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := &irma.ServiceProviderRequest{
+		Request:              getDisclosureRequest(id),
+		RequestorBaseRequest: irma.RequestorBaseRequest{Offline: true},
+	}
+	qr, token, _, err := irmaServer.irma.StartSession(request, nil)
+	require.NoError(t, err)
+	require.NotNil(t, qr.Request)
+
+	// The disclosure is computed from the session pointer only
+	offlineRequest, candidates, satisfiable, err := client.OfflineCandidates(qr)
+	require.NoError(t, err)
+	require.True(t, satisfiable)
+	require.Equal(t, 0, offlineRequest.Nonce.Cmp(request.Request.Nonce))
+	ids, err := candidates[0][0].Choose()
+	require.NoError(t, err)
+	_, err = client.PrepareOfflineDisclosure(qr, &irma.DisclosureChoice{Attributes: [][]*irma.AttributeIdentifier{ids}})
+	require.NoError(t, err)
+	status, err := irmaServer.irma.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusInitialized, status.Status)
+
+	disclosures, err := client.OfflineDisclosures()
+	require.NoError(t, err)
+	require.Len(t, disclosures, 1)
+	pending, err := client.SubmitOfflineDisclosures()
+	require.NoError(t, err)
+	require.Empty(t, pending)
+
+	result, err := irmaServer.irma.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, "456", result.Disclosed[0][0].Value["en"])
+	disclosures, err = client.OfflineDisclosures()
+	require.NoError(t, err)
+	require.Empty(t, disclosures)
+
+	// Offline sessions are only possible if no connection is needed to compute the disclosure
+	request = &irma.ServiceProviderRequest{
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("test.test.email.email")),
+		RequestorBaseRequest: irma.RequestorBaseRequest{Offline: true},
+	}
+	qr, _, _, err = irmaServer.irma.StartSession(request, nil)
+	require.NoError(t, err)
+	_, _, _, err = client.OfflineCandidates(qr)
+	require.ErrorContains(t, err, "keyshare server")
+
+	request.RequestorBaseRequest.RequirePairing = true
+	_, _, _, err = irmaServer.irma.StartSession(request, nil)
+	require.Error(t, err)
+	_, _, _, err = irmaServer.irma.StartSession(&irma.SignatureRequestorRequest{
+		Request:              getSigningRequest(id),
+		RequestorBaseRequest: irma.RequestorBaseRequest{Offline: true},
+	}, nil)
+	require.Error(t, err)
+}
+
+// compactQrHandler checks that permission is requested before the request is retrieved.
+type compactQrHandler struct {
+	*TestHandler
+	status func() irma.ServerStatus
+}
+
+func (h compactQrHandler) RequestVerificationPermission(request *irma.DisclosureRequest, satisfiable bool, candidates [][]irmaclient.DisclosureCandidates, requestorInfo *irma.RequestorInfo, callback irmaclient.PermissionHandler) {
+	require.Equal(h.t, irma.ServerStatusInitialized, h.status())
+	h.TestHandler.RequestVerificationPermission(request, satisfiable, candidates, requestorInfo, callback)
+}
+
+func TestCompactSessionPointer(t *testing.T) {
+	irmaServer := StartIrmaServer(t, IrmaServerConfiguration())
+	defer irmaServer.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	skbts, err := os.ReadFile(jwtPrivkeyPath)
+	require.NoError(t, err)
+	sk, err := jwt.ParseRSAPrivateKeyFromPEM(skbts)
+	require.NoError(t, err)
+	client.PinSessionPointerKey("localhost", &sk.PublicKey)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, token, _, err := irmaServer.irma.StartSession(&irma.ServiceProviderRequest{
+		Request:              getDisclosureRequest(id),
+		RequestorBaseRequest: irma.RequestorBaseRequest{CompactSessionPtr: true},
+	}, nil)
+	require.NoError(t, err)
+	compact, err := qr.MarshalCompact()
+	require.NoError(t, err)
+	parsed, err := irma.ParseCompactQr(compact)
+	require.NoError(t, err)
+	require.NoError(t, parsed.VerifySignature(&sk.PublicKey))
+
+	status := func() irma.ServerStatus {
+		result, err := irmaServer.irma.GetSessionResult(token)
+		require.NoError(t, err)
+		return result.Status
+	}
+	h := compactQrHandler{TestHandler: &TestHandler{t: t, c: make(chan *SessionResult), client: client}, status: status}
+	client.NewSession(compact, h)
+	if result := <-h.c; result != nil {
+		require.NoError(t, result.Err)
+	}
+	result, err := irmaServer.irma.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusDone, result.Status)
+	require.Equal(t, "456", result.Disclosed[0][0].Value["en"])
+
+	// Tampering with the request invalidates the signature
+	parsed.Request.Disclose[0][0][0].Type = irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	require.Error(t, parsed.VerifySignature(&sk.PublicKey))
+	_, err = parsed.MarshalCompact()
+	require.NoError(t, err)
+	parsed.Signature = ""
+	_, err = parsed.MarshalCompact()
+	require.Error(t, err)
+	_, err = irma.ParseCompactQr(irma.CompactQrPrefix + "invalid")
+	require.Error(t, err)
+}
+
+func TestChainedSessionUnsignedNextSessionPointer(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+	irmaServer := StartIrmaServer(t, IrmaServerConfiguration())
+	defer irmaServer.Stop()
+	nextServer := StartNextRequestServer(t, irmaServer.conf,
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"),
+	)
+	defer func() {
+		_ = nextServer.Close()
+	}()
+
+	skbts, err := os.ReadFile(jwtPrivkeyPath)
+	require.NoError(t, err)
+	sk, err := jwt.ParseRSAPrivateKeyFromPEM(skbts)
+	require.NoError(t, err)
+	client.PinSessionPointerKey("localhost", &sk.PublicKey)
+
+	// The session pointer of the first session is signed, but that of the next session is not
+	var request irma.ServiceProviderRequest
+	require.NoError(t, irma.NewHTTPTransport(nextSessionServerURL, false).Get("1", &request))
+	qr, _, _, err := irmaServer.irma.StartSession(&request, nil)
+	require.NoError(t, err)
+	require.NoError(t, qr.Sign(sk))
+	qrjson, err := json.Marshal(qr)
+	require.NoError(t, err)
+
+	h := &TestHandler{t: t, c: make(chan *SessionResult), client: client, expectedServerName: expectedRequestorInfo(t, client.Configuration)}
+	client.NewSession(string(qrjson), h)
+	result := <-h.c
+	require.NotNil(t, result)
+	require.Error(t, result.Err)
+}
+
+func TestAlternativeURLs(t *testing.T) {
+	// The IRMA app cannot reach the server at its URL, but it can at an alternative URL
+	conf := IrmaServerConfiguration()
+	conf.AlternativeURLs = []string{conf.URL}
+	conf.URL = "http://127.0.0.1:1"
+	irmaServer := StartIrmaServer(t, conf)
+	defer irmaServer.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	qr, token, _, err := irmaServer.irma.StartSession(getDisclosureRequest(id), nil)
+	require.NoError(t, err)
+	require.Equal(t, []string{strings.Replace(qr.URL, "127.0.0.1:1/", fmt.Sprintf("localhost:%d/", irmaServerPort), 1)}, qr.AlternativeURLs)
+	require.Equal(t, qr.AlternativeURLs[0], qr.ReachableURL(time.Second))
+
+	// The requestor shown to the user is that of the alternative URL, not of the unreachable URL
+	bts, err := json.Marshal(qr)
+	require.NoError(t, err)
+	h := &TestHandler{t: t, c: make(chan *SessionResult), client: client, expectedServerName: expectedRequestorInfo(t, client.Configuration)}
+	client.NewSession(string(bts), h)
+	if result := <-h.c; result != nil {
+		require.NoError(t, result.Err)
+	}
+	result, err := irmaServer.irma.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusDone, result.Status)
+
+	// Session pointers with alternative URLs cannot be made compact, so these do not include them
+	qr, _, _, err = irmaServer.irma.StartSession(&irma.ServiceProviderRequest{
+		Request:              getDisclosureRequest(id),
+		RequestorBaseRequest: irma.RequestorBaseRequest{CompactSessionPtr: true},
+	}, nil)
+	require.NoError(t, err)
+	require.Empty(t, qr.AlternativeURLs)
+}
+
+// chanLink is one end of an in-memory proximity.Link.
+type chanLink struct {
+	in  <-chan []byte
+	out chan<- []byte
+}
+
+func (l chanLink) Send(frame []byte) error {
+	l.out <- append([]byte{}, frame...)
+	return nil
+}
+
+func (l chanLink) Receive() ([]byte, error) {
+	frame, ok := <-l.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return frame, nil
+}
+
+func TestProximitySession(t *testing.T) {
+	irmaServer := StartIrmaServer(t, IrmaServerConfiguration())
+	defer irmaServer.Stop()
+	// The IRMA app and the terminal communicate only over the proximity link
+	require.NoError(t, irmaServer.http.Close())
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	for name, profile := range map[string]proximity.Profile{"BLE": proximity.BLE{MTU: 185}, "NFC": proximity.NFC{}} {
+		t.Run(name, func(t *testing.T) {
+			id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+			qr, token, _, err := irmaServer.irma.StartSession(getDisclosureRequest(id), nil)
+			require.NoError(t, err)
+
+			toTerminal, toApp := make(chan []byte, 1), make(chan []byte, 1)
+			app, terminal := chanLink{in: toApp, out: toTerminal}, chanLink{in: toTerminal, out: toApp}
+			served := make(chan error)
+			go func() {
+				served <- proximity.Serve(terminal, profile, irmaServer.irma.HandlerFunc())
+			}()
+
+			h := &TestHandler{t: t, c: make(chan *SessionResult), client: client}
+			client.NewSessionWithTransport(qr, proximity.NewTransport(app, profile, qr.URL), h)
+			if result := <-h.c; result != nil {
+				require.NoError(t, result.Err)
+			}
+			close(toTerminal)
+			require.NoError(t, <-served)
+
+			result, err := irmaServer.irma.GetSessionResult(token)
+			require.NoError(t, err)
+			require.Equal(t, irma.ServerStatusDone, result.Status)
+			require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+			require.Equal(t, "456", result.Disclosed[0][0].Value["en"])
+		})
+	}
+}
+
+func TestTSASignatureSession(t *testing.T) {
+	irmaServer := StartIrmaServer(t, IrmaServerConfiguration())
+	defer irmaServer.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// Let the irma-demo scheme specify a TSA, the first URL of which is unreachable
+	tsa := test.StartTSA(t)
+	demo := irma.NewSchemeManagerIdentifier("irma-demo")
+	for _, conf := range []*irma.Configuration{client.Configuration, irmaServer.conf.IrmaConfiguration} {
+		conf.SchemeManagers[demo].TSA = &irma.SchemeTSA{
+			URLs:         []string{"http://localhost:1/tsa", tsa.URL},
+			Certificates: []string{tsa.RootPEM},
+		}
+	}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result := doSession(t, getSigningRequest(id), client, irmaServer, nil, nil, nil)
+	require.Nil(t, result.Err)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Nil(t, result.Signature.Timestamp)
+	require.NotNil(t, result.Signature.TSATimestamp)
+	require.NotEmpty(t, result.Signature.TSATimestamp.Certificates)
+
+	// The signature can be verified offline, and its timestamp is bound to it
+	_, status, err := result.Signature.Verify(client.Configuration, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	logs, err := client.LoadNewestLogs(1)
+	require.NoError(t, err)
+	signature, err := logs[0].GetSignedMessage()
+	require.NoError(t, err)
+	require.Equal(t, result.Signature.TSATimestamp, signature.TSATimestamp)
+
+	signature.TSATimestamp = &irma.TSATimestamp{Token: append([]byte{}, result.Signature.TSATimestamp.Token...)}
+	signature.TSATimestamp.Token[len(signature.TSATimestamp.Token)-1] ^= 1
+	_, status, err = signature.Verify(client.Configuration, nil)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusInvalidTimestamp, status)
+}
+
+func TestSignatureArchive(t *testing.T) {
+	irmaServer := StartIrmaServer(t, IrmaServerConfiguration())
+	defer irmaServer.Stop()
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	tsa := test.StartTSA(t)
+	demo := irma.NewSchemeManagerIdentifier("irma-demo")
+	for _, conf := range []*irma.Configuration{client.Configuration, irmaServer.conf.IrmaConfiguration} {
+		conf.SchemeManagers[demo].TSA = &irma.SchemeTSA{URLs: []string{tsa.URL}, Certificates: []string{tsa.RootPEM}}
+	}
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := getSigningRequest(id)
+	result := doSession(t, request, client, irmaServer, nil, nil, nil)
+	require.Nil(t, result.Err)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+
+	archive, err := result.Signature.Archive(client.Configuration)
+	require.NoError(t, err)
+	require.Len(t, archive.Schemes, 1)
+	bts, err := json.Marshal(archive)
+	require.NoError(t, err)
+	archive = &irma.SignatureArchive{}
+	require.NoError(t, json.Unmarshal(bts, archive))
+	require.NoError(t, archive.Validate())
+
+	attrs, status, err := archive.VerifyArchive(irmaServer.conf.IrmaConfiguration, request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	require.Equal(t, id, attrs[0][0].Identifier)
+
+	// A verifier that no longer has the scheme needs to pin its public key
+	conf := &irma.Configuration{SchemeManagers: map[irma.SchemeManagerIdentifier]*irma.SchemeManager{
+		demo: {TSA: irmaServer.conf.IrmaConfiguration.SchemeManagers[demo].TSA},
+	}}
+	_, _, err = archive.VerifyArchive(conf, request)
+	require.Error(t, err)
+	require.NoError(t, conf.PinSchemePublicKeys("irma-demo", archive.Schemes[0].PublicKey))
+	_, status, err = archive.VerifyArchive(conf, request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+
+	// Archived scheme files cannot be modified
+	for p, file := range archive.Schemes[0].Files {
+		archive.Schemes[0].Files[p] = append(append([]byte{}, file...), ' ')
+		break
+	}
+	_, _, err = archive.VerifyArchive(irmaServer.conf.IrmaConfiguration, request)
+	require.Error(t, err)
+}
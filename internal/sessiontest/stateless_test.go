@@ -0,0 +1,64 @@
+package sessiontest
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatelessSessionStore(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	conf := IrmaServerConfiguration()
+	conf.StoreType = "stateless"
+	conf.StatelessSessionKey = make([]byte, 32)
+	irmaServer := StartIrmaServer(t, conf)
+	defer irmaServer.Stop()
+
+	// start server to receive session result callbacks
+	var callbacks int32
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&callbacks, 1)
+	})
+	s := &http.Server{Addr: fmt.Sprintf("localhost:%d", staticSessionServerPort), Handler: mux}
+	go func() { _ = s.ListenAndServe() }()
+	defer func() { require.NoError(t, s.Shutdown(context.Background())) }()
+
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{CallbackURL: staticSessionServerURL},
+		Request:              getDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}
+	qr, _, _, err := irmaServer.irma.StartSession(request, nil)
+	require.NoError(t, err)
+	bts, err := json.Marshal(qr)
+	require.NoError(t, err)
+
+	c := make(chan *SessionResult)
+	client.NewSession(string(bts), &TestHandler{t: t, c: c, client: client, expectedServerName: expectedRequestorInfo(t, client.Configuration)})
+	if result := <-c; result != nil {
+		require.NoError(t, result.Err)
+	}
+	require.Eventually(t, func() bool { return atomic.LoadInt32(&callbacks) == 1 }, 5*time.Second, 10*time.Millisecond)
+
+	// The client token cannot be used again after the session finished
+	transport := irma.NewHTTPTransport(qr.URL, false)
+	transport.SetHeader(irma.MinVersionHeader, "2.8")
+	transport.SetHeader(irma.MaxVersionHeader, "2.8")
+	transport.SetHeader(irma.AuthorizationHeader, "authorization")
+	err = transport.Post("proofs", nil, irma.Disclosure{})
+	require.Error(t, err)
+	require.Equal(t, string(server.ErrorSessionUnknown.Type), err.(*irma.SessionError).RemoteError.ErrorName)
+	time.Sleep(200 * time.Millisecond)
+	require.Equal(t, int32(1), atomic.LoadInt32(&callbacks))
+}
@@ -12,13 +12,13 @@ type Signer struct {
 	privateKey *ecdsa.PrivateKey
 }
 
-func NewSigner(t *testing.T) *Signer {
+func NewSigner(t testing.TB) *Signer {
 	privateKey, err := signed.GenerateKey()
 	require.NoError(t, err)
 	return &Signer{privateKey: privateKey}
 }
 
-func LoadSigner(t *testing.T, privateKey *ecdsa.PrivateKey) *Signer {
+func LoadSigner(t testing.TB, privateKey *ecdsa.PrivateKey) *Signer {
 	return &Signer{privateKey: privateKey}
 }
 
@@ -17,7 +17,7 @@ import (
 	"github.com/stretchr/testify/require"
 )
 
-func checkError(t *testing.T, err error) {
+func checkError(t testing.TB, err error) {
 	if err == nil {
 		return
 	}
@@ -69,7 +69,7 @@ func StopBadHttpServer() {
 
 // FindTestdataFolder finds the "testdata" folder which is in . or ..
 // depending on which package is calling us.
-func FindTestdataFolder(t *testing.T) string {
+func FindTestdataFolder(t testing.TB) string {
 	path := "testdata"
 
 	for i := 0; i < 4; i++ {
@@ -86,7 +86,7 @@ func FindTestdataFolder(t *testing.T) string {
 }
 
 // ClearTestStorage removes any output from previously run tests.
-func ClearTestStorage(t *testing.T, client io.Closer, storage string) {
+func ClearTestStorage(t testing.TB, client io.Closer, storage string) {
 	if client != nil {
 		checkError(t, client.Close())
 	}
@@ -102,14 +102,14 @@ func ClearAllTestStorage() {
 	}
 }
 
-func CreateTestStorage(t *testing.T) string {
+func CreateTestStorage(t testing.TB) string {
 	tmp, err := os.MkdirTemp("", "irmatest")
 	require.NoError(t, err)
 	checkError(t, common.EnsureDirectoryExists(filepath.Join(tmp, "client")))
 	return tmp
 }
 
-func SetupTestStorage(t *testing.T) string {
+func SetupTestStorage(t testing.TB) string {
 	storage := CreateTestStorage(t)
 	path := FindTestdataFolder(t)
 	err := common.CopyDirectory(filepath.Join(path, testStorageDir), filepath.Join(storage, "client"))
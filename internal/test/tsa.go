@@ -0,0 +1,192 @@
+package test
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	oidSignedData        = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo           = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidAttrContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSHA256            = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidECDSAWithSHA256   = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidTestPolicy        = asn1.ObjectIdentifier{1, 3, 6, 1, 4, 1, 99999, 1}
+)
+
+type tsaMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type tsaAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// TSA is an RFC 3161 timestamp authority for use in tests, of which the certificate is signed by
+// a self-signed root certificate.
+type TSA struct {
+	*httptest.Server
+	RootPEM string
+
+	key  *ecdsa.PrivateKey
+	cert *x509.Certificate
+}
+
+// StartTSA starts a TSA, which is stopped when the test finishes.
+func StartTSA(t *testing.T) *TSA {
+	rootKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	root := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "Test TSA root"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	rootDER, err := x509.CreateCertificate(rand.Reader, root, root, &rootKey.PublicKey, rootKey)
+	require.NoError(t, err)
+	root, err = x509.ParseCertificate(rootDER)
+	require.NoError(t, err)
+
+	tsa := &TSA{RootPEM: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: rootDER}))}
+	tsa.key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	certDER, err := x509.CreateCertificate(rand.Reader, &x509.Certificate{
+		SerialNumber: big.NewInt(2),
+		Subject:      pkix.Name{CommonName: "Test TSA"},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+	}, root, &tsa.key.PublicKey, rootKey)
+	require.NoError(t, err)
+	tsa.cert, err = x509.ParseCertificate(certDER)
+	require.NoError(t, err)
+
+	tsa.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, err := tsa.handle(r)
+		if err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		w.Header().Set("Content-Type", "application/timestamp-reply")
+		_, _ = w.Write(token)
+	}))
+	t.Cleanup(tsa.Close)
+	return tsa
+}
+
+func (tsa *TSA) handle(r *http.Request) ([]byte, error) {
+	bts, err := io.ReadAll(r.Body)
+	if err != nil {
+		return nil, err
+	}
+	var req struct {
+		Version        int
+		MessageImprint tsaMessageImprint
+		ReqPolicy      asn1.ObjectIdentifier `asn1:"optional"`
+		Nonce          *big.Int              `asn1:"optional"`
+		CertReq        bool                  `asn1:"optional"`
+	}
+	if _, err = asn1.Unmarshal(bts, &req); err != nil {
+		return nil, err
+	}
+
+	content, err := asn1.Marshal(struct {
+		Version        int
+		Policy         asn1.ObjectIdentifier
+		MessageImprint tsaMessageImprint
+		SerialNumber   *big.Int
+		GenTime        time.Time `asn1:"generalized"`
+		Nonce          *big.Int  `asn1:"optional"`
+	}{1, oidTestPolicy, req.MessageImprint, big.NewInt(time.Now().UnixNano()), time.Now().UTC(), req.Nonce})
+	if err != nil {
+		return nil, err
+	}
+
+	digest := sha256.Sum256(content)
+	contentType, _ := asn1.Marshal(oidTSTInfo)
+	messageDigest, _ := asn1.Marshal(digest[:])
+	signedAttrs, err := asn1.MarshalWithParams([]tsaAttribute{
+		{Type: oidAttrContentType, Values: []asn1.RawValue{{FullBytes: contentType}}},
+		{Type: oidAttrMessageDigest, Values: []asn1.RawValue{{FullBytes: messageDigest}}},
+	}, "set")
+	if err != nil {
+		return nil, err
+	}
+	hash := sha256.Sum256(signedAttrs)
+	signature, err := ecdsa.SignASN1(rand.Reader, tsa.key, hash[:])
+	if err != nil {
+		return nil, err
+	}
+	signedAttrs[0] = 0xA0 // implicit [0] tag instead of SET OF
+
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256}
+	certs, _ := asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: tsa.cert.Raw})
+	type signerInfo struct {
+		Version int
+		SID     struct {
+			Issuer       asn1.RawValue
+			SerialNumber *big.Int
+		}
+		DigestAlgorithm    pkix.AlgorithmIdentifier
+		SignedAttrs        asn1.RawValue
+		SignatureAlgorithm pkix.AlgorithmIdentifier
+		Signature          []byte
+	}
+	si := signerInfo{
+		Version:            1,
+		DigestAlgorithm:    sha256Alg,
+		SignedAttrs:        asn1.RawValue{FullBytes: signedAttrs},
+		SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDSAWithSHA256},
+		Signature:          signature,
+	}
+	si.SID.Issuer = asn1.RawValue{FullBytes: tsa.cert.RawIssuer}
+	si.SID.SerialNumber = tsa.cert.SerialNumber
+
+	type encapContentInfo struct {
+		EContentType asn1.ObjectIdentifier
+		EContent     []byte `asn1:"explicit,tag:0"`
+	}
+	signedData, err := asn1.Marshal(struct {
+		Version          int
+		DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+		EncapContentInfo encapContentInfo
+		Certificates     asn1.RawValue
+		SignerInfos      []signerInfo `asn1:"set"`
+	}{3, []pkix.AlgorithmIdentifier{sha256Alg}, encapContentInfo{oidTSTInfo, content}, asn1.RawValue{FullBytes: certs}, []signerInfo{si}})
+	if err != nil {
+		return nil, err
+	}
+
+	token, err := asn1.Marshal(struct {
+		ContentType asn1.ObjectIdentifier
+		Content     asn1.RawValue
+	}{oidSignedData, asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: signedData}})
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(struct {
+		Status         struct{ Status int }
+		TimeStampToken asn1.RawValue
+	}{TimeStampToken: asn1.RawValue{FullBytes: token}})
+}
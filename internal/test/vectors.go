@@ -0,0 +1,37 @@
+package test
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/stretchr/testify/require"
+)
+
+var updateVectors = flag.Bool("update-vectors", false, "write the test vectors in testdata/vectors instead of checking against them")
+
+// CheckVector checks that the serialized message equals the test vector at the specified path
+// within testdata/vectors, ignoring a trailing newline in the vector. If the tests are run with
+// -update-vectors, the message is written to the vector instead.
+func CheckVector(t *testing.T, path string, message []byte) {
+	path = filepath.Join(FindTestdataFolder(t), "vectors", path)
+	if *updateVectors {
+		require.NoError(t, common.EnsureDirectoryExists(filepath.Dir(path)))
+		require.NoError(t, os.WriteFile(path, append(message, '\n'), 0644))
+		return
+	}
+	vector, err := os.ReadFile(path)
+	require.NoError(t, err, "test vector missing: run the tests with -update-vectors to create it")
+	require.Equal(t, string(bytes.TrimSuffix(vector, []byte("\n"))), string(message),
+		"message differs from test vector %s", path)
+}
+
+// ReadVector returns the test vector at the specified path within testdata/vectors.
+func ReadVector(t *testing.T, path string) []byte {
+	vector, err := os.ReadFile(filepath.Join(FindTestdataFolder(t), "vectors", path))
+	require.NoError(t, err)
+	return bytes.TrimSuffix(vector, []byte("\n"))
+}
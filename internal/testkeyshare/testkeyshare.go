@@ -23,7 +23,7 @@ type KeyshareServer struct {
 	t *testing.T
 }
 
-func StartKeyshareServer(t *testing.T, l *logrus.Logger, schemeID irma.SchemeManagerIdentifier) *KeyshareServer {
+func StartKeyshareServer(t *testing.T, l *logrus.Logger, schemeID irma.SchemeManagerIdentifier, opts ...func(*keyshareserver.Configuration)) *KeyshareServer {
 	db := keyshareserver.NewMemoryDB()
 	err := db.AddUser(context.Background(), &keyshareserver.User{
 		Username: "",
@@ -56,7 +56,7 @@ func StartKeyshareServer(t *testing.T, l *logrus.Logger, schemeID irma.SchemeMan
 	require.NoError(t, err)
 
 	keyshareAttr := irma.NewAttributeTypeIdentifier(fmt.Sprintf("%s.test.mijnirma.email", schemeID))
-	s, err := keyshareserver.New(&keyshareserver.Configuration{
+	ksConf := &keyshareserver.Configuration{
 		Configuration: &server.Configuration{
 			IrmaConfiguration:     conf,
 			IssuerPrivateKeysPath: filepath.Join(testdataPath, "privatekeys"),
@@ -68,7 +68,11 @@ func StartKeyshareServer(t *testing.T, l *logrus.Logger, schemeID irma.SchemeMan
 		JwtPrivateKeyFile:     filepath.Join(testdataPath, "jwtkeys", "kss-sk.pem"),
 		StoragePrimaryKeyFile: filepath.Join(testdataPath, "keyshareStorageTestkey"),
 		KeyshareAttribute:     keyshareAttr,
-	})
+	}
+	for _, opt := range opts {
+		opt(ksConf)
+	}
+	s, err := keyshareserver.New(ksConf)
 	require.NoError(t, err)
 
 	keyshareServ := &KeyshareServer{http.Server{
@@ -2,10 +2,13 @@ package cmd
 
 import (
 	"crypto/tls"
+	"encoding/json"
+	"fmt"
 	"net/smtp"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strings"
 
 	irma "github.com/privacybydesign/irmago"
@@ -39,36 +42,122 @@ func configureEmail() keyshare.EmailConfiguration {
 		EmailAuth:       emailAuth,
 		EmailFrom:       viper.GetString("email_from"),
 		DefaultLanguage: viper.GetString("default_language"),
+		EmailRetries:    viper.GetInt("email_retries"),
 	}
 }
 
 func configureIRMAServer() (*server.Configuration, error) {
 	conf := &server.Configuration{
-		SchemesPath:            viper.GetString("schemes_path"),
-		SchemesAssetsPath:      viper.GetString("schemes_assets_path"),
-		SchemesUpdateInterval:  viper.GetInt("schemes_update"),
-		DisableSchemesUpdate:   viper.GetInt("schemes_update") == 0,
-		IssuerPrivateKeysPath:  viper.GetString("privkeys"),
-		RevocationDBType:       viper.GetString("revocation_db_type"),
-		RevocationDBConnStr:    viper.GetString("revocation_db_str"),
-		RevocationSettings:     irma.RevocationSettings{},
-		URL:                    viper.GetString("url"),
-		DisableTLS:             viper.GetBool("no_tls"),
-		Email:                  viper.GetString("email"),
-		EnableSSE:              viper.GetBool("sse"),
-		StoreType:              viper.GetString("store_type"),
-		Verbose:                viper.GetInt("verbose"),
-		Quiet:                  viper.GetBool("quiet"),
-		LogJSON:                viper.GetBool("log_json"),
-		Logger:                 logger,
-		Production:             viper.GetBool("production"),
-		MaxSessionLifetime:     viper.GetInt("max_session_lifetime"),
-		SessionResultLifetime:  viper.GetInt("session_result_lifetime"),
-		JwtIssuer:              viper.GetString("jwt_issuer"),
-		JwtPrivateKey:          viper.GetString("jwt_privkey"),
-		JwtPrivateKeyFile:      viper.GetString("jwt_privkey_file"),
-		AllowUnsignedCallbacks: viper.GetBool("allow_unsigned_callbacks"),
-		AugmentClientReturnURL: viper.GetBool("augment_client_return_url"),
+		SchemesPath:             viper.GetString("schemes_path"),
+		SchemesAssetsPath:       viper.GetString("schemes_assets_path"),
+		SchemesCachePath:        viper.GetString("schemes_cache_path"),
+		SchemesLogPath:          viper.GetString("schemes_log_path"),
+		SchemesLogSubmitURL:     viper.GetString("schemes_log_submit_url"),
+		SchemesUpdateInterval:   viper.GetInt("schemes_update"),
+		DisableSchemesUpdate:    viper.GetInt("schemes_update") == 0,
+		LazySchemes:             viper.GetBool("lazy_schemes"),
+		KeyshareJWKS:            viper.GetBool("keyshare_jwks"),
+		RequireKeyproofs:        viper.GetBool("require_keyproofs"),
+		ReissuanceHintDays:      viper.GetInt("reissuance_hint_days"),
+		IssuerPrivateKeysPath:   viper.GetString("privkeys"),
+		RevocationDBType:        viper.GetString("revocation_db_type"),
+		RevocationDBConnStr:     viper.GetString("revocation_db_str"),
+		RevocationSettings:      irma.RevocationSettings{},
+		URL:                     viper.GetString("url"),
+		FrontendURL:             viper.GetString("frontend_url"),
+		DisableTLS:              viper.GetBool("no_tls"),
+		Email:                   viper.GetString("email"),
+		EnableSSE:               viper.GetBool("sse"),
+		StoreType:               viper.GetString("store_type"),
+		StatelessSessionKeyFile: viper.GetString("stateless_session_key_file"),
+		Verbose:                 viper.GetInt("verbose"),
+		Quiet:                   viper.GetBool("quiet"),
+		LogJSON:                 viper.GetBool("log_json"),
+		Logger:                  logger,
+		Production:              viper.GetBool("production"),
+		MaxSessionLifetime:      viper.GetInt("max_session_lifetime"),
+		OfflineSessionLifetime:  viper.GetInt("offline_session_lifetime"),
+		SessionResultLifetime:   viper.GetInt("session_result_lifetime"),
+		SessionCleanupInterval:  viper.GetInt("session_cleanup_interval"),
+		SessionSnapshotFile:     viper.GetString("session_snapshot_file"),
+		SessionSnapshotInterval: viper.GetInt("session_snapshot_interval"),
+		StatusCacheDuration:     viper.GetInt("status_cache_duration"),
+		SessionHistory:          viper.GetBool("session_history"),
+		AirGapped:               viper.GetBool("air_gapped"),
+		JwtIssuer:               viper.GetString("jwt_issuer"),
+		JwtPrivateKey:           viper.GetString("jwt_privkey"),
+		JwtPrivateKeyFile:       viper.GetString("jwt_privkey_file"),
+		JwtSigner:               viper.GetString("jwt_signer"),
+		AttributeHashSaltFile:   viper.GetString("attribute_hash_salt_file"),
+		AllowUnsignedCallbacks:  viper.GetBool("allow_unsigned_callbacks"),
+		AugmentClientReturnURL:  viper.GetBool("augment_client_return_url"),
+		RotateClientAuth:        viper.GetBool("rotate_client_auth"),
+		SignSessionPointers:     viper.GetBool("sign_session_ptrs"),
+		KeyExpiryWarning:        viper.GetInt("key_expiry_warning"),
+
+		CallbackOutbox:             viper.GetBool("callback_outbox"),
+		CallbackRedeliveryInterval: viper.GetInt("callback_redelivery_interval"),
+		CallbackOutboxLifetime:     viper.GetInt("callback_outbox_lifetime"),
+
+		MaxSSEConnections:           viper.GetInt("max_sse_connections"),
+		MaxSSEConnectionsPerSession: viper.GetInt("max_sse_connections_per_session"),
+		SSEHeartbeatInterval:        viper.GetInt("sse_heartbeat_interval"),
+
+		SlowStoreOperationThreshold:  viper.GetInt("slow_store_operation_threshold"),
+		PublicConfigurationRateLimit: viper.GetInt("public_configuration_rate_limit"),
+		ProfileDir:                   viper.GetString("profile_dir"),
+		ProfileHeapThreshold:         viper.GetInt("profile_heap_threshold"),
+		MdocIssuerCertificatesFile:   viper.GetString("mdoc_issuer_certs_file"),
+	}
+
+	if err := handleJSONOrString("result_jwt_claims", &conf.ResultJwtClaims); err != nil {
+		return nil, err
+	}
+	if err := handleJSONOrString("issuance_policies", &conf.IssuancePolicies); err != nil {
+		return nil, err
+	}
+	if err := handleJSONOrString("mdoc_mapping", &conf.MdocMapping); err != nil {
+		return nil, err
+	}
+	if err := handleJSONOrString("keyshare_keys", &conf.KeyshareKeys); err != nil {
+		return nil, err
+	}
+	if err := handleJSONOrString("fallback_keys", &conf.FallbackKeys); err != nil {
+		return nil, err
+	}
+	if err := handleJSONOrString("outbound_http", &conf.OutboundHTTP); err != nil {
+		return nil, err
+	}
+	if err := handleJSONOrString("error_translations", &conf.ErrorTranslations); err != nil {
+		return nil, err
+	}
+	conf.StrictJSON = viper.GetStringSlice("strict_json")
+	conf.AlternativeURLs = viper.GetStringSlice("alternative_urls")
+	conf.TrustedProxies = viper.GetStringSlice("trusted_proxies")
+	conf.ForwardedHeaders = viper.GetStringSlice("forwarded_headers")
+	for _, id := range viper.GetStringSlice("pairing_required_credentials") {
+		conf.PairingRequiredCredentials = append(conf.PairingRequiredCredentials, irma.NewCredentialTypeIdentifier(id))
+	}
+	for _, id := range viper.GetStringSlice("allow_sunset_credentials") {
+		conf.AllowSunsetCredentials = append(conf.AllowSunsetCredentials, irma.NewCredentialTypeIdentifier(id))
+	}
+	conf.MockMode = viper.GetBool("mock_mode")
+	for _, attr := range viper.GetStringSlice("mock_attributes") {
+		id, value, ok := strings.Cut(attr, "=")
+		if !ok {
+			return nil, errors.Errorf("invalid mock attribute %s: must be of the form attribute-id=value", attr)
+		}
+		if conf.MockAttributes == nil {
+			conf.MockAttributes = map[string]string{}
+		}
+		conf.MockAttributes[id] = value
+	}
+	if viper.IsSet("issue_max_attr_length") || viper.IsSet("issue_attr_classes") || viper.IsSet("issue_attr_normalize") {
+		conf.AttributeValidation = &server.AttributeValidation{
+			MaxLength:      viper.GetInt("issue_max_attr_length"),
+			AllowedClasses: viper.GetStringSlice("issue_attr_classes"),
+			Normalize:      viper.GetBool("issue_attr_normalize"),
+		}
 	}
 
 	// Parse session store configuration
@@ -91,6 +180,7 @@ func configureIRMAServer() (*server.Configuration, error) {
 		conf.RedisSettings.SentinelUsername = viper.GetString("redis_sentinel_username")
 		conf.RedisSettings.SentinelPassword = viper.GetString("redis_sentinel_pw")
 		conf.RedisSettings.ACLUseKeyPrefixes = viper.GetBool("redis_acl_use_key_prefixes")
+		conf.RedisSettings.KeyPrefix = viper.GetString("redis_key_prefix")
 
 		conf.RedisSettings.DB = viper.GetInt("redis_db")
 
@@ -188,9 +278,126 @@ func readConfig(cmd *cobra.Command, name, logname string, configpaths []string,
 		}
 	} else {
 		logger.Info("Config file: ", viper.ConfigFileUsed())
+		if !viper.GetBool("no_strict_config") {
+			if err = checkConfigKeys(cmd.Flags(), viper.ConfigFileUsed()); err != nil {
+				die("", err)
+			}
+		}
+		if err = expandConfigValues(viper.ConfigFileUsed()); err != nil {
+			die("", err)
+		}
 	}
 }
 
+// checkConfigKeys returns an error listing all keys in the configuration file that do not
+// correspond to a flag, which viper would otherwise silently ignore (e.g. when misspelled).
+// Only the top-level keys are checked.
+func checkConfigKeys(flags *pflag.FlagSet, confpath string) error {
+	settings, err := readConfigFile(confpath)
+	if err != nil {
+		return err
+	}
+
+	var unknown []string
+	for key := range settings {
+		// The flags were normalized by readConfig to use underscores instead of dashes, like viper
+		if flag := flags.Lookup(key); flag == nil || flag.Name != key {
+			unknown = append(unknown, key)
+		}
+	}
+	if len(unknown) == 0 {
+		return nil
+	}
+	sort.Strings(unknown)
+	return errors.Errorf("Configuration file at %s contains unknown keys: %s (use --no-strict-config to ignore them)",
+		confpath, strings.Join(unknown, ", "))
+}
+
+// readConfigFile returns the settings in the configuration file only, i.e. without those from
+// flags, environment variables and defaults.
+func readConfigFile(confpath string) (map[string]interface{}, error) {
+	file := viper.New()
+	file.SetConfigFile(confpath)
+	if err := file.ReadInConfig(); err != nil {
+		return nil, errors.WrapPrefix(err, "Failed to unmarshal configuration file at "+confpath, 0)
+	}
+	return file.AllSettings(), nil
+}
+
+// envVarReference matches ${NAME} references to environment variables in configuration values,
+// and $${ with which a literal ${ can be written.
+var envVarReference = regexp.MustCompile(`\$\$\{|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandConfigValues resolves references in the string values of the configuration file, so
+// that secrets need not be included in it:
+//   - ${NAME} is replaced by the value of environment variable NAME, which must be set;
+//   - a value of the form file:<path> is replaced by the contents of that file, without trailing
+//     newlines. The path may itself contain ${NAME} references.
+//
+// The resolved values replace those of the configuration file in viper, so that flags and
+// environment variables still take precedence over them.
+func expandConfigValues(confpath string) error {
+	settings, err := readConfigFile(confpath)
+	if err != nil {
+		return err
+	}
+	var errs []string
+	expanded := expandConfigValue("", settings, &errs).(map[string]interface{})
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.Errorf("Failed to resolve values in configuration file at %s: %s", confpath, strings.Join(errs, "; "))
+	}
+	return viper.MergeConfigMap(expanded)
+}
+
+func expandConfigValue(key string, val interface{}, errs *[]string) interface{} {
+	switch v := val.(type) {
+	case map[string]interface{}:
+		m := make(map[string]interface{}, len(v))
+		for k, elem := range v {
+			m[k] = expandConfigValue(strings.TrimPrefix(key+"."+k, "."), elem, errs)
+		}
+		return m
+	case []interface{}:
+		l := make([]interface{}, len(v))
+		for i, elem := range v {
+			l[i] = expandConfigValue(fmt.Sprintf("%s[%d]", key, i), elem, errs)
+		}
+		return l
+	case string:
+		str, err := expandConfigString(v)
+		if err != nil {
+			*errs = append(*errs, key+": "+err.Error())
+		}
+		return str
+	default:
+		return val
+	}
+}
+
+func expandConfigString(val string) (string, error) {
+	var err error
+	val = envVarReference.ReplaceAllStringFunc(val, func(ref string) string {
+		if ref == "$${" {
+			return "${"
+		}
+		name := ref[2 : len(ref)-1]
+		envval, ok := os.LookupEnv(name)
+		if !ok && err == nil {
+			err = errors.Errorf("environment variable %s is not set", name)
+		}
+		return envval
+	})
+	if err != nil || !strings.HasPrefix(val, "file:") {
+		return val, err
+	}
+	bts, err := os.ReadFile(strings.TrimPrefix(val, "file:"))
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(bts), "\r\n"), nil
+}
+
 func handleMapOrString(key string, dest interface{}) error {
 	var m map[string]interface{}
 	var err error
@@ -208,6 +415,31 @@ func handleMapOrString(key string, dest interface{}) error {
 	return nil
 }
 
+// handleJSONOrString unmarshals the value of the specified key into dest, which can be either a
+// JSON string (when passed as flag or env var) or any structure in the configuration file.
+func handleJSONOrString(key string, dest interface{}) error {
+	val := viper.Get(key)
+	if val == nil || val == "" {
+		return nil
+	}
+	bts, isString := []byte(nil), false
+	if str, ok := val.(string); ok {
+		bts, isString = []byte(str), true
+	} else {
+		var err error
+		if bts, err = json.Marshal(val); err != nil {
+			return errors.WrapPrefix(err, "Failed to read "+key+" from config file", 0)
+		}
+	}
+	if err := json.Unmarshal(bts, dest); err != nil {
+		if isString {
+			return errors.WrapPrefix(err, "Failed to unmarshal "+key+" from flag or env var", 0)
+		}
+		return errors.WrapPrefix(err, "Failed to unmarshal "+key+" from config file", 0)
+	}
+	return nil
+}
+
 func handlePermission(typ string) []string {
 	if !viper.IsSet(typ) {
 		if typ == "revoke_perms" || (viper.GetBool("production") && typ == "issue_perms") {
@@ -0,0 +1,69 @@
+package cmd
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/stretchr/testify/require"
+)
+
+func TestCheckConfigKeys(t *testing.T) {
+	cmd := &cobra.Command{Use: "server"}
+	require.NoError(t, setFlags(cmd, false))
+	flags := cmd.Flags()
+	// as done by readConfig
+	flags.SetNormalizeFunc(func(_ *pflag.FlagSet, name string) pflag.NormalizedName {
+		return pflag.NormalizedName(strings.ReplaceAll(name, "-", "_"))
+	})
+
+	dir := t.TempDir()
+	valid := filepath.Join(dir, "valid.yml")
+	require.NoError(t, os.WriteFile(valid, []byte("port: 8088\nschemes_path: .\nrequestors:\n  app:\n    auth_method: token\n"), 0600))
+	require.NoError(t, checkConfigKeys(flags, valid))
+
+	invalid := filepath.Join(dir, "invalid.json")
+	require.NoError(t, os.WriteFile(invalid, []byte(`{"port": 8088, "requstors": {"app": {"auth_method": "token"}}, "schemes-path": ".", "no_tsl": true}`), 0600))
+	err := checkConfigKeys(flags, invalid)
+	require.Error(t, err)
+	require.Contains(t, err.Error(), "unknown keys: no_tsl, requstors, schemes-path")
+}
+
+func TestExpandConfigValues(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "token"), []byte("secret\n"), 0600))
+	t.Setenv("IRMA_TEST_DIR", dir)
+	t.Setenv("IRMA_TEST_USER", "user")
+
+	var errs []string
+	expanded := expandConfigValue("", map[string]interface{}{
+		"redis_username": "${IRMA_TEST_USER}",
+		"redis_pw":       "file:${IRMA_TEST_DIR}/token",
+		"email_password": "pa$$word$${IRMA_TEST_USER}",
+		"port":           8088,
+		"requestors": map[string]interface{}{
+			"app": map[string]interface{}{"key": "file:" + filepath.Join(dir, "token")},
+		},
+		"trusted_proxies": []interface{}{"${IRMA_TEST_USER}"},
+	}, &errs)
+	require.Empty(t, errs)
+	require.Equal(t, map[string]interface{}{
+		"redis_username": "user",
+		"redis_pw":       "secret",
+		"email_password": "pa$$word${IRMA_TEST_USER}",
+		"port":           8088,
+		"requestors": map[string]interface{}{
+			"app": map[string]interface{}{"key": "secret"},
+		},
+		"trusted_proxies": []interface{}{"user"},
+	}, expanded)
+
+	expandConfigValue("", map[string]interface{}{
+		"redis_pw":   "${IRMA_TEST_NONEXISTING}",
+		"requestors": map[string]interface{}{"app": map[string]interface{}{"key": "file:" + filepath.Join(dir, "nonexisting")}},
+	}, &errs)
+	require.Len(t, errs, 2)
+}
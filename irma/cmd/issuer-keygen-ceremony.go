@@ -0,0 +1,222 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"golang.org/x/term"
+)
+
+const keyCeremonyMinContribution = 32
+
+// keyCeremony lets multiple operators contribute entropy to the generation of an issuer keypair.
+// The final transcript hash keys a stream that is XORed with the system randomness, so that the
+// keys are unpredictable to anyone not knowing all contributions even if the system randomness
+// is flawed.
+type keyCeremony struct {
+	issuer        string
+	counter       uint
+	keylength     int
+	numAttributes int
+	expiryDate    time.Time
+	started       time.Time
+
+	operators     []string
+	contributions [][sha256.Size]byte // hashes of the contributions
+	transcript    [][sha256.Size]byte // transcript hash after each contribution
+}
+
+func newKeyCeremony(issuer string, operators []string, counter uint, keylength, numAttributes int, expiryDate time.Time) *keyCeremony {
+	return &keyCeremony{
+		issuer:        issuer,
+		operators:     operators,
+		counter:       counter,
+		keylength:     keylength,
+		numAttributes: numAttributes,
+		expiryDate:    expiryDate,
+		started:       time.Now(),
+	}
+}
+
+// collect asks each operator in turn to enter their contribution, which is not echoed if
+// stdin is a terminal.
+func (c *keyCeremony) collect() error {
+	in := bufio.NewReader(os.Stdin)
+	for _, operator := range c.operators {
+		fmt.Printf("Operator %s, type at least %d random characters and press enter: ", operator, keyCeremonyMinContribution)
+		var (
+			contribution []byte
+			err          error
+		)
+		if fd := int(os.Stdin.Fd()); term.IsTerminal(fd) {
+			contribution, err = term.ReadPassword(fd)
+		} else {
+			contribution, err = in.ReadBytes('\n')
+			if err == io.EOF && len(contribution) > 0 {
+				err = nil
+			}
+		}
+		fmt.Println()
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read contribution of "+operator, 0)
+		}
+		contribution = []byte(strings.TrimSpace(string(contribution)))
+		if len(contribution) < keyCeremonyMinContribution {
+			return errors.Errorf("contribution of %s is shorter than %d characters", operator, keyCeremonyMinContribution)
+		}
+		c.contribute(operator, contribution)
+	}
+	return nil
+}
+
+func (c *keyCeremony) contribute(operator string, contribution []byte) {
+	hash := sha256.Sum256(contribution)
+	c.contributions = append(c.contributions, hash)
+	c.transcript = append(c.transcript, c.hash(c.last(), []byte(operator), hash[:]))
+}
+
+// last returns the current transcript hash, which for the first contribution commits to the
+// parameters of the keypair.
+func (c *keyCeremony) last() []byte {
+	if len(c.transcript) == 0 {
+		params := fmt.Sprintf("irma issuer key ceremony\n%s\n%d\n%d\n%d\n%d",
+			c.issuer, c.counter, c.keylength, c.numAttributes, c.expiryDate.Unix())
+		h := sha256.Sum256([]byte(params))
+		return h[:]
+	}
+	return c.transcript[len(c.transcript)-1][:]
+}
+
+// hash hashes the length-prefixed inputs.
+func (c *keyCeremony) hash(inputs ...[]byte) [sha256.Size]byte {
+	h := sha256.New()
+	for _, input := range inputs {
+		_ = binary.Write(h, binary.BigEndian, uint32(len(input)))
+		h.Write(input)
+	}
+	var sum [sha256.Size]byte
+	copy(sum[:], h.Sum(nil))
+	return sum
+}
+
+// streamKey returns the key of the stream mixed into the system randomness. It is derived from
+// the transcript hash after the last contribution, which is included in the report, using a
+// domain-separated hash.
+func (c *keyCeremony) streamKey() []byte {
+	key := c.hash([]byte("irma issuer key ceremony stream key"), c.last())
+	return key[:]
+}
+
+// reader returns a reader of the specified system randomness mixed with the contributions,
+// from which the keypair is generated.
+func (c *keyCeremony) reader(system io.Reader) io.Reader {
+	return &ceremonyReader{system: system, key: c.streamKey()}
+}
+
+// report returns the printable report of the ceremony, including the final transcript hash
+// committing to the public key.
+func (c *keyCeremony) report(pubkeyfile string) (string, error) {
+	pk, err := os.ReadFile(pubkeyfile)
+	if err != nil {
+		return "", err
+	}
+	pkHash := sha256.Sum256(pk)
+	final := c.hash(c.last(), pk)
+
+	var b strings.Builder
+	line := func(format string, args ...interface{}) { _, _ = fmt.Fprintf(&b, format+"\n", args...) }
+	line("IRMA issuer key ceremony report")
+	line("===============================")
+	line("")
+	line("Issuer:             %s", c.issuer)
+	line("Key counter:        %d", c.counter)
+	line("Key length:         %d", c.keylength)
+	line("Attributes:         %d", c.numAttributes)
+	line("Expiry date:        %s", c.expiryDate.UTC().Format(time.RFC3339))
+	line("Started:            %s", c.started.UTC().Format(time.RFC3339))
+	line("Finished:           %s", time.Now().UTC().Format(time.RFC3339))
+	line("irma version:       %s", irma.Version)
+	line("")
+	line("Contributions (SHA256 of contribution, transcript hash after contribution):")
+	for i, operator := range c.operators {
+		line("%2d. %s", i+1, operator)
+		line("    %s", hex.EncodeToString(c.contributions[i][:]))
+		line("    %s", hex.EncodeToString(c.transcript[i][:]))
+	}
+	line("")
+	line("Public key:         %s", filepath.Base(pubkeyfile))
+	line("Public key SHA256:  %s", hex.EncodeToString(pkHash[:]))
+	line("Transcript hash:    %s", hex.EncodeToString(final[:]))
+	line("")
+	line("Each operator confirms that the contribution hash listed above matches the contribution")
+	line("they entered, and that the ceremony was performed as documented in this report.")
+	for _, operator := range c.operators {
+		line("")
+		line("%s", operator)
+		line("Signature: ______________________________   Date: ______________")
+	}
+	return b.String(), nil
+}
+
+// writeReport prints the report and writes it to the specified file, or to
+// Ceremonies/$counter.txt within the issuer directory.
+func (c *keyCeremony) writeReport(path, reportfile, pubkeyfile string) error {
+	report, err := c.report(pubkeyfile)
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to create ceremony report", 0)
+	}
+	if reportfile == "" {
+		dir := filepath.Join(path, "Ceremonies")
+		if err = common.EnsureDirectoryExists(dir); err != nil {
+			return errors.WrapPrefix(err, "Failed to create"+dir, 0)
+		}
+		reportfile = filepath.Join(dir, fmt.Sprintf("%d.txt", c.counter))
+	}
+	if err = os.WriteFile(reportfile, []byte(report), 0644); err != nil {
+		return errors.WrapPrefix(err, "failed to write ceremony report", 0)
+	}
+	fmt.Println()
+	fmt.Print(report)
+	fmt.Println()
+	fmt.Println("Ceremony report written to", reportfile)
+	return nil
+}
+
+// ceremonyReader XORs the system randomness with a SHA256-based stream keyed by streamKey().
+type ceremonyReader struct {
+	sync.Mutex
+	system  io.Reader
+	key     []byte
+	counter uint64
+	block   []byte
+}
+
+func (r *ceremonyReader) Read(b []byte) (int, error) {
+	n, err := r.system.Read(b)
+	r.Lock()
+	defer r.Unlock()
+	for i := 0; i < n; i++ {
+		if len(r.block) == 0 {
+			var ctr [8]byte
+			binary.BigEndian.PutUint64(ctr[:], r.counter)
+			r.counter++
+			block := sha256.Sum256(append(append([]byte{}, r.key...), ctr[:]...))
+			r.block = block[:]
+		}
+		b[i] ^= r.block[0]
+		r.block = r.block[1:]
+	}
+	return n, err
+}
@@ -0,0 +1,56 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func testKeyCeremony(contributions ...string) *keyCeremony {
+	operators := []string{"alice", "bob"}
+	c := newKeyCeremony("issuer", operators, 2, 2048, 6, time.Unix(1700000000, 0))
+	for i, contribution := range contributions {
+		c.contribute(operators[i], []byte(contribution))
+	}
+	return c
+}
+
+func TestKeyCeremonyTranscript(t *testing.T) {
+	c1 := testKeyCeremony("first contribution", "second contribution")
+	c2 := testKeyCeremony("first contribution", "second contribution")
+	require.Equal(t, c1.transcript, c2.transcript)
+	require.Equal(t, c1.streamKey(), c2.streamKey())
+
+	// The stream is determined by the transcript only, so given the same system randomness
+	// the same randomness is produced
+	zeros := make([]byte, 100)
+	out1, out2 := make([]byte, 100), make([]byte, 100)
+	_, err := io.ReadFull(c1.reader(bytes.NewReader(zeros)), out1)
+	require.NoError(t, err)
+	_, err = io.ReadFull(c2.reader(bytes.NewReader(zeros)), out2)
+	require.NoError(t, err)
+	require.Equal(t, out1, out2)
+	require.NotEqual(t, zeros, out1)
+
+	c3 := testKeyCeremony("first contribution", "other contribution")
+	require.Equal(t, c1.transcript[0], c3.transcript[0])
+	require.NotEqual(t, c1.transcript[1], c3.transcript[1])
+	require.NotEqual(t, c1.streamKey(), c3.streamKey())
+}
+
+func TestKeyCeremonyReport(t *testing.T) {
+	c := testKeyCeremony("first contribution", "second contribution")
+	pubkeyfile := filepath.Join(t.TempDir(), "2.xml")
+	require.NoError(t, os.WriteFile(pubkeyfile, []byte("<IssuerPublicKey/>"), 0644))
+
+	report, err := c.report(pubkeyfile)
+	require.NoError(t, err)
+	require.Contains(t, report, hex.EncodeToString(c.transcript[len(c.transcript)-1][:]))
+	require.NotContains(t, report, hex.EncodeToString(c.streamKey()))
+}
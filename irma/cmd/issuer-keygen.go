@@ -1,15 +1,19 @@
 package cmd
 
 import (
+	"crypto/rand"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/gabi/keyproof"
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/spf13/cobra"
 )
@@ -26,7 +30,17 @@ By default the keys are stored within the PrivateKeys and PublicKeys subfolder o
 created if necessary), next to any existing private-public keypairs.
 
 After adding keys, the scheme must be resigned (using "irma scheme sign") before it can be used in
-IRMA applications.`,
+IRMA applications.
+
+With --ceremony, the keypair is generated in a key ceremony: each of the specified operators in turn
+contributes entropy, which is mixed into the system randomness from which the keys are generated.
+The hashes of the contributions and of the public key are combined into a transcript hash, and
+documented in a printable ceremony report (by default Ceremonies/$counter.txt within "path") that
+the operators can sign.
+
+With --keyprove, a proof of the validity of the keypair (see "irma issuer keyprove") is generated
+after the keypair and stored in the Proofs subfolder of "path", so that IRMA servers can require
+valid keyproofs.`,
 	RunE: func(cmd *cobra.Command, args []string) error {
 		flags := cmd.Flags()
 		keylength, _ := flags.GetInt("keylength")
@@ -37,6 +51,9 @@ IRMA applications.`,
 		overwrite, _ := flags.GetBool("force-overwrite")
 		expiryDateString, _ := flags.GetString("expirydate")
 		validFor, _ := flags.GetString("valid-for")
+		operators, _ := flags.GetStringSlice("ceremony")
+		reportfile, _ := flags.GetString("ceremony-report")
+		keyprove, _ := flags.GetBool("keyprove")
 
 		var expiryDate time.Time
 		var err error
@@ -87,13 +104,26 @@ IRMA applications.`,
 			counter = uint(defaultCounter(path))
 		}
 
-		// Now generate the key pair
-		fmt.Println("Generating keys (may take several minutes)")
 		sysParams, ok := gabikeys.DefaultSystemParameters[keylength]
 		if !ok {
 			return errors.Errorf("Unsupported key length, should be one of %v", gabikeys.DefaultKeyLengths)
 		}
-		privk, pubk, err := gabikeys.GenerateKeyPair(sysParams, numAttributes, counter, expiryDate)
+
+		var ceremony *keyCeremony
+		if len(operators) > 0 {
+			ceremony = newKeyCeremony(filepath.Base(path), operators, counter, keylength, numAttributes, expiryDate)
+			if err = ceremony.collect(); err != nil {
+				return err
+			}
+		}
+
+		// Now generate the key pair
+		fmt.Println("Generating keys (may take several minutes)")
+		random := rand.Reader
+		if ceremony != nil {
+			random = ceremony.reader(rand.Reader)
+		}
+		privk, pubk, err := generateKeyPair(random, sysParams, numAttributes, counter, expiryDate)
 		if err != nil {
 			return err
 		}
@@ -120,6 +150,20 @@ IRMA applications.`,
 		if _, err = pubk.WriteToFile(pubkeyfile, overwrite); err != nil {
 			return errors.New("public key file already exists, will not overwrite (force with -f flag)")
 		}
+		if keyprove {
+			if !keyproof.CanProve(privk.PPrime, privk.QPrime) {
+				return errors.New("private key not eligible to proving")
+			}
+			proofpath := filepath.Join(path, "Proofs")
+			if err = common.EnsureDirectoryExists(proofpath); err != nil {
+				return errors.WrapPrefix(err, "Failed to create"+proofpath, 0)
+			}
+			fmt.Println("Generating keyproof (may take several minutes)")
+			writeKeyproof(privk, pubk, filepath.Join(proofpath, strconv.Itoa(int(counter))+".json.gz"))
+		}
+		if ceremony != nil {
+			return ceremony.writeReport(path, reportfile, pubkeyfile)
+		}
 		return nil
 	},
 }
@@ -151,4 +195,24 @@ func init() {
 	issuerKeygenCmd.Flags().UintP("counter", "c", 0, "Override key counter")
 	issuerKeygenCmd.Flags().IntP("numattributes", "a", 12, "Number of attributes")
 	issuerKeygenCmd.Flags().BoolP("force-overwrite", "f", false, "Force overwriting of key files if files already exist")
+	issuerKeygenCmd.Flags().Bool("keyprove", false, `Also generate a proof of validity of the keypair (in "Proofs`+string(os.PathSeparator)+`$counter.json.gz")`)
+	issuerKeygenCmd.Flags().StringSlice("ceremony", nil, "Generate the keys in a key ceremony in which these operators (comma-separated) contribute entropy")
+	issuerKeygenCmd.Flags().String("ceremony-report", "", `File to write the ceremony report to (default "Ceremonies`+string(os.PathSeparator)+`$counter.txt")`)
+}
+
+var generateKeyPairMutex sync.Mutex
+
+// generateKeyPair generates a keypair using the specified randomness. As gabi only reads from
+// crypto/rand.Reader, that is replaced by the specified reader while the keypair is generated.
+func generateKeyPair(random io.Reader, sysParams *gabikeys.SystemParameters, numAttributes int, counter uint, expiryDate time.Time) (
+	*gabikeys.PrivateKey, *gabikeys.PublicKey, error) {
+	if random == rand.Reader {
+		return gabikeys.GenerateKeyPair(sysParams, numAttributes, counter, expiryDate)
+	}
+	generateKeyPairMutex.Lock()
+	defer generateKeyPairMutex.Unlock()
+	system := rand.Reader
+	rand.Reader = random
+	defer func() { rand.Reader = system }()
+	return gabikeys.GenerateKeyPair(sysParams, numAttributes, counter, expiryDate)
 }
@@ -13,6 +13,7 @@ import (
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
 	"github.com/privacybydesign/gabi/keyproof"
+	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/spf13/cobra"
 )
@@ -100,43 +101,7 @@ may be used.`,
 			prooffile = filepath.Join(proofpath, strconv.Itoa(int(counter))+".json.gz")
 		}
 
-		// Open proof file for writing
-		proofOut, err := os.Create(prooffile)
-		if err != nil {
-			die("Error opening proof file for writing", err)
-		}
-		defer closeCloser(proofOut)
-
-		// Wrap it for gzip compression
-		proofWriter := gzip.NewWriter(proofOut)
-		defer closeCloser(proofWriter)
-
-		// Start log follower
-		follower := startLogFollower()
-		defer func() {
-			follower.quitEvents <- quitMessage{}
-			<-follower.finished
-		}()
-
-		// Build the proof
-		bases := []*big.Int{pk.Z, pk.S}
-		if pk.G != nil {
-			bases = append(bases, pk.G)
-		}
-		if pk.H != nil {
-			bases = append(bases, pk.H)
-		}
-		s := keyproof.NewValidKeyProofStructure(pk.N, append(bases, pk.R...))
-		proof := s.BuildProof(sk.PPrime, sk.QPrime)
-
-		// And write it to file
-		follower.StepStart("Writing proof", 0)
-		proofEncoder := json.NewEncoder(proofWriter)
-		err = proofEncoder.Encode(proof)
-		follower.StepDone()
-		if err != nil {
-			die("Could not write proof", err)
-		}
+		writeKeyproof(sk, pk, prooffile)
 	},
 }
 
@@ -149,6 +114,40 @@ func init() {
 	issuerKeyproveCmd.Flags().UintP("counter", "c", 0, "Counter of key to prove (defaults to latest)")
 }
 
+// writeKeyproof generates the keyproof of the keypair, and writes it to the specified file.
+func writeKeyproof(sk *gabikeys.PrivateKey, pk *gabikeys.PublicKey, prooffile string) {
+	// Open proof file for writing
+	proofOut, err := os.Create(prooffile)
+	if err != nil {
+		die("Error opening proof file for writing", err)
+	}
+	defer closeCloser(proofOut)
+
+	// Wrap it for gzip compression
+	proofWriter := gzip.NewWriter(proofOut)
+	defer closeCloser(proofWriter)
+
+	// Start log follower
+	follower := startLogFollower()
+	defer func() {
+		follower.quitEvents <- quitMessage{}
+		<-follower.finished
+	}()
+
+	// Build the proof
+	s := irma.KeyproofStructure(pk)
+	proof := s.BuildProof(sk.PPrime, sk.QPrime)
+
+	// And write it to file
+	follower.StepStart("Writing proof", 0)
+	proofEncoder := json.NewEncoder(proofWriter)
+	err = proofEncoder.Encode(proof)
+	follower.StepDone()
+	if err != nil {
+		die("Could not write proof", err)
+	}
+}
+
 func lastPrivateKeyIndex(path string) (counter int) {
 	matches, _ := filepath.Glob(filepath.Join(path, "PrivateKeys", "*.xml"))
 	for _, match := range matches {
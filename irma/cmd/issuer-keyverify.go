@@ -9,9 +9,9 @@ import (
 	"path/filepath"
 	"strconv"
 
-	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
 	"github.com/privacybydesign/gabi/keyproof"
+	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/spf13/cobra"
 )
@@ -102,14 +102,7 @@ On machines of 2 - 3 GHz verification will take some 5 - 15 minutes, during whic
 		follower.StepDone()
 
 		// Construct proof structure
-		bases := []*big.Int{pk.Z, pk.S}
-		if pk.G != nil {
-			bases = append(bases, pk.G)
-		}
-		if pk.H != nil {
-			bases = append(bases, pk.H)
-		}
-		s := keyproof.NewValidKeyProofStructure(pk.N, append(bases, pk.R...))
+		s := irma.KeyproofStructure(pk)
 
 		// And use it to validate the proof
 		if !s.VerifyProof(proof) {
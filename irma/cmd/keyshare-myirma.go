@@ -39,6 +39,7 @@ func init() {
 	flags.SortFlags = false
 
 	flags.StringP("config", "c", "", "path to configuration file")
+	flags.Bool("no-strict-config", false, "do not refuse to start when the configuration file contains unknown keys")
 	flags.StringP("schemes-path", "s", irma.DefaultSchemesPath(), "path to irma_configuration")
 	flags.String("schemes-assets-path", irma.DefaultSchemesAssetsPath(), "if specified, copy schemes from here into --schemes-path")
 	flags.Int("schemes-update", 60, "update IRMA schemes every x minutes (0 to disable)")
@@ -49,7 +50,7 @@ func init() {
 
 	headers["port"] = "Server address and port to listen on"
 	flags.IntP("port", "p", 8080, "port at which to listen")
-	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
+	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0), or unix:<path> or systemd[:<name>] to use a Unix domain socket or a socket passed by systemd")
 	flags.StringSlice("cors-allowed-origins", nil, "CORS allowed origins")
 
 	headers["db-type"] = "Database configuration"
@@ -72,6 +73,7 @@ func init() {
 	flags.String("redis-sentinel-pw", "", "Redis Sentinel password")
 	flags.Bool("redis-allow-empty-password", false, "explicitly allow an empty string as Redis password")
 	flags.Bool("redis-acl-use-key-prefixes", false, "if enabled all Redis keys will be prefixed with the username for ACLs (username:key)")
+	flags.String("redis-key-prefix", "", "prefix for all Redis keys (prefix:key), to share a Redis database between multiple servers")
 	flags.Int("redis-db", 0, "database to be selected after connecting to the server (default 0)")
 	flags.String("redis-tls-cert", "", "use Redis TLS with specific certificate or certificate authority")
 	flags.String("redis-tls-cert-file", "", "use Redis TLS path to specific certificate or certificate authority")
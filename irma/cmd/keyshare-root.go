@@ -2,7 +2,6 @@ package cmd
 
 import (
 	"context"
-	"fmt"
 	"net/http"
 	"os"
 	"os/signal"
@@ -29,15 +28,17 @@ type stoppableServer interface {
 }
 
 func runServer(serv stoppableServer, logger *logrus.Logger) {
-	// Determine full listening address.
-	fullAddr := fmt.Sprintf("%s:%d", viper.GetString("listen_addr"), viper.GetInt("port"))
-	logger.Info("Server listening at ", fullAddr)
+	listenAddr, port := viper.GetString("listen_addr"), viper.GetInt("port")
+	listener, err := server.Listen(listenAddr, port)
+	if err != nil {
+		die("Failed to listen", err)
+	}
+	logger.Info("Server listening at ", server.FullListenAddress(listenAddr, port))
 
 	// Load TLS configuration
 	TLSConfig := configureTLS()
 
 	httpServer := &http.Server{
-		Addr:              fullAddr,
 		Handler:           serv.Handler(),
 		TLSConfig:         TLSConfig,
 		ReadHeaderTimeout: server.ReadTimeout,
@@ -50,9 +51,9 @@ func runServer(serv stoppableServer, logger *logrus.Logger) {
 	go func() {
 		var err error
 		if TLSConfig != nil {
-			err = server.FilterStopError(httpServer.ListenAndServeTLS("", ""))
+			err = server.FilterStopError(httpServer.ServeTLS(listener, "", ""))
 		} else {
-			err = server.FilterStopError(httpServer.ListenAndServe())
+			err = server.FilterStopError(httpServer.Serve(listener))
 		}
 		if err != nil {
 			_ = server.LogError(err)
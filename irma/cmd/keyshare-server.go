@@ -39,6 +39,7 @@ func init() {
 	flags := keyshareServerCmd.Flags()
 	flags.SortFlags = false
 	flags.StringP("config", "c", "", "path to configuration file")
+	flags.Bool("no-strict-config", false, "do not refuse to start when the configuration file contains unknown keys")
 	flags.StringP("schemes-path", "s", irma.DefaultSchemesPath(), "path to irma_configuration")
 	flags.String("schemes-assets-path", irma.DefaultSchemesAssetsPath(), "if specified, copy schemes from here into --schemes-path")
 	flags.Int("schemes-update", 60, "update IRMA schemes every x minutes (0 to disable)")
@@ -47,7 +48,7 @@ func init() {
 
 	headers["port"] = "Server address and port to listen on"
 	flags.IntP("port", "p", 8080, "port at which to listen")
-	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0)")
+	flags.StringP("listen-addr", "l", "", "address at which to listen (default 0.0.0.0), or unix:<path> or systemd[:<name>] to use a Unix domain socket or a socket passed by systemd")
 
 	headers["db-type"] = "Database configuration"
 	flags.String("db-type", string(keyshareserver.DBTypePostgres), "Type of database to connect keyshare server to")
@@ -69,6 +70,7 @@ func init() {
 	flags.String("redis-sentinel-pw", "", "Redis Sentinel password")
 	flags.Bool("redis-allow-empty-password", false, "explicitly allow an empty string as Redis password")
 	flags.Bool("redis-acl-use-key-prefixes", false, "if enabled all Redis keys will be prefixed with the username for ACLs (username:key)")
+	flags.String("redis-key-prefix", "", "prefix for all Redis keys (prefix:key), to share a Redis database between multiple servers")
 	flags.Int("redis-db", 0, "database to be selected after connecting to the server (default 0)")
 	flags.String("redis-tls-cert", "", "use Redis TLS with specific certificate or certificate authority")
 	flags.String("redis-tls-cert-file", "", "use Redis TLS path to specific certificate or certificate authority")
@@ -83,8 +85,25 @@ func init() {
 	flags.String("jwt-issuer", keysharecore.JWTIssuerDefault, "JWT issuer used in \"iss\" field")
 	flags.Int("jwt-pin-expiry", keysharecore.JWTPinExpiryDefault, "Expiry of PIN JWT in seconds")
 	flags.String("storage-primary-key-file", "", "Primary key used for encrypting and decrypting secure containers")
+	flags.String("migration-key-file", "", "Key shared with another keyshare server, used for migrating users between the two (migration is disabled if not specified)")
 	flags.String("storage-fallback-keys-dir", "", "Directory containing fallback key(s) used to decrypt older secure containers (only .key files are considered; the storage primary key file and hidden files are ignored)")
 
+	headers["pin-min-length"] = "PIN policy and hashing"
+	flags.Int("pin-min-length", irma.KeysharePinPolicyDefault.MinLength, "Minimum length of new PINs, enforced by the IRMA app")
+	flags.Int("pin-max-length", 0, "Maximum length of new PINs, enforced by the IRMA app (0 means no maximum)")
+	flags.Int("pin-min-distinct-chars", 0, "Minimum number of distinct characters in new PINs, enforced by the IRMA app")
+	flags.Uint32("pin-hash-memory", keysharecore.PinHashParametersDefault.Memory, "Argon2id memory in KiB with which PINs are hashed (existing PIN hashes are upgraded on next login)")
+	flags.Uint32("pin-hash-iterations", keysharecore.PinHashParametersDefault.Iterations, "Argon2id iterations with which PINs are hashed")
+	flags.Uint8("pin-hash-parallelism", keysharecore.PinHashParametersDefault.Parallelism, "Argon2id parallelism with which PINs are hashed")
+
+	headers["admin-token"] = "Administration"
+	flags.String("admin-token", "", "Token authorizing requests to export the data stored about users at /admin/users/{username}/export, and to import migrated users without their PIN (disabled if not specified)")
+
+	headers["cosigner-url"] = "Splitting keyshare secrets with a cosigner"
+	flags.String("cosigner-url", "", "URL of the keyshare server with which the keyshare secrets of new users are split (disabled if not specified)")
+	flags.String("cosigner-token", "", "Token with which this server authenticates to the cosigner")
+	flags.String("cosigning-token", "", "Token authorizing another keyshare server to use this server as its cosigner (disabled if not specified)")
+
 	headers["keyshare-attribute"] = "Keyshare server attribute issued during registration"
 	flags.String("keyshare-attribute", "", "Attribute identifier that contains username")
 
@@ -94,11 +113,17 @@ func init() {
 	flags.String("email-username", "", "Username to use when authenticating with email server")
 	flags.String("email-password", "", "Password to use when authenticating with email server")
 	flags.String("email-from", "", "Email address to use as sender address")
+	flags.Int("email-retries", 0, "Number of times sending a notification email is retried after failing")
 	flags.String("default-language", "en", "Default language, used as fallback when users preferred language is not available")
 	flags.StringToString("registration-email-subjects", nil, "Translated subject lines for the registration email")
 	flags.StringToString("registration-email-files", nil, "Translated emails for the registration email")
 	flags.StringToString("verification-url", nil, "Base URL for the email verification link (localized)")
 	flags.Int("email-token-validity", 168, "Validity of email token in hours")
+	flags.StringToString("pin-blocked-email-subjects", nil, "Translated subject lines for the email notifying users that their account is blocked after too many wrong PINs")
+	flags.StringToString("pin-blocked-email-files", nil, "Translated emails notifying users that their account is blocked after too many wrong PINs")
+	flags.StringToString("device-enrolled-email-subjects", nil, "Translated subject lines for the email notifying users of the registration of a device key for their account")
+	flags.StringToString("device-enrolled-email-files", nil, "Translated emails notifying users of the registration of a device key for their account")
+	flags.Int("email-queue-size", 100, "Maximum number of notification emails awaiting delivery")
 
 	headers["tls-cert"] = "TLS configuration (leave empty to disable TLS)"
 	flags.String("tls-cert", "", "TLS certificate (chain)")
@@ -141,6 +166,20 @@ func configureKeyshareServer(cmd *cobra.Command) (*keyshareserver.Configuration,
 		JwtPinExpiry:           viper.GetInt("jwt_pin_expiry"),
 		StoragePrimaryKeyFile:  viper.GetString("storage_primary_key_file"),
 		StorageFallbackKeysDir: viper.GetString("storage_fallback_keys_dir"),
+		MigrationKeyFile:       viper.GetString("migration_key_file"),
+
+		PinMinLength:             viper.GetInt("pin_min_length"),
+		PinMaxLength:             viper.GetInt("pin_max_length"),
+		PinMinDistinctCharacters: viper.GetInt("pin_min_distinct_chars"),
+		PinHashMemory:            viper.GetUint32("pin_hash_memory"),
+		PinHashIterations:        viper.GetUint32("pin_hash_iterations"),
+		PinHashParallelism:       uint8(viper.GetUint("pin_hash_parallelism")),
+
+		AdminToken: viper.GetString("admin_token"),
+
+		CosignerURL:    viper.GetString("cosigner_url"),
+		CosignerToken:  viper.GetString("cosigner_token"),
+		CosigningToken: viper.GetString("cosigning_token"),
 
 		KeyshareAttribute: irma.NewAttributeTypeIdentifier(viper.GetString("keyshare_attribute")),
 
@@ -148,6 +187,12 @@ func configureKeyshareServer(cmd *cobra.Command) (*keyshareserver.Configuration,
 		RegistrationEmailFiles:    viper.GetStringMapString("registration_email_files"),
 		VerificationURL:           viper.GetStringMapString("verification_url"),
 		EmailTokenValidity:        viper.GetInt("email_token_validity"),
+
+		PinBlockedEmailSubjects:     viper.GetStringMapString("pin_blocked_email_subjects"),
+		PinBlockedEmailFiles:        viper.GetStringMapString("pin_blocked_email_files"),
+		DeviceEnrolledEmailSubjects: viper.GetStringMapString("device_enrolled_email_subjects"),
+		DeviceEnrolledEmailFiles:    viper.GetStringMapString("device_enrolled_email_files"),
+		EmailQueueSize:              viper.GetInt("email_queue_size"),
 	}
 
 	if conf.Production && conf.DBType != keyshareserver.DBTypePostgres {
@@ -28,6 +28,7 @@ func init() {
 	flags.SortFlags = false
 
 	flags.StringP("config", "c", "", "path to configuration file")
+	flags.Bool("no-strict-config", false, "do not refuse to start when the configuration file contains unknown keys")
 
 	headers["db-str"] = "Database configuration"
 	flags.String("db-str", "", "Database server connection string")
@@ -0,0 +1,54 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/go-errors/errors"
+	"github.com/spf13/cobra"
+)
+
+var requestLintCmd = &cobra.Command{
+	Use:   "lint",
+	Short: "Check the condiscon of a session request for problems",
+	Long: `The lint command checks the attributes that a session request asks users to disclose
+for redundant or duplicate disjunctions and options, options that can never be satisfied, and
+disjunctions that can be merged, using the installed schemes. The session request is specified
+like for the request command, either as a complete session request using --request, or using
+the other flags.
+
+The command fails if problems are found. Specify --fix to print the session request with the
+optimized condiscon, in which options are also ordered by the effort it takes users to satisfy
+them.`,
+	Example: `  irma request lint --request '{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}'`,
+	Args:    cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		request, conf, err := configureRequest(cmd)
+		if err != nil {
+			die("", err)
+		}
+		fix, _ := cmd.Flags().GetBool("fix")
+
+		warnings := request.SessionRequest().Disclosure().Optimize(conf)
+		for _, warning := range warnings {
+			fmt.Println(warning)
+		}
+		if fix {
+			fmt.Println(prettyprint(request))
+			return
+		}
+		if len(warnings) > 0 {
+			die("", errors.Errorf("%d problem(s) found", len(warnings)))
+		}
+		fmt.Println("No problems found.")
+	},
+}
+
+func init() {
+	requestCmd.AddCommand(requestLintCmd)
+
+	flags := requestLintCmd.Flags()
+	flags.SortFlags = false
+
+	addRequestFlags(flags)
+	flags.Bool("fix", false, "print the session request with the optimized condiscon")
+}
@@ -36,7 +36,7 @@ var requestCmd = &cobra.Command{
 		} else {
 			key, _ := flags.GetString("key")
 			name, _ := flags.GetString("name")
-			if output, err = signRequest(request, name, authmethod, key); err != nil {
+			if output, err = signRequest(request, name, authmethod, key, ""); err != nil {
 				die("Failed to sign request", err)
 			}
 		}
@@ -74,12 +74,13 @@ func configureJWTKey(authmethod, key string) (interface{}, jwt.SigningMethod, er
 	return sk, jwtalg, nil
 }
 
-func signRequest(request irma.RequestorRequest, name, authmethod, key string) (string, error) {
+// signRequest signs the request for the IRMA server at the specified audience, which may be empty.
+func signRequest(request irma.RequestorRequest, name, authmethod, key, audience string) (string, error) {
 	sk, jwtalg, err := configureJWTKey(authmethod, key)
 	if err != nil {
 		return "", err
 	}
-	return irma.SignRequestorRequest(request, jwtalg, sk, name)
+	return irma.SignRequestorRequestWithAudience(request, jwtalg, sk, name, audience)
 }
 
 func configureRequest(cmd *cobra.Command) (irma.RequestorRequest, *irma.Configuration, error) {
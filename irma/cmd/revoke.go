@@ -22,10 +22,12 @@ var revokeCmd = &cobra.Command{
 		verbosity, _ := cmd.Flags().GetCount("verbose")
 		url := args[2]
 
+		purge, _ := flags.GetBool("purge")
 		request := &irma.RevocationRequest{
 			LDContext:      irma.LDContextRevocationRequest,
 			CredentialType: irma.NewCredentialTypeIdentifier(args[0]),
 			Key:            args[1],
+			Purge:          purge,
 		}
 
 		postRevocation(request, url, schemesPath, schemesAssetsPath, authMethod, key, name, verbosity)
@@ -95,6 +97,7 @@ func init() {
 	flags.StringP("auth-method", "a", "none", "Authentication method to server (none, token, rsa, hmac)")
 	flags.String("key", "", "Key to sign request with")
 	flags.String("name", "", "Requestor name")
+	flags.Bool("purge", false, "instead of revoking, delete the issuance records of the key at the revocation server (after which the credentials can no longer be revoked)")
 	flags.CountP("verbose", "v", "verbose (repeatable)")
 
 	issuerCmd.AddCommand(revokeCmd)
@@ -0,0 +1,134 @@
+package cmd
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/spf13/cobra"
+)
+
+var searchCmd = &cobra.Command{
+	Use:   "search <term>...",
+	Short: "Search credential types and attributes in the installed schemes",
+	Long: `The search command searches all schemes in the irma_configuration directory for credential
+types and attributes whose identifier, name or description (in any language), or issuer name,
+contain all words of the term (case-insensitively).
+
+Matching credential types are printed with their issuer and whether they support revocation,
+followed by their matching attributes (or all attributes, if the credential type itself
+matches), which can be used in the condiscon of session requests.`,
+	Example: `  irma scheme search student number
+  irma scheme search --json pbdf.gemeente`,
+	Args: cobra.MinimumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		confPath, _ := flags.GetString("irmaconf")
+		confAssetsPath, _ := flags.GetString("irmaconf-assets")
+		asJSON, _ := flags.GetBool("json")
+
+		if err := common.AssertPathExists(confPath); err != nil {
+			die("Cannot read irma_configuration", err)
+		}
+		conf, err := irma.NewConfiguration(confPath, irma.ConfigurationOptions{ReadOnly: true, Assets: confAssetsPath})
+		if err != nil {
+			die("Failed to parse irma_configuration", err)
+		}
+		if err = conf.ParseFolder(); err != nil {
+			die("Failed to parse irma_configuration", err)
+		}
+
+		results := irma.NewAttributeIndex(conf).Search(strings.Join(args, " "))
+		if asJSON {
+			fmt.Println(prettyprint(searchResultsJSON(results)))
+			return
+		}
+		if len(results) == 0 {
+			die("", errors.New("No matching credential types or attributes found"))
+		}
+		for _, result := range results {
+			printSearchResult(result)
+		}
+	},
+}
+
+func init() {
+	schemeCmd.AddCommand(searchCmd)
+
+	flags := searchCmd.Flags()
+	flags.SortFlags = false
+	flags.StringP("irmaconf", "i", irma.DefaultSchemesPath(), "path to irma_configuration")
+	flags.String("irmaconf-assets", irma.DefaultSchemesAssetsPath(), "if specified, copy schemes from here into irmaconf")
+	flags.Bool("json", false, "print the results as JSON")
+}
+
+func printSearchResult(result irma.SearchResult) {
+	credtype := result.CredentialType
+	fmt.Println(credtype.Identifier(), formatTranslations(credtype.Name))
+	if result.Issuer != nil {
+		fmt.Println("  Issuer:    ", result.Issuer.Identifier(), formatTranslations(result.Issuer.Name))
+	}
+	fmt.Println("  Revocation:", credtype.RevocationSupported())
+	if !credtype.DeprecatedSince.IsZero() {
+		fmt.Println("  Deprecated:", credtype.DeprecatedSince.String())
+	}
+	for _, attr := range result.AttributeTypes {
+		fmt.Println("   ", attr.GetAttributeTypeIdentifier(), formatTranslations(attr.Name))
+	}
+	fmt.Println()
+}
+
+// formatTranslations returns the translations sorted by language, e.g. (en: Name, nl: Naam).
+func formatTranslations(ts irma.TranslatedString) string {
+	langs := make([]string, 0, len(ts))
+	for lang := range ts {
+		langs = append(langs, lang)
+	}
+	sort.Strings(langs)
+	texts := make([]string, 0, len(langs))
+	for _, lang := range langs {
+		texts = append(texts, lang+": "+ts[lang])
+	}
+	return "(" + strings.Join(texts, ", ") + ")"
+}
+
+type searchResultJSON struct {
+	ID         irma.CredentialTypeIdentifier `json:"id"`
+	Name       irma.TranslatedString         `json:"name"`
+	Issuer     irma.IssuerIdentifier         `json:"issuer"`
+	IssuerName irma.TranslatedString         `json:"issuerName,omitempty"`
+	Revocation bool                          `json:"revocation"`
+	Deprecated bool                          `json:"deprecated,omitempty"`
+	Attributes []attributeResultJSON         `json:"attributes"`
+}
+
+type attributeResultJSON struct {
+	ID   irma.AttributeTypeIdentifier `json:"id"`
+	Name irma.TranslatedString        `json:"name"`
+}
+
+func searchResultsJSON(results []irma.SearchResult) []searchResultJSON {
+	out := make([]searchResultJSON, 0, len(results))
+	for _, result := range results {
+		credtype := result.CredentialType
+		r := searchResultJSON{
+			ID:         credtype.Identifier(),
+			Name:       credtype.Name,
+			Issuer:     credtype.IssuerIdentifier(),
+			Revocation: credtype.RevocationSupported(),
+			Deprecated: !credtype.DeprecatedSince.IsZero(),
+			Attributes: []attributeResultJSON{},
+		}
+		if result.Issuer != nil {
+			r.IssuerName = result.Issuer.Name
+		}
+		for _, attr := range result.AttributeTypes {
+			r.Attributes = append(r.Attributes, attributeResultJSON{ID: attr.GetAttributeTypeIdentifier(), Name: attr.Name})
+		}
+		out = append(out, r)
+	}
+	return out
+}
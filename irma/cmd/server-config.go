@@ -0,0 +1,243 @@
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+)
+
+var serverConfigCmd = &cobra.Command{
+	Use:   "config",
+	Short: "Server configuration utilities",
+}
+
+var serverConfigDocsCmd = &cobra.Command{
+	Use:   "docs",
+	Short: "Print documentation of all server configuration options",
+	Long: `docs prints all configuration options of irma server: for each option its flag,
+environment variable and key in the configuration file, its type, its defaults in development
+and production mode, and its description. Options of the Configuration struct that are only
+available when using the IRMA server as a library are included as well.
+
+The same documentation is served by irma server at GET /docs/config (in JSON).`,
+	Args: cobra.NoArgs,
+	Run: func(command *cobra.Command, args []string) {
+		flags := command.Flags()
+		format, _ := flags.GetString("format")
+		output, _ := flags.GetString("output")
+
+		options, err := serverConfigDocs()
+		if err != nil {
+			die("Failed to generate configuration documentation", err)
+		}
+
+		var w io.Writer = os.Stdout
+		if output != "" {
+			f, err := os.Create(output)
+			if err != nil {
+				die("Failed to create output file", err)
+			}
+			defer closeCloser(f)
+			w = f
+		}
+
+		switch format {
+		case "json":
+			enc := json.NewEncoder(w)
+			enc.SetIndent("", "  ")
+			enc.SetEscapeHTML(false)
+			err = enc.Encode(options)
+		case "markdown":
+			err = writeConfigDocsMarkdown(w, options)
+		default:
+			die("", errors.New("unsupported format "+format))
+		}
+		if err != nil {
+			die("Failed to write configuration documentation", err)
+		}
+	},
+}
+
+func init() {
+	serverCmd.AddCommand(serverConfigCmd)
+	serverConfigCmd.AddCommand(serverConfigDocsCmd)
+
+	flags := serverConfigDocsCmd.Flags()
+	flags.SortFlags = false
+	flags.StringP("format", "f", "markdown", "output format: markdown or json")
+	flags.StringP("output", "o", "", "file to write the documentation to (default stdout)")
+}
+
+// machineDependentDefaults replaces the defaults of flags that depend on the machine on which
+// irma server runs, so that the documentation is the same everywhere. The URLs only have a
+// default in development mode.
+var machineDependentDefaults = map[string]string{
+	"url":                 "http://<first local IP>:port",
+	"alternative-urls":    "http://<other local IPs>:port",
+	"schemes-path":        "<data dir>/irma_configuration",
+	"schemes-assets-path": "<data dir>/irma_configuration_assets, if it exists",
+}
+
+// serverConfigDocs documents the flags of irma server, and the fields of
+// requestorserver.Configuration that have no flag.
+func serverConfigDocs() ([]*requestorserver.ConfigOption, error) {
+	fields := map[string]reflect.StructField{}
+	paths := map[string]string{}
+	var order []string
+	configFields(reflect.TypeOf(requestorserver.Configuration{}), "requestorserver.Configuration", fields, paths, &order)
+
+	dev, prod := &cobra.Command{Use: "server"}, &cobra.Command{Use: "server"}
+	if err := setFlags(dev, false); err != nil {
+		return nil, err
+	}
+	if err := setFlags(prod, true); err != nil {
+		return nil, err
+	}
+	headers := flagHeaders["irma server"]
+
+	var options []*requestorserver.ConfigOption
+	section := ""
+	documented := map[string]bool{}
+	dev.Flags().VisitAll(func(flag *pflag.Flag) {
+		if header, ok := headers[flag.Name]; ok {
+			section = header
+		}
+		key := strings.ReplaceAll(flag.Name, "-", "_")
+		option := &requestorserver.ConfigOption{
+			Key:         key,
+			Flag:        "--" + flag.Name,
+			EnvVar:      "IRMASERVER_" + strings.ToUpper(key),
+			Type:        flag.Value.Type(),
+			Default:     flagDefault(flag, false),
+			Section:     section,
+			Description: flag.Usage,
+		}
+		if prodDefault := flagDefault(prod.Flags().Lookup(flag.Name), true); prodDefault != option.Default {
+			option.ProductionDefault = &prodDefault
+		}
+		if field, ok := fields[key]; ok {
+			option.Field = paths[key]
+			option.GoType = field.Type.String()
+			documented[key] = true
+		}
+		options = append(options, option)
+	})
+
+	for _, key := range order {
+		if documented[key] {
+			continue
+		}
+		options = append(options, &requestorserver.ConfigOption{
+			Key:         key,
+			Field:       paths[key],
+			GoType:      fields[key].Type.String(),
+			Section:     "Library only",
+			Description: "only configurable when using the IRMA server as a library",
+		})
+	}
+	return options, nil
+}
+
+// configFields collects the exported fields of the specified struct that can be configured, by
+// their key in the configuration file, following squashed embedded structs.
+func configFields(typ reflect.Type, path string, fields map[string]reflect.StructField, paths map[string]string, order *[]string) {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	for i := 0; i < typ.NumField(); i++ {
+		field := typ.Field(i)
+		if !field.IsExported() {
+			continue
+		}
+		tag := field.Tag.Get("mapstructure")
+		if strings.Contains(tag, ",squash") {
+			ftyp := field.Type
+			if ftyp.Kind() == reflect.Ptr {
+				ftyp = ftyp.Elem()
+			}
+			configFields(ftyp, ftyp.String(), fields, paths, order)
+			continue
+		}
+		key := strings.Split(tag, ",")[0]
+		if key == "" {
+			key = strings.Split(field.Tag.Get("json"), ",")[0]
+		}
+		if key == "" || key == "-" {
+			continue
+		}
+		if _, ok := fields[key]; !ok {
+			*order = append(*order, key)
+		}
+		fields[key] = field
+		paths[key] = path + "." + field.Name
+	}
+}
+
+// flagDefault returns the default value of the flag as shown in the documentation.
+func flagDefault(flag *pflag.Flag, production bool) string {
+	if def, ok := machineDependentDefaults[flag.Name]; ok {
+		if production && (flag.Name == "url" || flag.Name == "alternative-urls") {
+			return ""
+		}
+		return def
+	}
+	if flag.DefValue == "[]" {
+		return ""
+	}
+	return flag.DefValue
+}
+
+func writeConfigDocsMarkdown(w io.Writer, options []*requestorserver.ConfigOption) error {
+	var b strings.Builder
+	b.WriteString("# IRMA server configuration\n\n")
+	b.WriteString("Each option can be specified as command line flag, as environment variable, or as key in the\n")
+	b.WriteString("configuration file passed with `--config`. Options without flag are only available when\n")
+	b.WriteString("using the IRMA server as a library.\n")
+
+	section := "-"
+	for _, option := range options {
+		if option.Section != section {
+			section = option.Section
+			title := section
+			if title == "" {
+				title = "General"
+			}
+			fmt.Fprintf(&b, "\n## %s\n\n", title)
+			b.WriteString("| Key | Flag | Environment variable | Type | Default | Description |\n")
+			b.WriteString("|-----|------|----------------------|------|---------|-------------|\n")
+		}
+		typ, def := option.Type, markdownCode(option.Default)
+		if typ == "" {
+			typ = option.GoType
+		}
+		if option.ProductionDefault != nil {
+			def += " (production: " + markdownCode(*option.ProductionDefault) + ")"
+		}
+		description := option.Description
+		if option.Field != "" {
+			description += " (`" + option.Field + "`)"
+		}
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s | %s | %s |\n",
+			option.Key, markdownCode(option.Flag), markdownCode(option.EnvVar), typ, def,
+			strings.ReplaceAll(description, "|", "\\|"),
+		)
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+func markdownCode(s string) string {
+	if s == "" {
+		return ""
+	}
+	return "`" + strings.ReplaceAll(s, "|", "\\|") + "`"
+}
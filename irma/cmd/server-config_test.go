@@ -0,0 +1,35 @@
+package cmd
+
+import (
+	"testing"
+
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServerConfigDocsUpToDate(t *testing.T) {
+	expected, err := serverConfigDocs()
+	require.NoError(t, err)
+	actual, err := requestorserver.ConfigDocs()
+	require.NoError(t, err)
+	require.Equal(t, expected, actual, "configdocs.json is out of date, run go generate ./server/requestorserver")
+}
+
+func TestServerConfigDocsFields(t *testing.T) {
+	options, err := serverConfigDocs()
+	require.NoError(t, err)
+
+	keys := map[string]*requestorserver.ConfigOption{}
+	for _, option := range options {
+		require.NotContains(t, keys, option.Key)
+		keys[option.Key] = option
+	}
+
+	require.Equal(t, "server.Configuration.MaxSessionLifetime", keys["max_session_lifetime"].Field)
+	require.Equal(t, "IRMASERVER_MAX_SESSION_LIFETIME", keys["max_session_lifetime"].EnvVar)
+	require.Equal(t, "15", keys["max_session_lifetime"].Default)
+	require.Equal(t, "requestorserver.Configuration.DisableRequestorAuthentication", keys["no_auth"].Field)
+	require.Equal(t, "false", *keys["no_auth"].ProductionDefault)
+	require.Equal(t, "", keys["host_perms"].Flag)
+	require.Equal(t, "requestorserver.Permissions.Hosts", keys["host_perms"].Field)
+}
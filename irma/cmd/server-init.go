@@ -0,0 +1,389 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/server/requestorserver"
+	"github.com/spf13/cobra"
+)
+
+var serverInitCmd = &cobra.Command{
+	Use:   "init",
+	Short: "Generate a server configuration interactively",
+	Long: `init asks a number of questions about the server to be deployed, and writes a
+configuration file and the keys it refers to into the output directory:
+  irmaserver.json           the configuration file, to be passed to irma server using -c
+  jwt_sk.pem                private key with which the server signs JWTs
+  requestors/<name>.pem     public keys of requestors authenticating with public keys
+  requestors/<name>_sk.pem  private keys to hand over to these requestors
+Existing files are never overwritten. Files containing secrets are only readable by the
+current user. Afterwards, the configuration is validated like "irma server check" does.
+
+Specify --defaults to skip the questions and generate a development configuration.`,
+	Args: cobra.NoArgs,
+	Run: func(command *cobra.Command, args []string) {
+		flags := command.Flags()
+		dir, _ := flags.GetString("dir")
+		defaults, _ := flags.GetBool("defaults")
+
+		p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout, defaults: defaults}
+		answers, err := askServerInit(p)
+		if err != nil {
+			die("", err)
+		}
+		confpath, err := answers.write(dir)
+		if err != nil {
+			die("Failed to write configuration", err)
+		}
+		fmt.Println("Configuration written at", confpath)
+
+		if err = validateServerInit(confpath, answers.production); err != nil {
+			die("Generated configuration is invalid (fix it, and check it using irma server check -c "+confpath+")", err)
+		}
+		fmt.Println("Configuration is valid, start the server using: irma server -c", confpath)
+	},
+}
+
+func init() {
+	serverCmd.AddCommand(serverInitCmd)
+
+	flags := serverInitCmd.Flags()
+	flags.SortFlags = false
+	flags.StringP("dir", "d", ".", "directory to write the configuration and keys to")
+	flags.Bool("defaults", false, "do not ask questions, but use the default answers")
+}
+
+// serverInit contains the answers to the questions of irma server init.
+type serverInit struct {
+	production bool
+	url        string
+	port       int
+	email      string
+	tlsCert    string
+	tlsKey     string
+	storeType  string
+	redisAddr  string
+	redisPw    string
+	redisNoTLS bool
+	noAuth     bool
+	requestors []serverInitRequestor
+}
+
+type serverInitRequestor struct {
+	name        string
+	authMethod  requestorserver.AuthenticationMethod
+	permissions requestorserver.Permissions
+}
+
+func askServerInit(p *prompter) (*serverInit, error) {
+	answers := &serverInit{}
+	var err error
+
+	answers.production = p.askBool("Run in production mode?", false)
+	if answers.port, err = strconv.Atoi(p.ask("Port to listen at", "8088")); err != nil {
+		return nil, errors.New("port must be a number")
+	}
+	defaultURL := ""
+	if !answers.production && len(localIPs) > 0 {
+		defaultURL = localURL(localIPs[0], strconv.Itoa(answers.port))
+	}
+	answers.url = p.ask("External URL of the server, to which the IRMA app connects", defaultURL)
+	if answers.production {
+		answers.email = p.ask("Email address of the server admin, for notifications about breaking changes (empty to opt out)", "")
+	}
+
+	if answers.tlsCert = p.ask("Path to TLS certificate (chain) (empty if TLS is terminated by a reverse proxy)", ""); answers.tlsCert != "" {
+		answers.tlsKey = p.ask("Path to TLS private key", "")
+	}
+
+	answers.storeType = p.askChoice("Session store", "memory", "memory", "redis")
+	if answers.storeType == "redis" {
+		answers.redisAddr = p.ask("Redis address (host:port)", "localhost:6379")
+		answers.redisPw = p.ask("Redis password", "")
+		answers.redisNoTLS = !p.askBool("Connect to Redis using TLS?", true)
+	}
+
+	if !answers.production {
+		answers.noAuth = !p.askBool("Authenticate requestors?", true)
+	}
+	if answers.noAuth {
+		return answers, nil
+	}
+	for {
+		def := ""
+		if len(answers.requestors) == 0 {
+			def = "requestor"
+		}
+		name := p.ask("Name of requestor (empty when done)", def)
+		if name == "" {
+			break
+		}
+		if _, ok := answers.requestor(name); ok || strings.ContainsAny(name, `/\`) {
+			fmt.Fprintln(p.out, "Requestor name already used or invalid")
+			continue
+		}
+		answers.requestors = append(answers.requestors, serverInitRequestor{
+			name: name,
+			authMethod: requestorserver.AuthenticationMethod(p.askChoice("Authentication method", "token",
+				requestorserver.AuthenticationMethodToken,
+				requestorserver.AuthenticationMethodPublicKey,
+				requestorserver.AuthenticationMethodHmac,
+			)),
+			permissions: requestorserver.Permissions{
+				Disclosing: p.askList("Attributes that the requestor may verify (comma-separated, * for all)", "*"),
+				Signing:    p.askList("Attributes that the requestor may request in signatures", "*"),
+				Issuing:    p.askList("Credentials that the requestor may issue (e.g. irma-demo.MijnOverheid.*)", ""),
+			},
+		})
+		if p.defaults {
+			break
+		}
+	}
+	if len(answers.requestors) == 0 {
+		return nil, errors.New("at least one requestor is required when requestors are authenticated")
+	}
+	return answers, nil
+}
+
+func (answers *serverInit) requestor(name string) (serverInitRequestor, bool) {
+	for _, r := range answers.requestors {
+		if r.name == name {
+			return r, true
+		}
+	}
+	return serverInitRequestor{}, false
+}
+
+// write generates the keys and writes them and the configuration file into dir, returning the
+// path of the configuration file.
+func (answers *serverInit) write(dir string) (string, error) {
+	// The configuration refers to the keys using absolute paths, as the server resolves relative
+	// paths against its working directory instead of the directory of the configuration file
+	dir, err := filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	confpath := filepath.Join(dir, "irmaserver.json")
+	jwtpath := filepath.Join(dir, "jwt_sk.pem")
+	paths := []string{confpath, jwtpath}
+	for _, r := range answers.requestors {
+		if r.authMethod == requestorserver.AuthenticationMethodPublicKey {
+			paths = append(paths, answers.requestorKeyPaths(dir, r.name)...)
+		}
+	}
+	// For safety we enforce that we never overwrite a file
+	for _, path := range paths {
+		if err := common.AssertPathNotExists(path); err != nil {
+			return "", errors.Errorf("File %s already exists, not overwriting", path)
+		}
+	}
+	if err := common.EnsureDirectoryExists(dir); err != nil {
+		return "", err
+	}
+
+	conf := map[string]interface{}{
+		"production":       answers.production,
+		"port":             answers.port,
+		"url":              answers.url,
+		"jwt_privkey_file": jwtpath,
+		"no_auth":          answers.noAuth,
+	}
+	if answers.production {
+		if answers.email != "" {
+			conf["email"] = answers.email
+		} else {
+			conf["no_email"] = true
+		}
+	}
+	if answers.tlsCert != "" {
+		conf["tls_cert_file"] = answers.tlsCert
+		conf["tls_privkey_file"] = answers.tlsKey
+	}
+	if answers.storeType == "redis" {
+		conf["store_type"] = "redis"
+		conf["redis_addr"] = answers.redisAddr
+		if answers.redisPw != "" {
+			conf["redis_pw"] = answers.redisPw
+		} else {
+			conf["redis_allow_empty_password"] = true
+		}
+		if answers.redisNoTLS {
+			conf["redis_no_tls"] = true
+		}
+	}
+
+	if _, err := writeRSAPrivateKey(jwtpath); err != nil {
+		return "", err
+	}
+	requestors := map[string]interface{}{}
+	for _, r := range answers.requestors {
+		requestor, err := answers.writeRequestor(dir, r)
+		if err != nil {
+			return "", err
+		}
+		requestors[r.name] = requestor
+	}
+	if len(requestors) > 0 {
+		conf["requestors"] = requestors
+	}
+
+	bts, err := json.MarshalIndent(conf, "", "  ")
+	if err != nil {
+		return "", err
+	}
+	// The configuration may contain requestor keys and the Redis password
+	return confpath, os.WriteFile(confpath, append(bts, '\n'), 0600)
+}
+
+func (answers *serverInit) requestorKeyPaths(dir, name string) []string {
+	return []string{
+		filepath.Join(dir, "requestors", name+".pem"),
+		filepath.Join(dir, "requestors", name+"_sk.pem"),
+	}
+}
+
+// writeRequestor returns the configuration of the requestor, generating its key.
+func (answers *serverInit) writeRequestor(dir string, r serverInitRequestor) (map[string]interface{}, error) {
+	requestor := map[string]interface{}{
+		"auth_method":    r.authMethod,
+		"disclose_perms": r.permissions.Disclosing,
+		"sign_perms":     r.permissions.Signing,
+		"issue_perms":    r.permissions.Issuing,
+	}
+
+	switch r.authMethod {
+	case requestorserver.AuthenticationMethodToken, requestorserver.AuthenticationMethodHmac:
+		requestor["key"] = randomBase64(32)
+	case requestorserver.AuthenticationMethodPublicKey:
+		paths := answers.requestorKeyPaths(dir, r.name)
+		if err := common.EnsureDirectoryExists(filepath.Dir(paths[0])); err != nil {
+			return nil, err
+		}
+		sk, err := writeRSAPrivateKey(paths[1])
+		if err != nil {
+			return nil, err
+		}
+		pkbts, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+		if err != nil {
+			return nil, err
+		}
+		if err = os.WriteFile(paths[0], pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkbts}), 0644); err != nil {
+			return nil, err
+		}
+		fmt.Println("Private key of requestor", r.name, "written at", paths[1])
+		requestor["key_file"] = paths[0]
+	}
+	return requestor, nil
+}
+
+func writeRSAPrivateKey(path string) (*rsa.PrivateKey, error) {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		return nil, err
+	}
+	bts := pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(sk)})
+	return sk, os.WriteFile(path, bts, 0600)
+}
+
+func randomBase64(n int) string {
+	bts := make([]byte, n)
+	if _, err := rand.Read(bts); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(bts)
+}
+
+// validateServerInit reads the configuration file and checks it, like irma server check.
+func validateServerInit(confpath string, production bool) error {
+	check := &cobra.Command{Use: "check"}
+	if err := setFlags(check, production); err != nil {
+		return err
+	}
+	if err := check.Flags().Set("config", confpath); err != nil {
+		return err
+	}
+	conf, err := configureServer(check)
+	if err != nil {
+		return err
+	}
+	conf.DisableSchemesUpdate = true
+	_, err = requestorserver.New(conf)
+	return err
+}
+
+// prompter asks questions on the command line.
+type prompter struct {
+	in       *bufio.Reader
+	out      io.Writer
+	defaults bool
+}
+
+// ask asks the question, returning the answer or def if the answer is empty.
+func (p *prompter) ask(question, def string) string {
+	if def != "" {
+		question += " [" + def + "]"
+	}
+	fmt.Fprint(p.out, question+": ")
+	if p.defaults {
+		fmt.Fprintln(p.out, def)
+		return def
+	}
+	answer, err := p.in.ReadString('\n')
+	if err != nil && answer == "" {
+		die("", errors.New("no answer"))
+	}
+	if answer = strings.TrimSpace(answer); answer == "" {
+		return def
+	}
+	return answer
+}
+
+func (p *prompter) askBool(question string, def bool) bool {
+	defstr := "n"
+	if def {
+		defstr = "y"
+	}
+	for {
+		switch strings.ToLower(p.ask(question+" (y/n)", defstr)) {
+		case "y", "yes":
+			return true
+		case "n", "no":
+			return false
+		}
+	}
+}
+
+func (p *prompter) askChoice(question, def string, choices ...string) string {
+	for {
+		answer := p.ask(question+" ("+strings.Join(choices, ", ")+")", def)
+		for _, choice := range choices {
+			if answer == choice {
+				return answer
+			}
+		}
+	}
+}
+
+func (p *prompter) askList(question, def string) []string {
+	list := []string{}
+	for _, item := range strings.Split(p.ask(question, def), ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
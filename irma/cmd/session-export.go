@@ -0,0 +1,101 @@
+package cmd
+
+import (
+	"io"
+	"os"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+)
+
+var sessionExportCmd = &cobra.Command{
+	Use:   "export [file]",
+	Short: "Export session results in CSV format",
+	Long: `export reads session results in JSON, as returned by GET /session/{requestorToken}/result,
+from the specified file or from stdin, and writes them in CSV format: one row per session result,
+with a column for each attribute.
+
+The attribute columns are those requested by the session request specified with --request, or
+otherwise all attributes disclosed in any of the session results. Use --hash or --redact to
+include only the hash of the values of an attribute, or only whether or not it was disclosed.`,
+	Example: `irma session export results.json --hash irma-demo.MijnOverheid.root.BSN
+irma session export results.json --request '{"@context":"https://irma.app/ld/request/disclosure/v2","disclose":[[["irma-demo.MijnOverheid.fullName.firstname"]]]}'`,
+	Args: cobra.MaximumNArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		output, _ := flags.GetString("output")
+		jsonrequest, _ := flags.GetString("request")
+
+		var r io.Reader = os.Stdin
+		if len(args) == 1 {
+			file, err := os.Open(args[0])
+			if err != nil {
+				die("Failed to open session results", err)
+			}
+			defer file.Close()
+			r = file
+		}
+		results, err := server.ReadSessionResults(r)
+		if err != nil {
+			die("Failed to read session results", err)
+		}
+
+		var request irma.SessionRequest
+		if jsonrequest != "" {
+			rrequest, err := server.ParseSessionRequest(jsonrequest)
+			if err != nil {
+				die("Failed to parse session request", err)
+			}
+			request = rrequest.SessionRequest()
+		}
+		attrs, err := server.ResultExportAttributes(request, results)
+		if err != nil {
+			die("Failed to determine attributes", err)
+		}
+		redactions, err := exportRedactions(cmd)
+		if err != nil {
+			die("", err)
+		}
+
+		var w io.Writer = os.Stdout
+		if output != "" {
+			file, err := os.Create(output)
+			if err != nil {
+				die("Failed to create output file", err)
+			}
+			defer file.Close()
+			w = file
+		}
+		if err = server.WriteSessionResultsCSV(w, results, attrs, redactions); err != nil {
+			die("Failed to write session results", err)
+		}
+	},
+}
+
+func exportRedactions(cmd *cobra.Command) (map[irma.AttributeTypeIdentifier]server.Redaction, error) {
+	redactions := map[irma.AttributeTypeIdentifier]server.Redaction{}
+	for flag, redaction := range map[string]server.Redaction{"hash": server.RedactionHash, "redact": server.RedactionOmit} {
+		attrs, _ := cmd.Flags().GetStringArray(flag)
+		for _, attr := range attrs {
+			id := irma.NewAttributeTypeIdentifier(attr)
+			if _, ok := redactions[id]; ok {
+				return nil, errors.Errorf("attribute %s specified more than once in --hash or --redact", attr)
+			}
+			redactions[id] = redaction
+		}
+	}
+	return redactions, nil
+}
+
+func init() {
+	sessionCmd.AddCommand(sessionExportCmd)
+
+	flags := sessionExportCmd.Flags()
+	flags.SortFlags = false
+	flags.StringP("request", "r", "", "JSON session request whose requested attributes determine the attribute columns")
+	flags.StringArray("hash", nil, "include only the SHA-256 hash of the values of this attribute (repeatable)")
+	flags.StringArray("redact", nil, "include only whether or not this attribute was disclosed (repeatable)")
+	flags.StringP("output", "o", "", "write the CSV to this file instead of stdout")
+}
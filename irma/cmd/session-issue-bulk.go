@@ -0,0 +1,232 @@
+package cmd
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/spf13/cobra"
+)
+
+var sessionIssueBulkCmd = &cobra.Command{
+	Use:   "issue-bulk",
+	Short: "Start an issuance session for each row of a CSV file",
+	Long: `issue-bulk starts an issuance session at an IRMA server for each row of the specified CSV file,
+and prints a report containing the token, the session pointer (i.e. QR contents) and the
+status of each session, in CSV format.
+
+The first line of the CSV file must contain the column names. By default, each column is
+mapped to the attribute of the same name of the credential(s) to be issued; use --map to
+map a column to another attribute.`,
+	Example: `irma session issue-bulk --server http://localhost:8088 --csv users.csv --credential irma-demo.MijnOverheid.fullName
+irma session issue-bulk --server http://localhost:8088 --csv users.csv --credential irma-demo.MijnOverheid.fullName --map surname=irma-demo.MijnOverheid.fullName.familyname`,
+	Args: cobra.NoArgs,
+	Run: func(cmd *cobra.Command, args []string) {
+		flags := cmd.Flags()
+		serverURL, _ := flags.GetString("server")
+		csvPath, _ := flags.GetString("csv")
+		output, _ := flags.GetString("output")
+		batchSize, _ := flags.GetInt("batch-size")
+		if serverURL == "" || csvPath == "" {
+			die("", errors.New("--server and --csv are required"))
+		}
+		if batchSize <= 0 {
+			die("", errors.New("--batch-size must be positive"))
+		}
+
+		f, err := os.Open(csvPath)
+		if err != nil {
+			die("Failed to open CSV file", err)
+		}
+		rows, err := server.ParseBulkIssuanceCSV(f)
+		_ = f.Close()
+		if err != nil {
+			die("Failed to read CSV file", err)
+		}
+
+		request, err := bulkIssuanceTemplate(cmd)
+		if err != nil {
+			die("Failed to construct session request", err)
+		}
+		mapping, err := bulkIssuanceMapping(cmd)
+		if err != nil {
+			die("Failed to parse mapping", err)
+		}
+
+		var w io.Writer = os.Stdout
+		if output != "" {
+			file, err := os.Create(output)
+			if err != nil {
+				die("Failed to create output file", err)
+			}
+			defer file.Close()
+			w = file
+		}
+
+		authMethod, _ := flags.GetString("authmethod")
+		key, _ := flags.GetString("key")
+		name, _ := flags.GetString("name")
+		recipientColumn, _ := flags.GetString("recipient-column")
+		language, _ := flags.GetString("language")
+		bulkRequest := &server.BulkIssuanceRequest{
+			Mapping:         mapping,
+			RecipientColumn: recipientColumn,
+			Language:        language,
+		}
+		results, err := postBulkRequest(serverURL, request, bulkRequest, rows, batchSize, name, authMethod, key)
+		if err != nil {
+			die("Bulk issuance failed", err)
+		}
+		if err = writeBulkIssuanceReport(w, results); err != nil {
+			die("Failed to write report", err)
+		}
+	},
+}
+
+func bulkIssuanceTemplate(cmd *cobra.Command) (*irma.IdentityProviderRequest, error) {
+	flags := cmd.Flags()
+	jsonrequest, _ := flags.GetString("request")
+	credentials, _ := flags.GetStringArray("credential")
+	if (jsonrequest == "") == (len(credentials) == 0) {
+		return nil, errors.New("provide either a template session request using --request or credential types using --credential")
+	}
+
+	if jsonrequest != "" {
+		rrequest, err := server.ParseSessionRequest(jsonrequest)
+		if err != nil {
+			return nil, err
+		}
+		request, ok := rrequest.(*irma.IdentityProviderRequest)
+		if !ok {
+			return nil, errors.New("template session request must be an issuance request")
+		}
+		return request, nil
+	}
+
+	creds := make([]*irma.CredentialRequest, 0, len(credentials))
+	for _, id := range credentials {
+		creds = append(creds, &irma.CredentialRequest{
+			CredentialTypeID: irma.NewCredentialTypeIdentifier(id),
+			Attributes:       map[string]string{},
+		})
+	}
+	return &irma.IdentityProviderRequest{Request: irma.NewIssuanceRequest(creds)}, nil
+}
+
+func bulkIssuanceMapping(cmd *cobra.Command) (map[string]irma.AttributeTypeIdentifier, error) {
+	mappings, _ := cmd.Flags().GetStringArray("map")
+	mapping := make(map[string]irma.AttributeTypeIdentifier, len(mappings))
+	for _, m := range mappings {
+		parts := strings.Split(m, "=")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, errors.Errorf("--map argument %s must be of the form column=attribute", m)
+		}
+		mapping[parts[0]] = irma.NewAttributeTypeIdentifier(parts[1])
+	}
+	return mapping, nil
+}
+
+func postBulkRequest(
+	serverURL string,
+	request *irma.IdentityProviderRequest,
+	bulkRequest *server.BulkIssuanceRequest,
+	rows []map[string]string,
+	batchSize int,
+	name, authMethod, key string,
+) ([]*server.BulkIssuanceResult, error) {
+	transport := irma.NewHTTPTransport(serverURL, false)
+
+	var template []byte
+	var err error
+	switch authMethod {
+	case "token":
+		transport.SetHeader("Authorization", key)
+		fallthrough
+	case "none":
+		template, err = json.Marshal(request)
+	case "hmac", "rsa":
+		var jwtstr string
+		if jwtstr, err = signRequest(request, name, authMethod, key, serverURL); err != nil {
+			return nil, err
+		}
+		template, err = json.Marshal(jwtstr)
+	default:
+		return nil, errors.New("Invalid authentication method (must be none, token, hmac or rsa)")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Post the rows in batches, to keep each of the HTTP requests within the server's time limits
+	results := make([]*server.BulkIssuanceResult, 0, len(rows))
+	for start := 0; start < len(rows); start += batchSize {
+		end := start + batchSize
+		if end > len(rows) {
+			end = len(rows)
+		}
+		var batch []*server.BulkIssuanceResult
+		bulkRequest.Request = template
+		bulkRequest.Rows = rows[start:end]
+		err = transport.Post("session/bulk", &batch, bulkRequest)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to post rows "+strconv.Itoa(start+1)+"-"+strconv.Itoa(end), 0)
+		}
+		for _, result := range batch {
+			result.Row += start
+		}
+		results = append(results, batch...)
+	}
+	return results, nil
+}
+
+func writeBulkIssuanceReport(w io.Writer, results []*server.BulkIssuanceResult) error {
+	writer := csv.NewWriter(w)
+	if err := writer.Write([]string{"row", "token", "sessionptr", "status", "notified", "error"}); err != nil {
+		return err
+	}
+	for _, result := range results {
+		var qr, rerr string
+		if result.SessionPtr != nil {
+			bts, err := json.Marshal(result.SessionPtr)
+			if err != nil {
+				return err
+			}
+			qr = string(bts)
+		}
+		if result.Err != nil {
+			rerr = result.Err.Error()
+		}
+		record := []string{strconv.Itoa(result.Row), string(result.Token), qr, string(result.Status), strconv.FormatBool(result.Notified), rerr}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func init() {
+	sessionCmd.AddCommand(sessionIssueBulkCmd)
+
+	flags := sessionIssueBulkCmd.Flags()
+	flags.SortFlags = false
+	flags.String("server", "", "IRMA server to post the session requests to")
+	flags.String("csv", "", "path to CSV file containing the attribute values, one session per row")
+	flags.StringArray("credential", nil, "credential type to issue in each session (repeatable)")
+	flags.StringP("request", "r", "", "JSON issuance session request to use as template (instead of --credential)")
+	flags.StringArray("map", nil, "map a CSV column to an attribute, as column=attribute (repeatable)")
+	flags.String("recipient-column", "", "CSV column containing the email address or phone number to which the server sends the session link")
+	flags.String("language", "", "language of the messages containing the session links (default: the server's default language)")
+	flags.StringP("output", "o", "", "write the report to this file instead of stdout")
+	flags.Int("batch-size", 100, "number of rows to post to the server per HTTP request")
+	flags.StringP("auth-method", "a", "none", "Authentication method to server (none, token, rsa, hmac)")
+	flags.SetNormalizeFunc(authmethodAlias)
+	flags.String("key", "", "Key to sign request with")
+	flags.String("name", "", "Requestor name")
+}
@@ -25,6 +25,8 @@ var (
 	httpServer *http.Server
 	irmaServer *irmaserver.Server
 	defaulturl string
+	// URLs of the other local IP addresses, advertised along with defaulturl
+	defaultAlternativeURLs []string
 
 	logger = logrus.New()
 )
@@ -316,7 +318,7 @@ func postRequest(serverURL string, request irma.RequestorRequest, name, authMeth
 		err = transport.Post("session", pkg, request)
 	case "hmac", "rsa":
 		var jwtstr string
-		jwtstr, err = signRequest(request, name, authMethod, key)
+		jwtstr, err = signRequest(request, name, authMethod, key, serverURL)
 		if err != nil {
 			return nil, err
 		}
@@ -391,6 +393,12 @@ func requestPairingPermission(options *irma.SessionOptions, completePairing func
 // Configuration functions
 
 func configureSessionServer(url string, port int, privatekeysPath string, irmaconfig *irma.Configuration, verbosity int) error {
+	var alternativeURLs []string
+	if url == defaulturl {
+		for _, u := range defaultAlternativeURLs {
+			alternativeURLs = append(alternativeURLs, server.ReplacePortString(u, port))
+		}
+	}
 	// Replace "port" in url with actual port
 	replace := "$1:" + strconv.Itoa(port)
 	url = string(regexp.MustCompile("(https?://[^/]*):port").ReplaceAll([]byte(url), []byte(replace)))
@@ -398,6 +406,7 @@ func configureSessionServer(url string, port int, privatekeysPath string, irmaco
 		IrmaConfiguration:    irmaconfig,
 		Logger:               logger,
 		URL:                  url,
+		AlternativeURLs:      alternativeURLs,
 		DisableSchemesUpdate: true,
 		Verbose:              verbosity,
 	}
@@ -440,8 +449,12 @@ func init() {
 
 	logger.Formatter = &prefixed.TextFormatter{FullTimestamp: true}
 
-	if localIP != "" {
-		defaulturl = "http://" + localIP + ":port"
+	for i, ip := range localIPs {
+		if i == 0 {
+			defaulturl = localURL(ip, "port")
+		} else {
+			defaultAlternativeURLs = append(defaultAlternativeURLs, localURL(ip, "port"))
+		}
 	}
 
 	flags := sessionCmd.Flags()
@@ -129,7 +129,7 @@ func signScheme(privatekey *ecdsa.PrivateKey, path string, skipverification bool
 	}
 
 	// Verify that our folder is a valid scheme
-	if err := VerifyScheme(path, false); err != nil {
+	if err := VerifyScheme(path, false, false); err != nil {
 		die("Scheme was signed but verification failed", err)
 	}
 	return nil
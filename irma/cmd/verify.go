@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"sort"
 
 	"github.com/go-errors/errors"
 	irma "github.com/privacybydesign/irmago"
@@ -15,8 +16,10 @@ import (
 var verifyCmd = &cobra.Command{
 	Use:   "verify [<path>]",
 	Short: "Verify irma_configuration folder correctness and authenticity",
-	Long:  `The verify command parses the specified irma_configuration directory, or the current directory if not specified, and checks the signatures of the contained scheme managers.`,
-	Args:  cobra.MaximumNArgs(1),
+	Long: `The verify command parses the specified irma_configuration directory, or the current directory if not specified, and checks the signatures of the contained scheme managers.
+
+With --keyproofs, the proofs of validity of all issuer public keys (see "irma issuer keyprove") are also verified, which takes several minutes per public key.`,
+	Args: cobra.MaximumNArgs(1),
 	RunE: func(cmd *cobra.Command, args []string) error {
 		var err error
 		var path string
@@ -28,7 +31,8 @@ var verifyCmd = &cobra.Command{
 				return err
 			}
 		}
-		if err = RunVerify(path, true); err == nil {
+		keyproofs, _ := cmd.Flags().GetBool("keyproofs")
+		if err = RunVerify(path, keyproofs, true); err == nil {
 			fmt.Println()
 			fmt.Println("Verification was successful.")
 		} else {
@@ -38,7 +42,7 @@ var verifyCmd = &cobra.Command{
 	},
 }
 
-func RunVerify(path string, verbose bool) error {
+func RunVerify(path string, keyproofs, verbose bool) error {
 	path, err := filepath.Abs(path)
 	if err != nil {
 		return err
@@ -49,14 +53,14 @@ func RunVerify(path string, verbose bool) error {
 		return err
 	}
 	if ok {
-		return VerifyIrmaConfiguration(path, verbose)
+		return VerifyIrmaConfiguration(path, keyproofs, verbose)
 	}
 	ok, err = common.IsScheme(path, true)
 	if err != nil {
 		return err
 	}
 	if ok {
-		return VerifyScheme(path, verbose)
+		return VerifyScheme(path, keyproofs, verbose)
 	}
 
 	return errors.New("path must contain a scheme, or multiple schemes in subdirectories")
@@ -68,7 +72,7 @@ func log(verbose bool, msg string) {
 	}
 }
 
-func VerifyScheme(path string, verbose bool) error {
+func VerifyScheme(path string, keyproofs, verbose bool) error {
 	log(verbose, "Verifying scheme")
 	conf, err := irma.NewConfiguration(filepath.Dir(filepath.Dir(path)), irma.ConfigurationOptions{ReadOnly: true})
 	if err != nil {
@@ -81,6 +85,11 @@ func VerifyScheme(path string, verbose bool) error {
 	if err := conf.ValidateKeys(); err != nil {
 		return err
 	}
+	if keyproofs {
+		if err := verifyKeyproofs(conf, verbose); err != nil {
+			return err
+		}
+	}
 
 	for _, warning := range conf.Warnings {
 		fmt.Println("Warning: " + warning)
@@ -88,7 +97,7 @@ func VerifyScheme(path string, verbose bool) error {
 	return nil
 }
 
-func VerifyIrmaConfiguration(path string, verbose bool) error {
+func VerifyIrmaConfiguration(path string, keyproofs, verbose bool) error {
 	log(verbose, "Verifying as configuration directory")
 	conf, err := irma.NewConfiguration(path, irma.ConfigurationOptions{ReadOnly: true})
 	if err != nil {
@@ -103,6 +112,11 @@ func VerifyIrmaConfiguration(path string, verbose bool) error {
 	if len(conf.SchemeManagers) == 0 {
 		return errors.New("Specified folder doesn't contain any schemes")
 	}
+	if keyproofs {
+		if err := verifyKeyproofs(conf, verbose); err != nil {
+			return err
+		}
+	}
 
 	for _, warning := range conf.Warnings {
 		fmt.Println("Warning: " + warning)
@@ -111,6 +125,23 @@ func VerifyIrmaConfiguration(path string, verbose bool) error {
 	return nil
 }
 
+func verifyKeyproofs(conf *irma.Configuration, verbose bool) error {
+	ids := make([]irma.IssuerIdentifier, 0, len(conf.Issuers))
+	for id := range conf.Issuers {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+	for _, id := range ids {
+		log(verbose, "Verifying keyproofs of "+id.String())
+		if err := conf.VerifyIssuerKeyproofs(id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 func init() {
 	schemeCmd.AddCommand(verifyCmd)
+
+	verifyCmd.Flags().Bool("keyproofs", false, "also verify the proofs of validity of the issuer public keys")
 }
@@ -23,6 +23,8 @@ type SignedMessage struct {
 	Context   *big.Int                  `json:"context"`
 	Message   string                    `json:"message"`
 	Timestamp *atum.Timestamp           `json:"timestamp"`
+
+	TSATimestamp *TSATimestamp `json:"tsatimestamp,omitempty"`
 }
 
 func (sm *SignedMessage) Version() int {
@@ -32,13 +34,30 @@ func (sm *SignedMessage) Version() int {
 	return 2
 }
 
+// Validate checks that the @context of the signed message is that of either legacy (version 1)
+// or version 2 signatures, and that it contains at most one timestamp.
+func (sm *SignedMessage) Validate() error {
+	if sm.Timestamp != nil && sm.TSATimestamp != nil {
+		return errMultipleTimestamps
+	}
+	return ValidateLDContext(sm.LDContext, nil, "", LDContextSignedMessage)
+}
+
 func (sm *SignedMessage) GetNonce() *big.Int {
-	return ASN1ConvertSignatureNonce(sm.Message, sm.Nonce, sm.Timestamp)
+	return ASN1ConvertSignatureNonce(sm.Message, sm.Nonce, sm.SignatureTimestamp())
+}
+
+// SignatureTimestamp returns the timestamp of the signed message, if any.
+func (sm *SignedMessage) SignatureTimestamp() *SignatureTimestamp {
+	if sm.Timestamp == nil && sm.TSATimestamp == nil {
+		return nil
+	}
+	return &SignatureTimestamp{Atum: sm.Timestamp, TSA: sm.TSATimestamp}
 }
 
 func (sm *SignedMessage) MatchesNonceAndContext(request *SignatureRequest) bool {
 	return sm.Context.Cmp(request.GetContext()) == 0 &&
-		sm.GetNonce().Cmp(request.GetNonce(sm.Timestamp)) == 0
+		sm.GetNonce().Cmp(request.GetNonce(sm.SignatureTimestamp())) == 0
 }
 
 func (sm *SignedMessage) Disclosure() *Disclosure {
@@ -52,16 +71,17 @@ func (sm *SignedMessage) Disclosure() *Disclosure {
 //
 //	nonce = SHA256(serverNonce, SHA256(message), timestampSignature)
 //
-// where serverNonce is the nonce sent by the signature requestor.
-func ASN1ConvertSignatureNonce(message string, nonce *big.Int, timestamp *atum.Timestamp) *big.Int {
+// where serverNonce is the nonce sent by the signature requestor, and timestampSignature is the
+// signature of an atum timestamp or the token of an RFC 3161 timestamp.
+func ASN1ConvertSignatureNonce(message string, nonce *big.Int, timestamp *SignatureTimestamp) *big.Int {
 	msgHash := sha256.Sum256([]byte(message))
 	n := nonce.Go()
 	if n == nil {
 		n = gobig.NewInt(0)
 	}
 	tohash := []interface{}{n, new(gobig.Int).SetBytes(msgHash[:])}
-	if timestamp != nil {
-		tohash = append(tohash, timestamp.Sig.Data)
+	if sig := timestamp.signature(); sig != nil {
+		tohash = append(tohash, sig)
 	}
 	asn1bytes, err := asn1.Marshal(tohash)
 	if err != nil {
@@ -1,13 +1,15 @@
 package irmaclient
 
 import (
+	"crypto/rsa"
 	"encoding/json"
+	"net/http"
 	"path/filepath"
 	"slices"
+	"strconv"
 	"sync"
 	"time"
 
-	"github.com/bwesterb/go-atum"
 	"github.com/go-co-op/gocron"
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
@@ -68,11 +70,15 @@ type Client struct {
 	signer                Signer
 	sessions              sessions
 
+	// Public keys with which session pointers of particular hosts must be signed
+	pinnedQrKeys map[string]*rsa.PublicKey
+
 	jobs       chan func()   // queue of jobs to run
 	jobsPause  chan struct{} // sending pauses background jobs
 	jobsPaused bool
 
-	credMutex sync.Mutex
+	credMutex    sync.Mutex
+	offlineMutex sync.Mutex // guards the offline disclosures in storage
 }
 
 // Preferences contains the preferences of the user of this client.
@@ -238,10 +244,17 @@ func (client *Client) loadCredentialStorage() (err error) {
 	if client.secretkey, err = client.storage.LoadSecretKey(); err != nil {
 		return
 	}
-	if client.attributes, err = client.storage.LoadAttributes(); err != nil {
+	if err = client.loadAttributeStorage(); err != nil {
 		return
 	}
-	if client.keyshareServers, err = client.storage.LoadKeyshareServers(); err != nil {
+	client.keyshareServers, err = client.storage.LoadKeyshareServers()
+	return
+}
+
+// loadAttributeStorage loads the attributes from storage, and resets the lookup table and the
+// credentials cache to match them.
+func (client *Client) loadAttributeStorage() (err error) {
+	if client.attributes, err = client.storage.LoadAttributes(); err != nil {
 		return
 	}
 
@@ -317,7 +330,9 @@ func (client *Client) CredentialInfoList() irma.CredentialInfoList {
 
 // addCredential adds the specified credential to the Client, saving its signature
 // immediately, and optionally cm.attributes as well.
-func (client *Client) addCredential(cred *credential) (err error) {
+// txAddCredential adds the credential in memory and stores it within the specified transaction.
+// If the transaction fails, the caller must undo the changes in memory using loadAttributeStorage().
+func (client *Client) txAddCredential(tx *transaction, cred *credential) (err error) {
 	id := irma.NewCredentialTypeIdentifier("")
 	if cred.CredentialType() != nil {
 		id = cred.CredentialType().Identifier()
@@ -336,7 +351,7 @@ func (client *Client) addCredential(cred *credential) (err error) {
 		}
 	}
 	if index != -1 {
-		if err = client.remove(id, index, false); err != nil {
+		if err = client.txRemove(tx, id, index, false); err != nil {
 			return err
 		}
 	}
@@ -346,7 +361,7 @@ func (client *Client) addCredential(cred *credential) (err error) {
 	if !id.Empty() {
 		if cred.CredentialType().IsSingleton {
 			for len(client.attrs(id)) != 0 {
-				if err = client.remove(id, 0, false); err != nil {
+				if err = client.txRemove(tx, id, 0, false); err != nil {
 					return
 				}
 			}
@@ -354,7 +369,7 @@ func (client *Client) addCredential(cred *credential) (err error) {
 
 		for i := len(client.attrs(id)) - 1; i >= 0; i-- { // Go backwards through array because remove manipulates it
 			if client.attrs(id)[i].EqualsExceptMetadata(cred.attrs) {
-				if err = client.remove(id, i, false); err != nil {
+				if err = client.txRemove(tx, id, i, false); err != nil {
 					return
 				}
 			}
@@ -370,12 +385,10 @@ func (client *Client) addCredential(cred *credential) (err error) {
 		client.lookup[cred.attrs.Hash()] = &credlookup
 	}
 
-	return client.storage.Transaction(func(tx *transaction) error {
-		if err = client.storage.TxStoreSignature(tx, cred); err != nil {
-			return err
-		}
-		return client.storage.TxStoreAttributes(tx, id, client.attributes[id])
-	})
+	if err = client.storage.TxStoreSignature(tx, cred); err != nil {
+		return err
+	}
+	return client.storage.TxStoreAttributes(tx, id, client.attributes[id])
 }
 
 func generateSecretKey() (*secretKey, error) {
@@ -389,6 +402,21 @@ func generateSecretKey() (*secretKey, error) {
 // Removal methods
 
 func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storeLog bool) error {
+	err := client.storage.Transaction(func(tx *transaction) error {
+		return client.txRemove(tx, id, index, storeLog)
+	})
+	if err != nil {
+		// Nothing was removed from storage, so undo the changes in memory
+		if lerr := client.loadAttributeStorage(); lerr != nil {
+			client.reportError(lerr)
+		}
+	}
+	return err
+}
+
+// txRemove removes the credential in memory and from storage within the specified transaction.
+// If the transaction fails, the caller must undo the changes in memory using loadAttributeStorage().
+func (client *Client) txRemove(tx *transaction, id irma.CredentialTypeIdentifier, index int, storeLog bool) error {
 	// Remove attributes
 	list, exists := client.attributes[id]
 	if !exists || index >= len(list) {
@@ -400,24 +428,21 @@ func (client *Client) remove(id irma.CredentialTypeIdentifier, index int, storeL
 	removed := map[irma.CredentialTypeIdentifier][]irma.TranslatedString{}
 	removed[id] = attrs.Strings()
 
-	err := client.storage.Transaction(func(tx *transaction) error {
-		if err := client.storage.TxDeleteSignature(tx, attrs.Hash()); err != nil {
-			return err
-		}
-		if err := client.storage.TxStoreAttributes(tx, id, client.attributes[id]); err != nil {
+	if err := client.storage.TxDeleteSignature(tx, attrs.Hash()); err != nil {
+		return err
+	}
+	if err := client.storage.TxStoreAttributes(tx, id, client.attributes[id]); err != nil {
+		return err
+	}
+	if storeLog {
+		err := client.storage.TxAddLogEntry(tx, &LogEntry{
+			Type:    ActionRemoval,
+			Time:    irma.Timestamp(time.Now()),
+			Removed: removed,
+		})
+		if err != nil {
 			return err
 		}
-		if storeLog {
-			return client.storage.TxAddLogEntry(tx, &LogEntry{
-				Type:    ActionRemoval,
-				Time:    irma.Timestamp(time.Now()),
-				Removed: removed,
-			})
-		}
-		return nil
-	})
-	if err != nil {
-		return err
 	}
 
 	// Remove credential from cache
@@ -863,7 +888,7 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 			}
 
 			identifier := attribute.Type
-			if identifier.IsCredential() {
+			if identifier.IsCredential() || identifier.IsMetadataAttribute() {
 				attributeIndices[i] = append(attributeIndices[i], &irma.DisclosedAttributeIndex{CredentialIndex: credIndex, AttributeIndex: 1, Identifier: ici})
 				continue // In this case we only disclose the metadata attribute, which is already handled above
 			}
@@ -884,7 +909,7 @@ func (client *Client) groupCredentials(choice *irma.DisclosureChoice) (
 
 // ProofBuilders constructs a list of proof builders for the specified attribute choice.
 func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.SessionRequest,
-) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, *atum.Timestamp, error) {
+) (gabi.ProofBuilderList, irma.DisclosedAttributeIndices, *irma.SignatureTimestamp, error) {
 	todisclose, attributeIndices, err := client.groupCredentials(choice)
 	if err != nil {
 		return nil, nil, nil, err
@@ -908,7 +933,7 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 		builders = append(builders, builder)
 	}
 
-	var timestamp *atum.Timestamp
+	var timestamp *irma.SignatureTimestamp
 	if r, ok := request.(*irma.SignatureRequest); ok {
 		var sigs []*big.Int
 		var disclosed [][]*big.Int
@@ -929,7 +954,7 @@ func (client *Client) ProofBuilders(choice *irma.DisclosureChoice, request irma.
 }
 
 // Proofs computes disclosure proofs containing the attributes specified by choice.
-func (client *Client) Proofs(choice *irma.DisclosureChoice, request irma.SessionRequest) (*irma.Disclosure, *atum.Timestamp, error) {
+func (client *Client) Proofs(choice *irma.DisclosureChoice, request irma.SessionRequest) (*irma.Disclosure, *irma.SignatureTimestamp, error) {
 	builders, choices, timestamp, err := client.ProofBuilders(choice, request)
 	if err != nil {
 		return nil, nil, err
@@ -1028,8 +1053,9 @@ func (client *Client) IssueCommitments(request *irma.IssuanceRequest, choice *ir
 }
 
 // ConstructCredentials constructs and saves new credentials using the specified issuance signature messages
-// and credential builders.
-func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest, builders gabi.ProofBuilderList) error {
+// and credential builders. The credentials are saved along with the log entry, if not nil, in a single
+// transaction, so that either all of them are saved or none of them.
+func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, request *irma.IssuanceRequest, builders gabi.ProofBuilderList, log *LogEntry) error {
 	if len(msg) > len(builders) {
 		return errors.New("Received unexpected amount of signatures")
 	}
@@ -1074,15 +1100,28 @@ func (client *Client) ConstructCredentials(msg []*gabi.IssueSignatureMessage, re
 		gabicreds = append(gabicreds, cred)
 	}
 
-	for _, gabicred := range gabicreds {
-		attrs := irma.NewAttributeListFromInts(gabicred.Attributes[1:], client.Configuration)
-		newcred, err := newCredential(gabicred, attrs, client.Configuration)
-		if err != nil {
-			return err
+	err := client.storage.Transaction(func(tx *transaction) error {
+		for _, gabicred := range gabicreds {
+			attrs := irma.NewAttributeListFromInts(gabicred.Attributes[1:], client.Configuration)
+			newcred, err := newCredential(gabicred, attrs, client.Configuration)
+			if err != nil {
+				return err
+			}
+			if err = client.txAddCredential(tx, newcred); err != nil {
+				return err
+			}
 		}
-		if err = client.addCredential(newcred); err != nil {
-			return err
+		if log != nil {
+			return client.storage.TxAddLogEntry(tx, log)
 		}
+		return nil
+	})
+	if err != nil {
+		// None of the credentials were saved, so undo the changes in memory
+		if lerr := client.loadAttributeStorage(); lerr != nil {
+			client.reportError(lerr)
+		}
+		return err
 	}
 
 	return nil
@@ -1126,13 +1165,16 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 	if len(manager.KeyshareServer) == 0 {
 		return errors.New("Scheme manager has no keyshare server")
 	}
-	if len(pin) < 5 {
-		return errors.New("PIN too short, must be at least 5 characters")
+	policy, err := client.keysharePinPolicy(manager.KeyshareServer)
+	if err != nil {
+		return err
+	}
+	if err = policy.Check(pin); err != nil {
+		return err
 	}
 
 	// We expect that the PIN is equal across all keyshare servers. Therefore, we verify the PIN at one other
 	// keyshare server. We don't check all servers to prevent issues when custom keyshare servers are not available.
-	var err error
 	pinCorrect := true
 	for kssManagerID, kss := range client.keyshareServers {
 		if kss.PinOutOfSync {
@@ -1173,7 +1215,7 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 		return err
 	}
 
-	transport := irma.NewHTTPTransport(manager.KeyshareServer, !client.Preferences.DeveloperMode)
+	transport := client.Configuration.HTTPClient.NewTransport(manager.KeyshareServer, !client.Preferences.DeveloperMode)
 	qr := &irma.Qr{}
 	err = transport.Post("client/register", qr, irma.KeyshareEnrollment{EnrollmentJWT: jwtt})
 	if err != nil {
@@ -1198,7 +1240,7 @@ func (client *Client) keyshareEnrollWorker(managerID irma.SchemeManagerIdentifie
 		},
 		resultErr: make(chan error),
 	}
-	client.newQrSession(qr, handler)
+	client.newQrSession(qr, handler, nil)
 	go func() {
 		err := <-handler.resultErr
 		if err != nil {
@@ -1234,7 +1276,7 @@ func (client *Client) KeyshareVerifyPin(pin string, schemeid irma.SchemeManagerI
 		}
 	}
 	kss := client.keyshareServers[schemeid]
-	transport := irma.NewHTTPTransport(scheme.KeyshareServer, !client.Preferences.DeveloperMode)
+	transport := client.Configuration.HTTPClient.NewTransport(kss.url(client.Configuration), !client.Preferences.DeveloperMode)
 	success, tries, blocked, err := client.verifyPinWorker(pin, kss, transport)
 	if err == nil && success {
 		client.ensureKeyshareAttributeValid(pin, kss, transport)
@@ -1255,6 +1297,9 @@ func (client *Client) KeyshareChangePin(oldPin string, newPin string) {
 				return
 			}
 			if !success {
+				if handler, ok := client.handler.(KeysharePinStatusHandler); ok {
+					handler.KeysharePinIncorrect(schemeID, attempts, blocked)
+				}
 				if attempts > 0 {
 					client.handler.ChangePinIncorrect(schemeID, attempts)
 				} else {
@@ -1264,6 +1309,21 @@ func (client *Client) KeyshareChangePin(oldPin string, newPin string) {
 			}
 		}
 
+		// Check the new PIN against the PIN policy of all keyshare servers before changing any.
+		for schemeID, kss := range client.keyshareServers {
+			if kss.PinOutOfSync {
+				continue
+			}
+			policy, err := client.keysharePinPolicy(kss.url(client.Configuration))
+			if err == nil {
+				err = policy.Check(newPin)
+			}
+			if err != nil {
+				client.handler.ChangePinFailure(schemeID, err)
+				return
+			}
+		}
+
 		// Change the PIN across all keyshare servers.
 		var updatedSchemes []irma.SchemeManagerIdentifier
 		var err error
@@ -1306,13 +1366,25 @@ func (client *Client) KeyshareChangePin(oldPin string, newPin string) {
 	}()
 }
 
+// keysharePinPolicy fetches the PIN policy of the keyshare server at the given URL,
+// falling back to the default policy for keyshare servers that do not publish one.
+func (client *Client) keysharePinPolicy(url string) (irma.KeysharePinPolicy, error) {
+	transport := client.Configuration.HTTPClient.NewTransport(url, !client.Preferences.DeveloperMode)
+	policy := irma.KeysharePinPolicy{}
+	err := transport.Get("client/pin_policy", &policy)
+	if serr, ok := err.(*irma.SessionError); ok && serr.RemoteStatus == http.StatusNotFound {
+		return irma.KeysharePinPolicyDefault, nil
+	}
+	return policy, err
+}
+
 func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdentifier, oldPin string, newPin string) error {
 	kss, ok := client.keyshareServers[managerID]
 	if !ok {
 		return errors.New("Unknown keyshare server")
 	}
 
-	transport := irma.NewHTTPTransport(client.Configuration.SchemeManagers[managerID].KeyshareServer, !client.Preferences.DeveloperMode)
+	transport := client.Configuration.HTTPClient.NewTransport(kss.url(client.Configuration), !client.Preferences.DeveloperMode)
 
 	claims := irma.KeyshareChangePinClaims{
 		KeyshareChangePinData: irma.KeyshareChangePinData{
@@ -1354,6 +1426,85 @@ func (client *Client) keyshareChangePinWorker(managerID irma.SchemeManagerIdenti
 	}
 }
 
+// KeyshareMigrate migrates the enrollment at the keyshare server of the specified scheme to the
+// keyshare server at the specified URL, after which the client uses the new keyshare server for
+// this scheme. The operators of both keyshare servers must share a migration key, and the new
+// keyshare server must sign its JWTs with a key trusted by the scheme. As the PIN and keyshare
+// secret are migrated along, the PIN and the credentials of the scheme remain unchanged.
+// Like KeyshareVerifyPin, it returns whether the PIN was correct; if not, how many tries are left,
+// or for how long the user is blocked.
+func (client *Client) KeyshareMigrate(schemeid irma.SchemeManagerIdentifier, url string, pin string) (bool, int, int, error) {
+	kss, ok := client.keyshareServers[schemeid]
+	if !ok {
+		return false, 0, 0, errors.Errorf("not enrolled at keyshare server of scheme %s", schemeid)
+	}
+	if kss.PinOutOfSync {
+		return false, 0, 0, errors.Errorf("PIN of scheme %s is out of sync", schemeid)
+	}
+	if url == kss.url(client.Configuration) {
+		return false, 0, 0, errors.New("already using this keyshare server")
+	}
+
+	// As the current keyshare server no longer has our user secrets after exporting them, we keep
+	// them until they are imported, and retry importing them if an earlier migration failed
+	if kss.Migration == nil || kss.MigrationURL != url || time.Now().Unix() >= kss.Migration.Expiry {
+		// Authenticate at the current keyshare server and export our user secrets
+		transport := client.Configuration.HTTPClient.NewTransport(kss.url(client.Configuration), !client.Preferences.DeveloperMode)
+		success, tries, blocked, err := client.verifyPinWorker(pin, kss, transport)
+		if err != nil || !success {
+			return success, tries, blocked, err
+		}
+		migration := &irma.KeyshareMigration{}
+		if err = transport.Post("users/migrate/export", migration, nil); err != nil {
+			return false, 0, 0, err
+		}
+		kss.Migration, kss.MigrationURL = migration, url
+		if err = client.storage.StoreKeyshareServers(client.keyshareServers); err != nil {
+			return false, 0, 0, err
+		}
+	}
+
+	// Import them at the new keyshare server, and check that we can authenticate there
+	migration := *kss.Migration
+	migration.Pin = kss.HashedPin(pin)
+	newTransport := client.Configuration.HTTPClient.NewTransport(url, !client.Preferences.DeveloperMode)
+	if err := newTransport.Post("client/migrate", nil, &migration); err != nil {
+		// The new keyshare server limits the PIN attempts for our user secrets like normal PIN checks
+		if serr, ok := err.(*irma.SessionError); ok && serr.RemoteError != nil {
+			switch serr.RemoteError.Status {
+			case http.StatusForbidden:
+				if tries, err := strconv.Atoi(serr.RemoteError.Message); err == nil {
+					return false, tries, 0, nil
+				}
+			case http.StatusTooManyRequests:
+				if blocked, err := strconv.Atoi(serr.RemoteError.Message); err == nil {
+					return false, 0, blocked, nil
+				}
+			}
+		}
+		return false, 0, 0, err
+	}
+	newKss := *kss
+	newKss.URL = url
+	newKss.Migration, newKss.MigrationURL = nil, ""
+	success, tries, blocked, err := client.verifyPinWorker(pin, &newKss, newTransport)
+	if err != nil || !success {
+		return success, tries, blocked, err
+	}
+	if !newKss.tokenValid(client.Configuration) {
+		return false, 0, 0, errors.Errorf("new keyshare server of scheme %s signs with an untrusted key", schemeid)
+	}
+
+	// Switch over to the new keyshare server
+	client.keyshareServers[schemeid] = &newKss
+	if err = client.storage.StoreKeyshareServers(client.keyshareServers); err != nil {
+		client.keyshareServers[schemeid] = kss
+		return false, 0, 0, err
+	}
+	irma.Logger.WithField("scheme", schemeid).Info("Migrated to new keyshare server ", url)
+	return true, 0, 0, nil
+}
+
 // KeyshareRemove unenrolls the keyshare server of the specified scheme manager and removes all associated credentials.
 func (client *Client) KeyshareRemove(manager irma.SchemeManagerIdentifier) error {
 	if _, contains := client.keyshareServers[manager]; !contains {
@@ -1465,7 +1616,7 @@ func (client *Client) ensureKeyshareAttributeValid(pin string, kss *keyshareServ
 			pin:       pin,
 			resultErr: make(chan error),
 		}
-		client.newQrSession(qr, handler)
+		client.newQrSession(qr, handler, nil)
 		if err := <-handler.resultErr; err != nil {
 			client.reportError(err)
 			return
@@ -1500,6 +1651,32 @@ func (client *Client) SetPreferences(pref Preferences) {
 
 func (client *Client) applyPreferences() {}
 
+// PinSessionPointerKey requires session pointers (QRs) pointing to the specified host to be signed
+// by the private key corresponding to the specified public key. Sessions with session pointers
+// lacking a valid signature are then refused, which protects against QRs being replaced by QRs
+// pointing to another server. This method should be called before any sessions are started.
+func (client *Client) PinSessionPointerKey(host string, pk *rsa.PublicKey) {
+	if client.pinnedQrKeys == nil {
+		client.pinnedQrKeys = map[string]*rsa.PublicKey{}
+	}
+	client.pinnedQrKeys[host] = pk
+}
+
+// PinSchemePublicKeys requires the specified scheme to have one of the specified PEM-encoded public
+// keys, so that installing or updating the scheme fails if its host serves another public key.
+// This protects users from a compromised scheme host. This method should be called before any
+// schemes are installed or updated.
+func (client *Client) PinSchemePublicKeys(scheme irma.SchemeManagerIdentifier, pks ...[]byte) error {
+	return client.Configuration.PinSchemePublicKeys(scheme.String(), pks...)
+}
+
+// InstallSchemeVerified installs the scheme at the specified URL, provided that the SHA256 hash of
+// its public key equals the specified hash. The hash should be obtained through another channel
+// than the scheme host, e.g. from a well-known URL of the scheme operator or bundled with the app.
+func (client *Client) InstallSchemeVerified(url string, publicKeyHash []byte) error {
+	return client.Configuration.InstallSchemeWithPublicKeyHash(url, publicKeyHash)
+}
+
 // ConfigurationUpdated should be run after Configuration.Download().
 // For any credential type in the updated scheme to which new attributes were added, this function
 // sets the value of these new attributes to 0 in all instances that the client currently has of this
@@ -0,0 +1,140 @@
+package irmaclient
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+var benchmarkCredType = irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+
+// benchmarkIssuanceRequest returns a request issuing n instances of benchmarkCredType with the
+// latest public key of its issuer.
+func benchmarkIssuanceRequest(b testing.TB, conf *irma.Configuration, n int) *irma.IssuanceRequest {
+	sk, err := conf.PrivateKeys.Latest(benchmarkCredType.IssuerIdentifier())
+	require.NoError(b, err)
+	var creds []*irma.CredentialRequest
+	for i := 0; i < n; i++ {
+		creds = append(creds, &irma.CredentialRequest{
+			CredentialTypeID: benchmarkCredType,
+			KeyCounter:       sk.Counter,
+			Attributes: map[string]string{
+				"firstnames": "Johan Pieter",
+				"firstname":  fmt.Sprintf("Johan %d", i),
+				"familyname": "Stuivezand",
+				"prefix":     "van",
+			},
+		})
+	}
+	request := irma.NewIssuanceRequest(creds)
+	request.ProtocolVersion = irma.NewVersion(2, 8)
+	request.Context = big.NewInt(1)
+	request.Nonce = big.NewInt(1)
+	return request
+}
+
+// issuerConfiguration parses the test schemes including the private keys of the issuers.
+func issuerConfiguration(b testing.TB) *irma.Configuration {
+	conf, err := irma.NewConfiguration(filepath.Join(test.FindTestdataFolder(b), "irma_configuration"), irma.ConfigurationOptions{})
+	require.NoError(b, err)
+	require.NoError(b, conf.ParseFolder())
+	return conf
+}
+
+// issueSignatures computes the issuer's signatures on the commitments of the client, as the IRMA
+// server does.
+func issueSignatures(conf *irma.Configuration, request *irma.IssuanceRequest, commitments *irma.IssueCommitmentMessage) ([]*gabi.IssueSignatureMessage, error) {
+	var sigs []*gabi.IssueSignatureMessage
+	for i, cred := range request.Credentials {
+		id := cred.CredentialTypeID.IssuerIdentifier()
+		pk, err := conf.PublicKey(id, cred.KeyCounter)
+		if err != nil {
+			return nil, err
+		}
+		sk, err := conf.PrivateKeys.Get(id, cred.KeyCounter)
+		if err != nil {
+			return nil, err
+		}
+		attrs, err := cred.AttributeList(conf, irma.GetMetadataVersion(request.ProtocolVersion), nil, time.Now())
+		if err != nil {
+			return nil, err
+		}
+		rb := conf.CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeIndices()
+		sig, err := gabi.NewIssuer(sk, pk, request.GetContext()).
+			IssueSignature(commitments.Proofs[i].(*gabi.ProofU).U, attrs.Ints, nil, commitments.Nonce2, rb)
+		if err != nil {
+			return nil, err
+		}
+		sigs = append(sigs, sig)
+	}
+	return sigs, nil
+}
+
+// benchmarkDisclosure returns a disclosure of one attribute of each of n credentials, issued to
+// the client beforehand, along with the request to verify it against.
+func benchmarkDisclosure(b *testing.B, client *Client, n int) (*irma.Disclosure, *irma.DisclosureRequest) {
+	conf := issuerConfiguration(b)
+	issuanceRequest := benchmarkIssuanceRequest(b, conf, n)
+	commitments, builders, err := client.IssueCommitments(issuanceRequest, &irma.DisclosureChoice{})
+	require.NoError(b, err)
+	sigs, err := issueSignatures(conf, issuanceRequest, commitments)
+	require.NoError(b, err)
+	require.NoError(b, client.ConstructCredentials(sigs, issuanceRequest, builders, nil))
+
+	attr := irma.NewAttributeTypeIdentifier(benchmarkCredType.String() + ".firstname")
+	request := irma.NewDisclosureRequest()
+	request.ProtocolVersion = irma.NewVersion(2, 8)
+	request.Context = big.NewInt(1)
+	request.Nonce = big.NewInt(1)
+	choice := &irma.DisclosureChoice{}
+	for _, list := range client.attributes[benchmarkCredType] {
+		request.AddSingle(attr, nil, nil)
+		choice.Attributes = append(choice.Attributes, []*irma.AttributeIdentifier{{Type: attr, CredentialHash: list.Hash()}})
+	}
+	disclosure, _, err := client.Proofs(choice, request)
+	require.NoError(b, err)
+	return disclosure, request
+}
+
+func BenchmarkVerifyDisclosure(b *testing.B) {
+	for _, n := range []int{1, 3, 8} {
+		b.Run(fmt.Sprintf("credentials=%d", n), func(b *testing.B) {
+			client, handler := parseStorage(b)
+			defer test.ClearTestStorage(b, client, handler.storage)
+			disclosure, request := benchmarkDisclosure(b, client, n)
+
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				_, status, err := disclosure.Verify(client.Configuration, request)
+				if err != nil || status != irma.ProofStatusValid {
+					b.Fatal(status, err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkIssueSignature(b *testing.B) {
+	client, handler := parseStorage(b)
+	defer test.ClearTestStorage(b, client, handler.storage)
+	conf := issuerConfiguration(b)
+	request := benchmarkIssuanceRequest(b, conf, 1)
+	commitments, _, err := client.IssueCommitments(request, &irma.DisclosureChoice{})
+	require.NoError(b, err)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := issueSignatures(conf, request, commitments); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -10,6 +10,7 @@ import (
 	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/internal/testkeyshare"
+	"github.com/privacybydesign/irmago/server/keyshare/keyshareserver"
 )
 
 // Test pinchange interaction
@@ -75,6 +76,36 @@ func TestKeyshareChangePinFailed(t *testing.T) {
 	require.True(t, success)
 }
 
+func TestKeysharePinPolicy(t *testing.T) {
+	testSchemeID := irma.NewSchemeManagerIdentifier("test")
+	test2SchemeID := irma.NewSchemeManagerIdentifier("test2")
+
+	ks1 := testkeyshare.StartKeyshareServer(t, irma.Logger, testSchemeID, func(conf *keyshareserver.Configuration) {
+		conf.PinMinDistinctCharacters = 3
+	})
+	defer ks1.Stop()
+	ks2 := testkeyshare.StartKeyshareServer(t, irma.Logger, test2SchemeID, func(conf *keyshareserver.Configuration) {
+		conf.PinMinLength = 6
+	})
+	defer ks2.Stop()
+
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	// The PIN of the existing enrollment is too short for the second keyshare server
+	client.KeyshareEnroll(test2SchemeID, nil, "12345", "en")
+	require.ErrorIs(t, <-handler.c, irma.ErrPinTooShort)
+	require.NotContains(t, client.keyshareServers, test2SchemeID)
+
+	// The new PIN has too few distinct characters for the first keyshare server
+	client.KeyshareChangePin("12345", "11111")
+	require.ErrorIs(t, <-handler.c, irma.ErrPinTooSimple)
+
+	success, _, _, err := client.KeyshareVerifyPin("12345", testSchemeID)
+	require.NoError(t, err)
+	require.True(t, success)
+}
+
 func TestKeyshareChallengeResponseUpgrade(t *testing.T) {
 	ks := testkeyshare.StartKeyshareServer(t, irma.Logger, irma.NewSchemeManagerIdentifier("test"))
 	defer ks.Stop()
@@ -8,7 +8,9 @@ import (
 	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
 	"github.com/privacybydesign/gabi/signed"
 	irma "github.com/privacybydesign/irmago"
@@ -16,6 +18,7 @@ import (
 	"github.com/privacybydesign/irmago/internal/concmap"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/sirupsen/logrus"
+	"go.etcd.io/bbolt"
 
 	"github.com/go-errors/errors"
 	"github.com/stretchr/testify/assert"
@@ -37,12 +40,12 @@ func TestMain(m *testing.M) {
 	os.Exit(retval)
 }
 
-func parseStorage(t *testing.T) (*Client, *TestClientHandler) {
+func parseStorage(t testing.TB) (*Client, *TestClientHandler) {
 	storage := test.SetupTestStorage(t)
 	return parseExistingStorage(t, storage)
 }
 
-func parseExistingStorage(t *testing.T, storage string) (*Client, *TestClientHandler) {
+func parseExistingStorage(t testing.TB, storage string) (*Client, *TestClientHandler) {
 	handler := &TestClientHandler{t: t, c: make(chan error), storage: storage}
 	path := test.FindTestdataFolder(t)
 
@@ -299,6 +302,60 @@ func TestCredentialRemoval(t *testing.T) {
 	require.Nil(t, cred)
 }
 
+func TestConstructCredentialsRollback(t *testing.T) {
+	client, handler := parseStorage(t)
+	defer test.ClearTestStorage(t, client, handler.storage)
+
+	conf := issuerConfiguration(t)
+	request := benchmarkIssuanceRequest(t, conf, 2)
+	commitments, builders, err := client.IssueCommitments(request, &irma.DisclosureChoice{})
+	require.NoError(t, err)
+	sigs, err := issueSignatures(conf, request, commitments)
+	require.NoError(t, err)
+
+	var hashes []string
+	for _, cred := range request.Credentials {
+		attrs, err := cred.AttributeList(conf, irma.GetMetadataVersion(request.ProtocolVersion), nil, time.Now())
+		require.NoError(t, err)
+		hashes = append(hashes, attrs.Hash())
+	}
+	creds := len(client.attrs(benchmarkCredType))
+	logs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+
+	// Make storing the signature of the second credential fail
+	err = client.storage.Transaction(func(tx *transaction) error {
+		b, err := tx.CreateBucketIfNotExists([]byte(signaturesBucket))
+		if err != nil {
+			return err
+		}
+		_, err = b.CreateBucket([]byte(hashes[1]))
+		return err
+	})
+	require.NoError(t, err)
+
+	log := &LogEntry{Type: irma.ActionIssuing, Time: irma.Timestamp(time.Now())}
+	err = client.ConstructCredentials(sigs, request, builders, log)
+	require.ErrorIs(t, err, bbolt.ErrIncompatibleValue)
+
+	// Neither the first credential nor the log entry is kept, in memory or in storage
+	require.Len(t, client.attrs(benchmarkCredType), creds)
+	require.NotContains(t, client.lookup, hashes[0])
+	for i := range client.attrs(benchmarkCredType) {
+		cred, err := client.credential(benchmarkCredType, i)
+		require.NoError(t, err)
+		require.NotContains(t, hashes, cred.attrs.Hash())
+	}
+	newLogs, err := client.LoadNewestLogs(100)
+	require.NoError(t, err)
+	require.Len(t, newLogs, len(logs))
+
+	require.NoError(t, client.storage.db.Close())
+	client, _ = parseExistingStorage(t, handler.storage)
+	require.Len(t, client.attrs(benchmarkCredType), creds)
+	require.NotContains(t, client.lookup, hashes[0])
+}
+
 func TestRemoveSchemes(t *testing.T) {
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t, client, handler.storage)
@@ -344,6 +401,35 @@ func TestRemoveSchemes(t *testing.T) {
 	require.Error(t, err)
 }
 
+func TestSameSessionRequest(t *testing.T) {
+	studentID := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	fromQr := irma.NewDisclosureRequest(studentID)
+	fromQr.Nonce = big.NewInt(42)
+	fromQr.Context = big.NewInt(1)
+
+	// retrieve simulates the client retrieving the request, serialized as by the server
+	retrieve := func(request irma.SessionRequest) *irma.DisclosureRequest {
+		bts, err := json.Marshal(request)
+		require.NoError(t, err)
+		retrieved := &irma.DisclosureRequest{}
+		require.NoError(t, json.Unmarshal(bts, retrieved))
+		return retrieved
+	}
+	require.True(t, sameSessionRequest(retrieve(fromQr), fromQr))
+
+	other := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.university"))
+	other.Nonce, other.Context = fromQr.Nonce, fromQr.Context
+	require.False(t, sameSessionRequest(retrieve(other), fromQr))
+
+	other = irma.NewDisclosureRequest(studentID)
+	other.Nonce, other.Context = big.NewInt(43), fromQr.Context
+	require.False(t, sameSessionRequest(retrieve(other), fromQr))
+
+	signature := irma.NewSignatureRequest("message", studentID)
+	signature.Nonce, signature.Context = fromQr.Nonce, fromQr.Context
+	require.False(t, sameSessionRequest(retrieve(signature), fromQr))
+}
+
 func TestWrongSchemeManager(t *testing.T) {
 	client, handler := parseStorage(t)
 	defer test.ClearTestStorage(t, client, handler.storage)
@@ -474,7 +560,7 @@ func TestCredentialsConcurrency(t *testing.T) {
 // ------
 
 type TestClientHandler struct {
-	t       *testing.T
+	t       testing.TB
 	c       chan error
 	storage string
 }
@@ -5,10 +5,8 @@ import (
 	"crypto/sha256"
 	"encoding/base64"
 	"net/http"
-	"strconv"
 	"time"
 
-	"github.com/bwesterb/go-atum"
 	"github.com/go-errors/errors"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/privacybydesign/gabi"
@@ -35,6 +33,7 @@ type keyshareSessionHandler interface {
 	KeyshareError(manager *irma.SchemeManagerIdentifier, err error)
 	KeysharePin()
 	KeysharePinOK()
+	KeysharePinIncorrect(manager irma.SchemeManagerIdentifier, remainingAttempts int, blockedDuration int)
 }
 
 type keyshareSession struct {
@@ -47,7 +46,7 @@ type keyshareSession struct {
 	keyshareServer   *keyshareServer // The one keyshare server in use in case of issuance
 	transports       map[irma.SchemeManagerIdentifier]*irma.HTTPTransport
 	issuerProofNonce *big.Int
-	timestamp        *atum.Timestamp
+	timestamp        *irma.SignatureTimestamp
 	pinCheck         bool
 	protocolVersion  *irma.ProtocolVersion
 }
@@ -58,15 +57,22 @@ type keyshareServer struct {
 	PinOutOfSync            bool   `json:"pin_out_of_sync,omitempty"`
 	SchemeManagerIdentifier irma.SchemeManagerIdentifier
 	ChallengeResponse       bool
-	token                   string
+	// URL of the keyshare server to which the enrollment was migrated, if any, overriding the
+	// keyshare server URL of the scheme
+	URL string `json:"url,omitempty"`
+	// User secrets exported by the keyshare server for migration to the keyshare server at
+	// MigrationURL, kept until they are imported since the keyshare server no longer has them
+	Migration    *irma.KeyshareMigration `json:"migration,omitempty"`
+	MigrationURL string                  `json:"migration_url,omitempty"`
+	token        string
 }
 
 const (
 	kssUsernameHeader = "X-IRMA-Keyshare-Username"
 	kssAuthHeader     = "Authorization"
-	kssPinSuccess     = "success"
-	kssPinFailure     = "failure"
-	kssPinError       = "error"
+	kssPinSuccess     = irma.KeysharePinStatusSuccess
+	kssPinFailure     = irma.KeysharePinStatusFailure
+	kssPinError       = irma.KeysharePinStatusError
 )
 
 func newKeyshareServer(schemeManagerIdentifier irma.SchemeManagerIdentifier) (*keyshareServer, error) {
@@ -149,7 +155,7 @@ func newKeyshareSession(
 		}
 
 		ks.keyshareServer = ks.client.keyshareServers[managerID]
-		transport := irma.NewHTTPTransport(scheme.KeyshareServer, !ks.client.Preferences.DeveloperMode)
+		transport := ks.client.Configuration.HTTPClient.NewTransport(ks.keyshareServer.url(ks.client.Configuration), !ks.client.Preferences.DeveloperMode)
 		transport.SetHeader(kssUsernameHeader, ks.keyshareServer.Username)
 		transport.SetHeader(kssAuthHeader, ks.keyshareServer.token)
 		ks.transports[managerID] = transport
@@ -170,6 +176,14 @@ func newKeyshareSession(
 	return ks, <-authenticated
 }
 
+// url returns the URL of the keyshare server of this enrollment.
+func (kss *keyshareServer) url(conf *irma.Configuration) string {
+	if kss.URL != "" {
+		return kss.URL
+	}
+	return conf.SchemeManagers[kss.SchemeManagerIdentifier].KeyshareServer
+}
+
 func (kss *keyshareServer) tokenValid(conf *irma.Configuration) bool {
 	parser := jwt.NewParser(jwt.WithoutClaimsValidation()) // We want to verify expiry on our own below so we can add leeway
 	claims := jwt.RegisteredClaims{}
@@ -206,6 +220,9 @@ func (ks *keyshareSession) VerifyPin(attempts int, authenticated chan bool) {
 			authenticated <- false
 			return
 		}
+		if !success {
+			ks.sessionHandler.KeysharePinIncorrect(manager, attemptsRemaining, blocked)
+		}
 		if blocked != 0 {
 			ks.sessionHandler.KeyshareBlocked(manager, blocked)
 			authenticated <- false
@@ -257,11 +274,24 @@ func (kss *keyshareServer) doChallengeResponse(signer Signer, transport *irma.HT
 		return nil, errors.New("challenge-response authentication method not supported")
 	}
 
+	// If our keyshare secret is split, the cosigner of the keyshare server also needs our authorization
+	var cosignerJWT string
+	if len(auth.CosignerChallenge) > 0 {
+		cosignerJWT, err = SignerCreateJWT(signer, keyname, irma.KeyshareCosignerAuthClaims{
+			RegisteredClaims: jwt.RegisteredClaims{ExpiresAt: jwt.NewNumericDate(time.Now().Add(challengeRequestJWTExpiry))},
+			Challenge:        auth.CosignerChallenge,
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+
 	jwtt, err = SignerCreateJWT(signer, keyname, irma.KeyshareAuthResponseClaims{
 		KeyshareAuthResponseData: irma.KeyshareAuthResponseData{
-			Username:  kss.Username,
-			Pin:       kss.HashedPin(pin),
-			Challenge: auth.Challenge,
+			Username:        kss.Username,
+			Pin:             kss.HashedPin(pin),
+			Challenge:       auth.Challenge,
+			CosignerAuthJWT: cosignerJWT,
 		},
 	})
 	if err != nil {
@@ -298,10 +328,10 @@ func (client *Client) verifyPinWorker(pin string, kss *keyshareServer, transport
 		transport.SetHeader(kssAuthHeader, kss.token)
 		return
 	case kssPinFailure:
-		tries, err = strconv.Atoi(pinresult.Message)
+		tries, err = pinresult.RemainingAttempts()
 		return
 	case kssPinError:
-		blocked, err = strconv.Atoi(pinresult.Message)
+		blocked, err = pinresult.BlockedDuration()
 		return
 	default:
 		err = &irma.SessionError{
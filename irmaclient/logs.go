@@ -20,9 +20,10 @@ type LogEntry struct {
 	Removed map[irma.CredentialTypeIdentifier][]irma.TranslatedString `json:",omitempty"`
 
 	// Signature sessions
-	SignedMessage          []byte          `json:",omitempty"`
-	Timestamp              *atum.Timestamp `json:",omitempty"`
-	SignedMessageLDContext string          `json:",omitempty"`
+	SignedMessage          []byte             `json:",omitempty"`
+	Timestamp              *atum.Timestamp    `json:",omitempty"`
+	TSATimestamp           *irma.TSATimestamp `json:",omitempty"`
+	SignedMessageLDContext string             `json:",omitempty"`
 
 	// Issuance sessions
 	IssueCommitment *irma.IssueCommitmentMessage `json:",omitempty"`
@@ -114,12 +115,13 @@ func (entry *LogEntry) GetSignedMessage() (abs *irma.SignedMessage, err error) {
 	}
 	sigrequest := request.(*irma.SignatureRequest)
 	return &irma.SignedMessage{
-		LDContext: entry.SignedMessageLDContext,
-		Signature: entry.Disclosure.Proofs,
-		Nonce:     sigrequest.Nonce,
-		Context:   sigrequest.GetContext(),
-		Message:   string(entry.SignedMessage),
-		Timestamp: entry.Timestamp,
+		LDContext:    entry.SignedMessageLDContext,
+		Signature:    entry.Disclosure.Proofs,
+		Nonce:        sigrequest.Nonce,
+		Context:      sigrequest.GetContext(),
+		Message:      string(entry.SignedMessage),
+		Timestamp:    entry.Timestamp,
+		TSATimestamp: entry.TSATimestamp,
 	}, nil
 }
 
@@ -142,7 +144,9 @@ func (session *session) createLogEntry(response interface{}) (*LogEntry, error)
 	case irma.ActionSigning:
 		// Get the signed message and timestamp
 		entry.SignedMessage = []byte(session.request.(*irma.SignatureRequest).Message)
-		entry.Timestamp = session.timestamp
+		if session.timestamp != nil {
+			entry.Timestamp, entry.TSATimestamp = session.timestamp.Atum, session.timestamp.TSA
+		}
 		entry.SignedMessageLDContext = irma.LDContextSignedMessage
 
 		fallthrough
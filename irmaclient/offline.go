@@ -0,0 +1,169 @@
+package irmaclient
+
+import (
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// OfflineDisclosure is a disclosure computed offline, from the disclosure request contained in the
+// session pointer, awaiting submission to the IRMA server before the offline session times out.
+// Offline disclosures involve no keyshare servers or nonrevocation proofs, as these require a connection.
+type OfflineDisclosure struct {
+	Qr         *irma.Qr         `json:"qr"`
+	Disclosure *irma.Disclosure `json:"disclosure"`
+	Prepared   irma.Timestamp   `json:"prepared"`
+}
+
+// OfflineCandidates returns the disclosure request contained in the specified session pointer and
+// the candidates for the user to choose from, like Candidates(), without contacting the IRMA server.
+func (client *Client) OfflineCandidates(qr *irma.Qr) (
+	request *irma.DisclosureRequest, candidates [][]DisclosureCandidates, satisfiable bool, err error,
+) {
+	if err = client.checkOfflineQr(qr); err != nil {
+		return nil, nil, false, err
+	}
+	candidates, satisfiable, err = client.Candidates(qr.Request)
+	return qr.Request, candidates, satisfiable, err
+}
+
+// PrepareOfflineDisclosure computes the disclosure of the attributes specified by choice for the
+// request contained in the specified session pointer, and stores it until it is submitted using
+// SubmitOfflineDisclosures().
+func (client *Client) PrepareOfflineDisclosure(qr *irma.Qr, choice *irma.DisclosureChoice) (*OfflineDisclosure, error) {
+	if err := client.checkOfflineQr(qr); err != nil {
+		return nil, err
+	}
+	if err := choice.Validate(); err != nil {
+		return nil, err
+	}
+	disclosure, _, err := client.Proofs(choice, qr.Request)
+	if err != nil {
+		return nil, err
+	}
+	d := &OfflineDisclosure{Qr: qr, Disclosure: disclosure, Prepared: irma.Timestamp(time.Now())}
+
+	client.offlineMutex.Lock()
+	defer client.offlineMutex.Unlock()
+	disclosures, err := client.storage.LoadOfflineDisclosures()
+	if err != nil {
+		return nil, err
+	}
+	if err = client.storage.StoreOfflineDisclosures(append(disclosures, d)); err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// OfflineDisclosures returns the offline disclosures that have not yet been submitted.
+func (client *Client) OfflineDisclosures() ([]*OfflineDisclosure, error) {
+	client.offlineMutex.Lock()
+	defer client.offlineMutex.Unlock()
+	return client.storage.LoadOfflineDisclosures()
+}
+
+// SubmitOfflineDisclosures submits the offline disclosures that have not yet been submitted to
+// their IRMA servers, and returns the disclosures that could not be submitted because of a
+// transport error, which are kept for a next attempt. Disclosures that are rejected by their IRMA
+// server, e.g. because the session timed out, are removed. This method should be invoked when
+// connectivity returns.
+func (client *Client) SubmitOfflineDisclosures() ([]*OfflineDisclosure, error) {
+	client.offlineMutex.Lock()
+	defer client.offlineMutex.Unlock()
+	disclosures, err := client.storage.LoadOfflineDisclosures()
+	if err != nil {
+		return nil, err
+	}
+
+	var pending []*OfflineDisclosure
+	for _, d := range disclosures {
+		err := client.submitOfflineDisclosure(d)
+		if serr, ok := err.(*irma.SessionError); ok && serr.ErrorType == irma.ErrorTransport {
+			pending = append(pending, d)
+		} else if err != nil {
+			irma.Logger.Warn(errors.WrapPrefix(err, "Failed to submit offline disclosure", 0).ErrorStack())
+		}
+	}
+	if err = client.storage.StoreOfflineDisclosures(pending); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// checkOfflineQr checks that the specified session pointer is of an offline session, of which the
+// disclosure can be computed without contacting the IRMA server or a keyshare server.
+func (client *Client) checkOfflineQr(qr *irma.Qr) error {
+	if err := qr.Validate(); err != nil {
+		return err
+	}
+	if qr.Request == nil {
+		return errors.New("session pointer contains no session request")
+	}
+	if _, err := client.parseQrURL(qr); err != nil {
+		return err
+	}
+
+	request := qr.Request
+	if request.DevelopmentMode && !client.Preferences.DeveloperMode {
+		return errors.New("server running in developer mode: either switch to production mode, or enable developer mode in IRMA app")
+	}
+	if len(request.Revocation) > 0 {
+		return errors.New("nonrevocation proofs cannot be computed offline")
+	}
+	if err := request.Disclose.Validate(client.Configuration); err != nil {
+		return err
+	}
+	for id := range request.Identifiers().SchemeManagers {
+		if client.Configuration.SchemeManagers[id].Distributed() {
+			return errors.Errorf("attributes of scheme %s cannot be disclosed offline, as this involves its keyshare server", id)
+		}
+	}
+	return nil
+}
+
+// submitOfflineDisclosure performs the session of the offline disclosure with its IRMA server,
+// posting the disclosure after checking that the session request equals the one in the session pointer.
+func (client *Client) submitOfflineDisclosure(d *OfflineDisclosure) error {
+	transport := client.Configuration.HTTPClient.NewTransport(d.Qr.URL, !client.Preferences.DeveloperMode)
+	transport.SetHeader(irma.MinVersionHeader, client.minVersion.String())
+	transport.SetHeader(irma.MaxVersionHeader, client.maxVersion.String())
+	auth, err := common.NewSessionToken()
+	if err != nil {
+		return err
+	}
+	transport.SetHeader(irma.AuthorizationHeader, auth)
+
+	request := &irma.DisclosureRequest{}
+	if err := transport.Get("", &irma.ClientSessionRequest{Request: request}); err != nil {
+		return err
+	}
+	if !sameSessionRequest(request, d.Qr.Request) {
+		_ = transport.Delete()
+		return errors.New("session request differs from the request in the session pointer")
+	}
+
+	response := &irma.ServerSessionResponse{ProtocolVersion: request.ProtocolVersion, SessionType: irma.ActionDisclosing}
+	if err := transport.Post("proofs", response, d.Disclosure); err != nil {
+		return err
+	}
+	if response.ProofStatus != irma.ProofStatusValid {
+		return &irma.SessionError{ErrorType: irma.ErrorRejected, Info: string(response.ProofStatus)}
+	}
+
+	s := &session{
+		Action:        irma.ActionDisclosing,
+		Version:       request.ProtocolVersion,
+		RequestorInfo: requestorInfo(d.Qr.URL, client.Configuration),
+		request:       request,
+	}
+	log, err := s.createLogEntry(d.Disclosure)
+	if err != nil {
+		return err
+	}
+	if err = client.storage.AddLogEntry(log); err != nil {
+		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to write log entry", 0).ErrorStack())
+	}
+	return nil
+}
@@ -4,11 +4,11 @@ import (
 	"encoding/json"
 	"fmt"
 	"net/url"
+	"reflect"
 	"runtime/debug"
 	"strings"
 	"time"
 
-	"github.com/bwesterb/go-atum"
 	"github.com/go-errors/errors"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
@@ -62,6 +62,22 @@ type Handler interface {
 	RequestPin(remainingAttempts int, callback PinHandler)
 }
 
+// BindingCodeHandler can optionally be implemented by a Handler. If so, BindingCodeSet is invoked
+// with the binding code of the session, if any, which should be shown to the user so that they can
+// compare it to the binding code shown on the requestor's web page.
+type BindingCodeHandler interface {
+	BindingCodeSet(bindingCode string)
+}
+
+// KeysharePinStatusHandler can optionally be implemented by a Handler or ClientHandler. If so,
+// KeysharePinIncorrect is invoked when the keyshare server of the specified scheme rejects a PIN,
+// with the number of PIN attempts left and, if the account is now blocked, the number of seconds
+// during which it is blocked, before RequestPin() or KeyshareBlocked() (or ChangePinIncorrect() or
+// ChangePinBlocked()) is invoked. This allows showing e.g. when the user can try again.
+type KeysharePinStatusHandler interface {
+	KeysharePinIncorrect(manager irma.SchemeManagerIdentifier, remainingAttempts int, blockedDuration int)
+}
+
 // SessionDismisser can dismiss the current IRMA session.
 type SessionDismisser interface {
 	Dismiss()
@@ -82,6 +98,7 @@ type session struct {
 	prepRevocation chan error // used when nonrevocation preprocessing is done
 
 	pendingPermissionRequest bool
+	requestFromQr            bool // the request was taken from the session pointer and must still be retrieved
 
 	next               *session
 	implicitDisclosure [][]*irma.AttributeIdentifier
@@ -91,12 +108,12 @@ type session struct {
 	builders         gabi.ProofBuilderList
 
 	// State for signature sessions
-	timestamp *atum.Timestamp
+	timestamp *irma.SignatureTimestamp
 
 	// These are empty on manual sessions
 	Hostname  string
 	ServerURL string
-	transport *irma.HTTPTransport
+	transport irma.SessionTransport
 }
 
 type sessions struct {
@@ -119,6 +136,10 @@ var supportedVersions = map[int][]int{
 	},
 }
 
+// Time within which the server must accept connections at the (alternative) URLs of a session
+// pointer for them to be considered reachable.
+const reachabilityTimeout = 2 * time.Second
+
 // Session constructors
 
 // NewSession starts a new IRMA session, given (along with a handler to pass feedback to) a session request.
@@ -126,13 +147,22 @@ var supportedVersions = map[int][]int{
 func (client *Client) NewSession(sessionrequest string, handler Handler) SessionDismisser {
 	bts := []byte(sessionrequest)
 
+	if strings.HasPrefix(sessionrequest, irma.CompactQrPrefix) {
+		qr, err := irma.ParseCompactQr(sessionrequest)
+		if err != nil {
+			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+			return nil
+		}
+		return client.newQrSession(qr, handler, nil)
+	}
+
 	qr := &irma.Qr{}
 	if err := json.Unmarshal(bts, qr); err == nil && qr.IsQr() {
 		if err = qr.Validate(); err != nil {
 			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
 			return nil
 		}
-		return client.newQrSession(qr, handler)
+		return client.newQrSession(qr, handler, nil)
 	}
 
 	sigRequest := &irma.SignatureRequest{}
@@ -157,8 +187,29 @@ func (client *Client) NewSession(sessionrequest string, handler Handler) Session
 	return nil
 }
 
+// NewSessionWithTransport starts a new IRMA session, given a session pointer and a handler like
+// NewSession(), in which the messages to the IRMA server are sent using the specified transport
+// instead of over HTTP, e.g. to a local terminal using the proximity package. The URL of the
+// session pointer is used as the session URL by the transport. Pairing is not supported.
+func (client *Client) NewSessionWithTransport(qr *irma.Qr, transport irma.SessionTransport, handler Handler) SessionDismisser {
+	if err := qr.Validate(); err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+		return nil
+	}
+	if qr.Type == irma.ActionRedirect {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Info: "static session pointers require HTTP"})
+		return nil
+	}
+	return client.newQrSession(qr, handler, transport)
+}
+
 // newManualSession starts a manual session, given a signature request in JSON and a handler to pass messages to
 func (client *Client) newManualSession(request irma.SessionRequest, handler Handler, action irma.Action) SessionDismisser {
+	token, err := common.NewSessionToken()
+	if err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+		return nil
+	}
 	client.PauseJobs()
 
 	doneChannel := make(chan struct{}, 1)
@@ -170,6 +221,7 @@ func (client *Client) newManualSession(request irma.SessionRequest, handler Hand
 		client:         client,
 		Version:        client.minVersion,
 		request:        request,
+		token:          token,
 		done:           doneChannel,
 		prepRevocation: make(chan error),
 	}
@@ -180,11 +232,18 @@ func (client *Client) newManualSession(request irma.SessionRequest, handler Hand
 	return session
 }
 
-// newQrSession creates and starts a new interactive IRMA session
-func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
+// newQrSession creates and starts a new interactive IRMA session, using an HTTPTransport
+// if the specified transport is nil
+func (client *Client) newQrSession(qr *irma.Qr, handler Handler, transport irma.SessionTransport) *session {
+	u, err := client.parseQrURL(qr)
+	if err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+		return nil
+	}
+
 	if qr.Type == irma.ActionRedirect {
 		newqr := &irma.Qr{}
-		transport := irma.NewHTTPTransport("", !client.Preferences.DeveloperMode)
+		transport := client.Configuration.HTTPClient.NewTransport("", !client.Preferences.DeveloperMode)
 		if err := transport.Post(qr.URL, newqr, struct{}{}); err != nil {
 			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorTransport, Err: errors.Wrap(err, 0)})
 			return nil
@@ -193,23 +252,43 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
 			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: errors.New("infinite static QR recursion")})
 			return nil
 		}
-		return client.newQrSession(newqr, handler)
+		return client.newQrSession(newqr, handler, nil)
 	}
 
+	// The session pointer may contain alternative URLs of the server, e.g. on other networks,
+	// of which we use the first one that we can reach. The requestor is determined from the URL
+	// that we actually use, so that an alternative URL cannot impersonate the requestor of the URL.
+	serverURL := qr.URL
+	if transport == nil {
+		serverURL = qr.ReachableURL(reachabilityTimeout)
+		transport = client.Configuration.HTTPClient.NewTransport(serverURL, !client.Preferences.DeveloperMode)
+	}
+	if serverURL != qr.URL {
+		if u, err = url.ParseRequestURI(serverURL); err != nil {
+			handler.Failure(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Err: err})
+			return nil
+		}
+	}
+
+	token, err := common.NewSessionToken()
+	if err != nil {
+		handler.Failure(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+		return nil
+	}
 	client.PauseJobs()
 
-	u, _ := url.ParseRequestURI(qr.URL) // Qr validator already checked this for errors
 	doneChannel := make(chan struct{}, 1)
 	doneChannel <- struct{}{}
 	close(doneChannel)
 	session := &session{
-		ServerURL:      qr.URL,
+		ServerURL:      serverURL,
 		Hostname:       u.Hostname(),
-		RequestorInfo:  requestorInfo(qr.URL, client.Configuration),
-		transport:      irma.NewHTTPTransport(qr.URL, !client.Preferences.DeveloperMode),
+		RequestorInfo:  requestorInfo(serverURL, client.Configuration),
+		transport:      transport,
 		Action:         qr.Type,
 		Handler:        handler,
 		client:         client,
+		token:          token,
 		done:           doneChannel,
 		prepRevocation: make(chan error),
 	}
@@ -239,18 +318,57 @@ func (client *Client) newQrSession(qr *irma.Qr, handler Handler) *session {
 
 	// From protocol version 2.8 also an authorization header must be included.
 	if client.maxVersion.Above(2, 7) {
-		clientAuth := common.NewSessionToken()
+		clientAuth, err := common.NewSessionToken()
+		if err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
+			return nil
+		}
 		session.transport.SetHeader(irma.AuthorizationHeader, clientAuth)
+		// Over HTTP the server may replace the authorization after each request
+		if transport, ok := session.transport.(*irma.HTTPTransport); ok {
+			session.transport.SetHeader(irma.AuthorizationRotationHeader, "true")
+			// From protocol version 2.9 the authorization can also be bound to our TLS connections
+			if client.maxVersion.Above(2, 8) {
+				if err := transport.EnableTLSBinding(); err != nil {
+					irma.Logger.Warn("failed to enable TLS binding: ", err.Error())
+				}
+			}
+		}
 	}
 
 	if !strings.HasSuffix(session.ServerURL, "/") {
 		session.ServerURL += "/"
 	}
 
+	// If the session pointer contains the request and its signature has been verified above, then we
+	// can ask the user for permission right away, retrieving the request only before responding
+	if qr.Request != nil && client.pinnedQrKeys[u.Hostname()] != nil && session.Action == irma.ActionDisclosing &&
+		qr.Request.ProtocolVersion != nil && !qr.Request.ProtocolVersion.AboveVersion(client.maxVersion) {
+		session.request = qr.Request
+		session.requestFromQr = true
+		go session.processSessionInfo()
+		return session
+	}
+
 	go session.getSessionInfo()
 	return session
 }
 
+// parseQrURL parses the URL of the session pointer, verifying the signature of the session pointer
+// if the key of its host is pinned.
+func (client *Client) parseQrURL(qr *irma.Qr) (*url.URL, error) {
+	u, err := url.ParseRequestURI(qr.URL)
+	if err != nil {
+		return nil, err
+	}
+	if pk := client.pinnedQrKeys[u.Hostname()]; pk != nil {
+		if err = qr.VerifySignature(pk); err != nil {
+			return nil, err
+		}
+	}
+	return u, nil
+}
+
 // Core session methods
 
 // getSessionInfo retrieves the first message in the IRMA protocol (only in interactive sessions)
@@ -271,6 +389,12 @@ func (session *session) getSessionInfo() {
 		return
 	}
 
+	if cr.Options.BindingCode != "" {
+		if handler, ok := session.Handler.(BindingCodeHandler); ok {
+			handler.BindingCodeSet(cr.Options.BindingCode)
+		}
+	}
+
 	// Check whether pairing is needed, and if so, wait for it to be completed.
 	if cr.Options.PairingMethod != irma.PairingMethodNone {
 		if err = session.handlePairing(cr.Options.PairingCode); err != nil {
@@ -282,13 +406,48 @@ func (session *session) getSessionInfo() {
 	session.processSessionInfo()
 }
 
+// retrieveRequest retrieves the session request from the server, in sessions that started with the
+// request from the session pointer, and checks that it equals the request from the session pointer.
+func (session *session) retrieveRequest() *irma.SessionError {
+	request := &irma.DisclosureRequest{}
+	cr := &irma.ClientSessionRequest{Request: request}
+	if err := session.transport.Get("", cr); err != nil {
+		return err.(*irma.SessionError)
+	}
+	if !sameSessionRequest(request, session.request.(*irma.DisclosureRequest)) {
+		return &irma.SessionError{
+			ErrorType: irma.ErrorInvalidRequest,
+			Info:      "session request differs from the request in the session pointer",
+		}
+	}
+	session.requestFromQr = false
+	return nil
+}
+
+// sameSessionRequest returns whether a session request retrieved from the server has the same
+// nonce, context and requested attributes as the request from a session pointer, against which the
+// proofs are computed. The @context must be that of the request from the session pointer as well,
+// so that a signature request, of which the message would not be shown to the user, is refused.
+// Requests that are sent only when pairing is completed are never the same.
+func sameSessionRequest(retrieved, fromQr *irma.DisclosureRequest) bool {
+	return retrieved.LDContext == fromQr.LDContext &&
+		retrieved.Nonce != nil && retrieved.Nonce.Cmp(fromQr.Nonce) == 0 &&
+		retrieved.GetContext().Cmp(fromQr.GetContext()) == 0 &&
+		reflect.DeepEqual(retrieved.Disclose, fromQr.Disclose)
+}
+
 func (session *session) handlePairing(pairingCode string) error {
+	// Waiting for the frontend requires the status endpoints of the server over HTTP
+	transport, ok := session.transport.(*irma.HTTPTransport)
+	if !ok {
+		return &irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Info: "pairing is not supported by the session transport"}
+	}
 	session.Handler.PairingRequired(pairingCode)
 
 	statuschan := make(chan irma.ServerStatus)
 	errorchan := make(chan error)
 
-	go irma.WaitStatusChanged(session.transport, irma.ServerStatusPairing, statuschan, errorchan)
+	go irma.WaitStatusChanged(transport, irma.ServerStatusPairing, statuschan, errorchan)
 	select {
 	case status := <-statuschan:
 		if status == irma.ServerStatusConnected {
@@ -476,6 +635,13 @@ func (session *session) doSession(proceed bool, choice *irma.DisclosureChoice) {
 	}
 	session.Handler.StatusUpdate(session.Action, irma.ClientStatusCommunicating)
 
+	if session.requestFromQr {
+		if err := session.retrieveRequest(); err != nil {
+			session.fail(err)
+			return
+		}
+	}
+
 	// wait for revocation preparation to finish
 	err := <-session.prepRevocation
 	if err != nil {
@@ -570,28 +736,36 @@ func (session *session) sendResponse(message interface{}) {
 			return
 		}
 		if session.Action == irma.ActionIssuing {
-			if err = session.client.ConstructCredentials(serverResponse.IssueSignatures, session.request.(*irma.IssuanceRequest), session.builders); err != nil {
+			// The log entry is saved along with the new credentials
+			if err = session.client.ConstructCredentials(serverResponse.IssueSignatures, session.request.(*irma.IssuanceRequest), session.builders, log); err != nil {
 				session.fail(&irma.SessionError{ErrorType: irma.ErrorCrypto, Err: err})
 				return
 			}
 		}
 	}
 
-	// We don't add new credentials in one transaction, because the credentials are already manipulated in cache,
-	// and it is too complex to do a rollback of all these changes if that single transaction would fail.
-	// Changing this would require a major refactor. Therefore, we currently start a separate transaction
-	// to add the log entry. If this fails, we log the error as a warning.
-	if err = session.client.storage.AddLogEntry(log); err != nil {
-		irma.Logger.Warn(errors.WrapPrefix(err, "Failed to write log entry", 0).ErrorStack())
+	// If writing the log entry of other sessions fails, we log the error as a warning.
+	if !session.IsInteractive() || session.Action != irma.ActionIssuing {
+		if err = session.client.storage.AddLogEntry(log); err != nil {
+			irma.Logger.Warn(errors.WrapPrefix(err, "Failed to write log entry", 0).ErrorStack())
+		}
 	}
 	if session.Action == irma.ActionIssuing {
 		session.client.handler.UpdateAttributes()
 	}
+	if serverResponse != nil && serverResponse.NextSession != nil {
+		if _, err = session.client.parseQrURL(serverResponse.NextSession); err != nil {
+			session.fail(&irma.SessionError{ErrorType: irma.ErrorInvalidRequest, Info: "Invalid next session pointer", Err: err})
+			return
+		}
+	}
 	session.finish(false)
 
 	if serverResponse != nil && serverResponse.NextSession != nil {
-		session.next = session.client.newQrSession(serverResponse.NextSession, session.Handler)
-		session.next.implicitDisclosure = session.choice.Attributes
+		// If the next session cannot be started, then newQrSession() has reported that to the handler
+		if session.next = session.client.newQrSession(serverResponse.NextSession, session.Handler, nil); session.next != nil {
+			session.next.implicitDisclosure = session.choice.Attributes
+		}
 	} else {
 		session.Handler.Success(string(messageJson))
 	}
@@ -841,6 +1015,12 @@ func (session *session) KeysharePinOK() {
 	session.Handler.StatusUpdate(session.Action, irma.ClientStatusCommunicating)
 }
 
+func (session *session) KeysharePinIncorrect(manager irma.SchemeManagerIdentifier, remainingAttempts int, blockedDuration int) {
+	if handler, ok := session.Handler.(KeysharePinStatusHandler); ok {
+		handler.KeysharePinIncorrect(manager, remainingAttempts, blockedDuration)
+	}
+}
+
 func (s sessions) remove(token string) {
 	last := s.sessions[token]
 	delete(s.sessions, token)
@@ -859,6 +1039,5 @@ func (s sessions) remove(token string) {
 }
 
 func (s sessions) add(session *session) {
-	session.token = common.NewSessionToken()
 	s.sessions[session.token] = session
 }
@@ -44,6 +44,7 @@ const (
 	preferencesKey  = "preferences"  // Value: Preferences
 	updatesKey      = "updates"      // Value: []update
 	kssKey          = "kss"          // Value: map[irma.SchemeManagerIdentifier]*keyshareServer
+	offlineKey      = "offline"      // Value: []*OfflineDisclosure
 
 	attributesBucket = "attrs" // Key: []byte, value: []*irma.AttributeList
 	logsBucket       = "logs"  // Key: (auto-increment index), value: *LogEntry
@@ -333,6 +334,12 @@ func (s *storage) TxStoreUpdates(tx *transaction, updates []update) error {
 	return s.txStore(tx, userdataBucket, updatesKey, updates)
 }
 
+func (s *storage) StoreOfflineDisclosures(disclosures []*OfflineDisclosure) error {
+	return s.Transaction(func(tx *transaction) error {
+		return s.txStore(tx, userdataBucket, offlineKey, disclosures)
+	})
+}
+
 func (s *storage) LoadSignature(attrs *irma.AttributeList) (*gabi.CLSignature, *revocation.Witness, error) {
 	credType := attrs.CredentialType()
 	if credType == nil {
@@ -554,6 +561,12 @@ func (s *storage) LoadUpdates() (updates []update, err error) {
 	return
 }
 
+func (s *storage) LoadOfflineDisclosures() (disclosures []*OfflineDisclosure, err error) {
+	disclosures = []*OfflineDisclosure{}
+	_, err = s.load(userdataBucket, offlineKey, &disclosures)
+	return
+}
+
 func (s *storage) LoadPreferences() (Preferences, error) {
 	config := defaultPreferences
 	_, err := s.load(userdataBucket, preferencesKey, &config)
@@ -0,0 +1,261 @@
+// Package testclient implements an IRMA client for end-to-end tests of IRMA integrations, such as
+// the backends and web pages of requestors. It performs sessions as the IRMA app would, but
+// without user interaction: it discloses the first satisfying credentials from its wallet,
+// accepts all credentials offered to it and enters a fixed PIN when a keyshare server asks for it.
+//
+// The wallet of the client is the irmaclient storage directory passed to New. It can be filled
+// with credentials by performing issuance sessions, or by copying an existing storage directory.
+// The client must not be used with real credentials: it uses a fixed storage encryption key by
+// default, and gives permission for any session.
+package testclient
+
+import (
+	"crypto/ecdsa"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/signed"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/irmaclient"
+)
+
+// DefaultAESKey is the key with which the storage of the client is encrypted if Options.AESKey is
+// not set, which is also used by the test storage in the testdata folder of this repository.
+var DefaultAESKey = [32]byte{
+	'a', 's', 'd', 'f', 'a', 's', 'd', 'f', 'a', 's', 'd', 'f', 'a', 's', 'd', 'f',
+	'a', 's', 'd', 'f', 'a', 's', 'd', 'f', 'a', 's', 'd', 'f', 'a', 's', 'd', 'f',
+}
+
+// ErrUnsatisfiable is returned by DoSession if the wallet does not contain the credentials
+// required by the session request.
+var ErrUnsatisfiable = errors.New("session request cannot be satisfied by the wallet")
+
+// Options configure a test client. The zero value is valid.
+type Options struct {
+	// Key with which the storage is encrypted (default DefaultAESKey)
+	AESKey [32]byte
+	// PIN entered when a keyshare server asks for it (default "12345")
+	Pin string
+	// Maximum duration of DoSession (default 30 seconds)
+	Timeout time.Duration
+	// If set, invoked with the pairing code when the session requires pairing, after which the
+	// session continues once the pairing is completed in the frontend. Otherwise such sessions fail.
+	PairingRequired func(pairingCode string)
+}
+
+// Client is an IRMA client that performs sessions without user interaction.
+type Client struct {
+	*irmaclient.Client
+	options Options
+}
+
+// New returns a test client using the storage directory at storagePath, which is created if it
+// does not exist, and the schemes in irmaConfigurationPath.
+func New(storagePath, irmaConfigurationPath string, options Options) (*Client, error) {
+	if options.AESKey == [32]byte{} {
+		options.AESKey = DefaultAESKey
+	}
+	if options.Pin == "" {
+		options.Pin = "12345"
+	}
+	if options.Timeout == 0 {
+		options.Timeout = 30 * time.Second
+	}
+
+	if err := common.EnsureDirectoryExists(storagePath); err != nil {
+		return nil, err
+	}
+	signer, err := loadSigner(filepath.Join(storagePath, "ecdsa_sk.pem"))
+	if err != nil {
+		return nil, err
+	}
+	client, err := irmaclient.New(storagePath, irmaConfigurationPath, clientHandler{}, signer, options.AESKey)
+	if err != nil {
+		return nil, err
+	}
+	client.SetPreferences(irmaclient.Preferences{DeveloperMode: true})
+	return &Client{Client: client, options: options}, nil
+}
+
+// DoSession performs the session to which the session pointer (i.e. the contents of the QR code
+// in JSON, or a compact QR) refers, and returns the result that the client sends to the frontend
+// after a successful session: the disclosure or attribute-based signature in JSON, if any.
+func (c *Client) DoSession(sessionPointer string) (string, error) {
+	handler := &sessionHandler{client: c, done: make(chan sessionResult, 1)}
+	dismisser := c.NewSession(sessionPointer, handler)
+	select {
+	case res := <-handler.done:
+		return res.result, res.err
+	case <-time.After(c.options.Timeout):
+		if dismisser != nil {
+			dismisser.Dismiss()
+		}
+		return "", errors.New("session timed out")
+	}
+}
+
+// loadSigner loads the ECDSA private key with which the client signs, generating it if necessary.
+func loadSigner(path string) (*signer, error) {
+	bts, err := os.ReadFile(path)
+	if err == nil {
+		sk, err := signed.UnmarshalPemPrivateKey(bts)
+		if err != nil {
+			return nil, err
+		}
+		return &signer{sk}, nil
+	}
+	if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	sk, err := signed.GenerateKey()
+	if err != nil {
+		return nil, err
+	}
+	if bts, err = signed.MarshalPemPrivateKey(sk); err != nil {
+		return nil, err
+	}
+	if err = os.WriteFile(path, bts, 0600); err != nil {
+		return nil, err
+	}
+	return &signer{sk}, nil
+}
+
+type signer struct {
+	privateKey *ecdsa.PrivateKey
+}
+
+func (s *signer) PublicKey(_ string) ([]byte, error) {
+	return signed.MarshalPublicKey(&s.privateKey.PublicKey)
+}
+
+func (s *signer) Sign(_ string, msg []byte) ([]byte, error) {
+	return signed.Sign(s.privateKey, msg)
+}
+
+type clientHandler struct{}
+
+func (clientHandler) UpdateConfiguration(new *irma.IrmaIdentifierSet)                       {}
+func (clientHandler) UpdateAttributes()                                                     {}
+func (clientHandler) Revoked(cred *irma.CredentialIdentifier)                               {}
+func (clientHandler) EnrollmentSuccess(manager irma.SchemeManagerIdentifier)                {}
+func (clientHandler) EnrollmentFailure(manager irma.SchemeManagerIdentifier, err error)     {}
+func (clientHandler) ChangePinSuccess()                                                     {}
+func (clientHandler) ChangePinFailure(manager irma.SchemeManagerIdentifier, err error)      {}
+func (clientHandler) ChangePinIncorrect(manager irma.SchemeManagerIdentifier, attempts int) {}
+func (clientHandler) ChangePinBlocked(manager irma.SchemeManagerIdentifier, timeout int)    {}
+func (clientHandler) ReportError(err error) {
+	irma.Logger.Warn("Test client error: ", err)
+}
+
+type sessionResult struct {
+	result string
+	err    error
+}
+
+// sessionHandler gives permission for the session, and reports its outcome over the done channel.
+type sessionHandler struct {
+	client *Client
+	done   chan sessionResult
+}
+
+func (h *sessionHandler) finish(result string, err error) {
+	select {
+	case h.done <- sessionResult{result: result, err: err}:
+	default: // the outcome was already reported
+	}
+}
+
+func (h *sessionHandler) StatusUpdate(action irma.Action, status irma.ClientStatus) {}
+func (h *sessionHandler) ClientReturnURLSet(clientReturnURL string)                 {}
+
+func (h *sessionHandler) PairingRequired(pairingCode string) {
+	if h.client.options.PairingRequired == nil {
+		h.finish("", errors.New("session requires pairing"))
+		return
+	}
+	h.client.options.PairingRequired(pairingCode)
+}
+
+func (h *sessionHandler) Success(result string) {
+	h.finish(result, nil)
+}
+
+func (h *sessionHandler) Cancelled() {
+	h.finish("", errors.New("session cancelled"))
+}
+
+func (h *sessionHandler) Failure(err *irma.SessionError) {
+	h.finish("", err)
+}
+
+func (h *sessionHandler) KeyshareBlocked(manager irma.SchemeManagerIdentifier, duration int) {
+	h.finish("", errors.Errorf("keyshare account at %s blocked for %d seconds", manager, duration))
+}
+
+func (h *sessionHandler) KeyshareEnrollmentIncomplete(manager irma.SchemeManagerIdentifier) {
+	h.finish("", errors.Errorf("keyshare enrollment at %s incomplete", manager))
+}
+
+func (h *sessionHandler) KeyshareEnrollmentMissing(manager irma.SchemeManagerIdentifier) {
+	h.finish("", errors.Errorf("not enrolled at keyshare server of %s", manager))
+}
+
+func (h *sessionHandler) KeyshareEnrollmentDeleted(manager irma.SchemeManagerIdentifier) {
+	h.finish("", errors.Errorf("keyshare enrollment at %s deleted", manager))
+}
+
+func (h *sessionHandler) RequestIssuancePermission(
+	request *irma.IssuanceRequest, satisfiable bool, candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo, callback irmaclient.PermissionHandler,
+) {
+	h.RequestVerificationPermission(&request.DisclosureRequest, satisfiable, candidates, requestorInfo, callback)
+}
+
+func (h *sessionHandler) RequestSignaturePermission(
+	request *irma.SignatureRequest, satisfiable bool, candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo, callback irmaclient.PermissionHandler,
+) {
+	h.RequestVerificationPermission(&request.DisclosureRequest, satisfiable, candidates, requestorInfo, callback)
+}
+
+// RequestVerificationPermission discloses, for each disjunction, the first candidate conjunction
+// that the wallet contains.
+func (h *sessionHandler) RequestVerificationPermission(
+	request *irma.DisclosureRequest, satisfiable bool, candidates [][]irmaclient.DisclosureCandidates,
+	requestorInfo *irma.RequestorInfo, callback irmaclient.PermissionHandler,
+) {
+	if !satisfiable {
+		h.finish("", ErrUnsatisfiable)
+		callback(false, nil)
+		return
+	}
+	choice := &irma.DisclosureChoice{}
+	for _, discon := range candidates {
+		var ids []*irma.AttributeIdentifier
+		var err error
+		for _, con := range discon {
+			if ids, err = con.Choose(); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			h.finish("", err)
+			callback(false, nil)
+			return
+		}
+		choice.Attributes = append(choice.Attributes, ids)
+	}
+	go callback(true, choice)
+}
+
+func (h *sessionHandler) RequestSchemeManagerPermission(manager *irma.SchemeManager, callback func(proceed bool)) {
+	go callback(true)
+}
+
+func (h *sessionHandler) RequestPin(remainingAttempts int, callback irmaclient.PinHandler) {
+	go callback(true, h.client.options.Pin)
+}
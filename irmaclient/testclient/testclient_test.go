@@ -0,0 +1,102 @@
+package testclient
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func startServer(t *testing.T) *irmaserver.Server {
+	logger := logrus.New()
+	logger.Level = logrus.FatalLevel
+	conf := &server.Configuration{
+		Logger:                logger,
+		SchemesPath:           filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		IssuerPrivateKeysPath: filepath.Join(test.FindTestdataFolder(t), "privatekeys"),
+	}
+	s, err := irmaserver.New(conf)
+	require.NoError(t, err)
+	httpServer := httptest.NewServer(s.HandlerFunc())
+	conf.URL = httpServer.URL + "/"
+	t.Cleanup(func() {
+		httpServer.Close()
+		s.Stop()
+	})
+	return s
+}
+
+func newClient(t *testing.T) *Client {
+	storage := test.SetupTestStorage(t)
+	client, err := New(filepath.Join(storage, "client"), filepath.Join(test.FindTestdataFolder(t), "irma_configuration"), Options{})
+	require.NoError(t, err)
+	t.Cleanup(func() { test.ClearTestStorage(t, client, storage) })
+	return client
+}
+
+func doSession(t *testing.T, s *irmaserver.Server, client *Client, request irma.SessionRequest) (*server.SessionResult, error) {
+	qr, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+	bts, err := json.Marshal(qr)
+	require.NoError(t, err)
+
+	_, sessionErr := client.DoSession(string(bts))
+	result, err := s.GetSessionResult(token)
+	require.NoError(t, err)
+	return result, sessionErr
+}
+
+func TestDisclosure(t *testing.T) {
+	s := startServer(t)
+	client := newClient(t)
+
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	result, err := doSession(t, s, client, irma.NewDisclosureRequest(id))
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Equal(t, "456", *result.Disclosed[0][0].RawValue)
+}
+
+func TestIssuance(t *testing.T) {
+	s := startServer(t)
+	client := newClient(t)
+
+	credtype := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+	request := irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID: credtype,
+		Attributes: map[string]string{
+			"firstnames": "Johan Pieter",
+			"firstname":  "Johan",
+			"familyname": "Stuivezand",
+			"prefix":     "van",
+		},
+	}})
+	result, err := doSession(t, s, client, request)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusDone, result.Status)
+
+	// The issued credential can be disclosed in a next session
+	id := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+	result, err = doSession(t, s, client, irma.NewDisclosureRequest(id))
+	require.NoError(t, err)
+	require.Equal(t, "Johan", *result.Disclosed[0][0].RawValue)
+}
+
+func TestUnsatisfiable(t *testing.T) {
+	s := startServer(t)
+	client := newClient(t)
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"))
+	request.Disclose[0][0][0].Value = new(string)
+	*request.Disclose[0][0][0].Value = "nonexisting"
+	_, err := doSession(t, s, client, request)
+	require.ErrorIs(t, err, ErrUnsatisfiable)
+}
@@ -1,6 +1,7 @@
 package irma
 
 import (
+	"crypto/ecdsa"
 	"crypto/rsa"
 	"crypto/sha256"
 	"crypto/x509"
@@ -14,6 +15,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-co-op/gocron"
@@ -34,7 +36,7 @@ type Configuration struct {
 	Issuers         map[IssuerIdentifier]*Issuer
 	CredentialTypes map[CredentialTypeIdentifier]*CredentialType
 	AttributeTypes  map[AttributeTypeIdentifier]*AttributeType
-	kssPublicKeys   map[SchemeManagerIdentifier]map[int]*rsa.PublicKey
+	kssPublicKeys   concmap.ConcMap[kssKeyIdentifier, *rsa.PublicKey]
 	publicKeys      concmap.ConcMap[PublicKeyIdentifier, *gabikeys.PublicKey]
 	reverseHashes   map[string]CredentialTypeIdentifier
 
@@ -61,6 +63,29 @@ type Configuration struct {
 	Scheduler   *gocron.Scheduler
 	Warnings    []string `json:"-"`
 
+	// Creates the transports of the outbound requests made for this configuration, such as scheme
+	// downloads and revocation traffic; if nil, the default HTTPClientSettings are used
+	HTTPClient *HTTPClient `json:"-"`
+
+	// Keyshare server JWKS fetching (see KeyshareJWKS in ConfigurationOptions)
+	kssJWKSMutex   *sync.Mutex
+	kssJWKSFetched map[SchemeManagerIdentifier]time.Time
+
+	// Results of keyproof verification, shared with snapshots (see keyproofs.go)
+	keyproofs *keyproofCache
+
+	// Copy-on-write snapshots of this configuration; nil for snapshots themselves
+	snapshots  *configurationSnapshots
+	snapshotID string
+	replaced   time.Time
+
+	// Public keys that schemes must have to be installed or updated, by scheme ID (see schemepins.go)
+	pinnedSchemeKeys map[string][]*ecdsa.PublicKey
+
+	// Issuer schemes in the configuration folder whose parsing is deferred (see EagerSchemes
+	// in ConfigurationOptions), by ID
+	lazySchemes map[SchemeManagerIdentifier]*SchemeManager
+
 	options     ConfigurationOptions
 	initialized bool
 	assets      string
@@ -87,6 +112,37 @@ type ConfigurationOptions struct {
 	RevocationDBConnStr string
 	RevocationDBType    string
 	RevocationSettings  RevocationSettings
+	// If set, keyshare server JWTs signed with a key not present in the scheme are verified
+	// against the JWKS published by the keyshare server of the scheme (see KeyshareJWKSPath)
+	KeyshareJWKS bool
+	// How long snapshots of the configuration remain available through SnapshotOf() after the
+	// schemes have been changed, e.g. for the duration of sessions started before the change
+	SnapshotRetention time.Duration
+	// Returns the current time, used to expire retained snapshots and to date scheme log entries
+	// and signature archives (default time.Now)
+	Now func() time.Time
+	// If not nil, ParseFolder() parses only these issuer schemes (and all requestor schemes). The
+	// other issuer schemes in the configuration folder are parsed when Download() first needs
+	// them, or when ParseLazySchemes() is invoked. This reduces startup time if the configuration
+	// folder contains large schemes that are rarely or never used.
+	EagerSchemes []SchemeManagerIdentifier
+	// If set, the parsed issuer schemes are cached in this directory, so that parsing unchanged
+	// schemes again (e.g. after a restart) is much faster (see schemecache.go)
+	CachePath string
+	// If set, the accepted scheme index signatures are recorded in this append-only transparency
+	// log, and scheme updates that roll back or fork a logged scheme are refused (see schemelog.go).
+	// The head of the log is stored next to it, in a file with the same name suffixed with .head
+	SchemeLogPath string
+	// If set, the entries of the scheme transparency log are also submitted to this URL
+	SchemeLogSubmitURL string
+}
+
+// kssKeyIdentifier identifies a keyshare server public key, from the scheme or from the JWKS
+// published by the keyshare server.
+type kssKeyIdentifier struct {
+	scheme SchemeManagerIdentifier
+	kid    int
+	jwks   bool
 }
 
 // NewConfiguration returns a new configuration. After this
@@ -97,6 +153,11 @@ func NewConfiguration(path string, opts ConfigurationOptions) (conf *Configurati
 		assets:   opts.Assets,
 		readOnly: opts.ReadOnly,
 		options:  opts,
+
+		kssJWKSMutex:   &sync.Mutex{},
+		kssJWKSFetched: map[SchemeManagerIdentifier]time.Time{},
+
+		snapshots: &configurationSnapshots{retained: map[string]*Configuration{}},
 	}
 
 	if conf.assets != "" { // If an assets folder is specified, then it must exist
@@ -141,6 +202,7 @@ func (conf *Configuration) ParseFolder() (err error) {
 	// what schemes exist so we can parse issuer schemes first.
 	var mgrerr *SchemeManagerError
 	var issuerschemes, requestorschemes []Scheme
+	conf.lazySchemes = map[SchemeManagerIdentifier]*SchemeManager{}
 	err = common.IterateSubfolders(conf.Path, func(dir string, _ os.FileInfo) error {
 		dirname := filepath.Base(dir)
 		if common.IsTempSchemeDir(dirname) {
@@ -163,6 +225,10 @@ func (conf *Configuration) ParseFolder() (err error) {
 		}
 		switch scheme.typ() {
 		case SchemeTypeIssuer:
+			if !conf.isEagerScheme(scheme.(*SchemeManager).Identifier()) {
+				conf.lazySchemes[scheme.(*SchemeManager).Identifier()] = scheme.(*SchemeManager)
+				return nil
+			}
 			issuerschemes = append(issuerschemes, scheme)
 		case SchemeTypeRequestor:
 			requestorschemes = append(requestorschemes, scheme)
@@ -175,9 +241,14 @@ func (conf *Configuration) ParseFolder() (err error) {
 		return
 	}
 
-	// Parse the schemes we found, issuer schemes first
-	for _, scheme := range append(issuerschemes, requestorschemes...) {
+	// Parse the schemes we found, issuer schemes first. Issuer schemes do not depend on each other,
+	// so we parse them in parallel, each into its own configuration, and merge those afterwards.
+	errs := conf.parseSchemesParallel(issuerschemes)
+	for _, scheme := range requestorschemes {
 		_, err := conf.ParseSchemeFolder(scheme.path())
+		errs = append(errs, err)
+	}
+	for _, err := range errs {
 		if err == nil {
 			continue // OK, do next scheme folder
 		}
@@ -213,6 +284,7 @@ func (conf *Configuration) ParseFolder() (err error) {
 	}
 
 	conf.initialized = true
+	conf.publishSnapshot()
 	conf.CallListeners()
 	if mgrerr != nil {
 		return mgrerr
@@ -220,6 +292,71 @@ func (conf *Configuration) ParseFolder() (err error) {
 	return
 }
 
+// ParseLazySchemes parses the issuer schemes whose parsing was deferred by ParseFolder()
+// (see EagerSchemes in ConfigurationOptions) and that have not been parsed since.
+func (conf *Configuration) ParseLazySchemes() error {
+	defer conf.lockSchemes()()
+	return conf.parseLazySchemes(conf.lazySchemeIDs())
+}
+
+// LazySchemes returns the issuer schemes whose parsing was deferred by ParseFolder() (see
+// EagerSchemes in ConfigurationOptions) and that have not been parsed since.
+func (conf *Configuration) LazySchemes() []SchemeManagerIdentifier {
+	defer conf.lockSchemes()()
+	return conf.lazySchemeIDs()
+}
+
+func (conf *Configuration) lazySchemeIDs() []SchemeManagerIdentifier {
+	ids := make([]SchemeManagerIdentifier, 0, len(conf.lazySchemes))
+	for id := range conf.lazySchemes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].Name() < ids[j].Name() })
+	return ids
+}
+
+func (conf *Configuration) isEagerScheme(id SchemeManagerIdentifier) bool {
+	if conf.options.EagerSchemes == nil {
+		return true
+	}
+	for _, eager := range conf.options.EagerSchemes {
+		if eager == id {
+			return true
+		}
+	}
+	return false
+}
+
+// parseLazySchemes parses those of the specified schemes whose parsing was deferred.
+func (conf *Configuration) parseLazySchemes(ids []SchemeManagerIdentifier) error {
+	var schemes []Scheme
+	for _, id := range ids {
+		if scheme, ok := conf.lazySchemes[id]; ok {
+			schemes = append(schemes, scheme)
+			delete(conf.lazySchemes, id)
+		}
+	}
+	if len(schemes) == 0 {
+		return nil
+	}
+
+	Logger.WithField("schemes", ids).Info("Parsing lazily loaded schemes")
+	var mgrerr *SchemeManagerError
+	for _, err := range conf.parseSchemesParallel(schemes) {
+		if e, ok := err.(*SchemeManagerError); ok {
+			mgrerr = e
+		} else if err != nil {
+			return err
+		}
+	}
+	conf.publishSnapshot()
+	conf.CallListeners()
+	if mgrerr != nil {
+		return mgrerr
+	}
+	return nil
+}
+
 // ParseOrRestoreFolder parses the irma_configuration folder, and when possible attempts to restore
 // any broken schemes from their remote.
 // Any error encountered during parsing is considered recoverable only if it is of type *SchemeManagerError;
@@ -261,11 +398,25 @@ func (conf *Configuration) Download(session SessionRequest) (downloaded *IrmaIde
 	if conf.readOnly {
 		return nil, errors.New("Cannot download into a read-only configuration")
 	}
+	defer conf.lockSchemes()()
 
 	missing, requiredMissing, err := conf.checkIdentifiers(session)
 	if err != nil {
 		return nil, err
 	}
+	if len(missing.SchemeManagers) > 0 && len(conf.lazySchemes) > 0 {
+		// Parse the missing schemes if their parsing was deferred, and check again
+		ids := make([]SchemeManagerIdentifier, 0, len(missing.SchemeManagers))
+		for id := range missing.SchemeManagers {
+			ids = append(ids, id)
+		}
+		if err = conf.parseLazySchemes(ids); err != nil {
+			return nil, err
+		}
+		if missing, requiredMissing, err = conf.checkIdentifiers(session); err != nil {
+			return nil, err
+		}
+	}
 	if len(missing.SchemeManagers) > 0 {
 		return nil, &UnknownIdentifierError{ErrorUnknownSchemeManager, missing}
 	}
@@ -282,7 +433,7 @@ func (conf *Configuration) Download(session SessionRequest) (downloaded *IrmaIde
 
 	// Try updating them
 	for id := range allMissing.allSchemes() {
-		if err = conf.UpdateScheme(conf.SchemeManagers[id], downloaded); err != nil {
+		if err = conf.updateScheme(conf.SchemeManagers[id], downloaded); err != nil {
 			return
 		}
 	}
@@ -407,33 +558,44 @@ func (conf *Configuration) KeyshareServerKeyFunc(scheme SchemeManagerIdentifier)
 				return nil, err
 			}
 		}
-		return conf.KeyshareServerPublicKey(scheme, kid)
+		pk, err := conf.KeyshareServerPublicKey(scheme, kid)
+		if err != nil && conf.options.KeyshareJWKS {
+			return conf.keyshareJWKSPublicKey(scheme, kid)
+		}
+		return pk, err
 	}
 }
 
 // KeyshareServerPublicKey returns the i'th public key of the specified scheme.
+// The public keys are cached after they have been read from the scheme.
 func (conf *Configuration) KeyshareServerPublicKey(schemeid SchemeManagerIdentifier, i int) (*rsa.PublicKey, error) {
-	if _, contains := conf.kssPublicKeys[schemeid]; !contains {
-		conf.kssPublicKeys[schemeid] = make(map[int]*rsa.PublicKey)
+	id := kssKeyIdentifier{scheme: schemeid, kid: i}
+	if pk := conf.kssPublicKeys.Get(id); pk != nil {
+		return pk, nil
 	}
-	if _, contains := conf.kssPublicKeys[schemeid][i]; !contains {
-		scheme := conf.SchemeManagers[schemeid]
-		pkbts, err := os.ReadFile(filepath.Join(scheme.path(), fmt.Sprintf("kss-%d.pem", i)))
-		if err != nil {
-			return nil, err
-		}
-		pkblk, _ := pem.Decode(pkbts)
-		genericPk, err := x509.ParsePKIXPublicKey(pkblk.Bytes)
-		if err != nil {
-			return nil, err
-		}
-		pk, ok := genericPk.(*rsa.PublicKey)
-		if !ok {
-			return nil, errors.New("Invalid keyshare server public key")
-		}
-		conf.kssPublicKeys[schemeid][i] = pk
+
+	scheme := conf.SchemeManagers[schemeid]
+	if scheme == nil {
+		return nil, errors.Errorf("unknown scheme %s", schemeid)
 	}
-	return conf.kssPublicKeys[schemeid][i], nil
+	pkbts, err := os.ReadFile(filepath.Join(scheme.path(), fmt.Sprintf("kss-%d.pem", i)))
+	if err != nil {
+		return nil, err
+	}
+	pkblk, _ := pem.Decode(pkbts)
+	if pkblk == nil {
+		return nil, errors.New("Invalid keyshare server public key")
+	}
+	genericPk, err := x509.ParsePKIXPublicKey(pkblk.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	pk, ok := genericPk.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("Invalid keyshare server public key")
+	}
+	conf.kssPublicKeys.Set(id, pk)
+	return pk, nil
 }
 
 // IsInitialized indicates whether this instance has successfully been initialized.
@@ -459,7 +621,16 @@ func (conf *Configuration) addReverseHash(credid CredentialTypeIdentifier) {
 }
 
 func (conf *Configuration) hashToCredentialType(hash []byte) *CredentialType {
-	if str, exists := conf.reverseHashes[base64.StdEncoding.EncodeToString(hash)]; exists {
+	// Encode into a buffer on the stack; the map lookup below does not copy it into a string
+	var buf [32]byte
+	var encoded []byte
+	if n := base64.StdEncoding.EncodedLen(len(hash)); n <= len(buf) {
+		encoded = buf[:n]
+		base64.StdEncoding.Encode(encoded, hash)
+	} else {
+		encoded = []byte(base64.StdEncoding.EncodeToString(hash))
+	}
+	if str, exists := conf.reverseHashes[string(encoded)]; exists {
 		return conf.CredentialTypes[str]
 	}
 	return nil
@@ -534,12 +705,15 @@ func (conf *Configuration) clear() {
 	conf.Requestors = make(map[string]*RequestorInfo)
 	conf.IssueWizards = make(map[IssueWizardIdentifier]*IssueWizard)
 	conf.DisabledRequestorSchemes = make(map[RequestorSchemeIdentifier]*SchemeManagerError)
-	conf.kssPublicKeys = make(map[SchemeManagerIdentifier]map[int]*rsa.PublicKey)
+	conf.kssPublicKeys = concmap.New[kssKeyIdentifier, *rsa.PublicKey]()
 	conf.publicKeys = concmap.New[PublicKeyIdentifier, *gabikeys.PublicKey]()
 	conf.reverseHashes = make(map[string]CredentialTypeIdentifier)
 	if conf.PrivateKeys == nil { // keep if already populated
 		conf.PrivateKeys = &privateKeyRingMerge{}
 	}
+	if conf.keyproofs == nil { // likewise
+		conf.keyproofs = &keyproofCache{verified: map[string]error{}, verifying: map[string]bool{}}
+	}
 }
 
 // Validation methods containing consistency checks on irma_configuration
@@ -591,7 +765,7 @@ func (conf *Configuration) checkCredentialTypes(session SessionRequest, missing
 			missing.CredentialTypes[credid] = struct{}{}
 			return nil
 		}
-		if !attr.Type.IsCredential() && !typ.ContainsAttribute(attr.Type) {
+		if !attr.Type.IsCredential() && !attr.Type.IsMetadataAttribute() && !typ.ContainsAttribute(attr.Type) {
 			missing.AttributeTypes[attr.Type] = struct{}{}
 		}
 		return nil
@@ -686,6 +860,12 @@ func (conf *Configuration) validateCredentialType(manager *SchemeManager, issuer
 	if err := validateDemoPrefix(cred.Name, cred.Languages); manager.Demo && err != nil {
 		return errors.Errorf("Name of demo credential %s invalid: %s", credid.String(), err.Error())
 	}
+	if !cred.SunsetDate.IsZero() && cred.SunsetDate.Before(cred.DeprecatedSince) {
+		return errors.Errorf("Credential type %s has a SunsetDate before its DeprecatedSince", credid.String())
+	}
+	if cred.ReplacedBy != nil && *cred.ReplacedBy == credid {
+		return errors.Errorf("Credential type %s is replaced by itself", credid.String())
+	}
 
 	for _, url := range cred.RevocationServers {
 		if !manager.Demo && !strings.HasPrefix(url, "https://") {
@@ -728,6 +908,12 @@ func (conf *Configuration) validateAttributes(cred *CredentialType) error {
 		if attr.RevocationAttribute && attr.RandomBlind {
 			return errors.New("attribute cannot be both revocation attribute and randomblind attribute")
 		}
+		if !attr.DataType.Known() {
+			return errors.Errorf("attribute %s of credential type %s has unknown type %s", attr.ID, name, attr.DataType)
+		}
+		if attr.DataType != AttributeDataTypeString && (attr.RevocationAttribute || attr.RandomBlind) {
+			return errors.Errorf("attribute %s of credential type %s cannot have a type", attr.ID, name)
+		}
 	}
 	if len(indices) != count {
 		conf.Warnings = append(conf.Warnings, fmt.Sprintf("Credential type %s has invalid attribute ordering, check the displayIndex tags", name))
@@ -782,7 +968,70 @@ func (conf *Configuration) validateTranslations(file string, o interface{}, lang
 	}
 }
 
+// parseSchemesParallel parses the specified issuer schemes in parallel, merging them into conf,
+// and returns the errors that occurred per scheme.
+func (conf *Configuration) parseSchemesParallel(schemes []Scheme) []error {
+	forks := make([]*Configuration, len(schemes))
+	errs := parallel(len(schemes), func(i int) error {
+		forks[i] = conf.fork()
+		_, err := forks[i].ParseSchemeFolder(schemes[i].path())
+		return err
+	})
+	for _, fork := range forks {
+		conf.merge(fork)
+		conf.Warnings = append(conf.Warnings, fork.Warnings...)
+	}
+	return errs
+}
+
+// fork returns an empty configuration having the same path and options as conf, into which
+// schemes or issuers can be parsed independently of (and concurrently with) conf, after which
+// it can be merged into conf.
+func (conf *Configuration) fork() *Configuration {
+	fork := &Configuration{
+		Path:        conf.Path,
+		PrivateKeys: conf.PrivateKeys,
+		HTTPClient:  conf.HTTPClient,
+		options:     conf.options,
+		assets:      conf.assets,
+		readOnly:    conf.readOnly,
+		keyproofs:   conf.keyproofs,
+	}
+	fork.clear()
+	return fork
+}
+
+// parallel invokes f(i) for 0 <= i < n on at most GOMAXPROCS goroutines at once, and returns
+// the errors it returned in order.
+func parallel(n int, f func(i int) error) []error {
+	errs := make([]error, n)
+	indices := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < runtime.GOMAXPROCS(0) && w < n; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range indices {
+				errs[i] = f(i)
+			}
+		}()
+	}
+	for i := 0; i < n; i++ {
+		indices <- i
+	}
+	close(indices)
+	wg.Wait()
+	return errs
+}
+
 func (conf *Configuration) join(other *Configuration) {
+	conf.merge(other)
+	conf.publishSnapshot()
+	conf.CallListeners()
+}
+
+// merge copies the schemes and their contents from the other configuration into conf.
+func (conf *Configuration) merge(other *Configuration) {
 	for key, val := range other.SchemeManagers {
 		conf.SchemeManagers[key] = val
 	}
@@ -801,9 +1050,9 @@ func (conf *Configuration) join(other *Configuration) {
 	for key, val := range other.AttributeTypes {
 		conf.AttributeTypes[key] = val
 	}
-	for key, val := range other.kssPublicKeys {
-		conf.kssPublicKeys[key] = val
-	}
+	other.kssPublicKeys.Iterate(func(key kssKeyIdentifier, val *rsa.PublicKey) {
+		conf.kssPublicKeys.Set(key, val)
+	})
 	for key, val := range other.RequestorSchemes {
 		conf.RequestorSchemes[key] = val
 	}
@@ -819,8 +1068,6 @@ func (conf *Configuration) join(other *Configuration) {
 	other.publicKeys.Iterate(func(key PublicKeyIdentifier, val *gabikeys.PublicKey) {
 		conf.publicKeys.Set(key, val)
 	})
-
-	conf.CallListeners()
 }
 
 func (e *UnknownIdentifierError) Error() string {
@@ -1,19 +1,36 @@
 package irma
 
 import (
+	"bytes"
+	"compress/gzip"
 	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
 	"encoding/json"
+	"encoding/pem"
 	"encoding/xml"
+	"errors"
 	"fmt"
+	"io"
+	"net"
 	"net/http"
+	"net/http/httptest"
 	"os"
 	"path"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/bwesterb/go-atum"
+	"github.com/fxamacker/cbor"
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/privacybydesign/gabi"
 	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/gabikeys"
@@ -30,7 +47,7 @@ func init() {
 	Logger.SetLevel(logrus.FatalLevel)
 }
 
-func parseConfiguration(t *testing.T) *Configuration {
+func parseConfiguration(t testing.TB) *Configuration {
 	conf, err := NewConfiguration("testdata/irma_configuration", ConfigurationOptions{})
 	require.NoError(t, err)
 	require.NoError(t, conf.ParseFolder())
@@ -110,6 +127,172 @@ func TestUpdateConfiguration(t *testing.T) {
 	require.Equal(t, *conf.Requestors["localhost"].LogoPath, logoPath)
 }
 
+func TestParseFolderLazySchemes(t *testing.T) {
+	full := parseConfiguration(t)
+	demo := NewSchemeManagerIdentifier("irma-demo")
+	testid := NewSchemeManagerIdentifier("test")
+
+	conf, err := NewConfiguration("testdata/irma_configuration", ConfigurationOptions{
+		EagerSchemes: []SchemeManagerIdentifier{demo},
+	})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	require.Contains(t, conf.SchemeManagers, demo)
+	require.NotContains(t, conf.SchemeManagers, testid)
+	require.Contains(t, conf.RequestorSchemes, NewRequestorSchemeIdentifier("test-requestors"))
+	require.Equal(t, []SchemeManagerIdentifier{testid, NewSchemeManagerIdentifier("test2")}, conf.LazySchemes())
+
+	// Downloading for a session request parses the schemes it needs
+	snapshotID := conf.SnapshotID()
+	_, err = conf.Download(NewDisclosureRequest(NewAttributeTypeIdentifier("test.test.email.email")))
+	require.NoError(t, err)
+	require.Contains(t, conf.SchemeManagers, testid)
+	require.Contains(t, conf.Snapshot().SchemeManagers, testid)
+	require.NotEqual(t, snapshotID, conf.SnapshotID())
+	require.Equal(t, []SchemeManagerIdentifier{NewSchemeManagerIdentifier("test2")}, conf.LazySchemes())
+
+	// Once all schemes are parsed, we have the same as when parsing everything at once
+	require.NoError(t, conf.ParseLazySchemes())
+	require.Empty(t, conf.LazySchemes())
+	require.Equal(t, full.SnapshotID(), conf.SnapshotID())
+	require.Len(t, conf.CredentialTypes, len(full.CredentialTypes))
+	for id := range full.CredentialTypes {
+		require.Contains(t, conf.CredentialTypes, id)
+	}
+	require.Len(t, conf.AttributeTypes, len(full.AttributeTypes))
+	require.Equal(t, full.reverseHashes, conf.reverseHashes)
+	require.ElementsMatch(t, full.Warnings, conf.Warnings)
+}
+
+func TestSchemeCache(t *testing.T) {
+	storage := test.CreateTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+	confpath := filepath.Join(storage, "irma_configuration")
+	cachepath := filepath.Join(storage, "cache")
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration"), confpath))
+	parse := func() *Configuration {
+		conf, err := NewConfiguration(confpath, ConfigurationOptions{CachePath: cachepath})
+		require.NoError(t, err)
+		require.NoError(t, conf.ParseFolder())
+		return conf
+	}
+	requireEqualContents := func(expected, actual *Configuration) {
+		require.Equal(t, expected.Warnings, actual.Warnings)
+		require.Equal(t, expected.reverseHashes, actual.reverseHashes)
+		require.Len(t, actual.AttributeTypes, len(expected.AttributeTypes))
+		require.Len(t, actual.Issuers, len(expected.Issuers))
+		for id, issuer := range expected.Issuers {
+			require.Equal(t, toJSONValue(issuer), toJSONValue(actual.Issuers[id]))
+		}
+		require.Len(t, actual.CredentialTypes, len(expected.CredentialTypes))
+		for id, cred := range expected.CredentialTypes {
+			require.Equal(t, toJSONValue(cred), toJSONValue(actual.CredentialTypes[id]))
+			require.Equal(t, cred.AttributeTypes, actual.CredentialTypes[id].AttributeTypes)
+		}
+	}
+
+	// Parsing writes the cache, after which the schemes are taken from the cache
+	parsed := parse()
+	requireEqualContents(parseConfiguration(t), parsed)
+	require.FileExists(t, filepath.Join(cachepath, "irma-demo.json"))
+	requireEqualContents(parsed, parse())
+
+	// Check that the cache is used by modifying it
+	issuerid := NewIssuerIdentifier("irma-demo.RU")
+	cachefile := filepath.Join(cachepath, "irma-demo.json")
+	bts, err := os.ReadFile(cachefile)
+	require.NoError(t, err)
+	var cache schemeCache
+	require.NoError(t, json.Unmarshal(bts, &cache))
+	for _, issuer := range cache.Issuers {
+		if issuer.Identifier() == issuerid {
+			issuer.Name = TranslatedString{"en": "cached"}
+		}
+	}
+	bts, err = json.Marshal(cache)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(cachefile, bts, 0600))
+	require.Equal(t, "cached", parse().Issuers[issuerid].Name["en"])
+
+	// Changing a file of the scheme invalidates the cache
+	description := filepath.Join(confpath, "irma-demo", "RU", "description.xml")
+	later := time.Now().Add(time.Minute)
+	require.NoError(t, os.Chtimes(description, later, later))
+	require.Equal(t, parsed.Issuers[issuerid].Name, parse().Issuers[issuerid].Name)
+	requireEqualContents(parsed, parse())
+
+	// A scheme whose index signature does not verify is not taken from the cache
+	sigfile := filepath.Join(confpath, "irma-demo", "index.sig")
+	sig, err := os.ReadFile(sigfile)
+	require.NoError(t, err)
+	sig[len(sig)-1] ^= 1
+	require.NoError(t, os.WriteFile(sigfile, sig, 0600))
+	require.Empty(t, parsed.schemeCacheKey(parsed.SchemeManagers[issuerid.SchemeManagerIdentifier()]))
+	conf := parse()
+	require.NotContains(t, conf.SchemeManagers, issuerid.SchemeManagerIdentifier())
+	require.NotContains(t, conf.Issuers, issuerid)
+}
+
+func TestConfigurationSnapshot(t *testing.T) {
+	storage := test.SetupTestStorage(t)
+	defer test.ClearTestStorage(t, nil, storage)
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	conf, err := NewConfiguration(filepath.Join(storage, "client"), ConfigurationOptions{
+		Assets:            filepath.Join("testdata", "irma_configuration"),
+		SnapshotRetention: time.Hour,
+	})
+	require.NoError(t, err)
+	require.Same(t, conf, conf.Snapshot())
+	require.NoError(t, conf.ParseFolder())
+
+	credid := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	attrid := NewAttributeTypeIdentifier("irma-demo.RU.studentCard.newAttribute")
+	before := conf.Snapshot()
+	beforeID := conf.SnapshotID()
+	require.NotSame(t, conf, before)
+	require.Same(t, before, before.Snapshot())
+	require.False(t, before.CredentialTypes[credid].ContainsAttribute(attrid))
+
+	// Snapshots cannot be changed themselves
+	scheme := conf.SchemeManagers[NewSchemeManagerIdentifier("irma-demo")]
+	require.Error(t, before.UpdateScheme(before.SchemeManagers[scheme.Identifier()], nil))
+
+	// Read the current snapshot while the scheme is being updated
+	stop := make(chan struct{})
+	errs := make(chan error, 1)
+	go func() {
+		defer close(errs)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				if conf.Snapshot().CredentialTypes[credid] == nil {
+					errs <- fmt.Errorf("credential type %s missing from snapshot", credid)
+					return
+				}
+			}
+		}
+	}()
+	scheme.URL = "http://localhost:48681/irma_configuration_updated/irma-demo"
+	require.NoError(t, conf.UpdateScheme(scheme, nil))
+	close(stop)
+	require.NoError(t, <-errs)
+
+	// The update is visible in new snapshots only
+	require.True(t, conf.CredentialTypes[credid].ContainsAttribute(attrid))
+	require.True(t, conf.Snapshot().CredentialTypes[credid].ContainsAttribute(attrid))
+	require.False(t, before.CredentialTypes[credid].ContainsAttribute(attrid))
+	require.NotEqual(t, beforeID, conf.SnapshotID())
+
+	// Previous snapshots remain available by their ID during the retention period
+	require.Same(t, before, conf.SnapshotOf(beforeID))
+	require.Same(t, conf.Snapshot(), conf.SnapshotOf(conf.SnapshotID()))
+	require.Same(t, conf.Snapshot(), conf.SnapshotOf("unknown"))
+}
+
 func TestParseInvalidIrmaConfiguration(t *testing.T) {
 	// The description.xml of the scheme manager under this folder has been edited
 	// to invalidate the scheme manager signature
@@ -156,6 +339,16 @@ func TestParseIrmaConfigurationLeftoverTempDir(t *testing.T) {
 	require.NoError(t, common.AssertPathExists(filepath.Join(confpath, ".foobar")))
 }
 
+func TestKeysharePinPolicy(t *testing.T) {
+	policy := KeysharePinPolicy{MinLength: 5, MaxLength: 8, MinDistinctCharacters: 3}
+	require.NoError(t, policy.Check("12345"))
+	require.NoError(t, policy.Check("€€€€12"))
+	require.ErrorIs(t, policy.Check("1234"), ErrPinTooShort)
+	require.ErrorIs(t, policy.Check("123456789"), ErrPinTooLong)
+	require.ErrorIs(t, policy.Check("11112"), ErrPinTooSimple)
+	require.NoError(t, KeysharePinPolicyDefault.Check("11111"))
+}
+
 func TestRetryHTTPRequest(t *testing.T) {
 	test.StartBadHttpServer(2, 1*time.Second, "42")
 	defer test.StopBadHttpServer()
@@ -188,6 +381,156 @@ func TestHTTPTransportCookieJar(t *testing.T) {
 	require.NoError(t, transport.Get("/checkcookie", nil))
 }
 
+func newHTTPClient(t *testing.T, settings HTTPClientSettings) *HTTPClient {
+	client, err := NewHTTPClient(settings)
+	require.NoError(t, err)
+	return client
+}
+
+func TestHTTPClientSettings(t *testing.T) {
+	for _, settings := range []HTTPClientSettings{
+		{Timeout: -1},
+		{Retries: -2},
+		{RetryWaitMin: 500, RetryWaitMax: 400},
+		{Backoff: "fibonacci"},
+		{Proxy: "proxy.example.com"},
+		{Proxy: "ftp://proxy.example.com"},
+		{CACertificates: "foo", CACertificatesFile: "ca.pem"},
+		{CACertificates: "not a certificate"},
+	} {
+		_, err := NewHTTPClient(settings)
+		require.Error(t, err, "%+v", settings)
+	}
+	client := newHTTPClient(t, HTTPClientSettings{RetryWaitMin: 500})
+	require.Equal(t, 500*time.Millisecond, client.NewTransport("", false).client.RetryWaitMax)
+	require.Equal(t, 200*time.Millisecond, NewHTTPTransport("", false).client.RetryWaitMax)
+
+	// Without retries, a request to a server that does not respond in time fails
+	test.StartBadHttpServer(2, 1*time.Second, "42")
+	client = newHTTPClient(t, HTTPClientSettings{Timeout: 500, Retries: -1})
+	_, err := client.NewTransport("http://localhost:48682", false).GetBytes("")
+	require.Error(t, err)
+	test.StopBadHttpServer()
+
+	// Requests are sent through the proxy, authenticating with the credentials in its URL
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "irma.invalid", r.URL.Host)
+		require.Equal(t, "Basic "+base64.StdEncoding.EncodeToString([]byte("user:pass")), r.Header.Get("Proxy-Authorization"))
+		_, _ = w.Write([]byte("proxied"))
+	}))
+	defer proxy.Close()
+	client = newHTTPClient(t, HTTPClientSettings{Proxy: strings.Replace(proxy.URL, "http://", "http://user:pass@", 1)})
+	bts, err := client.NewTransport("http://irma.invalid/", false).GetBytes("")
+	require.NoError(t, err)
+	require.Equal(t, "proxied", string(bts))
+
+	// Servers with certificates of the additional CAs are trusted
+	tlsServer := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("42"))
+	}))
+	defer tlsServer.Close()
+	_, err = newHTTPClient(t, HTTPClientSettings{Retries: -1}).NewTransport(tlsServer.URL, false).GetBytes("")
+	require.Error(t, err)
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: tlsServer.Certificate().Raw})
+	bts, err = newHTTPClient(t, HTTPClientSettings{CACertificates: string(ca)}).NewTransport(tlsServer.URL, false).GetBytes("")
+	require.NoError(t, err)
+	require.Equal(t, "42", string(bts))
+
+	// The additional CAs apply only to the client that they are configured for, e.g. not to the
+	// transports of a configuration without that client
+	conf := &Configuration{}
+	_, err = conf.HTTPClient.NewTransport(tlsServer.URL, false).GetBytes("")
+	require.Error(t, err)
+	conf.HTTPClient = newHTTPClient(t, HTTPClientSettings{CACertificatesFile: writeTempFile(t, ca)})
+	bts, err = conf.HTTPClient.NewTransport(tlsServer.URL, false).GetBytes("")
+	require.NoError(t, err)
+	require.Equal(t, "42", string(bts))
+}
+
+func writeTempFile(t *testing.T, contents []byte) string {
+	path := filepath.Join(t.TempDir(), "file")
+	require.NoError(t, os.WriteFile(path, contents, 0600))
+	return path
+}
+
+// dnsResponse returns a DNS response to the query, answering A questions with 127.0.0.1.
+func dnsResponse(t *testing.T, query []byte) []byte {
+	require.Greater(t, len(query), 12)
+	end := 12
+	for query[end] != 0 {
+		end += int(query[end]) + 1
+	}
+	end += 5 // terminating zero label, type and class
+	question := query[12:end]
+	isA := binary.BigEndian.Uint16(query[end-4:]) == 1
+
+	res := binary.BigEndian.AppendUint16(nil, binary.BigEndian.Uint16(query)) // ID
+	res = binary.BigEndian.AppendUint16(res, 0x8180)                          // response, recursion desired and available
+	res = binary.BigEndian.AppendUint16(res, 1)
+	if isA {
+		res = binary.BigEndian.AppendUint16(res, 1)
+	} else {
+		res = binary.BigEndian.AppendUint16(res, 0)
+	}
+	res = append(res, 0, 0, 0, 0)
+	res = append(res, question...)
+	if isA {
+		res = append(res, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4, 127, 0, 0, 1)
+	}
+	return res
+}
+
+func TestHTTPClientResolver(t *testing.T) {
+	for _, resolver := range []string{"https://", "https://[::1/dns-query", "dns.example.com/dns-query"} {
+		_, err := NewHTTPClient(HTTPClientSettings{Resolver: resolver})
+		require.Error(t, err, resolver)
+	}
+
+	target := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("42"))
+	}))
+	defer target.Close()
+	_, port, err := net.SplitHostPort(target.Listener.Addr().String())
+	require.NoError(t, err)
+	get := func(client *HTTPClient) {
+		bts, err := client.NewTransport("http://irma.test:"+port, false).GetBytes("")
+		require.NoError(t, err)
+		require.Equal(t, "42", string(bts))
+	}
+
+	// DNS server
+	dns, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer dns.Close()
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := dns.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			_, _ = dns.WriteTo(dnsResponse(t, buf[:n]), addr)
+		}
+	}()
+	get(newHTTPClient(t, HTTPClientSettings{Resolver: dns.LocalAddr().String()}))
+
+	// DNS-over-HTTPS server
+	var queries atomic.Int32
+	doh := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, http.MethodPost, r.Method)
+		require.Equal(t, "application/dns-message", r.Header.Get("Content-Type"))
+		query, err := io.ReadAll(r.Body)
+		require.NoError(t, err)
+		queries.Add(1)
+		w.Header().Set("Content-Type", "application/dns-message")
+		_, _ = w.Write(dnsResponse(t, query))
+	}))
+	defer doh.Close()
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: doh.Certificate().Raw})
+	get(newHTTPClient(t, HTTPClientSettings{Resolver: doh.URL + "/dns-query", CACertificates: string(ca)}))
+	require.NotZero(t, queries.Load())
+}
+
 func TestInvalidIrmaConfigurationRestoreFromRemote(t *testing.T) {
 	test.StartSchemeManagerHttpServer()
 	defer test.StopSchemeManagerHttpServer()
@@ -323,6 +666,203 @@ func TestInstallScheme(t *testing.T) {
 	require.NotNil(t, sk)
 }
 
+func TestSchemePinning(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	testPk, err := os.ReadFile(filepath.Join("testdata", "irma_configuration", "test", "pk.pem"))
+	require.NoError(t, err)
+	demoPk, err := os.ReadFile(filepath.Join("testdata", "irma_configuration", "irma-demo", "pk.pem"))
+	require.NoError(t, err)
+	url := "http://localhost:48681/irma_configuration/test"
+	id := NewSchemeManagerIdentifier("test")
+
+	// Installing a scheme whose public key is not pinned fails cleanly
+	conf, err := NewConfiguration(t.TempDir(), ConfigurationOptions{})
+	require.NoError(t, err)
+	require.Error(t, conf.PinSchemePublicKeys("test", []byte("invalid")))
+	require.NoError(t, conf.PinSchemePublicKeys("test", demoPk))
+	require.ErrorIs(t, conf.DangerousTOFUInstallScheme(url), ErrSchemePublicKeyNotPinned)
+	require.NotContains(t, conf.SchemeManagers, id)
+
+	// Installing and updating a scheme with a pinned public key succeeds
+	require.NoError(t, conf.PinSchemePublicKeys("test", demoPk, testPk))
+	require.NoError(t, conf.DangerousTOFUInstallScheme(url))
+	require.Contains(t, conf.SchemeManagers, id)
+	require.NoError(t, conf.PinSchemePublicKeys("test", demoPk))
+	require.ErrorIs(t, conf.UpdateScheme(conf.SchemeManagers[id], nil), ErrSchemePublicKeyNotPinned)
+
+	// Out-of-band verification of the public key hash
+	conf, err = NewConfiguration(t.TempDir(), ConfigurationOptions{})
+	require.NoError(t, err)
+	wrong := sha256.Sum256(demoPk)
+	require.Error(t, conf.InstallSchemeWithPublicKeyHash(url, wrong[:]))
+	require.NotContains(t, conf.SchemeManagers, id)
+	hash := sha256.Sum256(testPk)
+	require.NoError(t, conf.InstallSchemeWithPublicKeyHash(url, hash[:]))
+	require.Contains(t, conf.SchemeManagers, id)
+}
+
+func TestSchemeLog(t *testing.T) {
+	test.StartSchemeManagerHttpServer()
+	defer test.StopSchemeManagerHttpServer()
+
+	submitted := make(chan *SchemeLogEntry, 2)
+	publicLog := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entry := &SchemeLogEntry{}
+		require.NoError(t, json.NewDecoder(r.Body).Decode(entry))
+		submitted <- entry
+	}))
+	defer publicLog.Close()
+
+	logPath := filepath.Join(t.TempDir(), "schemes.log")
+	url := "http://localhost:48681/irma_configuration/irma-demo"
+	id := NewSchemeManagerIdentifier("irma-demo")
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	newConf := func() *Configuration {
+		conf, err := NewConfiguration(t.TempDir(), ConfigurationOptions{
+			SchemeLogPath:      logPath,
+			SchemeLogSubmitURL: publicLog.URL + "/entries",
+			Now:                func() time.Time { return now },
+		})
+		require.NoError(t, err)
+		return conf
+	}
+
+	// Installing and updating a scheme logs both versions, which are submitted to the public log
+	conf := newConf()
+	require.NoError(t, conf.DangerousTOFUInstallScheme(url))
+	scheme := conf.SchemeManagers[id]
+	scheme.URL = "http://localhost:48681/irma_configuration_updated/irma-demo"
+	require.NoError(t, conf.UpdateScheme(scheme, nil))
+	entries, err := conf.SchemeLog("irma-demo")
+	require.NoError(t, err)
+	require.Len(t, entries, 2)
+	require.True(t, entries[0].Timestamp.Before(entries[1].Timestamp))
+	require.Equal(t, entries[0].Signer, entries[1].Signer)
+	require.Empty(t, entries[0].PrevHash)
+	require.NotEmpty(t, entries[1].PrevHash)
+	require.True(t, now.Equal(entries[0].Accepted))
+	for _, entry := range entries {
+		require.Equal(t, entry.IndexHash, (<-submitted).IndexHash)
+	}
+	other, err := conf.SchemeLog("test")
+	require.NoError(t, err)
+	require.Empty(t, other)
+
+	// Installing the scheme again at the old version is refused as a rollback
+	conf = newConf()
+	require.ErrorIs(t, conf.DangerousTOFUInstallScheme(url), ErrSchemeRollback)
+	require.NotContains(t, conf.SchemeManagers, id)
+
+	// An index with the same timestamp as the last logged index but different contents is
+	// refused as a fork
+	logged, err := os.ReadFile(logPath)
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(string(logged)), "\n")
+	last := sha256.Sum256([]byte(lines[len(lines)-1]))
+	forked := *entries[0]
+	forked.IndexHash, forked.PrevHash = strings.Repeat("00", sha256.Size), hex.EncodeToString(last[:])
+	line, err := json.Marshal(&forked)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(logPath, append(append(logged, line...), '\n'), 0600))
+	conf = newConf()
+	require.ErrorIs(t, conf.DangerousTOFUInstallScheme(url), ErrSchemeFork)
+
+	// Changing an entry of the log breaks its hash chain
+	changed := strings.Replace(string(logged), entries[0].IndexHash, strings.Repeat("00", sha256.Size), 1)
+	require.NoError(t, os.WriteFile(logPath, []byte(changed), 0600))
+	_, err = conf.SchemeLog("")
+	require.Error(t, err)
+
+	// Removing the last entries of the log is detected using its head
+	require.NoError(t, os.WriteFile(logPath, []byte(lines[0]+"\n"), 0600))
+	_, err = conf.SchemeLog("")
+	require.ErrorContains(t, err, "truncated")
+	require.NoError(t, os.Remove(logPath))
+	_, err = conf.SchemeLog("")
+	require.Error(t, err)
+	require.NoError(t, os.WriteFile(logPath, logged, 0600))
+	_, err = conf.SchemeLog("")
+	require.NoError(t, err)
+}
+
+func TestVerifyKeyproof(t *testing.T) {
+	storage := t.TempDir()
+	require.NoError(t, common.CopyDirectory(filepath.Join("testdata", "irma_configuration", "irma-demo"), filepath.Join(storage, "irma-demo")))
+	conf, err := NewConfiguration(storage, ConfigurationOptions{})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	issuer := NewIssuerIdentifier("irma-demo.RU")
+	id := PublicKeyIdentifier{Issuer: issuer, Counter: 2}
+	require.ErrorIs(t, conf.VerifyKeyproof(id), ErrKeyproofMissing)
+	require.ErrorIs(t, conf.VerifyIssuerKeyproofs(issuer), ErrKeyproofMissing)
+	require.Error(t, conf.VerifyKeyproof(PublicKeyIdentifier{Issuer: issuer, Counter: 10}))
+
+	path, err := conf.KeyproofPath(id)
+	require.NoError(t, err)
+	require.Equal(t, filepath.Join(storage, "irma-demo", "RU", "Proofs", "2.json.gz"), path)
+	require.NoError(t, common.EnsureDirectoryExists(filepath.Dir(path)))
+	require.NoError(t, os.WriteFile(path, []byte("not gzipped"), 0600))
+	require.ErrorIs(t, conf.VerifyKeyproof(id), ErrKeyproofInvalid)
+
+	var proof bytes.Buffer
+	w := gzip.NewWriter(&proof)
+	_, err = w.Write([]byte("{}"))
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	require.NoError(t, os.WriteFile(path, proof.Bytes(), 0600))
+	require.ErrorIs(t, conf.VerifyKeyproof(id), ErrKeyproofInvalid)
+
+	// Snapshots share the verification results
+	require.ErrorIs(t, conf.Snapshot().VerifyKeyproof(id), ErrKeyproofInvalid)
+
+	// VerifiedIssuerKeyproofs only returns cached results, verifying the keyproofs that were not
+	// verified before in the background
+	ids := []PublicKeyIdentifier{{issuer, 0}, {issuer, 1}, id}
+	for _, id := range ids {
+		path, err := conf.KeyproofPath(id)
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(path, []byte("changed, not gzipped"), 0600))
+	}
+	require.ErrorIs(t, conf.VerifiedIssuerKeyproofs(issuer), ErrKeyproofUnverified)
+	require.Eventually(t, func() bool {
+		return errors.Is(conf.VerifiedIssuerKeyproofs(issuer), ErrKeyproofInvalid)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// Generating valid keyproofs takes too long for a test, so we cache their successful verification
+	for _, id := range ids {
+		key, _, _, err := conf.keyproofCacheKey(id)
+		require.NoError(t, err)
+		conf.keyproofs.Lock()
+		conf.keyproofs.verified[key] = nil
+		conf.keyproofs.Unlock()
+	}
+	require.NoError(t, conf.VerifiedIssuerKeyproofs(issuer))
+	require.NoError(t, conf.Snapshot().VerifiedIssuerKeyproofs(issuer))
+}
+
+func TestCredentialTypeDeprecation(t *testing.T) {
+	var credtype CredentialType
+	require.NoError(t, xml.Unmarshal([]byte(`<IssueSpecification version="4">
+		<DeprecatedSince>1600000000</DeprecatedSince>
+		<SunsetDate>1700000000</SunsetDate>
+		<ReplacedBy>irma-demo.RU.studentCard</ReplacedBy>
+	</IssueSpecification>`), &credtype))
+	require.Equal(t, NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), *credtype.ReplacedBy)
+
+	require.False(t, credtype.IsDeprecated(time.Unix(1500000000, 0)))
+	require.True(t, credtype.IsDeprecated(time.Unix(1600000000, 0)))
+	require.False(t, credtype.IsSunset(time.Unix(1600000000, 0)))
+	require.True(t, credtype.IsSunset(time.Unix(1700000000, 0)))
+
+	// A sunset date implies deprecation
+	credtype.DeprecatedSince = Timestamp{}
+	require.False(t, credtype.IsDeprecated(time.Unix(1600000000, 0)))
+	require.True(t, credtype.IsDeprecated(time.Unix(1700000000, 0)))
+}
+
 func TestMetadataAttribute(t *testing.T) {
 	metadata := NewMetadataAttribute(0x02)
 	if metadata.Version() != 0x02 {
@@ -418,7 +958,433 @@ func TestEmptySignature(t *testing.T) {
 	require.NotEqual(t, ProofStatusValid, status)
 }
 
+func TestSignatureRequestPlaceholders(t *testing.T) {
+	firstname, familyname := "Alice", "Doe"
+	disclosed := AttributeConDisCon{
+		{{{Type: NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"), Value: &firstname}}},
+		{{{Type: NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname"), Value: &familyname}}},
+	}
+	now := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	message := "I, {{disclosed.firstname}} {{ disclosed.irma-demo.MijnOverheid.fullName.familyname }}, agree on {{today}} ({{now}})"
+	request := NewSignatureRequest(message)
+	require.True(t, request.HasPlaceholders())
+	resolved, err := request.ResolvePlaceholders(now, disclosed)
+	require.NoError(t, err)
+	require.Equal(t, "I, Alice Doe, agree on 2024-03-01 (2024-03-01T12:30:00Z)", resolved.Message)
+	require.False(t, resolved.HasPlaceholders())
+	require.Equal(t, message, request.Message) // the request itself is left untouched
+
+	// Other text between double braces is not a placeholder
+	request = NewSignatureRequest("{{tomorrow}} {{ today}}")
+	resolved, err = request.ResolvePlaceholders(now, disclosed)
+	require.NoError(t, err)
+	require.Equal(t, "{{tomorrow}} 2024-03-01", resolved.Message)
+	require.False(t, NewSignatureRequest("{{tomorrow}}").HasPlaceholders())
+
+	// Attributes that were not disclosed are refused
+	_, err = NewSignatureRequest("{{disclosed.BSN}}").ResolvePlaceholders(now, disclosed)
+	require.Error(t, err)
+	_, err = NewSignatureRequest("{{disclosed.firstname}}").ResolvePlaceholders(now, nil)
+	require.Error(t, err)
+
+	// Attribute names must be unambiguous
+	other := "Bob"
+	disclosed = append(disclosed, AttributeDisCon{{{Type: NewAttributeTypeIdentifier("irma-demo.RU.fullName.firstname"), Value: &other}}})
+	_, err = NewSignatureRequest("{{disclosed.firstname}}").ResolvePlaceholders(now, disclosed)
+	require.Error(t, err)
+}
+
+func TestTSATimestamp(t *testing.T) {
+	tsa := test.StartTSA(t)
+	other := test.StartTSA(t)
+	down := httptest.NewServer(http.NotFoundHandler())
+	defer down.Close()
+
+	// The first TSA is down, so the timestamp is obtained from the redundant one
+	nonce := []byte("nonce")
+	scheme := &SchemeTSA{URLs: []string{down.URL, tsa.URL}, Certificates: []string{tsa.RootPEM}}
+	ts, err := GetTSATimestamp(nonce, scheme)
+	require.NoError(t, err)
+	require.Len(t, ts.Certificates, 1)
+
+	roots, err := scheme.Roots()
+	require.NoError(t, err)
+	genTime, err := ts.Verify(nonce, roots)
+	require.NoError(t, err)
+	require.WithinDuration(t, time.Now(), genTime, time.Minute)
+	require.Equal(t, genTime, (&SignatureTimestamp{TSA: ts}).Time())
+
+	_, err = ts.Verify([]byte("other nonce"), roots)
+	require.Error(t, err)
+	otherRoots, err := (&SchemeTSA{Certificates: []string{other.RootPEM}}).Roots()
+	require.NoError(t, err)
+	_, err = ts.Verify(nonce, otherRoots)
+	require.Error(t, err)
+	_, err = ts.Verify(nonce, roots, otherRoots)
+	require.Error(t, err)
+
+	// Timestamps of TSAs not trusted by the scheme are rejected
+	_, err = GetTSATimestamp(nonce, &SchemeTSA{URLs: []string{other.URL}, Certificates: []string{tsa.RootPEM}})
+	require.Error(t, err)
+
+	ts.Token[len(ts.Token)-1] ^= 1
+	_, err = ts.Verify(nonce, roots)
+	require.Error(t, err)
+}
+
+func TestSignedMessageMultipleTimestamps(t *testing.T) {
+	// A signed message could otherwise have its TSA timestamp verified, while its nonce and
+	// time are taken from a forged atum timestamp
+	tsa := test.StartTSA(t)
+	ts, err := GetTSATimestamp([]byte("nonce"), &SchemeTSA{URLs: []string{tsa.URL}, Certificates: []string{tsa.RootPEM}})
+	require.NoError(t, err)
+	forged := &atum.Timestamp{Time: 0, Sig: atum.Signature{Data: []byte("forged")}}
+
+	sm := &SignedMessage{LDContext: LDContextSignedMessage, Timestamp: forged, TSATimestamp: ts}
+	require.Error(t, sm.Validate())
+	require.Error(t, sm.VerifyTimestamp("message", nil))
+	status := sm.SignatureTimestamp()
+	require.Equal(t, ts.Token, status.signature())
+	require.NotEqual(t, time.Unix(0, 0), status.Time())
+
+	sm.Timestamp = nil
+	require.NoError(t, sm.Validate())
+}
+
 // Test attribute decoding with both old and new metadata versions
+func TestQrSignature(t *testing.T) {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	other, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	qr := &Qr{URL: "https://example.com/irma/session/abc", Type: ActionDisclosing}
+	require.Error(t, qr.VerifySignature(&sk.PublicKey))
+
+	require.NoError(t, qr.Sign(sk))
+	require.NoError(t, qr.VerifySignature(&sk.PublicKey))
+	require.Error(t, qr.VerifySignature(&other.PublicKey))
+
+	// Survives a JSON roundtrip
+	bts, err := json.Marshal(qr)
+	require.NoError(t, err)
+	parsed := &Qr{}
+	require.NoError(t, json.Unmarshal(bts, parsed))
+	require.NoError(t, parsed.VerifySignature(&sk.PublicKey))
+
+	swapped := *qr
+	swapped.URL = "https://evil.example.com/irma/session/abc"
+	require.Error(t, swapped.VerifySignature(&sk.PublicKey))
+	swapped = *qr
+	swapped.Type = ActionIssuing
+	require.Error(t, swapped.VerifySignature(&sk.PublicKey))
+	swapped = *qr
+	swapped.AlternativeURLs = []string{"https://evil.example.com/irma/session/abc"}
+	require.Error(t, swapped.VerifySignature(&sk.PublicKey))
+
+	// Alternative URLs are covered by the signature
+	qr.AlternativeURLs = []string{"http://[2001:db8::1]:8088/irma/session/abc"}
+	require.NoError(t, qr.Validate())
+	require.NoError(t, qr.Sign(sk))
+	require.NoError(t, qr.VerifySignature(&sk.PublicKey))
+	swapped = *qr
+	swapped.AlternativeURLs = nil
+	require.Error(t, swapped.VerifySignature(&sk.PublicKey))
+}
+
+func TestSignatureArchiveTime(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	conf, err := NewConfiguration(t.TempDir(), ConfigurationOptions{Now: func() time.Time { return now }})
+	require.NoError(t, err)
+	archive, err := (&SignedMessage{}).Archive(conf)
+	require.NoError(t, err)
+	require.Equal(t, now, time.Time(archive.Archived))
+}
+
+func TestCompactQr(t *testing.T) {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	nonce, err := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 256).Go())
+	require.NoError(t, err)
+	request := NewDisclosureRequest()
+	request.Disclose = AttributeConDisCon{
+		AttributeDisCon{
+			AttributeCon{NewAttributeRequest("irma-demo.MijnOverheid.fullName.firstname"), NewAttributeRequest("irma-demo.MijnOverheid.fullName.familyname")},
+		},
+		AttributeDisCon{
+			AttributeCon{NewAttributeRequest("irma-demo.RU.studentCard.studentID")},
+			AttributeCon{NewAttributeRequest("irma-demo.MijnOverheid.root.BSN")},
+		},
+	}
+	request.Labels[1] = TranslatedString{"en": "Student or citizen", "nl": "Student of burger"}
+	request.Context = big.NewInt(1)
+	request.Nonce = big.Convert(nonce)
+	request.ProtocolVersion = NewVersion(2, 8)
+
+	qr := &Qr{URL: "https://example.com/irma/session/9Rj2fMTWBxZmHMxbRPZp", Type: ActionDisclosing, Request: request}
+	require.NoError(t, qr.Sign(sk))
+
+	compact, err := qr.MarshalCompact()
+	require.NoError(t, err)
+	bts, err := json.Marshal(qr)
+	require.NoError(t, err)
+	require.Less(t, len(compact), len(bts))
+
+	// The request itself is encoded in much fewer bytes than its JSON
+	cbts, err := cbor.Marshal(newCompactRequest(request), cbor.EncOptions{})
+	require.NoError(t, err)
+	bts, err = json.Marshal(request)
+	require.NoError(t, err)
+	require.Less(t, len(cbts), len(bts)*3/4)
+
+	parsed, err := ParseCompactQr(compact)
+	require.NoError(t, err)
+	parsedbts, err := json.Marshal(parsed.Request)
+	require.NoError(t, err)
+	require.Equal(t, bts, parsedbts)
+	require.NoError(t, parsed.VerifySignature(&sk.PublicKey))
+
+	// Requests that the compact encoding does not preserve are refused
+	request.Revocation = NonRevocationParameters{NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root"): {Tolerance: 60}}
+	require.NoError(t, qr.Sign(sk))
+	_, err = qr.MarshalCompact()
+	require.Error(t, err)
+}
+
+func TestLDContext(t *testing.T) {
+	var ldContextErr *LDContextError
+
+	require.NoError(t, ValidateLDContext(LDContextDisclosureRequest, nil, SessionRequestLDContexts...))
+	require.NoError(t, ValidateLDContext(LDContextClientSessionRequest, NewVersion(2, 8), LDContextClientSessionRequest))
+	require.NoError(t, ValidateLDContext("", NewVersion(2, 4), "", LDContextSignedMessage))
+	require.NoError(t, ValidateLDContext(LDContextRevocationRequest, NewVersion(2, 4), LDContextRevocationRequest))
+
+	err := ValidateLDContext(LDContextIssuanceRequest, nil, LDContextDisclosureRequest)
+	require.ErrorAs(t, err, &ldContextErr)
+	require.Nil(t, ldContextErr.ProtocolVersion)
+	err = ValidateLDContext(LDContextClientSessionRequest, NewVersion(2, 7), LDContextClientSessionRequest)
+	require.ErrorAs(t, err, &ldContextErr)
+	require.Equal(t, NewVersion(2, 7), ldContextErr.ProtocolVersion)
+	require.ErrorAs(t, ValidateLDContext("", NewVersion(2, 5), "", LDContextSignedMessage), &ldContextErr)
+	require.ErrorAs(t, ValidateLDContext(LDContextSignedMessage, NewVersion(2, 4), "", LDContextSignedMessage), &ldContextErr)
+
+	// Messages of one kind are not accepted as messages of another kind
+	sigRequest := `{"@context":"https://irma.app/ld/request/signature/v2","message":"message","disclose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+	require.ErrorAs(t, UnmarshalValidate([]byte(sigRequest), &DisclosureRequest{}), &ldContextErr)
+	require.ErrorAs(t, UnmarshalValidate([]byte(`{"request":`+sigRequest+`}`), &ServiceProviderRequest{}), &ldContextErr)
+	require.NoError(t, UnmarshalValidate([]byte(`{"request":`+sigRequest+`}`), &SignatureRequestorRequest{}))
+	require.ErrorAs(t, UnmarshalValidate([]byte(`{"@context":"https://irma.app/ld/request/disclosure/v2"}`), &SignedMessage{}), &ldContextErr)
+	require.NoError(t, UnmarshalValidate([]byte(`{"message":"message"}`), &SignedMessage{}))
+}
+
+func TestNewRequestorRequest(t *testing.T) {
+	for action, expected := range map[Action]RequestorRequest{
+		ActionDisclosing: &ServiceProviderRequest{},
+		ActionSigning:    &SignatureRequestorRequest{},
+		ActionIssuing:    &IdentityProviderRequest{},
+	} {
+		rrequest, err := NewRequestorRequest(action)
+		require.NoError(t, err)
+		require.Equal(t, expected, rrequest)
+	}
+
+	_, err := NewRequestorRequest(ActionRedirect)
+	require.Error(t, err)
+
+	RegisterRequestorRequest(ActionRedirect, func() RequestorRequest { return &ServiceProviderRequest{} })
+	defer func() {
+		requestorRequestsMutex.Lock()
+		delete(requestorRequests, ActionRedirect)
+		requestorRequestsMutex.Unlock()
+	}()
+	rrequest, err := NewRequestorRequest(ActionRedirect)
+	require.NoError(t, err)
+	require.IsType(t, &ServiceProviderRequest{}, rrequest)
+}
+
+func TestPurposeValidate(t *testing.T) {
+	require.NoError(t, (&Purpose{Code: "kyc.age-check", Text: TranslatedString{"en": "Age check"}}).Validate())
+	require.Error(t, (&Purpose{Code: "kyc", Text: TranslatedString{"en": ""}}).Validate())
+	require.Error(t, (&Purpose{Text: TranslatedString{"en": "Age check"}}).Validate())
+	require.Error(t, (&Purpose{Code: "age check", Text: TranslatedString{"en": "Age check"}}).Validate())
+}
+
+func TestAttributeIndexSearch(t *testing.T) {
+	conf := parseConfiguration(t)
+	index := NewAttributeIndex(conf)
+	studentCard := NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+
+	find := func(results []SearchResult) *SearchResult {
+		for i := range results {
+			if results[i].CredentialType.Identifier() == studentCard {
+				return &results[i]
+			}
+		}
+		return nil
+	}
+	attrIDs := func(result *SearchResult) (ids []string) {
+		for _, attr := range result.AttributeTypes {
+			ids = append(ids, attr.ID)
+		}
+		return
+	}
+
+	// A matching credential type contains all its attribute types
+	result := find(index.Search("Studentenkaart"))
+	require.NotNil(t, result)
+	require.Len(t, result.AttributeTypes, len(result.CredentialType.AttributeTypes))
+	require.Equal(t, "RU", result.Issuer.ID)
+
+	// Attribute types match on their own texts combined with those of their credential type
+	result = find(index.Search("radboud NUMMER"))
+	require.NotNil(t, result)
+	require.Equal(t, []string{"studentCardNumber", "studentID"}, attrIDs(result))
+	result = find(index.Search("irma-demo.RU.studentCard.studentID"))
+	require.NotNil(t, result)
+	require.Equal(t, []string{"studentID"}, attrIDs(result))
+
+	require.Nil(t, find(index.Search("radboud nonexisting")))
+	require.Empty(t, index.Search(" "))
+}
+
+func TestConDisConBuilder(t *testing.T) {
+	conf := parseConfiguration(t)
+	studentID := NewAttributeRequest("irma-demo.RU.studentCard.studentID")
+	level := NewAttributeRequest("irma-demo.RU.studentCard.level")
+	bsn := NewAttributeRequest("irma-demo.MijnOverheid.root.BSN")
+
+	cdc, err := NewConDisConBuilder().
+		With(studentID).
+		Or(And(level.WithValue("PhD")), And(bsn.WithNotNull())).
+		Optional(And(bsn, level)).
+		BuildFor(conf)
+	require.NoError(t, err)
+	phd := "PhD"
+	require.Equal(t, AttributeConDisCon{
+		{{studentID}},
+		{{{Type: level.Type, Value: &phd}}, {{Type: bsn.Type, NotNull: true}}},
+		{{}, {bsn, level}},
+	}, cdc)
+
+	// Structural errors are reported by Build(), the first one taking precedence
+	_, err = NewConDisConBuilder().Build()
+	require.Error(t, err)
+	_, err = NewConDisConBuilder().With().With(studentID).Build()
+	require.EqualError(t, err, "With() requires at least one attribute")
+	_, err = NewConDisConBuilder().Or(And()).Build()
+	require.Error(t, err)
+	_, err = NewConDisConBuilder().Or(And(studentID, bsn, level)).Build()
+	require.Error(t, err)
+
+	// BuildFor() validates against the configuration
+	_, err = NewConDisConBuilder().With(NewAttributeRequest("irma-demo.RU.studentCard.nonexisting")).BuildFor(conf)
+	require.Error(t, err)
+	_, err = NewConDisConBuilder().With(NewAttributeRequest("irma-demo.RU.studentCard").WithValue("x")).BuildFor(conf)
+	require.Error(t, err)
+	_, err = NewConDisConBuilder().With(studentID, NewAttributeRequest("irma-demo.MijnOverheid.fullName.firstname")).BuildFor(conf)
+	require.Error(t, err)
+
+	conf.AttributeTypes[level.Type].DataType = AttributeDataTypeInteger
+	defer func() { conf.AttributeTypes[level.Type].DataType = "" }()
+	_, err = NewConDisConBuilder().With(level.WithValue("PhD")).BuildFor(conf)
+	require.Error(t, err)
+	_, err = NewConDisConBuilder().With(level.WithValue("3")).BuildFor(conf)
+	require.NoError(t, err)
+
+	// Metadata pseudo-attributes are accepted, and their values must be dates
+	expiry := NewAttributeRequest("irma-demo.RU.studentCard." + MetadataAttributeExpiry)
+	require.True(t, expiry.Type.IsMetadataAttribute())
+	require.False(t, studentID.Type.IsMetadataAttribute())
+	_, err = NewConDisConBuilder().With(studentID, expiry).BuildFor(conf)
+	require.NoError(t, err)
+	_, err = NewConDisConBuilder().With(expiry.WithValue("2030-01-01")).BuildFor(conf)
+	require.NoError(t, err)
+	_, err = NewConDisConBuilder().With(expiry.WithValue("soon")).BuildFor(conf)
+	require.Error(t, err)
+}
+
+func TestOptimizeConDisCon(t *testing.T) {
+	conf := parseConfiguration(t)
+	studentID := NewAttributeRequest("irma-demo.RU.studentCard.studentID")
+	level := NewAttributeRequest("irma-demo.RU.studentCard.level")
+	bsn := NewAttributeRequest("irma-demo.MijnOverheid.root.BSN")
+	firstname := NewAttributeRequest("irma-demo.MijnOverheid.fullName.firstname")
+	unknown := NewAttributeRequest("irma-demo.RU.studentCard.nonexisting")
+
+	cdc := AttributeConDisCon{
+		{{studentID}},
+		{{bsn, studentID, bsn}}, // duplicate request, non-adjacent credential type
+		{{level}},               // merged into disjunction 0
+		{{}, {bsn, level}, {firstname}, {unknown}},     // reordered, impossible option removed
+		{{studentID}, {firstname}},                     // redundant: studentID requested by disjunction 0
+		{{level.WithValue("a"), level.WithValue("b")}}, // impossible
+	}
+	optimized := cdc.Optimize(conf)
+	require.Equal(t, AttributeConDisCon{
+		{{studentID, level}},
+		{{bsn, studentID}},
+		{{}, {firstname}, {bsn, level}},
+		{{level.WithValue("a"), level.WithValue("b")}},
+	}, optimized.ConDisCon)
+	require.Equal(t, []int{0, 1, 3, 5}, optimized.Origins)
+	disjunctions := map[int]int{}
+	for _, w := range optimized.Warnings {
+		disjunctions[w.Disjunction]++
+	}
+	require.Equal(t, map[int]int{2: 1, 3: 2, 4: 1, 5: 2}, disjunctions)
+
+	// The original is not modified
+	require.Len(t, cdc[1][0], 3)
+
+	// Labels of disclosure requests move along
+	request := NewDisclosureRequest()
+	request.Disclose = AttributeConDisCon{{{level}}, {{studentID}}, {{bsn}}}
+	request.Labels = map[int]TranslatedString{0: {"en": "level"}, 2: {"en": "bsn"}}
+	require.Len(t, request.Optimize(conf), 1)
+	require.Equal(t, AttributeConDisCon{{{level, studentID}}, {{bsn}}}, request.Disclose)
+	require.Equal(t, map[int]TranslatedString{0: {"en": "level"}, 1: {"en": "bsn"}}, request.Labels)
+}
+
+func TestSessionRequestDiff(t *testing.T) {
+	newRequest := func() *DisclosureRequest {
+		request := NewDisclosureRequest(
+			NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+			NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"),
+		)
+		request.Labels = map[int]TranslatedString{0: {"en": "Student", "nl": "Student"}, 1: {"en": "BSN"}}
+		return request
+	}
+	a, b := newRequest(), newRequest()
+	require.True(t, SessionRequestsEqual(a, b))
+	require.Empty(t, SessionRequestsDiff(a, b))
+
+	b.Disclose[1][0][0].Type = NewAttributeTypeIdentifier("irma-demo.RU.studentCard.level")
+	b.Labels[0]["nl"] = "Studentnummer"
+	require.False(t, SessionRequestsEqual(a, b))
+	require.Equal(t, []RequestDifference{
+		{Path: "disclose[1][0][0]", A: "irma-demo.MijnOverheid.root.BSN", B: "irma-demo.RU.studentCard.level"},
+		{Path: "labels.0.nl", A: "Student", B: "Studentnummer"},
+	}, SessionRequestsDiff(a, b))
+
+	// Requests of different types differ in their context
+	signature := NewSignatureRequest("message")
+	diffs := SessionRequestsDiff(NewDisclosureRequest(), signature)
+	require.Len(t, diffs, 2)
+	require.Equal(t, "@context", diffs[0].Path)
+	require.Equal(t, "message", diffs[1].Path)
+	require.Nil(t, diffs[1].A)
+	require.False(t, SessionRequestsEqual(signature, nil))
+
+	// Requestor requests are compared including their session requests
+	ra := &ServiceProviderRequest{Request: newRequest(), RequestorBaseRequest: RequestorBaseRequest{CallbackURL: "https://example.com"}}
+	rb := &ServiceProviderRequest{Request: newRequest(), RequestorBaseRequest: RequestorBaseRequest{CallbackURL: "https://example.com"}}
+	require.True(t, RequestorRequestsEqual(ra, rb))
+	rb.Request.Labels[1] = TranslatedString{"en": "Citizen service number"}
+	require.Equal(t, []RequestDifference{{Path: "request.labels.1.en", A: "BSN", B: "Citizen service number"}}, RequestorRequestsDiff(ra, rb))
+}
+
 func TestAttributeDecoding(t *testing.T) {
 	expected := "male"
 
@@ -431,6 +1397,39 @@ func TestAttributeDecoding(t *testing.T) {
 	require.Equal(t, *oldString, expected)
 }
 
+func TestAttributeDataTypes(t *testing.T) {
+	require.NoError(t, AttributeDataTypeDate.Validate("2000-02-29"))
+	require.Error(t, AttributeDataTypeDate.Validate("29-02-2000"))
+	require.Error(t, AttributeDataTypeDate.Validate("2001-02-29"))
+	require.NoError(t, AttributeDataTypeInteger.Validate("-123456789012345678901234567890"))
+	require.Error(t, AttributeDataTypeInteger.Validate("12.5"))
+	require.NoError(t, AttributeDataTypeBoolean.Validate("false"))
+	require.Error(t, AttributeDataTypeBoolean.Validate("False"))
+	require.NoError(t, AttributeDataTypeString.Validate("anything"))
+	require.Error(t, AttributeDataType("float").Validate("1.5"))
+
+	date := time.Date(2000, 2, 29, 0, 0, 0, 0, time.UTC)
+	for _, value := range []string{"2000-02-29", "29-02-2000"} {
+		attr := &DisclosedAttribute{RawValue: &value, DataType: AttributeDataTypeDate}
+		parsed, err := attr.DateValue()
+		require.NoError(t, err)
+		require.Equal(t, date, parsed)
+	}
+
+	value := "Yes"
+	attr := &DisclosedAttribute{RawValue: &value, DataType: AttributeDataTypeBoolean}
+	typed, err := attr.TypedValue()
+	require.NoError(t, err)
+	require.Equal(t, true, typed)
+	_, err = attr.DateValue()
+	require.Error(t, err)
+
+	attr = &DisclosedAttribute{DataType: AttributeDataTypeInteger}
+	typed, err = attr.TypedValue()
+	require.NoError(t, err)
+	require.Nil(t, typed)
+}
+
 func TestSessionRequests(t *testing.T) {
 	attrval := "hello"
 	sigMessage := "message to be signed"
@@ -696,7 +1695,7 @@ func TestConDisconSingletons(t *testing.T) {
 	}
 }
 
-func parseDisclosure(t *testing.T) (*Configuration, *DisclosureRequest, *Disclosure) {
+func parseDisclosure(t testing.TB) (*Configuration, *DisclosureRequest, *Disclosure) {
 	conf := parseConfiguration(t)
 
 	requestJson := `{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"zVQJMG6TKZwfcv5TExFVSQ==","protocolVersion":"2.5","disclose":[[["irma-demo.RU.studentCard.studentID"]]],"labels":{"0":null}}`
@@ -743,6 +1742,78 @@ func TestVerify(t *testing.T) {
 	})
 }
 
+func BenchmarkVerify(b *testing.B) {
+	conf, request, disclosure := parseDisclosure(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		_, status, err := disclosure.Verify(conf, request)
+		if err != nil || status != ProofStatusValid {
+			b.Fatal(status, err)
+		}
+	}
+}
+
+func BenchmarkParseConfiguration(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		conf, err := NewConfiguration("testdata/irma_configuration", ConfigurationOptions{})
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err = conf.ParseFolder(); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDisclosedAttributes(b *testing.B) {
+	conf, request, disclosure := parseDisclosure(b)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := disclosure.DisclosedAttributes(conf, request.Disclose, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMetadataAttribute(b *testing.B) {
+	conf := parseConfiguration(b)
+	attr := MetadataFromInt(s2big("49043481832371145193140299771658227036446546573739245068"), conf)
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if attr.CredentialType() == nil || attr.Version() != 2 || attr.Expiry().IsZero() || attr.KeyCounter() != 2 {
+			b.Fatal("unexpected metadata")
+		}
+	}
+}
+
+func BenchmarkAttributeList(b *testing.B) {
+	conf := parseConfiguration(b)
+	credreq := &CredentialRequest{
+		CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"),
+		Attributes: map[string]string{
+			"firstnames": "Johan Pieter",
+			"firstname":  "Johan",
+			"familyname": "Stuivezand",
+			"prefix":     "van",
+		},
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		list, err := credreq.AttributeList(conf, 0x03, nil, time.Now())
+		if err != nil {
+			b.Fatal(err)
+		}
+		if len(list.Map()) == 0 || list.Hash() == "" {
+			b.Fatal("empty attribute list")
+		}
+	}
+}
+
 var (
 	revocationTestCred  = NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
 	revocationPkCounter = uint(2)
@@ -1640,3 +2711,92 @@ func TestInstallSchemeUnstableRemote(t *testing.T) {
 	err = conf.ParseFolder()
 	require.NoError(t, err)
 }
+
+func TestKeyshareJWKS(t *testing.T) {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	// JWK roundtrip
+	jwk := NewRSAJWK(5, &sk.PublicKey)
+	require.Equal(t, "5", jwk.Kid)
+	pk, err := jwk.RSAPublicKey()
+	require.NoError(t, err)
+	require.True(t, sk.PublicKey.Equal(pk))
+
+	var fetched atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, KeyshareJWKSPath, r.URL.Path)
+		fetched.Add(1)
+		bts, _ := json.Marshal(JWKS{Keys: []JWK{jwk}})
+		_, _ = w.Write(bts)
+	}))
+	defer ts.Close()
+
+	conf, err := NewConfiguration("testdata/irma_configuration", ConfigurationOptions{KeyshareJWKS: true})
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+	schemeid := NewSchemeManagerIdentifier("test")
+	conf.SchemeManagers[schemeid].KeyshareServer = ts.URL
+
+	sign := func(kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.RegisteredClaims{Issuer: "keyshare"})
+		token.Header["kid"] = kid
+		str, err := token.SignedString(sk)
+		require.NoError(t, err)
+		return str
+	}
+
+	// Key 0 is present in the scheme, so the JWKS is not fetched (and the signature is invalid)
+	_, err = jwt.Parse(sign("0"), conf.KeyshareServerKeyFunc(schemeid))
+	require.Error(t, err)
+	require.Equal(t, int32(0), fetched.Load())
+
+	// Key 5 is obtained from the JWKS, and cached afterwards
+	_, err = jwt.Parse(sign("5"), conf.KeyshareServerKeyFunc(schemeid))
+	require.NoError(t, err)
+	_, err = jwt.Parse(sign("5"), conf.KeyshareServerKeyFunc(schemeid))
+	require.NoError(t, err)
+	require.Equal(t, int32(1), fetched.Load())
+
+	// Unknown keys do not cause the JWKS to be fetched again immediately
+	_, err = jwt.Parse(sign("6"), conf.KeyshareServerKeyFunc(schemeid))
+	require.Error(t, err)
+	require.Equal(t, int32(1), fetched.Load())
+
+	// Without the option, the JWKS is not used
+	conf = parseConfiguration(t)
+	conf.SchemeManagers[schemeid].KeyshareServer = ts.URL
+	_, err = jwt.Parse(sign("5"), conf.KeyshareServerKeyFunc(schemeid))
+	require.Error(t, err)
+	require.Equal(t, int32(1), fetched.Load())
+}
+
+func TestKeysharePinStatus(t *testing.T) {
+	var status KeysharePinStatus
+	bts, err := json.Marshal(NewKeysharePinFailure(2))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(bts, &status))
+	attempts, err := status.RemainingAttempts()
+	require.NoError(t, err)
+	require.Equal(t, 2, attempts)
+
+	status = KeysharePinStatus{}
+	bts, err = json.Marshal(NewKeysharePinBlocked(300))
+	require.NoError(t, err)
+	require.NoError(t, json.Unmarshal(bts, &status))
+	duration, err := status.BlockedDuration()
+	require.NoError(t, err)
+	require.Equal(t, 300, duration)
+
+	// Keyshare servers that only send the message
+	status = KeysharePinStatus{}
+	require.NoError(t, json.Unmarshal([]byte(`{"status":"failure","message":"1"}`), &status))
+	attempts, err = status.RemainingAttempts()
+	require.NoError(t, err)
+	require.Equal(t, 1, attempts)
+	status = KeysharePinStatus{}
+	require.NoError(t, json.Unmarshal([]byte(`{"status":"error","message":"60"}`), &status))
+	duration, err = status.BlockedDuration()
+	require.NoError(t, err)
+	require.Equal(t, 60, duration)
+}
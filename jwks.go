@@ -0,0 +1,171 @@
+package irma
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"math/big"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
+)
+
+// KeyshareJWKSPath is the path, relative to the URL of the keyshare server of a scheme, at which
+// the keyshare server publishes the public keys with which it signs its JWTs.
+const KeyshareJWKSPath = "/.well-known/jwks.json"
+
+// Keyshare server JWKS are fetched at most this often, to prevent JWTs with unknown key IDs
+// from causing a request to the keyshare server for each JWT.
+const keyshareJWKSMinInterval = time.Minute
+
+// JWKS is a JSON Web Key Set (RFC 7517).
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK is a JSON Web Key (RFC 7517). Only RSA public keys are supported.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Use string `json:"use,omitempty"`
+	Alg string `json:"alg,omitempty"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+}
+
+// NewRSAJWK returns a JWK containing the RSA public key, for verifying RS256 signatures.
+func NewRSAJWK(kid uint32, pk *rsa.PublicKey) JWK {
+	return JWK{
+		Kty: "RSA",
+		Kid: strconv.FormatUint(uint64(kid), 10),
+		Use: "sig",
+		Alg: "RS256",
+		N:   base64.RawURLEncoding.EncodeToString(pk.N.Bytes()),
+		E:   base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pk.E)).Bytes()),
+	}
+}
+
+// RSAPublicKey returns the RSA public key contained in the JWK.
+func (k JWK) RSAPublicKey() (*rsa.PublicKey, error) {
+	if k.Kty != "RSA" {
+		return nil, errors.Errorf("unsupported JWK key type %s", k.Kty)
+	}
+	n, err := base64.RawURLEncoding.DecodeString(k.N)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "invalid JWK modulus", 0)
+	}
+	e, err := base64.RawURLEncoding.DecodeString(k.E)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "invalid JWK exponent", 0)
+	}
+	exponent := new(big.Int).SetBytes(e)
+	if !exponent.IsInt64() || exponent.Int64() < 3 || exponent.Int64() > 1<<31-1 {
+		return nil, errors.New("invalid JWK exponent")
+	}
+	return &rsa.PublicKey{N: new(big.Int).SetBytes(n), E: int(exponent.Int64())}, nil
+}
+
+// signingMethodRS256Signer is the RS256 JWT signing method for keys implementing crypto.Signer,
+// whose private key need not be available to us. Signatures are verified like those of RS256.
+type signingMethodRS256Signer struct{}
+
+func (signingMethodRS256Signer) Alg() string {
+	return jwt.SigningMethodRS256.Alg()
+}
+
+func (signingMethodRS256Signer) Verify(signingString, signature string, key interface{}) error {
+	return jwt.SigningMethodRS256.Verify(signingString, signature, key)
+}
+
+func (signingMethodRS256Signer) Sign(signingString string, key interface{}) (string, error) {
+	signer, ok := key.(crypto.Signer)
+	if !ok {
+		return "", jwt.ErrInvalidKeyType
+	}
+	digest := sha256.Sum256([]byte(signingString))
+	sig, err := signer.Sign(rand.Reader, digest[:], crypto.SHA256)
+	if err != nil {
+		return "", err
+	}
+	return jwt.EncodeSegment(sig), nil
+}
+
+// SignJwt returns a JWT containing the claims, signed using RS256 by the signer. The signer is either
+// an *rsa.PrivateKey, or a signer whose RSA private key is kept elsewhere, e.g. in a key management
+// service.
+func SignJwt(claims jwt.Claims, signer crypto.Signer) (string, error) {
+	return SignJwtWithKeyID(claims, signer, "")
+}
+
+// SignJwtWithKeyID is like SignJwt, but includes the specified key ID in the kid header of the
+// JWT, if it is not empty.
+func SignJwtWithKeyID(claims jwt.Claims, signer crypto.Signer, kid string) (string, error) {
+	if _, ok := signer.Public().(*rsa.PublicKey); !ok {
+		return "", errors.New("JWT signer does not have an RSA key")
+	}
+	token := jwt.NewWithClaims(signingMethodRS256Signer{}, claims)
+	if kid != "" {
+		token.Header["kid"] = kid
+	}
+	return token.SignedString(signer)
+}
+
+// keyshareJWKSPublicKey returns the public key with the given key ID from the JWKS published by
+// the keyshare server of the scheme. The JWKS is fetched anew if the key is not yet known and the
+// JWKS was not fetched recently, so that keyshare servers can rotate their keys.
+func (conf *Configuration) keyshareJWKSPublicKey(schemeid SchemeManagerIdentifier, kid int) (*rsa.PublicKey, error) {
+	id := kssKeyIdentifier{scheme: schemeid, kid: kid, jwks: true}
+	if pk := conf.kssPublicKeys.Get(id); pk != nil {
+		return pk, nil
+	}
+
+	conf.kssJWKSMutex.Lock()
+	defer conf.kssJWKSMutex.Unlock()
+	if pk := conf.kssPublicKeys.Get(id); pk != nil { // fetched while we were waiting for the lock
+		return pk, nil
+	}
+	if time.Since(conf.kssJWKSFetched[schemeid]) < keyshareJWKSMinInterval {
+		return nil, errors.Errorf("unknown keyshare server public key %d of scheme %s", kid, schemeid)
+	}
+
+	scheme := conf.SchemeManagers[schemeid]
+	if scheme == nil || scheme.KeyshareServer == "" {
+		return nil, errors.Errorf("scheme %s has no keyshare server", schemeid)
+	}
+	jwks := &JWKS{}
+	if err := conf.HTTPClient.NewTransport(scheme.KeyshareServer, true).Get(KeyshareJWKSPath[1:], jwks); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to fetch keyshare server JWKS", 0)
+	}
+	conf.kssJWKSFetched[schemeid] = time.Now()
+
+	// Replace the keys of the previous JWKS of this scheme, so that keys that the keyshare server
+	// no longer publishes are no longer accepted
+	conf.kssPublicKeys.DeleteIf(func(key kssKeyIdentifier, _ *rsa.PublicKey) bool {
+		return key.jwks && key.scheme == schemeid
+	})
+	for _, jwk := range jwks.Keys {
+		if jwk.Use != "" && jwk.Use != "sig" {
+			continue
+		}
+		keyid, err := strconv.Atoi(jwk.Kid)
+		if err != nil {
+			Logger.WithField("scheme", schemeid).Warn("Ignoring keyshare server JWK with non-numeric key ID ", jwk.Kid)
+			continue
+		}
+		pk, err := jwk.RSAPublicKey()
+		if err != nil {
+			Logger.WithField("scheme", schemeid).Warn("Ignoring invalid keyshare server JWK: ", err)
+			continue
+		}
+		conf.kssPublicKeys.Set(kssKeyIdentifier{scheme: schemeid, kid: keyid, jwks: true}, pk)
+	}
+
+	if pk := conf.kssPublicKeys.Get(id); pk != nil {
+		return pk, nil
+	}
+	return nil, errors.Errorf("unknown keyshare server public key %d of scheme %s", kid, schemeid)
+}
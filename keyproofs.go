@@ -0,0 +1,196 @@
+package irma
+
+import (
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/gabikeys"
+	"github.com/privacybydesign/gabi/keyproof"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrKeyproofMissing    = errors.New("keyproof missing")
+	ErrKeyproofInvalid    = errors.New("keyproof invalid")
+	ErrKeyproofUnverified = errors.New("keyproof not yet verified")
+)
+
+type keyproofCache struct {
+	sync.Mutex
+	verified map[string]error
+	// Keyproofs being verified in the background by VerifiedIssuerKeyproofs()
+	verifying map[string]bool
+}
+
+// KeyproofStructure returns the structure of the keyproof of the specified public key.
+func KeyproofStructure(pk *gabikeys.PublicKey) keyproof.ValidKeyProofStructure {
+	bases := []*big.Int{pk.Z, pk.S}
+	if pk.G != nil {
+		bases = append(bases, pk.G)
+	}
+	if pk.H != nil {
+		bases = append(bases, pk.H)
+	}
+	return keyproof.NewValidKeyProofStructure(pk.N, append(bases, pk.R...))
+}
+
+// KeyproofPath returns the path of the keyproof of the specified public key: $counter.json.gz in
+// the Proofs folder of the issuer, as generated by "irma issuer keyprove".
+func (conf *Configuration) KeyproofPath(id PublicKeyIdentifier) (string, error) {
+	scheme := conf.SchemeManagers[id.Issuer.SchemeManagerIdentifier()]
+	if scheme == nil {
+		return "", errors.Errorf("unknown scheme %s", id.Issuer.SchemeManagerIdentifier())
+	}
+	return filepath.Join(scheme.path(), id.Issuer.Name(), "Proofs", strconv.Itoa(int(id.Counter))+".json.gz"), nil
+}
+
+// VerifyKeyproof verifies the keyproof of the specified public key, i.e. the zero-knowledge proof
+// that its keypair was generated correctly, returning an error wrapping ErrKeyproofMissing or
+// ErrKeyproofInvalid if it is absent or invalid. The result is cached while the public key and
+// keyproof files are unchanged.
+func (conf *Configuration) VerifyKeyproof(id PublicKeyIdentifier) error {
+	key, pk, path, err := conf.keyproofCacheKey(id)
+	if err != nil {
+		return err
+	}
+	if err, verified := conf.keyproofs.get(key); verified {
+		return err
+	}
+	return conf.verifyKeyproof(id, key, pk, path)
+}
+
+// verifyKeyproof verifies the keyproof and caches the result, without holding the lock of the cache
+// during the verification, which takes minutes.
+func (conf *Configuration) verifyKeyproof(id PublicKeyIdentifier, key string, pk *gabikeys.PublicKey, path string) error {
+	Logger.WithFields(logrus.Fields{"issuer": id.Issuer.String(), "counter": id.Counter}).Info("Verifying keyproof (may take several minutes)")
+	err := verifyKeyproofFile(pk, path)
+	if err != nil && !errors.Is(err, ErrKeyproofInvalid) {
+		return err // don't cache I/O errors
+	}
+	if err != nil {
+		err = fmt.Errorf("public key %s-%d: %w", id.Issuer, id.Counter, err)
+	}
+	conf.keyproofs.Lock()
+	defer conf.keyproofs.Unlock()
+	conf.keyproofs.verified[key] = err
+	return err
+}
+
+// keyproofCacheKey returns the key under which the verification result of the keyproof of the
+// public key is cached, which changes when the public key or keyproof file changes, along with the
+// public key and the path of the keyproof.
+func (conf *Configuration) keyproofCacheKey(id PublicKeyIdentifier) (string, *gabikeys.PublicKey, string, error) {
+	pk, err := conf.PublicKey(id.Issuer, id.Counter)
+	if err != nil {
+		return "", nil, "", err
+	}
+	if pk == nil {
+		return "", nil, "", errors.Errorf("unknown public key %s-%d", id.Issuer, id.Counter)
+	}
+	path, err := conf.KeyproofPath(id)
+	if err != nil {
+		return "", nil, "", err
+	}
+	stat, err := os.Stat(path)
+	if os.IsNotExist(err) {
+		return "", nil, "", fmt.Errorf("public key %s-%d: %w", id.Issuer, id.Counter, ErrKeyproofMissing)
+	}
+	if err != nil {
+		return "", nil, "", err
+	}
+	return fmt.Sprintf("%s:%d:%d:%s", path, stat.Size(), stat.ModTime().UnixNano(), pk.N.String()), pk, path, nil
+}
+
+func (c *keyproofCache) get(key string) (error, bool) {
+	c.Lock()
+	defer c.Unlock()
+	err, verified := c.verified[key]
+	return err, verified
+}
+
+// VerifyIssuerKeyproofs verifies the keyproofs of all public keys of the specified issuer.
+func (conf *Configuration) VerifyIssuerKeyproofs(id IssuerIdentifier) error {
+	indices, err := conf.PublicKeyIndices(id)
+	if err != nil {
+		return err
+	}
+	for _, counter := range indices {
+		if err = conf.VerifyKeyproof(PublicKeyIdentifier{Issuer: id, Counter: counter}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// VerifiedIssuerKeyproofs returns the cached results of verifying the keyproofs of all public keys
+// of the specified issuer, without verifying them itself. The keyproofs that have not been verified
+// yet (e.g. of public keys added by a scheme update) yield an error wrapping ErrKeyproofUnverified,
+// and are verified in the background, after which their result is returned.
+func (conf *Configuration) VerifiedIssuerKeyproofs(id IssuerIdentifier) error {
+	indices, err := conf.PublicKeyIndices(id)
+	if err != nil {
+		return err
+	}
+	for _, counter := range indices {
+		pkid := PublicKeyIdentifier{Issuer: id, Counter: counter}
+		key, pk, path, err := conf.keyproofCacheKey(pkid)
+		if err != nil {
+			return err
+		}
+		err, verified := conf.keyproofs.get(key)
+		if !verified {
+			conf.verifyKeyproofInBackground(pkid, key, pk, path)
+			return fmt.Errorf("public key %s-%d: %w", id, counter, ErrKeyproofUnverified)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (conf *Configuration) verifyKeyproofInBackground(id PublicKeyIdentifier, key string, pk *gabikeys.PublicKey, path string) {
+	conf.keyproofs.Lock()
+	defer conf.keyproofs.Unlock()
+	if conf.keyproofs.verifying[key] {
+		return
+	}
+	conf.keyproofs.verifying[key] = true
+	go func() {
+		if err := conf.verifyKeyproof(id, key, pk, path); err != nil && !errors.Is(err, ErrKeyproofInvalid) {
+			Logger.WithError(err).Warn("Failed to verify keyproof")
+		}
+		conf.keyproofs.Lock()
+		defer conf.keyproofs.Unlock()
+		delete(conf.keyproofs.verifying, key)
+	}()
+}
+
+func verifyKeyproofFile(pk *gabikeys.PublicKey, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = f.Close() }()
+	r, err := gzip.NewReader(f)
+	if err != nil {
+		return fmt.Errorf("%w: %s", ErrKeyproofInvalid, err)
+	}
+	defer func() { _ = r.Close() }()
+	var proof keyproof.ValidKeyProof
+	if err = json.NewDecoder(r).Decode(&proof); err != nil {
+		return fmt.Errorf("%w: %s", ErrKeyproofInvalid, err)
+	}
+	structure := KeyproofStructure(pk)
+	if !structure.VerifyProof(proof) {
+		return ErrKeyproofInvalid
+	}
+	return nil
+}
@@ -0,0 +1,76 @@
+package irma
+
+import (
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// SessionRequestLDContexts contains the JSON-LD contexts of the session requests.
+var SessionRequestLDContexts = []string{
+	LDContextDisclosureRequest,
+	LDContextSignatureRequest,
+	LDContextIssuanceRequest,
+}
+
+// ldContextVersions is the compatibility table of the JSON-LD contexts of the messages exchanged
+// between IRMA servers and apps: for each context, the range of protocol versions in which messages
+// having that context are used. A nil bound means the range is unbounded on that side. The empty
+// context is that of legacy messages, e.g. attribute-based signatures made before condiscon.
+// Contexts of messages that are not exchanged with apps, such as revocation requests, are not
+// bound to protocol versions.
+var ldContextVersions = map[string]struct{ min, max *ProtocolVersion }{
+	"":                            {max: NewVersion(2, 4)},
+	LDContextDisclosureRequest:    {min: NewVersion(2, 5)},
+	LDContextSignatureRequest:     {min: NewVersion(2, 5)},
+	LDContextIssuanceRequest:      {min: NewVersion(2, 5)},
+	LDContextSignedMessage:        {min: NewVersion(2, 5)},
+	LDContextClientSessionRequest: {min: NewVersion(2, 8)},
+	LDContextSessionOptions:       {min: NewVersion(2, 8)},
+}
+
+// LDContextError is returned when the JSON-LD context (the @context field) of a message does not
+// match the kind of message that was expected, or is not used in the protocol version of the
+// session in which the message was received.
+type LDContextError struct {
+	LDContext string
+	Expected  []string
+	// Protocol version of the session, set if the context was expected but is not used in it
+	ProtocolVersion *ProtocolVersion
+}
+
+func (e *LDContextError) Error() string {
+	if e.ProtocolVersion != nil {
+		return fmt.Sprintf("@context %q is not supported in protocol version %s", e.LDContext, e.ProtocolVersion)
+	}
+	expected := make([]string, len(e.Expected))
+	for i, ldContext := range e.Expected {
+		expected[i] = fmt.Sprintf("%q", ldContext)
+	}
+	return fmt.Sprintf("unexpected @context %q, expected %s", e.LDContext, strings.Join(expected, " or "))
+}
+
+// LDContextSupported returns whether messages having the specified JSON-LD context are used in
+// the specified protocol version.
+func LDContextSupported(ldContext string, version *ProtocolVersion) bool {
+	versions, ok := ldContextVersions[ldContext]
+	if !ok {
+		return true
+	}
+	if versions.min != nil && version.BelowVersion(versions.min) {
+		return false
+	}
+	return versions.max == nil || !version.AboveVersion(versions.max)
+}
+
+// ValidateLDContext returns an *LDContextError if ldContext is not one of the expected contexts,
+// or if version is not nil and the context is not used in that protocol version.
+func ValidateLDContext(ldContext string, version *ProtocolVersion, expected ...string) error {
+	if !slices.Contains(expected, ldContext) {
+		return &LDContextError{LDContext: ldContext, Expected: expected}
+	}
+	if version != nil && !LDContextSupported(ldContext, version) {
+		return &LDContextError{LDContext: ldContext, Expected: expected, ProtocolVersion: version}
+	}
+	return nil
+}
@@ -43,6 +43,10 @@ func (dr *LegacyDisclosureRequest) Identifiers() *IrmaIdentifierSet { panic("not
 func (dr *LegacyDisclosureRequest) Base() *BaseRequest              { return &dr.BaseRequest }
 func (dr *LegacyDisclosureRequest) Action() Action                  { return ActionDisclosing }
 func (dr *LegacyDisclosureRequest) Legacy() (SessionRequest, error) { return dr, nil }
+func (dr *LegacyDisclosureRequest) Equal(SessionRequest) bool       { panic("not implemented") }
+func (dr *LegacyDisclosureRequest) Diff(SessionRequest) []RequestDifference {
+	panic("not implemented")
+}
 
 type LegacySignatureRequest struct {
 	LegacyDisclosureRequest
@@ -63,6 +67,10 @@ func (ir *LegacyIssuanceRequest) Identifiers() *IrmaIdentifierSet { panic("not i
 func (ir *LegacyIssuanceRequest) Base() *BaseRequest              { return &ir.BaseRequest }
 func (ir *LegacyIssuanceRequest) Action() Action                  { return ActionIssuing }
 func (ir *LegacyIssuanceRequest) Legacy() (SessionRequest, error) { return ir, nil }
+func (ir *LegacyIssuanceRequest) Equal(SessionRequest) bool       { panic("not implemented") }
+func (ir *LegacyIssuanceRequest) Diff(SessionRequest) []RequestDifference {
+	panic("not implemented")
+}
 
 func convertConDisCon(cdc AttributeConDisCon, labels map[int]TranslatedString) ([]LegacyLabeledDisjunction, error) {
 	var disjunctions []LegacyLabeledDisjunction
@@ -171,7 +179,16 @@ func (dr *DisclosureRequest) Legacy() (SessionRequest, error) {
 	}, nil
 }
 
-func (dr *DisclosureRequest) UnmarshalJSON(bts []byte) (err error) {
+func (dr *DisclosureRequest) UnmarshalJSON(bts []byte) error {
+	return dr.unmarshalJSON(bts, false)
+}
+
+// UnmarshalJSONStrict is like UnmarshalJSON, but refuses unknown fields (except in legacy requests).
+func (dr *DisclosureRequest) UnmarshalJSONStrict(bts []byte) error {
+	return dr.unmarshalJSON(bts, true)
+}
+
+func (dr *DisclosureRequest) unmarshalJSON(bts []byte, strict bool) (err error) {
 	var ldContext string
 	if ldContext, err = common.ParseLDContext(bts); err != nil {
 		return err
@@ -180,7 +197,7 @@ func (dr *DisclosureRequest) UnmarshalJSON(bts []byte) (err error) {
 	if ldContext != "" {
 		type newDisclosureRequest DisclosureRequest // Same type with default JSON unmarshaler
 		var req newDisclosureRequest
-		if err = json.Unmarshal(bts, &req); err != nil {
+		if err = unmarshalJSON(bts, &req, strict); err != nil {
 			return err
 		}
 		*dr = DisclosureRequest(req)
@@ -218,7 +235,16 @@ func (sr *SignatureRequest) Legacy() (SessionRequest, error) {
 	}, nil
 }
 
-func (sr *SignatureRequest) UnmarshalJSON(bts []byte) (err error) {
+func (sr *SignatureRequest) UnmarshalJSON(bts []byte) error {
+	return sr.unmarshalJSON(bts, false)
+}
+
+// UnmarshalJSONStrict is like UnmarshalJSON, but refuses unknown fields (except in legacy requests).
+func (sr *SignatureRequest) UnmarshalJSONStrict(bts []byte) error {
+	return sr.unmarshalJSON(bts, true)
+}
+
+func (sr *SignatureRequest) unmarshalJSON(bts []byte, strict bool) (err error) {
 	var ldContext string
 	if ldContext, err = common.ParseLDContext(bts); err != nil {
 		return err
@@ -232,7 +258,7 @@ func (sr *SignatureRequest) UnmarshalJSON(bts []byte) (err error) {
 			SkipExpiryCheck []CredentialTypeIdentifier `json:"skipExpiryCheck,omitempty"`
 			Message         string                     `json:"message"`
 		}
-		if err = json.Unmarshal(bts, &req); err != nil {
+		if err = unmarshalJSON(bts, &req, strict); err != nil {
 			return err
 		}
 		*sr = SignatureRequest{
@@ -277,7 +303,16 @@ func (ir *IssuanceRequest) Legacy() (SessionRequest, error) {
 	}, nil
 }
 
-func (ir *IssuanceRequest) UnmarshalJSON(bts []byte) (err error) {
+func (ir *IssuanceRequest) UnmarshalJSON(bts []byte) error {
+	return ir.unmarshalJSON(bts, false)
+}
+
+// UnmarshalJSONStrict is like UnmarshalJSON, but refuses unknown fields (except in legacy requests).
+func (ir *IssuanceRequest) UnmarshalJSONStrict(bts []byte) error {
+	return ir.unmarshalJSON(bts, true)
+}
+
+func (ir *IssuanceRequest) unmarshalJSON(bts []byte, strict bool) (err error) {
 	var ldContext string
 	if ldContext, err = common.ParseLDContext(bts); err != nil {
 		return err
@@ -291,7 +326,7 @@ func (ir *IssuanceRequest) UnmarshalJSON(bts []byte) (err error) {
 			SkipExpiryCheck []CredentialTypeIdentifier `json:"skipExpiryCheck,omitempty"`
 			Credentials     []*CredentialRequest       `json:"credentials"`
 		}
-		if err = json.Unmarshal(bts, &req); err != nil {
+		if err = unmarshalJSON(bts, &req, strict); err != nil {
 			return err
 		}
 		*ir = IssuanceRequest{
@@ -0,0 +1,429 @@
+package irma
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/x509"
+	"math/big"
+	"time"
+
+	"github.com/fxamacker/cbor"
+	"github.com/go-errors/errors"
+)
+
+const (
+	MdocVersion = "1.0"
+	// MdocContentType is the content type of mdoc requests and responses in IRMA sessions
+	MdocContentType = "application/cbor"
+	// MdocDocTypeMDL is the document type of mobile driving licences
+	MdocDocTypeMDL = "org.iso.18013.5.1.mDL"
+)
+
+// COSE header parameters, algorithms and key parameters (RFC 9052 and 9053) used by mdocs
+const (
+	coseHeaderAlg     = 1
+	coseHeaderX5Chain = 33
+	coseAlgES256      = -7
+	coseAlgES384      = -35
+	coseAlgES512      = -36
+	coseKeyKty        = 1
+	coseKeyCrv        = -1
+	coseKeyX          = -2
+	coseKeyY          = -3
+	coseKtyEC2        = 2
+)
+
+var (
+	coseCurves = map[int64]elliptic.Curve{1: elliptic.P256(), 2: elliptic.P384(), 3: elliptic.P521()}
+	coseAlgs   = map[int64]struct {
+		hash  crypto.Hash
+		curve elliptic.Curve
+	}{
+		coseAlgES256: {crypto.SHA256, elliptic.P256()},
+		coseAlgES384: {crypto.SHA384, elliptic.P384()},
+		coseAlgES512: {crypto.SHA512, elliptic.P521()},
+	}
+	mdocDigestAlgorithms = map[string]crypto.Hash{"SHA-256": crypto.SHA256, "SHA-384": crypto.SHA384, "SHA-512": crypto.SHA512}
+)
+
+type (
+	// MdocDeviceRequest requests data elements of one or more mdocs from their holder (ISO/IEC 18013-5),
+	// so that attributes can be disclosed using an mdoc such as a driving licence instead of an
+	// Idemix credential.
+	MdocDeviceRequest struct {
+		Version     string            `cbor:"version"`
+		DocRequests []*MdocDocRequest `cbor:"docRequests"`
+	}
+
+	MdocDocRequest struct {
+		// ItemsRequestBytes: MdocItemsRequest as embedded CBOR data item
+		ItemsRequest cbor.RawMessage `cbor:"itemsRequest"`
+	}
+
+	// MdocItemsRequest requests data elements of an mdoc of the specified type. Per namespace it
+	// contains the identifiers of the requested data elements, along with whether the verifier
+	// intends to retain their values.
+	MdocItemsRequest struct {
+		DocType    string                     `cbor:"docType"`
+		NameSpaces map[string]map[string]bool `cbor:"nameSpaces"`
+	}
+
+	// MdocDeviceResponse contains the mdocs that the holder presents in response to an MdocDeviceRequest.
+	MdocDeviceResponse struct {
+		Version   string          `cbor:"version"`
+		Documents []*MdocDocument `cbor:"documents,omitempty"`
+		Status    uint            `cbor:"status"`
+	}
+
+	MdocDocument struct {
+		DocType      string           `cbor:"docType"`
+		IssuerSigned MdocIssuerSigned `cbor:"issuerSigned"`
+		DeviceSigned MdocDeviceSigned `cbor:"deviceSigned"`
+	}
+
+	MdocIssuerSigned struct {
+		// Per namespace the IssuerSignedItemBytes of the disclosed data elements: MdocIssuerSignedItem
+		// as embedded CBOR data item
+		NameSpaces map[string][]cbor.RawMessage `cbor:"nameSpaces,omitempty"`
+		// Signature of the issuer over the MobileSecurityObject
+		IssuerAuth CoseSign1 `cbor:"issuerAuth"`
+	}
+
+	MdocDeviceSigned struct {
+		// DeviceNameSpacesBytes: the data elements returned by the device, as embedded CBOR data item
+		NameSpaces cbor.RawMessage `cbor:"nameSpaces"`
+		DeviceAuth MdocDeviceAuth  `cbor:"deviceAuth"`
+	}
+
+	// MdocDeviceAuth contains the signature or MAC of the device over its DeviceAuthenticationBytes.
+	// Only signatures are supported, as device MACs require an ephemeral key of the reader.
+	MdocDeviceAuth struct {
+		DeviceSignature *CoseSign1      `cbor:"deviceSignature,omitempty"`
+		DeviceMac       cbor.RawMessage `cbor:"deviceMac,omitempty"`
+	}
+
+	MdocIssuerSignedItem struct {
+		DigestID          uint        `cbor:"digestID"`
+		Random            []byte      `cbor:"random"`
+		ElementIdentifier string      `cbor:"elementIdentifier"`
+		ElementValue      interface{} `cbor:"elementValue"`
+	}
+
+	// MobileSecurityObject is signed by the issuer of an mdoc, and contains per namespace the digests
+	// of the data elements of the mdoc, and the public key of the device holding it.
+	MobileSecurityObject struct {
+		Version         string                     `cbor:"version"`
+		DigestAlgorithm string                     `cbor:"digestAlgorithm"`
+		ValueDigests    map[string]map[uint][]byte `cbor:"valueDigests"`
+		DeviceKeyInfo   MdocDeviceKeyInfo          `cbor:"deviceKeyInfo"`
+		DocType         string                     `cbor:"docType"`
+		ValidityInfo    MdocValidityInfo           `cbor:"validityInfo"`
+	}
+
+	MdocDeviceKeyInfo struct {
+		DeviceKey map[int]cbor.RawMessage `cbor:"deviceKey"` // COSE_Key
+	}
+
+	// MdocValidityInfo contains the times (in RFC 3339 format) at which an mdoc was signed,
+	// and from and until which it is valid.
+	MdocValidityInfo struct {
+		Signed     string `cbor:"signed"`
+		ValidFrom  string `cbor:"validFrom"`
+		ValidUntil string `cbor:"validUntil"`
+	}
+
+	// CoseSign1 is a COSE_Sign1 structure (RFC 9052).
+	CoseSign1 struct {
+		_           struct{} `cbor:",toarray"`
+		Protected   []byte
+		Unprotected map[int]cbor.RawMessage
+		Payload     []byte // nil if detached
+		Signature   []byte
+	}
+
+	// MdocVerifiedDocument is a document of which the presentation has been verified by
+	// MdocDeviceResponse.Verify(), containing the disclosed data elements per namespace.
+	MdocVerifiedDocument struct {
+		DocType    string
+		Issuer     *x509.Certificate // certificate of the document signer
+		Signed     time.Time
+		ValidUntil time.Time
+		Elements   map[string]map[string]interface{}
+	}
+)
+
+// MdocEmbeddedCBOR returns the encoding of v as embedded CBOR data item, i.e. as byte string
+// tagged with 24.
+func MdocEmbeddedCBOR(v interface{}) (cbor.RawMessage, error) {
+	bts, err := cbor.Marshal(v, cbor.EncOptions{})
+	if err != nil {
+		return nil, err
+	}
+	if bts, err = cbor.Marshal(bts, cbor.EncOptions{}); err != nil {
+		return nil, err
+	}
+	return append([]byte{0xd8, 0x18}, bts...), nil
+}
+
+// NewMdocDeviceRequest returns a device request for the specified data elements.
+func NewMdocDeviceRequest(items ...*MdocItemsRequest) (*MdocDeviceRequest, error) {
+	request := &MdocDeviceRequest{Version: MdocVersion, DocRequests: []*MdocDocRequest{}}
+	for _, item := range items {
+		bts, err := MdocEmbeddedCBOR(item)
+		if err != nil {
+			return nil, err
+		}
+		request.DocRequests = append(request.DocRequests, &MdocDocRequest{ItemsRequest: bts})
+	}
+	return request, nil
+}
+
+// MdocSessionTranscript returns the SessionTranscript of the IRMA session with the specified client
+// token (the last path segment of the session URL), consisting of the handover ["IRMA", token] and
+// no device engagement or reader key. As the client token is random and unique to the session, it
+// serves as the nonce that prevents device responses from being replayed in other sessions.
+func MdocSessionTranscript(token ClientToken) ([]byte, error) {
+	return cbor.Marshal([]interface{}{nil, nil, []interface{}{"IRMA", string(token)}}, cbor.EncOptions{})
+}
+
+// MdocDeviceAuthenticationBytes returns the DeviceAuthenticationBytes over which the device signs
+// in the specified session transcript.
+func MdocDeviceAuthenticationBytes(transcript []byte, docType string, deviceNameSpaces cbor.RawMessage) ([]byte, error) {
+	return MdocEmbeddedCBOR([]interface{}{"DeviceAuthentication", cbor.RawMessage(transcript), docType, deviceNameSpaces})
+}
+
+// Verify verifies the documents of the device response: the issuer signatures against the
+// specified trusted root certificates (of the issuing authorities), the digests of the disclosed
+// data elements, the validity of the documents at the specified time, and the device signatures
+// over the specified session transcript.
+func (resp *MdocDeviceResponse) Verify(roots *x509.CertPool, transcript []byte, now time.Time) ([]*MdocVerifiedDocument, error) {
+	if resp.Version != MdocVersion {
+		return nil, errors.Errorf("unsupported device response version %s", resp.Version)
+	}
+	if resp.Status != 0 {
+		return nil, errors.Errorf("device response has error status %d", resp.Status)
+	}
+	docs := make([]*MdocVerifiedDocument, 0, len(resp.Documents))
+	for _, doc := range resp.Documents {
+		verified, err := doc.verify(roots, transcript, now)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "invalid document of type "+doc.DocType, 0)
+		}
+		docs = append(docs, verified)
+	}
+	return docs, nil
+}
+
+func (doc *MdocDocument) verify(roots *x509.CertPool, transcript []byte, now time.Time) (*MdocVerifiedDocument, error) {
+	// Verify the issuer signature over the mobile security object
+	issuerAuth := &doc.IssuerSigned.IssuerAuth
+	cert, err := issuerAuth.certificate(roots, now)
+	if err != nil {
+		return nil, err
+	}
+	if err = issuerAuth.Verify(cert.PublicKey, nil); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid issuer signature", 0)
+	}
+	var msobts []byte
+	if err = cbor.Unmarshal(issuerAuth.Payload, &msobts); err != nil {
+		return nil, err
+	}
+	mso := &MobileSecurityObject{}
+	if err = cbor.Unmarshal(msobts, mso); err != nil {
+		return nil, err
+	}
+	if mso.DocType != doc.DocType {
+		return nil, errors.New("document type does not match mobile security object")
+	}
+
+	verified := &MdocVerifiedDocument{DocType: doc.DocType, Issuer: cert, Elements: map[string]map[string]interface{}{}}
+	var validFrom time.Time
+	if verified.Signed, err = time.Parse(time.RFC3339, mso.ValidityInfo.Signed); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid validity info", 0)
+	}
+	if validFrom, err = time.Parse(time.RFC3339, mso.ValidityInfo.ValidFrom); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid validity info", 0)
+	}
+	if verified.ValidUntil, err = time.Parse(time.RFC3339, mso.ValidityInfo.ValidUntil); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid validity info", 0)
+	}
+	if now.Before(validFrom) || now.After(verified.ValidUntil) {
+		return nil, errors.New("document is not valid")
+	}
+
+	// Check the disclosed data elements against their digests in the mobile security object
+	hash, ok := mdocDigestAlgorithms[mso.DigestAlgorithm]
+	if !ok {
+		return nil, errors.Errorf("unsupported digest algorithm %s", mso.DigestAlgorithm)
+	}
+	for ns, items := range doc.IssuerSigned.NameSpaces {
+		verified.Elements[ns] = map[string]interface{}{}
+		for _, itembts := range items {
+			var bts []byte
+			if err = cbor.Unmarshal(itembts, &bts); err != nil {
+				return nil, err
+			}
+			item := &MdocIssuerSignedItem{}
+			if err = cbor.Unmarshal(bts, item); err != nil {
+				return nil, err
+			}
+			h := hash.New()
+			h.Write(itembts)
+			digest, ok := mso.ValueDigests[ns][item.DigestID]
+			if !ok || !bytes.Equal(digest, h.Sum(nil)) {
+				return nil, errors.Errorf("digest of data element %s of namespace %s does not match", item.ElementIdentifier, ns)
+			}
+			verified.Elements[ns][item.ElementIdentifier] = item.ElementValue
+		}
+	}
+
+	// Verify the device signature, which binds the presentation to the session
+	sig := doc.DeviceSigned.DeviceAuth.DeviceSignature
+	if sig == nil {
+		return nil, errors.New("device response contains no device signature")
+	}
+	devicekey, err := coseKey(mso.DeviceKeyInfo.DeviceKey)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "invalid device key", 0)
+	}
+	payload, err := MdocDeviceAuthenticationBytes(transcript, doc.DocType, doc.DeviceSigned.NameSpaces)
+	if err != nil {
+		return nil, err
+	}
+	if err = sig.Verify(devicekey, payload); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid device signature", 0)
+	}
+
+	return verified, nil
+}
+
+// ToBeSigned returns the Sig_structure over which the signature is computed, with the specified
+// payload if it is detached from the structure.
+func (s *CoseSign1) ToBeSigned(detached []byte) ([]byte, error) {
+	payload := s.Payload
+	if detached != nil {
+		if payload != nil {
+			return nil, errors.New("COSE_Sign1 has both payload and detached payload")
+		}
+		payload = detached
+	}
+	if payload == nil {
+		return nil, errors.New("COSE_Sign1 has no payload")
+	}
+	return cbor.Marshal([]interface{}{"Signature1", s.Protected, []byte{}, payload}, cbor.EncOptions{})
+}
+
+// Verify verifies the ECDSA signature with the specified public key, with the specified payload if
+// it is detached from the structure.
+func (s *CoseSign1) Verify(pk crypto.PublicKey, detached []byte) error {
+	var protected map[int]interface{}
+	if err := cbor.Unmarshal(s.Protected, &protected); err != nil {
+		return err
+	}
+	alg, ok := protected[coseHeaderAlg].(int64)
+	if !ok {
+		return errors.New("missing or unsupported signature algorithm")
+	}
+	params, ok := coseAlgs[alg]
+	if !ok {
+		return errors.Errorf("unsupported signature algorithm %d", alg)
+	}
+	key, ok := pk.(*ecdsa.PublicKey)
+	if !ok || key.Curve != params.curve {
+		return errors.New("public key does not match signature algorithm")
+	}
+	size := (params.curve.Params().BitSize + 7) / 8
+	if len(s.Signature) != 2*size {
+		return errors.New("invalid signature length")
+	}
+
+	tbs, err := s.ToBeSigned(detached)
+	if err != nil {
+		return err
+	}
+	h := params.hash.New()
+	h.Write(tbs)
+	r, ss := new(big.Int).SetBytes(s.Signature[:size]), new(big.Int).SetBytes(s.Signature[size:])
+	if !ecdsa.Verify(key, h.Sum(nil), r, ss) {
+		return errors.New("signature does not verify")
+	}
+	return nil
+}
+
+// certificate returns the leaf certificate of the x5chain header, after verifying the chain
+// against the specified roots.
+func (s *CoseSign1) certificate(roots *x509.CertPool, now time.Time) (*x509.Certificate, error) {
+	raw, ok := s.Unprotected[coseHeaderX5Chain]
+	if !ok || len(raw) == 0 {
+		return nil, errors.New("issuer signature contains no certificate")
+	}
+	// x5chain is either a single certificate, or an array of certificates starting with the leaf
+	var chain [][]byte
+	var err error
+	if raw[0]>>5 == 2 { // major type byte string
+		chain = make([][]byte, 1)
+		err = cbor.Unmarshal(raw, &chain[0])
+	} else {
+		err = cbor.Unmarshal(raw, &chain)
+	}
+	if err != nil || len(chain) == 0 {
+		return nil, errors.New("invalid certificate chain")
+	}
+
+	certs := make([]*x509.Certificate, len(chain))
+	intermediates := x509.NewCertPool()
+	for i, bts := range chain {
+		if certs[i], err = x509.ParseCertificate(bts); err != nil {
+			return nil, err
+		}
+		if i > 0 {
+			intermediates.AddCert(certs[i])
+		}
+	}
+	if _, err = certs[0].Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		CurrentTime:   now,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageAny},
+	}); err != nil {
+		return nil, errors.WrapPrefix(err, "untrusted issuer certificate", 0)
+	}
+	return certs[0], nil
+}
+
+// coseKey returns the elliptic curve public key contained in the COSE_Key.
+func coseKey(key map[int]cbor.RawMessage) (*ecdsa.PublicKey, error) {
+	var kty, crv int64
+	var x, y []byte
+	for label, dst := range map[int]interface{}{coseKeyKty: &kty, coseKeyCrv: &crv, coseKeyX: &x, coseKeyY: &y} {
+		if err := cbor.Unmarshal(key[label], dst); err != nil {
+			return nil, err
+		}
+	}
+	curve, ok := coseCurves[crv]
+	if kty != coseKtyEC2 || !ok {
+		return nil, errors.New("unsupported key type")
+	}
+	size := (curve.Params().BitSize + 7) / 8
+	if len(x) != size || len(y) != size {
+		return nil, errors.New("invalid key coordinates")
+	}
+	// Check that the point is on the curve
+	point := append(append([]byte{4}, x...), y...)
+	var err error
+	switch curve {
+	case elliptic.P256():
+		_, err = ecdh.P256().NewPublicKey(point)
+	case elliptic.P384():
+		_, err = ecdh.P384().NewPublicKey(point)
+	default:
+		_, err = ecdh.P521().NewPublicKey(point)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &ecdsa.PublicKey{Curve: curve, X: new(big.Int).SetBytes(x), Y: new(big.Int).SetBytes(y)}, nil
+}
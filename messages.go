@@ -2,12 +2,21 @@ package irma
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/privacybydesign/gabi/big"
+	"io"
+	"net"
 	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/privacybydesign/irmago/internal/common"
 
@@ -29,6 +38,17 @@ const (
 	MinVersionHeader    = "X-IRMA-MinProtocolVersion"
 	MaxVersionHeader    = "X-IRMA-MaxProtocolVersion"
 	AuthorizationHeader = "Authorization"
+
+	// AuthorizationRotationHeader is sent by IRMA apps that support rotation of their authorization:
+	// the server then includes in each response to an authorized request the NextAuthorizationHeader,
+	// containing the authorization that the app must use in its next request, so that the
+	// authorization header of a single leaked request cannot be used to take over the session.
+	AuthorizationRotationHeader = "X-IRMA-Authorization-Rotation"
+	NextAuthorizationHeader     = "X-IRMA-Next-Authorization"
+
+	// TLSBindingHeader is sent by IRMA apps that connect over TLS directly to the IRMA server, from
+	// protocol version 2.9. It binds the authorization to a key of the app, see TLSBinding().
+	TLSBindingHeader = "X-IRMA-TLS-Binding"
 )
 
 // ProtocolVersion encodes the IRMA protocol version of an IRMA session.
@@ -122,8 +142,88 @@ type RemoteError struct {
 	Description string `json:"description,omitempty"`
 	Message     string `json:"message,omitempty"`
 	Stacktrace  string `json:"stacktrace,omitempty"`
+	// Stable, machine-readable identifier of the error, see the ErrorCode constants
+	Code RemoteErrorCode `json:"code,omitempty"`
+	// ID of the request that caused the error, with which it can be found in the server logs
+	CorrelationID string `json:"correlationId,omitempty"`
+	// If the requestor is not permitted to start the session, what exactly it is not permitted to do
+	PermissionDenials []*PermissionDenial `json:"permissionDenials,omitempty"`
+}
+
+// PermissionDenial specifies an attribute or credential type, or a host, which a requestor is not
+// permitted to use in a session request, and the permissions that were checked.
+type PermissionDenial struct {
+	// Identifier of the attribute or credential type, or the host
+	Identifier string `json:"identifier"`
+	// Name of the permissions in the server configuration, e.g. issue_perms
+	Permission string                 `json:"permission"`
+	Reason     PermissionDenialReason `json:"reason"`
+}
+
+// PermissionDenialReason specifies why the permissions of a requestor do not permit something.
+type PermissionDenialReason string
+
+const (
+	// The requestor has no permissions of this kind at all
+	PermissionDenialNoPermissions = PermissionDenialReason("NO_PERMISSIONS")
+	// None of the permissions of this kind of the requestor matches
+	PermissionDenialNotPermitted = PermissionDenialReason("NOT_PERMITTED")
+)
+
+func (d *PermissionDenial) String() string {
+	return fmt.Sprintf("%s (%s: %s)", d.Identifier, d.Permission, d.Reason)
 }
 
+// RemoteErrorCode is a stable, machine-readable identifier of an error returned by the API server.
+// Contrary to the error name and description, the codes are unique per error and do not change,
+// so clients should use them to distinguish errors.
+type RemoteErrorCode string
+
+// Error codes of the errors returned by the IRMA server and the keyshare server.
+const (
+	ErrorCodeInvalidTimestamp          = RemoteErrorCode("invalidTimestamp")
+	ErrorCodeIssuingDisabled           = RemoteErrorCode("issuingDisabled")
+	ErrorCodeMalformedVerifierRequest  = RemoteErrorCode("malformedVerifierRequest")
+	ErrorCodeMalformedSignatureRequest = RemoteErrorCode("malformedSignatureRequest")
+	ErrorCodeMalformedIssuerRequest    = RemoteErrorCode("malformedIssuerRequest")
+	ErrorCodeUnauthorized              = RemoteErrorCode("unauthorized")
+	ErrorCodeAttributesWrong           = RemoteErrorCode("attributesWrong")
+	ErrorCodeCannotIssue               = RemoteErrorCode("cannotIssue")
+	ErrorCodeIrmaUnauthorized          = RemoteErrorCode("sessionUnauthorized")
+	ErrorCodePairingRequired           = RemoteErrorCode("pairingRequired")
+	ErrorCodeIssuanceFailed            = RemoteErrorCode("issuanceFailed")
+	ErrorCodeInvalidProofs             = RemoteErrorCode("invalidProofs")
+	ErrorCodeAttributesMissing         = RemoteErrorCode("attributesMissing")
+	ErrorCodeAttributesExpired         = RemoteErrorCode("attributesExpired")
+	ErrorCodeUnexpectedRequest         = RemoteErrorCode("unexpectedRequest")
+	ErrorCodeUnknownPublicKey          = RemoteErrorCode("unknownPublicKey")
+	ErrorCodeKeyshareProofMissing      = RemoteErrorCode("keyshareProofMissing")
+	ErrorCodeSessionUnknown            = RemoteErrorCode("sessionUnknown")
+	ErrorCodeMalformedInput            = RemoteErrorCode("malformedInput")
+	ErrorCodeUnknown                   = RemoteErrorCode("unknown")
+	ErrorCodeNextSession               = RemoteErrorCode("nextSession")
+	ErrorCodeRevocation                = RemoteErrorCode("revocation")
+	ErrorCodeUnknownRevocationKey      = RemoteErrorCode("unknownRevocationKey")
+	ErrorCodeUnsupported               = RemoteErrorCode("unsupported")
+	ErrorCodeInvalidRequest            = RemoteErrorCode("invalidRequest")
+	ErrorCodeProtocolVersion           = RemoteErrorCode("protocolVersion")
+	ErrorCodeInvalidToken              = RemoteErrorCode("invalidToken")
+	ErrorCodeInternal                  = RemoteErrorCode("internal")
+	ErrorCodeRevalidateEmail           = RemoteErrorCode("revalidateEmail")
+	ErrorCodeNotification              = RemoteErrorCode("notification")
+	ErrorCodeCallbackFailed            = RemoteErrorCode("callbackFailed")
+	ErrorCodeUserNotRegistered         = RemoteErrorCode("userNotRegistered")
+	ErrorCodeInvalidJWT                = RemoteErrorCode("invalidJwt")
+	ErrorCodeInvalidEmail              = RemoteErrorCode("invalidEmail")
+	ErrorCodeTooManyRequests           = RemoteErrorCode("tooManyRequests")
+	ErrorCodeUserChanged               = RemoteErrorCode("userChanged")
+	ErrorCodePanic                     = RemoteErrorCode("panic")
+	ErrorCodeSSEDisabled               = RemoteErrorCode("sseDisabled")
+	ErrorCodeNotFound                  = RemoteErrorCode("notFound")
+	ErrorCodeMethodNotAllowed          = RemoteErrorCode("methodNotAllowed")
+	ErrorCodeLDContext                 = RemoteErrorCode("invalidLdContext")
+)
+
 type Validator interface {
 	Validate() error
 }
@@ -140,6 +240,44 @@ func UnmarshalValidate(data []byte, dest interface{}) error {
 	return nil
 }
 
+// StrictUnmarshaler is implemented by types having a custom UnmarshalJSON method that
+// can also unmarshal strictly, i.e. refusing unknown fields.
+type StrictUnmarshaler interface {
+	UnmarshalJSONStrict(data []byte) error
+}
+
+// UnmarshalValidateStrict is like UnmarshalValidate, but returns an error if data contains
+// fields that dest does not have (see json.Decoder.DisallowUnknownFields()). Types having a
+// custom UnmarshalJSON method are parsed strictly only if they implement StrictUnmarshaler.
+func UnmarshalValidateStrict(data []byte, dest interface{}) error {
+	if err := unmarshalJSON(data, dest, true); err != nil {
+		return err
+	}
+	if v, ok := dest.(Validator); ok {
+		return v.Validate()
+	}
+	return nil
+}
+
+// unmarshalJSON is json.Unmarshal, refusing unknown fields if strict is true.
+func unmarshalJSON(data []byte, dest interface{}, strict bool) error {
+	if !strict {
+		return json.Unmarshal(data, dest)
+	}
+	if s, ok := dest.(StrictUnmarshaler); ok {
+		return s.UnmarshalJSONStrict(data)
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(dest); err != nil {
+		return err
+	}
+	if _, err := decoder.Token(); err != io.EOF {
+		return errors.New("invalid JSON: unexpected data after top-level value")
+	}
+	return nil
+}
+
 func UnmarshalValidateBinary(data []byte, dest interface{}) error {
 	if err := UnmarshalBinary(data, dest); err != nil {
 		return err
@@ -171,8 +309,27 @@ func (err *RemoteError) Error() string {
 type Qr struct {
 	// Server with which to perform the session
 	URL string `json:"u"`
+	// Optional alternative URLs of the same session, e.g. on other networks or IP versions, that the
+	// client can use if it cannot reach URL (see ReachableURL())
+	AlternativeURLs []string `json:"alt,omitempty"`
 	// Session type (disclosing, signing, issuing)
 	Type Action `json:"irmaqr"`
+	// Optional JWT over URL and Type, signed by the server (see Sign() and VerifySignature())
+	Signature string `json:"sig,omitempty"`
+	// Optional disclosure request of the session, included for offline sessions so that the
+	// disclosure proof can be computed before the client can reach the server
+	Request *DisclosureRequest `json:"request,omitempty"`
+}
+
+// QrClaims are the contents of the signature of a Qr.
+type QrClaims struct {
+	jwt.RegisteredClaims
+	URL  string `json:"u"`
+	Type Action `json:"irmaqr"`
+	// Hex-encoded SHA256 hash of the JSON of the request of the Qr, if present
+	RequestHash string `json:"rh,omitempty"`
+	// Alternative URLs of the Qr, if present
+	AlternativeURLs []string `json:"alt,omitempty"`
 }
 
 // RequestorToken identifies a session from the perspective of the requestor.
@@ -339,6 +496,18 @@ type KeyshareChangePinClaims struct {
 	KeyshareChangePinData
 }
 
+// KeyshareMigration contains the secrets of a keyshare server user, encrypted with a migration key
+// shared between the operators of the keyshare server the user migrates from and the one the user
+// migrates to. When importing it, the user authenticates with the (hashed) PIN, unless the operator
+// of the keyshare server imports it. The secrets can only be imported before Expiry (Unix timestamp).
+type KeyshareMigration struct {
+	Username string `json:"id"`
+	Language string `json:"language,omitempty"`
+	Secrets  []byte `json:"secrets"`
+	Expiry   int64  `json:"expiry"`
+	Pin      string `json:"pin,omitempty"`
+}
+
 type KeyshareAuthRequest struct {
 	AuthRequestJWT string `json:"auth_request_jwt"`
 }
@@ -351,6 +520,9 @@ type KeyshareAuthRequestClaims struct {
 type KeyshareAuthChallenge struct {
 	Candidates []string `json:"candidates,omitempty"`
 	Challenge  []byte   `json:"challenge"`
+	// Present if the keyshare secret of the user is split with a cosigner, which must then be
+	// authorized by signing this challenge (see KeyshareCosignerAuthClaims)
+	CosignerChallenge []byte `json:"cosigner_challenge,omitempty"`
 }
 
 type KeyshareAuthResponse struct {
@@ -362,6 +534,8 @@ type KeyshareAuthResponseData struct {
 	Username  string `json:"id"`
 	Pin       string `json:"pin"`
 	Challenge []byte `json:"challenge,omitempty"`
+	// JWT containing KeyshareCosignerAuthClaims, if the keyshare server sent a cosigner challenge
+	CosignerAuthJWT string `json:"cosigner_auth_jwt,omitempty"`
 }
 
 type KeyshareAuthResponseClaims struct {
@@ -369,9 +543,97 @@ type KeyshareAuthResponseClaims struct {
 	KeyshareAuthResponseData
 }
 
+// KeyshareCosignerAuthClaims authorize the cosigner of a keyshare server to contribute to the proofs
+// of the user. They are signed with the key of the user's device, which the cosigner knows, and
+// contain the challenge of the cosigner but not the PIN, so that the keyshare server (which forwards
+// them) cannot obtain contributions of the cosigner without the user.
+type KeyshareCosignerAuthClaims struct {
+	jwt.RegisteredClaims
+	Challenge []byte `json:"cosigner_challenge"`
+}
+
+// KeysharePinStatus is the response of the keyshare server to PIN verifications and PIN changes.
+// Its Status is one of "success", "failure" (incorrect PIN) or "error" (account blocked). Older
+// keyshare servers only include the number of remaining attempts or the lockout duration as a
+// string in Message; use RemainingAttempts() and BlockedDuration() to support both.
 type KeysharePinStatus struct {
 	Status  string `json:"status"`
 	Message string `json:"message"`
+	// Number of PIN attempts left before the account is blocked (status "failure")
+	Attempts int `json:"remaining_attempts,omitempty"`
+	// Number of seconds during which the account is blocked (status "error")
+	Blocked int64 `json:"blocked_duration,omitempty"`
+}
+
+// KeysharePinPolicy is the policy of a keyshare server for the PINs of new users and changed PINs,
+// which it publishes at client/pin_policy. As IRMA apps send only hashes of PINs to the keyshare
+// server, they enforce the policy themselves before registering and before changing the PIN.
+type KeysharePinPolicy struct {
+	MinLength int `json:"min_length"`
+	// Maximum length of PINs (0 meaning no maximum)
+	MaxLength int `json:"max_length,omitempty"`
+	// Minimum number of distinct characters in PINs
+	MinDistinctCharacters int `json:"min_distinct_chars,omitempty"`
+}
+
+// KeysharePinPolicyDefault is the PIN policy of keyshare servers that do not publish one.
+var KeysharePinPolicyDefault = KeysharePinPolicy{MinLength: 5}
+
+var (
+	ErrPinTooShort  = errors.New("PIN too short")
+	ErrPinTooLong   = errors.New("PIN too long")
+	ErrPinTooSimple = errors.New("PIN has too few distinct characters")
+)
+
+// Check returns an error if the PIN does not satisfy the policy.
+func (p KeysharePinPolicy) Check(pin string) error {
+	length := len([]rune(pin))
+	if length < p.MinLength {
+		return ErrPinTooShort
+	}
+	if p.MaxLength > 0 && length > p.MaxLength {
+		return ErrPinTooLong
+	}
+	distinct := map[rune]struct{}{}
+	for _, c := range pin {
+		distinct[c] = struct{}{}
+	}
+	if len(distinct) < p.MinDistinctCharacters {
+		return ErrPinTooSimple
+	}
+	return nil
+}
+
+const (
+	KeysharePinStatusSuccess = "success"
+	KeysharePinStatusFailure = "failure"
+	KeysharePinStatusError   = "error"
+)
+
+// NewKeysharePinFailure returns the status of an incorrect PIN, with the given number of attempts left.
+func NewKeysharePinFailure(attempts int) KeysharePinStatus {
+	return KeysharePinStatus{Status: KeysharePinStatusFailure, Message: strconv.Itoa(attempts), Attempts: attempts}
+}
+
+// NewKeysharePinBlocked returns the status of a blocked account, with the given lockout duration in seconds.
+func NewKeysharePinBlocked(duration int64) KeysharePinStatus {
+	return KeysharePinStatus{Status: KeysharePinStatusError, Message: strconv.FormatInt(duration, 10), Blocked: duration}
+}
+
+// RemainingAttempts returns the number of PIN attempts left of a "failure" status.
+func (status *KeysharePinStatus) RemainingAttempts() (int, error) {
+	if status.Attempts > 0 {
+		return status.Attempts, nil
+	}
+	return strconv.Atoi(status.Message)
+}
+
+// BlockedDuration returns the number of seconds during which the account is blocked of an "error" status.
+func (status *KeysharePinStatus) BlockedDuration() (int, error) {
+	if status.Blocked > 0 {
+		return int(status.Blocked), nil
+	}
+	return strconv.Atoi(status.Message)
 }
 
 const (
@@ -491,6 +753,11 @@ func (e *SessionError) WrappedError() string {
 	return e.Err.Error()
 }
 
+// Unwrap returns the wrapped error, so that it can be checked with errors.Is() and errors.As().
+func (e *SessionError) Unwrap() error {
+	return e.Err
+}
+
 func (e *SessionError) Stack() string {
 	if withStack, ok := e.Err.(*errors.Error); ok {
 		return string(withStack.Stack())
@@ -548,12 +815,333 @@ func (qr *Qr) Validate() (err error) {
 	if _, err = url.ParseRequestURI(qr.URL); err != nil {
 		return errors.Errorf("invalid URL: %s", err.Error())
 	}
+	for _, u := range qr.AlternativeURLs {
+		if _, err = url.ParseRequestURI(u); err != nil {
+			return errors.Errorf("invalid alternative URL: %s", err.Error())
+		}
+	}
 	if !qr.IsQr() {
 		return errors.New("unsupported session type")
 	}
+	if qr.Request != nil {
+		if qr.Type != ActionDisclosing {
+			return errors.New("session request can only be included in disclosure session pointers")
+		}
+		if err = qr.Request.Validate(); err != nil {
+			return errors.WrapPrefix(err, "invalid session request", 0)
+		}
+	}
+	return nil
+}
+
+// Sign sets the signature of the Qr to a JWT over its URL(s), type and request (if any), signed with the
+// specified key, allowing clients that know the corresponding public key to detect QRs that have been
+// tampered with. The key is either an *rsa.PrivateKey or another signer of an RSA key (see SignJwt()).
+func (qr *Qr) Sign(sk crypto.Signer) error {
+	hash, err := qr.requestHash()
+	if err != nil {
+		return err
+	}
+	claims := &QrClaims{
+		RegisteredClaims: jwt.RegisteredClaims{IssuedAt: jwt.NewNumericDate(time.Now())},
+		URL:              qr.URL,
+		Type:             qr.Type,
+		RequestHash:      hash,
+		AlternativeURLs:  qr.AlternativeURLs,
+	}
+	sig, err := SignJwt(claims, sk)
+	if err != nil {
+		return err
+	}
+	qr.Signature = sig
+	return nil
+}
+
+// VerifySignature checks that the Qr has a signature made with the private key corresponding to the
+// specified public key, and that the URL(s), type and request in the signature match those of the Qr.
+func (qr *Qr) VerifySignature(pk *rsa.PublicKey) error {
+	if qr.Signature == "" {
+		return errors.New("session pointer is not signed")
+	}
+	claims := &QrClaims{}
+	_, err := jwt.ParseWithClaims(qr.Signature, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return pk, nil
+	})
+	if err != nil {
+		return errors.WrapPrefix(err, "invalid session pointer signature", 0)
+	}
+	hash, err := qr.requestHash()
+	if err != nil {
+		return err
+	}
+	if claims.URL != qr.URL || claims.Type != qr.Type || claims.RequestHash != hash ||
+		!slices.Equal(claims.AlternativeURLs, qr.AlternativeURLs) {
+		return errors.New("session pointer does not match its signature")
+	}
 	return nil
 }
 
+func (qr *Qr) requestHash() (string, error) {
+	if qr.Request == nil {
+		return "", nil
+	}
+	bts, err := json.Marshal(qr.Request)
+	if err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(bts)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// ReachableURL returns the first of the URL and the alternative URLs of the Qr whose host accepts
+// TCP connections within the specified timeout, or the URL of the Qr if none of them do.
+func (qr *Qr) ReachableURL(timeout time.Duration) string {
+	if len(qr.AlternativeURLs) == 0 {
+		return qr.URL
+	}
+	urls := append([]string{qr.URL}, qr.AlternativeURLs...)
+	reachable := make([]chan bool, len(urls))
+	for i, u := range urls {
+		reachable[i] = make(chan bool, 1)
+		go func(u string, c chan<- bool) {
+			c <- urlReachable(u, timeout)
+		}(u, reachable[i])
+	}
+	for i, c := range reachable {
+		if <-c {
+			return urls[i]
+		}
+	}
+	return qr.URL
+}
+
+func urlReachable(u string, timeout time.Duration) bool {
+	parsed, err := url.ParseRequestURI(u)
+	if err != nil {
+		return false
+	}
+	port := parsed.Port()
+	if port == "" {
+		port = "80"
+		if parsed.Scheme == "https" {
+			port = "443"
+		}
+	}
+	conn, err := net.DialTimeout("tcp", net.JoinHostPort(parsed.Hostname(), port), timeout)
+	if err != nil {
+		return false
+	}
+	_ = conn.Close()
+	return true
+}
+
+// CompactQrPrefix is the prefix of compact session pointers (see MarshalCompact()).
+const CompactQrPrefix = "irmaqr:"
+
+// compactQr is the CBOR encoding of a compact session pointer.
+type compactQr struct {
+	_         struct{} `cbor:",toarray"`
+	URL       string
+	Type      Action
+	Request   *compactRequest
+	Signature [][]byte // Decoded header, claims and signature of the JWT
+}
+
+// compactRequest is the CBOR encoding of the disclosure request of a compact session pointer,
+// using integer keys and binary nonces. As the signature of the session pointer hashes the JSON
+// of the request, the request must be restored exactly from its compact encoding.
+type compactRequest struct {
+	LDContext        string                        `cbor:"1,keyasint,omitempty"` // omitted if LDContextDisclosureRequest
+	Context          []byte                        `cbor:"2,keyasint,omitempty"`
+	Nonce            []byte                        `cbor:"3,keyasint,omitempty"`
+	ProtocolVersion  []int                         `cbor:"4,keyasint,omitempty"`
+	Disclose         [][][]compactAttributeRequest `cbor:"5,keyasint,omitempty"`
+	Labels           map[int]TranslatedString      `cbor:"6,keyasint,omitempty"`
+	Purpose          *compactPurpose               `cbor:"7,keyasint,omitempty"`
+	SkipExpiryCheck  []CredentialTypeIdentifier    `cbor:"8,keyasint,omitempty"`
+	DevelopmentMode  bool                          `cbor:"9,keyasint,omitempty"`
+	ClientReturnURL  string                        `cbor:"10,keyasint,omitempty"`
+	AugmentReturnURL bool                          `cbor:"11,keyasint,omitempty"`
+	Host             string                        `cbor:"12,keyasint,omitempty"`
+}
+
+type compactAttributeRequest struct {
+	Type    AttributeTypeIdentifier `cbor:"1,keyasint"`
+	Value   *string                 `cbor:"2,keyasint,omitempty"`
+	NotNull bool                    `cbor:"3,keyasint,omitempty"`
+}
+
+type compactPurpose struct {
+	Code string           `cbor:"1,keyasint"`
+	Text TranslatedString `cbor:"2,keyasint,omitempty"`
+}
+
+func newCompactRequest(request *DisclosureRequest) *compactRequest {
+	c := &compactRequest{
+		Labels:           request.Labels,
+		SkipExpiryCheck:  request.SkipExpiryCheck,
+		DevelopmentMode:  request.DevelopmentMode,
+		ClientReturnURL:  request.ClientReturnURL,
+		AugmentReturnURL: request.AugmentReturnURL,
+		Host:             request.Host,
+	}
+	if request.LDContext != LDContextDisclosureRequest {
+		c.LDContext = request.LDContext
+	}
+	if request.Context != nil {
+		c.Context = request.Context.Bytes()
+	}
+	if request.Nonce != nil {
+		c.Nonce = request.Nonce.Bytes()
+	}
+	if request.ProtocolVersion != nil {
+		c.ProtocolVersion = []int{request.ProtocolVersion.Major, request.ProtocolVersion.Minor}
+	}
+	if request.Purpose != nil {
+		c.Purpose = &compactPurpose{Code: request.Purpose.Code, Text: request.Purpose.Text}
+	}
+	for _, discon := range request.Disclose {
+		cdiscon := make([][]compactAttributeRequest, 0, len(discon))
+		for _, con := range discon {
+			ccon := make([]compactAttributeRequest, 0, len(con))
+			for _, attr := range con {
+				ccon = append(ccon, compactAttributeRequest(attr))
+			}
+			cdiscon = append(cdiscon, ccon)
+		}
+		c.Disclose = append(c.Disclose, cdiscon)
+	}
+	return c
+}
+
+func (c *compactRequest) request() (*DisclosureRequest, error) {
+	request := &DisclosureRequest{
+		BaseRequest: BaseRequest{
+			LDContext:        c.LDContext,
+			DevelopmentMode:  c.DevelopmentMode,
+			ClientReturnURL:  c.ClientReturnURL,
+			AugmentReturnURL: c.AugmentReturnURL,
+			Host:             c.Host,
+		},
+		Labels:          c.Labels,
+		SkipExpiryCheck: c.SkipExpiryCheck,
+	}
+	if request.LDContext == "" {
+		request.LDContext = LDContextDisclosureRequest
+	}
+	if c.Context != nil {
+		request.Context = new(big.Int).SetBytes(c.Context)
+	}
+	if c.Nonce != nil {
+		request.Nonce = new(big.Int).SetBytes(c.Nonce)
+	}
+	if c.ProtocolVersion != nil {
+		if len(c.ProtocolVersion) != 2 {
+			return nil, errors.New("invalid protocol version")
+		}
+		request.ProtocolVersion = NewVersion(c.ProtocolVersion[0], c.ProtocolVersion[1])
+	}
+	if c.Purpose != nil {
+		request.Purpose = &Purpose{Code: c.Purpose.Code, Text: c.Purpose.Text}
+	}
+	for _, cdiscon := range c.Disclose {
+		discon := make(AttributeDisCon, 0, len(cdiscon))
+		for _, ccon := range cdiscon {
+			con := make(AttributeCon, 0, len(ccon))
+			for _, attr := range ccon {
+				con = append(con, AttributeRequest(attr))
+			}
+			discon = append(discon, con)
+		}
+		request.Disclose = append(request.Disclose, discon)
+	}
+	return request, nil
+}
+
+// MarshalCompact encodes a signed Qr containing a disclosure request as CBOR, prefixed by
+// CompactQrPrefix, which is more compact than JSON for use in QRs. Using the embedded request,
+// clients that know the public key of the server need not retrieve the request from the server
+// before asking the user for permission.
+func (qr *Qr) MarshalCompact() (string, error) {
+	if qr.Request == nil || qr.Signature == "" {
+		return "", errors.New("only signed session pointers containing a request can be made compact")
+	}
+	if len(qr.AlternativeURLs) > 0 {
+		return "", errors.New("session pointers with alternative URLs cannot be made compact")
+	}
+
+	// The signature covers the JSON of the request, so refuse requests with fields that the
+	// compact encoding does not preserve (e.g. revocation parameters)
+	c := newCompactRequest(qr.Request)
+	restored, err := c.request()
+	if err != nil {
+		return "", err
+	}
+	original, err := json.Marshal(qr.Request)
+	if err != nil {
+		return "", err
+	}
+	bts, err := json.Marshal(restored)
+	if err != nil {
+		return "", err
+	}
+	if !bytes.Equal(original, bts) {
+		return "", errors.New("session request cannot be encoded compactly")
+	}
+
+	var sig [][]byte
+	for _, part := range strings.Split(qr.Signature, ".") {
+		decoded, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil || base64.RawURLEncoding.EncodeToString(decoded) != part {
+			return "", errors.New("session pointer signature cannot be encoded compactly")
+		}
+		sig = append(sig, decoded)
+	}
+
+	bts, err = cbor.Marshal(compactQr{URL: qr.URL, Type: qr.Type, Request: c, Signature: sig}, cbor.EncOptions{})
+	if err != nil {
+		return "", err
+	}
+	return CompactQrPrefix + base64.RawURLEncoding.EncodeToString(bts), nil
+}
+
+// ParseCompactQr parses and validates a compact session pointer (see MarshalCompact()). Its signature
+// is not verified; use VerifySignature() for that.
+func ParseCompactQr(s string) (*Qr, error) {
+	if !strings.HasPrefix(s, CompactQrPrefix) {
+		return nil, errors.New("not a compact session pointer")
+	}
+	bts, err := base64.RawURLEncoding.DecodeString(strings.TrimPrefix(s, CompactQrPrefix))
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "invalid compact session pointer", 0)
+	}
+	var c compactQr
+	if err = cbor.Unmarshal(bts, &c); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid compact session pointer", 0)
+	}
+	if c.Request == nil {
+		return nil, errors.New("compact session pointer contains no session request")
+	}
+	sig := make([]string, 0, len(c.Signature))
+	for _, part := range c.Signature {
+		sig = append(sig, base64.RawURLEncoding.EncodeToString(part))
+	}
+	qr := &Qr{URL: c.URL, Type: c.Type, Signature: strings.Join(sig, ".")}
+	if qr.Request, err = c.Request.request(); err != nil {
+		return nil, errors.WrapPrefix(err, "invalid session request in compact session pointer", 0)
+	}
+	if qr.Signature == "" {
+		return nil, errors.New("compact session pointer is not signed")
+	}
+	if err = qr.Validate(); err != nil {
+		return nil, err
+	}
+	return qr, nil
+}
+
 func (status ServerStatus) Finished() bool {
 	return status == ServerStatusDone || status == ServerStatusCancelled || status == ServerStatusTimeout
 }
@@ -571,6 +1159,66 @@ type ServerSessionResponse struct {
 type FrontendSessionStatus struct {
 	Status      ServerStatus `json:"status"`
 	NextSession *Qr          `json:"nextSession,omitempty"`
+	BindingCode string       `json:"bindingCode,omitempty"`
+	// Category of the error due to which the session was cancelled, if any
+	Error SessionErrorCategory `json:"error,omitempty"`
+}
+
+// SessionErrorCategory is a coarse category of the error due to which a session was cancelled,
+// that the frontend can use to inform the user without receiving the details of the error.
+type SessionErrorCategory string
+
+const (
+	SessionErrorAttributesExpired = SessionErrorCategory("ATTRIBUTES_EXPIRED") // Disclosed credentials were expired, so that the user should renew them
+	SessionErrorAttributesMissing = SessionErrorCategory("ATTRIBUTES_MISSING") // Not all requested attributes were disclosed
+	SessionErrorInvalidProofs     = SessionErrorCategory("INVALID_PROOFS")     // Proofs were invalid, e.g. of credentials of unknown issuer keys
+	SessionErrorClientUnsupported = SessionErrorCategory("CLIENT_UNSUPPORTED") // Client does not support the session, so that the user should update their app
+	SessionErrorClient            = SessionErrorCategory("CLIENT_ERROR")       // Client sent an invalid or unexpected request
+	SessionErrorServer            = SessionErrorCategory("SERVER_ERROR")       // Server failed to handle the session
+)
+
+// PublicConfigurationPath is the path, relative to the URL of an IRMA server, at which the server
+// publishes its PublicServerConfiguration.
+const PublicConfigurationPath = "/.well-known/irma-configuration"
+
+// PublicServerConfiguration describes the capabilities of an IRMA server, so that frontends and
+// IRMA apps can discover them instead of finding out by trial and error.
+type PublicServerConfiguration struct {
+	// Range of protocol versions supported by the server
+	MinProtocolVersion *ProtocolVersion `json:"minProtocolVersion"`
+	MaxProtocolVersion *ProtocolVersion `json:"maxProtocolVersion"`
+	Features           ServerFeatures   `json:"features"`
+	Schemes            []SchemeInfo     `json:"schemes"`
+	// Public keys with which the server signs JWTs, such as session result JWTs, signed session
+	// pointers and its public configuration
+	PublicKeys JWKS `json:"publicKeys"`
+}
+
+// ServerFeatures lists the features that an IRMA server supports in its sessions. The features
+// available in a particular session are listed in the SessionFeatures of its session options.
+type ServerFeatures struct {
+	// Pairing methods that frontends may choose from
+	PairingMethods []PairingMethod `json:"pairingMethods"`
+	// Whether status updates are available as server-sent events
+	SSE bool `json:"sse"`
+	// Whether sessions can be followed by chained sessions
+	ChainedSessions bool `json:"chainedSessions"`
+	// Whether session pointers are signed (see Qr.Sign())
+	SignedSessionPointers bool `json:"signedSessionPointers"`
+}
+
+// SchemeInfo identifies a scheme used by an IRMA server.
+type SchemeInfo struct {
+	ID   string     `json:"id"`
+	URL  string     `json:"url"`
+	Type SchemeType `json:"type"`
+}
+
+// PublicServerConfigurationClaims are the claims of the JWT in which an IRMA server publishes its
+// PublicServerConfiguration.
+type PublicServerConfigurationClaims struct {
+	jwt.RegisteredClaims
+	Configuration *PublicServerConfiguration `json:"configuration"`
 }
 
 func WrapErrorPrefix(err error, msg string) error {
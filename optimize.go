@@ -0,0 +1,359 @@
+package irma
+
+import (
+	"fmt"
+	"sort"
+)
+
+// OptimizedConDisCon is the result of AttributeConDisCon.Optimize().
+type OptimizedConDisCon struct {
+	ConDisCon AttributeConDisCon
+	// For each disjunction of ConDisCon, the index of the disjunction of the original condiscon
+	// from which it derives, e.g. for moving the labels of disclosure requests along
+	Origins []int
+	// Problems found in the original condiscon, and the changes made to it
+	Warnings []ConDisConWarning
+}
+
+// ConDisConWarning describes a problem with a disjunction of a condiscon.
+type ConDisConWarning struct {
+	// Index of the disjunction in the original condiscon
+	Disjunction int
+	Message     string
+}
+
+func (w ConDisConWarning) String() string {
+	return fmt.Sprintf("disjunction %d: %s", w.Disjunction, w.Message)
+}
+
+type optimizedDisCon struct {
+	origin int
+	cons   AttributeDisCon
+}
+
+// Optimize returns a simplified version of the condiscon, which asks the same of the user (apart
+// from options that can never be satisfied), along with warnings about what was changed or found.
+// The condiscon itself is not modified. In particular:
+//   - within inner conjunctions, duplicate attribute requests are removed and requests of the same
+//     credential type are made adjacent;
+//   - options that can never be satisfied (unknown attributes, invalid or conflicting values, or
+//     multiple non-singleton credential types) are removed if the disjunction has other options;
+//   - duplicate options, and disjunctions requesting attributes that are already requested by a
+//     mandatory disjunction (having a single option) are removed;
+//   - mandatory disjunctions requesting attributes of the same credential type are merged;
+//   - the options of each disjunction are ordered by the effort it takes users to satisfy them
+//     (fewer credentials and required values first), keeping the position of empty options.
+//
+// As removing and merging disjunctions changes the order of the disclosed attributes in session
+// results, this is not done automatically in sessions.
+func (cdc AttributeConDisCon) Optimize(conf *Configuration) *OptimizedConDisCon {
+	o := &OptimizedConDisCon{}
+	discons := o.normalize(cdc, conf)
+	discons = o.merge(discons)
+	discons = o.removeRedundant(discons)
+	o.checkSingletons(discons, conf)
+
+	o.ConDisCon = make(AttributeConDisCon, 0, len(discons))
+	o.Origins = make([]int, 0, len(discons))
+	for _, discon := range discons {
+		o.ConDisCon = append(o.ConDisCon, sortByFriction(discon.cons, conf))
+		o.Origins = append(o.Origins, discon.origin)
+	}
+	return o
+}
+
+// Optimize replaces the condiscon of the request by its optimized version (see
+// AttributeConDisCon.Optimize()), moving the labels along, and returns the warnings.
+func (dr *DisclosureRequest) Optimize(conf *Configuration) []ConDisConWarning {
+	optimized := dr.Disclose.Optimize(conf)
+	labels := map[int]TranslatedString{}
+	for i, origin := range optimized.Origins {
+		if label, ok := dr.Labels[origin]; ok {
+			labels[i] = label
+		}
+	}
+	dr.Disclose = optimized.ConDisCon
+	dr.Labels = labels
+	dr.ids = nil
+	return optimized.Warnings
+}
+
+func (o *OptimizedConDisCon) warn(disjunction int, format string, args ...interface{}) {
+	o.Warnings = append(o.Warnings, ConDisConWarning{Disjunction: disjunction, Message: fmt.Sprintf(format, args...)})
+}
+
+// normalize copies the disjunctions, normalizing their options and removing duplicate and
+// impossible ones.
+func (o *OptimizedConDisCon) normalize(cdc AttributeConDisCon, conf *Configuration) []*optimizedDisCon {
+	var discons []*optimizedDisCon
+	for i, discon := range cdc {
+		if len(discon) == 0 {
+			o.warn(i, "empty disjunction can never be satisfied")
+		}
+		var possible, impossible AttributeDisCon
+		for j, con := range discon {
+			con = normalizeCon(con)
+			if containsCon(possible, con) || containsCon(impossible, con) {
+				o.warn(i, "removed duplicate option %d", j)
+				continue
+			}
+			if reason := impossibleCon(con, conf); reason != "" {
+				o.warn(i, "option %d can never be satisfied: %s", j, reason)
+				impossible = append(impossible, con)
+				continue
+			}
+			possible = append(possible, con)
+		}
+		switch {
+		case len(possible) > 0 && len(impossible) > 0:
+			o.warn(i, "removed %d option(s) that can never be satisfied", len(impossible))
+		case len(possible) == 0 && len(impossible) > 0:
+			o.warn(i, "none of the options can be satisfied")
+			possible = impossible
+		}
+		discons = append(discons, &optimizedDisCon{origin: i, cons: possible})
+	}
+	return discons
+}
+
+// merge merges mandatory disjunctions requesting attributes of a single credential type into
+// the first mandatory disjunction requesting attributes of the same credential type.
+func (o *OptimizedConDisCon) merge(discons []*optimizedDisCon) []*optimizedDisCon {
+	var result []*optimizedDisCon
+	first := map[CredentialTypeIdentifier]*optimizedDisCon{}
+	for _, discon := range discons {
+		credtype, ok := singleCredentialType(discon)
+		if !ok {
+			result = append(result, discon)
+			continue
+		}
+		into, ok := first[credtype]
+		if !ok {
+			first[credtype] = discon
+			result = append(result, discon)
+			continue
+		}
+		merged := normalizeCon(append(append(AttributeCon{}, into.cons[0]...), discon.cons[0]...))
+		if conflictingValues(merged) != "" {
+			result = append(result, discon)
+			continue
+		}
+		into.cons[0] = merged
+		o.warn(discon.origin, "merged into disjunction %d, as both request attributes of %s", into.origin, credtype)
+	}
+	return result
+}
+
+// removeRedundant removes disjunctions having an option that requests only attributes that
+// are already requested by a mandatory disjunction.
+func (o *OptimizedConDisCon) removeRedundant(discons []*optimizedDisCon) []*optimizedDisCon {
+	var result []*optimizedDisCon
+outer:
+	for i, discon := range discons {
+		for j, other := range discons {
+			if i == j || !mandatory(other) {
+				continue
+			}
+			// Of two identical mandatory disjunctions, keep the first one
+			if mandatory(discon) && conEqual(discon.cons[0], other.cons[0]) && i < j {
+				continue
+			}
+			for _, con := range discon.cons {
+				if len(con) > 0 && conSubset(con, other.cons[0]) {
+					o.warn(discon.origin, "removed, as its attributes are already requested by disjunction %d", other.origin)
+					continue outer
+				}
+			}
+		}
+		result = append(result, discon)
+	}
+	return result
+}
+
+// checkSingletons warns about mandatory disjunctions requiring different values for the same
+// attribute of a singleton credential type, of which users can have only one instance.
+func (o *OptimizedConDisCon) checkSingletons(discons []*optimizedDisCon, conf *Configuration) {
+	values := map[AttributeTypeIdentifier]*optimizedDisCon{}
+	for _, discon := range discons {
+		if !mandatory(discon) {
+			continue
+		}
+		for _, attr := range discon.cons[0] {
+			credtype := conf.CredentialTypes[attr.Type.CredentialTypeIdentifier()]
+			if attr.Value == nil || credtype == nil || !credtype.IsSingleton {
+				continue
+			}
+			other, ok := values[attr.Type]
+			if !ok {
+				values[attr.Type] = discon
+				continue
+			}
+			for _, otherAttr := range other.cons[0] {
+				if otherAttr.Type == attr.Type && *otherAttr.Value != *attr.Value {
+					o.warn(discon.origin, "cannot be satisfied together with disjunction %d, as they require different values for %s of singleton credential type",
+						other.origin, attr.Type)
+				}
+			}
+		}
+	}
+}
+
+// normalizeCon returns a copy of the conjunction without duplicate attribute requests, and with
+// requests of the same credential type adjacent (in order of first occurrence).
+func normalizeCon(con AttributeCon) AttributeCon {
+	var credtypes []CredentialTypeIdentifier
+	grouped := map[CredentialTypeIdentifier]AttributeCon{}
+	for _, attr := range con {
+		credtype := attr.Type.CredentialTypeIdentifier()
+		if _, ok := grouped[credtype]; !ok {
+			credtypes = append(credtypes, credtype)
+		}
+		if !conContains(grouped[credtype], attr) {
+			grouped[credtype] = append(grouped[credtype], attr)
+		}
+	}
+	result := AttributeCon{}
+	for _, credtype := range credtypes {
+		result = append(result, grouped[credtype]...)
+	}
+	return result
+}
+
+// impossibleCon returns why the conjunction can never be satisfied, if so.
+func impossibleCon(con AttributeCon, conf *Configuration) string {
+	var nonsingleton *CredentialTypeIdentifier
+	for _, attr := range con {
+		credid := attr.Type.CredentialTypeIdentifier()
+		if !conf.ContainsCredentialType(credid) {
+			return "unknown credential type " + credid.String()
+		}
+		if attr.Type.IsCredential() {
+			if attr.Value != nil {
+				return "value required for credential type " + credid.String()
+			}
+		} else if attr.Type.IsMetadataAttribute() {
+			if attr.Value != nil && AttributeDataTypeDate.Validate(*attr.Value) != nil {
+				return "invalid value for " + attr.Type.String()
+			}
+		} else if !conf.ContainsAttributeType(attr.Type) {
+			return "unknown attribute type " + attr.Type.String()
+		} else if attr.Value != nil {
+			if err := conf.AttributeTypes[attr.Type].DataType.Validate(*attr.Value); err != nil {
+				return "invalid value for " + attr.Type.String()
+			}
+		}
+		if !conf.CredentialTypes[credid].IsSingleton {
+			if nonsingleton != nil && *nonsingleton != credid {
+				return "multiple non-singleton credential types"
+			}
+			nonsingleton = &credid
+		}
+	}
+	return conflictingValues(con)
+}
+
+// conflictingValues returns the attribute for which the conjunction requires different values, if any.
+func conflictingValues(con AttributeCon) string {
+	values := map[AttributeTypeIdentifier]string{}
+	for _, attr := range con {
+		if attr.Value == nil {
+			continue
+		}
+		if value, ok := values[attr.Type]; ok && value != *attr.Value {
+			return "different values required for " + attr.Type.String()
+		}
+		values[attr.Type] = *attr.Value
+	}
+	return ""
+}
+
+// sortByFriction orders the options, except empty ones, by the effort it takes users to satisfy
+// them: first by the number of credentials involved, then by the number of required values, and
+// then by the number of attributes.
+func sortByFriction(discon AttributeDisCon, conf *Configuration) AttributeDisCon {
+	var nonempty AttributeDisCon
+	for _, con := range discon {
+		if len(con) > 0 {
+			nonempty = append(nonempty, con)
+		}
+	}
+	sort.SliceStable(nonempty, func(i, j int) bool {
+		return conFriction(nonempty[i], conf) < conFriction(nonempty[j], conf)
+	})
+	result := make(AttributeDisCon, 0, len(discon))
+	for _, con := range discon {
+		if len(con) == 0 {
+			result = append(result, con)
+		} else {
+			result = append(result, nonempty[0])
+			nonempty = nonempty[1:]
+		}
+	}
+	return result
+}
+
+func conFriction(con AttributeCon, conf *Configuration) int {
+	friction := 100*len(con.CredentialTypes()) + len(con)
+	for _, attr := range con {
+		if attr.Value != nil || attr.NotNull {
+			friction += 10
+		}
+	}
+	for _, credid := range con.CredentialTypes() {
+		if credtype := conf.CredentialTypes[credid]; credtype != nil && !credtype.DeprecatedSince.IsZero() {
+			friction += 1000
+		}
+	}
+	return friction
+}
+
+func mandatory(discon *optimizedDisCon) bool {
+	return len(discon.cons) == 1 && len(discon.cons[0]) > 0
+}
+
+func singleCredentialType(discon *optimizedDisCon) (CredentialTypeIdentifier, bool) {
+	if !mandatory(discon) {
+		return CredentialTypeIdentifier{}, false
+	}
+	credtypes := discon.cons[0].CredentialTypes()
+	if len(credtypes) != 1 {
+		return CredentialTypeIdentifier{}, false
+	}
+	return credtypes[0], true
+}
+
+func attributeRequestEqual(a, b AttributeRequest) bool {
+	return a.Type == b.Type && a.NotNull == b.NotNull &&
+		(a.Value == nil) == (b.Value == nil) && (a.Value == nil || *a.Value == *b.Value)
+}
+
+func conContains(con AttributeCon, attr AttributeRequest) bool {
+	for _, a := range con {
+		if attributeRequestEqual(a, attr) {
+			return true
+		}
+	}
+	return false
+}
+
+func conSubset(sub, con AttributeCon) bool {
+	for _, attr := range sub {
+		if !conContains(con, attr) {
+			return false
+		}
+	}
+	return true
+}
+
+func conEqual(a, b AttributeCon) bool {
+	return conSubset(a, b) && conSubset(b, a)
+}
+
+func containsCon(discon AttributeDisCon, con AttributeCon) bool {
+	for _, c := range discon {
+		if conEqual(c, con) {
+			return true
+		}
+	}
+	return false
+}
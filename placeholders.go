@@ -0,0 +1,72 @@
+package irma
+
+import (
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+var messagePlaceholder = regexp.MustCompile(`\{\{\s*(today|now|disclosed\.[\w.-]+)\s*\}\}`)
+
+// HasPlaceholders returns whether the message of the signature request contains placeholders.
+func (sr *SignatureRequest) HasPlaceholders() bool {
+	return messagePlaceholder.MatchString(sr.Message)
+}
+
+// ResolvePlaceholders returns a copy of the signature request in which the placeholders in the
+// message are replaced by their values at the specified time:
+//   - {{today}}: the date, as YYYY-MM-DD;
+//   - {{now}}: the time, in RFC 3339 format;
+//   - {{disclosed.<attribute>}}: the value of the attribute, specified by its full identifier or
+//     by its name if unambiguous, taken from the specified attributes disclosed in previous sessions.
+//
+// Attributes that were not disclosed result in an error. Other text between double braces is left untouched.
+func (sr *SignatureRequest) ResolvePlaceholders(now time.Time, disclosed AttributeConDisCon) (*SignatureRequest, error) {
+	var err error
+	resolved := *sr
+	resolved.Message = messagePlaceholder.ReplaceAllStringFunc(sr.Message, func(placeholder string) string {
+		if err != nil {
+			return placeholder
+		}
+		var value string
+		value, err = resolvePlaceholder(messagePlaceholder.FindStringSubmatch(placeholder)[1], now, disclosed)
+		return value
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &resolved, nil
+}
+
+func resolvePlaceholder(name string, now time.Time, disclosed AttributeConDisCon) (string, error) {
+	switch name {
+	case "today":
+		return now.Format("2006-01-02"), nil
+	case "now":
+		return now.Format(time.RFC3339), nil
+	}
+
+	attr := strings.TrimPrefix(name, "disclosed.")
+	var exact, named []*string
+	_ = disclosed.Iterate(func(req *AttributeRequest) error {
+		if req.Type.String() == attr {
+			exact = append(exact, req.Value)
+		} else if req.Type.Name() == attr {
+			named = append(named, req.Value)
+		}
+		return nil
+	})
+	if len(exact) == 0 && len(named) > 1 {
+		return "", errors.Errorf("placeholder %s in signature request message is ambiguous", name)
+	}
+	var value *string
+	if matches := append(exact, named...); len(matches) > 0 {
+		value = matches[0]
+	}
+	if value == nil {
+		return "", errors.Errorf("attribute of placeholder %s in signature request message was not disclosed", name)
+	}
+	return *value, nil
+}
@@ -0,0 +1,55 @@
+package irma
+
+import (
+	"sync"
+
+	"github.com/privacybydesign/gabi/big"
+)
+
+// Scratch big.Ints and byte buffers for the temporaries of decoding, hashing and computing
+// attributes, which happens for each attribute in each session. Reusing them keeps the garbage
+// collector from having to clean up after every disclosure.
+var (
+	intPool = sync.Pool{New: func() interface{} { return new(big.Int) }}
+	bufPool = sync.Pool{New: func() interface{} { b := make([]byte, 0, 64); return &b }}
+)
+
+// Scratch values larger than this (in bytes) are not returned to the pools, so that a single
+// huge attribute does not keep its memory alive.
+const maxPooledSize = 1024
+
+func getInt() *big.Int {
+	return intPool.Get().(*big.Int)
+}
+
+func putInt(i *big.Int) {
+	if i.BitLen() > 8*maxPooledSize {
+		return
+	}
+	intPool.Put(i)
+}
+
+// getBuf returns a scratch buffer of length n, whose contents are undefined.
+func getBuf(n int) *[]byte {
+	buf := bufPool.Get().(*[]byte)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	*buf = (*buf)[:n]
+	return buf
+}
+
+func putBuf(buf *[]byte) {
+	if cap(*buf) > maxPooledSize {
+		return
+	}
+	bufPool.Put(buf)
+}
+
+// intBytes writes the absolute value of i as a big-endian byte slice into a scratch buffer,
+// which should be returned using putBuf() after use.
+func intBytes(i *big.Int) *[]byte {
+	buf := getBuf((i.BitLen() + 7) / 8)
+	i.Go().FillBytes(*buf)
+	return buf
+}
@@ -0,0 +1,93 @@
+package proximity
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// DefaultBLEMTU is the minimum ATT MTU of BLE, used if no MTU was negotiated.
+const DefaultBLEMTU = 23
+
+// Headers of BLE frames, as in ISO/IEC 18013-5
+const (
+	bleLastChunk = 0x00
+	bleMoreChunk = 0x01
+)
+
+// BLE is the Profile for BLE GATT. As in ISO/IEC 18013-5, a message is split into chunks that fit
+// in a characteristic write or notification, each prefixed by a byte that is 0x01 if more chunks of
+// the message follow and 0x00 for the last chunk.
+type BLE struct {
+	// ATT MTU negotiated by the devices (default value 0 means DefaultBLEMTU)
+	MTU int
+}
+
+var _ Profile = BLE{}
+
+func (b BLE) RoundTrip(link Link, request []byte) ([]byte, error) {
+	if err := b.write(link, request); err != nil {
+		return nil, err
+	}
+	return b.read(link)
+}
+
+func (b BLE) ReadRequest(link Link) ([]byte, error) {
+	return b.read(link)
+}
+
+func (b BLE) WriteResponse(link Link, response []byte) error {
+	return b.write(link, response)
+}
+
+// chunkSize returns the maximum chunk size: the MTU minus the opcode and handle of the ATT
+// write or notification, and the header of the chunk.
+func (b BLE) chunkSize() int {
+	mtu := b.MTU
+	if mtu == 0 {
+		mtu = DefaultBLEMTU
+	}
+	return mtu - 3 - 1
+}
+
+func (b BLE) write(link Link, message []byte) error {
+	if len(message) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	size := b.chunkSize()
+	if size <= 0 {
+		return errors.Errorf("BLE MTU %d too small", b.MTU)
+	}
+	for {
+		n := min(size, len(message))
+		header := byte(bleMoreChunk)
+		if n == len(message) {
+			header = bleLastChunk
+		}
+		if err := link.Send(append([]byte{header}, message[:n]...)); err != nil {
+			return err
+		}
+		message = message[n:]
+		if header == bleLastChunk {
+			return nil
+		}
+	}
+}
+
+func (b BLE) read(link Link) ([]byte, error) {
+	var message []byte
+	for {
+		frame, err := link.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if len(frame) == 0 || (frame[0] != bleLastChunk && frame[0] != bleMoreChunk) {
+			return nil, errors.New("invalid BLE frame")
+		}
+		if len(message)+len(frame)-1 > MaxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		message = append(message, frame[1:]...)
+		if frame[0] == bleLastChunk {
+			return message, nil
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package proximity
+
+import (
+	"github.com/go-errors/errors"
+)
+
+// APDU constants of the NFC profile, as in ISO/IEC 18013-5 and ISO/IEC 7816-4
+const (
+	nfcClaChaining  = 0x10
+	nfcInsEnvelope  = 0xC3
+	nfcInsGetResp   = 0xC0
+	nfcMaxCmdData   = 255
+	nfcMaxRespData  = 256
+	nfcSW1MoreData  = 0x61
+	nfcSW1Success   = 0x90
+	nfcSW1WrongIns  = 0x6D
+	nfcSW1WrongData = 0x6A
+)
+
+var (
+	nfcSWSuccess      = []byte{nfcSW1Success, 0x00}
+	nfcSWWrongIns     = []byte{nfcSW1WrongIns, 0x00}
+	nfcSWWrongData    = []byte{nfcSW1WrongData, 0x80}
+	errInvalidNFCAPDU = errors.New("invalid NFC APDU")
+)
+
+// NFC is the Profile for NFC, in which the IRMA app acts as reader and the terminal as (emulated)
+// card. As in ISO/IEC 18013-5, the reader sends a message in ENVELOPE command APDUs using command
+// chaining, and the card returns its message in the response APDU to the last ENVELOPE command,
+// split over subsequent GET RESPONSE commands (status word 61XX) if it does not fit. Only short
+// APDUs are used.
+type NFC struct{}
+
+var _ Profile = NFC{}
+
+func (NFC) RoundTrip(link Link, request []byte) ([]byte, error) {
+	if len(request) > MaxMessageSize {
+		return nil, ErrMessageTooLarge
+	}
+
+	// Send the request in ENVELOPE commands
+	var res []byte
+	for {
+		n := min(nfcMaxCmdData, len(request))
+		cla := byte(0)
+		if n < len(request) {
+			cla = nfcClaChaining
+		}
+		apdu := []byte{cla, nfcInsEnvelope, 0, 0}
+		if n > 0 {
+			apdu = append(append(apdu, byte(n)), request[:n]...)
+		}
+		apdu = append(apdu, 0) // Le: 256
+		if err := link.Send(apdu); err != nil {
+			return nil, err
+		}
+		var err error
+		if res, err = link.Receive(); err != nil {
+			return nil, err
+		}
+		request = request[n:]
+		if cla == 0 {
+			break
+		}
+		if len(res) != 2 || res[0] != nfcSW1Success {
+			return nil, errors.Errorf("card refused ENVELOPE command: %X", res)
+		}
+	}
+
+	// Receive the response, using GET RESPONSE commands while the card has more data
+	var message []byte
+	for {
+		if len(res) < 2 {
+			return nil, errInvalidNFCAPDU
+		}
+		sw1, sw2 := res[len(res)-2], res[len(res)-1]
+		if len(message)+len(res)-2 > MaxMessageSize {
+			return nil, ErrMessageTooLarge
+		}
+		message = append(message, res[:len(res)-2]...)
+		switch sw1 {
+		case nfcSW1Success:
+			return message, nil
+		case nfcSW1MoreData:
+			if err := link.Send([]byte{0, nfcInsGetResp, 0, 0, sw2}); err != nil {
+				return nil, err
+			}
+			var err error
+			if res, err = link.Receive(); err != nil {
+				return nil, err
+			}
+		default:
+			return nil, errors.Errorf("card returned error status %X", res[len(res)-2:])
+		}
+	}
+}
+
+func (NFC) ReadRequest(link Link) ([]byte, error) {
+	var message []byte
+	for {
+		apdu, err := link.Receive()
+		if err != nil {
+			return nil, err
+		}
+		if len(apdu) < 4 || apdu[1] != nfcInsEnvelope {
+			_ = link.Send(nfcSWWrongIns)
+			return nil, errInvalidNFCAPDU
+		}
+		// Short APDU: CLA INS P1 P2 [Lc data] [Le]
+		var data []byte
+		if len(apdu) > 5 {
+			lc := int(apdu[4])
+			if lc == 0 || len(apdu) < 5+lc {
+				_ = link.Send(nfcSWWrongData)
+				return nil, errInvalidNFCAPDU
+			}
+			data = apdu[5 : 5+lc]
+		}
+		if len(message)+len(data) > MaxMessageSize {
+			_ = link.Send(nfcSWWrongData)
+			return nil, ErrMessageTooLarge
+		}
+		message = append(message, data...)
+		if apdu[0]&nfcClaChaining == 0 {
+			return message, nil
+		}
+		if err = link.Send(nfcSWSuccess); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (NFC) WriteResponse(link Link, response []byte) error {
+	if len(response) > MaxMessageSize {
+		return ErrMessageTooLarge
+	}
+	for {
+		n := min(nfcMaxRespData, len(response))
+		apdu := append([]byte{}, response[:n]...)
+		response = response[n:]
+		if len(response) == 0 {
+			return link.Send(append(apdu, nfcSWSuccess...))
+		}
+		// SW2 is the number of remaining bytes, where 0 means 256 or more
+		sw2 := byte(0)
+		if len(response) < nfcMaxRespData {
+			sw2 = byte(len(response))
+		}
+		if err := link.Send(append(apdu, nfcSW1MoreData, sw2)); err != nil {
+			return err
+		}
+		cmd, err := link.Receive()
+		if err != nil {
+			return err
+		}
+		if len(cmd) < 4 || cmd[1] != nfcInsGetResp {
+			_ = link.Send(nfcSWWrongIns)
+			return errInvalidNFCAPDU
+		}
+	}
+}
@@ -0,0 +1,235 @@
+// Package proximity implements IRMA sessions between a phone and a local terminal without internet,
+// over Bluetooth Low Energy (BLE) or NFC, mirroring the device retrieval of ISO/IEC 18013-5 (mobile
+// driving licences). The IRMA app sends the messages that it would otherwise send to the IRMA
+// server over HTTP as CBOR-encoded request messages over a Link with the terminal, which passes them
+// to the http.Handler of an IRMA server (e.g. irmaserver.Server.HandlerFunc()) running on the
+// terminal and returns its responses.
+//
+// Messages are split into frames according to a Profile: BLE frames are GATT characteristic writes
+// and notifications, and NFC frames are APDUs. The IRMA app always initiates the exchange of a
+// message, i.e. it acts as the GATT client (central) or NFC reader, while the terminal acts as GATT
+// server (peripheral) or emulated card.
+//
+// The session pointer, containing the session URL, is transferred to the IRMA app beforehand, e.g.
+// by showing it as a QR on the terminal or by NFC; the IRMA app then starts the session using
+// irmaclient.Client.NewSessionWithTransport() and a Transport over the Link.
+package proximity
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/fxamacker/cbor"
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// MaxMessageSize is the maximum size of request and response messages in bytes.
+const MaxMessageSize = 1 << 20
+
+var ErrMessageTooLarge = errors.New("proximity message too large")
+
+type (
+	// Link sends and receives frames to and from the other device. Receive returns io.EOF when
+	// the link is closed.
+	Link interface {
+		Send(frame []byte) error
+		Receive() ([]byte, error)
+	}
+
+	// Profile splits messages into frames and reassembles them, for a particular kind of Link.
+	Profile interface {
+		// RoundTrip sends a request message and returns the response message (IRMA app side).
+		RoundTrip(link Link, request []byte) ([]byte, error)
+		// ReadRequest receives a request message (terminal side).
+		ReadRequest(link Link) ([]byte, error)
+		// WriteResponse sends the response message to the last request message (terminal side).
+		WriteResponse(link Link, response []byte) error
+	}
+
+	// Request is the message with which the IRMA app sends an HTTP request to the terminal.
+	Request struct {
+		_       struct{} `cbor:",toarray"`
+		Method  string
+		Path    string // path and query of the URL
+		Headers map[string]string
+		Body    []byte
+	}
+
+	// Response is the message with which the terminal sends the HTTP response to a Request.
+	Response struct {
+		_      struct{} `cbor:",toarray"`
+		Status int
+		Body   []byte
+	}
+)
+
+// Transport implements irma.SessionTransport, sending messages to the terminal over a Link.
+type Transport struct {
+	Server string
+
+	link    Link
+	profile Profile
+	headers map[string]string
+	mutex   sync.Mutex
+}
+
+var _ irma.SessionTransport = (*Transport)(nil)
+
+// NewTransport returns a Transport to the session at the specified URL on the terminal, relative
+// to which the URLs passed to its methods are resolved.
+func NewTransport(link Link, profile Profile, server string) *Transport {
+	if !strings.HasSuffix(server, "/") {
+		server += "/"
+	}
+	return &Transport{Server: server, link: link, profile: profile, headers: map[string]string{}}
+}
+
+func (transport *Transport) SetHeader(name, val string) {
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	transport.headers[http.CanonicalHeaderKey(name)] = val
+}
+
+// Post sends the object to the terminal and parses its response into result.
+func (transport *Transport) Post(url string, result interface{}, object interface{}) error {
+	body, err := json.Marshal(object)
+	if err != nil {
+		return &irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err}
+	}
+	return transport.request(url, http.MethodPost, result, body)
+}
+
+// Get sends a GET request to the terminal and parses its response into result.
+func (transport *Transport) Get(url string, result interface{}) error {
+	return transport.request(url, http.MethodGet, result, nil)
+}
+
+// Delete sends a DELETE request to the terminal.
+func (transport *Transport) Delete() error {
+	return transport.request("", http.MethodDelete, nil, nil)
+}
+
+func (transport *Transport) request(path string, method string, result interface{}, body []byte) error {
+	u, err := url.Parse(transport.Server + path)
+	if err != nil {
+		return &irma.SessionError{ErrorType: irma.ErrorTransport, Err: err}
+	}
+
+	// Only one message can be exchanged at a time over a link
+	transport.mutex.Lock()
+	defer transport.mutex.Unlock()
+	headers := make(map[string]string, len(transport.headers)+1)
+	for name, val := range transport.headers {
+		headers[name] = val
+	}
+	if body != nil {
+		headers["Content-Type"] = "application/json; charset=UTF-8"
+	}
+	req, err := cbor.Marshal(Request{Method: method, Path: u.RequestURI(), Headers: headers, Body: body}, cbor.EncOptions{})
+	if err != nil {
+		return &irma.SessionError{ErrorType: irma.ErrorSerialization, Err: err}
+	}
+	resbts, err := transport.profile.RoundTrip(transport.link, req)
+	if err != nil {
+		return &irma.SessionError{ErrorType: irma.ErrorTransport, Err: err}
+	}
+	var res Response
+	if err = cbor.Unmarshal(resbts, &res); err != nil {
+		return &irma.SessionError{ErrorType: irma.ErrorServerResponse, Err: err}
+	}
+
+	switch {
+	case res.Status == http.StatusNoContent || (method == http.MethodDelete && res.Status == http.StatusOK):
+		return nil
+	case res.Status != http.StatusOK:
+		apierr := &irma.RemoteError{}
+		if err = json.Unmarshal(res.Body, apierr); err != nil || apierr.ErrorName == "" {
+			return &irma.SessionError{ErrorType: irma.ErrorServerResponse, Err: err, RemoteStatus: res.Status}
+		}
+		return &irma.SessionError{ErrorType: irma.ErrorApi, RemoteStatus: res.Status, RemoteError: apierr}
+	case result == nil:
+		return nil
+	}
+	if err = irma.UnmarshalValidate(res.Body, result); err != nil {
+		return &irma.SessionError{ErrorType: irma.ErrorServerResponse, Err: err, RemoteStatus: res.Status}
+	}
+	return nil
+}
+
+// Serve passes the request messages received over the link to the handler and sends back its
+// responses, until the link is closed. The handler should not send server-sent events.
+func Serve(link Link, profile Profile, handler http.Handler) error {
+	for {
+		reqbts, err := profile.ReadRequest(link)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		res := serveRequest(reqbts, handler)
+		resbts, err := cbor.Marshal(res, cbor.EncOptions{})
+		if err != nil {
+			return err
+		}
+		if err = profile.WriteResponse(link, resbts); err != nil {
+			return err
+		}
+	}
+}
+
+func serveRequest(reqbts []byte, handler http.Handler) Response {
+	var req Request
+	if err := cbor.Unmarshal(reqbts, &req); err != nil {
+		return Response{Status: http.StatusBadRequest}
+	}
+	r, err := http.NewRequest(req.Method, req.Path, bytes.NewReader(req.Body))
+	if err != nil {
+		return Response{Status: http.StatusBadRequest}
+	}
+	for name, val := range req.Headers {
+		r.Header.Set(name, val)
+	}
+	r.RequestURI = req.Path
+	r.RemoteAddr = "proximity"
+
+	w := &responseWriter{header: http.Header{}}
+	handler.ServeHTTP(w, r)
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	return Response{Status: w.status, Body: w.body.Bytes()}
+}
+
+// responseWriter records the response of an http.Handler.
+type responseWriter struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+}
+
+func (w *responseWriter) Header() http.Header {
+	return w.header
+}
+
+func (w *responseWriter) Write(bts []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+	if w.body.Len()+len(bts) > MaxMessageSize {
+		return 0, ErrMessageTooLarge
+	}
+	return w.body.Write(bts)
+}
+
+func (w *responseWriter) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+}
@@ -0,0 +1,153 @@
+package proximity
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+// pipeLink is one end of an in-memory Link.
+type pipeLink struct {
+	in     <-chan []byte
+	out    chan<- []byte
+	frames *int // counts the frames sent
+}
+
+func newPipe() (*pipeLink, *pipeLink) {
+	a, b := make(chan []byte, 1), make(chan []byte, 1)
+	return &pipeLink{in: a, out: b, frames: new(int)}, &pipeLink{in: b, out: a, frames: new(int)}
+}
+
+func (l *pipeLink) Send(frame []byte) error {
+	*l.frames++
+	l.out <- append([]byte{}, frame...)
+	return nil
+}
+
+func (l *pipeLink) Receive() ([]byte, error) {
+	frame, ok := <-l.in
+	if !ok {
+		return nil, io.EOF
+	}
+	return frame, nil
+}
+
+func (l *pipeLink) Close() {
+	close(l.out)
+}
+
+func TestProfiles(t *testing.T) {
+	for name, profile := range map[string]Profile{"BLE": BLE{}, "BLE512": BLE{MTU: 512}, "NFC": NFC{}} {
+		t.Run(name, func(t *testing.T) {
+			for _, size := range []int{0, 1, 18, 19, 20, 255, 256, 257, 1000, 100000} {
+				request, response := bytes.Repeat([]byte{1}, size), bytes.Repeat([]byte{2}, size+1)
+				app, terminal := newPipe()
+				done := make(chan error)
+				go func() {
+					req, err := profile.ReadRequest(terminal)
+					if err == nil && !bytes.Equal(request, req) {
+						err = io.ErrUnexpectedEOF
+					}
+					if err == nil {
+						err = profile.WriteResponse(terminal, response)
+					}
+					done <- err
+				}()
+				res, err := profile.RoundTrip(app, request)
+				require.NoError(t, err, size)
+				require.NoError(t, <-done, size)
+				require.Equal(t, response, res, size)
+			}
+		})
+	}
+}
+
+func TestBLEFrames(t *testing.T) {
+	app, terminal := newPipe()
+	go func() {
+		_ = BLE{}.write(app, bytes.Repeat([]byte{1}, 40))
+	}()
+	for _, header := range []byte{bleMoreChunk, bleMoreChunk, bleLastChunk} {
+		frame, err := terminal.Receive()
+		require.NoError(t, err)
+		require.LessOrEqual(t, len(frame), DefaultBLEMTU-3)
+		require.Equal(t, header, frame[0])
+	}
+	require.Equal(t, 3, *app.frames)
+
+	go func() { _ = app.Send([]byte{0x02, 1, 2}) }()
+	_, err := BLE{}.read(terminal)
+	require.Error(t, err)
+	_, err = BLE{MTU: 4}.RoundTrip(app, []byte{1})
+	require.Error(t, err)
+}
+
+func TestNFCInvalidAPDU(t *testing.T) {
+	app, terminal := newPipe()
+	go func() {
+		_ = app.Send([]byte{0x00, 0xA4, 0x04, 0x00})
+	}()
+	_, err := NFC{}.ReadRequest(terminal)
+	require.Error(t, err)
+	sw, err := app.Receive()
+	require.NoError(t, err)
+	require.Equal(t, nfcSWWrongIns, sw)
+}
+
+func TestTransport(t *testing.T) {
+	handler := http.NewServeMux()
+	handler.HandleFunc("/session/token/", func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			server.WriteJson(w, irma.ServerStatusInitialized)
+		case http.MethodDelete:
+			w.WriteHeader(http.StatusNoContent)
+		}
+	})
+	handler.HandleFunc("/session/token/proofs", func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get(irma.AuthorizationHeader) != "auth" {
+			server.WriteError(w, server.ErrorIrmaUnauthorized, "")
+			return
+		}
+		var body map[string]string
+		if err := server.ParseBody(r, &body); err != nil {
+			server.WriteError(w, server.ErrorMalformedInput, err.Error())
+			return
+		}
+		server.WriteJson(w, body)
+	})
+
+	for name, profile := range map[string]Profile{"BLE": BLE{}, "NFC": NFC{}} {
+		t.Run(name, func(t *testing.T) {
+			app, terminal := newPipe()
+			done := make(chan error)
+			go func() {
+				done <- Serve(terminal, profile, handler)
+			}()
+
+			transport := NewTransport(app, profile, "http://terminal/session/token")
+			var status irma.ServerStatus
+			require.NoError(t, transport.Get("", &status))
+			require.Equal(t, irma.ServerStatusInitialized, status)
+
+			var res map[string]string
+			err := transport.Post("proofs", &res, map[string]string{"a": "b"})
+			require.Error(t, err)
+			require.Equal(t, irma.ErrorApi, err.(*irma.SessionError).ErrorType)
+			require.Equal(t, string(server.ErrorIrmaUnauthorized.Type), err.(*irma.SessionError).RemoteError.ErrorName)
+
+			transport.SetHeader(irma.AuthorizationHeader, "auth")
+			require.NoError(t, transport.Post("proofs", &res, map[string]string{"a": "b"}))
+			require.Equal(t, map[string]string{"a": "b"}, res)
+			require.NoError(t, transport.Delete())
+
+			app.Close()
+			require.NoError(t, <-done)
+		})
+	}
+}
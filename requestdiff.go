@@ -0,0 +1,110 @@
+package irma
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+)
+
+// RequestDifference is a difference between two session requests or requestor requests, as
+// returned by SessionRequestsDiff() and RequestorRequestsDiff().
+type RequestDifference struct {
+	// Location of the difference in the JSON representation of the requests, e.g. "disclose[0][1]"
+	// or "request.labels.0"; empty if the requests differ as a whole
+	Path string
+	// JSON values at Path in both requests (decoded into interface{}); nil if absent
+	A, B interface{}
+}
+
+func (d RequestDifference) String() string {
+	a, _ := json.Marshal(d.A)
+	b, _ := json.Marshal(d.B)
+	return fmt.Sprintf("%s: %s != %s", d.Path, a, b)
+}
+
+// SessionRequestsEqual returns whether the JSON representations of the session requests are
+// equal, independent of the order of the keys of JSON objects and maps such as the labels.
+func SessionRequestsEqual(a, b SessionRequest) bool {
+	return len(SessionRequestsDiff(a, b)) == 0
+}
+
+// SessionRequestsDiff returns the differences between the JSON representations of the session
+// requests, independent of the order of the keys of JSON objects and maps such as the labels.
+func SessionRequestsDiff(a, b SessionRequest) []RequestDifference {
+	return diffRequests(a, b)
+}
+
+// RequestorRequestsEqual returns whether the JSON representations of the requestor requests,
+// including their session requests, are equal (see SessionRequestsEqual).
+func RequestorRequestsEqual(a, b RequestorRequest) bool {
+	return len(RequestorRequestsDiff(a, b)) == 0
+}
+
+// RequestorRequestsDiff returns the differences between the JSON representations of the requestor
+// requests, including their session requests (see SessionRequestsDiff).
+func RequestorRequestsDiff(a, b RequestorRequest) []RequestDifference {
+	return diffRequests(a, b)
+}
+
+func diffRequests(a, b interface{}) []RequestDifference {
+	var diffs []RequestDifference
+	diffJSON("", toJSONValue(a), toJSONValue(b), &diffs)
+	return diffs
+}
+
+// toJSONValue returns the JSON representation of v, decoded into interface{}.
+func toJSONValue(v interface{}) interface{} {
+	if v == nil || reflect.ValueOf(v).Kind() == reflect.Ptr && reflect.ValueOf(v).IsNil() {
+		return nil
+	}
+	bts, err := json.Marshal(v)
+	if err != nil {
+		return err.Error()
+	}
+	var val interface{}
+	decoder := json.NewDecoder(bytes.NewReader(bts))
+	decoder.UseNumber() // keep large numbers such as nonces intact
+	if err = decoder.Decode(&val); err != nil {
+		return err.Error()
+	}
+	return val
+}
+
+func diffJSON(path string, a, b interface{}, diffs *[]RequestDifference) {
+	switch a := a.(type) {
+	case map[string]interface{}:
+		if b, ok := b.(map[string]interface{}); ok {
+			keys := make([]string, 0, len(a)+len(b))
+			for key := range a {
+				keys = append(keys, key)
+			}
+			for key := range b {
+				if _, ok := a[key]; !ok {
+					keys = append(keys, key)
+				}
+			}
+			sort.Strings(keys)
+			for _, key := range keys {
+				p := key
+				if path != "" {
+					p = path + "." + key
+				}
+				diffJSON(p, a[key], b[key], diffs)
+			}
+			return
+		}
+	case []interface{}:
+		if b, ok := b.([]interface{}); ok && len(a) == len(b) {
+			for i := range a {
+				diffJSON(path+"["+strconv.Itoa(i)+"]", a[i], b[i], diffs)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(a, b) {
+		*diffs = append(*diffs, RequestDifference{Path: path, A: a, B: b})
+	}
+}
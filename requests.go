@@ -6,10 +6,11 @@ import (
 	"fmt"
 	"os"
 	"reflect"
+	"regexp"
 	"strconv"
+	"sync"
 	"time"
 
-	"github.com/bwesterb/go-atum"
 	"github.com/go-errors/errors"
 	"github.com/golang-jwt/jwt/v4"
 	"github.com/privacybydesign/gabi"
@@ -38,6 +39,8 @@ type BaseRequest struct {
 	Context         *big.Int         `json:"context,omitempty"`
 	Nonce           *big.Int         `json:"nonce,omitempty"`
 	ProtocolVersion *ProtocolVersion `json:"protocolVersion,omitempty"`
+	// Purpose of the session as specified by the requestor, to be shown to the user
+	Purpose *Purpose `json:"purpose,omitempty"`
 
 	// Revocation is set by the requestor to indicate that it requires nonrevocation proofs for the
 	// specified credential types.
@@ -110,7 +113,7 @@ type CredentialRequest struct {
 type SessionRequest interface {
 	Validator
 	Base() *BaseRequest
-	GetNonce(timestamp *atum.Timestamp) *big.Int
+	GetNonce(timestamp *SignatureTimestamp) *big.Int
 	Disclosure() *DisclosureRequest
 	Identifiers() *IrmaIdentifierSet
 	Action() Action
@@ -125,15 +128,53 @@ type ServerJwt struct {
 	Type       string    `json:"sub"`
 	ServerName string    `json:"iss"`
 	IssuedAt   Timestamp `json:"iat"`
+	Audience   string    `json:"aud,omitempty"`
 }
 
 // RequestorBaseRequest contains fields present in all RequestorRequest types
 // with which the requestor configures an IRMA session.
 type RequestorBaseRequest struct {
-	ResultJwtValidity int              `json:"validity,omitempty"`    // Validity of session result JWT in seconds
-	ClientTimeout     int              `json:"timeout,omitempty"`     // Wait this many seconds for the IRMA app to connect before the session times out
-	CallbackURL       string           `json:"callbackUrl,omitempty"` // URL to post session result to
-	NextSession       *NextSessionData `json:"nextSession,omitempty"` // Data about session to start after this one (if any)
+	ResultJwtValidity int              `json:"validity,omitempty"`          // Validity of session result JWT in seconds
+	ClientTimeout     int              `json:"timeout,omitempty"`           // Wait this many seconds for the IRMA app to connect before the session times out
+	CallbackURL       string           `json:"callbackUrl,omitempty"`       // URL to post session result to
+	NextSession       *NextSessionData `json:"nextSession,omitempty"`       // Data about session to start after this one (if any)
+	BindingCode       bool             `json:"bindingCode,omitempty"`       // Show a binding code both in the frontend and in the IRMA app
+	RequirePairing    bool             `json:"requirePairing,omitempty"`    // Always pair the frontend and the IRMA app with a pairing code
+	Purpose           *Purpose         `json:"purpose,omitempty"`           // Purpose of the session, shown to the user and recorded in the session result
+	Offline           bool             `json:"offline,omitempty"`           // Include the request in the session pointer, so the IRMA app can prepare the disclosure offline
+	CompactSessionPtr bool             `json:"compactSessionPtr,omitempty"` // Include the request in a signed session pointer, also returned in compact form
+	Mdoc              bool             `json:"mdoc,omitempty"`              // Allow the attributes to be presented as mdocs (ISO/IEC 18013-5) instead of using Idemix
+
+	// Whether ResultJwtValidity was set by SetDefaultsIfNecessary() instead of by the requestor
+	defaultResultJwtValidity bool
+}
+
+// RequestInSessionPtr returns whether the session request is included in the session pointer.
+func (r *RequestorBaseRequest) RequestInSessionPtr() bool {
+	return r.Offline || r.CompactSessionPtr
+}
+
+// Purpose describes why a requestor starts a session, using a machine-readable code and a text
+// explaining the purpose to the user.
+type Purpose struct {
+	Code string           `json:"code"`
+	Text TranslatedString `json:"text"`
+}
+
+var purposeCodeRegexp = regexp.MustCompile(`^[a-zA-Z0-9_.:-]+$`)
+
+// Validate checks that the purpose has a code consisting of letters, digits and the characters
+// _ . : - and a nonempty text in at least one language.
+func (p *Purpose) Validate() error {
+	if !purposeCodeRegexp.MatchString(p.Code) {
+		return errors.Errorf("invalid purpose code %q", p.Code)
+	}
+	for _, text := range p.Text {
+		if text != "" {
+			return nil
+		}
+	}
+	return errors.New("purpose must have a text")
 }
 
 type NextSessionData struct {
@@ -151,9 +192,16 @@ type RequestorRequest interface {
 func (r *RequestorBaseRequest) SetDefaultsIfNecessary() {
 	if r.ResultJwtValidity == 0 {
 		r.ResultJwtValidity = DefaultJwtValidity
+		r.defaultResultJwtValidity = true
 	}
 }
 
+// ResultJwtValiditySet returns whether the requestor specified the validity of the result JWT,
+// instead of it having the default value set by SetDefaultsIfNecessary().
+func (r *RequestorBaseRequest) ResultJwtValiditySet() bool {
+	return r.ResultJwtValidity != 0 && !(r.defaultResultJwtValidity && r.ResultJwtValidity == DefaultJwtValidity)
+}
+
 // A ServiceProviderRequest contains a disclosure request.
 type ServiceProviderRequest struct {
 	RequestorBaseRequest
@@ -172,6 +220,68 @@ type IdentityProviderRequest struct {
 	Request *IssuanceRequest `json:"request"`
 }
 
+// Constructors of the RequestorRequest types used by sessions of each action, see
+// RegisterRequestorRequest().
+var (
+	requestorRequestsMutex sync.RWMutex
+	requestorRequests      = map[Action]func() RequestorRequest{
+		ActionDisclosing: func() RequestorRequest { return &ServiceProviderRequest{} },
+		ActionSigning:    func() RequestorRequest { return &SignatureRequestorRequest{} },
+		ActionIssuing:    func() RequestorRequest { return &IdentityProviderRequest{} },
+	}
+)
+
+// RegisterRequestorRequest registers the constructor of the RequestorRequest type used by sessions
+// of the specified action, overriding any earlier registration for the action. NewRequestorRequest()
+// uses the registered constructors e.g. when deserializing sessions.
+func RegisterRequestorRequest(action Action, constructor func() RequestorRequest) {
+	requestorRequestsMutex.Lock()
+	defer requestorRequestsMutex.Unlock()
+	requestorRequests[action] = constructor
+}
+
+// NewRequestorRequest returns a new, empty instance of the RequestorRequest type registered for
+// the specified action, into which requests of sessions of the action can be unmarshaled.
+func NewRequestorRequest(action Action) (RequestorRequest, error) {
+	requestorRequestsMutex.RLock()
+	constructor, ok := requestorRequests[action]
+	requestorRequestsMutex.RUnlock()
+	if !ok {
+		return nil, errors.Errorf("no requestor request type registered for action %s", action)
+	}
+	return constructor(), nil
+}
+
+// UnmarshalJSONStrict unmarshals the requestor request, refusing unknown fields.
+func (r *ServiceProviderRequest) UnmarshalJSONStrict(bts []byte) error {
+	r.Request = &DisclosureRequest{}
+	return unmarshalRequestorRequestStrict(bts, &r.RequestorBaseRequest, r.Request)
+}
+
+// UnmarshalJSONStrict unmarshals the requestor request, refusing unknown fields.
+func (r *SignatureRequestorRequest) UnmarshalJSONStrict(bts []byte) error {
+	r.Request = &SignatureRequest{}
+	return unmarshalRequestorRequestStrict(bts, &r.RequestorBaseRequest, r.Request)
+}
+
+// UnmarshalJSONStrict unmarshals the requestor request, refusing unknown fields.
+func (r *IdentityProviderRequest) UnmarshalJSONStrict(bts []byte) error {
+	r.Request = &IssuanceRequest{}
+	return unmarshalRequestorRequestStrict(bts, &r.RequestorBaseRequest, r.Request)
+}
+
+func unmarshalRequestorRequestStrict(bts []byte, base *RequestorBaseRequest, request StrictUnmarshaler) error {
+	var temp struct {
+		RequestorBaseRequest
+		Request json.RawMessage `json:"request"`
+	}
+	if err := unmarshalJSON(bts, &temp, true); err != nil {
+		return err
+	}
+	*base = temp.RequestorBaseRequest
+	return request.UnmarshalJSONStrict(temp.Request)
+}
+
 // ServiceProviderJwt is a requestor JWT for a disclosure session.
 type ServiceProviderJwt struct {
 	ServerJwt
@@ -241,6 +351,9 @@ type FrontendSessionRequest struct {
 	MinProtocolVersion *ProtocolVersion `json:"minProtocolVersion"`
 	// MaxProtocolVersion that the server supports for the frontend protocol.
 	MaxProtocolVersion *ProtocolVersion `json:"maxProtocolVersion"`
+	// URL of the session at which the frontend endpoints are available, if the server serves
+	// them separately from the endpoints for the IRMA app at the URL in the session pointer.
+	URL string `json:"url,omitempty"`
 }
 
 type RevocationRequest struct {
@@ -248,6 +361,8 @@ type RevocationRequest struct {
 	CredentialType CredentialTypeIdentifier `json:"type"`
 	Key            string                   `json:"revocationKey,omitempty"`
 	Issued         int64                    `json:"issued,omitempty"`
+	// If true, the issuance records of the revocation key are purged instead of revoked
+	Purge bool `json:"purge,omitempty"`
 }
 
 type NonRevocationRequest struct {
@@ -261,6 +376,36 @@ type SessionOptions struct {
 	LDContext     string        `json:"@context,omitempty"`
 	PairingMethod PairingMethod `json:"pairingMethod"`
 	PairingCode   string        `json:"pairingCode,omitempty"`
+	// Human-readable code shown both on the requestor's web page and in the IRMA app, allowing users
+	// to check that the session in their app belongs to the web page in front of them
+	BindingCode string `json:"bindingCode,omitempty"`
+	// Whether the server requires pairing for this session, in which case the frontend cannot
+	// disable it
+	PairingRequired bool `json:"pairingRequired,omitempty"`
+	// Capabilities of the server for this session, so that frontends need not derive them from
+	// the server version
+	Features *SessionFeatures `json:"features,omitempty"`
+}
+
+// SessionFeatures advertises the capabilities of the server for a particular session to the frontend.
+type SessionFeatures struct {
+	// Pairing methods that the frontend may choose from
+	PairingMethods []PairingMethod `json:"pairingMethods"`
+	// Whether status updates are available as server-sent events; if not, the frontend must poll
+	SSE bool `json:"sse"`
+	// Whether another session follows this one after it completes
+	ChainedSession bool `json:"chainedSession,omitempty"`
+	// Statuses through which the session is expected to progress if it succeeds
+	ExpectedStatuses []ServerStatus `json:"expectedStatuses"`
+}
+
+// UpdateExpectedStatuses updates the expected statuses of the session to the pairing method.
+func (f *SessionFeatures) UpdateExpectedStatuses(pairingMethod PairingMethod) {
+	f.ExpectedStatuses = []ServerStatus{ServerStatusInitialized}
+	if pairingMethod != PairingMethodNone {
+		f.ExpectedStatuses = append(f.ExpectedStatuses, ServerStatusPairing)
+	}
+	f.ExpectedStatuses = append(f.ExpectedStatuses, ServerStatusConnected, ServerStatusDone)
 }
 
 // ClientSessionRequest contains all information irmaclient needs to know to initiate a session.
@@ -304,8 +449,8 @@ func (n *NonRevocationParameters) MarshalJSON() ([]byte, error) {
 }
 
 func (r *RevocationRequest) Validate() error {
-	if r.LDContext != LDContextRevocationRequest {
-		return errors.New("not a revocation request")
+	if err := ValidateLDContext(r.LDContext, nil, LDContextRevocationRequest); err != nil {
+		return errors.WrapPrefix(err, "not a revocation request", 0)
 	}
 	return nil
 }
@@ -326,7 +471,7 @@ func (b *BaseRequest) GetContext() *big.Int {
 	return b.Context
 }
 
-func (b *BaseRequest) GetNonce(*atum.Timestamp) *big.Int {
+func (b *BaseRequest) GetNonce(*SignatureTimestamp) *big.Int {
 	if b.Nonce == nil {
 		return bigZero
 	}
@@ -434,7 +579,14 @@ func (c AttributeCon) Satisfy(proofs gabi.ProofList, indices []*DisclosedAttribu
 
 	for j := range c {
 		index := indices[j]
-		attr, val, err := extractAttribute(proofs, index, revocation[index.CredentialIndex], conf)
+		var attr *DisclosedAttribute
+		var val *string
+		var err error
+		if c[j].Type.IsMetadataAttribute() {
+			attr, val, err = extractMetadataAttribute(proofs, index, c[j].Type, revocation[index.CredentialIndex], conf)
+		} else {
+			attr, val, err = extractAttribute(proofs, index, revocation[index.CredentialIndex], conf)
+		}
 		if err != nil {
 			return false, nil, err
 		}
@@ -604,8 +756,8 @@ func (dr *DisclosureRequest) IsDisclosureRequest() bool {
 }
 
 func (dr *DisclosureRequest) Validate() error {
-	if !dr.IsDisclosureRequest() {
-		return errors.New("Not a disclosure request")
+	if err := ValidateLDContext(dr.LDContext, nil, LDContextDisclosureRequest); err != nil {
+		return errors.WrapPrefix(err, "Not a disclosure request", 0)
 	}
 	if len(dr.Identifiers().AttributeTypes) == 0 {
 		return errors.New("Disclosure request had no attributes")
@@ -669,6 +821,11 @@ func (cr *CredentialRequest) Validate(conf *Configuration) error {
 		if present && attrtype.RandomBlind {
 			return &SessionError{ErrorType: ErrorRandomBlind, Err: errors.New("randomblind attribute cannot be set in credential request")}
 		}
+		if present {
+			if err := attrtype.DataType.Validate(cr.Attributes[attrtype.ID]); err != nil {
+				return &SessionError{ErrorType: ErrorInvalidRequest, Err: errors.WrapPrefix(err, "attribute "+attrtype.ID, 0)}
+			}
+		}
 	}
 
 	// Check that the random blind attributes match between client configuration / CredentialRequest
@@ -737,8 +894,8 @@ func (cr *CredentialRequest) AttributeList(
 			// Set attribute to str << 1 + 1
 			attrs[i+1].SetBytes([]byte(str))
 			if meta.Version() >= 0x03 {
-				attrs[i+1].Lsh(attrs[i+1], 1)             // attr <<= 1
-				attrs[i+1].Add(attrs[i+1], big.NewInt(1)) // attr += 1
+				attrs[i+1].Lsh(attrs[i+1], 1)      // attr <<= 1
+				attrs[i+1].Add(attrs[i+1], bigOne) // attr += 1
 			}
 		}
 	}
@@ -792,8 +949,8 @@ func (ir *IssuanceRequest) GetCredentialInfoList(
 func (ir *IssuanceRequest) Action() Action { return ActionIssuing }
 
 func (ir *IssuanceRequest) Validate() error {
-	if ir.LDContext != LDContextIssuanceRequest {
-		return errors.New("Not an issuance request")
+	if err := ValidateLDContext(ir.LDContext, nil, LDContextIssuanceRequest); err != nil {
+		return errors.WrapPrefix(err, "Not an issuance request", 0)
 	}
 	if len(ir.Credentials) == 0 {
 		return errors.New("Empty issuance request")
@@ -815,11 +972,11 @@ func (ir *IssuanceRequest) Validate() error {
 
 // GetNonce returns the nonce of this signature session
 // (with the message already hashed into it).
-func (sr *SignatureRequest) GetNonce(timestamp *atum.Timestamp) *big.Int {
+func (sr *SignatureRequest) GetNonce(timestamp *SignatureTimestamp) *big.Int {
 	return ASN1ConvertSignatureNonce(sr.Message, sr.BaseRequest.GetNonce(nil), timestamp)
 }
 
-func (sr *SignatureRequest) SignatureFromMessage(message interface{}, timestamp *atum.Timestamp) (*SignedMessage, error) {
+func (sr *SignatureRequest) SignatureFromMessage(message interface{}, timestamp *SignatureTimestamp) (*SignedMessage, error) {
 	signature, ok := message.(*Disclosure)
 
 	if !ok {
@@ -830,15 +987,18 @@ func (sr *SignatureRequest) SignatureFromMessage(message interface{}, timestamp
 	if nonce == nil {
 		nonce = bigZero
 	}
-	return &SignedMessage{
+	signed := &SignedMessage{
 		LDContext: LDContextSignedMessage,
 		Signature: signature.Proofs,
 		Indices:   signature.Indices,
 		Nonce:     nonce,
 		Context:   sr.GetContext(),
 		Message:   sr.Message,
-		Timestamp: timestamp,
-	}, nil
+	}
+	if timestamp != nil {
+		signed.Timestamp, signed.TSATimestamp = timestamp.Atum, timestamp.TSA
+	}
+	return signed, nil
 }
 
 func (sr *SignatureRequest) Action() Action { return ActionSigning }
@@ -848,8 +1008,8 @@ func (sr *SignatureRequest) IsSignatureRequest() bool {
 }
 
 func (sr *SignatureRequest) Validate() error {
-	if !sr.IsSignatureRequest() {
-		return errors.New("Not a signature request")
+	if err := ValidateLDContext(sr.LDContext, nil, LDContextSignatureRequest); err != nil {
+		return errors.WrapPrefix(err, "Not a signature request", 0)
 	}
 	if sr.Message == "" {
 		return errors.New("Signature request had empty message")
@@ -961,10 +1121,7 @@ func NewServiceProviderJwt(servername string, dr *DisclosureRequest) *ServicePro
 			IssuedAt:   Timestamp(time.Now()),
 			Type:       "verification_request",
 		},
-		Request: &ServiceProviderRequest{
-			RequestorBaseRequest: RequestorBaseRequest{ResultJwtValidity: DefaultJwtValidity},
-			Request:              dr,
-		},
+		Request: &ServiceProviderRequest{Request: dr},
 	}
 }
 
@@ -976,10 +1133,7 @@ func NewSignatureRequestorJwt(servername string, sr *SignatureRequest) *Signatur
 			IssuedAt:   Timestamp(time.Now()),
 			Type:       "signature_request",
 		},
-		Request: &SignatureRequestorRequest{
-			RequestorBaseRequest: RequestorBaseRequest{ResultJwtValidity: DefaultJwtValidity},
-			Request:              sr,
-		},
+		Request: &SignatureRequestorRequest{Request: sr},
 	}
 }
 
@@ -991,10 +1145,7 @@ func NewIdentityProviderJwt(servername string, ir *IssuanceRequest) *IdentityPro
 			IssuedAt:   Timestamp(time.Now()),
 			Type:       "issue_request",
 		},
-		Request: &IdentityProviderRequest{
-			RequestorBaseRequest: RequestorBaseRequest{ResultJwtValidity: DefaultJwtValidity},
-			Request:              ir,
-		},
+		Request: &IdentityProviderRequest{Request: ir},
 	}
 }
 
@@ -1134,17 +1285,28 @@ func SignSessionRequest(request SessionRequest, alg jwt.SigningMethod, key inter
 }
 
 func SignRequestorRequest(request RequestorRequest, alg jwt.SigningMethod, key interface{}, name string) (string, error) {
+	return SignRequestorRequestWithAudience(request, alg, key, name, "")
+}
+
+// SignRequestorRequestWithAudience signs the request like SignRequestorRequest(), including the
+// specified audience as aud claim, i.e. the URL of the IRMA server for which the JWT is intended.
+func SignRequestorRequestWithAudience(
+	request RequestorRequest, alg jwt.SigningMethod, key interface{}, name, audience string,
+) (string, error) {
 	var jwtcontents RequestorJwt
 	switch r := request.(type) {
 	case *IdentityProviderRequest:
-		jwtcontents = NewIdentityProviderJwt(name, nil)
-		jwtcontents.(*IdentityProviderJwt).Request = r
+		j := NewIdentityProviderJwt(name, nil)
+		j.Request, j.Audience = r, audience
+		jwtcontents = j
 	case *ServiceProviderRequest:
-		jwtcontents = NewServiceProviderJwt(name, nil)
-		jwtcontents.(*ServiceProviderJwt).Request = r
+		j := NewServiceProviderJwt(name, nil)
+		j.Request, j.Audience = r, audience
+		jwtcontents = j
 	case *SignatureRequestorRequest:
-		jwtcontents = NewSignatureRequestorJwt(name, nil)
-		jwtcontents.(*SignatureRequestorJwt).Request = r
+		j := NewSignatureRequestorJwt(name, nil)
+		j.Request, j.Audience = r, audience
+		jwtcontents = j
 	}
 	return jwtcontents.Sign(alg, key)
 }
@@ -1163,8 +1325,8 @@ func NewFrontendOptionsRequest() FrontendOptionsRequest {
 }
 
 func (or *FrontendOptionsRequest) Validate() error {
-	if or.LDContext != LDContextFrontendOptionsRequest {
-		return errors.New("Not a frontend options request")
+	if err := ValidateLDContext(or.LDContext, nil, LDContextFrontendOptionsRequest); err != nil {
+		return errors.WrapPrefix(err, "Not a frontend options request", 0)
 	}
 	return nil
 }
@@ -1195,8 +1357,13 @@ func (cr *ClientSessionRequest) UnmarshalJSON(data []byte) error {
 }
 
 func (cr *ClientSessionRequest) Validate() error {
-	if cr.LDContext != LDContextClientSessionRequest {
-		return errors.New("Not a client request")
+	if err := ValidateLDContext(cr.LDContext, nil, LDContextClientSessionRequest); err != nil {
+		return errors.WrapPrefix(err, "Not a client request", 0)
+	}
+	if cr.Options != nil {
+		if err := ValidateLDContext(cr.Options.LDContext, nil, LDContextSessionOptions); err != nil {
+			return errors.WrapPrefix(err, "Invalid session options", 0)
+		}
 	}
 	// The 'Request' field is not required. When this field is empty, we have to skip the validation.
 	// We cannot detect this easily, because in Go empty structs are automatically populated with
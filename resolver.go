@@ -0,0 +1,124 @@
+package irma
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+)
+
+const dohContentType = "application/dns-message"
+
+// resolverAddress returns the address (host:port) of the DNS server of the settings, or "" if DoH
+// or the system resolver is used.
+func (settings HTTPClientSettings) resolverAddress() (string, error) {
+	if settings.Resolver == "" || strings.HasPrefix(settings.Resolver, "https://") {
+		return "", nil
+	}
+	if _, _, err := net.SplitHostPort(settings.Resolver); err == nil {
+		return settings.Resolver, nil
+	}
+	if strings.Contains(settings.Resolver, "/") {
+		return "", errors.New("Invalid HTTP client resolver, must be host[:port] of a DNS server or https:// URL of a DoH server")
+	}
+	return net.JoinHostPort(strings.Trim(settings.Resolver, "[]"), "53"), nil
+}
+
+// resolver returns the resolver to use for outbound connections, or nil for the system resolver.
+// It queries either a DNS server or a DNS-over-HTTPS (DoH, RFC 8484) server. A DoH server is contacted trusting the specified CAs, or those of the system if nil.
+func (settings HTTPClientSettings) resolver(rootCAs *x509.CertPool) *net.Resolver {
+	if settings.Resolver == "" {
+		return nil
+	}
+	if strings.HasPrefix(settings.Resolver, "https://") {
+		client := &http.Client{
+			Timeout: time.Duration(settings.Timeout) * time.Millisecond,
+			Transport: &http.Transport{
+				Proxy:             settings.proxy(),
+				TLSClientConfig:   &tls.Config{RootCAs: rootCAs},
+				ForceAttemptHTTP2: true,
+			},
+		}
+		return &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return &dohConn{ctx: ctx, client: client, url: settings.Resolver}, nil
+			},
+		}
+	}
+	address, _ := settings.resolverAddress() // validated in NewHTTPClient()
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// dohConn is a net.Conn that sends each DNS query written to it to a DoH server, and from which
+// the response of the DoH server is read. As it is not a net.PacketConn, the resolver of the
+// standard library prefixes the DNS messages with their length, as over TCP.
+type dohConn struct {
+	ctx      context.Context
+	client   *http.Client
+	url      string
+	response bytes.Buffer
+}
+
+func (c *dohConn) Write(b []byte) (int, error) {
+	if len(b) < 2 || int(binary.BigEndian.Uint16(b)) != len(b)-2 {
+		return 0, errors.New("incomplete DNS query")
+	}
+
+	req, err := http.NewRequestWithContext(c.ctx, http.MethodPost, c.url, bytes.NewReader(b[2:]))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", dohContentType)
+	req.Header.Set("Accept", dohContentType)
+	res, err := c.client.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer func() { _ = res.Body.Close() }()
+	if res.StatusCode != http.StatusOK {
+		return 0, errors.Errorf("DoH server responded with status %d", res.StatusCode)
+	}
+	response, err := io.ReadAll(io.LimitReader(res.Body, 65535))
+	if err != nil {
+		return 0, err
+	}
+
+	c.response.Reset()
+	_ = binary.Write(&c.response, binary.BigEndian, uint16(len(response)))
+	c.response.Write(response)
+	return len(b), nil
+}
+
+func (c *dohConn) Read(b []byte) (int, error) {
+	return c.response.Read(b)
+}
+
+func (c *dohConn) Close() error         { return nil }
+func (c *dohConn) LocalAddr() net.Addr  { return dohAddr("") }
+func (c *dohConn) RemoteAddr() net.Addr { return dohAddr(c.url) }
+
+// Deadlines are ignored, as the requests to the DoH server are bounded by the context of the
+// resolver and the timeout of the HTTP client.
+func (c *dohConn) SetDeadline(time.Time) error      { return nil }
+func (c *dohConn) SetReadDeadline(time.Time) error  { return nil }
+func (c *dohConn) SetWriteDeadline(time.Time) error { return nil }
+
+type dohAddr string
+
+func (a dohAddr) Network() string { return "doh" }
+func (a dohAddr) String() string  { return string(a) }
@@ -18,6 +18,7 @@ import (
 	"github.com/privacybydesign/gabi/revocation"
 	"github.com/privacybydesign/gabi/signed"
 	sseclient "github.com/sietseringers/go-sse"
+	"github.com/sirupsen/logrus"
 )
 
 type (
@@ -58,6 +59,10 @@ type (
 		RevocationServerURL string `json:"revocation_server_url,omitempty" mapstructure:"revocation_server_url"`
 		Tolerance           uint64 `json:"tolerance,omitempty" mapstructure:"tolerance"` // in seconds, min 30
 		SSE                 bool   `json:"sse,omitempty" mapstructure:"sse"`
+		// Number of days after issuance after which issuance records are deleted, even if the
+		// credential has not yet expired (after which it can no longer be revoked). If 0,
+		// issuance records are deleted when the credential expires.
+		Retention uint `json:"retention,omitempty" mapstructure:"retention"`
 
 		// set to now whenever a new update is received, or when the RA indicates
 		// there are no new updates. Thus it specifies up to what time our nonrevocation
@@ -278,12 +283,59 @@ func (rs *RevocationStorage) AddIssuanceRecord(r *IssuanceRecord) error {
 	return rs.recordStorage.AddIssuanceRecord(r)
 }
 
+// AddIssuanceRecords stores the given issuance records, either all of them or none of them.
+func (rs *RevocationStorage) AddIssuanceRecords(records []*IssuanceRecord) error {
+	return rs.recordStorage.AddIssuanceRecords(records)
+}
+
 // IssuanceRecords returns all issuance records matching the given credential type, revocation key and issuance time.
 // If the given issuance time is zero, then the issuance time is being ignored as condition.
 func (rs *RevocationStorage) IssuanceRecords(id CredentialTypeIdentifier, key string, issued time.Time) ([]*IssuanceRecord, error) {
 	return rs.recordStorage.IssuanceRecords(id, key, issued)
 }
 
+// PurgeIssuanceRecords deletes all issuance records of the credential type with the given
+// revocation key, e.g. to honour a request for erasure of the personal data from which the key is
+// derived. Credentials whose issuance record is purged can no longer be revoked, so revoke them
+// first if necessary. The accumulators and revocation events are unaffected, as these do not
+// contain revocation keys.
+func (rs *RevocationStorage) PurgeIssuanceRecords(id CredentialTypeIdentifier, key string) error {
+	if !rs.settings.Get(id).Authority {
+		return errors.Errorf("cannot purge issuance records of %s", id)
+	}
+	if key == "" {
+		return errors.New("cannot purge issuance records: no revocation key specified")
+	}
+	count, err := rs.recordStorage.DeleteIssuanceRecords(id, key, time.Time{})
+	if err != nil {
+		return err
+	}
+	if count == 0 {
+		return ErrUnknownRevocationKey
+	}
+	// Log the purge for auditing, but not the revocation key, as that is what is being purged
+	Logger.WithFields(logrus.Fields{"credtype": id, "count": count}).Info("Purged issuance records")
+	return nil
+}
+
+// deleteRetainedIssuanceRecords deletes the issuance records whose retention period has passed.
+func (rs *RevocationStorage) deleteRetainedIssuanceRecords() error {
+	for id, settings := range rs.settings {
+		if !settings.Authority || settings.Retention == 0 {
+			continue
+		}
+		before := time.Now().AddDate(0, 0, -int(settings.Retention))
+		count, err := rs.recordStorage.DeleteIssuanceRecords(id, "", before)
+		if err != nil {
+			return err
+		}
+		if count > 0 {
+			Logger.WithFields(logrus.Fields{"credtype": id, "count": count}).Info("Deleted issuance records after retention period")
+		}
+	}
+	return nil
+}
+
 // Revocation methods
 
 // Revoke revokes the credential(s) specified by key and issued, if found within the current revocation storage.
@@ -514,25 +566,72 @@ func (rs *RevocationStorage) SyncIfOld(id CredentialTypeIdentifier, maxage uint6
 // SaveIssuanceRecord either stores the issuance record locally, if we are the revocation server of
 // the crecential type, or it signs and sends it to the remote revocation server.
 func (rs *RevocationStorage) SaveIssuanceRecord(id CredentialTypeIdentifier, rec *IssuanceRecord, sk *gabikeys.PrivateKey) error {
-	credtype := rs.conf.CredentialTypes[id]
-	if credtype == nil {
-		return ErrorUnknownCredentialType
-	}
-	if !credtype.RevocationSupported() {
-		return errors.New("cannot save issuance record: credential type does not support revocation")
+	authority, err := rs.issuanceRecordAuthority(id)
+	if err != nil {
+		return err
 	}
 
 	// Just store it if we are the revocation server for this credential type
-	settings := rs.settings.Get(id)
-	if settings.Authority {
+	if authority {
 		return rs.AddIssuanceRecord(rec)
 	}
 
 	// We have to send it, sign it first
-	if settings.RevocationServerURL == "" {
-		return errors.New("cannot send issuance record: no server_url configured")
+	return rs.client.PostIssuanceRecord(id, sk, rec, rs.settings.Get(id).RevocationServerURL)
+}
+
+// SaveIssuanceRecords saves the issuance records of the credentials issued in a single session,
+// like SaveIssuanceRecord. The records of which we are the revocation server are stored in a single
+// transaction, after all other records have been sent to their revocation servers, so that none of
+// them are stored if sending one of them fails. Records already sent to a remote revocation server
+// cannot be withdrawn; as the corresponding credentials are not issued, these are never used, and
+// they are deleted by the revocation server once they expire.
+func (rs *RevocationStorage) SaveIssuanceRecords(records []*IssuanceRecord) error {
+	var local []*IssuanceRecord
+	for _, rec := range records {
+		authority, err := rs.issuanceRecordAuthority(rec.CredType)
+		if err != nil {
+			return err
+		}
+		if authority {
+			local = append(local, rec)
+		}
+	}
+
+	for _, rec := range records {
+		if rs.settings.Get(rec.CredType).Authority {
+			continue
+		}
+		sk, err := rs.Keys.PrivateKey(rec.CredType.IssuerIdentifier(), *rec.PKCounter)
+		if err != nil {
+			return err
+		}
+		if err = rs.client.PostIssuanceRecord(rec.CredType, sk, rec, rs.settings.Get(rec.CredType).RevocationServerURL); err != nil {
+			return err
+		}
+	}
+
+	if len(local) == 0 {
+		return nil
 	}
-	return rs.client.PostIssuanceRecord(id, sk, rec, settings.RevocationServerURL)
+	return rs.AddIssuanceRecords(local)
+}
+
+// issuanceRecordAuthority checks that issuance records of the credential type can be saved,
+// and returns whether we are the revocation server of the credential type.
+func (rs *RevocationStorage) issuanceRecordAuthority(id CredentialTypeIdentifier) (bool, error) {
+	credtype := rs.conf.CredentialTypes[id]
+	if credtype == nil {
+		return false, ErrorUnknownCredentialType
+	}
+	if !credtype.RevocationSupported() {
+		return false, errors.New("cannot save issuance record: credential type does not support revocation")
+	}
+	settings := rs.settings.Get(id)
+	if !settings.Authority && settings.RevocationServerURL == "" {
+		return false, errors.New("cannot send issuance record: no server_url configured")
+	}
+	return settings.Authority, nil
 }
 
 // Misscelaneous methods
@@ -619,6 +718,15 @@ func (rs *RevocationStorage) Load(debug bool, dbtype, connstr string, settings R
 				return errors.Errorf("revocation authority mode for %s cannot be combined with URL", id.String())
 			}
 		}
+		if rs.conf.HTTPClient.Disabled() {
+			// SSE updates are received using a client other than HTTPTransport, so check this here
+			if s.SSE {
+				return errors.Errorf("revocation update events (SSE) for %s require outbound network access, which is disabled", id.String())
+			}
+			if !s.Authority && s.Server {
+				return errors.Errorf("revocation server mode for %s requires outbound network access to %s, which is disabled", id.String(), s.RevocationServerURL)
+			}
+		}
 		if s.Server {
 			t = &id
 		}
@@ -652,6 +760,9 @@ func (rs *RevocationStorage) Load(debug bool, dbtype, connstr string, settings R
 		if err := rs.recordStorage.DeleteExpiredIssuanceRecords(); err != nil {
 			Logger.WithField("error", err).Error("failed to delete expired issuance records")
 		}
+		if err := rs.deleteRetainedIssuanceRecords(); err != nil {
+			Logger.WithField("error", err).Error("failed to delete issuance records after retention period")
+		}
 	}); err != nil {
 		return err
 	}
@@ -869,7 +980,7 @@ func (client RevocationClient) getMultiple(urls []string, path string, dest inte
 
 func (client RevocationClient) transport(forceHTTPS bool) *HTTPTransport {
 	if client.http == nil {
-		client.http = NewHTTPTransport("", forceHTTPS)
+		client.http = client.Conf.HTTPClient.NewTransport("", forceHTTPS)
 		client.http.Binary = true
 	}
 	return client.http
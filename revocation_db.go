@@ -60,6 +60,8 @@ type (
 
 		// AddIssuanceRecord adds the given issuance record to the revocation storage.
 		AddIssuanceRecord(*IssuanceRecord) error
+		// AddIssuanceRecords adds the given issuance records to the revocation storage, either all of them or none of them.
+		AddIssuanceRecords([]*IssuanceRecord) error
 		// IssuanceRecords returns all issuance records matching the given credential type, revocation key and issuance time.
 		// If the given issuance time is zero, then the issuance time is being ignored as condition.
 		IssuanceRecords(id CredentialTypeIdentifier, key string, issued time.Time) ([]*IssuanceRecord, error)
@@ -67,6 +69,10 @@ type (
 		UpdateIssuanceRecord(id CredentialTypeIdentifier, key string, issued time.Time, handler func([]*IssuanceRecord) error) error
 		// DeleteExpiredIssuanceRecords deletes all issuance records for which ValidUntil has passed the current time.
 		DeleteExpiredIssuanceRecords() error
+		// DeleteIssuanceRecords deletes the issuance records of the given credential type matching the given
+		// revocation key, if not empty, and issued before the given time, if not zero. It returns the number
+		// of deleted records.
+		DeleteIssuanceRecords(id CredentialTypeIdentifier, key string, issuedBefore time.Time) (int64, error)
 	}
 
 	// sqlRevStorage is a wrapper around gorm, storing any record type in a SQL database,
@@ -341,6 +347,19 @@ func (s sqlRevStorage) AddIssuanceRecord(r *IssuanceRecord) error {
 	return nil
 }
 
+// AddIssuanceRecords implements revocationRecordStorage interface.
+func (s sqlRevStorage) AddIssuanceRecords(records []*IssuanceRecord) error {
+	return s.gorm.Transaction(func(tx *gorm.DB) error {
+		for _, r := range records {
+			if err := tx.Create(r).Error; err != nil {
+				Logger.WithError(err).Error("Failed to add issuance record to database")
+				return errRevocationDB
+			}
+		}
+		return nil
+	})
+}
+
 // IssuanceRecord implements revocationRecordStorage interface.
 func (s sqlRevStorage) IssuanceRecords(id CredentialTypeIdentifier, key string, issued time.Time) ([]*IssuanceRecord, error) {
 	return txIssuanceRecords(s.gorm, id, key, issued)
@@ -378,6 +397,26 @@ func (s sqlRevStorage) DeleteExpiredIssuanceRecords() error {
 	return nil
 }
 
+// DeleteIssuanceRecords implements revocationRecordStorage interface.
+func (s sqlRevStorage) DeleteIssuanceRecords(id CredentialTypeIdentifier, key string, issuedBefore time.Time) (int64, error) {
+	if key == "" && issuedBefore.IsZero() {
+		return 0, errors.New("refusing to delete all issuance records")
+	}
+	query := s.gorm.Where("cred_type = ?", id)
+	if key != "" {
+		query = query.Where("revocationkey = ?", key)
+	}
+	if !issuedBefore.IsZero() {
+		query = query.Where("issued < ?", issuedBefore.UnixNano())
+	}
+	result := query.Delete(IssuanceRecord{})
+	if result.Error != nil {
+		Logger.WithError(result.Error).Error("Failed to delete issuance records from database")
+		return 0, errRevocationDB
+	}
+	return result.RowsAffected, nil
+}
+
 // txIssuanceRecords returns all issuance records matching the given credential type, revocation key and issuance time within
 // the given GORM database transaction. If the given issuance time is zero, then the issuance time is being ignored as condition.
 func txIssuanceRecords(tx *gorm.DB, id CredentialTypeIdentifier, key string, issued time.Time) ([]*IssuanceRecord, error) {
@@ -543,6 +582,13 @@ func (m *memRevStorage) AddIssuanceRecord(r *IssuanceRecord) error {
 	return errors.New("not implemented")
 }
 
+// AddIssuanceRecords implements revocationRecordStorage interface.
+// This functionality is not implemented to prevent misconfiguration.
+// The memRevStorage is not persistent after a restart, which is important for the storage of issuance records.
+func (m *memRevStorage) AddIssuanceRecords(records []*IssuanceRecord) error {
+	return errors.New("not implemented")
+}
+
 // IssuanceRecords implements revocationRecordStorage interface.
 // This functionality is not implemented to prevent misconfiguration.
 // The memRevStorage is not persistent after a restart, which is important for the storage of issuance records.
@@ -563,6 +609,12 @@ func (m *memRevStorage) DeleteExpiredIssuanceRecords() error {
 	return nil
 }
 
+// DeleteIssuanceRecords implements revocationRecordStorage interface.
+func (m *memRevStorage) DeleteIssuanceRecords(id CredentialTypeIdentifier, key string, issuedBefore time.Time) (int64, error) {
+	// The memRevStorage does not support storing issuance records, so nothing has to be deleted.
+	return 0, nil
+}
+
 // Utility functions for memRevStorage
 
 func copyEvents(events []*revocation.Event) []*revocation.Event {
@@ -0,0 +1,439 @@
+package irma
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"io"
+	gobig "math/big"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+const (
+	TSARequestContentType  = "application/timestamp-query"
+	TSAResponseContentType = "application/timestamp-reply"
+)
+
+var (
+	oidSignedData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidTSTInfo             = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 16, 1, 4}
+	oidAttrContentType     = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidSHA256              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512              = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+	oidRSAEncryption       = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidECPublicKey         = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+	tsaDigestAlgorithms    = map[crypto.Hash]asn1.ObjectIdentifier{crypto.SHA256: oidSHA256, crypto.SHA384: oidSHA384, crypto.SHA512: oidSHA512}
+	tsaSignatureAlgorithms = []struct {
+		oid    asn1.ObjectIdentifier
+		digest crypto.Hash // for algorithms of which the OID does not specify the hash function
+		alg    x509.SignatureAlgorithm
+	}{
+		{oidRSAEncryption, crypto.SHA256, x509.SHA256WithRSA},
+		{oidRSAEncryption, crypto.SHA384, x509.SHA384WithRSA},
+		{oidRSAEncryption, crypto.SHA512, x509.SHA512WithRSA},
+		{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 11}, 0, x509.SHA256WithRSA},
+		{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 12}, 0, x509.SHA384WithRSA},
+		{asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 13}, 0, x509.SHA512WithRSA},
+		{oidECPublicKey, crypto.SHA256, x509.ECDSAWithSHA256},
+		{oidECPublicKey, crypto.SHA384, x509.ECDSAWithSHA384},
+		{oidECPublicKey, crypto.SHA512, x509.ECDSAWithSHA512},
+		{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}, 0, x509.ECDSAWithSHA256},
+		{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 3}, 0, x509.ECDSAWithSHA384},
+		{asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 4}, 0, x509.ECDSAWithSHA512},
+		{asn1.ObjectIdentifier{1, 3, 101, 112}, 0, x509.PureEd25519},
+	}
+)
+
+// SchemeTSA specifies RFC 3161 timestamp authorities (TSAs) that are used for timestamping
+// attribute-based signatures over attributes of the scheme, instead of its TimestampServer.
+// Redundant TSAs can be specified by multiple URLs, which are tried in order.
+type SchemeTSA struct {
+	URLs         []string `xml:"Url"`
+	Certificates []string `xml:"Certificate"` // PEM-encoded root certificates of the TSAs
+
+	once  sync.Once
+	roots *x509.CertPool
+	err   error
+}
+
+// TSATimestamp is an RFC 3161 timestamp over an attribute-based signature, along with the
+// certificate chain of the TSA that created it, so that it can be verified offline against the
+// root certificates of the TSA.
+type TSATimestamp struct {
+	Token        []byte   `json:"token"`                  // DER-encoded TimeStampToken
+	Certificates [][]byte `json:"certificates,omitempty"` // DER-encoded certificate chain of the TSA
+}
+
+type tsaMessageImprint struct {
+	HashAlgorithm pkix.AlgorithmIdentifier
+	HashedMessage []byte
+}
+
+type tsaRequest struct {
+	Version        int
+	MessageImprint tsaMessageImprint
+	Nonce          *gobig.Int `asn1:"optional"`
+	CertReq        bool       `asn1:"optional"`
+}
+
+type tsaResponse struct {
+	Status struct {
+		Status       int
+		StatusString []string       `asn1:"optional"`
+		FailInfo     asn1.BitString `asn1:"optional"`
+	}
+	TimeStampToken asn1.RawValue `asn1:"optional"`
+}
+
+type tsaAccuracy struct {
+	Seconds int `asn1:"optional"`
+	Millis  int `asn1:"optional,tag:0"`
+	Micros  int `asn1:"optional,tag:1"`
+}
+
+type tsaTSTInfo struct {
+	Version        int
+	Policy         asn1.ObjectIdentifier
+	MessageImprint tsaMessageImprint
+	SerialNumber   *gobig.Int
+	GenTime        time.Time     `asn1:"generalized"`
+	Accuracy       tsaAccuracy   `asn1:"optional"`
+	Ordering       bool          `asn1:"optional"`
+	Nonce          *gobig.Int    `asn1:"optional"`
+	TSA            asn1.RawValue `asn1:"optional,tag:0"`
+	Extensions     asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type cmsSignedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo struct {
+		EContentType asn1.ObjectIdentifier
+		EContent     []byte `asn1:"explicit,tag:0"`
+	}
+	Certificates asn1.RawValue   `asn1:"optional,tag:0"`
+	CRLs         asn1.RawValue   `asn1:"optional,tag:1"`
+	SignerInfos  []cmsSignerInfo `asn1:"set"`
+}
+
+type cmsSignerInfo struct {
+	Version            int
+	SID                asn1.RawValue
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type cmsIssuerAndSerialNumber struct {
+	Issuer       asn1.RawValue
+	SerialNumber *gobig.Int
+}
+
+type cmsAttribute struct {
+	Type   asn1.ObjectIdentifier
+	Values []asn1.RawValue `asn1:"set"`
+}
+
+// Roots returns the pool of root certificates of the TSAs.
+func (tsa *SchemeTSA) Roots() (*x509.CertPool, error) {
+	tsa.once.Do(func() {
+		tsa.roots = x509.NewCertPool()
+		for _, cert := range tsa.Certificates {
+			if !tsa.roots.AppendCertsFromPEM([]byte(cert)) {
+				tsa.err = errors.New("failed to parse TSA certificate")
+				return
+			}
+		}
+	})
+	return tsa.roots, tsa.err
+}
+
+// GetTSATimestamp requests an RFC 3161 timestamp over the nonce from the URLs of the specified TSAs
+// in turn, until one of them returns a timestamp that is valid according to the root certificates
+// of all of the TSAs.
+func GetTSATimestamp(nonce []byte, tsas ...*SchemeTSA) (*TSATimestamp, error) {
+	return getTSATimestamp(nil, nonce, tsas...)
+}
+
+func getTSATimestamp(client *HTTPClient, nonce []byte, tsas ...*SchemeTSA) (*TSATimestamp, error) {
+	var roots []*x509.CertPool
+	var urls []string
+	for _, tsa := range tsas {
+		pool, err := tsa.Roots()
+		if err != nil {
+			return nil, err
+		}
+		roots = append(roots, pool)
+		urls = append(urls, tsa.URLs...)
+	}
+	if len(urls) == 0 {
+		return nil, errors.New("no TSA URLs specified")
+	}
+
+	var err error
+	for _, url := range urls {
+		var ts *TSATimestamp
+		if ts, err = requestTSATimestamp(client, url, nonce, roots); err == nil {
+			return ts, nil
+		}
+		Logger.Warnf("Failed to get timestamp from TSA %s: %v", url, err)
+	}
+	return nil, err
+}
+
+func requestTSATimestamp(client *HTTPClient, url string, nonce []byte, roots []*x509.CertPool) (*TSATimestamp, error) {
+	reqNonce, err := rand.Int(rand.Reader, new(gobig.Int).Lsh(gobig.NewInt(1), 64))
+	if err != nil {
+		return nil, err
+	}
+	hash := crypto.SHA256.New()
+	hash.Write(nonce)
+	req, err := asn1.Marshal(tsaRequest{
+		Version: 1,
+		MessageImprint: tsaMessageImprint{
+			HashAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue},
+			HashedMessage: hash.Sum(nil),
+		},
+		Nonce:   reqNonce,
+		CertReq: true,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), responseDeadline)
+	defer cancel()
+	res, err := client.NewTransport("", false).request(ctx, url, http.MethodPost, bytes.NewReader(req), TSARequestContentType)
+	if err != nil {
+		return nil, err
+	}
+	defer common.Close(res.Body)
+	if res.StatusCode != http.StatusOK {
+		return nil, &SessionError{ErrorType: ErrorServerResponse, RemoteStatus: res.StatusCode}
+	}
+	bts, err := io.ReadAll(res.Body)
+	if err != nil {
+		return nil, &SessionError{ErrorType: ErrorServerResponse, Err: err, RemoteStatus: res.StatusCode}
+	}
+
+	var resp tsaResponse
+	if rest, err := asn1.Unmarshal(bts, &resp); err != nil || len(rest) > 0 {
+		return nil, errors.New("failed to parse TSA response")
+	}
+	// PKIStatus granted (0) or grantedWithMods (1)
+	if resp.Status.Status > 1 {
+		return nil, errors.Errorf("TSA refused request with status %d %v", resp.Status.Status, resp.Status.StatusString)
+	}
+
+	ts := &TSATimestamp{Token: resp.TimeStampToken.FullBytes}
+	token, err := ts.parse()
+	if err != nil {
+		return nil, err
+	}
+	if token.info.Nonce == nil || token.info.Nonce.Cmp(reqNonce) != 0 {
+		return nil, errors.New("TSA response does not contain the nonce of the request")
+	}
+	chain, err := ts.verify(token, nonce, roots)
+	if err != nil {
+		return nil, err
+	}
+	for _, cert := range chain {
+		ts.Certificates = append(ts.Certificates, cert.Raw)
+	}
+	return ts, nil
+}
+
+// Verify verifies that the timestamp is over the specified nonce and that it was created by a
+// TSA whose certificate chains to each of the specified pools of root certificates, using the
+// certificates embedded in the timestamp. It returns the time at which the timestamp was created.
+func (ts *TSATimestamp) Verify(nonce []byte, roots ...*x509.CertPool) (time.Time, error) {
+	token, err := ts.parse()
+	if err != nil {
+		return time.Time{}, err
+	}
+	if _, err = ts.verify(token, nonce, roots); err != nil {
+		return time.Time{}, err
+	}
+	return token.info.GenTime, nil
+}
+
+type tsaToken struct {
+	info   tsaTSTInfo
+	signer *x509.Certificate
+	certs  []*x509.Certificate
+}
+
+// verify verifies the message imprint of the token and the certificate chain of its signer,
+// returning the chain (excluding the root) that was built against the first pool of roots.
+func (ts *TSATimestamp) verify(token *tsaToken, nonce []byte, roots []*x509.CertPool) ([]*x509.Certificate, error) {
+	var hash crypto.Hash
+	for h, oid := range tsaDigestAlgorithms {
+		if oid.Equal(token.info.MessageImprint.HashAlgorithm.Algorithm) {
+			hash = h
+		}
+	}
+	if hash == 0 {
+		return nil, errors.New("unsupported hash algorithm in timestamp")
+	}
+	h := hash.New()
+	h.Write(nonce)
+	if !bytes.Equal(h.Sum(nil), token.info.MessageImprint.HashedMessage) {
+		return nil, errors.New("timestamp is not over the nonce")
+	}
+
+	if len(roots) == 0 {
+		return nil, errors.New("no TSA root certificates specified")
+	}
+	intermediates := x509.NewCertPool()
+	for _, cert := range token.certs {
+		intermediates.AddCert(cert)
+	}
+	var chain []*x509.Certificate
+	for i, pool := range roots {
+		chains, err := token.signer.Verify(x509.VerifyOptions{
+			Roots:         pool,
+			Intermediates: intermediates,
+			CurrentTime:   token.info.GenTime,
+			KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageTimeStamping},
+		})
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to verify TSA certificate", 0)
+		}
+		if i == 0 {
+			chain = chains[0][:len(chains[0])-1]
+		}
+	}
+	return chain, nil
+}
+
+// parse parses the token and verifies the signature over its TSTInfo.
+func (ts *TSATimestamp) parse() (*tsaToken, error) {
+	var ci cmsContentInfo
+	if rest, err := asn1.Unmarshal(ts.Token, &ci); err != nil || len(rest) > 0 || !ci.ContentType.Equal(oidSignedData) {
+		return nil, errors.New("timestamp token is not a CMS SignedData structure")
+	}
+	var sd cmsSignedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse timestamp token", 0)
+	}
+	if !sd.EncapContentInfo.EContentType.Equal(oidTSTInfo) || len(sd.SignerInfos) != 1 {
+		return nil, errors.New("timestamp token does not contain a single signed TSTInfo")
+	}
+	token := &tsaToken{}
+	if _, err := asn1.Unmarshal(sd.EncapContentInfo.EContent, &token.info); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse TSTInfo", 0)
+	}
+
+	var err error
+	if len(sd.Certificates.Bytes) > 0 {
+		if token.certs, err = x509.ParseCertificates(sd.Certificates.Bytes); err != nil {
+			return nil, err
+		}
+	}
+	for _, bts := range ts.Certificates {
+		cert, err := x509.ParseCertificate(bts)
+		if err != nil {
+			return nil, err
+		}
+		token.certs = append(token.certs, cert)
+	}
+
+	signer := sd.SignerInfos[0]
+	if token.signer, err = cmsSignerCertificate(signer.SID, token.certs); err != nil {
+		return nil, err
+	}
+	if err = cmsVerifySignerInfo(signer, token.signer, sd.EncapContentInfo.EContent); err != nil {
+		return nil, err
+	}
+	return token, nil
+}
+
+// cmsSignerCertificate returns the certificate identified by the SignerIdentifier.
+func cmsSignerCertificate(sid asn1.RawValue, certs []*x509.Certificate) (*x509.Certificate, error) {
+	var ias cmsIssuerAndSerialNumber
+	isSKI := sid.Class == asn1.ClassContextSpecific && sid.Tag == 0
+	if !isSKI {
+		if _, err := asn1.Unmarshal(sid.FullBytes, &ias); err != nil {
+			return nil, errors.New("failed to parse signer identifier of timestamp token")
+		}
+	}
+	for _, cert := range certs {
+		if isSKI && bytes.Equal(cert.SubjectKeyId, sid.Bytes) ||
+			!isSKI && cert.SerialNumber.Cmp(ias.SerialNumber) == 0 && bytes.Equal(cert.RawIssuer, ias.Issuer.FullBytes) {
+			return cert, nil
+		}
+	}
+	return nil, errors.New("certificate of timestamp token signer not found")
+}
+
+// cmsVerifySignerInfo verifies the signature of the SignerInfo over its signed attributes, and
+// that these contain the digest of the content.
+func cmsVerifySignerInfo(signer cmsSignerInfo, cert *x509.Certificate, content []byte) error {
+	if len(signer.SignedAttrs.FullBytes) == 0 {
+		return errors.New("timestamp token has no signed attributes")
+	}
+	var digest crypto.Hash
+	for h, oid := range tsaDigestAlgorithms {
+		if oid.Equal(signer.DigestAlgorithm.Algorithm) {
+			digest = h
+		}
+	}
+	alg := x509.UnknownSignatureAlgorithm
+	for _, a := range tsaSignatureAlgorithms {
+		if a.oid.Equal(signer.SignatureAlgorithm.Algorithm) && (a.digest == 0 || a.digest == digest) {
+			alg = a.alg
+		}
+	}
+	if digest == 0 || alg == x509.UnknownSignatureAlgorithm {
+		return errors.New("unsupported algorithm in timestamp token")
+	}
+
+	// The signature is over the DER encoding of the signed attributes as SET OF, instead of the
+	// implicit [0] tag with which they are included in the SignerInfo
+	signed := append([]byte{0x31}, signer.SignedAttrs.FullBytes[1:]...)
+	if err := cert.CheckSignature(alg, signed, signer.Signature); err != nil {
+		return errors.WrapPrefix(err, "invalid timestamp token signature", 0)
+	}
+
+	var attrs []cmsAttribute
+	if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+		return errors.WrapPrefix(err, "failed to parse signed attributes of timestamp token", 0)
+	}
+	h := digest.New()
+	h.Write(content)
+	var contentType asn1.ObjectIdentifier
+	var messageDigest []byte
+	for _, attr := range attrs {
+		if len(attr.Values) != 1 {
+			continue
+		}
+		switch {
+		case attr.Type.Equal(oidAttrContentType):
+			_, _ = asn1.Unmarshal(attr.Values[0].FullBytes, &contentType)
+		case attr.Type.Equal(oidAttrMessageDigest):
+			_, _ = asn1.Unmarshal(attr.Values[0].FullBytes, &messageDigest)
+		}
+	}
+	if !contentType.Equal(oidTSTInfo) || !bytes.Equal(messageDigest, h.Sum(nil)) {
+		return errors.New("signed attributes of timestamp token do not match its TSTInfo")
+	}
+	return nil
+}
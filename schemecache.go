@@ -0,0 +1,135 @@
+package irma
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// Version of the format of cache files; cache files of other versions are ignored.
+const schemeCacheVersion = 1
+
+// schemeCache is the content of the cache file of an issuer scheme in ConfigurationOptions.CachePath,
+// containing its parsed issuers and credential types, which are used instead of parsing the scheme
+// as long as the key of the scheme on disk is unchanged.
+type schemeCache struct {
+	Version         int
+	Key             string
+	Issuers         []*Issuer
+	CredentialTypes []cachedCredentialType
+	Warnings        []string
+}
+
+// cachedCredentialType contains the attribute types of the credential type, which are not
+// included in its JSON representation.
+type cachedCredentialType struct {
+	CredentialType *CredentialType
+	AttributeTypes []*AttributeType
+}
+
+func (conf *Configuration) schemeCachePath(scheme *SchemeManager) string {
+	return filepath.Join(conf.options.CachePath, scheme.ID+".json")
+}
+
+// schemeCacheKey returns the key identifying the present state of the scheme on disk: the hash of
+// its index and the sizes and modification times of the files in it. It returns the empty string
+// if the scheme is not cached or if the signature on its index does not verify.
+func (conf *Configuration) schemeCacheKey(s Scheme) string {
+	scheme, ok := s.(*SchemeManager)
+	if !ok || conf.options.CachePath == "" {
+		return ""
+	}
+	indexbts, err := conf.readSignedIndex(scheme.path())
+	if err != nil {
+		return "" // let parsing the scheme report the problem
+	}
+	index := SchemeManagerIndex(make(map[string]SchemeFileHash))
+	if err = index.FromString(string(indexbts)); err != nil || index.Scheme() != scheme.ID {
+		return ""
+	}
+	files := make([]string, 0, len(index))
+	for file := range index {
+		files = append(files, file)
+	}
+	sort.Strings(files)
+
+	hash := sha256.New()
+	hash.Write(indexbts)
+	for _, file := range files {
+		info, err := os.Stat(filepath.Join(scheme.path(), file[len(scheme.ID)+1:]))
+		if err != nil {
+			return "" // let parsing the scheme report the problem
+		}
+		_, _ = fmt.Fprintf(hash, "%s %d %d\n", file, info.Size(), info.ModTime().UnixNano())
+	}
+	return hex.EncodeToString(hash.Sum(nil))
+}
+
+// loadSchemeCache adds the issuers and credential types of the scheme from its cache file to
+// conf, if the cache file exists and has the specified key. It returns whether it did so.
+func (conf *Configuration) loadSchemeCache(scheme *SchemeManager, key string) bool {
+	bts, err := os.ReadFile(conf.schemeCachePath(scheme))
+	if err != nil {
+		return false
+	}
+	var cache schemeCache
+	if err = json.Unmarshal(bts, &cache); err != nil {
+		Logger.Warnf("Ignoring invalid cache file of scheme %s: %s", scheme.ID, err)
+		return false
+	}
+	if cache.Version != schemeCacheVersion || cache.Key != key {
+		return false
+	}
+
+	for _, issuer := range cache.Issuers {
+		conf.Issuers[issuer.Identifier()] = issuer
+	}
+	for _, cached := range cache.CredentialTypes {
+		cred := cached.CredentialType
+		cred.AttributeTypes = cached.AttributeTypes
+		credid := cred.Identifier()
+		conf.CredentialTypes[credid] = cred
+		conf.addReverseHash(credid)
+		for _, attr := range cred.AttributeTypes {
+			conf.AttributeTypes[attr.GetAttributeTypeIdentifier()] = attr
+		}
+	}
+	conf.Warnings = append(conf.Warnings, cache.Warnings...)
+	Logger.Debugf("Took scheme %s from cache", scheme.ID)
+	return true
+}
+
+// saveSchemeCache writes the issuers and credential types of the scheme, and the warnings that
+// were raised while parsing it, to its cache file.
+func (conf *Configuration) saveSchemeCache(scheme *SchemeManager, key string, warnings []string) error {
+	cache := schemeCache{
+		Version:  schemeCacheVersion,
+		Key:      key,
+		Warnings: warnings,
+	}
+	for id, issuer := range conf.Issuers {
+		if id.SchemeManagerIdentifier() == scheme.Identifier() {
+			cache.Issuers = append(cache.Issuers, issuer)
+		}
+	}
+	for id, cred := range conf.CredentialTypes {
+		if id.SchemeManagerIdentifier() == scheme.Identifier() {
+			cache.CredentialTypes = append(cache.CredentialTypes, cachedCredentialType{cred, cred.AttributeTypes})
+		}
+	}
+
+	bts, err := json.Marshal(cache)
+	if err != nil {
+		return err
+	}
+	if err = common.EnsureDirectoryExists(conf.options.CachePath); err != nil {
+		return err
+	}
+	return common.SaveFile(conf.schemeCachePath(scheme), bts)
+}
@@ -0,0 +1,214 @@
+package irma
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	ErrSchemeRollback = errors.New("scheme index is older than the last logged index of the scheme")
+	ErrSchemeFork     = errors.New("scheme index differs from the last logged index of the scheme with the same timestamp")
+)
+
+// SchemeLogEntry records a scheme index signature accepted by a Configuration. The scheme log
+// (see ConfigurationOptions.SchemeLogPath) contains one entry per line, each including the hash
+// of the previous line so that entries cannot be removed or changed unnoticed.
+type SchemeLogEntry struct {
+	Scheme    string     `json:"scheme"`
+	Type      SchemeType `json:"type"`
+	Timestamp Timestamp  `json:"timestamp"` // timestamp of the scheme, signed by the index
+	IndexHash string     `json:"indexHash"` // hex-encoded SHA256 hash of the index
+	Signature []byte     `json:"signature"` // index signature
+	Signer    string     `json:"signer"`    // hex-encoded SHA256 hash of the public key (pk.pem) of the scheme
+	Accepted  time.Time  `json:"accepted"`
+	PrevHash  string     `json:"prevHash"` // hex-encoded SHA256 hash of the previous line of the log, if any
+}
+
+// schemeLogHead records the number of entries of the scheme log and the hash of its last line,
+// so that removal of the last entries, which keeps the hash chain intact, is detected.
+type schemeLogHead struct {
+	Count int    `json:"count"`
+	Hash  string `json:"hash"`
+}
+
+// SchemeLog returns the entries of the scheme transparency log of the specified scheme, or of
+// all schemes if id is empty, in the order in which they were accepted. It returns an error if
+// the log is not enabled, if the hash chain of its entries is broken, or if it was truncated.
+func (conf *Configuration) SchemeLog(id string) ([]*SchemeLogEntry, error) {
+	if conf.options.SchemeLogPath == "" {
+		return nil, errors.New("scheme transparency log is not enabled")
+	}
+	defer conf.lockSchemes()()
+	entries, _, err := conf.readSchemeLog()
+	if err != nil || id == "" {
+		return entries, err
+	}
+	var filtered []*SchemeLogEntry
+	for _, entry := range entries {
+		if entry.Scheme == id {
+			filtered = append(filtered, entry)
+		}
+	}
+	return filtered, nil
+}
+
+func (conf *Configuration) schemeLogHeadPath() string {
+	return conf.options.SchemeLogPath + ".head"
+}
+
+// readSchemeLog reads and verifies the log against its head, returning its entries and the hash
+// of its last line. The log may contain more entries than the head, which happens if writing the
+// head failed after appending an entry.
+func (conf *Configuration) readSchemeLog() ([]*SchemeLogEntry, string, error) {
+	head := &schemeLogHead{}
+	headbts, err := os.ReadFile(conf.schemeLogHeadPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, "", err
+	}
+	if err == nil {
+		if err = json.Unmarshal(headbts, head); err != nil {
+			return nil, "", errors.Errorf("scheme log head is invalid: %s", err)
+		}
+	}
+
+	f, err := os.Open(conf.options.SchemeLogPath)
+	if os.IsNotExist(err) {
+		if head.Count > 0 {
+			return nil, "", errors.New("scheme log is missing")
+		}
+		return nil, "", nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	defer func() { _ = f.Close() }()
+
+	var (
+		entries []*SchemeLogEntry
+		prev    string
+	)
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(nil, 1<<20)
+	for n := 1; scanner.Scan(); n++ {
+		line := scanner.Bytes()
+		entry := &SchemeLogEntry{}
+		if err = json.Unmarshal(line, entry); err != nil {
+			return nil, "", errors.Errorf("scheme log line %d is invalid: %s", n, err)
+		}
+		if entry.PrevHash != prev {
+			return nil, "", errors.Errorf("scheme log line %d does not follow the previous line", n)
+		}
+		entries = append(entries, entry)
+		sha := sha256.Sum256(line)
+		prev = hex.EncodeToString(sha[:])
+		if n == head.Count && prev != head.Hash {
+			return nil, "", errors.Errorf("scheme log line %d does not match the head of the log", n)
+		}
+	}
+	if err = scanner.Err(); err != nil {
+		return nil, "", err
+	}
+	if len(entries) < head.Count {
+		return nil, "", errors.Errorf("scheme log is truncated: it has %d entries instead of %d", len(entries), head.Count)
+	}
+	if len(entries) > 0 && len(headbts) == 0 {
+		return nil, "", errors.New("scheme log head is missing")
+	}
+	return entries, prev, nil
+}
+
+// logSchemeAccepted checks the index of the scheme that is about to be accepted against the last
+// logged index of the scheme, refusing indices with an earlier timestamp (rollback) or a different
+// index with the same timestamp (fork), and appends it to the log if it is new. The public key of the scheme
+// is read from the specified scheme directory. Must be called with the schemes locked.
+func (conf *Configuration) logSchemeAccepted(scheme Scheme, state *remoteSchemeState, dir string) error {
+	if conf.options.SchemeLogPath == "" {
+		return nil
+	}
+	pk, err := os.ReadFile(filepath.Join(dir, "pk.pem"))
+	if err != nil {
+		return err
+	}
+	entries, prev, err := conf.readSchemeLog()
+	if err != nil {
+		return err
+	}
+
+	indexHash := sha256.Sum256(state.indexBytes)
+	signer := sha256.Sum256(pk)
+	entry := &SchemeLogEntry{
+		Scheme:    scheme.id(),
+		Type:      scheme.typ(),
+		Timestamp: *state.timestamp,
+		IndexHash: hex.EncodeToString(indexHash[:]),
+		Signature: state.signatureBytes,
+		Signer:    hex.EncodeToString(signer[:]),
+		Accepted:  conf.now().UTC(),
+		PrevHash:  prev,
+	}
+	for i := len(entries) - 1; i >= 0; i-- {
+		last := entries[i]
+		if last.Scheme != entry.Scheme || last.Type != entry.Type {
+			continue
+		}
+		switch {
+		case entry.Timestamp.Before(last.Timestamp):
+			return ErrSchemeRollback
+		case !entry.Timestamp.After(last.Timestamp) && last.IndexHash != entry.IndexHash:
+			return ErrSchemeFork
+		case last.IndexHash == entry.IndexHash:
+			return nil // already logged, e.g. when reinstalling the scheme
+		}
+		break
+	}
+
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	if err = common.EnsureDirectoryExists(filepath.Dir(conf.options.SchemeLogPath)); err != nil {
+		return err
+	}
+	f, err := os.OpenFile(conf.options.SchemeLogPath, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err = f.Write(append(line, '\n')); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Sync(); err != nil {
+		_ = f.Close()
+		return err
+	}
+	if err = f.Close(); err != nil {
+		return err
+	}
+	sha := sha256.Sum256(line)
+	headbts, err := json.Marshal(&schemeLogHead{Count: len(entries) + 1, Hash: hex.EncodeToString(sha[:])})
+	if err != nil {
+		return err
+	}
+	if err = common.SaveFile(conf.schemeLogHeadPath(), headbts); err != nil {
+		return err
+	}
+
+	if url := conf.options.SchemeLogSubmitURL; url != "" {
+		go func() {
+			if err := conf.HTTPClient.NewTransport("", false).Post(url, nil, json.RawMessage(line)); err != nil {
+				Logger.WithFields(logrus.Fields{"scheme": entry.Scheme, "url": url}).
+					Warn("Failed to submit scheme index to transparency log: ", err)
+			}
+		}()
+	}
+	return nil
+}
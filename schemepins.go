@@ -0,0 +1,80 @@
+package irma
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/pem"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi/signed"
+)
+
+// ErrSchemePublicKeyNotPinned is returned when installing or updating a scheme whose public key
+// is not one of the keys pinned using PinSchemePublicKeys().
+var ErrSchemePublicKeyNotPinned = errors.New("scheme public key does not match the pinned public keys")
+
+// PinSchemePublicKeys requires the scheme with the specified ID to have one of the specified
+// PEM-encoded public keys when it is installed or updated, protecting against a compromised
+// scheme host serving another public key. Pinning keys of a scheme replaces
+// the previously pinned keys of that scheme.
+func (conf *Configuration) PinSchemePublicKeys(id string, pks ...[]byte) error {
+	if len(pks) == 0 {
+		return errors.New("no public keys specified")
+	}
+	keys := make([]*ecdsa.PublicKey, 0, len(pks))
+	for _, pk := range pks {
+		// signed.UnmarshalPemPublicKey() panics on invalid PEM
+		if block, _ := pem.Decode(pk); block == nil {
+			return errors.New("pinned public key of scheme " + id + " is not PEM-encoded")
+		}
+		key, err := signed.UnmarshalPemPublicKey(pk)
+		if err != nil {
+			return WrapErrorPrefix(err, "failed to parse pinned public key of scheme "+id)
+		}
+		keys = append(keys, key)
+	}
+
+	defer conf.lockSchemes()()
+	if conf.pinnedSchemeKeys == nil {
+		conf.pinnedSchemeKeys = map[string][]*ecdsa.PublicKey{}
+	}
+	conf.pinnedSchemeKeys[id] = keys
+	return nil
+}
+
+// InstallSchemeWithPublicKeyHash downloads and adds the specified scheme to this Configuration,
+// like InstallScheme(), provided that the SHA256 hash of the public key (i.e., of the pk.pem file)
+// served by the scheme host equals the specified hash, which must have been obtained out of band.
+func (conf *Configuration) InstallSchemeWithPublicKeyHash(url string, hash []byte) error {
+	if len(hash) != sha256.Size {
+		return errors.New("invalid public key hash specified")
+	}
+	pk, err := conf.HTTPClient.NewTransport(url, true).GetBytes("pk.pem")
+	if err != nil {
+		return err
+	}
+	computed := sha256.Sum256(pk)
+	if subtle.ConstantTimeCompare(computed[:], hash) != 1 {
+		return errors.Errorf("hash of scheme public key is %s, expected %s",
+			hex.EncodeToString(computed[:]), hex.EncodeToString(hash))
+	}
+	defer conf.lockSchemes()()
+	return conf.installScheme(url, pk, "")
+}
+
+// checkSchemePublicKey checks that the public key of the specified scheme is pinned, if public
+// keys of the scheme have been pinned.
+func (conf *Configuration) checkSchemePublicKey(id string, pk *ecdsa.PublicKey) error {
+	keys, pinned := conf.pinnedSchemeKeys[id]
+	if !pinned {
+		return nil
+	}
+	for _, key := range keys {
+		if key.Equal(pk) {
+			return nil
+		}
+	}
+	return ErrSchemePublicKeyNotPinned
+}
@@ -3,6 +3,7 @@ package irma
 import (
 	"bytes"
 	"crypto/ecdsa"
+	"crypto/rsa"
 	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
@@ -63,7 +64,7 @@ type (
 		setPath(path string)
 		parseContents(conf *Configuration) error
 		validate(conf *Configuration) (SchemeManagerStatus, error)
-		update() error
+		update(conf *Configuration) error
 		handleUpdateFile(conf *Configuration, path, filename string, bts []byte, transport *HTTPTransport, _ *IrmaIdentifierSet) error
 		delete(conf *Configuration) error
 		add(conf *Configuration)
@@ -115,6 +116,7 @@ const (
 // the scheme directory might get in an inconsistent state.
 func (conf *Configuration) DownloadDefaultSchemes() error {
 	Logger.Info("downloading default schemes (may take a while)")
+	defer conf.lockSchemes()()
 	for _, s := range DefaultSchemes {
 		Logger.WithFields(logrus.Fields{"url": s.URL}).Debugf("Downloading scheme")
 		if err := conf.installScheme(s.URL, s.Publickey, ""); err != nil {
@@ -134,6 +136,7 @@ func (conf *Configuration) InstallScheme(url string, publickey []byte) error {
 	if len(publickey) == 0 {
 		return errors.New("no public key specified")
 	}
+	defer conf.lockSchemes()()
 	return conf.installScheme(url, publickey, "")
 }
 
@@ -142,6 +145,7 @@ func (conf *Configuration) InstallScheme(url string, publickey []byte) error {
 // Limitation: when this function is stopped unexpectedly (i.e. a panic or a sigint takes place),
 // the scheme directory might get in an inconsistent state.
 func (conf *Configuration) DangerousTOFUInstallScheme(url string) error {
+	defer conf.lockSchemes()()
 	return conf.installScheme(url, nil, "")
 }
 
@@ -170,13 +174,14 @@ func (conf *Configuration) AutoUpdateSchemes(interval int) error {
 }
 
 func (conf *Configuration) UpdateSchemes() error {
+	defer conf.lockSchemes()()
 	for _, scheme := range conf.SchemeManagers {
-		if err := conf.UpdateScheme(scheme, nil); err != nil {
+		if err := conf.updateScheme(scheme, nil); err != nil {
 			return err
 		}
 	}
 	for _, scheme := range conf.RequestorSchemes {
-		if err := conf.UpdateScheme(scheme, nil); err != nil {
+		if err := conf.updateScheme(scheme, nil); err != nil {
 			return err
 		}
 	}
@@ -187,7 +192,13 @@ func (conf *Configuration) UpdateSchemes() error {
 // with the remote version at the scheme's URL, downloading and storing
 // new and modified files, according to the index files of both versions.
 // It stores the identifiers of new or updated entities in the second parameter.
+// Snapshots of the configuration (see Snapshot()) are not affected by the update.
 func (conf *Configuration) UpdateScheme(scheme Scheme, downloaded *IrmaIdentifierSet) error {
+	defer conf.lockSchemes()()
+	return conf.updateScheme(scheme, downloaded)
+}
+
+func (conf *Configuration) updateScheme(scheme Scheme, downloaded *IrmaIdentifierSet) error {
 	if conf.readOnly {
 		return errors.New("cannot update a read-only configuration")
 	}
@@ -244,7 +255,10 @@ func (conf *Configuration) UpdateScheme(scheme Scheme, downloaded *IrmaIdentifie
 	if scheme, err = newconf.ParseSchemeFolder(newSchemePath); err != nil {
 		return err
 	}
-	if err = scheme.update(); err != nil {
+	if err = scheme.update(conf); err != nil {
+		return err
+	}
+	if err = conf.logSchemeAccepted(scheme, remoteState, newSchemePath); err != nil {
 		return err
 	}
 
@@ -276,7 +290,12 @@ func (conf *Configuration) DangerousDeleteScheme(scheme Scheme) error {
 	if exists {
 		return errors.New("cannot delete scheme that is included in assets")
 	}
-	return scheme.delete(conf)
+	defer conf.lockSchemes()()
+	if err = scheme.delete(conf); err != nil {
+		return err
+	}
+	conf.publishSnapshot()
+	return nil
 }
 
 func (conf *Configuration) ParseSchemeFolder(dir string) (scheme Scheme, serr error) {
@@ -305,6 +324,14 @@ func (conf *Configuration) ParseSchemeFolder(dir string) (scheme Scheme, serr er
 		scheme.addError(conf, serr)
 	}()
 
+	// Take the scheme contents from the cache if the scheme did not change since it was cached
+	cacheKey := conf.schemeCacheKey(scheme)
+	if cacheKey != "" && conf.loadSchemeCache(scheme.(*SchemeManager), cacheKey) {
+		scheme.setStatus(SchemeManagerStatusValid)
+		return
+	}
+	warnings := len(conf.Warnings)
+
 	// validate scheme contents
 	if status, err := scheme.validate(conf); err != nil {
 		serr = &SchemeManagerError{Scheme: id, Status: status, Err: err}
@@ -316,6 +343,11 @@ func (conf *Configuration) ParseSchemeFolder(dir string) (scheme Scheme, serr er
 		return
 	}
 	scheme.setStatus(SchemeManagerStatusValid)
+	if cacheKey != "" {
+		if err = conf.saveSchemeCache(scheme.(*SchemeManager), cacheKey, conf.Warnings[warnings:]); err != nil {
+			Logger.Warnf("Failed to write cache file of scheme %s: %s", id, err)
+		}
+	}
 	return
 }
 
@@ -331,7 +363,7 @@ func (conf *Configuration) updateSchemeFiles(
 	scheme Scheme, index SchemeManagerIndex, newschemepath string, downloaded *IrmaIdentifierSet,
 ) error {
 	var (
-		transport = NewHTTPTransport(scheme.url(), true)
+		transport = conf.HTTPClient.NewTransport(scheme.url(), true)
 		oldIndex  = scheme.idx()
 		id        = scheme.id()
 	)
@@ -439,6 +471,7 @@ func (conf *Configuration) reinstallScheme(scheme Scheme) (err error) {
 	}
 	defer func() {
 		scheme.deleteError(conf, err)
+		conf.publishSnapshot()
 	}()
 
 	// first try remote
@@ -512,7 +545,7 @@ func (conf *Configuration) installScheme(url string, publickey []byte, dir strin
 		return errors.New("cannot install scheme into a read-only configuration")
 	}
 
-	scheme, err := downloadScheme(url)
+	scheme, err := downloadScheme(conf.HTTPClient, url)
 	if err != nil {
 		return err
 	}
@@ -540,7 +573,7 @@ func (conf *Configuration) installScheme(url string, publickey []byte, dir strin
 			return
 		}
 	} else {
-		if _, err = downloadFile(NewHTTPTransport(url, true), dirPath, "pk.pem"); err != nil {
+		if _, err = downloadFile(conf.HTTPClient.NewTransport(url, true), dirPath, "pk.pem"); err != nil {
 			return
 		}
 	}
@@ -550,7 +583,7 @@ func (conf *Configuration) installScheme(url string, publickey []byte, dir strin
 	}
 
 	scheme.add(conf)
-	return conf.UpdateScheme(scheme, nil)
+	return conf.updateScheme(scheme, nil)
 }
 
 type remoteSchemeState struct {
@@ -587,7 +620,7 @@ func (conf *Configuration) checkRemoteScheme(scheme Scheme) (bool, *remoteScheme
 }
 
 func (conf *Configuration) checkRemoteTimestamp(scheme Scheme) (*remoteSchemeState, error) {
-	t := NewHTTPTransport(scheme.url(), true)
+	t := conf.HTTPClient.NewTransport(scheme.url(), true)
 	indexbts, err := t.GetBytes("index")
 	if err != nil {
 		return nil, err
@@ -604,6 +637,9 @@ func (conf *Configuration) checkRemoteTimestamp(scheme Scheme) (*remoteSchemeSta
 	if err != nil {
 		return nil, err
 	}
+	if err = conf.checkSchemePublicKey(scheme.id(), pk); err != nil {
+		return nil, err
+	}
 
 	// Verify signature and the timestamp hash in the index
 	if err = signed.Verify(pk, indexbts, sig); err != nil {
@@ -674,7 +710,14 @@ func (conf *Configuration) copyFromAssets(subdir string) (bool, error) {
 // verifySignature verifies the signature on the scheme index file
 // (which contains the SHA256 hashes of all files under this scheme,
 // which are used for verifying file authenticity).
-func (conf *Configuration) verifySignature(dir string) (err error) {
+func (conf *Configuration) verifySignature(dir string) error {
+	_, err := conf.readSignedIndex(dir)
+	return err
+}
+
+// readSignedIndex returns the contents of the index file of the scheme in dir, after verifying
+// its signature against the scheme public key.
+func (conf *Configuration) readSignedIndex(dir string) (indexbts []byte, err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			if e, ok := r.(error); ok {
@@ -686,28 +729,31 @@ func (conf *Configuration) verifySignature(dir string) (err error) {
 	}()
 
 	if err := common.AssertPathExists(filepath.Join(dir, "index"), filepath.Join(dir, "index.sig"), filepath.Join(dir, "pk.pem")); err != nil {
-		return errors.New("Missing scheme manager index file, signature, or public key")
+		return nil, errors.New("Missing scheme manager index file, signature, or public key")
 	}
 
 	// Read and hash index file
-	indexbts, err := os.ReadFile(filepath.Join(dir, "index"))
+	indexbts, err = os.ReadFile(filepath.Join(dir, "index"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Read and parse scheme public key
 	pk, err := conf.schemePublicKey(dir)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
 	// Read and parse signature
 	sig, err := os.ReadFile(filepath.Join(dir, "index.sig"))
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return signed.Verify(pk, indexbts, sig)
+	if err = signed.Verify(pk, indexbts, sig); err != nil {
+		return nil, err
+	}
+	return indexbts, nil
 }
 
 func (conf *Configuration) schemePublicKey(dir string) (*ecdsa.PublicKey, error) {
@@ -825,7 +871,7 @@ func dirInScheme(index SchemeManagerIndex, dir string) bool {
 	return false
 }
 
-func downloadScheme(url string) (Scheme, error) {
+func downloadScheme(client *HTTPClient, url string) (Scheme, error) {
 	if url[len(url)-1] == '/' {
 		url = url[:len(url)-1]
 	}
@@ -843,7 +889,7 @@ func downloadScheme(url string) (Scheme, error) {
 		if strings.HasSuffix(url, "/"+filename) {
 			u = url[:len(url)-1-len(filename)]
 		}
-		b, err := NewHTTPTransport(u, true).GetBytes(filename)
+		b, err := client.NewTransport(u, true).GetBytes(filename)
 		if err != nil {
 			if err.(*SessionError).RemoteStatus == 404 {
 				continue
@@ -963,35 +1009,29 @@ func (scheme *SchemeManager) path() string { return scheme.storagepath }
 func (scheme *SchemeManager) setPath(path string) { scheme.storagepath = path }
 
 func (scheme *SchemeManager) parseContents(conf *Configuration) error {
+	var dirs []string
 	err := common.IterateSubfolders(scheme.path(), func(dir string, _ os.FileInfo) error {
-		issuer := &Issuer{}
-
-		exists, err := conf.parseSchemeFile(scheme, filepath.Join(filepath.Base(dir), "description.xml"), issuer)
-		if err != nil {
-			return err
-		}
-		if !exists {
-			return nil
-		}
-		if issuer.XMLVersion < 4 {
-			return errors.New("Unsupported issuer description")
-		}
-
-		if len(issuer.Languages) == 0 {
-			issuer.Languages = scheme.Languages
-		}
-		if err = conf.validateIssuer(scheme, issuer, dir); err != nil {
-			return err
-		}
-
-		conf.Issuers[issuer.Identifier()] = issuer
-		return scheme.parseCredentialsFolder(conf, issuer, filepath.Join(dir, "Issues"))
+		dirs = append(dirs, dir)
+		return nil
 	})
-
 	if err != nil {
 		return err
 	}
 
+	// Parse the issuers in parallel, each into its own configuration, and merge those in order
+	forks := make([]*Configuration, len(dirs))
+	errs := parallel(len(dirs), func(i int) error {
+		forks[i] = conf.fork()
+		return scheme.parseIssuer(forks[i], dirs[i])
+	})
+	for i, fork := range forks {
+		conf.merge(fork)
+		conf.Warnings = append(conf.Warnings, fork.Warnings...)
+		if errs[i] != nil {
+			return errs[i]
+		}
+	}
+
 	// validate that there are no circular dependencies
 	for _, credType := range conf.CredentialTypes {
 		if credType.SchemeManagerID == scheme.ID {
@@ -1004,6 +1044,32 @@ func (scheme *SchemeManager) parseContents(conf *Configuration) error {
 	return nil
 }
 
+// parse $schememanager/$issuer/description.xml and the credential types of the issuer
+func (scheme *SchemeManager) parseIssuer(conf *Configuration, dir string) error {
+	issuer := &Issuer{}
+
+	exists, err := conf.parseSchemeFile(scheme, filepath.Join(filepath.Base(dir), "description.xml"), issuer)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		return nil
+	}
+	if issuer.XMLVersion < 4 {
+		return errors.New("Unsupported issuer description")
+	}
+
+	if len(issuer.Languages) == 0 {
+		issuer.Languages = scheme.Languages
+	}
+	if err = conf.validateIssuer(scheme, issuer, dir); err != nil {
+		return err
+	}
+
+	conf.Issuers[issuer.Identifier()] = issuer
+	return scheme.parseCredentialsFolder(conf, issuer, filepath.Join(dir, "Issues"))
+}
+
 var (
 	errCircDep = errors.Errorf("No valid dependency branch could be built. There might be a circular dependency.")
 )
@@ -1018,9 +1084,10 @@ func (ct CredentialType) validateDependencies(conf *Configuration, validatedDeps
 			conSatisfied := true
 
 			for _, item := range con {
-				if conf.CredentialTypes[item].SchemeManagerID != ct.SchemeManagerID {
+				// The credential type may be absent if it is in another scheme that was parsed separately
+				if dep, ok := conf.CredentialTypes[item]; !ok || dep.SchemeManagerID != ct.SchemeManagerID {
 					return errors.Errorf("credential type %s in scheme %s has dependency outside the scheme: %s",
-						ct.Identifier().String(), ct.SchemeManagerID, conf.CredentialTypes[item].Identifier().String())
+						ct.Identifier().String(), ct.SchemeManagerID, item.String())
 				}
 
 				// all items need to be valid for middle to be valid
@@ -1070,6 +1137,11 @@ func (scheme *SchemeManager) validate(conf *Configuration) (SchemeManagerStatus,
 			return SchemeManagerStatusParsingError, errors.Errorf("Scheme %s has keyshare URL but no keyshare public key kss-0.pem", scheme.ID)
 		}
 	}
+	if scheme.TSA != nil {
+		if _, err := scheme.TSA.Roots(); err != nil {
+			return SchemeManagerStatusParsingError, errors.Errorf("Scheme %s has invalid TSA certificate", scheme.ID)
+		}
+	}
 	conf.validateTranslations(fmt.Sprintf("Scheme %s", scheme.ID), scheme, scheme.Languages)
 
 	// Verify that all other files are validly signed
@@ -1080,8 +1152,8 @@ func (scheme *SchemeManager) validate(conf *Configuration) (SchemeManagerStatus,
 	return SchemeManagerStatusValid, nil
 }
 
-func (scheme *SchemeManager) update() error {
-	return scheme.downloadDemoPrivateKeys()
+func (scheme *SchemeManager) update(conf *Configuration) error {
+	return scheme.downloadDemoPrivateKeys(conf.HTTPClient)
 }
 
 func (scheme *SchemeManager) handleUpdateFile(conf *Configuration, _, filename string, _ []byte, _ *HTTPTransport, downloaded *IrmaIdentifierSet) error {
@@ -1134,6 +1206,11 @@ func (scheme *SchemeManager) delete(conf *Configuration) error {
 			delete(conf.CredentialTypes, cred)
 		}
 	}
+	if conf.options.CachePath != "" {
+		if err := os.Remove(conf.schemeCachePath(scheme)); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
 
 	return os.RemoveAll(scheme.path())
 }
@@ -1176,7 +1253,9 @@ func (scheme *SchemeManager) purge(conf *Configuration) {
 	id := scheme.Identifier()
 	delete(conf.SchemeManagers, id)
 	delete(conf.DisabledSchemeManagers, id)
-	delete(conf.kssPublicKeys, id)
+	conf.kssPublicKeys.DeleteIf(func(key kssKeyIdentifier, _ *rsa.PublicKey) bool {
+		return key.scheme == id
+	})
 	for issuerid, issuer := range conf.Issuers {
 		if issuer.SchemeManagerIdentifier() == id {
 			delete(conf.Issuers, issuerid)
@@ -1203,8 +1282,15 @@ func (scheme *SchemeManager) purge(conf *Configuration) {
 }
 
 func (scheme *SchemeManager) verifyFiles(conf *Configuration) error {
+	files := make([]string, 0, len(scheme.index))
 	for file := range scheme.index {
-		file = file[len(scheme.id())+1:] // strip scheme name
+		files = append(files, file[len(scheme.id())+1:]) // strip scheme name
+	}
+	sort.Strings(files)
+
+	// Reading and hashing the files dominates parsing time, so we do this in parallel
+	errs := parallel(len(files), func(i int) error {
+		file := files[i]
 		exists, err := common.PathExists(filepath.Join(scheme.path(), file))
 		if err != nil {
 			return err
@@ -1213,7 +1299,11 @@ func (scheme *SchemeManager) verifyFiles(conf *Configuration) error {
 			return errors.Errorf("file %s in index is not found on disk", file)
 		}
 		// Don't care about the actual bytes
-		if _, _, err = conf.readSignedFile(scheme.index, scheme.path(), file); err != nil {
+		_, _, err = conf.readSignedFile(scheme.index, scheme.path(), file)
+		return err
+	})
+	for _, err := range errs {
+		if err != nil {
 			return err
 		}
 	}
@@ -1293,13 +1383,13 @@ func (scheme *SchemeManager) parseCredentialsFolder(conf *Configuration, issuer
 // downloadDemoPrivateKeys attempts to download the scheme and issuer private keys, if the scheme is
 // a demo scheme and if they are not already present in the scheme, without failing if any of them
 // is not available.
-func (scheme *SchemeManager) downloadDemoPrivateKeys() error {
+func (scheme *SchemeManager) downloadDemoPrivateKeys(client *HTTPClient) error {
 	if !scheme.Demo {
 		return nil
 	}
 
 	Logger.WithField("scheme", scheme.ID).Debugf("Attempting downloading of private keys")
-	transport := NewHTTPTransport(scheme.URL, true)
+	transport := client.NewTransport(scheme.URL, true)
 
 	_, err := downloadFile(transport, scheme.path(), "sk.pem")
 	if err != nil { // If downloading of any of the private key fails just log it, and then continue
@@ -1462,7 +1552,7 @@ func (scheme *RequestorScheme) checkLogo(conf *Configuration, logo string) (Sche
 	return "", nil
 }
 
-func (scheme *RequestorScheme) update() error {
+func (scheme *RequestorScheme) update(*Configuration) error {
 	return nil
 }
 
@@ -0,0 +1,115 @@
+package irma
+
+import (
+	"sort"
+	"strings"
+)
+
+// AttributeIndex is an index of the credential types and attribute types of a Configuration,
+// searchable by (parts of) their identifiers, names and descriptions in any language, and the
+// names of their issuers.
+type AttributeIndex struct {
+	conf    *Configuration
+	entries []*attributeIndexEntry
+}
+
+// SearchResult is a credential type matching a search term.
+type SearchResult struct {
+	CredentialType *CredentialType
+	Issuer         *Issuer
+	// Attribute types of the credential type matching the term. Contains all attribute types
+	// if the credential type itself matches the term.
+	AttributeTypes []*AttributeType
+}
+
+type attributeIndexEntry struct {
+	credtype *CredentialType
+	text     string
+	attrs    []string // text of each attribute type, in the order of credtype.AttributeTypes
+}
+
+// NewAttributeIndex indexes the credential types and attribute types of the configuration.
+func NewAttributeIndex(conf *Configuration) *AttributeIndex {
+	index := &AttributeIndex{conf: conf}
+	for id, credtype := range conf.CredentialTypes {
+		texts := []string{id.String()}
+		texts = append(texts, translations(credtype.Name)...)
+		texts = append(texts, translations(credtype.Description)...)
+		if issuer := conf.Issuers[id.IssuerIdentifier()]; issuer != nil {
+			texts = append(texts, translations(issuer.Name)...)
+		}
+		entry := &attributeIndexEntry{credtype: credtype, text: indexText(texts)}
+		for _, attr := range credtype.AttributeTypes {
+			texts = []string{attr.GetAttributeTypeIdentifier().String()}
+			texts = append(texts, translations(attr.Name)...)
+			texts = append(texts, translations(attr.Description)...)
+			entry.attrs = append(entry.attrs, indexText(texts))
+		}
+		index.entries = append(index.entries, entry)
+	}
+	sort.Slice(index.entries, func(i, j int) bool {
+		return index.entries[i].credtype.Identifier().String() < index.entries[j].credtype.Identifier().String()
+	})
+	return index
+}
+
+// Search returns the credential types, sorted by identifier, that match the term
+// case-insensitively. Each of the words of the term has to occur in the credential type (its
+// identifier, name, description or issuer name) or, for matching attribute types, in either the
+// credential type or the attribute type.
+func (index *AttributeIndex) Search(term string) []SearchResult {
+	words := strings.Fields(strings.ToLower(term))
+	if len(words) == 0 {
+		return nil
+	}
+
+	var results []SearchResult
+	for _, entry := range index.entries {
+		var attrs []*AttributeType
+		credtypeMatches := containsAll(words, entry.text)
+		for i, attr := range entry.credtype.AttributeTypes {
+			if credtypeMatches || containsAll(words, entry.text+"\n"+entry.attrs[i]) && containsAny(words, entry.attrs[i]) {
+				attrs = append(attrs, attr)
+			}
+		}
+		if !credtypeMatches && len(attrs) == 0 {
+			continue
+		}
+		results = append(results, SearchResult{
+			CredentialType: entry.credtype,
+			Issuer:         index.conf.Issuers[entry.credtype.IssuerIdentifier()],
+			AttributeTypes: attrs,
+		})
+	}
+	return results
+}
+
+func translations(ts TranslatedString) []string {
+	texts := make([]string, 0, len(ts))
+	for _, text := range ts {
+		texts = append(texts, text)
+	}
+	return texts
+}
+
+func indexText(texts []string) string {
+	return strings.ToLower(strings.Join(texts, "\n"))
+}
+
+func containsAll(words []string, text string) bool {
+	for _, word := range words {
+		if !strings.Contains(text, word) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsAny(words []string, text string) bool {
+	for _, word := range words {
+		if strings.Contains(text, word) {
+			return true
+		}
+	}
+	return false
+}
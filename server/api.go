@@ -3,7 +3,9 @@ package server
 import (
 	"bytes"
 	"context"
+	"crypto"
 	"crypto/rsa"
+	"crypto/sha256"
 	"encoding/hex"
 	"encoding/json"
 	"io"
@@ -30,6 +32,48 @@ type SessionPackage struct {
 	SessionPtr      *irma.Qr                     `json:"sessionPtr"`
 	Token           irma.RequestorToken          `json:"token,omitempty"`
 	FrontendRequest *irma.FrontendSessionRequest `json:"frontendRequest"`
+	// Session pointer in compact form (see irma.Qr.MarshalCompact()), if requested using compactSessionPtr
+	CompactSessionPtr string `json:"compactSessionPtr,omitempty"`
+}
+
+// SessionInfo contains information about an open session of a requestor.
+type SessionInfo struct {
+	Token      irma.RequestorToken `json:"token"`
+	Type       irma.Action         `json:"type"`
+	Status     irma.ServerStatus   `json:"status"`
+	Created    time.Time           `json:"created"`
+	LastActive time.Time           `json:"lastActive"`
+}
+
+// SessionList contains a page of the open sessions of a requestor, ordered by creation time,
+// along with the total number of open sessions matching the query.
+type SessionList struct {
+	Sessions []*SessionInfo `json:"sessions"`
+	Total    int            `json:"total"`
+}
+
+// UndeliveredCallback contains information about a session result that could not be POSTed to the
+// callback URL of its session, and which is kept in the callback outbox for redelivery.
+type UndeliveredCallback struct {
+	Token       irma.RequestorToken `json:"token"`
+	CallbackURL string              `json:"callbackUrl"`
+	Attempts    int                 `json:"attempts"`
+	Created     time.Time           `json:"created"`
+	LastAttempt time.Time           `json:"lastAttempt"`
+	LastError   string              `json:"lastError"`
+}
+
+// SessionEvent is an entry in the history of a session, which is recorded if SessionHistory is
+// enabled in the Configuration. It is either a status change of the session, or a request of the
+// IRMA app or frontend to one of the endpoints of the session (in which case Status and PrevStatus
+// are the statuses before and after the request). Events contain no attribute values.
+type SessionEvent struct {
+	Time       time.Time         `json:"time"`
+	Endpoint   string            `json:"endpoint,omitempty"` // method and route of the request, if any
+	HTTPStatus int               `json:"httpStatus,omitempty"`
+	PrevStatus irma.ServerStatus `json:"prevStatus"`
+	Status     irma.ServerStatus `json:"status"`
+	RequestID  string            `json:"requestId,omitempty"`
 }
 
 // SessionResult contains session information such as the session status, type, possible errors,
@@ -43,16 +87,38 @@ type SessionResult struct {
 	Signature   *irma.SignedMessage          `json:"signature,omitempty"`
 	Err         *irma.RemoteError            `json:"error,omitempty"`
 	NextSession irma.RequestorToken          `json:"nextSession,omitempty"`
+	Purpose     *irma.Purpose                `json:"purpose,omitempty"`
+	// The message to be signed in signature sessions, with the placeholders of the request resolved
+	Message string `json:"message,omitempty"`
+	// The mdocs with which the attributes were disclosed, if presented as mdocs instead of using Idemix
+	Mdoc []*MdocDocumentInfo `json:"mdoc,omitempty"`
+	// Warnings about the session request, e.g. about deprecated credential types that it involves
+	Warnings []string `json:"warnings,omitempty"`
+	// Disclosed credentials that were expired or that expire soon, which the user may need to renew
+	// (only present if ProofStatus is valid)
+	ReissuanceHints []*ReissuanceHint `json:"reissuanceHints,omitempty"`
 
 	LegacySession bool `json:"-"` // true if request was started with legacy (i.e. pre-condiscon) session request
 }
 
+// ReissuanceHint describes a disclosed credential that was expired or that expires soon, with
+// which the requestor can guide the user to renew the credential.
+type ReissuanceHint struct {
+	Credential irma.CredentialTypeIdentifier `json:"credential"`
+	Expiry     irma.Timestamp                `json:"expiry"`
+	Expired    bool                          `json:"expired"`
+	// Where the credential can be obtained, as specified by the scheme, if known
+	IssueURL *irma.TranslatedString `json:"issueURL,omitempty"`
+}
+
 // SessionHandler is a function that can handle a session result
 // once an IRMA session has completed.
 type SessionHandler func(*SessionResult)
 
 type LogOptions struct {
 	Response, Headers, From, EncodeBinary bool
+	// If set, determines the address of the client that is logged if From is set, e.g. Configuration.ClientIP
+	ClientIP func(*http.Request) string
 }
 
 // LegacySessionResult is a pre-condiscon version of SessionResult.
@@ -98,6 +164,7 @@ func RemoteError(err Error, message string) *irma.RemoteError {
 		"status":      err.Status,
 		"description": err.Description,
 		"error":       err.Type,
+		"code":        err.Code,
 		"message":     message,
 	}).Warnf("Sending session error")
 	if Logger.IsLevelEnabled(logrus.DebugLevel) {
@@ -108,6 +175,7 @@ func RemoteError(err Error, message string) *irma.RemoteError {
 		Status:      err.Status,
 		Description: err.Description,
 		ErrorName:   string(err.Type),
+		Code:        err.Code,
 		Message:     message,
 		Stacktrace:  stack,
 	}
@@ -149,6 +217,7 @@ func WriteJson(w http.ResponseWriter, object interface{}) {
 }
 
 func WriteBinaryResponse(w http.ResponseWriter, object interface{}, rerr *irma.RemoteError) {
+	rerr = withCorrelationID(w, localize(w, rerr))
 	status, bts := BinaryResponse(object, rerr)
 	w.Header().Set("Content-Type", "application/octet-stream")
 	w.WriteHeader(status)
@@ -157,6 +226,7 @@ func WriteBinaryResponse(w http.ResponseWriter, object interface{}, rerr *irma.R
 
 // WriteResponse writes the specified object or error as JSON to the http.ResponseWriter.
 func WriteResponse(w http.ResponseWriter, object interface{}, rerr *irma.RemoteError) {
+	rerr = withCorrelationID(w, localize(w, rerr))
 	status, bts := JsonResponse(object, rerr)
 	w.Header().Set("Content-Type", "application/json; charset=UTF-8")
 	w.WriteHeader(status)
@@ -166,6 +236,18 @@ func WriteResponse(w http.ResponseWriter, object interface{}, rerr *irma.RemoteE
 	}
 }
 
+// withCorrelationID returns a copy of the error having as correlation ID the request ID that
+// RequestIDMiddleware set in the response headers, if any.
+func withCorrelationID(w http.ResponseWriter, rerr *irma.RemoteError) *irma.RemoteError {
+	id := w.Header().Get(RequestIDHeader)
+	if rerr == nil || id == "" {
+		return rerr
+	}
+	cpy := *rerr
+	cpy.CorrelationID = id
+	return &cpy
+}
+
 // WriteString writes the specified string to the http.ResponseWriter.
 func WriteString(w http.ResponseWriter, str string) {
 	w.Header().Set("Content-Type", "text/plain")
@@ -181,7 +263,18 @@ func WriteString(w http.ResponseWriter, str string) {
 //   - SessionRequest instances (DisclosureRequest, SignatureRequest, IssuanceRequest)
 //   - JSON representations ([]byte or string) of any of the above.
 func ParseSessionRequest(request interface{}) (irma.RequestorRequest, error) {
-	rr, e := parseInput(request)
+	return parseSessionRequest(request, irma.UnmarshalValidate)
+}
+
+// ParseSessionRequestStrict is like ParseSessionRequest, but refuses JSON representations
+// containing unknown fields (e.g. a misspelled "disclose"). Legacy session requests are parsed
+// as by ParseSessionRequest.
+func ParseSessionRequestStrict(request interface{}) (irma.RequestorRequest, error) {
+	return parseSessionRequest(request, irma.UnmarshalValidateStrict)
+}
+
+func parseSessionRequest(request interface{}, unmarshal func([]byte, interface{}) error) (irma.RequestorRequest, error) {
+	rr, e := parseInput(request, unmarshal)
 	if e != nil {
 		return nil, e
 	}
@@ -190,14 +283,14 @@ func ParseSessionRequest(request interface{}) (irma.RequestorRequest, error) {
 	return rr, e
 }
 
-func parseInput(request interface{}) (irma.RequestorRequest, error) {
+func parseInput(request interface{}, unmarshal func([]byte, interface{}) error) (irma.RequestorRequest, error) {
 	switch r := request.(type) {
 	case irma.RequestorRequest:
 		return r, nil
 	case irma.SessionRequest:
 		return wrapSessionRequest(r)
 	case string:
-		return parseInput([]byte(r))
+		return parseInput([]byte(r), unmarshal)
 	case []byte:
 		var isRequestorRequest bool
 		ldContext, err := common.ParseLDContext(r)
@@ -228,9 +321,9 @@ func parseInput(request interface{}) (irma.RequestorRequest, error) {
 			case irma.LDContextIssuanceRequest:
 				msg = &irma.IdentityProviderRequest{}
 			default:
-				return nil, errors.New("Invalid requestor request type")
+				return nil, &irma.LDContextError{LDContext: ldContext, Expected: irma.SessionRequestLDContexts}
 			}
-			if err := irma.UnmarshalValidate(r, msg); err != nil {
+			if err := unmarshal(r, msg); err != nil {
 				return nil, err
 			}
 			return msg, nil
@@ -244,9 +337,9 @@ func parseInput(request interface{}) (irma.RequestorRequest, error) {
 			case irma.LDContextIssuanceRequest:
 				msg = &irma.IssuanceRequest{}
 			default:
-				return nil, errors.New("Invalid session request type")
+				return nil, &irma.LDContextError{LDContext: ldContext, Expected: irma.SessionRequestLDContexts}
 			}
-			if err := irma.UnmarshalValidate(r, msg); err != nil {
+			if err := unmarshal(r, msg); err != nil {
 				return nil, err
 			}
 			return wrapSessionRequest(msg)
@@ -269,13 +362,25 @@ func wrapSessionRequest(request irma.SessionRequest) (irma.RequestorRequest, err
 	}
 }
 
-// LocalIP returns the IP address of one of the (non-loopback) network interfaces
+// LocalIP returns the IP address of one of the (non-loopback) network interfaces,
+// preferring IPv4 addresses over IPv6 addresses (see LocalIPs()).
 func LocalIP() (string, error) {
+	ips, err := LocalIPs()
+	if err != nil {
+		return "", err
+	}
+	return ips[0], nil
+}
+
+// LocalIPs returns the global unicast IP addresses of all (non-loopback) network interfaces that
+// are up, the IPv4 addresses before the IPv6 addresses.
+func LocalIPs() ([]string, error) {
 	// Based on https://play.golang.org/p/BDt3qEQ_2H from https://stackoverflow.com/a/23558495
 	ifaces, err := net.Interfaces()
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	var ipv4, ipv6 []string
 	for _, iface := range ifaces {
 		if iface.Flags&net.FlagUp == 0 {
 			continue // interface down
@@ -285,7 +390,7 @@ func LocalIP() (string, error) {
 		}
 		addrs, err := iface.Addrs()
 		if err != nil {
-			return "", err
+			return nil, err
 		}
 		for _, addr := range addrs {
 			var ip net.IP
@@ -295,17 +400,20 @@ func LocalIP() (string, error) {
 			case *net.IPAddr:
 				ip = v.IP
 			}
-			if ip == nil || ip.IsLoopback() {
-				continue
+			if ip == nil || !ip.IsGlobalUnicast() {
+				continue // also skips link-local addresses, which are not reachable without a zone
 			}
-			ip = ip.To4()
-			if ip == nil {
-				continue // not an ipv4 address
+			if ip4 := ip.To4(); ip4 != nil {
+				ipv4 = append(ipv4, ip4.String())
+			} else {
+				ipv6 = append(ipv6, ip.String())
 			}
-			return ip.String(), nil
 		}
 	}
-	return "", errors.New("No IP found")
+	if len(ipv4)+len(ipv6) == 0 {
+		return nil, errors.New("No IP found")
+	}
+	return append(ipv4, ipv6...), nil
 }
 
 func Verbosity(level int) logrus.Level {
@@ -323,7 +431,17 @@ func TypeString(x interface{}) string {
 	return reflect.TypeOf(x).String()
 }
 
-func ResultJwt(sessionresult *SessionResult, issuer string, validity int, privatekey *rsa.PrivateKey) (string, error) {
+// ResultJwt returns the session result as a JWT signed by the signer (see irma.SignJwt()).
+func ResultJwt(sessionresult *SessionResult, issuer string, validity int, signer crypto.Signer) (string, error) {
+	return MappedResultJwt(sessionresult, issuer, validity, signer, "", nil)
+}
+
+// MappedResultJwt is like ResultJwt, but additionally includes the disclosed attributes
+// as named values in the "claims" field of the JWT, according to the specified mapping,
+// and the key ID (if not empty) in its kid header.
+func MappedResultJwt(
+	sessionresult *SessionResult, issuer string, validity int, signer crypto.Signer, kid string, mapping AttributeMapping,
+) (string, error) {
 	standardclaims := jwt.StandardClaims{
 		Issuer:   issuer,
 		IssuedAt: time.Now().Unix(),
@@ -331,48 +449,89 @@ func ResultJwt(sessionresult *SessionResult, issuer string, validity int, privat
 	}
 	standardclaims.ExpiresAt = standardclaims.IssuedAt + int64(validity)
 
+	var mapped map[string]string
+	if len(mapping) > 0 {
+		var err error
+		if mapped, err = mapping.Apply(sessionresult.Disclosed); err != nil {
+			return "", err
+		}
+	}
+
 	var claims jwt.Claims
 	if sessionresult.LegacySession {
 		claims = struct {
 			jwt.StandardClaims
 			*LegacySessionResult
-		}{standardclaims, sessionresult.Legacy()}
+			Claims map[string]string `json:"claims,omitempty"`
+		}{standardclaims, sessionresult.Legacy(), mapped}
 	} else {
 		claims = struct {
 			jwt.StandardClaims
 			*SessionResult
-		}{standardclaims, sessionresult}
+			Claims map[string]string `json:"claims,omitempty"`
+		}{standardclaims, sessionresult, mapped}
 	}
 
 	// Sign the jwt and return it
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	return token.SignedString(privatekey)
-}
-
-func DoResultCallback(callbackUrl string, result *SessionResult, issuer string, validity int, privatekey *rsa.PrivateKey) {
-	logger := Logger.WithFields(logrus.Fields{"session": result.Token, "callbackUrl": callbackUrl})
+	return irma.SignJwtWithKeyID(claims, signer, kid)
+}
+
+// IdempotencyKeyHeader is the HTTP header of session result callbacks containing a key derived
+// from the requestor token of the session, which is the same for all callbacks of the session.
+// Requestors can use it to ignore duplicate callbacks, which are made when callbacks are retried,
+// and when a session of the stateless session store is finished at several server instances.
+const IdempotencyKeyHeader = "Idempotency-Key"
+
+// IdempotencyKey returns the idempotency key of the callbacks of the session with the specified
+// requestor token. As the requestor token gives access to the session, it is hashed.
+func IdempotencyKey(token irma.RequestorToken) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:16])
+}
+
+// DoResultCallback POSTs the session result to the callback URL using the specified HTTP client
+// (nil meaning the default settings), as a JWT if a signer is specified (see MappedResultJwt).
+// The request ID of the context, if any, is sent along in the X-Request-ID header, and the
+// idempotency key of the session in the Idempotency-Key header. Failures are logged and returned.
+func DoResultCallback(
+	ctx context.Context, client *irma.HTTPClient, callbackUrl string, result *SessionResult, issuer string, validity int,
+	signer crypto.Signer, kid string, mapping AttributeMapping,
+) error {
+	logger := Logger.WithContext(ctx).WithFields(logrus.Fields{"session": result.Token, "callbackUrl": callbackUrl})
 	if !strings.HasPrefix(callbackUrl, "https") {
 		logger.Warn("POSTing session result to callback URL without TLS: attributes are unencrypted in traffic")
 	} else {
 		logger.Debug("POSTing session result")
 	}
 
+	// A nil private key passed as signer is not a nil interface value
+	if sk, ok := signer.(*rsa.PrivateKey); ok && sk == nil {
+		signer = nil
+	}
+
 	var res interface{}
-	if privatekey != nil {
+	if signer != nil {
 		var err error
-		res, err = ResultJwt(result, issuer, validity, privatekey)
+		res, err = MappedResultJwt(result, issuer, validity, signer, kid, mapping)
 		if err != nil {
-			_ = LogError(errors.WrapPrefix(err, "Failed to create JWT for result callback", 0))
-			return
+			return LogError(errors.WrapPrefix(err, "Failed to create JWT for result callback", 0))
 		}
 	} else {
 		res = result
 	}
 
-	if err := irma.NewHTTPTransport(callbackUrl, false).Post("", nil, res); err != nil {
+	transport := client.NewTransport(callbackUrl, false)
+	if id := RequestID(ctx); id != "" {
+		transport.SetHeader(RequestIDHeader, id)
+	}
+	transport.SetHeader(IdempotencyKeyHeader, IdempotencyKey(result.Token))
+	if err := transport.Post("", nil, res); err != nil {
 		// not our problem, log it and go on
-		logger.Warn(errors.WrapPrefix(err, "Failed to POST session result to callback URL", 0))
+		err = errors.WrapPrefix(err, "Failed to POST session result to callback URL", 0)
+		logger.Warn(err)
+		return err
 	}
+	return nil
 }
 
 func log(level logrus.Level, err error, msg ...string) error {
@@ -405,6 +564,10 @@ func LogWarning(err error, msg ...string) error {
 }
 
 func LogRequest(typ, proto, method, url, from string, headers http.Header, message []byte) {
+	logRequest(context.Background(), typ, proto, method, url, from, headers, message)
+}
+
+func logRequest(ctx context.Context, typ, proto, method, url, from string, headers http.Header, message []byte) {
 	fields := logrus.Fields{
 		"type":   typ,
 		"proto":  proto,
@@ -424,10 +587,14 @@ func LogRequest(typ, proto, method, url, from string, headers http.Header, messa
 	if from != "" {
 		fields["from"] = from
 	}
-	Logger.WithFields(fields).Tracef("=> request")
+	Logger.WithContext(ctx).WithFields(fields).Tracef("=> request")
 }
 
 func LogResponse(url string, status int, duration time.Duration, binary bool, response []byte) {
+	logResponse(context.Background(), url, status, duration, binary, response)
+}
+
+func logResponse(ctx context.Context, url string, status int, duration time.Duration, binary bool, response []byte) {
 	fields := logrus.Fields{
 		"status":   status,
 		"duration": duration.String(),
@@ -439,7 +606,7 @@ func LogResponse(url string, status int, duration time.Duration, binary bool, re
 			fields["response"] = string(response)
 		}
 	}
-	l := Logger.WithFields(fields)
+	l := Logger.WithContext(ctx).WithFields(fields)
 	if status < 400 {
 		l.Trace("<= response")
 	} else {
@@ -461,6 +628,7 @@ func NewLogger(verbosity int, quiet bool, json bool) *logrus.Logger {
 	}
 
 	logger.Level = Verbosity(verbosity)
+	logger.AddHook(RequestIDHook{})
 	if json {
 		logger.SetFormatter(&logrus.JSONFormatter{})
 	} else {
@@ -527,8 +695,11 @@ func LogMiddleware(typ string, opts LogOptions) func(next http.Handler) http.Han
 				}
 				if opts.From {
 					from = r.RemoteAddr
+					if opts.ClientIP != nil {
+						from = opts.ClientIP(r)
+					}
 				}
-				LogRequest(typ, r.Proto, r.Method, r.URL.String(), from, headers, message)
+				logRequest(r.Context(), typ, r.Proto, r.Method, r.URL.String(), from, headers, message)
 			}
 
 			// copy output of HTTP handler to our buffer for later logging
@@ -556,7 +727,7 @@ func LogMiddleware(typ string, opts LogOptions) func(next http.Handler) http.Han
 				if opts.EncodeBinary && !strings.HasPrefix(ww.Header().Get("Content-Type"), "application/json") {
 					hexencode = true
 				}
-				LogResponse(r.URL.String(), ww.Status(), time.Since(start), hexencode, resp)
+				logResponse(r.Context(), r.URL.String(), ww.Status(), time.Since(start), hexencode, resp)
 			}()
 
 			// start timer and preform request
@@ -566,20 +737,6 @@ func LogMiddleware(typ string, opts LogOptions) func(next http.Handler) http.Han
 	}
 }
 
-// RecoverMiddleware is middleware that logs and returns a 500 error if something unhandled (panic) occurs
-func RecoverMiddleware(next http.Handler) http.Handler {
-	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		defer func() {
-			res := recover()
-			if res != nil {
-				LogError(errors.Errorf("Internal server error: %v", res))
-				WriteError(w, ErrorInternal, "")
-			}
-		}()
-		next.ServeHTTP(w, r)
-	})
-}
-
 func ParseBody(r *http.Request, input interface{}) error {
 	defer common.Close(r.Body)
 	body, err := io.ReadAll(r.Body)
@@ -623,6 +780,11 @@ func NewHTTPResponseRecorder(w http.ResponseWriter) *HTTPResponseRecorder {
 	}
 }
 
+// Unwrap returns the recorded http.ResponseWriter.
+func (r *HTTPResponseRecorder) Unwrap() http.ResponseWriter {
+	return r.wrapped
+}
+
 // Header implements http.ResponseWriter
 func (r *HTTPResponseRecorder) Header() http.Header {
 	return r.header
@@ -639,6 +801,14 @@ func (r *HTTPResponseRecorder) WriteHeader(statusCode int) {
 	r.statusCode = statusCode
 }
 
+// StatusCode returns the HTTP status code written to the recorder, which defaults to 200.
+func (r *HTTPResponseRecorder) StatusCode() int {
+	if r.statusCode == 0 {
+		return http.StatusOK
+	}
+	return r.statusCode
+}
+
 // Flush implements http.Flusher.
 func (r *HTTPResponseRecorder) Flush() {
 	if !r.Flushed {
@@ -7,10 +7,14 @@ import (
 	"github.com/privacybydesign/irmago/internal/common"
 	"io"
 	"net/http"
+	"os"
+	"path/filepath"
 	"testing"
 	"time"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/stretchr/testify/require"
 )
 
@@ -83,6 +87,61 @@ func TestParseSessionRequest(t *testing.T) {
 		_, err := ParseSessionRequest(`{"foo": "bar"}`)
 		require.Error(t, err)
 	})
+
+	t.Run("invalid context", func(t *testing.T) {
+		for _, request := range []string{
+			`{"@context":"https://irma.app/ld/request/revocation/v1","type":"irma-demo.RU.studentCard"}`,
+			`{"request":{"@context":"https://irma.app/ld/request/client/v1"}}`,
+		} {
+			_, err := ParseSessionRequest(request)
+			var ldContextErr *irma.LDContextError
+			require.ErrorAs(t, err, &ldContextErr)
+			require.Equal(t, ErrorLDContext, InputError(err, ErrorInvalidRequest))
+		}
+		require.Equal(t, ErrorInvalidRequest, InputError(fmt.Errorf("other error"), ErrorInvalidRequest))
+		_, err := ParseSessionRequest(`{"request":{}}`)
+		require.Error(t, err)
+		require.Equal(t, ErrorInvalidRequest, InputError(err, ErrorInvalidRequest))
+	})
+
+	t.Run("strict", func(t *testing.T) {
+		_, err := ParseSessionRequestStrict(requestJson)
+		require.NoError(t, err)
+		_, err = ParseSessionRequestStrict(requestorRequestJson)
+		require.NoError(t, err)
+
+		misspelled := `{"@context":"https://irma.app/ld/request/disclosure/v2","dislose":[[["irma-demo.RU.studentCard.studentID"]]]}`
+		_, err = ParseSessionRequestStrict(misspelled)
+		require.ErrorContains(t, err, "dislose")
+		_, err = ParseSessionRequestStrict(fmt.Sprintf(`{"request": %s, "validty": 60}`, requestJson))
+		require.ErrorContains(t, err, "validty")
+		_, err = ParseSessionRequestStrict(requestJson + `{}`)
+		require.Error(t, err)
+	})
+}
+
+func TestStrictJSONEnabled(t *testing.T) {
+	conf := &Configuration{StrictJSON: []string{StrictJSONProofs}}
+	require.NoError(t, conf.verifyStrictJSON())
+	require.True(t, conf.StrictJSONEnabled(StrictJSONProofs))
+	require.False(t, conf.StrictJSONEnabled(StrictJSONSessionRequests))
+
+	conf.StrictJSON = []string{StrictJSONAll}
+	require.True(t, conf.StrictJSONEnabled(StrictJSONSessionRequests))
+
+	conf.StrictJSON = []string{"sessions"}
+	require.Error(t, conf.verifyStrictJSON())
+}
+
+func TestValidatePurpose(t *testing.T) {
+	purpose := &irma.Purpose{Code: "kyc", Text: irma.TranslatedString{"en": "Identification of customers"}}
+	conf := &Configuration{Purposes: map[string][]string{"requestor": {"kyc"}}}
+	require.NoError(t, conf.ValidatePurpose("requestor", purpose))
+	require.NoError(t, conf.ValidatePurpose("other", purpose))
+	require.NoError(t, conf.ValidatePurpose("other", nil))
+	require.Error(t, conf.ValidatePurpose("requestor", nil))
+	require.Error(t, conf.ValidatePurpose("requestor", &irma.Purpose{Code: "marketing", Text: purpose.Text}))
+	require.Error(t, conf.ValidatePurpose("other", &irma.Purpose{Code: "kyc"}))
 }
 
 type readerFunc func(p []byte) (int, error)
@@ -171,3 +230,54 @@ func stopServer(t *testing.T, server *http.Server) {
 	require.NoError(t, server.Shutdown(ctx))
 	cancel()
 }
+
+func TestResultJwtVector(t *testing.T) {
+	bts, err := os.ReadFile(filepath.Join(test.FindTestdataFolder(t), "jwtkeys", "sk.pem"))
+	require.NoError(t, err)
+	sk, err := jwt.ParseRSAPrivateKeyFromPEM(bts)
+	require.NoError(t, err)
+
+	value := "456"
+	result := &SessionResult{
+		Token:       "AbCdEfGhIjKlMnOpQrSt",
+		Status:      irma.ServerStatusDone,
+		Type:        irma.ActionDisclosing,
+		ProofStatus: irma.ProofStatusValid,
+		Disclosed: [][]*irma.DisclosedAttribute{{{
+			RawValue:     &value,
+			Value:        irma.NewTranslatedString(&value),
+			Identifier:   irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+			Status:       irma.AttributeProofStatusPresent,
+			IssuanceTime: irma.Timestamp(time.Unix(1893456000, 0)),
+		}}},
+	}
+	token, err := ResultJwt(result, "testserver", 120, sk)
+	require.NoError(t, err)
+
+	// The vector contains the claims of the JWT, except for the time-dependent iat and exp
+	claims := jwt.MapClaims{}
+	_, err = jwt.ParseWithClaims(token, claims, func(*jwt.Token) (interface{}, error) { return &sk.PublicKey, nil })
+	require.NoError(t, err)
+	require.Equal(t, claims["iat"].(float64)+120, claims["exp"])
+	delete(claims, "iat")
+	delete(claims, "exp")
+	bts, err = json.Marshal(claims)
+	require.NoError(t, err)
+	test.CheckVector(t, "common/result-jwt-claims.json", bts)
+}
+
+func TestMappedResultJwtKeyID(t *testing.T) {
+	bts, err := os.ReadFile(filepath.Join(test.FindTestdataFolder(t), "jwtkeys", "sk.pem"))
+	require.NoError(t, err)
+	sk, err := jwt.ParseRSAPrivateKeyFromPEM(bts)
+	require.NoError(t, err)
+	result := &SessionResult{Token: "AbCdEfGhIjKlMnOpQrSt", Status: irma.ServerStatusDone, Type: irma.ActionDisclosing}
+
+	for kid, expected := range map[string]interface{}{"": nil, "2024-01": "2024-01"} {
+		token, err := MappedResultJwt(result, "testserver", 120, sk, kid, nil)
+		require.NoError(t, err)
+		parsed, err := jwt.Parse(token, func(*jwt.Token) (interface{}, error) { return &sk.PublicKey, nil })
+		require.NoError(t, err)
+		require.Equal(t, expected, parsed.Header["kid"])
+	}
+}
@@ -0,0 +1,101 @@
+package server
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"slices"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// Minimum length of the attribute hash salt in bytes.
+const minAttributeHashSaltLength = 16
+
+func (conf *Configuration) verifyAttributeHashing() error {
+	if conf.AttributeHashSalt == nil && conf.AttributeHashSaltFile != "" {
+		salt, err := common.ReadKey("", conf.AttributeHashSaltFile)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read attribute hash salt", 0)
+		}
+		conf.AttributeHashSalt = salt
+	}
+	if conf.AttributeHashSalt != nil && len(conf.AttributeHashSalt) < minAttributeHashSaltLength {
+		return errors.Errorf("Attribute hash salt must be at least %d bytes", minAttributeHashSaltLength)
+	}
+
+	for requestor, attrs := range conf.HashedAttributes {
+		if len(attrs) > 0 && conf.AttributeHashSalt == nil {
+			return errors.Errorf("Requestor %s has hashed attributes, but no attribute hash salt is configured", requestor)
+		}
+		for _, attr := range attrs {
+			if _, ok := conf.IrmaConfiguration.AttributeTypes[attr]; !ok {
+				return errors.Errorf("Unknown hashed attribute %s of requestor %s", attr, requestor)
+			}
+		}
+	}
+	return nil
+}
+
+// HashAttributeValue returns the salted hash of an attribute value for the requestor: the hex-encoded
+// HMAC-SHA256 of the value, keyed with the attribute hash salt and the requestor name, so that the
+// hashes of a value differ per requestor and cannot be computed without the salt.
+func (conf *Configuration) HashAttributeValue(requestor, value string) string {
+	key := hmac.New(sha256.New, conf.AttributeHashSalt)
+	key.Write([]byte(requestor))
+	mac := hmac.New(sha256.New, key.Sum(nil))
+	mac.Write([]byte(value))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// HashedAttributeRequested returns an attribute that is hashed for the requestor and occurs in the
+// condiscon, if any.
+func (conf *Configuration) HashedAttributeRequested(requestor string, condiscon irma.AttributeConDisCon) (irma.AttributeTypeIdentifier, bool) {
+	var found irma.AttributeTypeIdentifier
+	attrs := conf.HashedAttributes[requestor]
+	if len(attrs) == 0 {
+		return found, false
+	}
+	_ = condiscon.Iterate(func(attr *irma.AttributeRequest) error {
+		if found.Empty() && slices.Contains(attrs, attr.Type) {
+			found = attr.Type
+		}
+		return nil
+	})
+	return found, !found.Empty()
+}
+
+// HashResultAttributes returns the session result with the values of the disclosed attributes
+// that are hashed for the requestor (see HashedAttributes) replaced by their salted hashes, for
+// inclusion in result JWTs and callbacks. The result itself is not modified.
+func (conf *Configuration) HashResultAttributes(requestor string, result *SessionResult) *SessionResult {
+	attrs := conf.HashedAttributes[requestor]
+	if len(attrs) == 0 || result == nil || len(result.Disclosed) == 0 {
+		return result
+	}
+
+	hashed := *result
+	hashed.Disclosed = make([][]*irma.DisclosedAttribute, len(result.Disclosed))
+	for i, con := range result.Disclosed {
+		hashed.Disclosed[i] = make([]*irma.DisclosedAttribute, len(con))
+		for j, attr := range con {
+			hashed.Disclosed[i][j] = attr
+			if attr.RawValue == nil || !slices.Contains(attrs, attr.Identifier) {
+				continue
+			}
+			value := conf.HashAttributeValue(requestor, *attr.RawValue)
+			hashedAttr := *attr
+			hashedAttr.RawValue = &value
+			hashedAttr.Value = make(irma.TranslatedString, len(attr.Value))
+			for lang := range attr.Value {
+				hashedAttr.Value[lang] = value
+			}
+			// The hash is a string, regardless of the datatype of the attribute
+			hashedAttr.DataType = ""
+			hashed.Disclosed[i][j] = &hashedAttr
+		}
+	}
+	return &hashed
+}
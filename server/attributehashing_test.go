@@ -0,0 +1,66 @@
+package server
+
+import (
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHashResultAttributes(t *testing.T) {
+	bsn := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	conf := &Configuration{
+		HashedAttributes:  map[string][]irma.AttributeTypeIdentifier{"requestor": {bsn}},
+		AttributeHashSalt: []byte("0123456789abcdef"),
+	}
+	attr := disclosedAttribute(bsn.String(), "12345")
+	attr.Value = irma.TranslatedString{"": "12345", "en": "12345"}
+	attr.DataType = irma.AttributeDataTypeInteger
+	result := &SessionResult{Disclosed: [][]*irma.DisclosedAttribute{{
+		disclosedAttribute("irma-demo.MijnOverheid.fullName.firstname", "Alice"),
+		attr,
+	}}}
+
+	hashed := conf.HashResultAttributes("requestor", result)
+	hash := conf.HashAttributeValue("requestor", "12345")
+	require.Len(t, hash, 64)
+	require.Equal(t, hash, *hashed.Disclosed[0][1].RawValue)
+	require.Equal(t, irma.TranslatedString{"": hash, "en": hash}, hashed.Disclosed[0][1].Value)
+	require.Empty(t, hashed.Disclosed[0][1].DataType)
+	require.Equal(t, "Alice", *hashed.Disclosed[0][0].RawValue)
+
+	// The original result is not modified
+	require.Equal(t, "12345", *result.Disclosed[0][1].RawValue)
+	require.Equal(t, irma.AttributeDataTypeInteger, result.Disclosed[0][1].DataType)
+
+	// Hashes differ per requestor, and depend on the salt
+	require.NotEqual(t, hash, conf.HashAttributeValue("other", "12345"))
+	require.Same(t, result, conf.HashResultAttributes("other", result))
+	other := &Configuration{AttributeHashSalt: []byte("fedcba9876543210")}
+	require.NotEqual(t, hash, other.HashAttributeValue("requestor", "12345"))
+
+	disclose := irma.AttributeConDisCon{{{irma.NewAttributeRequest(bsn.String())}}}
+	found, ok := conf.HashedAttributeRequested("requestor", disclose)
+	require.True(t, ok)
+	require.Equal(t, bsn, found)
+	_, ok = conf.HashedAttributeRequested("other", disclose)
+	require.False(t, ok)
+}
+
+func TestVerifyAttributeHashing(t *testing.T) {
+	conf := &Configuration{
+		IrmaConfiguration: &irma.Configuration{AttributeTypes: map[irma.AttributeTypeIdentifier]*irma.AttributeType{
+			irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"): {},
+		}},
+		HashedAttributes: map[string][]irma.AttributeTypeIdentifier{
+			"requestor": {irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")},
+		},
+	}
+	require.Error(t, conf.verifyAttributeHashing())
+	conf.AttributeHashSalt = []byte("short")
+	require.Error(t, conf.verifyAttributeHashing())
+	conf.AttributeHashSalt = []byte("0123456789abcdef")
+	require.NoError(t, conf.verifyAttributeHashing())
+	conf.HashedAttributes["requestor"] = append(conf.HashedAttributes["requestor"], irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.foo"))
+	require.Error(t, conf.verifyAttributeHashing())
+}
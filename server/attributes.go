@@ -0,0 +1,85 @@
+package server
+
+import (
+	"unicode"
+	"unicode/utf8"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"golang.org/x/text/unicode/norm"
+)
+
+// AttributeValidation restricts the values of the attributes that the server issues, to prevent
+// issuing credentials that the IRMA app renders incorrectly or whose attributes do not fit in the
+// attribute encoding of the issuer's public key.
+type AttributeValidation struct {
+	// Maximum length of attribute values in bytes (0 means no maximum)
+	MaxLength int `json:"max_length" mapstructure:"max_length"`
+	// Unicode categories (e.g. "L", "Nd" or "Zs") or scripts (e.g. "Latin") to which all characters
+	// of attribute values must belong. If empty, all characters except control characters are allowed.
+	AllowedClasses []string `json:"allowed_classes" mapstructure:"allowed_classes"`
+	// Normalize attribute values to Unicode normalization form NFC before validating and issuing them
+	Normalize bool `json:"normalize" mapstructure:"normalize"`
+
+	classes []*unicode.RangeTable
+}
+
+// Validate checks the configuration, and must be called before the other methods.
+func (v *AttributeValidation) Validate() error {
+	if v.MaxLength < 0 {
+		return errors.New("max_length must not be negative")
+	}
+	v.classes = make([]*unicode.RangeTable, 0, len(v.AllowedClasses))
+	for _, class := range v.AllowedClasses {
+		table, ok := unicode.Categories[class]
+		if !ok {
+			table, ok = unicode.Scripts[class]
+		}
+		if !ok {
+			return errors.Errorf("unknown Unicode category or script %s", class)
+		}
+		v.classes = append(v.classes, table)
+	}
+	return nil
+}
+
+// Value returns the attribute value, normalized if so configured, or an error if it is not allowed.
+func (v *AttributeValidation) Value(value string) (string, error) {
+	if !utf8.ValidString(value) {
+		return "", errors.New("attribute value is not valid UTF-8")
+	}
+	if v.Normalize {
+		value = norm.NFC.String(value)
+	}
+	if v.MaxLength > 0 && len(value) > v.MaxLength {
+		return "", errors.Errorf("attribute value is longer than %d bytes", v.MaxLength)
+	}
+	for _, r := range value {
+		if len(v.classes) == 0 && unicode.IsControl(r) || len(v.classes) > 0 && !unicode.In(r, v.classes...) {
+			return "", errors.Errorf("attribute value contains disallowed character %U", r)
+		}
+	}
+	return value, nil
+}
+
+// Check checks the attribute values of the credential request, without modifying it.
+func (v *AttributeValidation) Check(cred *irma.CredentialRequest) error {
+	for name, value := range cred.Attributes {
+		if _, err := v.Value(value); err != nil {
+			return errors.WrapPrefix(err, "invalid value for attribute "+name, 0)
+		}
+	}
+	return nil
+}
+
+// Apply checks the attribute values of the credential request, normalizing them if so configured.
+func (v *AttributeValidation) Apply(cred *irma.CredentialRequest) error {
+	for name, value := range cred.Attributes {
+		value, err := v.Value(value)
+		if err != nil {
+			return errors.WrapPrefix(err, "invalid value for attribute "+name, 0)
+		}
+		cred.Attributes[name] = value
+	}
+	return nil
+}
@@ -0,0 +1,50 @@
+package server
+
+import (
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAttributeValidation(t *testing.T) {
+	require.Error(t, (&AttributeValidation{AllowedClasses: []string{"Klingon"}}).Validate())
+	require.Error(t, (&AttributeValidation{MaxLength: -1}).Validate())
+
+	v := &AttributeValidation{MaxLength: 4}
+	require.NoError(t, v.Validate())
+	_, err := v.Value("abcd")
+	require.NoError(t, err)
+	_, err = v.Value("abcde")
+	require.Error(t, err)
+	_, err = v.Value("ab\ncd")
+	require.Error(t, err)
+	_, err = v.Value("\xff")
+	require.Error(t, err)
+
+	v = &AttributeValidation{AllowedClasses: []string{"Latin", "Zs"}}
+	require.NoError(t, v.Validate())
+	_, err = v.Value("Jan Jansen")
+	require.NoError(t, err)
+	_, err = v.Value("Jan Jansen 2")
+	require.Error(t, err)
+}
+
+func TestAttributeValidationNormalize(t *testing.T) {
+	v := &AttributeValidation{Normalize: true, MaxLength: 2}
+	require.NoError(t, v.Validate())
+
+	// "e" followed by a combining acute accent is 3 bytes, its NFC form "\u00e9" is 2 bytes
+	value, err := v.Value("e\u0301")
+	require.NoError(t, err)
+	require.Equal(t, "\u00e9", value)
+
+	cred := &irma.CredentialRequest{Attributes: map[string]string{"name": "e\u0301"}}
+	require.NoError(t, v.Check(cred))
+	require.Equal(t, "e\u0301", cred.Attributes["name"])
+	require.NoError(t, v.Apply(cred))
+	require.Equal(t, "\u00e9", cred.Attributes["name"])
+
+	cred.Attributes["name"] = "abc"
+	require.Error(t, v.Apply(cred))
+}
@@ -0,0 +1,145 @@
+package server
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"strings"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// BulkIssuanceRequest is a request to start one issuance session per row of attribute values,
+// which is useful when onboarding a cohort of users at once.
+type BulkIssuanceRequest struct {
+	// Session request that serves as template for each of the issuance sessions, either as JSON
+	// or as a JWT (encoded as JSON string). It is authenticated in the same way as session requests
+	// that are POSTed to /session.
+	Request json.RawMessage `json:"request"`
+	// Maps column names of the rows to attribute types of the credentials in the template.
+	// Columns that are not present in the mapping are mapped to the attribute of the same name,
+	// if exactly one credential type in the template has such an attribute.
+	Mapping map[string]irma.AttributeTypeIdentifier `json:"mapping,omitempty"`
+	// Attribute values per session, indexed by column name
+	Rows []map[string]string `json:"rows"`
+	// If set, the column containing the email address or phone number of the user, to which the
+	// session link is sent. This column is not mapped to an attribute. Requires the server to be
+	// configured for sending session links.
+	RecipientColumn string `json:"recipientColumn,omitempty"`
+	// Language of the session link messages (default: the server's default language)
+	Language string `json:"language,omitempty"`
+}
+
+// BulkIssuanceResult reports on the session that was started for a single row of a BulkIssuanceRequest.
+type BulkIssuanceResult struct {
+	Row        int                 `json:"row"`
+	Token      irma.RequestorToken `json:"token,omitempty"`
+	SessionPtr *irma.Qr            `json:"sessionPtr,omitempty"`
+	Status     irma.ServerStatus   `json:"status,omitempty"`
+	Notified   bool                `json:"notified,omitempty"`
+	Err        *irma.RemoteError   `json:"error,omitempty"`
+}
+
+// ParseBulkIssuanceCSV reads CSV data whose first line contains the column names,
+// and returns the subsequent lines as rows suitable for BulkIssuanceRequest.Rows.
+func ParseBulkIssuanceCSV(r io.Reader) ([]map[string]string, error) {
+	reader := csv.NewReader(r)
+	reader.TrimLeadingSpace = true
+	records, err := reader.ReadAll()
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to parse CSV", 0)
+	}
+	if len(records) == 0 {
+		return nil, errors.New("CSV contains no header line")
+	}
+
+	header := records[0]
+	for i, name := range header {
+		header[i] = strings.TrimSpace(name)
+		if header[i] == "" {
+			return nil, errors.Errorf("CSV header contains empty column name at column %d", i+1)
+		}
+	}
+
+	rows := make([]map[string]string, 0, len(records)-1)
+	for _, record := range records[1:] {
+		row := make(map[string]string, len(header))
+		for i, value := range record {
+			row[header[i]] = value
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// RowRequest returns a copy of the specified issuance request template in which the attribute values
+// are taken from the given row, according to the mapping of the BulkIssuanceRequest.
+func (req *BulkIssuanceRequest) RowRequest(
+	conf *irma.Configuration, template *irma.IdentityProviderRequest, row map[string]string,
+) (*irma.IdentityProviderRequest, error) {
+	bts, err := json.Marshal(template)
+	if err != nil {
+		return nil, err
+	}
+	request := &irma.IdentityProviderRequest{}
+	if err = json.Unmarshal(bts, request); err != nil {
+		return nil, err
+	}
+
+	for column, value := range row {
+		if column == req.RecipientColumn {
+			continue
+		}
+		attr, err := req.attributeForColumn(conf, request.Request, column)
+		if err != nil {
+			return nil, err
+		}
+		cred := findCredentialRequest(request.Request, attr.CredentialTypeIdentifier())
+		if cred == nil {
+			return nil, errors.Errorf("column %s maps to attribute %s of a credential not present in the request", column, attr)
+		}
+		if cred.Attributes == nil {
+			cred.Attributes = map[string]string{}
+		}
+		cred.Attributes[attr.Name()] = value
+	}
+	return request, nil
+}
+
+func (req *BulkIssuanceRequest) attributeForColumn(
+	conf *irma.Configuration, request *irma.IssuanceRequest, column string,
+) (irma.AttributeTypeIdentifier, error) {
+	if attr, ok := req.Mapping[column]; ok {
+		return attr, nil
+	}
+
+	var found []irma.AttributeTypeIdentifier
+	for _, cred := range request.Credentials {
+		credtype := conf.CredentialTypes[cred.CredentialTypeID]
+		if credtype == nil {
+			return irma.AttributeTypeIdentifier{}, errors.Errorf("unknown credential type %s", cred.CredentialTypeID)
+		}
+		attr := irma.NewAttributeTypeIdentifier(cred.CredentialTypeID.String() + "." + column)
+		if credtype.ContainsAttribute(attr) {
+			found = append(found, attr)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return irma.AttributeTypeIdentifier{}, errors.Errorf("column %s is not mapped to any attribute", column)
+	case 1:
+		return found[0], nil
+	default:
+		return irma.AttributeTypeIdentifier{}, errors.Errorf("column %s is ambiguous, specify a mapping for it", column)
+	}
+}
+
+func findCredentialRequest(request *irma.IssuanceRequest, id irma.CredentialTypeIdentifier) *irma.CredentialRequest {
+	for _, cred := range request.Credentials {
+		if cred.CredentialTypeID == id {
+			return cred
+		}
+	}
+	return nil
+}
@@ -0,0 +1,90 @@
+package server
+
+import (
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestParseBulkIssuanceCSV(t *testing.T) {
+	t.Run("valid", func(t *testing.T) {
+		rows, err := ParseBulkIssuanceCSV(strings.NewReader("firstname, familyname\nAlice,Smith\nBob, Jones\n"))
+		require.NoError(t, err)
+		require.Equal(t, []map[string]string{
+			{"firstname": "Alice", "familyname": "Smith"},
+			{"firstname": "Bob", "familyname": "Jones"},
+		}, rows)
+	})
+
+	t.Run("empty", func(t *testing.T) {
+		_, err := ParseBulkIssuanceCSV(strings.NewReader(""))
+		require.Error(t, err)
+	})
+
+	t.Run("empty column name", func(t *testing.T) {
+		_, err := ParseBulkIssuanceCSV(strings.NewReader("firstname,\nAlice,Smith\n"))
+		require.Error(t, err)
+	})
+
+	t.Run("inconsistent number of fields", func(t *testing.T) {
+		_, err := ParseBulkIssuanceCSV(strings.NewReader("firstname,familyname\nAlice\n"))
+		require.Error(t, err)
+	})
+}
+
+func TestBulkIssuanceRowRequest(t *testing.T) {
+	conf, err := irma.NewConfiguration(
+		filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		irma.ConfigurationOptions{},
+	)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	fullName := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	template := &irma.IdentityProviderRequest{
+		Request: irma.NewIssuanceRequest([]*irma.CredentialRequest{
+			{CredentialTypeID: fullName, Attributes: map[string]string{"prefix": "van"}},
+			{CredentialTypeID: studentCard},
+		}),
+	}
+
+	t.Run("implicit mapping", func(t *testing.T) {
+		req := &BulkIssuanceRequest{}
+		request, err := req.RowRequest(conf, template, map[string]string{"firstname": "Alice", "studentID": "s123"})
+		require.NoError(t, err)
+		require.Equal(t, map[string]string{"firstname": "Alice", "prefix": "van"}, request.Request.Credentials[0].Attributes)
+		require.Equal(t, map[string]string{"studentID": "s123"}, request.Request.Credentials[1].Attributes)
+
+		// The template must be left untouched
+		require.Equal(t, map[string]string{"prefix": "van"}, template.Request.Credentials[0].Attributes)
+		require.Nil(t, template.Request.Credentials[1].Attributes)
+	})
+
+	t.Run("explicit mapping", func(t *testing.T) {
+		req := &BulkIssuanceRequest{Mapping: map[string]irma.AttributeTypeIdentifier{
+			"surname": irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname"),
+		}}
+		request, err := req.RowRequest(conf, template, map[string]string{"surname": "Smith"})
+		require.NoError(t, err)
+		require.Equal(t, "Smith", request.Request.Credentials[0].Attributes["familyname"])
+	})
+
+	t.Run("unmapped column", func(t *testing.T) {
+		req := &BulkIssuanceRequest{}
+		_, err := req.RowRequest(conf, template, map[string]string{"surname": "Smith"})
+		require.Error(t, err)
+	})
+
+	t.Run("mapping to absent credential", func(t *testing.T) {
+		req := &BulkIssuanceRequest{Mapping: map[string]irma.AttributeTypeIdentifier{
+			"email": irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"),
+		}}
+		_, err := req.RowRequest(conf, template, map[string]string{"email": "123"})
+		require.Error(t, err)
+	})
+}
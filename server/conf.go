@@ -2,14 +2,21 @@ package server
 
 import (
 	"context"
+	"crypto"
+	"crypto/rand"
 	"crypto/rsa"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"fmt"
+	"io"
+	"net"
+	"net/url"
 	"regexp"
+	"slices"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-co-op/gocron"
@@ -32,14 +39,65 @@ type Configuration struct {
 	SchemesPath string `json:"schemes_path" mapstructure:"schemes_path"`
 	// If specified, schemes found here are copied into SchemesPath (only used if IrmaConfiguration == nil)
 	SchemesAssetsPath string `json:"schemes_assets_path" mapstructure:"schemes_assets_path"`
+	// If specified, parsed schemes are cached here, so that unchanged schemes are parsed faster
+	// on the next startup (only used if IrmaConfiguration == nil)
+	SchemesCachePath string `json:"schemes_cache_path" mapstructure:"schemes_cache_path"`
+	// If specified, accepted scheme index signatures are recorded in this append-only transparency
+	// log, and scheme updates that roll back or fork a logged scheme are refused
+	SchemesLogPath string `json:"schemes_log_path" mapstructure:"schemes_log_path"`
+	// If specified, entries of the scheme transparency log are also submitted to this URL
+	SchemesLogSubmitURL string `json:"schemes_log_submit_url" mapstructure:"schemes_log_submit_url"`
 	// Disable scheme updating
 	DisableSchemesUpdate bool `json:"disable_schemes_update" mapstructure:"disable_schemes_update"`
 	// Update all schemes every x minutes (default value 0 means 60) (use DisableSchemesUpdate to disable)
 	SchemesUpdateInterval int `json:"schemes_update" mapstructure:"schemes_update"`
+	// Parse only the schemes in EagerSchemes at startup, and other schemes when sessions first need
+	// them, to reduce startup time (only used if IrmaConfiguration == nil)
+	LazySchemes bool `json:"lazy_schemes" mapstructure:"lazy_schemes"`
+	// Schemes to parse at startup if LazySchemes is enabled. The IRMA server populates this with
+	// the schemes referred to by the permissions of the requestors.
+	EagerSchemes []irma.SchemeManagerIdentifier `json:"-"`
+	// Verify keyshare server JWTs signed with keys not present in the scheme against the JWKS
+	// published by the keyshare server, so that keyshare servers can rotate their keys
+	KeyshareJWKS bool `json:"keyshare_jwks" mapstructure:"keyshare_jwks"`
+	// Per scheme, additional public keys with which keyshare server JWTs are accepted during
+	// the given validity windows, e.g. while migrating to a new keyshare server deployment
+	KeyshareKeys map[irma.SchemeManagerIdentifier][]KeyshareKey `json:"keyshare_keys" mapstructure:"keyshare_keys"`
+	// Sessions involving these credential types always require pairing of the frontend and the
+	// IRMA app, regardless of the frontend options
+	PairingRequiredCredentials []irma.CredentialTypeIdentifier `json:"pairing_required_credentials" mapstructure:"pairing_required_credentials"`
+	// Credential types that may still be issued and verified after their sunset date (see
+	// irma.CredentialType.SunsetDate), e.g. while migrating to their replacement
+	AllowSunsetCredentials []irma.CredentialTypeIdentifier `json:"allow_sunset_credentials" mapstructure:"allow_sunset_credentials"`
+	// Number of days before their expiry within which disclosed credentials are included in the
+	// reissuance hints of the session result, in addition to expired credentials (default value 0
+	// means only expired credentials)
+	ReissuanceHintDays int `json:"reissuance_hint_days" mapstructure:"reissuance_hint_days"`
+	// Refuse sessions involving issuers of which not all public keys have a valid keyproof (proof of
+	// correct key generation, see "irma issuer keyprove"). The keyproofs are verified at startup,
+	// which takes several minutes per public key; those of public keys added later are verified in
+	// the background, until which sessions involving them are refused.
+	RequireKeyproofs bool `json:"require_keyproofs" mapstructure:"require_keyproofs"`
+	// Endpoints at which JSON messages containing unknown fields are refused (any of the StrictJSON
+	// constants, or StrictJSONAll), so that e.g. misspelled fields do not go unnoticed
+	StrictJSON []string `json:"strict_json" mapstructure:"strict_json"`
 	// Path to issuer private keys to parse
 	IssuerPrivateKeysPath string `json:"privkeys" mapstructure:"privkeys"`
 	// URL at which the IRMA app can reach this server during sessions
 	URL string `json:"url" mapstructure:"url"`
+	// Alternative URLs at which the IRMA app can reach this server during sessions, e.g. on other
+	// networks or over IPv6, which are included in session pointers so that the app can use the
+	// first one it can reach if it cannot reach URL
+	AlternativeURLs []string `json:"alternative_urls" mapstructure:"alternative_urls"`
+	// External URL to the frontend endpoints, if these are served separately from the endpoints for the
+	// IRMA app (using irmaserver.FrontendHandlerFunc()). If set, irmaserver.HandlerFunc() does not serve
+	// the frontend endpoints.
+	FrontendURL string `json:"frontend_url" mapstructure:"frontend_url"`
+	// Path under which irmaserver.HandlerFunc() and irmaserver.FrontendHandlerFunc() are mounted,
+	// e.g. /irma/ behind an ingress that forwards requests at that path. The handlers strip it from
+	// request paths that start with it, so it does not matter whether the ingress strips it, and it
+	// is appended to URL, AlternativeURLs and FrontendURL if they do not already end with it.
+	PathPrefix string `json:"path_prefix" mapstructure:"path_prefix"`
 	// Required to be set to true if URL does not begin with https:// in production mode.
 	// In this case, the server would communicate with IRMA apps over plain HTTP. You must otherwise
 	// ensure (using eg a reverse proxy with TLS enabled) that the attributes are protected in transit.
@@ -50,6 +108,14 @@ type Configuration struct {
 	Email string `json:"email" mapstructure:"email"`
 	// Enable server sent events for status updates (experimental; tends to hang when a reverse proxy is used)
 	EnableSSE bool `json:"enable_sse" mapstructure:"enable_sse"`
+	// Maximum number of simultaneous server-sent events connections, in total and per session and
+	// kind of subscriber (IRMA app, frontend or requestor) (default value 0 means unlimited)
+	MaxSSEConnections           int `json:"max_sse_connections" mapstructure:"max_sse_connections"`
+	MaxSSEConnectionsPerSession int `json:"max_sse_connections_per_session" mapstructure:"max_sse_connections_per_session"`
+	// Interval in seconds at which heartbeat comments are sent over server-sent events connections,
+	// to prevent proxies from closing idle connections (default value 0 means 30, negative values
+	// disable heartbeats)
+	SSEHeartbeatInterval int `json:"sse_heartbeat_interval" mapstructure:"sse_heartbeat_interval"`
 	// StoreType in which session data will be stored.
 	// If left empty, session data will be stored in memory by default.
 	StoreType string `json:"store_type" mapstructure:"store_type"`
@@ -57,6 +123,21 @@ type Configuration struct {
 	RedisSettings *RedisSettings `json:"redis_settings" mapstructure:"redis_settings"`
 	// redisClient that is already initialized using the above RedisSettings.
 	redisClient *RedisClient `json:"-"`
+	// File containing the 32 byte AES key with which the stateless session store (store type
+	// "stateless") encrypts and authenticates the session state that it puts in client tokens.
+	// Each server instance refuses client tokens of sessions that it finished before, but other
+	// instances do not know of these, so that the session result callback can be made more than
+	// once; requestors should deduplicate callbacks using their Idempotency-Key header.
+	StatelessSessionKeyFile string `json:"stateless_session_key_file" mapstructure:"stateless_session_key_file"`
+	// Stateless session key read from StatelessSessionKeyFile, if not set directly.
+	StatelessSessionKey []byte `json:"-"`
+	// Session store operations taking longer than this many milliseconds are logged (0 disables logging)
+	SlowStoreOperationThreshold int `json:"slow_store_operation_threshold" mapstructure:"slow_store_operation_threshold"`
+	// Directory to which heap and goroutine profiles are written when the heap size exceeds
+	// ProfileHeapThreshold (leave empty to disable)
+	ProfileDir string `json:"profile_dir" mapstructure:"profile_dir"`
+	// Heap size in megabytes above which profiles are written to ProfileDir
+	ProfileHeapThreshold int `json:"profile_heap_threshold" mapstructure:"profile_heap_threshold"`
 
 	// Static session requests that can be created by POST /session/{name}
 	StaticSessions map[string]interface{} `json:"static_sessions"`
@@ -65,8 +146,30 @@ type Configuration struct {
 
 	// Maximum duration of a session once a client connects in minutes (default value 0 means 15)
 	MaxSessionLifetime int `json:"max_session_lifetime" mapstructure:"max_session_lifetime"`
+	// Maximum duration in minutes of offline sessions before a client connects, if the session
+	// request specifies no client timeout (default value 0 means 60)
+	OfflineSessionLifetime int `json:"offline_session_lifetime" mapstructure:"offline_session_lifetime"`
 	// Determines how long a session result is preserved in minutes (default value 0 means 5)
 	SessionResultLifetime int `json:"session_result_lifetime" mapstructure:"session_result_lifetime"`
+	// Interval in seconds at which expired sessions are deleted from the memory session store
+	// (default value 0 means 10; the Redis session store expires sessions itself)
+	SessionCleanupInterval int `json:"session_cleanup_interval" mapstructure:"session_cleanup_interval"`
+	// File to which the sessions of the memory session store are saved periodically and on shutdown,
+	// and from which they are restored on startup (leave empty to disable)
+	SessionSnapshotFile string `json:"session_snapshot_file" mapstructure:"session_snapshot_file"`
+	// Interval in seconds at which the memory session store is saved to the session snapshot file
+	// (default value 0 means 60)
+	SessionSnapshotInterval int `json:"session_snapshot_interval" mapstructure:"session_snapshot_interval"`
+	// Duration in milliseconds (at most 1000) during which responses to status requests of the IRMA
+	// app and frontend are cached, so that frequent polls of the same session need not each access the
+	// session store (default value 0 disables caching). Concurrent identical status requests are
+	// always handled only once.
+	StatusCacheDuration int `json:"status_cache_duration" mapstructure:"status_cache_duration"`
+
+	// Record the history of each session, i.e. its status changes and the requests of the IRMA app
+	// and frontend (without attribute values), for debugging e.g. why a session timed out. The
+	// history can be retrieved using irmaserver.GetSessionHistory().
+	SessionHistory bool `json:"session_history" mapstructure:"session_history"`
 
 	// Used in the "iss" field of result JWTs from /result-jwt and /getproof
 	JwtIssuer string `json:"jwt_issuer" mapstructure:"jwt_issuer"`
@@ -75,12 +178,90 @@ type Configuration struct {
 	JwtPrivateKeyFile string `json:"jwt_privkey_file" mapstructure:"jwt_privkey_file"`
 	// Parsed JWT private key
 	JwtRSAPrivateKey *rsa.PrivateKey `json:"-"`
+	// URI of an RSA key in a key management service with which JWTs are signed instead of with
+	// JwtPrivateKey, so that the private key is never present on this host (see NewKMSSigner()).
+	JwtSigner string `json:"jwt_signer" mapstructure:"jwt_signer"`
+	// Signer constructed from JwtSigner, if not set directly. Can be set to any crypto.Signer of an RSA key.
+	JwtCryptoSigner crypto.Signer `json:"-"`
+	// Maximum number of requests per minute per IP address to the public configuration endpoint
+	// at irma.PublicConfigurationPath (default value 0 means 60)
+	PublicConfigurationRateLimit int `json:"public_configuration_rate_limit" mapstructure:"public_configuration_rate_limit"`
+	// Timeouts, retries, backoff, proxy, additional trusted CAs and DNS resolver of the outbound HTTP
+	// requests of the server, e.g. result callbacks, requests for next sessions, and requests to
+	// revocation servers, keyshare servers and scheme hosts. These are not applied to an
+	// IrmaConfiguration passed by the caller that has its own HTTPClient.
+	OutboundHTTP irma.HTTPClientSettings `json:"outbound_http" mapstructure:"outbound_http"`
+	// Forbid outbound network access to other servers (air-gapped mode), for e.g. offline
+	// verification terminals. Options and session requests that need it (e.g. email, jwt_signer,
+	// revocation SSE, callback URLs and next sessions) are refused, and schemes are not updated nor
+	// downloaded. Connections to the configured session store and databases are not affected.
+	AirGapped bool `json:"air_gapped" mapstructure:"air_gapped"`
+	// IP addresses or CIDR ranges (e.g. 10.0.0.0/8) of the reverse proxies in front of this server,
+	// whose forwarded headers are honored when determining the address, scheme and host of clients
+	TrustedProxies []string `json:"trusted_proxies" mapstructure:"trusted_proxies"`
+	// Forwarded headers of trusted proxies to honor: X-Forwarded-For, X-Forwarded-Proto and/or
+	// X-Forwarded-Host (default X-Forwarded-For and X-Forwarded-Proto if TrustedProxies is set)
+	ForwardedHeaders []string `json:"forwarded_headers" mapstructure:"forwarded_headers"`
+	// Parsed TrustedProxies
+	trustedProxies []*net.IPNet
+	// Whether to sign session pointers (QR contents) with the JWT private key, so that clients
+	// that have pinned the corresponding public key can detect replaced QRs
+	SignSessionPointers bool `json:"sign_session_ptrs" mapstructure:"sign_session_ptrs"`
+	// Disclosed attributes to include as named (and optionally transformed) values in result JWTs
+	ResultJwtClaims AttributeMapping `json:"result_jwt_claims" mapstructure:"result_jwt_claims"`
+	// Per requestor, the attributes whose values are replaced by salted hashes in the session results
+	// that the requestor receives as JWT or callback (see HashResultAttributes()), so that these
+	// values (e.g. a BSN) do not end up in logs and queues downstream
+	HashedAttributes map[string][]irma.AttributeTypeIdentifier `json:"hashed_attributes" mapstructure:"hashed_attributes"`
+	// Per requestor, the codes of the purposes (see irma.Purpose) that its sessions may have. The session
+	// requests of requestors present here must specify one of their purposes.
+	Purposes map[string][]string `json:"purposes" mapstructure:"purposes"`
+	// Per requestor, the key ID included in the kid header of the result JWTs and callback JWTs that
+	// the requestor receives, e.g. so that it can select the right key when the JWT key is rotated
+	JwtKeyIDs map[string]string `json:"jwt_kids" mapstructure:"jwt_kids"`
+	// File containing the secret salt (at least 16 bytes) with which attribute values are hashed
+	AttributeHashSaltFile string `json:"attribute_hash_salt_file" mapstructure:"attribute_hash_salt_file"`
+	// Attribute hash salt read from AttributeHashSaltFile, if not set directly
+	AttributeHashSalt []byte `json:"-"`
+	// PEM file containing the certificates of the issuing authorities (IACA certificates) of the
+	// mdocs (ISO/IEC 18013-5) that are accepted in sessions in which mdoc presentation is enabled
+	MdocIssuerCertificatesFile string `json:"mdoc_issuer_certs_file" mapstructure:"mdoc_issuer_certs_file"`
+	// Mdoc issuer certificates read from MdocIssuerCertificatesFile, if not set directly
+	MdocIssuerCertificates []*x509.Certificate `json:"-"`
+	// Data elements of mdocs that may be presented instead of the attributes to which they are mapped
+	MdocMapping MdocMapping `json:"mdoc_mapping" mapstructure:"mdoc_mapping"`
+	// Pool of the mdoc issuer certificates
+	mdocRoots *x509.CertPool
+	// Restrictions on the values of issued attributes (leave nil to disable)
+	AttributeValidation *AttributeValidation `json:"attribute_validation" mapstructure:"attribute_validation"`
+	// Number of days before the expiry of the public key of an issuer private key at which to start
+	// warning about it, and issuing with the issuer's fallback key if configured (0 to disable)
+	KeyExpiryWarning int `json:"key_expiry_warning" mapstructure:"key_expiry_warning"`
+	// Per issuer, the counter of the key with which to issue instead of its latest key, once the
+	// public key of the latest key expires within key_expiry_warning days
+	FallbackKeys map[irma.IssuerIdentifier]uint `json:"fallback_keys" mapstructure:"fallback_keys"`
+	// Called for each issuer key whose public key expires within key_expiry_warning days,
+	// when checking daily for expiring keys
+	KeyExpiryHandler func(IssuerKeyExpiry) `json:"-"`
+	// Default and derived values of attributes, applied during issuance
+	IssuancePolicies IssuancePolicies `json:"issuance_policies" mapstructure:"issuance_policies"`
 	// Whether to allow callbackUrl to be set in session requests when no JWT privatekey is installed
 	// (which is potentially unsafe depending on the setup)
 	AllowUnsignedCallbacks bool `json:"allow_unsigned_callbacks" mapstructure:"allow_unsigned_callbacks"`
+	// Keep session results that could not be POSTed to the callback URL of their session in an
+	// outbox in the session store, from which their delivery is periodically retried
+	CallbackOutbox bool `json:"callback_outbox" mapstructure:"callback_outbox"`
+	// Interval in seconds between redelivery attempts of undelivered session results (default value 0 means 60)
+	CallbackRedeliveryInterval int `json:"callback_redelivery_interval" mapstructure:"callback_redelivery_interval"`
+	// Determines how long undelivered session results are kept in the outbox in minutes (default value 0 means 1440)
+	CallbackOutboxLifetime int `json:"callback_outbox_lifetime" mapstructure:"callback_outbox_lifetime"`
 	// Whether to augment the clientreturnurl with the server token of the request (this allows for stateless
 	// requestor servers more easily)
 	AugmentClientReturnURL bool `json:"augment_client_return_url" mapstructure:"augment_client_return_url"`
+	// Whether to replace the authorization of IRMA apps that support it after each of their requests,
+	// sending them the next one in the X-IRMA-Next-Authorization response header. Only enable this if
+	// reverse proxies in front of this server pass this header on to the app.
+	RotateClientAuth bool `json:"rotate_client_auth" mapstructure:"rotate_client_auth"`
 
 	// Logging verbosity level: 0 is normal, 1 includes DEBUG level, 2 includes TRACE level
 	Verbose int `json:"verbose" mapstructure:"verbose"`
@@ -90,6 +271,9 @@ type Configuration struct {
 	LogJSON bool `json:"log_json" mapstructure:"log_json"`
 	// Custom logger instance. If specified, Verbose, Quiet and LogJSON are ignored.
 	Logger *logrus.Logger `json:"-"`
+	// Translations of error descriptions per language (e.g. "nl") and error code, in addition to
+	// or overriding the included translations, see LocalizationMiddleware()
+	ErrorTranslations map[string]map[irma.RemoteErrorCode]string `json:"error_translations" mapstructure:"error_translations"`
 
 	// Connection string for revocation database
 	RevocationDBConnStr string `json:"revocation_db_str" mapstructure:"revocation_db_str"`
@@ -100,8 +284,85 @@ type Configuration struct {
 
 	// Production mode: enables safer and stricter defaults and config checking
 	Production bool `json:"production" mapstructure:"production"`
+
+	// Mock mode, for end-to-end tests of requestor backends without an IRMA app: sessions are
+	// completed as soon as they are started, with fake results in which the requested attributes
+	// are disclosed. Cannot be used in production mode nor with the stateless session store.
+	MockMode bool `json:"mock_mode" mapstructure:"mock_mode"`
+	// Values of the attributes in the fake results of MockMode, per attribute type identifier.
+	// Attributes not specified here get the value required by the session request, if any, or
+	// otherwise a value depending on their datatype: "mock", 0, true or the current date.
+	MockAttributes map[string]string `json:"mock_attributes" mapstructure:"mock_attributes"`
+
+	// Custom clock, used instead of the system time for time-dependent checks such as session expiry
+	// and public key expiry (e.g. to test them). If nil, the system time is used.
+	Clock Clock `json:"-"`
+	// Custom source of randomness, used instead of crypto/rand for generating session tokens,
+	// pairing codes, binding codes and nonces (e.g. to make tests reproducible by passing a seeded
+	// math/rand.Rand). If nil, crypto/rand is used. Cannot be used in production mode. Reads are
+	// serialized, so the reader need not be safe for concurrent use.
+	Entropy io.Reader `json:"-"`
+
+	// Client of the outbound HTTP requests, created from OutboundHTTP by Check()
+	httpClient *irma.HTTPClient
+	// Entropy, wrapped by Check() so that it is read by one goroutine at a time
+	entropy *lockedReader
+	// Included translations of error descriptions along with ErrorTranslations, set by Check()
+	errorTranslations *errorTranslations
+}
+
+// lockedReader serializes the reads of a reader that is not safe for concurrent use.
+type lockedReader struct {
+	sync.Mutex
+	r io.Reader
 }
 
+func (l *lockedReader) Read(p []byte) (int, error) {
+	l.Lock()
+	defer l.Unlock()
+	return l.r.Read(p)
+}
+
+// Clock provides the current time.
+type Clock interface {
+	Now() time.Time
+}
+
+// Now returns the current time according to the configured Clock.
+func (conf *Configuration) Now() time.Time {
+	if conf.Clock == nil {
+		return time.Now()
+	}
+	return conf.Clock.Now()
+}
+
+// HTTPClient returns the client with which outbound HTTP requests are sent, according to
+// OutboundHTTP and AirGapped.
+func (conf *Configuration) HTTPClient() *irma.HTTPClient {
+	return conf.httpClient
+}
+
+// Rand returns the source of randomness according to the configured Entropy.
+func (conf *Configuration) Rand() io.Reader {
+	if conf.Entropy == nil {
+		return rand.Reader
+	}
+	if conf.entropy == nil || conf.entropy.r != conf.Entropy {
+		return conf.Entropy // Check() not invoked yet
+	}
+	return conf.entropy
+}
+
+// Endpoints at which strict JSON parsing can be enabled using StrictJSON in the Configuration.
+const (
+	StrictJSONAll                = "all"
+	StrictJSONSessionRequests    = "session"     // session requests of requestors (POST /session, /session/preflight)
+	StrictJSONRevocationRequests = "revocation"  // revocation requests of requestors (POST /revocation)
+	StrictJSONCommitments        = "commitments" // issuance commitments of the IRMA app
+	StrictJSONProofs             = "proofs"      // disclosures and signatures of the IRMA app
+	StrictJSONFrontendOptions    = "options"     // session options of the frontend
+)
+
 type RedisClient struct {
 	*redis.Client
 	FailoverMode bool
@@ -121,6 +382,9 @@ type RedisSettings struct {
 	// ACLUseKeyPrefixes ensures all Redis keys are prefixed with the username in the format "username:key".
 	// This can be used for key permissions in the Redis ACL system. If ACLUseKeyPrefixes is false, no prefix is used.
 	ACLUseKeyPrefixes bool `json:"acl_use_key_prefixes,omitempty" mapstructure:"acl_use_key_prefixes"`
+	// KeyPrefix is prepended to all Redis keys in the format "prefix:key" (after the username prefix, if enabled),
+	// so that multiple servers can share a Redis database without key collisions.
+	KeyPrefix string `json:"key_prefix,omitempty" mapstructure:"key_prefix"`
 
 	// SentinelUsername for Redis Sentinel authentication. If sentinel_username is empty, the default user is used.
 	SentinelUsername string `json:"sentinel_username,omitempty" mapstructure:"sentinel_username"`
@@ -141,26 +405,82 @@ func (conf *Configuration) Check() error {
 	if conf.Logger == nil {
 		conf.Logger = NewLogger(conf.Verbose, conf.Quiet, conf.LogJSON)
 	}
-	Logger = conf.Logger
-	irma.SetLogger(conf.Logger)
+	// Avoid writing the package loggers if unchanged, as other instances may be using them
+	if Logger != conf.Logger {
+		Logger = conf.Logger
+	}
+	if irma.Logger != conf.Logger {
+		irma.SetLogger(conf.Logger)
+	}
+
+	var err error
+	if conf.errorTranslations, err = includedErrorTranslations.with(conf.ErrorTranslations); err != nil {
+		return err
+	}
 
 	// Use default session lifetimes if not specified
 	if conf.MaxSessionLifetime == 0 {
 		conf.MaxSessionLifetime = 15
 	}
+	if conf.OfflineSessionLifetime == 0 {
+		conf.OfflineSessionLifetime = 60
+	}
 	if conf.SessionResultLifetime == 0 {
 		conf.SessionResultLifetime = 5
 	}
+	if conf.SessionCleanupInterval == 0 {
+		conf.SessionCleanupInterval = 10
+	}
+	if conf.SessionSnapshotInterval == 0 {
+		conf.SessionSnapshotInterval = 60
+	}
+	if conf.CallbackRedeliveryInterval == 0 {
+		conf.CallbackRedeliveryInterval = 60
+	}
+	if conf.CallbackOutboxLifetime == 0 {
+		conf.CallbackOutboxLifetime = 24 * 60
+	}
+	if conf.SSEHeartbeatInterval == 0 {
+		conf.SSEHeartbeatInterval = 30
+	}
+	if conf.PublicConfigurationRateLimit == 0 {
+		conf.PublicConfigurationRateLimit = 60
+	}
+
+	if conf.Production && conf.Entropy != nil {
+		return errors.New("Entropy cannot be used in production mode")
+	}
+	if conf.Entropy != nil && (conf.entropy == nil || conf.entropy.r != conf.Entropy) {
+		conf.entropy = &lockedReader{r: conf.Entropy}
+	}
 
 	// loop to avoid repetetive err != nil line triplets
 	for _, f := range []func() error{
+		conf.verifyOutboundHTTP,
 		conf.verifyIrmaConf,
 		conf.verifyPrivateKeys,
 		conf.verifyURL,
 		conf.verifyEmail,
 		conf.verifyRevocation,
 		conf.verifyJwtPrivateKey,
+		conf.verifyJwtSigner,
+		conf.verifySignSessionPointers,
+		conf.verifyResultJwtClaims,
+		conf.verifyAttributeValidation,
+		conf.verifyIssuancePolicies,
+		conf.verifyFallbackKeys,
+		conf.verifyKeyshareKeys,
+		conf.verifyPairingRequiredCredentials,
+		conf.verifyAllowSunsetCredentials,
+		conf.verifyKeyproofs,
+		conf.verifyStrictJSON,
+		conf.verifyTrustedProxies,
 		conf.verifyStaticSessions,
+		conf.verifyStatelessSessions,
+		conf.verifyAttributeHashing,
+		conf.verifyMdoc,
+		conf.verifyProfiling,
+		conf.verifyMockMode,
 	} {
 		if err := f(); err != nil {
 			_ = LogError(err)
@@ -173,6 +493,14 @@ func (conf *Configuration) Check() error {
 		}
 	}
 
+	if conf.StatusCacheDuration < 0 || conf.StatusCacheDuration > 1000 {
+		return errors.New("status_cache_duration must be between 0 and 1000 milliseconds")
+	}
+
+	if conf.SessionSnapshotFile != "" && conf.StoreType == "redis" {
+		return errors.New("Session snapshots can only be used with the memory session store.")
+	}
+
 	if conf.EnableSSE && conf.StoreType == "redis" {
 		return errors.New("Currently server-sent events (SSE) cannot be used simultaneously with the Redis session store.")
 	}
@@ -197,7 +525,7 @@ func (conf *Configuration) HavePrivateKeys() bool {
 
 func (conf *Configuration) verifyStaticSessions() error {
 	conf.StaticSessionRequests = make(map[string]irma.RequestorRequest)
-	if len(conf.StaticSessions) > 0 && conf.JwtRSAPrivateKey == nil && !conf.AllowUnsignedCallbacks {
+	if len(conf.StaticSessions) > 0 && conf.JwtSigningKey() == nil && !conf.AllowUnsignedCallbacks {
 		return errors.New("static sessions configured but no JWT private key is installed: either install JWT or enable allow_unsigned_callbacks in configuration")
 	}
 	for name, r := range conf.StaticSessions {
@@ -235,6 +563,9 @@ func GocronPanicHandler(logger *logrus.Logger) gocron.PanicHandlerFunc {
 			details = "failed to marshal recovered data: " + err.Error()
 		}
 		logger.Error(fmt.Sprintf("panic during gocron job '%s': %s", jobName, details))
+		panicsMutex.Lock()
+		panics["gocron"]++
+		panicsMutex.Unlock()
 	}
 }
 
@@ -254,21 +585,44 @@ func (conf *Configuration) verifyIrmaConf() error {
 			return errors.Errorf("Nonexisting schemes_path provided: %s", conf.SchemesPath)
 		}
 		conf.Logger.WithField("schemes_path", conf.SchemesPath).Info("Determined schemes path")
+		var eager []irma.SchemeManagerIdentifier
+		if conf.LazySchemes {
+			eager = append([]irma.SchemeManagerIdentifier{}, conf.EagerSchemes...) // not nil
+		}
 		conf.IrmaConfiguration, err = irma.NewConfiguration(conf.SchemesPath, irma.ConfigurationOptions{
 			Assets:              conf.SchemesAssetsPath,
 			RevocationDBType:    conf.RevocationDBType,
 			RevocationDBConnStr: conf.RevocationDBConnStr,
 			RevocationSettings:  conf.RevocationSettings,
+			KeyshareJWKS:        conf.KeyshareJWKS,
+			// Keep the schemes that sessions were started with for their entire lifetime
+			SnapshotRetention:  time.Duration(conf.MaxSessionLifetime) * time.Minute,
+			Now:                conf.Now,
+			EagerSchemes:       eager,
+			CachePath:          conf.SchemesCachePath,
+			SchemeLogPath:      conf.SchemesLogPath,
+			SchemeLogSubmitURL: conf.SchemesLogSubmitURL,
 		})
 		if err != nil {
 			return err
 		}
+		conf.IrmaConfiguration.HTTPClient = conf.httpClient
 		if err = conf.IrmaConfiguration.ParseFolder(); err != nil {
 			return err
 		}
+		if lazy := conf.IrmaConfiguration.LazySchemes(); len(lazy) > 0 {
+			conf.Logger.WithField("schemes", lazy).Info("Deferred parsing of schemes until sessions need them")
+		}
+	}
+
+	// An IRMA configuration passed by the caller keeps its own HTTP client, if any
+	if conf.IrmaConfiguration.HTTPClient == nil {
+		conf.IrmaConfiguration.HTTPClient = conf.httpClient
+	} else if conf.AirGapped && !conf.IrmaConfiguration.HTTPClient.Disabled() {
+		return errors.New("The HTTP client of the IRMA configuration must be disabled in air-gapped mode")
 	}
 
-	if len(conf.IrmaConfiguration.SchemeManagers) == 0 {
+	if len(conf.IrmaConfiguration.SchemeManagers) == 0 && len(conf.IrmaConfiguration.LazySchemes()) == 0 {
 		conf.Logger.Infof("No schemes found in %s, downloading default (irma-demo and pbdf)", conf.SchemesPath)
 		if err := conf.IrmaConfiguration.DownloadDefaultSchemes(); err != nil {
 			return err
@@ -384,10 +738,20 @@ func (conf *Configuration) verifyRevocation() error {
 }
 
 func (conf *Configuration) verifyURL() error {
-	if conf.URL != "" {
-		if !strings.HasSuffix(conf.URL, "/") {
-			conf.URL = conf.URL + "/"
+	if conf.PathPrefix != "" {
+		if !strings.HasPrefix(conf.PathPrefix, "/") {
+			return errors.Errorf("path_prefix must start with a slash, but doesn't: %s", conf.PathPrefix)
+		}
+		if !strings.HasSuffix(conf.PathPrefix, "/") {
+			conf.PathPrefix += "/"
+		}
+		if conf.PathPrefix == "/" {
+			conf.PathPrefix = ""
 		}
+	}
+
+	if conf.URL != "" {
+		conf.URL = conf.withPathPrefix(conf.URL)
 		if !strings.HasPrefix(conf.URL, "https://") {
 			if !conf.Production || conf.DisableTLS {
 				conf.DisableTLS = true
@@ -401,9 +765,36 @@ func (conf *Configuration) verifyURL() error {
 	} else {
 		conf.Logger.Warn("No url parameter specified in configuration; unless an url is elsewhere prepended in the QR, the IRMA client will not be able to connect")
 	}
+	if len(conf.AlternativeURLs) > 0 && conf.URL == "" {
+		return errors.New("alternative_urls specified but no url")
+	}
+	for i, u := range conf.AlternativeURLs {
+		if _, err := url.ParseRequestURI(u); err != nil {
+			return errors.WrapPrefix(err, "Invalid URL in alternative_urls", 0)
+		}
+		conf.AlternativeURLs[i] = conf.withPathPrefix(u)
+		if !strings.HasPrefix(u, "https://") && conf.Production && !conf.DisableTLS {
+			return errors.Errorf("alternative url %s does not use TLS, which is unsafe in production mode without a reverse proxy", u)
+		}
+	}
+	if conf.FrontendURL != "" {
+		conf.FrontendURL = conf.withPathPrefix(conf.FrontendURL)
+	}
 	return nil
 }
 
+// withPathPrefix returns the specified URL ending with a slash, and with the PathPrefix appended
+// if it does not already end with it.
+func (conf *Configuration) withPathPrefix(u string) string {
+	if !strings.HasSuffix(u, "/") {
+		u += "/"
+	}
+	if conf.PathPrefix != "" && !strings.HasSuffix(u, conf.PathPrefix) {
+		u += conf.PathPrefix[1:]
+	}
+	return u
+}
+
 type serverInfo struct {
 	Email   string `json:"email"`
 	Version string `json:"version"`
@@ -416,7 +807,7 @@ func (conf *Configuration) verifyEmail() error {
 	if !strings.Contains(conf.Email, "@") || strings.Contains(conf.Email, "\n") {
 		return errors.New("Invalid email address specified")
 	}
-	t := irma.NewHTTPTransport("https://privacybydesign.foundation/", true)
+	t := conf.httpClient.NewTransport("https://privacybydesign.foundation/", true)
 	t.SetHeader("User-Agent", "irmaserver")
 	data := &serverInfo{Email: conf.Email, Version: irma.Version}
 
@@ -445,6 +836,199 @@ func (conf *Configuration) verifyJwtPrivateKey() error {
 	return err
 }
 
+func (conf *Configuration) verifyJwtSigner() error {
+	if conf.JwtCryptoSigner == nil {
+		if conf.JwtSigner == "" {
+			return nil
+		}
+		if conf.JwtRSAPrivateKey != nil {
+			return errors.New("jwt_signer cannot be used in combination with a JWT private key")
+		}
+		signer, err := NewKMSSigner(conf.JwtSigner)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to create JWT signer", 0)
+		}
+		conf.JwtCryptoSigner = signer
+	}
+	if _, ok := conf.JwtCryptoSigner.Public().(*rsa.PublicKey); !ok {
+		return errors.New("JWT signer does not have an RSA key")
+	}
+	conf.Logger.Info("JWT signer configured, JWT endpoints enabled")
+	return nil
+}
+
+// JwtSigningKey returns the signer of result JWTs, callback JWTs and session pointers: JwtCryptoSigner
+// if set, and otherwise JwtRSAPrivateKey. It returns nil if neither is set.
+func (conf *Configuration) JwtSigningKey() crypto.Signer {
+	if conf.JwtCryptoSigner != nil {
+		return conf.JwtCryptoSigner
+	}
+	if conf.JwtRSAPrivateKey != nil {
+		return conf.JwtRSAPrivateKey
+	}
+	return nil
+}
+
+// JwtPublicKey returns the public key of JwtSigningKey(), or nil if there is none.
+func (conf *Configuration) JwtPublicKey() *rsa.PublicKey {
+	signer := conf.JwtSigningKey()
+	if signer == nil {
+		return nil
+	}
+	pk, _ := signer.Public().(*rsa.PublicKey)
+	return pk
+}
+
+// verifyOutboundHTTP creates the HTTP client of the outbound HTTP settings, before any transports
+// are created for e.g. scheme downloads.
+func (conf *Configuration) verifyOutboundHTTP() error {
+	if conf.AirGapped {
+		if err := conf.verifyAirGapped(); err != nil {
+			return err
+		}
+		conf.OutboundHTTP.Disabled = true
+	}
+	client, err := irma.NewHTTPClient(conf.OutboundHTTP)
+	if err != nil {
+		return errors.WrapPrefix(err, "Invalid outbound_http", 0)
+	}
+	conf.httpClient = client
+	return nil
+}
+
+// verifyAirGapped refuses the options that require outbound network access, and disables the
+// automatic scheme updates.
+func (conf *Configuration) verifyAirGapped() error {
+	if conf.Email != "" {
+		return errors.New("email cannot be used in air-gapped mode, as it is sent to privacybydesign.foundation")
+	}
+	if conf.JwtSigner != "" {
+		return errors.New("jwt_signer cannot be used in air-gapped mode, as it requires access to the key management service")
+	}
+	if conf.StoreType == "stateless" || conf.CallbackOutbox {
+		return errors.New("The stateless session store and the callback outbox cannot be used in air-gapped mode, as they require callbacks")
+	}
+	if conf.SchemesLogSubmitURL != "" {
+		return errors.New("schemes_log_submit_url cannot be used in air-gapped mode")
+	}
+	if !conf.DisableSchemesUpdate {
+		conf.Logger.Info("Air-gapped mode: automatic scheme updates disabled")
+		conf.DisableSchemesUpdate = true
+	}
+	return nil
+}
+
+func (conf *Configuration) verifyStatelessSessions() error {
+	if conf.StoreType != "stateless" {
+		return nil
+	}
+	if conf.StatelessSessionKey == nil {
+		if conf.StatelessSessionKeyFile == "" {
+			return errors.New("The stateless session store requires a stateless session key")
+		}
+		key, err := common.ReadKey("", conf.StatelessSessionKeyFile)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read stateless session key", 0)
+		}
+		conf.StatelessSessionKey = key
+	}
+	if len(conf.StatelessSessionKey) != 32 {
+		return errors.New("Stateless session key must be 32 bytes")
+	}
+	if conf.EnableSSE || conf.SessionSnapshotFile != "" || conf.CallbackOutbox || conf.SessionHistory {
+		return errors.New("Server-sent events, session snapshots, the callback outbox and session history cannot be used with the stateless session store")
+	}
+	return nil
+}
+
+func (conf *Configuration) verifySignSessionPointers() error {
+	if conf.SignSessionPointers && conf.JwtSigningKey() == nil {
+		return errors.New("Signing session pointers requires a JWT private key")
+	}
+	return nil
+}
+
+func (conf *Configuration) verifyPairingRequiredCredentials() error {
+	for _, id := range conf.PairingRequiredCredentials {
+		if conf.IrmaConfiguration.CredentialTypes[id] == nil {
+			return errors.Errorf("Unknown credential type %s in pairing_required_credentials", id)
+		}
+	}
+	return nil
+}
+
+func (conf *Configuration) verifyAllowSunsetCredentials() error {
+	for _, id := range conf.AllowSunsetCredentials {
+		if conf.IrmaConfiguration.CredentialTypes[id] == nil {
+			return errors.Errorf("Unknown credential type %s in allow_sunset_credentials", id)
+		}
+	}
+	return nil
+}
+
+func (conf *Configuration) verifyKeyproofs() error {
+	if !conf.RequireKeyproofs {
+		return nil
+	}
+	conf.Logger.Info("Verifying keyproofs of issuer public keys (may take several minutes per key)")
+	for id := range conf.IrmaConfiguration.Issuers {
+		err := conf.IrmaConfiguration.VerifyIssuerKeyproofs(id)
+		if errors.Is(err, irma.ErrKeyproofMissing) || errors.Is(err, irma.ErrKeyproofInvalid) {
+			conf.Logger.WithField("issuer", id.String()).Warn(err.Error() + "; sessions involving this issuer will be refused")
+		} else if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (conf *Configuration) verifyStrictJSON() error {
+	for _, endpoint := range conf.StrictJSON {
+		switch endpoint {
+		case StrictJSONAll, StrictJSONSessionRequests, StrictJSONRevocationRequests,
+			StrictJSONCommitments, StrictJSONProofs, StrictJSONFrontendOptions:
+		default:
+			return errors.Errorf("Unknown endpoint %s in strict_json", endpoint)
+		}
+	}
+	return nil
+}
+
+// StrictJSONEnabled returns whether JSON messages containing unknown fields are refused at the
+// specified endpoint (one of the StrictJSON constants).
+func (conf *Configuration) StrictJSONEnabled(endpoint string) bool {
+	for _, e := range conf.StrictJSON {
+		if e == endpoint || e == StrictJSONAll {
+			return true
+		}
+	}
+	return false
+}
+
+func (conf *Configuration) verifyResultJwtClaims() error {
+	if err := conf.ResultJwtClaims.Validate(); err != nil {
+		return errors.WrapPrefix(err, "Invalid result_jwt_claims", 0)
+	}
+	return nil
+}
+
+func (conf *Configuration) verifyIssuancePolicies() error {
+	if err := conf.IssuancePolicies.Validate(conf.IrmaConfiguration); err != nil {
+		return errors.WrapPrefix(err, "Invalid issuance_policies", 0)
+	}
+	return nil
+}
+
+func (conf *Configuration) verifyAttributeValidation() error {
+	if conf.AttributeValidation == nil {
+		return nil
+	}
+	if err := conf.AttributeValidation.Validate(); err != nil {
+		return errors.WrapPrefix(err, "Invalid attribute_validation", 0)
+	}
+	return nil
+}
+
 // RedisClient returns the Redis client using the settings from the configuration.
 func (conf *Configuration) RedisClient() (*RedisClient, error) {
 	if conf.redisClient != nil {
@@ -497,6 +1081,9 @@ func (conf *Configuration) RedisClient() (*RedisClient, error) {
 	if conf.RedisSettings.ACLUseKeyPrefixes {
 		keyPrefix = conf.RedisSettings.Username + ":"
 	}
+	if conf.RedisSettings.KeyPrefix != "" {
+		keyPrefix += conf.RedisSettings.KeyPrefix + ":"
+	}
 	conf.redisClient = &RedisClient{
 		Client:       cl,
 		FailoverMode: failoverMode,
@@ -596,3 +1183,24 @@ func TLSConf(cert, certfile, key, keyfile string) (*tls.Config, error) {
 		},
 	}, nil
 }
+
+// ValidatePurpose checks that the purpose, if specified, is valid, and that it is one of the
+// purposes of the requestor if the requestor has purposes.
+func (conf *Configuration) ValidatePurpose(requestor string, purpose *irma.Purpose) error {
+	if purpose != nil {
+		if err := purpose.Validate(); err != nil {
+			return err
+		}
+	}
+	allowed, ok := conf.Purposes[requestor]
+	if !ok {
+		return nil
+	}
+	if purpose == nil {
+		return errors.New("session request must specify a purpose")
+	}
+	if !slices.Contains(allowed, purpose.Code) {
+		return errors.Errorf("purpose %s not allowed", purpose.Code)
+	}
+	return nil
+}
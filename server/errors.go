@@ -1,53 +1,132 @@
 package server
 
+import (
+	"net/http"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
 // Error represents an error that occurred during an IRMA sessions.
 type Error struct {
-	Type        ErrorType `json:"error"`
-	Status      int       `json:"status"`
-	Description string    `json:"description"`
+	Type        ErrorType            `json:"error"`
+	Code        irma.RemoteErrorCode `json:"code"`
+	Status      int                  `json:"status"`
+	Description string               `json:"description"`
 }
 
 type ErrorType string
 
 // General errors
 var (
-	ErrorInvalidTimestamp          Error = Error{Type: "INVALID_TIMESTAMP", Status: 400, Description: "Timestamp was not an epoch boundary"}
-	ErrorIssuingDisabled           Error = Error{Type: "ISSUING_DISABLED", Status: 403, Description: "This server does not support issuing"}
-	ErrorMalformedVerifierRequest  Error = Error{Type: "MALFORMED_VERIFIER_REQUEST", Status: 400, Description: "Malformed verification request"}
-	ErrorMalformedSignatureRequest Error = Error{Type: "MALFORMED_SIGNATURE_REQUEST", Status: 400, Description: "Malformed signature request"}
-	ErrorMalformedIssuerRequest    Error = Error{Type: "MALFORMED_ISSUER_REQUEST", Status: 400, Description: "Malformed issuer request"}
-	ErrorUnauthorized              Error = Error{Type: "UNAUTHORIZED", Status: 403, Description: "You are not authorized to issue or verify this attribute"}
-	ErrorAttributesWrong           Error = Error{Type: "ATTRIBUTES_WRONG", Status: 400, Description: "Specified attribute(s) do not belong to this credential type or missing attributes"}
-	ErrorCannotIssue               Error = Error{Type: "CANNOT_ISSUE", Status: 500, Description: "Cannot issue this credential"}
-
-	ErrorIrmaUnauthorized     Error = Error{Type: "UNAUTHORIZED", Status: 403, Description: "You are not authorized to access the session"}
-	ErrorPairingRequired      Error = Error{Type: "PAIRING_REQUIRED", Status: 403, Description: "Pairing is required first"}
-	ErrorIssuanceFailed       Error = Error{Type: "ISSUANCE_FAILED", Status: 500, Description: "Failed to create credential(s)"}
-	ErrorInvalidProofs        Error = Error{Type: "INVALID_PROOFS", Status: 400, Description: "Invalid secret key commitments and/or disclosure proofs"}
-	ErrorAttributesMissing    Error = Error{Type: "ATTRIBUTES_MISSING", Status: 400, Description: "Not all requested-for attributes were present"}
-	ErrorAttributesExpired    Error = Error{Type: "ATTRIBUTES_EXPIRED", Status: 400, Description: "Disclosed attributes were expired"}
-	ErrorUnexpectedRequest    Error = Error{Type: "UNEXPECTED_REQUEST", Status: 403, Description: "Unexpected request in this state"}
-	ErrorUnknownPublicKey     Error = Error{Type: "UNKNOWN_PUBLIC_KEY", Status: 403, Description: "Attributes were not valid against a known public key"}
-	ErrorKeyshareProofMissing Error = Error{Type: "KEYSHARE_PROOF_MISSING", Status: 403, Description: "ProofP object from a keyshare server missing"}
-	ErrorSessionUnknown       Error = Error{Type: "SESSION_UNKNOWN", Status: 400, Description: "Unknown or expired session"}
-	ErrorMalformedInput       Error = Error{Type: "MALFORMED_INPUT", Status: 400, Description: "Input could not be parsed"}
-	ErrorUnknown              Error = Error{Type: "EXCEPTION", Status: 500, Description: "Encountered unexpected problem"}
-	ErrorNextSession          Error = Error{Type: "NEXT_SESSION", Status: 500, Description: "Error starting next session"}
-	ErrorRevocation           Error = Error{Type: "REVOCATION", Status: 500, Description: "Revocation error"}
-	ErrorUnknownRevocationKey Error = Error{Type: "UNKNOWN_REVOCATION_KEY", Status: 404, Description: "No issuance records correspond to the given revocationKey"}
-
-	ErrorUnsupported     Error = Error{Type: "UNSUPPORTED", Status: 501, Description: "Unsupported by this server"}
-	ErrorInvalidRequest  Error = Error{Type: "INVALID_REQUEST", Status: 400, Description: "Invalid HTTP request"}
-	ErrorProtocolVersion Error = Error{Type: "PROTOCOL_VERSION", Status: 400, Description: "Protocol version negotiation failed"}
-	ErrorInvalidToken    Error = Error{Type: "INVALID_TOKEN", Status: 403, Description: "Provided token is unknown or invalid"}
-	ErrorInternal        Error = Error{Type: "INTERNAL_ERROR", Status: 500, Description: "Internal server error"}
-	ErrorRevalidateEmail Error = Error{Type: "REVALIDATE_EMAIL", Status: 500, Description: "Invalid email address is scheduled for revalidation"}
+	ErrorInvalidTimestamp          Error = Error{Type: "INVALID_TIMESTAMP", Code: irma.ErrorCodeInvalidTimestamp, Status: 400, Description: "Timestamp was not an epoch boundary"}
+	ErrorIssuingDisabled           Error = Error{Type: "ISSUING_DISABLED", Code: irma.ErrorCodeIssuingDisabled, Status: 403, Description: "This server does not support issuing"}
+	ErrorMalformedVerifierRequest  Error = Error{Type: "MALFORMED_VERIFIER_REQUEST", Code: irma.ErrorCodeMalformedVerifierRequest, Status: 400, Description: "Malformed verification request"}
+	ErrorMalformedSignatureRequest Error = Error{Type: "MALFORMED_SIGNATURE_REQUEST", Code: irma.ErrorCodeMalformedSignatureRequest, Status: 400, Description: "Malformed signature request"}
+	ErrorMalformedIssuerRequest    Error = Error{Type: "MALFORMED_ISSUER_REQUEST", Code: irma.ErrorCodeMalformedIssuerRequest, Status: 400, Description: "Malformed issuer request"}
+	ErrorUnauthorized              Error = Error{Type: "UNAUTHORIZED", Code: irma.ErrorCodeUnauthorized, Status: 403, Description: "You are not authorized to issue or verify this attribute"}
+	ErrorAttributesWrong           Error = Error{Type: "ATTRIBUTES_WRONG", Code: irma.ErrorCodeAttributesWrong, Status: 400, Description: "Specified attribute(s) do not belong to this credential type or missing attributes"}
+	ErrorCannotIssue               Error = Error{Type: "CANNOT_ISSUE", Code: irma.ErrorCodeCannotIssue, Status: 500, Description: "Cannot issue this credential"}
+
+	ErrorIrmaUnauthorized     Error = Error{Type: "UNAUTHORIZED", Code: irma.ErrorCodeIrmaUnauthorized, Status: 403, Description: "You are not authorized to access the session"}
+	ErrorPairingRequired      Error = Error{Type: "PAIRING_REQUIRED", Code: irma.ErrorCodePairingRequired, Status: 403, Description: "Pairing is required first"}
+	ErrorIssuanceFailed       Error = Error{Type: "ISSUANCE_FAILED", Code: irma.ErrorCodeIssuanceFailed, Status: 500, Description: "Failed to create credential(s)"}
+	ErrorInvalidProofs        Error = Error{Type: "INVALID_PROOFS", Code: irma.ErrorCodeInvalidProofs, Status: 400, Description: "Invalid secret key commitments and/or disclosure proofs"}
+	ErrorAttributesMissing    Error = Error{Type: "ATTRIBUTES_MISSING", Code: irma.ErrorCodeAttributesMissing, Status: 400, Description: "Not all requested-for attributes were present"}
+	ErrorAttributesExpired    Error = Error{Type: "ATTRIBUTES_EXPIRED", Code: irma.ErrorCodeAttributesExpired, Status: 400, Description: "Disclosed attributes were expired"}
+	ErrorUnexpectedRequest    Error = Error{Type: "UNEXPECTED_REQUEST", Code: irma.ErrorCodeUnexpectedRequest, Status: 403, Description: "Unexpected request in this state"}
+	ErrorUnknownPublicKey     Error = Error{Type: "UNKNOWN_PUBLIC_KEY", Code: irma.ErrorCodeUnknownPublicKey, Status: 403, Description: "Attributes were not valid against a known public key"}
+	ErrorKeyshareProofMissing Error = Error{Type: "KEYSHARE_PROOF_MISSING", Code: irma.ErrorCodeKeyshareProofMissing, Status: 403, Description: "ProofP object from a keyshare server missing"}
+	ErrorSessionUnknown       Error = Error{Type: "SESSION_UNKNOWN", Code: irma.ErrorCodeSessionUnknown, Status: 400, Description: "Unknown or expired session"}
+	ErrorMalformedInput       Error = Error{Type: "MALFORMED_INPUT", Code: irma.ErrorCodeMalformedInput, Status: 400, Description: "Input could not be parsed"}
+	ErrorUnknown              Error = Error{Type: "EXCEPTION", Code: irma.ErrorCodeUnknown, Status: 500, Description: "Encountered unexpected problem"}
+	ErrorNextSession          Error = Error{Type: "NEXT_SESSION", Code: irma.ErrorCodeNextSession, Status: 500, Description: "Error starting next session"}
+	ErrorRevocation           Error = Error{Type: "REVOCATION", Code: irma.ErrorCodeRevocation, Status: 500, Description: "Revocation error"}
+	ErrorUnknownRevocationKey Error = Error{Type: "UNKNOWN_REVOCATION_KEY", Code: irma.ErrorCodeUnknownRevocationKey, Status: 404, Description: "No issuance records correspond to the given revocationKey"}
+
+	ErrorUnsupported      Error = Error{Type: "UNSUPPORTED", Code: irma.ErrorCodeUnsupported, Status: 501, Description: "Unsupported by this server"}
+	ErrorInvalidRequest   Error = Error{Type: "INVALID_REQUEST", Code: irma.ErrorCodeInvalidRequest, Status: 400, Description: "Invalid HTTP request"}
+	ErrorProtocolVersion  Error = Error{Type: "PROTOCOL_VERSION", Code: irma.ErrorCodeProtocolVersion, Status: 400, Description: "Protocol version negotiation failed"}
+	ErrorInvalidToken     Error = Error{Type: "INVALID_TOKEN", Code: irma.ErrorCodeInvalidToken, Status: 403, Description: "Provided token is unknown or invalid"}
+	ErrorInternal         Error = Error{Type: "INTERNAL_ERROR", Code: irma.ErrorCodeInternal, Status: 500, Description: "Internal server error"}
+	ErrorRevalidateEmail  Error = Error{Type: "REVALIDATE_EMAIL", Code: irma.ErrorCodeRevalidateEmail, Status: 500, Description: "Invalid email address is scheduled for revalidation"}
+	ErrorNotification     Error = Error{Type: "NOTIFICATION_FAILED", Code: irma.ErrorCodeNotification, Status: 502, Description: "Failed to send session link to recipient"}
+	ErrorPanic            Error = Error{Type: "PANIC", Code: irma.ErrorCodePanic, Status: 500, Description: "Encountered unexpected problem"}
+	ErrorSSEDisabled      Error = Error{Type: "SSE_DISABLED", Code: irma.ErrorCodeSSEDisabled, Status: 500, Description: "Server sent events disabled"}
+	ErrorNotFound         Error = Error{Type: "INVALID_REQUEST", Code: irma.ErrorCodeNotFound, Status: 404, Description: "Endpoint not found"}
+	ErrorMethodNotAllowed Error = Error{Type: "INVALID_REQUEST", Code: irma.ErrorCodeMethodNotAllowed, Status: 405, Description: "Method not allowed"}
+	ErrorCallbackFailed   Error = Error{Type: "CALLBACK_FAILED", Code: irma.ErrorCodeCallbackFailed, Status: 502, Description: "Failed to POST session result to callback URL"}
+	ErrorLDContext        Error = Error{Type: "INVALID_LD_CONTEXT", Code: irma.ErrorCodeLDContext, Status: 400, Description: "Message has an unexpected or unsupported @context"}
 )
 
 // Keyshare errors
 var (
-	ErrorUserNotRegistered = Error{Type: "USER_NOT_REGISTERED", Status: 403, Description: "User is not yet fully registered"}
-	ErrorInvalidJWT        = Error{Type: "UNAUTHORIZED", Status: 403, Description: "Invalid or expired jwt provided"}
-	ErrorInvalidEmail      = Error{Type: "INVALID_EMAIL", Status: 400, Description: "Invalid email address"}
-	ErrorTooManyRequests   = Error{Type: "TOO_MANY_REQUESTS", Status: 429, Description: "Too many requests"}
+	ErrorUserNotRegistered = Error{Type: "USER_NOT_REGISTERED", Code: irma.ErrorCodeUserNotRegistered, Status: 403, Description: "User is not yet fully registered"}
+	ErrorInvalidJWT        = Error{Type: "UNAUTHORIZED", Code: irma.ErrorCodeInvalidJWT, Status: 403, Description: "Invalid or expired jwt provided"}
+	ErrorInvalidEmail      = Error{Type: "INVALID_EMAIL", Code: irma.ErrorCodeInvalidEmail, Status: 400, Description: "Invalid email address"}
+	ErrorTooManyRequests   = Error{Type: "TOO_MANY_REQUESTS", Code: irma.ErrorCodeTooManyRequests, Status: 429, Description: "Too many requests"}
+	ErrorUserChanged       = Error{Type: "USER_CHANGED", Code: irma.ErrorCodeUserChanged, Status: 409, Description: "User was changed concurrently, please try again"}
 )
+
+// ErrorCatalog contains all errors that can be returned by the servers, e.g. for serving a
+// catalog of the error codes to clients.
+var ErrorCatalog = []Error{
+	ErrorInvalidTimestamp,
+	ErrorIssuingDisabled,
+	ErrorMalformedVerifierRequest,
+	ErrorMalformedSignatureRequest,
+	ErrorMalformedIssuerRequest,
+	ErrorUnauthorized,
+	ErrorAttributesWrong,
+	ErrorCannotIssue,
+	ErrorIrmaUnauthorized,
+	ErrorPairingRequired,
+	ErrorIssuanceFailed,
+	ErrorInvalidProofs,
+	ErrorAttributesMissing,
+	ErrorAttributesExpired,
+	ErrorUnexpectedRequest,
+	ErrorUnknownPublicKey,
+	ErrorKeyshareProofMissing,
+	ErrorSessionUnknown,
+	ErrorMalformedInput,
+	ErrorUnknown,
+	ErrorNextSession,
+	ErrorRevocation,
+	ErrorUnknownRevocationKey,
+	ErrorUnsupported,
+	ErrorInvalidRequest,
+	ErrorProtocolVersion,
+	ErrorInvalidToken,
+	ErrorInternal,
+	ErrorRevalidateEmail,
+	ErrorNotification,
+	ErrorPanic,
+	ErrorSSEDisabled,
+	ErrorNotFound,
+	ErrorMethodNotAllowed,
+	ErrorCallbackFailed,
+	ErrorLDContext,
+	ErrorUserNotRegistered,
+	ErrorInvalidJWT,
+	ErrorInvalidEmail,
+	ErrorTooManyRequests,
+	ErrorUserChanged,
+}
+
+// HandleErrorCatalog writes ErrorCatalog as JSON, allowing clients to look up the errors
+// corresponding to the codes they may encounter.
+func HandleErrorCatalog(w http.ResponseWriter, _ *http.Request) {
+	WriteJson(w, ErrorCatalog)
+}
+
+// InputError returns ErrorLDContext if err was caused by a message having an unexpected or
+// unsupported JSON-LD context (see irma.LDContextError), and fallback otherwise. Messages lacking
+// a context where one is expected are not considered to have an unexpected context.
+func InputError(err error, fallback Error) Error {
+	var ldContextErr *irma.LDContextError
+	if errors.As(err, &ldContextErr) && (ldContextErr.LDContext != "" || ldContextErr.ProtocolVersion != nil) {
+		return ErrorLDContext
+	}
+	return fallback
+}
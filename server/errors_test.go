@@ -0,0 +1,43 @@
+package server
+
+import (
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestErrorCatalog(t *testing.T) {
+	// Collect the names of all Error variables declared in errors.go
+	file, err := parser.ParseFile(token.NewFileSet(), "errors.go", nil, 0)
+	require.NoError(t, err)
+	var names []string
+	for _, decl := range file.Decls {
+		gen, ok := decl.(*ast.GenDecl)
+		if !ok || gen.Tok != token.VAR {
+			continue
+		}
+		for _, spec := range gen.Specs {
+			spec := spec.(*ast.ValueSpec)
+			for i, name := range spec.Names {
+				lit, ok := spec.Values[i].(*ast.CompositeLit)
+				if !ok {
+					continue
+				}
+				if ident, ok := lit.Type.(*ast.Ident); ok && ident.Name == "Error" {
+					names = append(names, name.Name)
+				}
+			}
+		}
+	}
+	require.Len(t, ErrorCatalog, len(names), "all errors should be included in ErrorCatalog")
+
+	codes := map[string]bool{}
+	for _, e := range ErrorCatalog {
+		require.NotEmpty(t, e.Code, "error %s has no code", e.Type)
+		require.False(t, codes[string(e.Code)], "duplicate error code %s", e.Code)
+		codes[string(e.Code)] = true
+	}
+}
@@ -0,0 +1,140 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// Redaction specifies how the value of an attribute is included in an export of session results.
+type Redaction string
+
+const (
+	RedactionNone Redaction = ""       // The attribute value as is
+	RedactionHash Redaction = "hash"   // The hex-encoded SHA-256 hash of the attribute value
+	RedactionOmit Redaction = "redact" // Only whether or not the attribute was disclosed
+)
+
+// The value of redacted attributes in an export
+const redactedValue = "REDACTED"
+
+// The columns preceding the attribute columns in an export of session results
+var resultExportColumns = []string{"token", "type", "status", "proofStatus"}
+
+// ReadSessionResults reads a stream of JSON session results, such as returned by
+// GET /session/{requestorToken}/result, e.g. one per line.
+func ReadSessionResults(r io.Reader) ([]*SessionResult, error) {
+	var results []*SessionResult
+	decoder := json.NewDecoder(r)
+	for {
+		result := &SessionResult{}
+		err := decoder.Decode(result)
+		if err == io.EOF {
+			return results, nil
+		}
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to parse session result "+strconv.Itoa(len(results)+1), 0)
+		}
+		results = append(results, result)
+	}
+}
+
+// ResultExportAttributes returns the attribute columns of an export of the session results. If a
+// request is given, these are the attributes it requests; otherwise they are all attributes that
+// were disclosed in one or more of the results.
+func ResultExportAttributes(request irma.SessionRequest, results []*SessionResult) ([]irma.AttributeTypeIdentifier, error) {
+	found := map[irma.AttributeTypeIdentifier]struct{}{}
+	if request != nil {
+		err := request.Disclosure().Disclose.Iterate(func(attr *irma.AttributeRequest) error {
+			found[attr.Type] = struct{}{}
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, result := range results {
+			for _, con := range result.Disclosed {
+				for _, attr := range con {
+					found[attr.Identifier] = struct{}{}
+				}
+			}
+		}
+	}
+
+	attrs := make([]irma.AttributeTypeIdentifier, 0, len(found))
+	for attr := range found {
+		attrs = append(attrs, attr)
+	}
+	sort.Slice(attrs, func(i, j int) bool { return attrs[i].String() < attrs[j].String() })
+	return attrs, nil
+}
+
+// WriteSessionResultsCSV writes the session results to w in CSV format, one row per result,
+// including a column for each of the specified attributes. Attributes not occurring in redactions
+// are written as is.
+func WriteSessionResultsCSV(
+	w io.Writer,
+	results []*SessionResult,
+	attrs []irma.AttributeTypeIdentifier,
+	redactions map[irma.AttributeTypeIdentifier]Redaction,
+) error {
+	for attr, redaction := range redactions {
+		if redaction != RedactionNone && redaction != RedactionHash && redaction != RedactionOmit {
+			return errors.Errorf("unknown redaction %s for attribute %s", redaction, attr)
+		}
+	}
+
+	writer := csv.NewWriter(w)
+	header := append([]string{}, resultExportColumns...)
+	for _, attr := range attrs {
+		header = append(header, attr.String())
+	}
+	if err := writer.Write(header); err != nil {
+		return err
+	}
+
+	for _, result := range results {
+		values := map[irma.AttributeTypeIdentifier]*irma.DisclosedAttribute{}
+		for _, con := range result.Disclosed {
+			for _, attr := range con {
+				if _, ok := values[attr.Identifier]; !ok {
+					values[attr.Identifier] = attr
+				}
+			}
+		}
+
+		record := []string{string(result.Token), string(result.Type), string(result.Status), string(result.ProofStatus)}
+		for _, id := range attrs {
+			record = append(record, redact(values[id], redactions[id]))
+		}
+		if err := writer.Write(record); err != nil {
+			return err
+		}
+	}
+	writer.Flush()
+	return writer.Error()
+}
+
+func redact(attr *irma.DisclosedAttribute, redaction Redaction) string {
+	if attr == nil || attr.RawValue == nil {
+		return ""
+	}
+	value := *attr.RawValue
+	switch redaction {
+	case RedactionHash:
+		hash := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(hash[:])
+	case RedactionOmit:
+		return redactedValue
+	default:
+		return value
+	}
+}
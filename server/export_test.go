@@ -0,0 +1,48 @@
+package server
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExportSessionResults(t *testing.T) {
+	input := `{"token":"a","status":"DONE","type":"disclosing","proofStatus":"VALID","disclosed":[[{"id":"irma-demo.MijnOverheid.fullName.firstname","rawvalue":"Alice","status":"PRESENT"},{"id":"irma-demo.MijnOverheid.root.BSN","rawvalue":"12345","status":"PRESENT"}]]}
+{"token":"b","status":"CANCELLED","type":"disclosing"}
+`
+	results, err := ReadSessionResults(strings.NewReader(input))
+	require.NoError(t, err)
+	require.Len(t, results, 2)
+
+	attrs, err := ResultExportAttributes(nil, results)
+	require.NoError(t, err)
+	require.Equal(t, []irma.AttributeTypeIdentifier{
+		irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"),
+		irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"),
+	}, attrs)
+
+	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"))
+	requested, err := ResultExportAttributes(request, results)
+	require.NoError(t, err)
+	require.Equal(t, attrs[1:], requested)
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteSessionResultsCSV(&buf, results, attrs, map[irma.AttributeTypeIdentifier]Redaction{
+		irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"): RedactionHash,
+	}))
+	require.Equal(t, "token,type,status,proofStatus,irma-demo.MijnOverheid.fullName.firstname,irma-demo.MijnOverheid.root.BSN\n"+
+		"a,disclosing,DONE,VALID,Alice,5994471abb01112afcc18159f6cc74b4f511b99806da59b3caf5a9c173cacfc5\n"+
+		"b,disclosing,CANCELLED,,,\n", buf.String())
+
+	buf.Reset()
+	require.NoError(t, WriteSessionResultsCSV(&buf, results[:1], attrs[:1], map[irma.AttributeTypeIdentifier]Redaction{
+		attrs[0]: RedactionOmit,
+	}))
+	require.Contains(t, buf.String(), "a,disclosing,DONE,VALID,REDACTED\n")
+
+	_, err = ReadSessionResults(strings.NewReader(`{"token":`))
+	require.Error(t, err)
+}
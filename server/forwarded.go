@@ -0,0 +1,137 @@
+package server
+
+import (
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+// Forwarded headers of reverse proxies that can be honored using ForwardedHeaders in the Configuration.
+const (
+	ForwardedFor   = "X-Forwarded-For"
+	ForwardedProto = "X-Forwarded-Proto"
+	ForwardedHost  = "X-Forwarded-Host"
+)
+
+var defaultForwardedHeaders = []string{ForwardedFor, ForwardedProto}
+
+func (conf *Configuration) verifyTrustedProxies() error {
+	conf.trustedProxies = nil
+	for _, proxy := range conf.TrustedProxies {
+		if !strings.Contains(proxy, "/") {
+			ip := net.ParseIP(proxy)
+			if ip == nil {
+				return errors.Errorf("Invalid IP address %s in trusted_proxies", proxy)
+			}
+			conf.trustedProxies = append(conf.trustedProxies, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+			continue
+		}
+		_, cidr, err := net.ParseCIDR(proxy)
+		if err != nil {
+			return errors.WrapPrefix(err, "Invalid CIDR range in trusted_proxies", 0)
+		}
+		conf.trustedProxies = append(conf.trustedProxies, cidr)
+	}
+
+	if len(conf.ForwardedHeaders) == 0 && len(conf.TrustedProxies) > 0 {
+		conf.ForwardedHeaders = append([]string(nil), defaultForwardedHeaders...)
+	}
+	for i, header := range conf.ForwardedHeaders {
+		header = http.CanonicalHeaderKey(header)
+		switch header {
+		case ForwardedFor, ForwardedProto, ForwardedHost:
+		default:
+			return errors.Errorf("Unsupported header %s in forwarded_headers", header)
+		}
+		conf.ForwardedHeaders[i] = header
+	}
+	if len(conf.ForwardedHeaders) > 0 && len(conf.TrustedProxies) == 0 {
+		conf.Logger.Warn("forwarded_headers specified but no trusted_proxies: forwarded headers are ignored")
+	}
+	return nil
+}
+
+// forwarded returns the values of the specified forwarded header of the request, if the request
+// was sent by a trusted proxy and the header is honored.
+func (conf *Configuration) forwarded(r *http.Request, header string) []string {
+	if !conf.honors(header) || !conf.trustedProxy(remoteIP(r)) {
+		return nil
+	}
+	var values []string
+	for _, value := range r.Header.Values(header) {
+		for _, v := range strings.Split(value, ",") {
+			values = append(values, strings.TrimSpace(v))
+		}
+	}
+	return values
+}
+
+func (conf *Configuration) honors(header string) bool {
+	for _, h := range conf.ForwardedHeaders {
+		if h == header {
+			return true
+		}
+	}
+	return false
+}
+
+func (conf *Configuration) trustedProxy(addr string) bool {
+	ip := net.ParseIP(addr)
+	if ip == nil {
+		return false
+	}
+	for _, cidr := range conf.trustedProxies {
+		if cidr.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// ClientIP returns the IP address of the client that sent the request. This is the remote address
+// of the connection, unless that belongs to a trusted proxy and X-Forwarded-For is honored: then
+// it is the last address in X-Forwarded-For that does not belong to a trusted proxy, as each
+// proxy appends the address from which it received the request. Addresses before it may have been
+// sent by the client itself and are therefore ignored.
+func (conf *Configuration) ClientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	addrs := conf.forwarded(r, ForwardedFor)
+	for i := len(addrs) - 1; i >= 0 && conf.trustedProxy(ip); i-- {
+		if net.ParseIP(addrs[i]) == nil {
+			break
+		}
+		ip = addrs[i]
+	}
+	return ip
+}
+
+// RequestScheme returns the scheme (http or https) with which the client sent the request, taken
+// from X-Forwarded-Proto if the request was sent by a trusted proxy and the header is honored.
+func (conf *Configuration) RequestScheme(r *http.Request) string {
+	if protos := conf.forwarded(r, ForwardedProto); len(protos) > 0 {
+		return strings.ToLower(protos[len(protos)-1])
+	}
+	if r.TLS != nil {
+		return "https"
+	}
+	return "http"
+}
+
+// RequestHost returns the host to which the client sent the request, taken from X-Forwarded-Host
+// if the request was sent by a trusted proxy and the header is honored.
+func (conf *Configuration) RequestHost(r *http.Request) string {
+	if hosts := conf.forwarded(r, ForwardedHost); len(hosts) > 0 {
+		return hosts[len(hosts)-1]
+	}
+	return r.Host
+}
@@ -0,0 +1,64 @@
+package server
+
+import (
+	"crypto/tls"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestTrustedProxies(t *testing.T) {
+	conf := &Configuration{Logger: logrus.New(), TrustedProxies: []string{"10.0.0.0/8", "192.168.1.1"}}
+	require.NoError(t, conf.verifyTrustedProxies())
+	require.Equal(t, []string{ForwardedFor, ForwardedProto}, conf.ForwardedHeaders)
+
+	request := func(remoteAddr string, headers map[string]string) *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "http://irma.example.com/", nil)
+		r.RemoteAddr = remoteAddr
+		for name, value := range headers {
+			r.Header.Set(name, value)
+		}
+		return r
+	}
+
+	// The forwarded headers of untrusted clients are ignored
+	r := request("1.2.3.4:1234", map[string]string{ForwardedFor: "5.6.7.8", ForwardedProto: "https"})
+	require.Equal(t, "1.2.3.4", conf.ClientIP(r))
+	require.Equal(t, "http", conf.RequestScheme(r))
+
+	// Addresses appended by trusted proxies are skipped, but spoofed addresses before the client's are not used
+	r = request("10.0.0.1:1234", map[string]string{ForwardedFor: "9.9.9.9, 5.6.7.8, 192.168.1.1", ForwardedProto: "https"})
+	require.Equal(t, "5.6.7.8", conf.ClientIP(r))
+	require.Equal(t, "https", conf.RequestScheme(r))
+	r = request("10.0.0.1:1234", map[string]string{ForwardedFor: "9.9.9.9, 192.168.1.1, 5.6.7.8, 10.1.1.1"})
+	require.Equal(t, "5.6.7.8", conf.ClientIP(r))
+	r = request("10.0.0.1:1234", map[string]string{ForwardedFor: "5.6.7.8, garbage, 10.1.1.1"})
+	require.Equal(t, "10.1.1.1", conf.ClientIP(r))
+	r = request("10.0.0.1:1234", map[string]string{ForwardedFor: "192.168.1.1, 10.1.1.1"})
+	require.Equal(t, "192.168.1.1", conf.ClientIP(r))
+
+	// X-Forwarded-Host is not honored by default
+	r = request("10.0.0.1:1234", map[string]string{ForwardedHost: "other.example.com"})
+	require.Equal(t, "irma.example.com", conf.RequestHost(r))
+	conf.ForwardedHeaders = []string{"x-forwarded-host"}
+	require.NoError(t, conf.verifyTrustedProxies())
+	require.Equal(t, "other.example.com", conf.RequestHost(r))
+	require.Equal(t, "10.0.0.1", conf.ClientIP(request("10.0.0.1:1234", map[string]string{ForwardedFor: "5.6.7.8"})))
+
+	r = request("1.2.3.4:1234", nil)
+	r.TLS = &tls.ConnectionState{}
+	require.Equal(t, "https", conf.RequestScheme(r))
+
+	// The default forwarded headers are not modified through the configuration
+	conf = &Configuration{Logger: logrus.New(), TrustedProxies: []string{"10.0.0.0/8"}}
+	require.NoError(t, conf.verifyTrustedProxies())
+	conf.ForwardedHeaders[0] = ForwardedHost
+	require.Equal(t, []string{ForwardedFor, ForwardedProto}, defaultForwardedHeaders)
+
+	require.Error(t, (&Configuration{TrustedProxies: []string{"10.0.0.0/33"}}).verifyTrustedProxies())
+	require.Error(t, (&Configuration{TrustedProxies: []string{"proxy"}}).verifyTrustedProxies())
+	require.Error(t, (&Configuration{TrustedProxies: []string{"10.0.0.1"}, ForwardedHeaders: []string{"Forwarded"}}).verifyTrustedProxies())
+}
@@ -8,6 +8,7 @@ import (
 	"context"
 	"net/http"
 	"net/url"
+	"sort"
 	"sync"
 	"time"
 
@@ -21,6 +22,7 @@ import (
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/sirupsen/logrus"
+	"golang.org/x/sync/singleflight"
 )
 
 // AllowIssuingExpiredCredentials indicates whether or not expired credentials can be issued.
@@ -29,11 +31,25 @@ var AllowIssuingExpiredCredentials = false
 type Server struct {
 	conf                   *server.Configuration
 	router                 *chi.Mux
+	frontendRouter         *chi.Mux
 	sessions               sessionStore
 	scheduler              *gocron.Scheduler
 	serverSentEvents       *sse.Server
 	activeSSEHandlers      map[irma.RequestorToken]bool
 	activeSSEHandlersMutex sync.Mutex
+	sseConnections         map[irma.RequestorToken]map[*sseConnection]struct{}
+	sseConnectionCount     int
+	requestLocks           map[irma.ClientToken]*requestLock
+	requestLocksMutex      sync.Mutex
+	statusRequests         singleflight.Group
+	statusCache            map[string]*statusResponse
+	statusCacheMutex       sync.Mutex
+	statistics             *server.UsageStatistics
+	storeStatistics        *server.StoreStatistics
+
+	publicConfigurationHandler http.Handler
+	publicConfigurationOnce    sync.Once
+	publicConfigurationCache   publicConfigurationCache
 }
 
 // Default server instance
@@ -60,24 +76,44 @@ func New(conf *server.Configuration) (*Server, error) {
 		scheduler:         gocron.NewScheduler(time.UTC),
 		serverSentEvents:  e,
 		activeSSEHandlers: make(map[irma.RequestorToken]bool),
+		sseConnections:    make(map[irma.RequestorToken]map[*sseConnection]struct{}),
+		requestLocks:      make(map[irma.ClientToken]*requestLock),
+		statusCache:       make(map[string]*statusResponse),
+		statistics:        server.NewUsageStatistics(),
+		storeStatistics:   server.NewStoreStatistics(),
 	}
 
 	switch conf.StoreType {
 	case "":
 		fallthrough // no specification defaults to the memory session store
 	case "memory":
-		s.sessions = &memorySessionStore{
+		memStore := &memorySessionStore{
 			conf:           conf,
 			requestor:      make(map[irma.RequestorToken]*memorySessionData),
 			client:         make(map[irma.ClientToken]*memorySessionData),
 			updateChannels: make(map[irma.RequestorToken][]chan *sessionData),
+			outboxEntries:  make(map[irma.RequestorToken]*outboxEntry),
 		}
+		s.sessions = memStore
 
-		if _, err := s.scheduler.Every(10).Seconds().Do(func() {
-			s.sessions.(*memorySessionStore).deleteExpired()
+		if _, err := s.scheduler.Every(conf.SessionCleanupInterval).Seconds().Do(func() {
+			memStore.deleteExpired()
 		}); err != nil {
 			return nil, err
 		}
+
+		if conf.SessionSnapshotFile != "" {
+			if err := memStore.loadSnapshot(); err != nil {
+				return nil, err
+			}
+			if _, err := s.scheduler.Every(conf.SessionSnapshotInterval).Seconds().WaitForSchedule().Do(func() {
+				if err := memStore.saveSnapshot(); err != nil {
+					s.conf.Logger.WithError(err).Error("Failed to save session snapshot")
+				}
+			}); err != nil {
+				return nil, err
+			}
+		}
 	case "redis":
 		cl, err := conf.RedisClient()
 		if err != nil {
@@ -87,9 +123,22 @@ func New(conf *server.Configuration) (*Server, error) {
 			client: cl,
 			conf:   conf,
 		}
+	case "stateless":
+		store, err := newStatelessSessionStore(conf)
+		if err != nil {
+			return nil, err
+		}
+		s.sessions = store
+
+		if _, err := s.scheduler.Every(conf.SessionCleanupInterval).Seconds().Do(func() {
+			store.deleteExpired()
+		}); err != nil {
+			return nil, err
+		}
 	default:
 		return nil, errors.New("storeType not known")
 	}
+	s.sessions = &measuredSessionStore{sessionStore: s.sessions, conf: conf, stats: s.storeStatistics}
 
 	if _, err := s.scheduler.Every(irma.RevocationParameters.RequestorUpdateInterval).Seconds().Do(func() {
 		for credid, settings := range s.conf.RevocationSettings {
@@ -105,6 +154,24 @@ func New(conf *server.Configuration) (*Server, error) {
 		return nil, err
 	}
 
+	if conf.CallbackOutbox {
+		if _, err := s.scheduler.Every(conf.CallbackRedeliveryInterval).Seconds().Do(s.redeliverCallbacks); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.KeyExpiryWarning > 0 {
+		if _, err := s.scheduler.Every(1).Day().Do(s.conf.CheckIssuerKeyExpiries); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.ProfileDir != "" {
+		if _, err := s.scheduler.Every(server.ProfileCheckInterval).Seconds().Do(server.NewHeapProfiler(conf).Check); err != nil {
+			return nil, err
+		}
+	}
+
 	gocron.SetPanicHandler(server.GocronPanicHandler(s.conf.Logger))
 	s.scheduler.StartAsync()
 
@@ -118,7 +185,8 @@ func New(conf *server.Configuration) (*Server, error) {
 //
 //	http.HandleFunc("/irma/", irmaserver.HandlerFunc())
 //
-// The IRMA app can then perform IRMA sessions at https://example.com/irma.
+// The IRMA app can then perform IRMA sessions at https://example.com/irma, if the PathPrefix
+// of the configuration is set to /irma/.
 func HandlerFunc() http.HandlerFunc {
 	return s.HandlerFunc()
 }
@@ -130,6 +198,10 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 	r := chi.NewRouter()
 	s.router = r
 
+	if s.conf.PathPrefix != "" {
+		r.Use(s.pathPrefixMiddleware)
+	}
+	r.Use(server.RequestIDMiddleware)
 	r.Use(server.RecoverMiddleware)
 
 	opts := server.LogOptions{Response: true, Headers: true, From: false, EncodeBinary: true}
@@ -137,28 +209,32 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 
 	r.Use(server.SizeLimitMiddleware)
 	r.Use(server.TimeoutMiddleware([]string{"/statusevents", "/updateevents"}, server.WriteTimeout))
+	r.Use(server.LocalizationMiddleware(s.conf))
 
-	notfound := &irma.RemoteError{Status: 404, ErrorName: string(server.ErrorInvalidRequest.Type)}
-	notallowed := &irma.RemoteError{Status: 405, ErrorName: string(server.ErrorInvalidRequest.Type)}
+	notfound := &irma.RemoteError{Status: 404, ErrorName: string(server.ErrorNotFound.Type), Code: server.ErrorNotFound.Code}
+	notallowed := &irma.RemoteError{Status: 405, ErrorName: string(server.ErrorMethodNotAllowed.Type), Code: server.ErrorMethodNotAllowed.Code}
 	r.NotFound(errorWriter(notfound, server.WriteResponse))
 	r.MethodNotAllowed(errorWriter(notallowed, server.WriteResponse))
 
 	r.Route("/session/{clientToken}", func(r chi.Router) {
+		r.Use(s.statusCoalescingMiddleware)
+		r.Use(s.requestLockMiddleware)
 		r.Use(s.sessionMiddleware)
 		r.Delete("/", s.handleSessionDelete)
 		r.Get("/status", s.handleSessionStatus)
 		r.Get("/statusevents", s.handleSessionStatusEvents)
-		r.Route("/frontend", func(r chi.Router) {
-			r.Use(s.frontendMiddleware)
-			r.Get("/status", s.handleFrontendStatus)
-			r.Get("/statusevents", s.handleFrontendStatusEvents)
-			r.Post("/options", s.handleFrontendOptionsPost)
-			r.Post("/pairingcompleted", s.handleFrontendPairingCompleted)
-		})
+		r.Get("/mdoc", s.handleSessionMdocRequest)
+		r.Post("/mdoc", s.handleSessionMdocResponse)
+		if s.conf.FrontendURL == "" {
+			r.Route("/frontend", s.attachFrontendEndpoints)
+		}
 		r.Group(func(r chi.Router) {
 			r.Use(s.cacheMiddleware)
 			r.Get("/", s.handleSessionGet)
 			r.Group(func(r chi.Router) {
+				if s.conf.StoreType == "stateless" {
+					r.Use(s.statelessMiddleware)
+				}
 				r.Use(s.pairingMiddleware)
 				r.Get("/request", s.handleSessionGetRequest)
 				r.Post("/commitments", s.handleSessionCommitments)
@@ -181,6 +257,58 @@ func (s *Server) HandlerFunc() http.HandlerFunc {
 	return s.router.ServeHTTP
 }
 
+// FrontendHandlerFunc returns a http.HandlerFunc that handles the frontend protocol with the
+// frontend (i.e. the browser), for when the frontend endpoints are served separately from the
+// endpoints for the IRMA app. In that case FrontendURL must be set in the configuration,
+// and HandlerFunc() does not handle the frontend endpoints.
+func FrontendHandlerFunc() http.HandlerFunc {
+	return s.FrontendHandlerFunc()
+}
+func (s *Server) FrontendHandlerFunc() http.HandlerFunc {
+	if s.frontendRouter != nil {
+		return s.frontendRouter.ServeHTTP
+	}
+
+	r := chi.NewRouter()
+	s.frontendRouter = r
+
+	if s.conf.PathPrefix != "" {
+		r.Use(s.pathPrefixMiddleware)
+	}
+	r.Use(server.RequestIDMiddleware)
+	r.Use(server.RecoverMiddleware)
+
+	opts := server.LogOptions{Response: true, Headers: true, From: false, EncodeBinary: true}
+	r.Use(server.LogMiddleware("frontend", opts))
+
+	r.Use(server.SizeLimitMiddleware)
+	r.Use(server.TimeoutMiddleware([]string{"/statusevents"}, server.WriteTimeout))
+	r.Use(server.LocalizationMiddleware(s.conf))
+
+	notfound := &irma.RemoteError{Status: 404, ErrorName: string(server.ErrorNotFound.Type), Code: server.ErrorNotFound.Code}
+	notallowed := &irma.RemoteError{Status: 405, ErrorName: string(server.ErrorMethodNotAllowed.Type), Code: server.ErrorMethodNotAllowed.Code}
+	r.NotFound(errorWriter(notfound, server.WriteResponse))
+	r.MethodNotAllowed(errorWriter(notallowed, server.WriteResponse))
+
+	r.Route("/session/{clientToken}", func(r chi.Router) {
+		r.Use(s.statusCoalescingMiddleware)
+		r.Use(s.sessionMiddleware)
+		r.Delete("/", s.handleSessionDelete) // used by the frontend to cancel the session
+		r.Route("/frontend", s.attachFrontendEndpoints)
+	})
+
+	return s.frontendRouter.ServeHTTP
+}
+
+func (s *Server) attachFrontendEndpoints(r chi.Router) {
+	r.Use(s.frontendMiddleware)
+	r.Get("/status", s.handleFrontendStatus)
+	r.Get("/statusevents", s.handleFrontendStatusEvents)
+	r.Get("/options", s.handleFrontendOptionsGet)
+	r.Post("/options", s.handleFrontendOptionsPost)
+	r.Post("/pairingcompleted", s.handleFrontendPairingCompleted)
+}
+
 // Stop the server.
 func Stop() {
 	s.Stop()
@@ -193,6 +321,23 @@ func (s *Server) Stop() {
 	s.sessions.stop()
 }
 
+// UsageStatistics returns the counts of issued and disclosed credential types and attributes
+// in the sessions that this server instance completed.
+func UsageStatistics() *server.UsageStatistics {
+	return s.UsageStatistics()
+}
+func (s *Server) UsageStatistics() *server.UsageStatistics {
+	return s.statistics
+}
+
+// StoreStatistics returns the measurements of the operations of the session store.
+func StoreStatistics() *server.StoreStatistics {
+	return s.StoreStatistics()
+}
+func (s *Server) StoreStatistics() *server.StoreStatistics {
+	return s.storeStatistics
+}
+
 // StartSession starts an IRMA session, running the handler on completion, if specified.
 // The session requestorToken (the second return parameter) can be used in GetSessionResult()
 // and CancelSession(). The session's frontendAuth (the third return parameter) is needed
@@ -205,18 +350,43 @@ func StartSession(request interface{}, handler server.SessionHandler,
 }
 func (s *Server) StartSession(req interface{}, handler server.SessionHandler,
 ) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
-	return s.startNextSession(req, handler, nil, "")
+	return s.startNextSession(req, handler, "", nil, "")
 }
+
+// StartRequestorSession starts an IRMA session like StartSession() on behalf of the specified
+// requestor, so that it is included in the open sessions of the requestor (see OpenSessions()).
+func StartRequestorSession(requestor string, request interface{}, handler server.SessionHandler,
+) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
+	return s.StartRequestorSession(requestor, request, handler)
+}
+func (s *Server) StartRequestorSession(requestor string, req interface{}, handler server.SessionHandler,
+) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
+	return s.startNextSession(req, handler, requestor, nil, "")
+}
+
 func (s *Server) startNextSession(
-	req interface{}, handler server.SessionHandler, disclosed irma.AttributeConDisCon, FrontendAuth irma.FrontendAuthorization,
+	req interface{}, handler server.SessionHandler, requestor string, disclosed irma.AttributeConDisCon, FrontendAuth irma.FrontendAuthorization,
 ) (*irma.Qr, irma.RequestorToken, *irma.FrontendSessionRequest, error) {
 	if s.conf.StoreType == "redis" && handler != nil {
 		return nil, "", nil, errors.New("Handlers cannot be used in combination with Redis.")
 	}
-	rrequest, err := server.ParseSessionRequest(req)
+	if s.conf.StoreType == "stateless" && handler != nil {
+		return nil, "", nil, errors.New("Handlers cannot be used in combination with the stateless session store.")
+	}
+	rrequest, err := parseSessionRequest(s.conf, req)
 	if err != nil {
 		return nil, "", nil, err
 	}
+	if s.conf.StoreType == "stateless" {
+		if err := validateStatelessRequest(rrequest, s.pairingRequired(rrequest)); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	if s.conf.AirGapped {
+		if err := validateAirGappedRequest(rrequest); err != nil {
+			return nil, "", nil, err
+		}
+	}
 
 	request := rrequest.SessionRequest()
 	action := request.Action()
@@ -224,12 +394,44 @@ func (s *Server) startNextSession(
 	if err := s.validateRequest(request); err != nil {
 		return nil, "", nil, err
 	}
+	if _, err := s.credentialTypeWarnings(request); err != nil {
+		return nil, "", nil, err
+	}
+	if sigrequest, ok := rrequest.(*irma.SignatureRequestorRequest); ok && sigrequest.Request.HasPlaceholders() {
+		// Resolve the placeholders now, such that the message signed by the user is fixed
+		resolved, err := sigrequest.Request.ResolvePlaceholders(s.conf.Now(), disclosed)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		sigrequest.Request, request = resolved, resolved
+	}
+	if err := s.conf.ValidatePurpose(requestor, rrequest.Base().Purpose); err != nil {
+		return nil, "", nil, err
+	}
+	if rrequest.Base().RequestInSessionPtr() {
+		if err := s.validateRequestInSessionPtr(rrequest); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	if rrequest.Base().Mdoc {
+		if err := s.validateMdocRequest(rrequest); err != nil {
+			return nil, "", nil, err
+		}
+	}
+	// Only purposes of the requestor request are validated, so these are the ones shown to the user
+	request.Base().Purpose = rrequest.Base().Purpose
+	if action == irma.ActionSigning {
+		// Signatures contain the values of the attributes, which can then not be hashed
+		if attr, ok := s.conf.HashedAttributeRequested(requestor, request.Disclosure().Disclose); ok {
+			return nil, "", nil, errors.Errorf("attribute %s is hashed in session results and cannot be used in signature sessions", attr)
+		}
+	}
 	if action == irma.ActionIssuing {
 		// Include the AttributeTypeIdentifiers of random blind attributes to each CredentialRequest.
 		// This way, the client can check prematurely, i.e., before the session,
 		// if it has the same random blind attributes in it's configuration.
 		for _, cred := range request.(*irma.IssuanceRequest).Credentials {
-			cred.RandomBlindAttributeTypeIDs = s.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeNames()
+			cred.RandomBlindAttributeTypeIDs = s.conf.IrmaConfiguration.Snapshot().CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeNames()
 		}
 
 		if err := s.validateIssuanceRequest(request.(*irma.IssuanceRequest)); err != nil {
@@ -238,7 +440,9 @@ func (s *Server) startNextSession(
 	}
 
 	pairingRecommended := false
-	if rrequest.Base().NextSession != nil && rrequest.Base().NextSession.URL != "" {
+	if s.pairingRequired(rrequest) {
+		pairingRecommended = true
+	} else if rrequest.Base().NextSession != nil && rrequest.Base().NextSession.URL != "" {
 		pairingRecommended = true
 	} else if action == irma.ActionDisclosing {
 		err := request.Disclosure().Disclose.Iterate(func(attr *irma.AttributeRequest) error {
@@ -256,7 +460,7 @@ func (s *Server) startNextSession(
 	}
 
 	request.Base().DevelopmentMode = !s.conf.Production
-	ses, err := s.newSession(context.Background(), action, rrequest, disclosed, FrontendAuth)
+	ses, err := s.newSession(context.Background(), action, rrequest, requestor, disclosed, FrontendAuth)
 	if err != nil {
 		return nil, "", nil, err
 	}
@@ -265,31 +469,43 @@ func (s *Server) startNextSession(
 		s.conf.Logger.
 			WithFields(logrus.Fields{"session": ses.RequestorToken, "clienttoken": ses.ClientToken}).
 			Info("Session request: ", server.ToJson(rrequest))
+	} else if purged, err := purgeRequest(rrequest); err != nil {
+		s.conf.Logger.
+			WithFields(logrus.Fields{"session": ses.RequestorToken}).
+			WithError(err).Warn("Session request could not be logged")
 	} else {
 		s.conf.Logger.
 			WithFields(logrus.Fields{"session": ses.RequestorToken}).
-			Info("Session request (purged of attribute values): ", server.ToJson(purgeRequest(rrequest)))
+			Info("Session request (purged of attribute values): ", server.ToJson(purged))
 	}
 
 	if handler != nil {
-		go func() {
-			statusChan, err := s.sessionStatusChannel(context.Background(), ses.RequestorToken, ses.timeout(s.conf))
-			if err != nil {
-				s.conf.Logger.WithError(err).Error("Failed to subscribe to session status updates for handler")
-				return
-			}
-			for status := range statusChan {
-				if status.Finished() {
-					if err := s.sessions.transaction(context.Background(), ses.RequestorToken, func(ses *sessionData) (bool, error) {
-						handler(ses.Result)
-						return false, nil
-					}); err != nil {
-						s.conf.Logger.WithError(err).Error("Failed to execute session handler")
+		// Subscribe before returning, so that in mock mode the handler sees the session finish
+		statusChan, err := s.sessionStatusChannel(context.Background(), ses.RequestorToken, ses.timeout(s.conf))
+		if err != nil {
+			s.conf.Logger.WithError(err).Error("Failed to subscribe to session status updates for handler")
+		} else {
+			go func() {
+				defer server.RecoverPanic("session handler")
+				for status := range statusChan {
+					if status.Finished() {
+						if err := s.sessions.transaction(context.Background(), ses.RequestorToken, func(ses *sessionData) (bool, error) {
+							handler(ses.Result)
+							return false, nil
+						}); err != nil {
+							s.conf.Logger.WithError(err).Error("Failed to execute session handler")
+						}
+						return
 					}
-					return
 				}
-			}
-		}()
+			}()
+		}
+	}
+
+	if s.conf.MockMode {
+		if err := s.completeMockSession(ses.RequestorToken); err != nil {
+			return nil, "", nil, err
+		}
 	}
 
 	url, err := url.Parse(s.conf.URL)
@@ -301,18 +517,48 @@ func (s *Server) startNextSession(
 		url.Host = request.Base().Host
 	}
 
-	return &irma.Qr{
-			Type: action,
-			URL:  url.String(),
-		},
-		ses.RequestorToken,
-		&irma.FrontendSessionRequest{
-			Authorization:      ses.FrontendAuth,
-			PairingRecommended: pairingRecommended,
-			MinProtocolVersion: minFrontendProtocolVersion,
-			MaxProtocolVersion: maxFrontendProtocolVersion,
-		},
-		nil
+	qr := &irma.Qr{
+		Type: action,
+		URL:  url.String(),
+	}
+	// Compact session pointers have no room for alternative URLs, and if the request specifies
+	// a host then that is the only one at which the IRMA app should reach us
+	if request.Base().Host == "" && !rrequest.Base().CompactSessionPtr {
+		for _, alt := range s.conf.AlternativeURLs {
+			// The configuration ensures that alternative URLs end with a slash
+			qr.AlternativeURLs = append(qr.AlternativeURLs, alt+"session/"+string(ses.ClientToken))
+		}
+	}
+	if rrequest.Base().RequestInSessionPtr() {
+		// Include the request as the IRMA app will receive it, so that it can compute the disclosure
+		// without retrieving the request
+		qr.Request = &irma.DisclosureRequest{}
+		if err = copyObject(request.(*irma.DisclosureRequest), qr.Request); err != nil {
+			return nil, "", nil, err
+		}
+		qr.Request.ProtocolVersion = maxProtocolVersion
+	}
+	if s.conf.SignSessionPointers || rrequest.Base().CompactSessionPtr {
+		if err = qr.Sign(s.conf.JwtSigningKey()); err != nil {
+			return nil, "", nil, err
+		}
+	}
+
+	frontendRequest := &irma.FrontendSessionRequest{
+		Authorization:      ses.FrontendAuth,
+		PairingRecommended: pairingRecommended,
+		MinProtocolVersion: minFrontendProtocolVersion,
+		MaxProtocolVersion: maxFrontendProtocolVersion,
+	}
+	if s.conf.FrontendURL != "" {
+		frontendURL, err := url.Parse(s.conf.FrontendURL)
+		if err != nil {
+			return nil, "", nil, err
+		}
+		frontendRequest.URL = frontendURL.JoinPath("session", string(ses.ClientToken)).String()
+	}
+
+	return qr, ses.RequestorToken, frontendRequest, nil
 }
 
 // GetSessionResult retrieves the result of the specified IRMA session.
@@ -327,6 +573,36 @@ func (s *Server) GetSessionResult(requestorToken irma.RequestorToken) (res *serv
 	return
 }
 
+// GetHashedSessionResult retrieves the result of the specified IRMA session like GetSessionResult(),
+// with the values of the attributes that are hashed for the requestor of the session replaced by
+// their salted hashes (see server.Configuration.HashResultAttributes()).
+func GetHashedSessionResult(requestorToken irma.RequestorToken) (*server.SessionResult, error) {
+	return s.GetHashedSessionResult(requestorToken)
+}
+func (s *Server) GetHashedSessionResult(requestorToken irma.RequestorToken) (res *server.SessionResult, err error) {
+	err = s.sessions.transaction(context.Background(), requestorToken, func(session *sessionData) (bool, error) {
+		res = s.conf.HashResultAttributes(session.Requestor, session.Result)
+		return false, nil
+	})
+	return
+}
+
+// GetSessionHistory retrieves the status changes of the specified IRMA session and the requests
+// of the IRMA app and frontend to it, if SessionHistory is enabled in the configuration.
+func GetSessionHistory(requestorToken irma.RequestorToken) ([]server.SessionEvent, error) {
+	return s.GetSessionHistory(requestorToken)
+}
+func (s *Server) GetSessionHistory(requestorToken irma.RequestorToken) (history []server.SessionEvent, err error) {
+	if !s.conf.SessionHistory {
+		return nil, errors.New("session history is not enabled")
+	}
+	err = s.sessions.transaction(context.Background(), requestorToken, func(session *sessionData) (bool, error) {
+		history = session.History
+		return false, nil
+	})
+	return
+}
+
 // GetRequest retrieves the request submitted by the requestor that started the specified IRMA session.
 func GetRequest(requestorToken irma.RequestorToken) (irma.RequestorRequest, error) {
 	return s.GetRequest(requestorToken)
@@ -339,14 +615,119 @@ func (s *Server) GetRequest(requestorToken irma.RequestorToken) (req irma.Reques
 	return
 }
 
+// GetRequestor retrieves the name of the requestor that started the specified IRMA session, which
+// is empty if the session was not started using StartRequestorSession().
+func GetRequestor(requestorToken irma.RequestorToken) (string, error) {
+	return s.GetRequestor(requestorToken)
+}
+func (s *Server) GetRequestor(requestorToken irma.RequestorToken) (requestor string, err error) {
+	err = s.sessions.transaction(context.Background(), requestorToken, func(session *sessionData) (bool, error) {
+		requestor = session.Requestor
+		return false, nil
+	})
+	return
+}
+
+// GetRequestorToken retrieves the requestor token of the IRMA session having the specified client token.
+func GetRequestorToken(clientToken irma.ClientToken) (irma.RequestorToken, error) {
+	return s.GetRequestorToken(clientToken)
+}
+func (s *Server) GetRequestorToken(clientToken irma.ClientToken) (token irma.RequestorToken, err error) {
+	err = s.sessions.clientTransaction(context.Background(), clientToken, func(session *sessionData) (bool, error) {
+		token = session.RequestorToken
+		return false, nil
+	})
+	return
+}
+
+// OpenSessions returns the sessions of the specified requestor that are not yet finished, ordered by
+// creation time. If status is not empty, only sessions having that status are included. The offset
+// and limit parameters can be used to page through the sessions; a limit of 0 means no limit.
+func OpenSessions(requestor string, status irma.ServerStatus, offset, limit int) (*server.SessionList, error) {
+	return s.OpenSessions(requestor, status, offset, limit)
+}
+func (s *Server) OpenSessions(requestor string, status irma.ServerStatus, offset, limit int) (*server.SessionList, error) {
+	sessions, err := s.sessions.requestorSessions(context.Background(), requestor)
+	if err != nil {
+		return nil, err
+	}
+
+	list := &server.SessionList{Sessions: []*server.SessionInfo{}}
+	for _, session := range sessions {
+		if session.Status.Finished() || (status != "" && session.Status != status) {
+			continue
+		}
+		list.Sessions = append(list.Sessions, &server.SessionInfo{
+			Token:      session.RequestorToken,
+			Type:       session.Action,
+			Status:     session.Status,
+			Created:    session.Created,
+			LastActive: session.LastActive,
+		})
+	}
+	sort.Slice(list.Sessions, func(i, j int) bool {
+		return list.Sessions[i].Created.Before(list.Sessions[j].Created)
+	})
+
+	list.Total = len(list.Sessions)
+	if offset > len(list.Sessions) {
+		offset = len(list.Sessions)
+	}
+	list.Sessions = list.Sessions[offset:]
+	if limit > 0 && limit < len(list.Sessions) {
+		list.Sessions = list.Sessions[:limit]
+	}
+	return list, nil
+}
+
+// UndeliveredCallbacks returns the session results of the specified requestor in the callback outbox,
+// i.e. whose callback failed and whose delivery is being retried (see server.Configuration.CallbackOutbox).
+func UndeliveredCallbacks(requestor string) ([]*server.UndeliveredCallback, error) {
+	return s.UndeliveredCallbacks(requestor)
+}
+func (s *Server) UndeliveredCallbacks(requestor string) ([]*server.UndeliveredCallback, error) {
+	entries, err := s.sessions.outbox(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	callbacks := []*server.UndeliveredCallback{}
+	for _, entry := range entries {
+		if entry.Requestor == requestor {
+			callbacks = append(callbacks, &entry.UndeliveredCallback)
+		}
+	}
+	sort.Slice(callbacks, func(i, j int) bool {
+		return callbacks[i].Created.Before(callbacks[j].Created)
+	})
+	return callbacks, nil
+}
+
+// RedeliverCallback immediately retries POSTing the result of the specified session, which must
+// be in the callback outbox, to its callback URL. If this fails, the session result remains in the
+// outbox and the error is returned.
+func RedeliverCallback(requestorToken irma.RequestorToken) error {
+	return s.RedeliverCallback(requestorToken)
+}
+func (s *Server) RedeliverCallback(requestorToken irma.RequestorToken) error {
+	entries, err := s.sessions.outbox(context.Background())
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.Token == requestorToken {
+			return s.redeliverCallback(entry)
+		}
+	}
+	return &UnknownSessionError{requestorToken, ""}
+}
+
 // CancelSession cancels the specified IRMA session.
 func CancelSession(requestorToken irma.RequestorToken) error {
 	return s.CancelSession(requestorToken)
 }
 func (s *Server) CancelSession(requestorToken irma.RequestorToken) (err error) {
 	err = s.sessions.transaction(context.Background(), requestorToken, func(session *sessionData) (bool, error) {
-		session.handleDelete(s.conf)
-		return true, nil
+		return true, session.handleDelete(s.conf)
 	})
 	return
 }
@@ -360,7 +741,7 @@ func SetFrontendOptions(requestorToken irma.RequestorToken, request *irma.Fronte
 }
 func (s *Server) SetFrontendOptions(requestorToken irma.RequestorToken, request *irma.FrontendOptionsRequest) (o *irma.SessionOptions, err error) {
 	err = s.sessions.transaction(context.Background(), requestorToken, func(session *sessionData) (bool, error) {
-		o, err = session.updateFrontendOptions(request)
+		o, err = session.updateFrontendOptions(request, s.conf)
 		return true, err
 	})
 	return
@@ -387,6 +768,16 @@ func (s *Server) Revoke(credid irma.CredentialTypeIdentifier, key string, issued
 	return s.conf.IrmaConfiguration.Revocation.Revoke(credid, key, issued)
 }
 
+// PurgeIssuanceRecords deletes the issuance records of the credentials of the specified type
+// having the specified revocation key, after which they can no longer be revoked. (Can only be
+// used if this server is the revocation server for the specified credential type.)
+func PurgeIssuanceRecords(credid irma.CredentialTypeIdentifier, key string) error {
+	return s.PurgeIssuanceRecords(credid, key)
+}
+func (s *Server) PurgeIssuanceRecords(credid irma.CredentialTypeIdentifier, key string) error {
+	return s.conf.IrmaConfiguration.Revocation.PurgeIssuanceRecords(credid, key)
+}
+
 // SubscribeServerSentEvents subscribes the HTTP client to server sent events on status updates
 // of the specified IRMA session.
 func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Request, token irma.RequestorToken) error {
@@ -395,16 +786,17 @@ func (s *Server) SubscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 		Arg:       string(token),
 	}))
 	return s.sessions.transaction(context.Background(), token, func(session *sessionData) (bool, error) {
-		return false, s.subscribeServerSentEvents(w, r, session, true)
+		return false, s.subscribeServerSentEvents(w, r, session, sseSubscriberRequestor)
 	})
 }
 
-func (s *Server) subscribeServerSentEvents(w http.ResponseWriter, r *http.Request, session *sessionData, requestor bool) error {
+func (s *Server) subscribeServerSentEvents(w http.ResponseWriter, r *http.Request, session *sessionData, subscriber sseSubscriber) error {
 	if !s.conf.EnableSSE {
 		server.WriteResponse(w, nil, &irma.RemoteError{
-			Status:      http.StatusInternalServerError,
-			Description: "Server sent events disabled",
-			ErrorName:   "SSE_DISABLED",
+			Status:      server.ErrorSSEDisabled.Status,
+			Description: server.ErrorSSEDisabled.Description,
+			ErrorName:   string(server.ErrorSSEDisabled.Type),
+			Code:        server.ErrorSSEDisabled.Code,
 		})
 		s.conf.Logger.Info("GET /statusevents: endpoint disabled (see --sse in irma server -h)")
 		return nil
@@ -417,6 +809,12 @@ func (s *Server) subscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 
 	activeHandler := false
 	s.activeSSEHandlersMutex.Lock()
+	conn, err := s.registerSSEConnection(r.Context(), session.RequestorToken, subscriber)
+	if err != nil {
+		s.activeSSEHandlersMutex.Unlock()
+		server.WriteError(w, server.ErrorTooManyRequests, err.Error())
+		return nil
+	}
 	if active := s.activeSSEHandlers[session.RequestorToken]; active {
 		activeHandler = true
 	} else {
@@ -429,14 +827,17 @@ func (s *Server) subscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 		updateChan, err := s.sessions.subscribeUpdates(ctx, session.RequestorToken)
 		if err != nil {
 			cancel()
+			s.unregisterSSEConnection(conn)
 			return err
 		}
 		go func() {
+			defer server.RecoverPanic("server-sent events")
 			defer cancel()
 			s.serverSentEventsHandler(session, updateChan)
 			s.activeSSEHandlersMutex.Lock()
 			defer s.activeSSEHandlersMutex.Unlock()
 			delete(s.activeSSEHandlers, session.RequestorToken)
+			s.closeSSEConnections(session.RequestorToken)
 		}()
 	}
 
@@ -447,9 +848,10 @@ func (s *Server) subscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 	// - the "open" event also goes to all other webclients currently listening, as we have no way to send this
 	//   event to just the webclient currently listening. (Thus the handler of this "open" event must be idempotent.)
 	go func() {
+		defer server.RecoverPanic("server-sent events")
 		time.Sleep(200 * time.Millisecond)
 		token := string(session.ClientToken)
-		if requestor {
+		if subscriber == sseSubscriberRequestor {
 			token = string(session.RequestorToken)
 		} else {
 			s.serverSentEvents.SendMessage("frontendsession/"+token, sse.NewMessage("", "", "open"))
@@ -457,7 +859,7 @@ func (s *Server) subscribeServerSentEvents(w http.ResponseWriter, r *http.Reques
 		s.serverSentEvents.SendMessage("session/"+token, sse.NewMessage("", "", "open"))
 	}()
 
-	s.serverSentEvents.ServeHTTP(w, r)
+	s.serveSSE(w, r, conn)
 	return nil
 }
 
@@ -0,0 +1,115 @@
+package irmaserver
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// statusResponse is a recorded response to a status request.
+type statusResponse struct {
+	status  int
+	header  http.Header
+	body    []byte
+	expires time.Time
+}
+
+func (res *statusResponse) Header() http.Header {
+	return res.header
+}
+
+func (res *statusResponse) Write(b []byte) (int, error) {
+	if res.status == 0 {
+		res.status = http.StatusOK
+	}
+	res.body = append(res.body, b...)
+	return len(b), nil
+}
+
+func (res *statusResponse) WriteHeader(status int) {
+	if res.status == 0 {
+		res.status = status
+	}
+}
+
+func (res *statusResponse) writeTo(w http.ResponseWriter) {
+	for key, values := range res.header {
+		w.Header()[key] = append([]string(nil), values...)
+	}
+	w.WriteHeader(res.status)
+	_, _ = w.Write(res.body)
+}
+
+// statusCoalescingMiddleware coalesces concurrent identical GET requests to the status endpoints,
+// which are polled frequently by frontends and apps not using server-sent events: only the first
+// is handled, and its response is sent to all of them. It also caches their responses if
+// Configuration.StatusCacheDuration is set. Requests are identical if they have the same path,
+// host and authorization header, so that e.g. a status request of the frontend with an invalid
+// authorization never receives the response of a valid one.
+func (s *Server) statusCoalescingMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet || !strings.HasSuffix(r.URL.Path, "/status") {
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		key := strings.Join([]string{r.URL.Path, s.conf.RequestHost(r), r.Header.Get(irma.AuthorizationHeader)}, "\x00")
+		if res := s.cachedStatusResponse(key); res != nil {
+			res.writeTo(w)
+			return
+		}
+
+		res, _, _ := s.statusRequests.Do(key, func() (interface{}, error) {
+			// The response is sent to all coalesced requests, so it must not depend on the
+			// client of this request disconnecting
+			ctx, cancel := context.WithTimeout(context.WithoutCancel(r.Context()), server.WriteTimeout)
+			defer cancel()
+			res := &statusResponse{header: http.Header{}}
+			next.ServeHTTP(res, r.WithContext(ctx))
+			if res.status == 0 {
+				res.status = http.StatusOK
+			}
+			s.cacheStatusResponse(key, res)
+			return res, nil
+		})
+		res.(*statusResponse).writeTo(w)
+	})
+}
+
+func (s *Server) cachedStatusResponse(key string) *statusResponse {
+	if s.conf.StatusCacheDuration == 0 {
+		return nil
+	}
+	s.statusCacheMutex.Lock()
+	defer s.statusCacheMutex.Unlock()
+	res := s.statusCache[key]
+	if res == nil || !s.conf.Now().Before(res.expires) {
+		return nil
+	}
+	return res
+}
+
+// cacheStatusResponse caches the response for Configuration.StatusCacheDuration milliseconds,
+// if it was successful, and removes it from the cache afterwards.
+func (s *Server) cacheStatusResponse(key string, res *statusResponse) {
+	if s.conf.StatusCacheDuration == 0 || res.status != http.StatusOK {
+		return
+	}
+	duration := time.Duration(s.conf.StatusCacheDuration) * time.Millisecond
+	res.expires = s.conf.Now().Add(duration)
+
+	s.statusCacheMutex.Lock()
+	defer s.statusCacheMutex.Unlock()
+	s.statusCache[key] = res
+	time.AfterFunc(duration, func() {
+		s.statusCacheMutex.Lock()
+		defer s.statusCacheMutex.Unlock()
+		if s.statusCache[key] == res {
+			delete(s.statusCache, key)
+		}
+	})
+}
@@ -0,0 +1,98 @@
+package irmaserver
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatusCoalescing(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	conf := sessionsConf(t)
+	conf.Clock = clock
+	conf.URL = "https://example.com/irma/"
+	conf.StatusCacheDuration = 200
+	s := newTestServer(t, conf)
+
+	qr, _, _, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	path := sessionPath(qr)
+
+	// A slow status endpoint behind the same middleware as the status endpoint of the IRMA app
+	var computed atomic.Int32
+	r := chi.NewRouter()
+	r.Route("/session/{clientToken}", func(r chi.Router) {
+		r.Use(s.statusCoalescingMiddleware)
+		r.Use(s.requestLockMiddleware)
+		r.Use(s.sessionMiddleware)
+		r.Get("/status", func(w http.ResponseWriter, r *http.Request) {
+			n := computed.Add(1)
+			select {
+			case <-time.After(100 * time.Millisecond):
+				server.WriteJson(w, n)
+			case <-r.Context().Done():
+				server.WriteError(w, server.ErrorUnknown, r.Context().Err().Error())
+			}
+		})
+	})
+
+	getWithContext := func(ctx context.Context, auth string, responses chan<- *httptest.ResponseRecorder) {
+		req := httptest.NewRequest(http.MethodGet, path+"/status", nil).WithContext(ctx)
+		req.Header.Set(irma.AuthorizationHeader, auth)
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, req)
+		responses <- rec
+	}
+	get := func(auth string, responses chan<- *httptest.ResponseRecorder) {
+		getWithContext(context.Background(), auth, responses)
+	}
+
+	// Concurrent identical status requests are handled once, and all receive the same response
+	responses := make(chan *httptest.ResponseRecorder, 5)
+	for i := 0; i < 5; i++ {
+		go get("", responses)
+	}
+	for i := 0; i < 5; i++ {
+		rec := <-responses
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "1", rec.Body.String())
+		require.Contains(t, rec.Header().Get("Content-Type"), "application/json")
+	}
+	require.Equal(t, int32(1), computed.Load())
+
+	// Within the cache duration, identical status requests receive the cached response,
+	// while status requests with a different authorization are handled separately
+	go get("", responses)
+	require.Equal(t, "1", (<-responses).Body.String())
+	go get("other", responses)
+	require.Equal(t, "2", (<-responses).Body.String())
+	require.Equal(t, int32(2), computed.Load())
+
+	// After the cache duration, the status is retrieved again
+	clock.advance(250 * time.Millisecond)
+	go get("", responses)
+	require.Equal(t, "3", (<-responses).Body.String())
+
+	// The status is retrieved for all coalesced requests even if the client whose request is
+	// handled disconnects
+	ctx, cancel := context.WithCancel(context.Background())
+	go getWithContext(ctx, "third", responses)
+	time.Sleep(20 * time.Millisecond)
+	go get("third", responses)
+	time.Sleep(20 * time.Millisecond)
+	cancel()
+	for i := 0; i < 2; i++ {
+		rec := <-responses
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.Equal(t, "4", rec.Body.String())
+	}
+	require.Empty(t, s.requestLocks)
+}
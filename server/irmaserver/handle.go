@@ -24,14 +24,14 @@ import (
 // Maintaining the session state is done here, as well as checking whether the session is in the
 // appropriate status before handling the request.
 
-func (session *sessionData) handleDelete(conf *server.Configuration) {
+func (session *sessionData) handleDelete(conf *server.Configuration) error {
 	if session.Status.Finished() {
-		return
+		return nil
 	}
 	session.markAlive(conf)
 
-	session.Result = &server.SessionResult{Token: session.RequestorToken, Status: irma.ServerStatusCancelled, Type: session.Action}
-	session.setStatus(irma.ServerStatusCancelled, conf)
+	session.Result = &server.SessionResult{Token: session.RequestorToken, Status: irma.ServerStatusCancelled, Type: session.Action, Warnings: session.warnings()}
+	return session.setStatus(irma.ServerStatusCancelled, conf)
 }
 
 func (session *sessionData) handleGetClientRequest(min, max *irma.ProtocolVersion, clientAuth irma.ClientAuthorization, conf *server.Configuration) (
@@ -56,6 +56,11 @@ func (session *sessionData) handleGetClientRequest(min, max *irma.ProtocolVersio
 	}
 	session.ClientAuth = clientAuth
 
+	// Protocol versions below 2.8 don't support pairing
+	if session.Options.PairingRequired && !session.Version.Above(2, 7) {
+		return nil, session.fail(server.ErrorProtocolVersion, "Pairing is required for this session, which is not supported by this client", conf)
+	}
+
 	// we include the latest revocation updates for the client here, as opposed to when the session
 	// was started, so that the client always gets the very latest revocation records
 	sessionRequest := session.Rrequest.SessionRequest()
@@ -74,10 +79,12 @@ func (session *sessionData) handleGetClientRequest(min, max *irma.ProtocolVersio
 	logger.WithFields(logrus.Fields{"version": session.Version.String()}).Debugf("Protocol version negotiated")
 	sessionRequest.Base().ProtocolVersion = session.Version
 
+	status := irma.ServerStatusConnected
 	if session.Options.PairingMethod != irma.PairingMethodNone && session.Version.Above(2, 7) {
-		session.setStatus(irma.ServerStatusPairing, conf)
-	} else {
-		session.setStatus(irma.ServerStatusConnected, conf)
+		status = irma.ServerStatusPairing
+	}
+	if err = session.setStatus(status, conf); err != nil {
+		return nil, server.RemoteError(server.ErrorUnexpectedRequest, err.Error())
 	}
 
 	if session.Version.Below(2, 5) {
@@ -86,7 +93,7 @@ func (session *sessionData) handleGetClientRequest(min, max *irma.ProtocolVersio
 		return legacy, nil
 	}
 
-	if session.Version.Below(2, 8) {
+	if !irma.LDContextSupported(irma.LDContextClientSessionRequest, session.Version) {
 		// These versions do not support the ClientSessionRequest format, so send the SessionRequest.
 		request, err := session.getRequest()
 		if err != nil {
@@ -117,7 +124,10 @@ func (session *sessionData) handlePostSignature(signature *irma.SignedMessage, c
 	request := sessionRequest.(*irma.SignatureRequest)
 	request.Disclose = append(request.Disclose, session.ImplicitDisclosure...)
 
-	session.Result.Disclosed, session.Result.ProofStatus, err = signature.Verify(conf.IrmaConfiguration, request)
+	session.Result.Disclosed, session.Result.ProofStatus, err = signature.Verify(session.irmaConfiguration(conf), request)
+	if err == nil {
+		session.Result.ReissuanceHints = session.reissuanceHints(signature.Signature, conf)
+	}
 	if err != nil && err == irma.ErrMissingPublicKey {
 		rerr = session.fail(server.ErrorUnknownPublicKey, err.Error(), conf)
 	} else if err != nil {
@@ -141,7 +151,10 @@ func (session *sessionData) handlePostDisclosure(disclosure *irma.Disclosure, co
 	request := session.Rrequest.SessionRequest().(*irma.DisclosureRequest)
 	request.Disclose = append(request.Disclose, session.ImplicitDisclosure...)
 
-	session.Result.Disclosed, session.Result.ProofStatus, err = disclosure.Verify(conf.IrmaConfiguration, request)
+	session.Result.Disclosed, session.Result.ProofStatus, err = disclosure.Verify(session.irmaConfiguration(conf), request)
+	if err == nil {
+		session.Result.ReissuanceHints = session.reissuanceHints(disclosure.Proofs, conf)
+	}
 	if err != nil && err == irma.ErrMissingPublicKey {
 		rerr = session.fail(server.ErrorUnknownPublicKey, err.Error(), conf)
 	} else if err != nil {
@@ -155,9 +168,91 @@ func (session *sessionData) handlePostDisclosure(disclosure *irma.Disclosure, co
 	}, rerr
 }
 
+// checkMdocReader checks that an mdoc reader can take part in the session, i.e. that the session
+// allows mdoc presentation and has not been taken up by an IRMA app.
+func (session *sessionData) checkMdocReader() *irma.RemoteError {
+	if !session.Rrequest.Base().Mdoc {
+		return server.RemoteError(server.ErrorUnsupported, "Session does not allow presenting mdocs")
+	}
+	if session.Options.PairingMethod != irma.PairingMethodNone {
+		return server.RemoteError(server.ErrorPairingRequired, "Mdocs cannot be presented in sessions requiring pairing")
+	}
+	if session.Status != irma.ServerStatusInitialized && (session.Status != irma.ServerStatusConnected || !session.MdocReader) {
+		return server.RemoteError(server.ErrorUnexpectedRequest, "Session already started")
+	}
+	return nil
+}
+
+func (session *sessionData) handleGetMdocRequest(conf *server.Configuration) (*irma.MdocDeviceRequest, *irma.RemoteError) {
+	if rerr := session.checkMdocReader(); rerr != nil {
+		return nil, rerr
+	}
+	session.markAlive(conf)
+
+	request := session.Rrequest.SessionRequest().(*irma.DisclosureRequest)
+	items, _ := conf.MdocMapping.ItemsRequests(append(request.Disclose, session.ImplicitDisclosure...))
+	res, err := irma.NewMdocDeviceRequest(items...)
+	if err != nil {
+		return nil, session.fail(server.ErrorUnknown, err.Error(), conf)
+	}
+	if rerr := session.connectMdocReader(conf); rerr != nil {
+		return nil, rerr
+	}
+	return res, nil
+}
+
+// connectMdocReader marks the session as connected to an mdoc reader, if it is not yet.
+func (session *sessionData) connectMdocReader(conf *server.Configuration) *irma.RemoteError {
+	session.MdocReader = true
+	if session.Status == irma.ServerStatusConnected {
+		return nil
+	}
+	if err := session.setStatus(irma.ServerStatusConnected, conf); err != nil {
+		return server.RemoteError(server.ErrorUnexpectedRequest, err.Error())
+	}
+	return nil
+}
+
+func (session *sessionData) handlePostMdocResponse(response *irma.MdocDeviceResponse, conf *server.Configuration) (*irma.ServerSessionResponse, *irma.RemoteError) {
+	if rerr := session.checkMdocReader(); rerr != nil {
+		return nil, rerr
+	}
+	// Readers may post their response without first retrieving the request
+	if rerr := session.connectMdocReader(conf); rerr != nil {
+		return nil, rerr
+	}
+	session.markAlive(conf)
+
+	request := session.Rrequest.SessionRequest().(*irma.DisclosureRequest)
+	request.Disclose = append(request.Disclose, session.ImplicitDisclosure...)
+
+	transcript, err := irma.MdocSessionTranscript(session.ClientToken)
+	if err != nil {
+		return nil, session.fail(server.ErrorUnknown, err.Error(), conf)
+	}
+	docs, err := response.Verify(conf.MdocRoots(), transcript, conf.Now())
+	if err != nil {
+		return nil, session.fail(server.ErrorInvalidProofs, err.Error(), conf)
+	}
+	session.Result.Disclosed, session.Result.ProofStatus, err = conf.MdocMapping.Disclosed(session.irmaConfiguration(conf), request.Disclose, docs)
+	if err != nil {
+		return nil, session.fail(server.ErrorInvalidProofs, err.Error(), conf)
+	}
+	for _, doc := range docs {
+		session.Result.Mdoc = append(session.Result.Mdoc, server.NewMdocDocumentInfo(doc))
+	}
+
+	return &irma.ServerSessionResponse{
+		SessionType:     irma.ActionDisclosing,
+		ProtocolVersion: maxProtocolVersion,
+		ProofStatus:     session.Result.ProofStatus,
+	}, nil
+}
+
 func (session *sessionData) handlePostCommitments(commitments *irma.IssueCommitmentMessage, conf *server.Configuration) (*irma.ServerSessionResponse, *irma.RemoteError) {
 	session.markAlive(conf)
 	request := session.Rrequest.SessionRequest().(*irma.IssuanceRequest)
+	irmaconf := session.irmaConfiguration(conf)
 
 	discloseCount := len(commitments.Proofs) - len(request.Credentials)
 	if discloseCount < 0 {
@@ -166,13 +261,13 @@ func (session *sessionData) handlePostCommitments(commitments *irma.IssueCommitm
 
 	// Compute list of public keys against which to verify the received proofs
 	disclosureproofs := irma.ProofList(commitments.Proofs[:discloseCount])
-	pubkeys, err := disclosureproofs.ExtractPublicKeys(conf.IrmaConfiguration)
+	pubkeys, err := disclosureproofs.ExtractPublicKeys(irmaconf)
 	if err != nil {
 		return nil, session.fail(server.ErrorMalformedInput, err.Error(), conf)
 	}
 	for _, cred := range request.Credentials {
 		iss := cred.CredentialTypeID.IssuerIdentifier()
-		pubkey, _ := conf.IrmaConfiguration.PublicKey(iss, cred.KeyCounter) // No error, already checked earlier
+		pubkey, _ := irmaconf.PublicKey(iss, cred.KeyCounter) // No error, already checked earlier
 		pubkeys = append(pubkeys, pubkey)
 	}
 
@@ -180,20 +275,26 @@ func (session *sessionData) handlePostCommitments(commitments *irma.IssueCommitm
 	for i, proof := range commitments.Proofs {
 		pubkey := pubkeys[i]
 		schemeid := irma.NewIssuerIdentifier(pubkey.Issuer).SchemeManagerIdentifier()
-		if conf.IrmaConfiguration.SchemeManagers[schemeid].Distributed() {
+		if irmaconf.SchemeManagers[schemeid].Distributed() {
 			proofP, err := session.getProofP(commitments, schemeid, conf)
 			if err != nil {
 				return nil, session.fail(server.ErrorKeyshareProofMissing, err.Error(), conf)
 			}
+			// From protocol version 2.9 the ProofU of the client already includes the keyshare server's P,
+			// so that of a legacy ProofP only the response has to be merged in
+			if proofU, ok := proof.(*gabi.ProofU); ok && proofP.P != nil && session.Version.Above(2, 8) {
+				proofU.SResponse.Add(proofU.SResponse, proofP.SResponse)
+				continue
+			}
 			proof.MergeProofP(proofP, pubkey)
 		}
 	}
 
 	// Verify all proofs and check disclosed attributes, if any, against request
-	now := time.Now()
+	now := conf.Now()
 	request.Disclose = append(request.Disclose, session.ImplicitDisclosure...)
 	session.Result.Disclosed, session.Result.ProofStatus, err = commitments.Disclosure().VerifyAgainstRequest(
-		conf.IrmaConfiguration, request, request.GetContext(), request.GetNonce(nil), pubkeys, &now, false,
+		irmaconf, request, request.GetContext(), request.GetNonce(nil), pubkeys, &now, false,
 	)
 	if err != nil {
 		if err == irma.ErrMissingPublicKey {
@@ -208,29 +309,40 @@ func (session *sessionData) handlePostCommitments(commitments *irma.IssueCommitm
 	if session.Result.ProofStatus != irma.ProofStatusValid {
 		return nil, session.fail(server.ErrorInvalidProofs, "", conf)
 	}
+	session.Result.ReissuanceHints = session.reissuanceHints(commitments.Proofs[:discloseCount], conf)
 
-	// Compute CL signatures
+	// Compute CL signatures. The issuance records of revocable credentials are saved only once all
+	// signatures have been computed, so that either all credentials are issued or none of them.
 	var sigs []*gabi.IssueSignatureMessage
+	var issrecords []*irma.IssuanceRecord
 	for i, cred := range request.Credentials {
 		id := cred.CredentialTypeID.IssuerIdentifier()
-		pk, _ := conf.IrmaConfiguration.PublicKey(id, cred.KeyCounter)
-		sk, _ := conf.IrmaConfiguration.PrivateKeys.Latest(id)
+		pk, _ := irmaconf.PublicKey(id, cred.KeyCounter)
+		sk, _ := irmaconf.PrivateKeys.Get(id, cred.KeyCounter) // No error, already checked earlier
 		issuer := gabi.NewIssuer(sk, pk, one)
 		proof, ok := commitments.Proofs[i+discloseCount].(*gabi.ProofU)
 		if !ok {
 			return nil, session.fail(server.ErrorMalformedInput, "Received invalid issuance commitment", conf)
 		}
-		attrs, witness, err := session.computeAttributes(sk, cred, conf)
+		attrs, witness, issrecord, err := session.computeAttributes(sk, cred, conf)
 		if err != nil {
 			return nil, session.fail(server.ErrorIssuanceFailed, err.Error(), conf)
 		}
-		rb := conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeIndices()
+		if issrecord != nil {
+			issrecords = append(issrecords, issrecord)
+		}
+		rb := irmaconf.CredentialTypes[cred.CredentialTypeID].RandomBlindAttributeIndices()
 		sig, err := issuer.IssueSignature(proof.U, attrs, witness, commitments.Nonce2, rb)
 		if err != nil {
 			return nil, session.fail(server.ErrorIssuanceFailed, err.Error(), conf)
 		}
 		sigs = append(sigs, sig)
 	}
+	if len(issrecords) > 0 {
+		if err = conf.IrmaConfiguration.Revocation.SaveIssuanceRecords(issrecords); err != nil {
+			return nil, session.fail(server.ErrorIssuanceFailed, err.Error(), conf)
+		}
+	}
 
 	return &irma.ServerSessionResponse{
 		SessionType:     irma.ActionIssuing,
@@ -255,24 +367,27 @@ func (session *sessionData) nextSession(conf *server.Configuration) (irma.Reques
 		return nil, nil, errors.New("session in invalid state")
 	}
 
+	result := conf.HashResultAttributes(session.Requestor, session.Result)
 	var res interface{}
 	var err error
-	if conf.JwtRSAPrivateKey != nil {
-		res, err = server.ResultJwt(
-			session.Result,
+	if conf.JwtSigningKey() != nil {
+		res, err = server.MappedResultJwt(
+			result,
 			conf.JwtIssuer,
 			base.ResultJwtValidity,
-			conf.JwtRSAPrivateKey,
+			conf.JwtSigningKey(),
+			conf.JwtKeyIDs[session.Requestor],
+			conf.ResultJwtClaims,
 		)
 		if err != nil {
 			return nil, nil, err
 		}
 	} else {
-		res = session.Result
+		res = result
 	}
 
 	var reqbts json.RawMessage
-	err = irma.NewHTTPTransport("", false).Post(url, &reqbts, res)
+	err = conf.HTTPClient().NewTransport("", false).Post(url, &reqbts, res)
 	if err != nil {
 		if sessErr, ok := err.(*irma.SessionError); ok && sessErr.RemoteStatus == http.StatusNoContent {
 			// 204 instead of a new sessionRequest means no next session is coming
@@ -280,7 +395,7 @@ func (session *sessionData) nextSession(conf *server.Configuration) (irma.Reques
 		}
 		return nil, nil, err
 	}
-	req, err := server.ParseSessionRequest([]byte(reqbts))
+	req, err := parseSessionRequest(conf, []byte(reqbts))
 	if err != nil {
 		return nil, nil, err
 	}
@@ -313,7 +428,7 @@ func (s *Server) startNext(session *sessionData, res *irma.ServerSessionResponse
 	// All attributes that were disclosed in the previous session, as well as any attributes
 	// from sessions before that, need to be disclosed in the new session as well.
 	// Therefore pass them as parameters to startNextSession
-	qr, token, _, err := s.startNextSession(next, nil, disclosed, session.FrontendAuth)
+	qr, token, _, err := s.startNextSession(next, nil, session.Requestor, disclosed, session.FrontendAuth)
 	if err != nil {
 		return err
 	}
@@ -333,8 +448,8 @@ func (s *Server) handleSessionCommitments(w http.ResponseWriter, r *http.Request
 		server.WriteError(w, server.ErrorMalformedInput, err.Error())
 		return
 	}
-	if err := irma.UnmarshalValidate(bts, commitments); err != nil {
-		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+	if err := s.unmarshal(server.StrictJSONCommitments, bts, commitments); err != nil {
+		server.WriteError(w, server.InputError(err, server.ErrorMalformedInput), err.Error())
 		return
 	}
 	session := r.Context().Value("session").(*sessionData)
@@ -347,7 +462,11 @@ func (s *Server) handleSessionCommitments(w http.ResponseWriter, r *http.Request
 		server.WriteError(w, server.ErrorNextSession, err.Error())
 		return
 	}
-	session.setStatus(irma.ServerStatusDone, s.conf)
+	if err = session.setStatus(irma.ServerStatusDone, s.conf); err != nil {
+		server.WriteError(w, server.ErrorUnexpectedRequest, err.Error())
+		return
+	}
+	s.statistics.Record(session.Rrequest.SessionRequest(), session.Result)
 	server.WriteResponse(w, res, nil)
 }
 
@@ -364,15 +483,19 @@ func (s *Server) handleSessionProofs(w http.ResponseWriter, r *http.Request) {
 	switch session.Action {
 	case irma.ActionDisclosing:
 		disclosure := &irma.Disclosure{}
-		if err := irma.UnmarshalValidate(bts, disclosure); err != nil {
-			server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		if err := s.unmarshal(server.StrictJSONProofs, bts, disclosure); err != nil {
+			server.WriteError(w, server.InputError(err, server.ErrorMalformedInput), err.Error())
 			return
 		}
 		res, rerr = session.handlePostDisclosure(disclosure, s.conf)
 	case irma.ActionSigning:
 		signature := &irma.SignedMessage{}
-		if err := irma.UnmarshalValidate(bts, signature); err != nil {
-			server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		if err := s.unmarshal(server.StrictJSONProofs, bts, signature); err != nil {
+			server.WriteError(w, server.InputError(err, server.ErrorMalformedInput), err.Error())
+			return
+		}
+		if err := irma.ValidateLDContext(signature.LDContext, session.Version, "", irma.LDContextSignedMessage); err != nil {
+			server.WriteError(w, server.ErrorLDContext, err.Error())
 			return
 		}
 		res, rerr = session.handlePostSignature(signature, s.conf)
@@ -387,7 +510,57 @@ func (s *Server) handleSessionProofs(w http.ResponseWriter, r *http.Request) {
 		server.WriteError(w, server.ErrorNextSession, err.Error())
 		return
 	}
-	session.setStatus(irma.ServerStatusDone, s.conf)
+	if err = session.setStatus(irma.ServerStatusDone, s.conf); err != nil {
+		server.WriteError(w, server.ErrorUnexpectedRequest, err.Error())
+		return
+	}
+	s.statistics.Record(session.Rrequest.SessionRequest(), session.Result)
+	server.WriteResponse(w, res, nil)
+}
+
+func (s *Server) handleSessionMdocRequest(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value("session").(*sessionData)
+	res, rerr := session.handleGetMdocRequest(s.conf)
+	if rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+	bts, err := irma.MarshalBinary(res)
+	if err != nil {
+		server.WriteError(w, server.ErrorUnknown, err.Error())
+		return
+	}
+	w.Header().Set("Content-Type", irma.MdocContentType)
+	_, _ = w.Write(bts)
+}
+
+func (s *Server) handleSessionMdocResponse(w http.ResponseWriter, r *http.Request) {
+	defer common.Close(r.Body)
+	bts, err := io.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return
+	}
+	response := &irma.MdocDeviceResponse{}
+	if err = irma.UnmarshalBinary(bts, response); err != nil {
+		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		return
+	}
+	session := r.Context().Value("session").(*sessionData)
+	res, rerr := session.handlePostMdocResponse(response, s.conf)
+	if rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+	if err = s.startNext(session, res); err != nil {
+		server.WriteError(w, server.ErrorNextSession, err.Error())
+		return
+	}
+	if err = session.setStatus(irma.ServerStatusDone, s.conf); err != nil {
+		server.WriteError(w, server.ErrorUnexpectedRequest, err.Error())
+		return
+	}
+	s.statistics.Record(session.Rrequest.SessionRequest(), session.Result)
 	server.WriteResponse(w, res, nil)
 }
 
@@ -403,7 +576,7 @@ func (s *Server) handleSessionStatusEvents(w http.ResponseWriter, r *http.Reques
 		Component: server.ComponentSession,
 		Arg:       string(session.ClientToken),
 	}))
-	if err := s.subscribeServerSentEvents(w, r, session, false); err != nil {
+	if err := s.subscribeServerSentEvents(w, r, session, sseSubscriberApp); err != nil {
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
 	}
@@ -411,7 +584,10 @@ func (s *Server) handleSessionStatusEvents(w http.ResponseWriter, r *http.Reques
 
 func (s *Server) handleSessionDelete(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*sessionData)
-	session.handleDelete(s.conf)
+	if err := session.handleDelete(s.conf); err != nil {
+		server.WriteError(w, server.ErrorUnexpectedRequest, err.Error())
+		return
+	}
 	w.WriteHeader(200)
 }
 
@@ -427,7 +603,29 @@ func (s *Server) handleSessionGet(w http.ResponseWriter, r *http.Request) {
 	}
 	session := r.Context().Value("session").(*sessionData)
 	clientAuth := irma.ClientAuthorization(r.Header.Get(irma.AuthorizationHeader))
+	// Apps that connect over TLS directly to us may bind their authorization to their TLS connections
+	var tlsBindingKey []byte
+	if binding := r.Header.Get(irma.TLSBindingHeader); binding != "" && r.TLS != nil && s.conf.StoreType != "stateless" {
+		var err error
+		if tlsBindingKey, err = irma.VerifyTLSBinding(binding, r.TLS); err != nil {
+			server.WriteError(w, server.ErrorIrmaUnauthorized, err.Error())
+			return
+		}
+	}
 	res, err := session.handleGetClientRequest(&min, &max, clientAuth, s.conf)
+	if err == nil && clientAuth != "" && session.Version.Above(2, 8) {
+		session.TLSBindingKey = tlsBindingKey
+	}
+	// In stateless mode the authorization of the client is not kept, so it cannot be rotated
+	if err == nil && clientAuth != "" && r.Header.Get(irma.AuthorizationRotationHeader) != "" &&
+		s.conf.RotateClientAuth && s.conf.StoreType != "stateless" {
+		session.RotateClientAuth = true
+		if rotateErr := session.rotateClientAuth(w, s.conf); rotateErr != nil {
+			s.conf.Logger.WithError(rotateErr).Error("Failed to rotate client authorization")
+			server.WriteError(w, server.ErrorInternal, "")
+			return
+		}
+	}
 	server.WriteResponse(w, res, err)
 }
 
@@ -457,12 +655,17 @@ func (s *Server) handleFrontendStatusEvents(w http.ResponseWriter, r *http.Reque
 		Component: server.ComponentFrontendSession,
 		Arg:       string(session.ClientToken),
 	}))
-	if err := s.subscribeServerSentEvents(w, r, session, false); err != nil {
+	if err := s.subscribeServerSentEvents(w, r, session, sseSubscriberFrontend); err != nil {
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
 	}
 }
 
+func (s *Server) handleFrontendOptionsGet(w http.ResponseWriter, r *http.Request) {
+	session := r.Context().Value("session").(*sessionData)
+	server.WriteResponse(w, &session.Options, nil)
+}
+
 func (s *Server) handleFrontendOptionsPost(w http.ResponseWriter, r *http.Request) {
 	defer common.Close(r.Body)
 	optionsRequest := &irma.FrontendOptionsRequest{}
@@ -471,14 +674,14 @@ func (s *Server) handleFrontendOptionsPost(w http.ResponseWriter, r *http.Reques
 		server.WriteError(w, server.ErrorMalformedInput, err.Error())
 		return
 	}
-	err = irma.UnmarshalValidate(bts, optionsRequest)
+	err = s.unmarshal(server.StrictJSONFrontendOptions, bts, optionsRequest)
 	if err != nil {
-		server.WriteError(w, server.ErrorMalformedInput, err.Error())
+		server.WriteError(w, server.InputError(err, server.ErrorMalformedInput), err.Error())
 		return
 	}
 
 	session := r.Context().Value("session").(*sessionData)
-	res, err := session.updateFrontendOptions(optionsRequest)
+	res, err := session.updateFrontendOptions(optionsRequest, s.conf)
 	if err != nil {
 		server.WriteError(w, server.ErrorUnexpectedRequest, err.Error())
 		return
@@ -541,7 +744,14 @@ func (s *Server) handleRevocationUpdateEvents(w http.ResponseWriter, r *http.Req
 			Arg:       id,
 		}))
 	}
-	s.serverSentEvents.ServeHTTP(w, r)
+	s.activeSSEHandlersMutex.Lock()
+	conn, err := s.registerSSEConnection(r.Context(), "", sseSubscriberRevocation)
+	s.activeSSEHandlersMutex.Unlock()
+	if err != nil {
+		server.WriteBinaryResponse(w, nil, server.RemoteError(server.ErrorTooManyRequests, err.Error()))
+		return
+	}
+	s.serveSSE(w, r, conn)
 }
 
 // GET revocation/update/{credtype}/{count}[/{pkcounter}]
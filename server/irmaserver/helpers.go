@@ -4,13 +4,17 @@ import (
 	"bytes"
 	"context"
 	"crypto/sha256"
+	"crypto/subtle"
 	"encoding/json"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"reflect"
+	"slices"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/alexandrevicenzi/go-sse"
@@ -33,20 +37,18 @@ var one *big.Int = big.NewInt(1)
 // Session helpers
 
 func (session *sessionData) markAlive(conf *server.Configuration) {
-	session.LastActive = time.Now()
+	session.LastActive = conf.Now()
 	conf.Logger.
 		WithFields(logrus.Fields{"session": session.RequestorToken}).
 		Debug("Session marked active, deletion delayed")
 }
 
-func (session *sessionData) setStatus(status irma.ServerStatus, conf *server.Configuration) {
-	session.Status = status
-	session.Result.Status = status
-
-	// Execute callback and handler if status is Finished
-	if session.Status.Finished() {
-		session.doResultCallback(conf)
-	}
+// irmaConfiguration returns the snapshot of the schemes as of the start of the session, so that
+// scheme updates do not change the credential types and keys of the session halfway; or the
+// current snapshot if the former is no longer retained (or known, as with other server instances
+// sharing a Redis session store running other scheme versions).
+func (session *sessionData) irmaConfiguration(conf *server.Configuration) *irma.Configuration {
+	return conf.IrmaConfiguration.SnapshotOf(session.SchemesSnapshot)
 }
 
 func (session *sessionData) doResultCallback(conf *server.Configuration) {
@@ -54,45 +56,180 @@ func (session *sessionData) doResultCallback(conf *server.Configuration) {
 	if url == "" {
 		return
 	}
-	server.DoResultCallback(url,
-		session.Result,
+	result := conf.HashResultAttributes(session.Requestor, session.Result)
+	err := server.DoResultCallback(server.WithRequestID(context.Background(), session.requestID), conf.HTTPClient(), url,
+		result,
 		conf.JwtIssuer,
 		session.Rrequest.Base().ResultJwtValidity,
-		conf.JwtRSAPrivateKey,
+		conf.JwtSigningKey(),
+		conf.JwtKeyIDs[session.Requestor],
+		conf.ResultJwtClaims,
+	)
+	if err == nil || !conf.CallbackOutbox {
+		return
+	}
+
+	// The session store puts the result in the callback outbox once the session is updated
+	now := conf.Now()
+	session.undeliveredCallback = &outboxEntry{
+		UndeliveredCallback: server.UndeliveredCallback{
+			Token:       session.RequestorToken,
+			CallbackURL: url,
+			Attempts:    1,
+			Created:     now,
+			LastAttempt: now,
+			LastError:   err.Error(),
+		},
+		Requestor: session.Requestor,
+		Result:    result,
+		Validity:  session.Rrequest.Base().ResultJwtValidity,
+		RequestID: session.requestID,
+	}
+}
+
+// redeliverCallbacks retries delivering the session results in the callback outbox, and drops
+// those that have been in the outbox longer than the configured lifetime.
+func (s *Server) redeliverCallbacks() {
+	entries, err := s.sessions.outbox(context.Background())
+	if err != nil {
+		s.conf.Logger.WithError(err).Error("Failed to read callback outbox")
+		return
+	}
+	lifetime := time.Duration(s.conf.CallbackOutboxLifetime) * time.Minute
+	for _, entry := range entries {
+		if s.conf.Now().Sub(entry.Created) > lifetime {
+			s.conf.Logger.WithFields(logrus.Fields{"session": entry.Token, "attempts": entry.Attempts}).
+				Warn("Dropping undelivered session result from callback outbox")
+			if err := s.sessions.deleteOutbox(context.Background(), entry.Token); err != nil {
+				s.conf.Logger.WithError(err).Error("Failed to delete entry from callback outbox")
+			}
+			continue
+		}
+		_ = s.redeliverCallback(entry) // already logged
+	}
+}
+
+func (s *Server) redeliverCallback(entry *outboxEntry) error {
+	err := server.DoResultCallback(server.WithRequestID(context.Background(), entry.RequestID), s.conf.HTTPClient(), entry.CallbackURL,
+		entry.Result,
+		s.conf.JwtIssuer,
+		entry.Validity,
+		s.conf.JwtSigningKey(),
+		s.conf.JwtKeyIDs[entry.Requestor],
+		s.conf.ResultJwtClaims,
 	)
+	if err == nil {
+		s.conf.Logger.WithFields(logrus.Fields{"session": entry.Token, "attempts": entry.Attempts + 1}).
+			Info("Session result from callback outbox delivered")
+		if err := s.sessions.deleteOutbox(context.Background(), entry.Token); err != nil {
+			s.conf.Logger.WithError(err).Error("Failed to delete entry from callback outbox")
+			return err
+		}
+		return nil
+	}
+
+	entry.Attempts++
+	entry.LastAttempt = s.conf.Now()
+	entry.LastError = err.Error()
+	if err := s.sessions.putOutbox(context.Background(), entry); err != nil {
+		s.conf.Logger.WithError(err).Error("Failed to update entry in callback outbox")
+	}
+	return err
 }
 
 // Checks whether requested options are valid in the current session context.
-func (session *sessionData) updateFrontendOptions(request *irma.FrontendOptionsRequest) (*irma.SessionOptions, error) {
+func (session *sessionData) updateFrontendOptions(request *irma.FrontendOptionsRequest, conf *server.Configuration) (*irma.SessionOptions, error) {
 	if session.Status != irma.ServerStatusInitialized {
 		return nil, errors.New("Frontend options can only be updated when session is in initialized state")
 	}
 	if request.PairingMethod == "" {
 		return &session.Options, nil
+	} else if request.PairingMethod != irma.PairingMethodNone && session.Rrequest.Base().RequestInSessionPtr() {
+		return nil, errors.New("Pairing is not supported for sessions with the request in the session pointer")
+	} else if request.PairingMethod == irma.PairingMethodNone && session.Options.PairingRequired {
+		// Pairing is enforced by the server, so we keep the current pairing code
+		return &session.Options, nil
 	} else if request.PairingMethod == irma.PairingMethodNone {
 		session.Options.PairingCode = ""
 	} else if request.PairingMethod == irma.PairingMethodPin {
-		session.Options.PairingCode = common.NewPairingCode()
+		code, err := common.NewPairingCodeFrom(conf.Rand())
+		if err != nil {
+			return nil, err
+		}
+		session.Options.PairingCode = code
 	} else {
 		return nil, errors.New("Pairing method unknown")
 	}
 	session.Options.PairingMethod = request.PairingMethod
+	if session.Options.Features != nil {
+		session.Options.Features.UpdateExpectedStatuses(request.PairingMethod)
+	}
 	return &session.Options, nil
 }
 
+// pairingRequired returns whether pairing is required for the session, either by the requestor or
+// because it involves one of the credential types for which the server requires pairing.
+func (s *Server) pairingRequired(request irma.RequestorRequest) bool {
+	if request.Base().RequirePairing {
+		return true
+	}
+	if len(s.conf.PairingRequiredCredentials) == 0 {
+		return false
+	}
+	ids := request.SessionRequest().Identifiers()
+	for _, id := range s.conf.PairingRequiredCredentials {
+		if _, ok := ids.CredentialTypes[id]; ok {
+			return true
+		}
+	}
+	return false
+}
+
+// sessionFeatures returns the capabilities of the server for the session, to be advertised to the frontend.
+func (s *Server) sessionFeatures(request irma.RequestorRequest, options irma.SessionOptions) *irma.SessionFeatures {
+	features := &irma.SessionFeatures{
+		PairingMethods: []irma.PairingMethod{irma.PairingMethodNone, irma.PairingMethodPin},
+		SSE:            s.conf.EnableSSE,
+		ChainedSession: request.Base().NextSession != nil && request.Base().NextSession.URL != "",
+	}
+	if options.PairingRequired {
+		features.PairingMethods = []irma.PairingMethod{irma.PairingMethodPin}
+	}
+	if s.conf.StoreType == "stateless" {
+		// Enabling pairing changes the session state, which the stateless session store cannot save
+		features.PairingMethods = []irma.PairingMethod{irma.PairingMethodNone}
+	}
+	features.UpdateExpectedStatuses(options.PairingMethod)
+	return features
+}
+
 // Complete the pairing process of frontend and irma client
 func (session *sessionData) pairingCompleted(conf *server.Configuration) error {
 	if session.Status == irma.ServerStatusPairing {
-		session.setStatus(irma.ServerStatusConnected, conf)
-		return nil
+		return session.setStatus(irma.ServerStatusConnected, conf)
 	}
 	return errors.New("Pairing was not enabled")
 }
 
+// warnings returns the warnings of the session result, which are kept when the result is replaced.
+func (session *sessionData) warnings() []string {
+	if session.Result == nil {
+		return nil
+	}
+	return session.Result.Warnings
+}
+
 func (session *sessionData) fail(err server.Error, message string, conf *server.Configuration) *irma.RemoteError {
 	rerr := server.RemoteError(err, message)
-	session.Result = &server.SessionResult{Err: rerr, Token: session.RequestorToken, Status: irma.ServerStatusCancelled, Type: session.Action}
-	session.setStatus(irma.ServerStatusCancelled, conf)
+	// The result of a finished session must not be overwritten
+	if terr := session.checkTransition(irma.ServerStatusCancelled); terr != nil {
+		conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).WithError(terr).Warn("Not failing finished session")
+		return rerr
+	}
+	session.Result = &server.SessionResult{Err: rerr, Token: session.RequestorToken, Status: irma.ServerStatusCancelled, Type: session.Action, Warnings: session.warnings()}
+	if terr := session.setStatus(irma.ServerStatusCancelled, conf); terr != nil {
+		conf.Logger.WithError(terr).Error("Failed to cancel session")
+	}
 	return rerr
 }
 
@@ -134,12 +271,16 @@ const retryTimeLimit = 10 * time.Second
 // - the body is not empty
 // - last time was not more than 10 seconds ago (retryablehttp client gives up before this)
 // - the session status is what it is expected to be when receiving the request for a second time.
-func (session *sessionData) checkCache(endpoint string, message []byte) (int, []byte) {
+//
+// The bodies are compared in constant time. Concurrent retries are handled one at a time by the
+// requestLockMiddleware, so that they find the response cached by the first request.
+func (session *sessionData) checkCache(endpoint string, message []byte, conf *server.Configuration) (int, []byte) {
+	cachedHash, hash := sha256.Sum256(session.ResponseCache.Message), sha256.Sum256(message)
 	if session.ResponseCache.Endpoint != endpoint ||
 		len(session.ResponseCache.Response) == 0 ||
 		session.ResponseCache.SessionStatus != session.Status ||
-		session.LastActive.Before(time.Now().Add(-retryTimeLimit)) ||
-		sha256.Sum256(session.ResponseCache.Message) != sha256.Sum256(message) {
+		session.LastActive.Before(conf.Now().Add(-retryTimeLimit)) ||
+		subtle.ConstantTimeCompare(cachedHash[:], hash[:]) != 1 {
 		session.ResponseCache = responseCache{}
 		return 0, nil
 	}
@@ -150,7 +291,7 @@ func (session *sessionData) checkCache(endpoint string, message []byte) (int, []
 
 func (session *sessionData) computeWitness(sk *gabikeys.PrivateKey, cred *irma.CredentialRequest, conf *server.Configuration) (*revocation.Witness, error) {
 	id := cred.CredentialTypeID
-	credtyp := conf.IrmaConfiguration.CredentialTypes[id]
+	credtyp := session.irmaConfiguration(conf).CredentialTypes[id]
 	if !credtyp.RevocationSupported() || !session.Rrequest.SessionRequest().Base().RevocationSupported() {
 		return nil, nil
 	}
@@ -190,27 +331,30 @@ func (session *sessionData) computeWitness(sk *gabikeys.PrivateKey, cred *irma.C
 	return witness, nil
 }
 
+// computeAttributes computes the attributes of the credential to be issued, along with its
+// nonrevocation witness and issuance record if it is revocable. The issuance record is not saved.
 func (session *sessionData) computeAttributes(
 	sk *gabikeys.PrivateKey, cred *irma.CredentialRequest, conf *server.Configuration,
-) ([]*big.Int, *revocation.Witness, error) {
+) ([]*big.Int, *revocation.Witness, *irma.IssuanceRecord, error) {
 	id := cred.CredentialTypeID
 	witness, err := session.computeWitness(sk, cred, conf)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 	var nonrevAttr *big.Int
 	if witness != nil {
 		nonrevAttr = witness.E
 	}
 
-	issuedAt := time.Now()
-	attributes, err := cred.AttributeList(conf.IrmaConfiguration, 0x03, nonrevAttr, issuedAt)
+	issuedAt := conf.Now()
+	attributes, err := cred.AttributeList(session.irmaConfiguration(conf), 0x03, nonrevAttr, issuedAt)
 	if err != nil {
-		return nil, nil, err
+		return nil, nil, nil, err
 	}
 
+	var issrecord *irma.IssuanceRecord
 	if witness != nil {
-		issrecord := &irma.IssuanceRecord{
+		issrecord = &irma.IssuanceRecord{
 			CredType:   id,
 			PKCounter:  &sk.Counter,
 			Key:        cred.RevocationKey,
@@ -218,67 +362,104 @@ func (session *sessionData) computeAttributes(
 			Issued:     issuedAt.UnixNano(),
 			ValidUntil: attributes.Expiry().UnixNano(),
 		}
-		err = conf.IrmaConfiguration.Revocation.SaveIssuanceRecord(id, issrecord, sk)
-		if err != nil {
-			return nil, nil, err
-		}
 	}
 
-	return attributes.Ints, witness, nil
+	return attributes.Ints, witness, issrecord, nil
 }
 
 func (s *Server) validateIssuanceRequest(request *irma.IssuanceRequest) error {
 	for _, cred := range request.Credentials {
 		// Check that we have the appropriate private key
-		iss := cred.CredentialTypeID.IssuerIdentifier()
-		privatekey, err := s.conf.IrmaConfiguration.PrivateKeys.Latest(iss)
+		counter, err := s.checkIssuerKeys(cred.CredentialTypeID.IssuerIdentifier())
 		if err != nil {
 			return err
 		}
-		if privatekey == nil {
-			return errors.Errorf("missing private key of issuer %s", iss.String())
-		}
-		pubkey, err := s.conf.IrmaConfiguration.PublicKey(iss, privatekey.Counter)
-		if err != nil {
+		cred.KeyCounter = counter
+
+		if err := s.checkRevocationConfiguration(cred); err != nil {
 			return err
 		}
-		if pubkey == nil {
-			return errors.Errorf("missing public key of issuer %s", iss.String())
-		}
-		now := time.Now()
-		if now.Unix() > pubkey.ExpiryDate {
-			return errors.Errorf("cannot issue using expired public key %s-%d", iss.String(), privatekey.Counter)
-		}
-		cred.KeyCounter = privatekey.Counter
 
-		if s.conf.IrmaConfiguration.CredentialTypes[cred.CredentialTypeID].RevocationSupported() {
-			settings := s.conf.RevocationSettings[cred.CredentialTypeID]
-			if settings == nil || (settings.RevocationServerURL == "" && !settings.Server) {
-				return errors.Errorf("revocation enabled for %s but no revocation server configured", cred.CredentialTypeID)
-			}
-			if cred.RevocationKey == "" {
-				return errors.Errorf("revocation enabled for %s but no revocationKey specified", cred.CredentialTypeID)
-			}
+		// Fill in default and derived attributes
+		if err := s.conf.IssuancePolicies.Apply(s.conf.IrmaConfiguration.Snapshot(), cred, s.conf.Logger); err != nil {
+			return err
 		}
 
 		// Check that the credential is consistent with irma_configuration
-		if err := cred.Validate(s.conf.IrmaConfiguration); err != nil {
+		if err := cred.Validate(s.conf.IrmaConfiguration.Snapshot()); err != nil {
 			return err
 		}
+		if s.conf.AttributeValidation != nil {
+			if err := s.conf.AttributeValidation.Apply(cred); err != nil {
+				return err
+			}
+		}
 
 		// Ensure the credential has an expiry date
-		defaultValidity := irma.Timestamp(time.Now().AddDate(0, 6, 0))
+		defaultValidity := irma.Timestamp(s.conf.Now().AddDate(0, 6, 0))
 		if cred.Validity == nil {
 			cred.Validity = &defaultValidity
 		}
-		if !AllowIssuingExpiredCredentials && cred.Validity.Before(irma.Timestamp(now)) {
-			return errors.New("cannot issue expired credentials")
+		if err := checkCredentialValidity(cred, s.conf.Now()); err != nil {
+			return err
 		}
 	}
 
 	return nil
 }
 
+// checkIssuerKeys checks that we have the private key of the issuer with which to issue and that
+// its public key is not expired, returning the counter of the private key.
+func (s *Server) checkIssuerKeys(iss irma.IssuerIdentifier) (uint, error) {
+	counter, err := s.checkPrivateKey(iss)
+	if err != nil {
+		return 0, err
+	}
+	return counter, s.checkPublicKey(iss, counter)
+}
+
+// checkPrivateKey returns the counter of the private key of the issuer with which to issue:
+// its latest private key, or its fallback key if the latest one expires soon.
+func (s *Server) checkPrivateKey(iss irma.IssuerIdentifier) (uint, error) {
+	return s.conf.IssuanceKeyCounter(iss)
+}
+
+func (s *Server) checkPublicKey(iss irma.IssuerIdentifier, counter uint) error {
+	pubkey, err := s.conf.IrmaConfiguration.Snapshot().PublicKey(iss, counter)
+	if err != nil {
+		return err
+	}
+	if pubkey == nil {
+		return errors.Errorf("missing public key of issuer %s", iss.String())
+	}
+	if s.conf.Now().Unix() > pubkey.ExpiryDate {
+		return errors.Errorf("cannot issue using expired public key %s-%d", iss.String(), counter)
+	}
+	return nil
+}
+
+func (s *Server) checkRevocationConfiguration(cred *irma.CredentialRequest) error {
+	credtype := s.conf.IrmaConfiguration.Snapshot().CredentialTypes[cred.CredentialTypeID]
+	if credtype == nil || !credtype.RevocationSupported() {
+		return nil
+	}
+	settings := s.conf.RevocationSettings[cred.CredentialTypeID]
+	if settings == nil || (settings.RevocationServerURL == "" && !settings.Server) {
+		return errors.Errorf("revocation enabled for %s but no revocation server configured", cred.CredentialTypeID)
+	}
+	if cred.RevocationKey == "" {
+		return errors.Errorf("revocation enabled for %s but no revocationKey specified", cred.CredentialTypeID)
+	}
+	return nil
+}
+
+func checkCredentialValidity(cred *irma.CredentialRequest, now time.Time) error {
+	if !AllowIssuingExpiredCredentials && cred.Validity != nil && cred.Validity.Before(irma.Timestamp(now)) {
+		return errors.New("cannot issue expired credentials")
+	}
+	return nil
+}
+
 func (session *sessionData) getProofP(commitments *irma.IssueCommitmentMessage, scheme irma.SchemeManagerIdentifier, conf *server.Configuration) (*gabi.ProofP, error) {
 	if session.KssProofs == nil {
 		session.KssProofs = make(map[irma.SchemeManagerIdentifier]*gabi.ProofP)
@@ -294,13 +475,9 @@ func (session *sessionData) getProofP(commitments *irma.IssueCommitmentMessage,
 			jwt.StandardClaims
 			ProofP *gabi.ProofP
 		}{}
-		token, err := jwt.ParseWithClaims(str, claims, conf.IrmaConfiguration.KeyshareServerKeyFunc(scheme))
-		if err != nil {
+		if err := conf.ParseKeyshareJWT(str, scheme, claims); err != nil {
 			return nil, err
 		}
-		if !token.Valid {
-			return nil, errors.Errorf("invalid keyshare proof included for scheme %s", scheme.Name())
-		}
 		session.KssProofs[scheme] = claims.ProofP
 	}
 
@@ -342,35 +519,122 @@ func (session *sessionData) getRequest() (irma.SessionRequest, error) {
 	return copy, nil
 }
 
-func (session *sessionData) hash() [32]byte {
+func (session *sessionData) hash() ([32]byte, error) {
 	// Note: This marshalling does not consider the order of the `map[irma.SchemeManagerIdentifier]*gabi.ProofP` items.
 	sessionJSON, err := json.Marshal(session)
 	if err != nil {
-		panic(err)
+		return [32]byte{}, errors.WrapPrefix(err, "failed to marshal session for hashing", 0)
 	}
 
-	return sha256.Sum256(sessionJSON)
+	return sha256.Sum256(sessionJSON), nil
 }
 
 func (session *sessionData) timeout(conf *server.Configuration) time.Duration {
 	maxSessionDuration := time.Duration(conf.MaxSessionLifetime) * time.Minute
 	if session.Status == irma.ServerStatusInitialized && session.Rrequest.Base().ClientTimeout != 0 {
 		maxSessionDuration = time.Duration(session.Rrequest.Base().ClientTimeout) * time.Second
+	} else if session.Status == irma.ServerStatusInitialized && session.Rrequest.Base().Offline {
+		maxSessionDuration = time.Duration(conf.OfflineSessionLifetime) * time.Minute
 	} else if session.Status.Finished() {
 		maxSessionDuration = 0
 	}
-	return maxSessionDuration - time.Since(session.LastActive)
+	return maxSessionDuration - conf.Now().Sub(session.LastActive)
 }
 
+// ttl returns how long the session is kept in the session store: until SessionResultLifetime after
+// it finished or timed out. It must be computed on the session as stored, i.e. before applyTimeout().
 func (session *sessionData) ttl(conf *server.Configuration) time.Duration {
 	return session.timeout(conf) + time.Duration(conf.SessionResultLifetime)*time.Minute
 }
 
+// expired returns whether the session may be deleted from the session store.
+func (session *sessionData) expired(conf *server.Configuration) bool {
+	return session.ttl(conf) <= 0
+}
+
+// timedOut returns whether the session has timed out without having finished.
+func (session *sessionData) timedOut(conf *server.Configuration) bool {
+	return !session.Status.Finished() && session.timeout(conf) <= 0
+}
+
+// applyTimeout sets the status of the session to timed out if it has timed out,
+// which executes the callback of the session.
+func (session *sessionData) applyTimeout(conf *server.Configuration) {
+	if session.timedOut(conf) {
+		if err := session.setStatus(irma.ServerStatusTimeout, conf); err != nil {
+			conf.Logger.WithError(err).Error("Failed to time out session")
+		}
+	}
+}
+
 func (session *sessionData) frontendSessionStatus() irma.FrontendSessionStatus {
-	return irma.FrontendSessionStatus{
+	status := irma.FrontendSessionStatus{
 		Status:      session.Status,
 		NextSession: session.Next,
+		BindingCode: session.Options.BindingCode,
+	}
+	if session.Status == irma.ServerStatusCancelled && session.Result != nil && session.Result.Err != nil {
+		status.Error = sessionErrorCategory(session.Result.Err)
 	}
+	return status
+}
+
+// reissuanceHints returns hints for the credentials disclosed in the proofs that are expired, or
+// that expire within Configuration.ReissuanceHintDays, so that the requestor can guide the user to
+// renew them. As the metadata of the proofs is only trustworthy if the proofs are valid, there are
+// no hints unless the proof status of the session is valid.
+func (session *sessionData) reissuanceHints(proofs gabi.ProofList, conf *server.Configuration) []*server.ReissuanceHint {
+	if session.Result.ProofStatus != irma.ProofStatusValid {
+		return nil
+	}
+	irmaconf := session.irmaConfiguration(conf)
+	now := conf.Now()
+	threshold := now.AddDate(0, 0, conf.ReissuanceHintDays)
+
+	var hints []*server.ReissuanceHint
+	hinted := map[irma.CredentialTypeIdentifier]bool{}
+	for _, proof := range proofs {
+		proofd, ok := proof.(*gabi.ProofD)
+		if !ok || proofd.ADisclosed[1] == nil {
+			continue
+		}
+		metadata := irma.MetadataFromInt(proofd.ADisclosed[1], irmaconf) // index 1 is metadata attribute
+		credtype := metadata.CredentialType()
+		if credtype == nil || !metadata.Expiry().Before(threshold) || hinted[credtype.Identifier()] {
+			continue
+		}
+		hinted[credtype.Identifier()] = true
+		hints = append(hints, &server.ReissuanceHint{
+			Credential: credtype.Identifier(),
+			Expiry:     irma.Timestamp(metadata.Expiry()),
+			Expired:    metadata.Expiry().Before(now),
+			IssueURL:   credtype.IssueURL,
+		})
+	}
+	return hints
+}
+
+// sessionErrorCategories maps the codes of the errors with which sessions can be cancelled to
+// the categories shown to the frontend; other errors are categorized as server errors.
+var sessionErrorCategories = map[irma.RemoteErrorCode]irma.SessionErrorCategory{
+	irma.ErrorCodeAttributesExpired:    irma.SessionErrorAttributesExpired,
+	irma.ErrorCodeAttributesMissing:    irma.SessionErrorAttributesMissing,
+	irma.ErrorCodeInvalidProofs:        irma.SessionErrorInvalidProofs,
+	irma.ErrorCodeUnknownPublicKey:     irma.SessionErrorInvalidProofs,
+	irma.ErrorCodeKeyshareProofMissing: irma.SessionErrorInvalidProofs,
+	irma.ErrorCodeProtocolVersion:      irma.SessionErrorClientUnsupported,
+	irma.ErrorCodeIrmaUnauthorized:     irma.SessionErrorClient,
+	irma.ErrorCodeMalformedInput:       irma.SessionErrorClient,
+	irma.ErrorCodeUnexpectedRequest:    irma.SessionErrorClient,
+}
+
+// sessionErrorCategory returns the category of the error shown to the frontend, which unlike the
+// error itself does not reveal e.g. the attributes involved or details of the server.
+func sessionErrorCategory(err *irma.RemoteError) irma.SessionErrorCategory {
+	if category, ok := sessionErrorCategories[err.Code]; ok {
+		return category
+	}
+	return irma.SessionErrorServer
 }
 
 // UnmarshalJSON unmarshals sessionData.
@@ -392,27 +656,81 @@ func (session *sessionData) UnmarshalJSON(data []byte) error {
 
 	*session = sessionData(temp.rawSession)
 
-	// unmarshal Rrequest
-	switch session.Action {
-	case "issuing":
-		session.Rrequest = &irma.IdentityProviderRequest{}
-	case "disclosing":
-		session.Rrequest = &irma.ServiceProviderRequest{}
-	case "signing":
-		session.Rrequest = &irma.SignatureRequestorRequest{}
+	// unmarshal Rrequest into the type registered for the action of the session
+	rrequest, err := irma.NewRequestorRequest(session.Action)
+	if err != nil {
+		// Sessions of actions without requestor request type (e.g. redirect) carry no request
+		if bytes.Equal(temp.Rrequest, []byte("null")) {
+			return nil
+		}
+		return err
 	}
-
-	return json.Unmarshal(temp.Rrequest, session.Rrequest)
+	if err = json.Unmarshal(temp.Rrequest, rrequest); err != nil {
+		return err
+	}
+	session.Rrequest = rrequest
+	return nil
 }
 
 // Other
 
+// validateAirGappedRequest checks that the session request requires no outbound network access.
+func validateAirGappedRequest(request irma.RequestorRequest) error {
+	base := request.Base()
+	switch {
+	case base.CallbackURL != "":
+		return errors.New("callbackUrl cannot be used in air-gapped mode, as it requires outbound network access")
+	case base.NextSession != nil && base.NextSession.URL != "":
+		return errors.New("nextSession cannot be used in air-gapped mode, as it requires outbound network access")
+	}
+	return nil
+}
+
+// credentialTypeWarnings returns warnings about the deprecated credential types that the request
+// involves, or an error if it involves credential types whose sunset date has passed, unless they
+// are allowed by AllowSunsetCredentials.
+func (s *Server) credentialTypeWarnings(request irma.SessionRequest) ([]string, error) {
+	conf := s.conf.IrmaConfiguration.Snapshot()
+	now := s.conf.Now()
+	var ids []irma.CredentialTypeIdentifier
+	for id := range request.Identifiers().CredentialTypes {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+
+	var warnings []string
+	for _, id := range ids {
+		typ := conf.CredentialTypes[id]
+		if typ == nil || !typ.IsDeprecated(now) {
+			continue
+		}
+		var replacement string
+		if typ.ReplacedBy != nil {
+			replacement = ", use " + typ.ReplacedBy.String() + " instead"
+		}
+		if typ.IsSunset(now) {
+			warning := fmt.Sprintf("credential type %s was sunset at %s%s", id, time.Time(typ.SunsetDate).Format(time.RFC3339), replacement)
+			if !slices.Contains(s.conf.AllowSunsetCredentials, id) {
+				return nil, errors.New(warning)
+			}
+			warnings = append(warnings, warning)
+			continue
+		}
+		warning := fmt.Sprintf("credential type %s is deprecated", id)
+		if !typ.SunsetDate.IsZero() {
+			warning += " and will be sunset at " + time.Time(typ.SunsetDate).Format(time.RFC3339)
+		}
+		warnings = append(warnings, warning+replacement)
+	}
+	return warnings, nil
+}
+
 func (s *Server) validateRequest(request irma.SessionRequest) error {
 	if _, err := s.conf.IrmaConfiguration.Download(request); err != nil {
 		return err
 	}
 	base := request.Base()
-	if err := base.Validate(s.conf.IrmaConfiguration); err != nil {
+	if err := base.Validate(s.conf.IrmaConfiguration.Snapshot()); err != nil {
 		return err
 	}
 	if base.AugmentReturnURL {
@@ -423,7 +741,85 @@ func (s *Server) validateRequest(request irma.SessionRequest) error {
 			return errors.New("cannot augment empty client return url")
 		}
 	}
-	return request.Disclosure().Disclose.Validate(s.conf.IrmaConfiguration)
+	if s.conf.RequireKeyproofs {
+		// The keyproofs are verified at startup, and those of keys added later in the background
+		for issuer := range request.Identifiers().Issuers {
+			if err := s.conf.IrmaConfiguration.VerifiedIssuerKeyproofs(issuer); err != nil {
+				return err
+			}
+		}
+	}
+	return request.Disclosure().Disclose.Validate(s.conf.IrmaConfiguration.Snapshot())
+}
+
+// validateRequestInSessionPtr checks that the request of a session can be included in its session
+// pointer, so that the IRMA app can compute the disclosure without first retrieving the request
+// (e.g. because it is offline), i.e. that the IRMA app does not need anything else from the server
+// before the disclosure is posted.
+func (s *Server) validateRequestInSessionPtr(rrequest irma.RequestorRequest) error {
+	request := rrequest.SessionRequest()
+	if request.Action() != irma.ActionDisclosing {
+		return errors.New("only the request of disclosure sessions can be included in the session pointer")
+	}
+	if len(request.Base().Revocation) > 0 {
+		return errors.New("nonrevocation proofs cannot be required if the request is included in the session pointer")
+	}
+	if rrequest.Base().NextSession != nil {
+		return errors.New("sessions with the request in the session pointer cannot be chained")
+	}
+	if rrequest.Base().BindingCode {
+		return errors.New("sessions with the request in the session pointer cannot have a binding code")
+	}
+	if s.pairingRequired(rrequest) {
+		return errors.New("sessions with the request in the session pointer cannot require pairing")
+	}
+	if rrequest.Base().CompactSessionPtr && s.conf.JwtSigningKey() == nil {
+		return errors.New("compact session pointers require a JWT private key to sign them with")
+	}
+	if rrequest.Base().CompactSessionPtr && len(rrequest.SessionRequest().Base().Revocation) > 0 {
+		return errors.New("compact session pointers cannot contain requests for nonrevocation proofs")
+	}
+	return nil
+}
+
+// validateMdocRequest checks that the attributes of a session in which mdoc presentation is enabled
+// can be disclosed by presenting mdocs, and that the session needs nothing that mdoc readers lack.
+func (s *Server) validateMdocRequest(rrequest irma.RequestorRequest) error {
+	request := rrequest.SessionRequest()
+	if request.Action() != irma.ActionDisclosing {
+		return errors.New("mdocs can only be presented in disclosure sessions")
+	}
+	if len(request.Base().Revocation) > 0 {
+		return errors.New("nonrevocation proofs cannot be required in sessions in which mdocs can be presented")
+	}
+	if rrequest.Base().NextSession != nil {
+		return errors.New("sessions in which mdocs can be presented cannot be chained")
+	}
+	if s.pairingRequired(rrequest) {
+		return errors.New("sessions in which mdocs can be presented cannot require pairing")
+	}
+	if _, ok := s.conf.MdocMapping.ItemsRequests(request.Disclosure().Disclose); !ok {
+		return errors.New("requested attributes cannot be presented as mdocs: not all are mapped to mdoc data elements")
+	}
+	return nil
+}
+
+// unmarshal unmarshals and validates a JSON message received at the specified endpoint,
+// refusing unknown fields if strict JSON parsing is enabled for the endpoint.
+func (s *Server) unmarshal(endpoint string, bts []byte, dest interface{}) error {
+	if s.conf.StrictJSONEnabled(endpoint) {
+		return irma.UnmarshalValidateStrict(bts, dest)
+	}
+	return irma.UnmarshalValidate(bts, dest)
+}
+
+// parseSessionRequest parses a session request of a requestor, see server.ParseSessionRequest(),
+// refusing unknown fields if strict JSON parsing is enabled for session requests.
+func parseSessionRequest(conf *server.Configuration, req interface{}) (irma.RequestorRequest, error) {
+	if conf.StrictJSONEnabled(server.StrictJSONSessionRequests) {
+		return server.ParseSessionRequestStrict(req)
+	}
+	return server.ParseSessionRequest(req)
 }
 
 func copyObject[T any](object T, copy T) error {
@@ -438,15 +834,19 @@ func copyObject[T any](object T, copy T) error {
 }
 
 func copyInterface(i interface{}) (interface{}, error) {
-	copy := reflect.New(reflect.TypeOf(i).Elem()).Interface()
+	typ := reflect.TypeOf(i)
+	if typ == nil || typ.Kind() != reflect.Pointer || reflect.ValueOf(i).IsNil() {
+		return nil, errors.Errorf("cannot copy %T: not a non-nil pointer", i)
+	}
+	copy := reflect.New(typ.Elem()).Interface()
 	if err := copyObject(i, copy); err != nil {
 		return nil, err
 	}
 	return copy, nil
 }
 
-// purgeRequest logs the request excluding any attribute values.
-func purgeRequest(request irma.RequestorRequest) irma.RequestorRequest {
+// purgeRequest returns a copy of the request excluding any attribute values, for logging.
+func purgeRequest(request irma.RequestorRequest) (irma.RequestorRequest, error) {
 	// We want to log as much as possible of the request, but no attribute values.
 	// We cannot just remove them from the request parameter as that would break the calling code.
 	// So we create a deep copy of the request from which we can then safely remove whatever we want to.
@@ -455,11 +855,18 @@ func purgeRequest(request irma.RequestorRequest) irma.RequestorRequest {
 	// of the same type as request, into which we then unmarshal our copy.
 	cpy, err := copyInterface(request)
 	if err != nil {
-		panic(err)
+		return nil, errors.WrapPrefix(err, "failed to copy request for purging", 0)
+	}
+	purged, ok := cpy.(irma.RequestorRequest)
+	if !ok {
+		return nil, errors.Errorf("failed to copy request for purging: %T is not a requestor request", cpy)
+	}
+	if sr := purged.SessionRequest(); sr == nil || reflect.ValueOf(sr).IsNil() {
+		return nil, errors.New("failed to purge request: no session request")
 	}
 
 	// Remove required attribute values from any attributes to be disclosed
-	_ = cpy.(irma.RequestorRequest).SessionRequest().Disclosure().Disclose.Iterate(
+	_ = purged.SessionRequest().Disclosure().Disclose.Iterate(
 		func(attr *irma.AttributeRequest) error {
 			attr.Value = nil
 			return nil
@@ -467,13 +874,13 @@ func purgeRequest(request irma.RequestorRequest) irma.RequestorRequest {
 	)
 
 	// Remove attribute values from attributes to be issued
-	if isreq, ok := cpy.(*irma.IdentityProviderRequest); ok {
+	if isreq, ok := purged.(*irma.IdentityProviderRequest); ok {
 		for _, cred := range isreq.Request.Credentials {
 			cred.Attributes = nil
 		}
 	}
 
-	return cpy.(irma.RequestorRequest)
+	return purged, nil
 }
 
 func eventServer(conf *server.Configuration) *sse.Server {
@@ -509,6 +916,30 @@ func errorWriter(err *irma.RemoteError, writer func(w http.ResponseWriter, objec
 	}
 }
 
+// pathPrefixMiddleware routes requests whose path starts with the PathPrefix of the configuration
+// as if the prefix were absent, so that our routers work both when the prefix is stripped before the
+// requests reach us (e.g. by an ingress, or by chi's Mount()) and when it is not.
+func (s *Server) pathPrefixMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rctx := chi.RouteContext(r.Context())
+		if rctx == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		path := rctx.RoutePath
+		if path == "" {
+			path = r.URL.RawPath
+		}
+		if path == "" {
+			path = r.URL.Path
+		}
+		if strings.HasPrefix(path, s.conf.PathPrefix) {
+			rctx.RoutePath = "/" + strings.TrimPrefix(path, s.conf.PathPrefix)
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (s *Server) frontendMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		session := r.Context().Value("session").(*sessionData)
@@ -522,6 +953,54 @@ func (s *Server) frontendMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// requestLock serializes the requests of a session (see requestLockMiddleware).
+type requestLock struct {
+	sync.Mutex
+	users int
+}
+
+// requestLockMiddleware handles the requests of each session, except for server-sent events, one
+// at a time. Without it, a retry of a request that is still being handled would not find the cached
+// response of that request (see cacheMiddleware), so that the response would be computed twice,
+// e.g. issuing the credentials of an issuance session twice. If multiple servers share a Redis
+// session store, then retries handled by different servers can still be computed twice, but the
+// session store ensures that only one of them updates the session.
+func (s *Server) requestLockMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, "/statusevents") {
+			next.ServeHTTP(w, r)
+			return
+		}
+		unlock := s.lockRequests(irma.ClientToken(chi.URLParam(r, "clientToken")))
+		defer unlock()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// lockRequests acquires the request lock of the specified session, and returns a function
+// releasing it.
+func (s *Server) lockRequests(token irma.ClientToken) func() {
+	s.requestLocksMutex.Lock()
+	lock := s.requestLocks[token]
+	if lock == nil {
+		lock = &requestLock{}
+		s.requestLocks[token] = lock
+	}
+	lock.users++
+	s.requestLocksMutex.Unlock()
+
+	lock.Lock()
+	return func() {
+		lock.Unlock()
+		s.requestLocksMutex.Lock()
+		defer s.requestLocksMutex.Unlock()
+		lock.users--
+		if lock.users == 0 {
+			delete(s.requestLocks, token)
+		}
+	}
+}
+
 func (s *Server) cacheMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		session := r.Context().Value("session").(*sessionData)
@@ -535,8 +1014,15 @@ func (s *Server) cacheMiddleware(next http.Handler) http.Handler {
 		r.Body = io.NopCloser(bytes.NewBuffer(message))
 
 		// if a cache is set and applicable, return it
-		status, output := session.checkCache(r.URL.Path, message)
+		status, output := session.checkCache(r.URL.Path, message, s.conf)
 		if status > 0 && len(output) > 0 {
+			// The client did not receive the authorization to use after the cached request. This is sent
+			// only once, and only to a retry presenting the same authorization as the cached request.
+			auth := irma.ClientAuthorization(r.Header.Get(irma.AuthorizationHeader))
+			if session.ResponseCache.NextAuth != "" && auth == session.ResponseCache.Auth {
+				w.Header().Set(irma.NextAuthorizationHeader, string(session.ResponseCache.NextAuth))
+				session.ResponseCache.NextAuth = ""
+			}
 			w.WriteHeader(status)
 			_, _ = w.Write(output)
 			return
@@ -555,6 +1041,10 @@ func (s *Server) cacheMiddleware(next http.Handler) http.Handler {
 			Status:        ww.Status(),
 			SessionStatus: session.Status,
 		}
+		if next := ww.Header().Get(irma.NextAuthorizationHeader); next != "" {
+			session.ResponseCache.Auth = irma.ClientAuthorization(r.Header.Get(irma.AuthorizationHeader))
+			session.ResponseCache.NextAuth = irma.ClientAuthorization(next)
+		}
 	})
 }
 
@@ -569,14 +1059,29 @@ func (s *Server) sessionMiddleware(next http.Handler) http.Handler {
 		recorder := server.NewHTTPResponseRecorder(w)
 		if err := s.sessions.clientTransaction(r.Context(), token, func(session *sessionData) (bool, error) {
 			expectedHost := session.Rrequest.SessionRequest().Base().Host
-			if expectedHost != "" && expectedHost != r.Host {
+			if expectedHost != "" && expectedHost != s.conf.RequestHost(r) {
 				server.WriteError(recorder, server.ErrorUnauthorized, "Host mismatch")
 				return false, nil
 			}
 
-			hashBefore := session.hash()
+			hashBefore, err := session.hash()
+			if err != nil {
+				return false, err
+			}
+			statusBefore := session.Status
 			next.ServeHTTP(recorder, r.WithContext(context.WithValue(r.Context(), "session", session)))
-			hashAfter := session.hash()
+			if endpoint := historyEndpoint(r); endpoint != "" && !recorder.Flushed {
+				session.recordEvent(server.SessionEvent{
+					Endpoint:   endpoint,
+					HTTPStatus: recorder.StatusCode(),
+					PrevStatus: statusBefore,
+					Status:     session.Status,
+				}, s.conf)
+			}
+			hashAfter, err := session.hash()
+			if err != nil {
+				return false, err
+			}
 			sessionUpdated := hashBefore != hashAfter
 
 			// SSE bypasses the middleware and flushes the response writer directly.
@@ -628,15 +1133,45 @@ func (s *Server) pairingMiddleware(next http.Handler) http.Handler {
 			return
 		}
 		clientAuth := irma.ClientAuthorization(r.Header.Get(irma.AuthorizationHeader))
-		if session.ClientAuth != clientAuth {
+		if session.ClientAuth != clientAuth || !session.checkTLSBinding(r) {
 			server.WriteError(w, server.ErrorIrmaUnauthorized, "")
 			return
 		}
+		if err := session.rotateClientAuth(w, s.conf); err != nil {
+			s.conf.Logger.WithError(err).Error("Failed to rotate client authorization")
+			server.WriteError(w, server.ErrorInternal, "")
+			return
+		}
 
 		next.ServeHTTP(w, r)
 	})
 }
 
+// rotateClientAuth replaces the authorization of the IRMA app, if it supports authorization rotation,
+// by a new one that is sent to the app in the response, and that it must use in its next request.
+func (session *sessionData) rotateClientAuth(w http.ResponseWriter, conf *server.Configuration) error {
+	if !session.RotateClientAuth {
+		return nil
+	}
+	auth, err := common.NewSessionTokenFrom(conf.Rand())
+	if err != nil {
+		return err
+	}
+	session.ClientAuth = irma.ClientAuthorization(auth)
+	w.Header().Set(irma.NextAuthorizationHeader, string(session.ClientAuth))
+	return nil
+}
+
+// checkTLSBinding checks that the request is sent over a TLS connection that is signed by the key
+// to which the IRMA app bound its authorization, if it did so.
+func (session *sessionData) checkTLSBinding(r *http.Request) bool {
+	if session.TLSBindingKey == nil {
+		return true
+	}
+	key, err := irma.VerifyTLSBinding(r.Header.Get(irma.TLSBindingHeader), r.TLS)
+	return err == nil && bytes.Equal(key, session.TLSBindingKey)
+}
+
 func (s *Server) serverSentEventsHandler(initialSession *sessionData, updateChan chan *sessionData) {
 	timeoutTime := time.Now().Add(initialSession.timeout(s.conf))
 
@@ -714,6 +1249,7 @@ func (s *Server) sessionStatusChannel(ctx context.Context, token irma.RequestorT
 	statusChan := make(chan irma.ServerStatus, 4)
 	timeoutTime := time.Now().Add(initialTimeout)
 	go func() {
+		defer server.RecoverPanic("session status")
 		defer cancel()
 
 		var currStatus irma.ServerStatus
@@ -751,13 +1287,24 @@ func (s *Server) newSession(
 	ctx context.Context,
 	action irma.Action,
 	request irma.RequestorRequest,
+	requestor string,
 	disclosed irma.AttributeConDisCon,
 	frontendAuth irma.FrontendAuthorization,
 ) (*sessionData, error) {
-	clientToken := irma.ClientToken(common.NewSessionToken())
-	requestorToken := irma.RequestorToken(common.NewSessionToken())
+	token, err := common.NewSessionTokenFrom(s.conf.Rand())
+	if err != nil {
+		return nil, err
+	}
+	clientToken := irma.ClientToken(token)
+	if token, err = common.NewSessionTokenFrom(s.conf.Rand()); err != nil {
+		return nil, err
+	}
+	requestorToken := irma.RequestorToken(token)
 	if len(frontendAuth) == 0 {
-		frontendAuth = irma.FrontendAuthorization(common.NewSessionToken())
+		if token, err = common.NewSessionTokenFrom(s.conf.Rand()); err != nil {
+			return nil, err
+		}
+		frontendAuth = irma.FrontendAuthorization(token)
 	}
 
 	base := request.SessionRequest().Base()
@@ -770,17 +1317,21 @@ func (s *Server) newSession(
 	}
 
 	ses := &sessionData{
-		Action:         action,
-		Rrequest:       request,
-		LastActive:     time.Now(),
-		RequestorToken: requestorToken,
-		ClientToken:    clientToken,
-		Status:         irma.ServerStatusInitialized,
+		Action:          action,
+		Rrequest:        request,
+		Requestor:       requestor,
+		Created:         s.conf.Now(),
+		LastActive:      s.conf.Now(),
+		RequestorToken:  requestorToken,
+		ClientToken:     clientToken,
+		Status:          irma.ServerStatusInitialized,
+		SchemesSnapshot: s.conf.IrmaConfiguration.SnapshotID(),
 		Result: &server.SessionResult{
 			LegacySession: request.SessionRequest().Base().Legacy(),
 			Token:         requestorToken,
 			Type:          action,
 			Status:        irma.ServerStatusInitialized,
+			Purpose:       request.Base().Purpose,
 		},
 		Options: irma.SessionOptions{
 			LDContext:     irma.LDContextSessionOptions,
@@ -789,13 +1340,36 @@ func (s *Server) newSession(
 		FrontendAuth:       frontendAuth,
 		ImplicitDisclosure: disclosed,
 	}
+	if request.Base().BindingCode {
+		if ses.Options.BindingCode, err = common.NewBindingCodeFrom(s.conf.Rand()); err != nil {
+			return nil, err
+		}
+	}
+	if s.pairingRequired(request) {
+		ses.Options.PairingMethod = irma.PairingMethodPin
+		if ses.Options.PairingCode, err = common.NewPairingCodeFrom(s.conf.Rand()); err != nil {
+			return nil, err
+		}
+		ses.Options.PairingRequired = true
+	}
+	ses.Options.Features = s.sessionFeatures(request, ses.Options)
+	if sigrequest, ok := request.SessionRequest().(*irma.SignatureRequest); ok {
+		ses.Result.Message = sigrequest.Message
+	}
+	// Sessions involving credential types that are sunset are refused in startNextSession()
+	if warnings, _ := s.credentialTypeWarnings(request.SessionRequest()); len(warnings) > 0 {
+		ses.Result.Warnings = warnings
+		s.conf.Logger.WithFields(logrus.Fields{"session": requestorToken, "action": action}).
+			Warn("Session involves deprecated credential types: ", strings.Join(warnings, "; "))
+	}
 
+	ses.requestID = server.RequestID(ctx)
+	ses.recordEvent(server.SessionEvent{Status: irma.ServerStatusInitialized}, s.conf)
 	s.conf.Logger.WithFields(logrus.Fields{"session": ses.RequestorToken}).Debug("New session started")
-	nonce, _ := gabi.GenerateNonce()
-	base.Nonce = nonce
+	base.Nonce = common.NewNonce(s.conf.Rand())
 	base.Context = one
 
-	err := s.sessions.add(ctx, ses)
+	err = s.sessions.add(ctx, ses)
 	if err != nil {
 		return nil, err
 	}
@@ -2,22 +2,341 @@ package irmaserver
 
 import (
 	"encoding/json"
+	"errors"
+	mathrand "math/rand"
 	"testing"
+	"testing/iotest"
+	"time"
 
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/stretchr/testify/require"
 )
 
+const (
+	testDisclosureRequest = `{"request":{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"MtILupG0g0J23GNR1YtupQ==","devMode":true,"disclose":[[[{"type":"test.test.email.email","value":"example@example.com"}]]]}}`
+	testIssuanceRequest   = `{"request":{"@context":"https://irma.app/ld/request/issuance/v2","context":"AQ==","nonce":"wrmq+QY8r86nbGTI+mMAzg==","devMode":true,"credentials":[{"validity":2000000000,"keyCounter":2,"credential":"irma-demo.RU.studentCard","attributes":{"level":"42","studentCardNumber":"31415927","studentID":"s1234567","university":"Radboud"}}],"disclose":[[[{"type":"test.test.email.email","value":"example@example.com"}]]]}}`
+	testSignatureRequest  = `{"request":{"@context":"https://irma.app/ld/request/signature/v2","context":"AQ==","nonce":"MtILupG0g0J23GNR1YtupQ==","devMode":true,"message":"message to be signed","disclose":[[["irma-demo.MijnOverheid.ageLimits.over18"]]]}}`
+)
+
 func TestAnonimizeRequest(t *testing.T) {
-	req, err := server.ParseSessionRequest(`{"request":{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"MtILupG0g0J23GNR1YtupQ==","devMode":true,"disclose":[[[{"type":"test.test.email.email","value":"example@example.com"}]]]}}`)
+	req, err := server.ParseSessionRequest(testDisclosureRequest)
 	require.NoError(t, err)
-	out, err := json.Marshal(purgeRequest(req))
+	purged, err := purgeRequest(req)
+	require.NoError(t, err)
+	out, err := json.Marshal(purged)
 	require.NoError(t, err)
 	require.Equal(t, `{"validity":120,"request":{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"MtILupG0g0J23GNR1YtupQ==","devMode":true,"disclose":[[["test.test.email.email"]]]}}`, string(out))
 
-	req, err = server.ParseSessionRequest(`{"request":{"@context":"https://irma.app/ld/request/issuance/v2","context":"AQ==","nonce":"wrmq+QY8r86nbGTI+mMAzg==","devMode":true,"credentials":[{"validity":2000000000,"keyCounter":2,"credential":"irma-demo.RU.studentCard","attributes":{"level":"42","studentCardNumber":"31415927","studentID":"s1234567","university":"Radboud"}}],"disclose":[[[{"type":"test.test.email.email","value":"example@example.com"}]]]}}`)
+	req, err = server.ParseSessionRequest(testIssuanceRequest)
+	require.NoError(t, err)
+	purged, err = purgeRequest(req)
 	require.NoError(t, err)
-	out, err = json.Marshal(purgeRequest(req))
+	out, err = json.Marshal(purged)
 	require.NoError(t, err)
 	require.Equal(t, `{"validity":120,"request":{"@context":"https://irma.app/ld/request/issuance/v2","context":"AQ==","nonce":"wrmq+QY8r86nbGTI+mMAzg==","devMode":true,"disclose":[[["test.test.email.email"]]],"credentials":[{"validity":2000000000,"keyCounter":2,"credential":"irma-demo.RU.studentCard","attributes":null}]}}`, string(out))
+
+	// Requests lacking a session request are refused instead of causing a panic
+	_, err = purgeRequest(nil)
+	require.Error(t, err)
+	_, err = purgeRequest((*irma.ServiceProviderRequest)(nil))
+	require.Error(t, err)
+	_, err = purgeRequest(&irma.ServiceProviderRequest{})
+	require.Error(t, err)
+}
+
+func TestSessionDataRoundTrip(t *testing.T) {
+	for _, input := range []string{testDisclosureRequest, testSignatureRequest, testIssuanceRequest} {
+		req, err := server.ParseSessionRequest(input)
+		require.NoError(t, err)
+		session := &sessionData{
+			Action:         req.SessionRequest().Action(),
+			RequestorToken: "token",
+			ClientToken:    "clienttoken",
+			Version:        irma.NewVersion(2, 8),
+			Rrequest:       req,
+			Status:         irma.ServerStatusConnected,
+			Result:         &server.SessionResult{Token: "token", Status: irma.ServerStatusConnected},
+		}
+		bts, err := json.Marshal(session)
+		require.NoError(t, err)
+
+		parsed := &sessionData{}
+		require.NoError(t, json.Unmarshal(bts, parsed))
+		require.IsType(t, req, parsed.Rrequest)
+		again, err := json.Marshal(parsed)
+		require.NoError(t, err)
+		require.JSONEq(t, string(bts), string(again))
+	}
+
+	// Sessions of actions without requestor request type round-trip if they carry no request
+	for _, action := range []irma.Action{irma.ActionRedirect, irma.ActionRevoking} {
+		session := &sessionData{Action: action, RequestorToken: "token", Status: irma.ServerStatusDone}
+		bts, err := json.Marshal(session)
+		require.NoError(t, err)
+		parsed := &sessionData{}
+		require.NoError(t, json.Unmarshal(bts, parsed))
+		require.Equal(t, session, parsed)
+
+		require.Error(t, json.Unmarshal([]byte(`{"Action":"`+string(action)+`","Rrequest":{}}`), &sessionData{}))
+	}
+}
+
+func FuzzPurgeRequest(f *testing.F) {
+	f.Add(testDisclosureRequest)
+	f.Add(testIssuanceRequest)
+	f.Fuzz(func(t *testing.T, input string) {
+		req, err := server.ParseSessionRequest(input)
+		if err != nil {
+			return
+		}
+		purged, err := purgeRequest(req)
+		if err != nil {
+			return
+		}
+		_ = purged.SessionRequest().Disclosure().Disclose.Iterate(func(attr *irma.AttributeRequest) error {
+			require.Nil(t, attr.Value)
+			return nil
+		})
+		_, err = json.Marshal(purged)
+		require.NoError(t, err)
+	})
+}
+
+func FuzzSessionDataHash(f *testing.F) {
+	f.Add(testDisclosureRequest)
+	f.Add(testIssuanceRequest)
+	f.Fuzz(func(t *testing.T, input string) {
+		req, err := server.ParseSessionRequest(input)
+		if err != nil {
+			return
+		}
+		session := &sessionData{Rrequest: req, Result: &server.SessionResult{}}
+		hash, err := session.hash()
+		if err != nil {
+			return
+		}
+		again, err := session.hash()
+		require.NoError(t, err)
+		require.Equal(t, hash, again)
+	})
+}
+
+func FuzzSessionDataUnmarshalJSON(f *testing.F) {
+	for _, input := range []string{testDisclosureRequest, testSignatureRequest, testIssuanceRequest} {
+		req, err := server.ParseSessionRequest(input)
+		require.NoError(f, err)
+		session := &sessionData{
+			Action:         req.SessionRequest().Action(),
+			RequestorToken: "token",
+			ClientToken:    "clienttoken",
+			Version:        irma.NewVersion(2, 8),
+			Rrequest:       req,
+			Status:         irma.ServerStatusConnected,
+			Result:         &server.SessionResult{Token: "token", Status: irma.ServerStatusConnected},
+		}
+		bts, err := json.Marshal(session)
+		require.NoError(f, err)
+		f.Add(bts)
+	}
+	f.Add([]byte(`{"Action":"redirect","Rrequest":{}}`))
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		session := &sessionData{}
+		if err := json.Unmarshal(data, session); err != nil {
+			return
+		}
+		_, err := session.hash()
+		require.NoError(t, err)
+	})
+}
+
+func TestReissuanceHints(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	conf := sessionsConf(t)
+	conf.Clock = clock
+	conf.ReissuanceHintDays = 7
+	require.NoError(t, conf.Check())
+	session := &sessionData{Result: &server.SessionResult{ProofStatus: irma.ProofStatusValid}}
+
+	proof := func(credtype string, attributes map[string]string, validity time.Duration) *gabi.ProofD {
+		expiry := irma.Timestamp(clock.Now().Add(validity))
+		req := &irma.CredentialRequest{
+			CredentialTypeID: irma.NewCredentialTypeIdentifier(credtype),
+			Validity:         &expiry,
+			Attributes:       attributes,
+		}
+		list, err := req.AttributeList(conf.IrmaConfiguration, 0x03, nil, clock.Now())
+		require.NoError(t, err)
+		return &gabi.ProofD{ADisclosed: map[int]*big.Int{1: list.Ints[0]}}
+	}
+	proofs := gabi.ProofList{
+		proof("irma-demo.RU.studentCard", map[string]string{"university": "Radboud", "studentCardNumber": "31415927", "studentID": "s1234567", "level": "42"}, 8*24*time.Hour),
+		proof("test.test.email", map[string]string{"email": "example@example.com"}, 365*24*time.Hour),
+	}
+
+	// Credentials expiring within ReissuanceHintDays are hinted at
+	hints := session.reissuanceHints(proofs, conf)
+	require.Len(t, hints, 1)
+	require.Equal(t, irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard"), hints[0].Credential)
+	require.False(t, hints[0].Expired)
+	require.NotNil(t, hints[0].IssueURL)
+
+	// Expired credentials are hinted at as such
+	clock.advance(10 * 24 * time.Hour)
+	hints = session.reissuanceHints(proofs, conf)
+	require.Len(t, hints, 1)
+	require.True(t, hints[0].Expired)
+
+	// Proofs that are not valid are not hinted at
+	for _, status := range []irma.ProofStatus{irma.ProofStatusExpired, irma.ProofStatusInvalid} {
+		session.Result.ProofStatus = status
+		require.Empty(t, session.reissuanceHints(proofs, conf))
+	}
+	session.Result.ProofStatus = irma.ProofStatusValid
+
+	conf.ReissuanceHintDays = 0
+	clock.advance(-9 * 24 * time.Hour)
+	require.Empty(t, session.reissuanceHints(proofs, conf))
+}
+
+func TestAirGapped(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.AirGapped = true
+	conf.Email = "admin@example.com"
+	_, err := New(conf)
+	require.ErrorContains(t, err, "air-gapped")
+
+	conf = sessionsConf(t)
+	conf.AirGapped = true
+	s := newTestServer(t, conf)
+	require.True(t, conf.DisableSchemesUpdate)
+
+	disclose := studentIDRequest()
+	_, _, _, err = s.StartSession(disclose, nil)
+	require.NoError(t, err)
+
+	for _, base := range []irma.RequestorBaseRequest{
+		{CallbackURL: "http://localhost/callback"},
+		{NextSession: &irma.NextSessionData{URL: "http://localhost/next"}},
+	} {
+		_, _, _, err = s.StartSession(&irma.ServiceProviderRequest{Request: disclose, RequestorBaseRequest: base}, nil)
+		require.ErrorContains(t, err, "air-gapped mode")
+	}
+
+	// Outbound requests of the server and of its IRMA configuration are refused centrally
+	err = conf.HTTPClient().NewTransport("http://localhost/", false).Get("", nil)
+	require.ErrorIs(t, err, irma.ErrOutboundDisabled)
+	err = conf.IrmaConfiguration.HTTPClient.NewTransport("http://localhost/", false).Get("", nil)
+	require.ErrorIs(t, err, irma.ErrOutboundDisabled)
+}
+
+func TestRequireKeyproofs(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.RequireKeyproofs = true
+	s := newTestServer(t, conf)
+
+	// The test schemes contain no keyproofs
+	_, _, _, err := s.StartSession(studentIDRequest(), nil)
+	require.ErrorIs(t, err, irma.ErrKeyproofMissing)
+}
+
+func TestDeprecatedCredentialTypes(t *testing.T) {
+	conf := sessionsConf(t)
+	s := newTestServer(t, conf)
+
+	id := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	replacement := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.root")
+	credtype := conf.IrmaConfiguration.CredentialTypes[id]
+	now := time.Now()
+	credtype.DeprecatedSince = irma.Timestamp(now.Add(-time.Hour))
+	credtype.SunsetDate = irma.Timestamp(now.Add(time.Hour))
+	credtype.ReplacedBy = &replacement
+	require.True(t, credtype.IsDeprecated(now))
+	require.False(t, credtype.IsSunset(now))
+
+	// Deprecated credential types can still be used, with warnings in the session result
+	disclose := studentIDRequest()
+	_, token, _, err := s.StartSession(disclose, nil)
+	require.NoError(t, err)
+	result, err := s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Len(t, result.Warnings, 1)
+	require.Contains(t, result.Warnings[0], "irma-demo.RU.studentCard is deprecated and will be sunset")
+	require.Contains(t, result.Warnings[0], "use irma-demo.MijnOverheid.root instead")
+
+	// Warnings are kept when the session is cancelled
+	require.NoError(t, s.CancelSession(token))
+	result, err = s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusCancelled, result.Status)
+	require.Len(t, result.Warnings, 1)
+
+	// After the sunset date, sessions are refused unless the credential type is allowed
+	credtype.SunsetDate = irma.Timestamp(now.Add(-time.Minute))
+	_, _, _, err = s.StartSession(disclose, nil)
+	require.ErrorContains(t, err, "irma-demo.RU.studentCard was sunset")
+	conf.AllowSunsetCredentials = []irma.CredentialTypeIdentifier{id}
+	_, token, _, err = s.StartSession(disclose, nil)
+	require.NoError(t, err)
+	result, err = s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Len(t, result.Warnings, 1)
+	require.Contains(t, result.Warnings[0], "was sunset")
+}
+
+func TestEntropy(t *testing.T) {
+	start := func() (*irma.Qr, irma.RequestorToken, irma.FrontendAuthorization, *big.Int) {
+		conf := sessionsConf(t)
+		conf.Entropy = mathrand.New(mathrand.NewSource(1))
+		s := newTestServer(t, conf)
+		qr, token, frontendRequest, err := s.StartSession(studentIDRequest(), nil)
+		require.NoError(t, err)
+		sessionRequest, err := s.GetRequest(token)
+		require.NoError(t, err)
+		return qr, token, frontendRequest.Authorization, sessionRequest.SessionRequest().Base().Nonce
+	}
+
+	// Sessions started with the same entropy get the same tokens and nonce
+	qr1, token1, auth1, nonce1 := start()
+	qr2, token2, auth2, nonce2 := start()
+	require.Equal(t, qr1.URL, qr2.URL)
+	require.Equal(t, token1, token2)
+	require.Equal(t, auth1, auth2)
+	require.Equal(t, nonce1, nonce2)
+
+	// The entropy need not be safe for concurrent use
+	conf := sessionsConf(t)
+	conf.Entropy = mathrand.New(mathrand.NewSource(1))
+	s := newTestServer(t, conf)
+	tokens := make(chan irma.RequestorToken)
+	errs := make(chan error)
+	for i := 0; i < 10; i++ {
+		go func() {
+			if _, token, _, err := s.StartSession(studentIDRequest(), nil); err != nil {
+				errs <- err
+			} else {
+				tokens <- token
+			}
+		}()
+	}
+	seen := map[irma.RequestorToken]bool{}
+	for i := 0; i < 10; i++ {
+		select {
+		case err := <-errs:
+			require.NoError(t, err)
+		case token := <-tokens:
+			require.False(t, seen[token])
+			seen[token] = true
+		}
+	}
+
+	// Failing to read from the entropy fails the session instead of panicking
+	conf = sessionsConf(t)
+	conf.Entropy = iotest.ErrReader(errors.New("entropy exhausted"))
+	s = newTestServer(t, conf)
+	_, _, _, err := s.StartSession(studentIDRequest(), nil)
+	require.ErrorContains(t, err, "entropy exhausted")
 }
@@ -0,0 +1,51 @@
+package irmaserver
+
+import (
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// maxSessionHistory is the maximum amount of events kept per session; older events are dropped,
+// so that e.g. a client that keeps retrying a request cannot make the session grow unbounded.
+const maxSessionHistory = 100
+
+// recordEvent appends the event to the history of the session, if session history is enabled.
+func (session *sessionData) recordEvent(event server.SessionEvent, conf *server.Configuration) {
+	if !conf.SessionHistory {
+		return
+	}
+	event.Time = conf.Now()
+	event.RequestID = session.requestID
+	session.History = append(session.History, event)
+	if len(session.History) > maxSessionHistory {
+		session.History = session.History[len(session.History)-maxSessionHistory:]
+	}
+}
+
+// recordStatusChange is the status hook recording status changes in the session history. Requests
+// of the IRMA app and frontend are recorded by the sessionMiddleware.
+func recordStatusChange(session *sessionData, conf *server.Configuration) {
+	session.recordEvent(server.SessionEvent{PrevStatus: session.PrevStatus, Status: session.Status}, conf)
+}
+
+// historyEndpoint returns the method and route, relative to the session, of the request to record
+// in the session history, or "" if it is not recorded. Polling the session status is not recorded,
+// as that would make every poll update the session.
+func historyEndpoint(r *http.Request) string {
+	route := r.URL.Path
+	if rctx := chi.RouteContext(r.Context()); rctx != nil && rctx.RoutePattern() != "" {
+		route = rctx.RoutePattern()
+	}
+	if strings.HasSuffix(route, "/status") || strings.HasSuffix(route, "/statusevents") {
+		return ""
+	}
+	// Patterns of subrouters end up joined with an extra slash
+	route = strings.TrimPrefix(strings.ReplaceAll(route, "//", "/"), "/session/{clientToken}")
+	if route == "" {
+		route = "/"
+	}
+	return r.Method + " " + route
+}
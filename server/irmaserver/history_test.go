@@ -0,0 +1,62 @@
+package irmaserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSessionHistory(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.URL = "https://example.com/irma/"
+	conf.SessionHistory = true
+	s := newTestServer(t, conf)
+
+	qr, token, _, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	path := sessionPath(qr)
+
+	do := func(method, path string) int {
+		rec := httptest.NewRecorder()
+		s.HandlerFunc()(rec, httptest.NewRequest(method, path, nil))
+		return rec.Code
+	}
+	require.Equal(t, http.StatusBadRequest, do(http.MethodGet, path+"/")) // lacks protocol version headers
+	require.Equal(t, http.StatusOK, do(http.MethodGet, path+"/status"))
+	require.Equal(t, http.StatusOK, do(http.MethodDelete, path+"/"))
+
+	history, err := s.GetSessionHistory(token)
+	require.NoError(t, err)
+	for i := range history {
+		require.False(t, history[i].Time.IsZero())
+		history[i].Time = time.Time{}
+		if i > 0 { // the session was not started in a request
+			require.NotEmpty(t, history[i].RequestID)
+			history[i].RequestID = ""
+		}
+	}
+
+	// Polling the status is not recorded
+	require.Equal(t, []server.SessionEvent{
+		{Status: irma.ServerStatusInitialized},
+		{Endpoint: "GET /", HTTPStatus: http.StatusBadRequest, PrevStatus: irma.ServerStatusInitialized, Status: irma.ServerStatusInitialized},
+		{PrevStatus: irma.ServerStatusInitialized, Status: irma.ServerStatusCancelled},
+		{Endpoint: "DELETE /", HTTPStatus: http.StatusOK, PrevStatus: irma.ServerStatusInitialized, Status: irma.ServerStatusCancelled},
+	}, history)
+
+	// The history is bounded
+	session := &sessionData{}
+	for i := 0; i < maxSessionHistory+10; i++ {
+		session.recordEvent(server.SessionEvent{Endpoint: "GET /"}, conf)
+	}
+	require.Len(t, session.History, maxSessionHistory)
+
+	conf.SessionHistory = false
+	_, err = s.GetSessionHistory(token)
+	require.Error(t, err)
+}
@@ -0,0 +1,34 @@
+package irmaserver
+
+import (
+	"context"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// completeMockSession completes the specified session that was just started, as if an IRMA app
+// disclosed the requested attributes (see server.Configuration.MockMode). Issuance sessions are
+// completed without issuing credentials, and signature sessions without a signature. If the
+// session request specifies a next session, it is started (and completed) as well.
+func (s *Server) completeMockSession(token irma.RequestorToken) error {
+	return s.sessions.transaction(context.Background(), token, func(session *sessionData) (bool, error) {
+		request := session.Rrequest.SessionRequest()
+		disclose := append(append(irma.AttributeConDisCon{}, request.Disclosure().Disclose...), session.ImplicitDisclosure...)
+		session.Result.Disclosed = s.conf.MockDisclosed(disclose)
+		session.Result.ProofStatus = irma.ProofStatusValid
+		if err := session.setStatus(irma.ServerStatusConnected, s.conf); err != nil {
+			return false, err
+		}
+		if err := s.startNext(session, &irma.ServerSessionResponse{}); err != nil {
+			session.fail(server.ErrorNextSession, err.Error(), s.conf)
+			return true, nil
+		}
+		if err := session.setStatus(irma.ServerStatusDone, s.conf); err != nil {
+			return false, err
+		}
+		s.conf.Logger.WithFields(logrus.Fields{"session": token}).Info("Mock session completed")
+		return true, nil
+	})
+}
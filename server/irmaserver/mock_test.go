@@ -0,0 +1,54 @@
+package irmaserver
+
+import (
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMockMode(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.MockMode = true
+	conf.MockAttributes = map[string]string{"irma-demo.RU.studentCard.studentID": "456"}
+	s := newTestServer(t, conf)
+
+	request := irma.NewDisclosureRequest(
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+		irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"),
+	)
+	value := "Johan"
+	request.Disclose[1][0][0].Value = &value
+
+	results := make(chan *server.SessionResult, 1)
+	_, token, _, err := s.StartSession(request, func(result *server.SessionResult) {
+		results <- result
+	})
+	require.NoError(t, err)
+
+	select {
+	case result := <-results:
+		require.Equal(t, token, result.Token)
+	case <-time.After(time.Second):
+		t.Fatal("session handler not invoked")
+	}
+
+	result, err := s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusDone, result.Status)
+	require.Equal(t, irma.ProofStatusValid, result.ProofStatus)
+	require.Len(t, result.Disclosed, 2)
+	require.Equal(t, "456", *result.Disclosed[0][0].RawValue)
+	require.Equal(t, "Johan", *result.Disclosed[1][0].RawValue)
+	require.Equal(t, irma.AttributeProofStatusPresent, result.Disclosed[1][0].Status)
+}
+
+func TestMockModeNotInProduction(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.MockMode = true
+	conf.Production = true
+	_, err := New(conf)
+	require.Error(t, err)
+}
@@ -0,0 +1,60 @@
+package irmaserver
+
+import (
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// Preflight performs all checks that StartSession would perform on the specified issuance request,
+// without starting a session. Contrary to StartSession, it does not stop at the first failure but
+// returns a report of all checks. The request parameter can be of any type accepted by StartSession.
+func Preflight(request interface{}) (*server.PreflightReport, error) {
+	return s.Preflight(request)
+}
+func (s *Server) Preflight(req interface{}) (*server.PreflightReport, error) {
+	rrequest, err := parseSessionRequest(s.conf, req)
+	if err != nil {
+		return nil, err
+	}
+	request, ok := rrequest.SessionRequest().(*irma.IssuanceRequest)
+	if !ok {
+		return nil, errors.New("preflight is only supported for issuance requests")
+	}
+
+	report := server.NewPreflightReport()
+	s.PreflightIssuanceRequest(request, report)
+	return report, nil
+}
+
+// PreflightIssuanceRequest adds the outcome of checking the issuance request to the report.
+func (s *Server) PreflightIssuanceRequest(request *irma.IssuanceRequest, report *server.PreflightReport) {
+	report.Add(server.PreflightCheckRequest, nil, s.validateRequest(request))
+
+	irmaconf := s.conf.IrmaConfiguration.Snapshot()
+	for _, cred := range request.Credentials {
+		id := cred.CredentialTypeID
+		if irmaconf.CredentialTypes[id] == nil {
+			report.Add(server.PreflightCheckCredentialType, &id, errors.Errorf("unknown credential type %s", id))
+			continue
+		}
+		report.Add(server.PreflightCheckCredentialType, &id, nil)
+
+		iss := id.IssuerIdentifier()
+		counter, err := s.checkPrivateKey(iss)
+		report.Add(server.PreflightCheckPrivateKey, &id, err)
+		if err == nil {
+			report.Add(server.PreflightCheckPublicKey, &id, s.checkPublicKey(iss, counter))
+		}
+		report.Add(server.PreflightCheckRevocation, &id, s.checkRevocationConfiguration(cred))
+		err = s.conf.IssuancePolicies.Apply(irmaconf, cred, s.conf.Logger)
+		if err == nil {
+			err = cred.Validate(irmaconf)
+		}
+		if err == nil && s.conf.AttributeValidation != nil {
+			err = s.conf.AttributeValidation.Check(cred)
+		}
+		report.Add(server.PreflightCheckAttributes, &id, err)
+		report.Add(server.PreflightCheckValidity, &id, checkCredentialValidity(cred, s.conf.Now()))
+	}
+}
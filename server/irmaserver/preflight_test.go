@@ -0,0 +1,64 @@
+package irmaserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPreflight(t *testing.T) {
+	// Serve the schemes, which are updated when a request misses required attributes, locally
+	// by proxying all outbound requests to a server serving the testdata folder
+	schemes := httptest.NewServer(http.FileServer(http.Dir(test.FindTestdataFolder(t))))
+	defer schemes.Close()
+	common.ForceHTTPS = false
+	defer func() { common.ForceHTTPS = true }()
+
+	conf := sessionsConf(t)
+	conf.IssuerPrivateKeysPath = filepath.Join(test.FindTestdataFolder(t), "privatekeys")
+	conf.OutboundHTTP.Proxy = schemes.URL
+	s := newTestServer(t, conf)
+
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	report, err := s.Preflight(irma.NewIssuanceRequest([]*irma.CredentialRequest{{
+		CredentialTypeID: studentCard,
+		Attributes: map[string]string{
+			"university":        "Radboud",
+			"studentCardNumber": "31415927",
+			"studentID":         "s1234567",
+			"level":             "42",
+		},
+	}}))
+	require.NoError(t, err)
+	require.True(t, report.Valid)
+	require.NotEmpty(t, report.Checks)
+
+	// All failures are reported, not just the first one
+	stempas := irma.NewCredentialTypeIdentifier("irma-demo.stemmen.stempas")
+	report, err = s.Preflight(irma.NewIssuanceRequest([]*irma.CredentialRequest{
+		{CredentialTypeID: studentCard, Attributes: map[string]string{"university": "Radboud"}},
+		{CredentialTypeID: stempas, Attributes: map[string]string{"election": "test"}},
+	}))
+	require.NoError(t, err)
+	require.False(t, report.Valid)
+	var failed []server.PreflightCheckType
+	for _, check := range report.Checks {
+		if !check.Passed {
+			require.NotEmpty(t, check.Message)
+			failed = append(failed, check.Check)
+		}
+	}
+	require.Equal(t, []server.PreflightCheckType{server.PreflightCheckRequest, server.PreflightCheckAttributes}, failed)
+	require.Equal(t, server.PreflightCheckRequest, report.Checks[0].Check)
+	require.Contains(t, report.Checks[0].Message, "Required attributes are missing")
+
+	_, err = s.Preflight(studentIDRequest())
+	require.Error(t, err)
+}
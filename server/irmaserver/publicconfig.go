@@ -0,0 +1,165 @@
+package irmaserver
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// The public configuration is cached for this long, both by us and by clients.
+const publicConfigurationMaxAge = 5 * time.Minute
+
+// Validity of the JWT containing the public configuration, which clients may keep for verifying
+// e.g. session pointers until it expires.
+const publicConfigurationValidity = 24 * time.Hour
+
+// publicConfigurationCache holds the most recently generated response of the public configuration
+// endpoint, so that it is not signed anew for each request.
+type publicConfigurationCache struct {
+	sync.Mutex
+	body        []byte
+	contentType string
+	etag        string
+	expires     time.Time
+}
+
+// PublicConfigurationHandlerFunc returns a http.HandlerFunc that handles GET and HEAD requests for the
+// public configuration of the server (see irma.PublicServerConfiguration), to be served at
+// irma.PublicConfigurationPath. If a JWT signing key is configured, the public configuration is
+// returned as a JWT signed with it (see irma.PublicServerConfigurationClaims), and as JSON otherwise.
+// Requests are rate limited per IP address to PublicConfigurationRateLimit requests per minute.
+func (s *Server) PublicConfigurationHandlerFunc() http.HandlerFunc {
+	s.publicConfigurationOnce.Do(func() {
+		opts := server.LogOptions{Response: false, Headers: false, From: true, ClientIP: s.conf.ClientIP}
+		s.publicConfigurationHandler = server.LogMiddleware("configuration", opts)(
+			server.ClientRateLimitMiddleware(s.conf, s.conf.PublicConfigurationRateLimit, time.Minute)(
+				http.HandlerFunc(s.handlePublicConfiguration),
+			),
+		)
+	})
+	return s.publicConfigurationHandler.ServeHTTP
+}
+
+func (s *Server) handlePublicConfiguration(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		server.WriteError(w, server.ErrorMethodNotAllowed, "")
+		return
+	}
+
+	cache := &s.publicConfigurationCache
+	cache.Lock()
+	now := s.conf.Now()
+	if now.After(cache.expires) {
+		body, contentType, err := s.signedPublicConfiguration(now)
+		if err != nil {
+			cache.Unlock()
+			_ = server.LogError(err)
+			server.WriteError(w, server.ErrorInternal, "")
+			return
+		}
+		hash := sha256.Sum256(body)
+		cache.body, cache.contentType = body, contentType
+		cache.etag = `"` + hex.EncodeToString(hash[:16]) + `"`
+		cache.expires = now.Add(publicConfigurationMaxAge)
+	}
+	body, contentType, etag, expires := cache.body, cache.contentType, cache.etag, cache.expires
+	cache.Unlock()
+
+	w.Header().Set("Cache-Control", "public, max-age="+strconv.Itoa(int(expires.Sub(now).Seconds())))
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(http.StatusOK)
+	if r.Method != http.MethodHead {
+		_, _ = w.Write(body)
+	}
+}
+
+// signedPublicConfiguration returns the public configuration as a signed JWT if a JWT signing key
+// is configured, and as JSON otherwise, along with its content type.
+func (s *Server) signedPublicConfiguration(now time.Time) ([]byte, string, error) {
+	config := s.publicConfiguration()
+	signer := s.conf.JwtSigningKey()
+	if signer == nil {
+		bts, err := json.Marshal(config)
+		return bts, "application/json", err
+	}
+
+	claims := &irma.PublicServerConfigurationClaims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			Issuer:    s.conf.JwtIssuer,
+			Subject:   "irma_configuration",
+			IssuedAt:  jwt.NewNumericDate(now),
+			ExpiresAt: jwt.NewNumericDate(now.Add(publicConfigurationValidity)),
+		},
+		Configuration: config,
+	}
+	j, err := irma.SignJwt(claims, signer)
+	return []byte(j), "application/jwt", err
+}
+
+// publicConfiguration returns the capabilities of the server.
+func (s *Server) publicConfiguration() *irma.PublicServerConfiguration {
+	min := minSecureProtocolVersion
+	if AcceptInsecureProtocolVersions {
+		min = minProtocolVersion
+	}
+	config := &irma.PublicServerConfiguration{
+		MinProtocolVersion: min,
+		MaxProtocolVersion: maxProtocolVersion,
+		Features: irma.ServerFeatures{
+			PairingMethods:        []irma.PairingMethod{irma.PairingMethodNone, irma.PairingMethodPin},
+			SSE:                   s.conf.EnableSSE,
+			ChainedSessions:       true,
+			SignedSessionPointers: s.conf.SignSessionPointers,
+		},
+		Schemes:    []irma.SchemeInfo{},
+		PublicKeys: irma.JWKS{Keys: []irma.JWK{}},
+	}
+	if s.conf.StoreType == "stateless" {
+		// See validateStatelessRequest() and sessionFeatures()
+		config.Features.PairingMethods = []irma.PairingMethod{irma.PairingMethodNone}
+		config.Features.ChainedSessions = false
+	}
+
+	irmaconf := s.conf.IrmaConfiguration.Snapshot()
+	for id, scheme := range irmaconf.SchemeManagers {
+		config.Schemes = append(config.Schemes, irma.SchemeInfo{ID: id.String(), URL: scheme.URL, Type: irma.SchemeTypeIssuer})
+	}
+	for id, scheme := range irmaconf.RequestorSchemes {
+		config.Schemes = append(config.Schemes, irma.SchemeInfo{ID: id.String(), URL: scheme.URL, Type: irma.SchemeTypeRequestor})
+	}
+	sort.Slice(config.Schemes, func(i, j int) bool {
+		return config.Schemes[i].ID < config.Schemes[j].ID
+	})
+
+	if pk := s.conf.JwtPublicKey(); pk != nil {
+		jwk := irma.NewRSAJWK(0, pk)
+		jwk.Kid = "" // the server has a single key
+		config.PublicKeys.Keys = append(config.PublicKeys.Keys, jwk)
+		// which is also listed under the key IDs with which the JWTs of some requestors are signed
+		var kids []string
+		for _, kid := range s.conf.JwtKeyIDs {
+			kids = append(kids, kid)
+		}
+		sort.Strings(kids)
+		for _, kid := range slices.Compact(kids) {
+			jwk.Kid = kid
+			config.PublicKeys.Keys = append(config.PublicKeys.Keys, jwk)
+		}
+	}
+	return config
+}
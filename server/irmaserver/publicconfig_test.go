@@ -0,0 +1,81 @@
+package irmaserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPublicConfiguration(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	conf := sessionsConf(t)
+	conf.Clock = clock
+	conf.EnableSSE = true
+	conf.JwtPrivateKeyFile = filepath.Join(test.FindTestdataFolder(t), "jwtkeys", "sk.pem")
+	conf.PublicConfigurationRateLimit = 2
+	conf.JwtKeyIDs = map[string]string{"requestor1": "key1", "requestor2": "key1", "requestor3": "key2"}
+	s := newTestServer(t, conf)
+
+	get := func(etag string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, irma.PublicConfigurationPath, nil)
+		if etag != "" {
+			req.Header.Set("If-None-Match", etag)
+		}
+		rec := httptest.NewRecorder()
+		s.PublicConfigurationHandlerFunc()(rec, req)
+		return rec
+	}
+
+	rec := get("")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, "application/jwt", rec.Header().Get("Content-Type"))
+	require.Equal(t, "public, max-age=300", rec.Header().Get("Cache-Control"))
+
+	claims := &irma.PublicServerConfigurationClaims{}
+	_, err := jwt.ParseWithClaims(rec.Body.String(), claims, func(token *jwt.Token) (interface{}, error) {
+		return conf.JwtPublicKey(), nil
+	})
+	require.NoError(t, err)
+	config := claims.Configuration
+	require.Equal(t, maxProtocolVersion, config.MaxProtocolVersion)
+	require.True(t, config.Features.SSE)
+	require.True(t, config.Features.ChainedSessions)
+	require.Contains(t, config.Features.PairingMethods, irma.PairingMethod(irma.PairingMethodPin))
+	require.Contains(t, config.Schemes, irma.SchemeInfo{
+		ID:   "irma-demo",
+		URL:  conf.IrmaConfiguration.SchemeManagers[irma.NewSchemeManagerIdentifier("irma-demo")].URL,
+		Type: irma.SchemeTypeIssuer,
+	})
+	// The key is listed without key ID and under each key ID of the requestors
+	require.Len(t, config.PublicKeys.Keys, 3)
+	for i, kid := range []string{"", "key1", "key2"} {
+		require.Equal(t, kid, config.PublicKeys.Keys[i].Kid)
+		pk, err := config.PublicKeys.Keys[i].RSAPublicKey()
+		require.NoError(t, err)
+		require.True(t, pk.Equal(conf.JwtPublicKey()))
+	}
+
+	// The cached document is returned, which the client may already have
+	clock.advance(time.Minute)
+	rec2 := get(rec.Header().Get("ETag"))
+	require.Equal(t, http.StatusNotModified, rec2.Code)
+	require.Equal(t, "public, max-age=240", rec2.Header().Get("Cache-Control"))
+
+	// HEAD requests are answered without body
+	req := httptest.NewRequest(http.MethodHead, irma.PublicConfigurationPath, nil)
+	rec3 := httptest.NewRecorder()
+	s.PublicConfigurationHandlerFunc()(rec3, req)
+	require.Equal(t, http.StatusOK, rec3.Code)
+	require.Equal(t, rec.Header().Get("ETag"), rec3.Header().Get("ETag"))
+	require.Empty(t, rec3.Body.Bytes())
+
+	// Requests are rate limited
+	require.Equal(t, http.StatusTooManyRequests, get("").Code)
+}
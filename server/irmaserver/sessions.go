@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"fmt"
+	"os"
+	"strconv"
 	"sync"
 	"time"
 
@@ -12,6 +14,7 @@ import (
 	"github.com/go-redis/redis/v8"
 	"github.com/privacybydesign/gabi"
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/server"
 
 	"github.com/sirupsen/logrus"
@@ -23,9 +26,12 @@ type sessionData struct {
 	ClientToken        irma.ClientToken
 	Version            *irma.ProtocolVersion `json:",omitempty"`
 	Rrequest           irma.RequestorRequest
-	LegacyCompatible   bool // if the request is convertible to pre-condiscon format
+	Requestor          string `json:",omitempty"` // name of the requestor that started the session, if known
+	LegacyCompatible   bool   // if the request is convertible to pre-condiscon format
 	Status             irma.ServerStatus
+	PrevStatus         irma.ServerStatus `json:",omitempty"` // status before the last status change, see setStatus()
 	ResponseCache      responseCache
+	Created            time.Time
 	LastActive         time.Time
 	Result             *server.SessionResult
 	KssProofs          map[irma.SchemeManagerIdentifier]*gabi.ProofP
@@ -34,6 +40,27 @@ type sessionData struct {
 	ImplicitDisclosure irma.AttributeConDisCon
 	Options            irma.SessionOptions
 	ClientAuth         irma.ClientAuthorization
+	RotateClientAuth   bool   `json:",omitempty"` // whether ClientAuth is replaced after each authorized request
+	MdocReader         bool   `json:",omitempty"` // set once an mdoc reader instead of an IRMA app takes part in the session
+	TLSBindingKey      []byte `json:",omitempty"` // public key to which the IRMA app bound its authorization, see irma.TLSBinding()
+	// ID of the snapshot of the schemes at the start of the session, see irmaConfiguration()
+	SchemesSnapshot string `json:",omitempty"`
+	// Status changes and requests of the session, if SessionHistory is enabled in the configuration
+	History []server.SessionEvent `json:",omitempty"`
+
+	// Set if the result callback failed during the current transaction, to be put in the callback outbox
+	undeliveredCallback *outboxEntry
+	// ID of the request during which the current transaction takes place, if any
+	requestID string
+}
+
+// outboxEntry is a session result in the callback outbox, whose delivery is periodically retried.
+type outboxEntry struct {
+	server.UndeliveredCallback
+	Requestor string
+	Result    *server.SessionResult
+	Validity  int
+	RequestID string `json:",omitempty"` // of the request that finished the session, sent along with redeliveries
 }
 
 type responseCache struct {
@@ -42,6 +69,8 @@ type responseCache struct {
 	Response      []byte
 	Status        int
 	SessionStatus irma.ServerStatus
+	Auth          irma.ClientAuthorization `json:",omitempty"` // presented by the client in the cached request
+	NextAuth      irma.ClientAuthorization `json:",omitempty"` // sent to the client in the cached response
 }
 
 type sessionStore interface {
@@ -49,6 +78,10 @@ type sessionStore interface {
 	transaction(context.Context, irma.RequestorToken, func(*sessionData) (bool, error)) error
 	clientTransaction(context.Context, irma.ClientToken, func(*sessionData) (bool, error)) error
 	subscribeUpdates(context.Context, irma.RequestorToken) (chan *sessionData, error)
+	requestorSessions(context.Context, string) ([]*sessionData, error)
+	putOutbox(context.Context, *outboxEntry) error
+	outbox(context.Context) ([]*outboxEntry, error)
+	deleteOutbox(context.Context, irma.RequestorToken) error
 	stop()
 }
 
@@ -58,6 +91,8 @@ type memorySessionStore struct {
 	requestor      map[irma.RequestorToken]*memorySessionData
 	client         map[irma.ClientToken]*memorySessionData
 	updateChannels map[irma.RequestorToken][]chan *sessionData
+	outboxEntries  map[irma.RequestorToken]*outboxEntry
+	outboxMutex    sync.Mutex
 }
 
 type memorySessionData struct {
@@ -65,6 +100,24 @@ type memorySessionData struct {
 	*sessionData
 }
 
+// snapshot returns the current session data, and a deep copy of it that can be modified without side effects
+// (the session struct contains pointers to other structs).
+func (memSes *memorySessionData) snapshot() (*sessionData, *sessionData, error) {
+	memSes.Lock()
+	defer memSes.Unlock()
+	ses := &sessionData{}
+	if err := copyObject(memSes.sessionData, ses); err != nil {
+		return nil, nil, err
+	}
+	return memSes.sessionData, ses, nil
+}
+
+// memoryStoreSnapshot is the content of the session snapshot file of the memory session store.
+type memoryStoreSnapshot struct {
+	Sessions []*sessionData
+	Outbox   []*outboxEntry `json:",omitempty"`
+}
+
 type redisSessionStore struct {
 	client *server.RedisClient
 	conf   *server.Configuration
@@ -78,6 +131,8 @@ func (err *RedisError) Error() string {
 	return fmt.Sprintf("redis error: %s", err.err)
 }
 
+var errSessionConflict = errors.New("session changed by another routine")
+
 type UnknownSessionError struct {
 	requestorToken irma.RequestorToken
 	clientToken    irma.ClientToken
@@ -97,6 +152,8 @@ const (
 	maxLockRetryTime           = 2 * time.Second
 	requestorTokenLookupPrefix = "token:"
 	clientTokenLookupPrefix    = "session:"
+	requestorSessionsPrefix    = "requestor-sessions:"
+	callbackOutboxKey          = "callback-outbox"
 )
 
 var (
@@ -106,7 +163,7 @@ var (
 
 	minProtocolVersion       = irma.NewVersion(2, 4)
 	minSecureProtocolVersion = irma.NewVersion(2, 8)
-	maxProtocolVersion       = irma.NewVersion(2, 8)
+	maxProtocolVersion       = irma.NewVersion(2, 9)
 
 	minFrontendProtocolVersion = irma.NewVersion(1, 0)
 	maxFrontendProtocolVersion = irma.NewVersion(1, 1)
@@ -129,7 +186,7 @@ func (s *memorySessionStore) transaction(ctx context.Context, t irma.RequestorTo
 	if memSes == nil {
 		return &UnknownSessionError{t, ""}
 	}
-	return s.handleTransaction(memSes, handler)
+	return s.handleTransaction(ctx, memSes, handler, &UnknownSessionError{t, ""})
 }
 
 func (s *memorySessionStore) clientTransaction(ctx context.Context, t irma.ClientToken, handler func(session *sessionData) (bool, error)) error {
@@ -140,29 +197,32 @@ func (s *memorySessionStore) clientTransaction(ctx context.Context, t irma.Clien
 	if memSes == nil {
 		return &UnknownSessionError{"", t}
 	}
-	return s.handleTransaction(memSes, handler)
+	return s.handleTransaction(ctx, memSes, handler, &UnknownSessionError{"", t})
 }
 
-func (s *memorySessionStore) handleTransaction(memSes *memorySessionData, handler func(session *sessionData) (bool, error)) error {
-	// The session struct contains pointers to other structs, so we need to give the handler a deep copy to prevent side effects.
-	sesBefore := memSes.sessionData
-	ses := &sessionData{}
-	memSes.Lock()
-	err := copyObject(sesBefore, ses)
-	memSes.Unlock()
+func (s *memorySessionStore) handleTransaction(
+	ctx context.Context,
+	memSes *memorySessionData,
+	handler func(session *sessionData) (bool, error),
+	unknownErr *UnknownSessionError,
+) error {
+	sesBefore, ses, err := memSes.snapshot()
 	if err != nil {
 		return err
 	}
-
-	if !ses.Status.Finished() && ses.timeout(s.conf) <= 0 {
-		ses.setStatus(irma.ServerStatusTimeout, s.conf)
+	// Expired sessions that have not yet been deleted are unknown, as they would be in Redis
+	if ses.expired(s.conf) {
+		return unknownErr
 	}
 
+	ses.requestID = server.RequestID(ctx)
+	ses.applyTimeout(s.conf)
+
 	if update, err := handler(ses); !update || err != nil {
 		return err
 	}
 
-	s.conf.Logger.
+	s.conf.Logger.WithContext(ctx).
 		WithFields(logrus.Fields{"session": ses.RequestorToken, "status": ses.Status}).
 		Info("Session updated")
 
@@ -176,11 +236,18 @@ func (s *memorySessionStore) handleTransaction(memSes *memorySessionData, handle
 	memSes.Lock()
 	defer memSes.Unlock()
 	if sesBefore != memSes.sessionData {
-		return errors.New("session changed by another routine")
+		return errSessionConflict
 	}
 	memSes.sessionData = sesAfter
 
+	if ses.undeliveredCallback != nil {
+		if err := s.putOutbox(ctx, ses.undeliveredCallback); err != nil {
+			return err
+		}
+	}
+
 	go func() {
+		defer server.RecoverPanic("session updates")
 		for _, channel := range s.updateChannels[ses.RequestorToken] {
 			channel <- ses
 		}
@@ -196,7 +263,78 @@ func (s *memorySessionStore) subscribeUpdates(ctx context.Context, token irma.Re
 	return statusChan, nil
 }
 
+func (s *memorySessionStore) requestorSessions(ctx context.Context, requestor string) ([]*sessionData, error) {
+	// As in deleteExpired, we don't hold the store lock while accessing the sessions
+	s.RLock()
+	tokens := make([]irma.RequestorToken, 0, len(s.requestor))
+	for token := range s.requestor {
+		tokens = append(tokens, token)
+	}
+	s.RUnlock()
+
+	var sessions []*sessionData
+	for _, token := range tokens {
+		s.RLock()
+		memSes := s.requestor[token]
+		s.RUnlock()
+		if memSes == nil {
+			continue // deleted in the meantime
+		}
+		_, session, err := memSes.snapshot()
+		if err != nil {
+			return nil, err
+		}
+		// As in the Redis store, expired sessions are skipped and timeouts are not applied to the stored sessions
+		if session.Requestor != requestor || session.expired(s.conf) {
+			continue
+		}
+		if session.timedOut(s.conf) {
+			_ = session.transition(irma.ServerStatusTimeout) // cannot fail, as timedOut() implies the session is not finished
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+func (s *memorySessionStore) putOutbox(ctx context.Context, entry *outboxEntry) error {
+	// Store a copy, so that the caller can't modify the entry in memory
+	cpy := &outboxEntry{}
+	if err := copyObject(entry, cpy); err != nil {
+		return err
+	}
+	s.outboxMutex.Lock()
+	defer s.outboxMutex.Unlock()
+	s.outboxEntries[entry.Token] = cpy
+	return nil
+}
+
+func (s *memorySessionStore) outbox(ctx context.Context) ([]*outboxEntry, error) {
+	s.outboxMutex.Lock()
+	defer s.outboxMutex.Unlock()
+	entries := make([]*outboxEntry, 0, len(s.outboxEntries))
+	for _, entry := range s.outboxEntries {
+		cpy := &outboxEntry{}
+		if err := copyObject(entry, cpy); err != nil {
+			return nil, err
+		}
+		entries = append(entries, cpy)
+	}
+	return entries, nil
+}
+
+func (s *memorySessionStore) deleteOutbox(ctx context.Context, token irma.RequestorToken) error {
+	s.outboxMutex.Lock()
+	defer s.outboxMutex.Unlock()
+	delete(s.outboxEntries, token)
+	return nil
+}
+
 func (s *memorySessionStore) stop() {
+	if s.conf.SessionSnapshotFile != "" {
+		if err := s.saveSnapshot(); err != nil {
+			s.conf.Logger.WithError(err).Error("Failed to save session snapshot")
+		}
+	}
 	s.Lock()
 	defer s.Unlock()
 	for _, session := range s.requestor {
@@ -216,17 +354,22 @@ func (s *memorySessionStore) deleteExpired() {
 	}
 	s.RUnlock()
 
+	// The expiry is determined on the sessions as stored, like Redis does using the TTL set when storing
+	// the session. So timed out sessions are kept for SessionResultLifetime after they timed out.
 	expired := make([]irma.RequestorToken, 0, len(toCheck))
 	for token := range toCheck {
-		if err := s.transaction(context.Background(), token, func(session *sessionData) (bool, error) {
-			if session.ttl(s.conf) <= 0 {
-				s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Info("Deleting expired session")
-				expired = append(expired, token)
-			}
-			return false, nil
-		}); err != nil {
-			s.conf.Logger.WithFields(logrus.Fields{"session": token}).WithError(err).Error("Error while deleting expired session")
+		s.RLock()
+		memSes := s.requestor[token]
+		s.RUnlock()
+		if memSes == nil {
+			continue
 		}
+		memSes.Lock()
+		if memSes.expired(s.conf) {
+			s.conf.Logger.WithFields(logrus.Fields{"session": token}).Info("Deleting expired session")
+			expired = append(expired, token)
+		}
+		memSes.Unlock()
 	}
 
 	// Using a write lock, delete the expired sessions
@@ -243,6 +386,74 @@ func (s *memorySessionStore) deleteExpired() {
 	}
 }
 
+// saveSnapshot atomically writes the unexpired sessions and the callback outbox to the session snapshot file.
+func (s *memorySessionStore) saveSnapshot() error {
+	// As in deleteExpired, we don't hold the store lock while accessing the sessions
+	s.RLock()
+	memSessions := make([]*memorySessionData, 0, len(s.requestor))
+	for _, memSes := range s.requestor {
+		memSessions = append(memSessions, memSes)
+	}
+	s.RUnlock()
+
+	snapshot := memoryStoreSnapshot{Sessions: make([]*sessionData, 0, len(memSessions))}
+	for _, memSes := range memSessions {
+		memSes.Lock()
+		if !memSes.expired(s.conf) {
+			snapshot.Sessions = append(snapshot.Sessions, memSes.sessionData)
+		}
+		memSes.Unlock()
+	}
+	var err error
+	if snapshot.Outbox, err = s.outbox(context.Background()); err != nil {
+		return err
+	}
+
+	bts, err := json.Marshal(snapshot)
+	if err != nil {
+		return err
+	}
+	if err = common.SaveFile(s.conf.SessionSnapshotFile, bts); err != nil {
+		return err
+	}
+	s.conf.Logger.WithField("sessions", len(snapshot.Sessions)).Debug("Session snapshot saved")
+	return nil
+}
+
+// loadSnapshot restores the sessions and the callback outbox from the session snapshot file, if it exists.
+// Sessions that expired in the meantime are skipped. Handlers of sessions started using the Go API
+// are not restored, so that no handler is invoked for such sessions after the restart.
+func (s *memorySessionStore) loadSnapshot() error {
+	bts, err := os.ReadFile(s.conf.SessionSnapshotFile)
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	var snapshot memoryStoreSnapshot
+	if err = json.Unmarshal(bts, &snapshot); err != nil {
+		return errors.WrapPrefix(err, "failed to parse session snapshot", 0)
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	restored := 0
+	for _, session := range snapshot.Sessions {
+		if session.expired(s.conf) {
+			continue
+		}
+		memSes := &memorySessionData{sessionData: session}
+		s.requestor[session.RequestorToken] = memSes
+		s.client[session.ClientToken] = memSes
+		restored++
+	}
+	for _, entry := range snapshot.Outbox {
+		s.outboxEntries[entry.Token] = entry
+	}
+	s.conf.Logger.WithField("sessions", restored).Info("Sessions restored from session snapshot")
+	return nil
+}
+
 func (s *redisSessionStore) add(ctx context.Context, session *sessionData) error {
 	sessionJSON, err := json.Marshal(session)
 	if err != nil {
@@ -253,33 +464,36 @@ func (s *redisSessionStore) add(ctx context.Context, session *sessionData) error
 	if ttl <= 0 {
 		return &RedisError{errors.New("session ttl is in the past")}
 	}
-	if err := s.client.Watch(ctx, func(tx *redis.Tx) error {
-		if err := tx.Set(
+	// Write all keys in a single MULTI/EXEC transaction, so that either all or none of them are written
+	if _, err := s.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Set(
 			ctx,
 			s.client.KeyPrefix+requestorTokenLookupPrefix+string(session.RequestorToken),
 			string(session.ClientToken),
 			ttl,
-		).Err(); err != nil {
-			return err
-		}
-		if err := tx.Set(
+		)
+		pipe.Set(
 			ctx,
 			s.client.KeyPrefix+clientTokenLookupPrefix+string(session.ClientToken),
 			sessionJSON,
 			ttl,
-		).Err(); err != nil {
-			return err
-		}
-
-		if s.client.FailoverMode {
-			if err := s.client.Wait(ctx, 1, time.Second).Err(); err != nil {
-				return err
-			}
-		}
+		)
+		// Index the session by its requestor, scored by the session's expiry time
+		pipe.ZAdd(
+			ctx,
+			s.client.KeyPrefix+requestorSessionsPrefix+session.Requestor,
+			&redis.Z{Score: float64(s.conf.Now().Add(ttl).Unix()), Member: string(session.RequestorToken)},
+		)
+		s.expireRequestorSessions(ctx, pipe, session.Requestor)
 		return nil
 	}); err != nil {
 		return &RedisError{err}
 	}
+	if s.client.FailoverMode {
+		if err := s.client.Wait(ctx, 1, time.Second).Err(); err != nil {
+			return &RedisError{err}
+		}
+	}
 
 	s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("Session added in Redis datastore")
 	return nil
@@ -303,8 +517,11 @@ func (s *redisSessionStore) transaction(ctx context.Context, t irma.RequestorTok
 }
 
 func (s *redisSessionStore) clientTransaction(ctx context.Context, t irma.ClientToken, handler func(session *sessionData) (bool, error)) error {
+	var undelivered *outboxEntry
+	clientKey := s.client.KeyPrefix + clientTokenLookupPrefix + string(t)
+	// Watch the session, so that the update below fails if the session was changed in the meantime
 	err := s.client.Watch(ctx, func(tx *redis.Tx) error {
-		getResult := tx.Get(ctx, s.client.KeyPrefix+clientTokenLookupPrefix+string(t))
+		getResult := tx.Get(ctx, clientKey)
 		if getResult.Err() == redis.Nil {
 			return &UnknownSessionError{"", t}
 		} else if getResult.Err() != nil {
@@ -318,16 +535,14 @@ func (s *redisSessionStore) clientTransaction(ctx context.Context, t irma.Client
 
 		s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("Session received from Redis datastore")
 
-		// Timeout check
-		if !session.Status.Finished() && session.timeout(s.conf) <= 0 {
-			session.setStatus(irma.ServerStatusTimeout, s.conf)
-		}
+		session.requestID = server.RequestID(ctx)
+		session.applyTimeout(s.conf)
 
 		if update, err := handler(session); !update || err != nil {
 			return err
 		}
 
-		s.conf.Logger.
+		s.conf.Logger.WithContext(ctx).
 			WithFields(logrus.Fields{"session": session.RequestorToken, "status": session.Status}).
 			Info("Session updated")
 
@@ -342,10 +557,17 @@ func (s *redisSessionStore) clientTransaction(ctx context.Context, t irma.Client
 			return errors.New("session ttl is in the past")
 		}
 
-		if err := tx.Set(ctx, s.client.KeyPrefix+clientTokenLookupPrefix+string(t), sessionJSON, ttl).Err(); err != nil {
-			return err
-		}
-		if err := tx.Expire(ctx, s.client.KeyPrefix+requestorTokenLookupPrefix+string(session.RequestorToken), ttl).Err(); err != nil {
+		if _, err := tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Set(ctx, clientKey, sessionJSON, ttl)
+			pipe.Expire(ctx, s.client.KeyPrefix+requestorTokenLookupPrefix+string(session.RequestorToken), ttl)
+			pipe.ZAddXX(
+				ctx,
+				s.client.KeyPrefix+requestorSessionsPrefix+session.Requestor,
+				&redis.Z{Score: float64(s.conf.Now().Add(ttl).Unix()), Member: string(session.RequestorToken)},
+			)
+			s.expireRequestorSessions(ctx, pipe, session.Requestor)
+			return nil
+		}); err != nil {
 			return err
 		}
 		if s.client.FailoverMode {
@@ -353,13 +575,17 @@ func (s *redisSessionStore) clientTransaction(ctx context.Context, t irma.Client
 				return err
 			}
 		}
+		undelivered = session.undeliveredCallback
 		return nil
-	})
+	}, clientKey)
 	if _, ok := err.(*UnknownSessionError); ok {
 		return err
 	} else if err != nil {
 		return &RedisError{err}
 	}
+	if undelivered != nil {
+		return s.putOutbox(ctx, undelivered)
+	}
 	return nil
 }
 
@@ -367,6 +593,129 @@ func (s *redisSessionStore) subscribeUpdates(ctx context.Context, token irma.Req
 	return nil, errors.New("not implemented")
 }
 
+// expireRequestorSessionsScript removes the expired sessions from the index of the sessions of a
+// requestor (KEYS[1]), given the current time (ARGV[1]), and lets the index expire together with
+// the last of its sessions.
+const expireRequestorSessionsScript = `
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. ARGV[1])
+local last = redis.call('ZRANGE', KEYS[1], -1, -1, 'WITHSCORES')
+if #last > 0 then
+	redis.call('EXPIREAT', KEYS[1], math.ceil(tonumber(last[2])))
+end
+return 0
+`
+
+// expireRequestorSessions trims the index of the sessions of the requestor and sets its expiry,
+// so that it does not grow nor remain in Redis indefinitely.
+func (s *redisSessionStore) expireRequestorSessions(ctx context.Context, pipe redis.Pipeliner, requestor string) {
+	pipe.Eval(
+		ctx,
+		expireRequestorSessionsScript,
+		[]string{s.client.KeyPrefix + requestorSessionsPrefix + requestor},
+		s.conf.Now().Unix(),
+	)
+}
+
+func (s *redisSessionStore) requestorSessions(ctx context.Context, requestor string) ([]*sessionData, error) {
+	key := s.client.KeyPrefix + requestorSessionsPrefix + requestor
+	now := strconv.FormatInt(s.conf.Now().Unix(), 10)
+
+	// Sessions whose expiry time has passed have been deleted by Redis, so we can remove them from the index
+	var tokensCmd *redis.StringSliceCmd
+	if _, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.ZRemRangeByScore(ctx, key, "-inf", "("+now)
+		tokensCmd = pipe.ZRangeByScore(ctx, key, &redis.ZRangeBy{Min: now, Max: "+inf"})
+		return nil
+	}); err != nil {
+		return nil, &RedisError{err}
+	}
+	tokens := tokensCmd.Val()
+	if len(tokens) == 0 {
+		return nil, nil
+	}
+
+	// Look up the client tokens and then the sessions, each in one round trip
+	clientTokens, err := s.pipelinedGet(ctx, requestorTokenLookupPrefix, tokens)
+	if err != nil {
+		return nil, err
+	}
+	sessionsJSON, err := s.pipelinedGet(ctx, clientTokenLookupPrefix, clientTokens)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := make([]*sessionData, 0, len(sessionsJSON))
+	for _, sessionJSON := range sessionsJSON {
+		session := &sessionData{}
+		if err := json.Unmarshal([]byte(sessionJSON), session); err != nil {
+			return nil, &RedisError{err}
+		}
+		if session.timedOut(s.conf) {
+			_ = session.transition(irma.ServerStatusTimeout) // cannot fail, as timedOut() implies the session is not finished
+		}
+		sessions = append(sessions, session)
+	}
+	return sessions, nil
+}
+
+// pipelinedGet gets the values of the keys having the specified prefix and suffixes in one round trip,
+// skipping keys that don't exist.
+func (s *redisSessionStore) pipelinedGet(ctx context.Context, prefix string, suffixes []string) ([]string, error) {
+	cmds := make([]*redis.StringCmd, len(suffixes))
+	if _, err := s.client.Pipelined(ctx, func(pipe redis.Pipeliner) error {
+		for i, suffix := range suffixes {
+			cmds[i] = pipe.Get(ctx, s.client.KeyPrefix+prefix+suffix)
+		}
+		return nil
+	}); err != nil && err != redis.Nil {
+		return nil, &RedisError{err}
+	}
+	vals := make([]string, 0, len(cmds))
+	for _, cmd := range cmds {
+		if cmd.Err() == redis.Nil {
+			continue // expired in the meantime
+		} else if cmd.Err() != nil {
+			return nil, &RedisError{cmd.Err()}
+		}
+		vals = append(vals, cmd.Val())
+	}
+	return vals, nil
+}
+
+func (s *redisSessionStore) putOutbox(ctx context.Context, entry *outboxEntry) error {
+	entryJSON, err := json.Marshal(entry)
+	if err != nil {
+		return &RedisError{err}
+	}
+	if err = s.client.HSet(ctx, s.client.KeyPrefix+callbackOutboxKey, string(entry.Token), entryJSON).Err(); err != nil {
+		return &RedisError{err}
+	}
+	return nil
+}
+
+func (s *redisSessionStore) outbox(ctx context.Context) ([]*outboxEntry, error) {
+	vals, err := s.client.HVals(ctx, s.client.KeyPrefix+callbackOutboxKey).Result()
+	if err != nil {
+		return nil, &RedisError{err}
+	}
+	entries := make([]*outboxEntry, 0, len(vals))
+	for _, val := range vals {
+		entry := &outboxEntry{}
+		if err := json.Unmarshal([]byte(val), entry); err != nil {
+			return nil, &RedisError{err}
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (s *redisSessionStore) deleteOutbox(ctx context.Context, token irma.RequestorToken) error {
+	if err := s.client.HDel(ctx, s.client.KeyPrefix+callbackOutboxKey, string(token)).Err(); err != nil {
+		return &RedisError{err}
+	}
+	return nil
+}
+
 func (s *redisSessionStore) stop() {
 	err := s.client.Close()
 	if err != nil {
@@ -374,3 +723,67 @@ func (s *redisSessionStore) stop() {
 	}
 	s.conf.Logger.Info("Redis client closed successfully")
 }
+
+// measuredSessionStore records the duration and outcome of the operations of a session store
+// in the store statistics, and logs operations that take longer than the configured threshold.
+type measuredSessionStore struct {
+	sessionStore
+	conf  *server.Configuration
+	stats *server.StoreStatistics
+}
+
+func (s *measuredSessionStore) measure(operation string, start time.Time, err error) {
+	duration := time.Since(start)
+	s.stats.Record(operation, duration, err)
+	if rerr, ok := err.(*RedisError); err == errSessionConflict || (ok && rerr.err == redis.TxFailedErr) {
+		s.stats.RecordConflict()
+	}
+	threshold := time.Duration(s.conf.SlowStoreOperationThreshold) * time.Millisecond
+	if threshold > 0 && duration > threshold {
+		s.conf.Logger.WithFields(logrus.Fields{"operation": operation, "duration": duration}).
+			Warn("Slow session store operation")
+	}
+}
+
+// measureHandler measures the time spent in a transaction handler separately from the store operation.
+func (s *measuredSessionStore) measureHandler(handler func(*sessionData) (bool, error)) func(*sessionData) (bool, error) {
+	return func(session *sessionData) (update bool, err error) {
+		defer func(start time.Time) { s.measure("handler", start, err) }(time.Now())
+		return handler(session)
+	}
+}
+
+func (s *measuredSessionStore) add(ctx context.Context, session *sessionData) (err error) {
+	defer func(start time.Time) { s.measure("add", start, err) }(time.Now())
+	return s.sessionStore.add(ctx, session)
+}
+
+func (s *measuredSessionStore) transaction(ctx context.Context, t irma.RequestorToken, handler func(*sessionData) (bool, error)) (err error) {
+	defer func(start time.Time) { s.measure("transaction", start, err) }(time.Now())
+	return s.sessionStore.transaction(ctx, t, s.measureHandler(handler))
+}
+
+func (s *measuredSessionStore) clientTransaction(ctx context.Context, t irma.ClientToken, handler func(*sessionData) (bool, error)) (err error) {
+	defer func(start time.Time) { s.measure("client_transaction", start, err) }(time.Now())
+	return s.sessionStore.clientTransaction(ctx, t, s.measureHandler(handler))
+}
+
+func (s *measuredSessionStore) requestorSessions(ctx context.Context, requestor string) (sessions []*sessionData, err error) {
+	defer func(start time.Time) { s.measure("requestor_sessions", start, err) }(time.Now())
+	return s.sessionStore.requestorSessions(ctx, requestor)
+}
+
+func (s *measuredSessionStore) putOutbox(ctx context.Context, entry *outboxEntry) (err error) {
+	defer func(start time.Time) { s.measure("put_outbox", start, err) }(time.Now())
+	return s.sessionStore.putOutbox(ctx, entry)
+}
+
+func (s *measuredSessionStore) outbox(ctx context.Context) (entries []*outboxEntry, err error) {
+	defer func(start time.Time) { s.measure("outbox", start, err) }(time.Now())
+	return s.sessionStore.outbox(ctx)
+}
+
+func (s *measuredSessionStore) deleteOutbox(ctx context.Context, token irma.RequestorToken) (err error) {
+	defer func(start time.Time) { s.measure("delete_outbox", start, err) }(time.Now())
+	return s.sessionStore.deleteOutbox(ctx, token)
+}
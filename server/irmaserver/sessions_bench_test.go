@@ -0,0 +1,70 @@
+package irmaserver
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+// benchmarkStores runs the benchmark against the memory and the Redis session store.
+func benchmarkStores(b *testing.B, f func(b *testing.B, s *Server)) {
+	b.Run("store=memory", func(b *testing.B) {
+		s, err := New(sessionsConf(b))
+		require.NoError(b, err)
+		defer s.Stop()
+		f(b, s)
+	})
+
+	b.Run("store=redis", func(b *testing.B) {
+		mr := miniredis.NewMiniRedis()
+		require.NoError(b, mr.Start())
+		defer mr.Close()
+
+		conf := sessionsConf(b)
+		conf.StoreType = "redis"
+		conf.RedisSettings = &server.RedisSettings{Addr: mr.Addr(), DisableTLS: true}
+		s, err := New(conf)
+		require.NoError(b, err)
+		defer s.Stop()
+		f(b, s)
+	})
+}
+
+func BenchmarkStartSession(b *testing.B) {
+	benchmarkStores(b, func(b *testing.B, s *Server) {
+		request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, _, _, err := s.StartSession(request, nil); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkSessionTransaction measures a round-trip to the session store: loading a session,
+// and saving it after an update, as done for each request of the IRMA app.
+func BenchmarkSessionTransaction(b *testing.B) {
+	benchmarkStores(b, func(b *testing.B, s *Server) {
+		request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+		_, token, _, err := s.StartSession(request, nil)
+		require.NoError(b, err)
+
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			err := s.sessions.transaction(context.Background(), token, func(session *sessionData) (bool, error) {
+				session.LastActive = s.conf.Now()
+				return true, nil
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -2,10 +2,19 @@ package irmaserver
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
 	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/go-chi/chi/v5"
 	"github.com/privacybydesign/irmago/internal/test"
 
 	irma "github.com/privacybydesign/irmago"
@@ -21,19 +30,44 @@ func init() {
 	logger.Level = logrus.FatalLevel
 }
 
-func sessionsConf(t *testing.T) *server.Configuration {
+func sessionsConf(t testing.TB) *server.Configuration {
 	return &server.Configuration{
 		Logger:      logger,
 		SchemesPath: filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
 	}
 }
 
-func TestSessionHandlerInvokedOnCancel(t *testing.T) {
-	s, err := New(sessionsConf(t))
+// newTestServer returns a new server with the specified configuration, which is stopped when the test ends.
+func newTestServer(t *testing.T, conf *server.Configuration) *Server {
+	s, err := New(conf)
 	require.NoError(t, err)
-	defer s.Stop()
+	t.Cleanup(s.Stop)
+	return s
+}
 
-	request := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+// studentIDRequest returns a request to disclose the student ID of the demo student card.
+func studentIDRequest() *irma.DisclosureRequest {
+	return irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+}
+
+// sessionPath returns the path of the endpoints of the IRMA app of the session with the specified QR.
+func sessionPath(qr *irma.Qr) string {
+	return "/session/" + qr.URL[strings.LastIndex(qr.URL, "/")+1:]
+}
+
+// memoryStore returns the memory session store of the server, which is wrapped by the store measurements.
+func memoryStore(t *testing.T, s *Server) *memorySessionStore {
+	measured, ok := s.sessions.(*measuredSessionStore)
+	require.True(t, ok)
+	store, ok := measured.sessionStore.(*memorySessionStore)
+	require.True(t, ok)
+	return store
+}
+
+func TestSessionHandlerInvokedOnCancel(t *testing.T) {
+	s := newTestServer(t, sessionsConf(t))
+
+	request := studentIDRequest()
 
 	var handlerInvoked bool
 	_, token, _, err := s.StartSession(request, func(result *server.SessionResult) {
@@ -47,42 +81,37 @@ func TestSessionHandlerInvokedOnCancel(t *testing.T) {
 }
 
 func TestSessionHandlerInvokedOnTimeout(t *testing.T) {
-	s, err := New(sessionsConf(t))
-	require.NoError(t, err)
-	defer s.Stop()
+	s := newTestServer(t, sessionsConf(t))
 
 	request := &irma.ServiceProviderRequest{
 		RequestorBaseRequest: irma.RequestorBaseRequest{
 			ClientTimeout: 1,
 		},
-		Request: irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+		Request: studentIDRequest(),
 	}
 
 	var handlerInvoked bool
-	_, _, _, err = s.StartSession(request, func(result *server.SessionResult) {
+	_, _, _, err := s.StartSession(request, func(result *server.SessionResult) {
 		handlerInvoked = true
 	})
 	require.NoError(t, err)
 
 	time.Sleep(2 * time.Second)
-	s.sessions.(*memorySessionStore).deleteExpired()
+	memoryStore(t, s).deleteExpired()
 	time.Sleep(100 * time.Millisecond) // give session handler time to run
 
 	require.True(t, handlerInvoked)
 }
 
 func TestMemoryStoreNoDeadlock(t *testing.T) {
-	s, err := New(sessionsConf(t))
-	require.NoError(t, err)
-	defer s.Stop()
+	s := newTestServer(t, sessionsConf(t))
 
 	req, err := server.ParseSessionRequest(`{"request":{"@context":"https://irma.app/ld/request/disclosure/v2","context":"AQ==","nonce":"MtILupG0g0J23GNR1YtupQ==","devMode":true,"disclose":[[[{"type":"test.test.email.email","value":"example@example.com"}]]]}}`)
 	require.NoError(t, err)
-	session, err := s.newSession(context.Background(), irma.ActionDisclosing, req, nil, "")
+	session, err := s.newSession(context.Background(), irma.ActionDisclosing, req, "", nil, "")
 	require.NoError(t, err)
 
-	memSessions, ok := s.sessions.(*memorySessionStore)
-	require.True(t, ok)
+	memSessions := memoryStore(t, s)
 	memSession := memSessions.requestor[session.RequestorToken]
 
 	memSession.Lock()
@@ -96,7 +125,7 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 	}()
 
 	go func() {
-		s.sessions.(*memorySessionStore).deleteExpired()
+		memSessions.deleteExpired()
 		deletingCompleted = true
 	}()
 
@@ -105,7 +134,7 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 
 	// Make a new session; this involves adding it to the memory session store.
 	go func() {
-		_, _ = s.newSession(context.Background(), irma.ActionDisclosing, req, nil, "")
+		_, _ = s.newSession(context.Background(), irma.ActionDisclosing, req, "", nil, "")
 		addingCompleted = true
 	}()
 
@@ -114,3 +143,536 @@ func TestMemoryStoreNoDeadlock(t *testing.T) {
 	require.True(t, addingCompleted)
 	require.False(t, deletingCompleted)
 }
+
+func TestSessionBindingCode(t *testing.T) {
+	s := newTestServer(t, sessionsConf(t))
+
+	disclose := studentIDRequest()
+	_, token, _, err := s.StartSession(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{BindingCode: true},
+		Request:              disclose,
+	}, nil)
+	require.NoError(t, err)
+
+	require.NoError(t, s.sessions.transaction(context.Background(), token, func(session *sessionData) (bool, error) {
+		code := session.Options.BindingCode
+		require.Len(t, code, 6)
+		require.Equal(t, code, session.frontendSessionStatus().BindingCode)
+		request, err := session.getClientRequest()
+		require.NoError(t, err)
+		require.Equal(t, code, request.Options.BindingCode)
+		return false, nil
+	}))
+
+	// Without opting in, no binding code is generated
+	_, token, _, err = s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	require.NoError(t, s.sessions.transaction(context.Background(), token, func(session *sessionData) (bool, error) {
+		require.Empty(t, session.Options.BindingCode)
+		return false, nil
+	}))
+}
+
+func TestSessionSchemesSnapshot(t *testing.T) {
+	s := newTestServer(t, sessionsConf(t))
+
+	_, token, _, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+
+	// Sessions use the snapshot of the schemes as of their start, also after being (de)serialized
+	snapshot := s.conf.IrmaConfiguration.Snapshot()
+	require.NotSame(t, s.conf.IrmaConfiguration, snapshot)
+	require.NoError(t, s.sessions.transaction(context.Background(), token, func(session *sessionData) (bool, error) {
+		require.Equal(t, snapshot.SnapshotID(), session.SchemesSnapshot)
+		require.Same(t, snapshot, session.irmaConfiguration(s.conf))
+		return false, nil
+	}))
+}
+
+func TestSessionPurpose(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.Purposes = map[string][]string{"requestor": {"kyc"}}
+	s := newTestServer(t, conf)
+
+	purpose := &irma.Purpose{Code: "kyc", Text: irma.TranslatedString{"en": "Identification of customers"}}
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{Purpose: purpose},
+		Request:              studentIDRequest(),
+	}
+	_, token, _, err := s.StartRequestorSession("requestor", request, nil)
+	require.NoError(t, err)
+
+	// The purpose is included in the session request for the IRMA app and in the result
+	require.NoError(t, s.sessions.transaction(context.Background(), token, func(session *sessionData) (bool, error) {
+		request, err := session.getClientRequest()
+		require.NoError(t, err)
+		require.Equal(t, purpose, request.Request.Base().Purpose)
+		return false, nil
+	}))
+	result, err := s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, purpose, result.Purpose)
+
+	// Purposes not allowed for the requestor are refused, as well as missing purposes
+	request.Purpose = &irma.Purpose{Code: "marketing", Text: purpose.Text}
+	_, _, _, err = s.StartRequestorSession("requestor", request, nil)
+	require.Error(t, err)
+	request.Purpose = nil
+	_, _, _, err = s.StartRequestorSession("requestor", request, nil)
+	require.Error(t, err)
+	_, _, _, err = s.StartRequestorSession("other", request, nil)
+	require.NoError(t, err)
+}
+
+func TestSignatureMessagePlaceholders(t *testing.T) {
+	clock := &testClock{now: time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)}
+	conf := sessionsConf(t)
+	conf.Clock = clock
+	s := newTestServer(t, conf)
+
+	// Placeholders are resolved when the session starts, in the request sent to the IRMA app and in the result
+	id := irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")
+	request := irma.NewSignatureRequest("Signed on {{today}}", id)
+	_, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+	require.Equal(t, "Signed on {{today}}", request.Message) // the request itself is left untouched
+	require.NoError(t, s.sessions.transaction(context.Background(), token, func(session *sessionData) (bool, error) {
+		request, err := session.getClientRequest()
+		require.NoError(t, err)
+		require.Equal(t, "Signed on 2024-03-01", request.Request.(*irma.SignatureRequest).Message)
+		return false, nil
+	}))
+	result, err := s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, "Signed on 2024-03-01", result.Message)
+
+	// Attributes disclosed in previous chained sessions can be used
+	studentID := "456"
+	disclosed := irma.AttributeConDisCon{{{{Type: id, Value: &studentID}}}}
+	_, token, _, err = s.startNextSession(irma.NewSignatureRequest("Student {{disclosed.studentID}}", id), nil, "", disclosed, "")
+	require.NoError(t, err)
+	result, err = s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, "Student 456", result.Message)
+
+	_, _, _, err = s.StartSession(irma.NewSignatureRequest("Student {{disclosed.studentID}}", id), nil)
+	require.Error(t, err)
+}
+
+type testClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func (c *testClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *testClock) advance(d time.Duration) {
+	c.Lock()
+	defer c.Unlock()
+	c.now = c.now.Add(d)
+}
+
+func TestSessionExpiryUsesClock(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	conf := sessionsConf(t)
+	conf.Clock = clock
+	s := newTestServer(t, conf)
+
+	_, token, _, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+
+	clock.advance(time.Duration(conf.MaxSessionLifetime-1) * time.Minute)
+	result, err := s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusInitialized, result.Status)
+
+	clock.advance(2 * time.Minute)
+	result, err = s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusTimeout, result.Status)
+}
+
+func TestMemoryStoreExpiry(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	conf := sessionsConf(t)
+	conf.Clock = clock
+	s := newTestServer(t, conf)
+
+	_, token, _, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	store := memoryStore(t, s)
+
+	// The result of a timed out session is kept for the session result lifetime, as in Redis
+	clock.advance(time.Duration(conf.MaxSessionLifetime+1) * time.Minute)
+	store.deleteExpired()
+	result, err := s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusTimeout, result.Status)
+
+	// Afterwards the session is unknown, also before it is deleted
+	clock.advance(time.Duration(conf.SessionResultLifetime) * time.Minute)
+	_, err = s.GetSessionResult(token)
+	require.IsType(t, &UnknownSessionError{}, err)
+	store.deleteExpired()
+	require.NotContains(t, store.requestor, token)
+}
+
+func TestCallbackOutbox(t *testing.T) {
+	var available atomic.Bool
+	var delivered atomic.Int32
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !available.Load() {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		delivered.Add(1)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer callbackServer.Close()
+
+	clock := &testClock{now: time.Now()}
+	conf := sessionsConf(t)
+	conf.Clock = clock
+	conf.CallbackOutbox = true
+	conf.CallbackRedeliveryInterval = 3600 // we invoke redelivery manually below
+	s := newTestServer(t, conf)
+
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{CallbackURL: callbackServer.URL},
+		Request:              studentIDRequest(),
+	}
+	_, token, _, err := s.StartRequestorSession("requestor", request, nil)
+	require.NoError(t, err)
+
+	// The callback fails, so the result is put in the outbox
+	require.NoError(t, s.CancelSession(token))
+	callbacks, err := s.UndeliveredCallbacks("requestor")
+	require.NoError(t, err)
+	require.Len(t, callbacks, 1)
+	require.Equal(t, token, callbacks[0].Token)
+	require.Equal(t, 1, callbacks[0].Attempts)
+	callbacks, err = s.UndeliveredCallbacks("other")
+	require.NoError(t, err)
+	require.Empty(t, callbacks)
+
+	// Redelivery keeps failing while the callback URL is unavailable
+	require.Error(t, s.RedeliverCallback(token))
+	callbacks, err = s.UndeliveredCallbacks("requestor")
+	require.NoError(t, err)
+	require.Equal(t, 2, callbacks[0].Attempts)
+
+	// Once the callback URL is available again, the result is delivered and removed from the outbox
+	available.Store(true)
+	s.redeliverCallbacks()
+	require.Equal(t, int32(1), delivered.Load())
+	callbacks, err = s.UndeliveredCallbacks("requestor")
+	require.NoError(t, err)
+	require.Empty(t, callbacks)
+	require.IsType(t, &UnknownSessionError{}, s.RedeliverCallback(token))
+
+	// Results are dropped from the outbox after its lifetime
+	available.Store(false)
+	_, token, _, err = s.StartRequestorSession("requestor", request, nil)
+	require.NoError(t, err)
+	require.NoError(t, s.CancelSession(token))
+	clock.advance(time.Duration(conf.CallbackOutboxLifetime+1) * time.Minute)
+	available.Store(true)
+	s.redeliverCallbacks()
+	require.Equal(t, int32(1), delivered.Load())
+	callbacks, err = s.UndeliveredCallbacks("requestor")
+	require.NoError(t, err)
+	require.Empty(t, callbacks)
+}
+
+func TestStoreStatistics(t *testing.T) {
+	s := newTestServer(t, sessionsConf(t))
+
+	_, token, _, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	require.NoError(t, s.CancelSession(token))
+
+	report := s.StoreStatistics().Report()
+	require.Equal(t, uint64(1), report.Operations["add"].Count)
+	require.NotZero(t, report.Operations["transaction"].Count)
+	require.Equal(t, report.Operations["transaction"].Count, report.Operations["handler"].Count)
+	require.Zero(t, report.Conflicts)
+
+	// A session that changed during a transaction is counted as a conflict
+	store := memoryStore(t, s)
+	err = s.sessions.transaction(context.Background(), token, func(session *sessionData) (bool, error) {
+		memSes := store.requestor[token]
+		memSes.Lock()
+		defer memSes.Unlock()
+		changed := *memSes.sessionData
+		memSes.sessionData = &changed
+		return true, nil
+	})
+	require.Error(t, err)
+	require.Equal(t, uint64(1), s.StoreStatistics().Report().Conflicts)
+}
+
+func TestMemoryStoreSnapshot(t *testing.T) {
+	clock := &testClock{now: time.Now()}
+	conf := sessionsConf(t)
+	conf.Clock = clock
+	conf.SessionSnapshotFile = filepath.Join(t.TempDir(), "sessions.json")
+	s, err := New(conf)
+	require.NoError(t, err)
+
+	_, token, _, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	_, cancelledToken, _, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	require.NoError(t, s.CancelSession(cancelledToken))
+	s.Stop()
+
+	// The sessions are restored by a new server using the same snapshot file
+	s, err = New(conf)
+	require.NoError(t, err)
+	result, err := s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusInitialized, result.Status)
+	result, err = s.GetSessionResult(cancelledToken)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusCancelled, result.Status)
+	s.Stop()
+
+	// Sessions that expired while the server was down are not restored
+	clock.advance(time.Duration(conf.SessionResultLifetime+1) * time.Minute)
+	s, err = New(conf)
+	require.NoError(t, err)
+	defer s.Stop()
+	result, err = s.GetSessionResult(token)
+	require.NoError(t, err)
+	require.Equal(t, irma.ServerStatusInitialized, result.Status)
+	_, err = s.GetSessionResult(cancelledToken)
+	require.IsType(t, &UnknownSessionError{}, err)
+	require.NotContains(t, memoryStore(t, s).requestor, cancelledToken)
+}
+
+func TestFrontendHandler(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.URL = "https://example.com/irma/"
+	conf.FrontendURL = "https://frontend.example.com/irma/"
+	s := newTestServer(t, conf)
+
+	qr, _, frontendRequest, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	clientToken := qr.URL[len(conf.URL+"session/"):]
+	require.Equal(t, conf.FrontendURL+"session/"+clientToken, frontendRequest.URL)
+
+	get := func(handler http.HandlerFunc, path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(irma.AuthorizationHeader, string(frontendRequest.Authorization))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	// The frontend endpoints are only served by the frontend handler
+	require.Equal(t, http.StatusOK, get(s.FrontendHandlerFunc(), "/session/"+clientToken+"/frontend/status"))
+	require.Equal(t, http.StatusNotFound, get(s.HandlerFunc(), "/session/"+clientToken+"/frontend/status"))
+	require.Equal(t, http.StatusNotFound, get(s.FrontendHandlerFunc(), "/session/"+clientToken+"/status"))
+	require.Equal(t, http.StatusOK, get(s.HandlerFunc(), "/session/"+clientToken+"/status"))
+}
+
+func TestPathPrefix(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.URL = "https://example.com"
+	conf.FrontendURL = "https://example.com/frontend"
+	conf.PathPrefix = "/irma"
+	s := newTestServer(t, conf)
+	require.Equal(t, "/irma/", conf.PathPrefix)
+	require.Equal(t, "https://example.com/irma/", conf.URL)
+	require.Equal(t, "https://example.com/frontend/irma/", conf.FrontendURL)
+
+	qr, _, frontendRequest, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	clientToken := qr.URL[len("https://example.com/irma/session/"):]
+	require.Equal(t, "https://example.com/frontend/irma/session/"+clientToken, frontendRequest.URL)
+
+	get := func(handler http.HandlerFunc, path string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set(irma.AuthorizationHeader, string(frontendRequest.Authorization))
+		rec := httptest.NewRecorder()
+		handler(rec, req)
+		return rec.Code
+	}
+
+	// The endpoints are served whether or not the prefix has been stripped from the request path
+	mux := http.NewServeMux()
+	mux.HandleFunc("/irma/", s.HandlerFunc())
+	require.Equal(t, http.StatusOK, get(mux.ServeHTTP, "/irma/session/"+clientToken+"/status"))
+	require.Equal(t, http.StatusOK, get(s.HandlerFunc(), "/session/"+clientToken+"/status"))
+	require.Equal(t, http.StatusOK, get(s.FrontendHandlerFunc(), "/irma/session/"+clientToken+"/frontend/status"))
+	require.Equal(t, http.StatusOK, get(s.FrontendHandlerFunc(), "/session/"+clientToken+"/frontend/status"))
+	require.Equal(t, http.StatusNotFound, get(s.HandlerFunc(), "/other/session/"+clientToken+"/status"))
+
+	conf = sessionsConf(t)
+	conf.PathPrefix = "irma/"
+	_, err = New(conf)
+	require.Error(t, err)
+}
+
+func TestClientAuthRotation(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.URL = "https://example.com/irma/"
+	conf.RotateClientAuth = true
+	s := newTestServer(t, conf)
+
+	qr, _, _, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	path := sessionPath(qr)
+
+	send := func(method, path, auth string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, strings.NewReader("{}"))
+		req.Header.Set(irma.MinVersionHeader, "2.8")
+		req.Header.Set(irma.MaxVersionHeader, "2.8")
+		req.Header.Set(irma.AuthorizationHeader, auth)
+		req.Header.Set(irma.AuthorizationRotationHeader, "true")
+		rec := httptest.NewRecorder()
+		s.HandlerFunc()(rec, req)
+		return rec
+	}
+
+	// Each response contains the authorization for the next request
+	rec := send(http.MethodGet, path+"/", "first")
+	require.Equal(t, http.StatusOK, rec.Code)
+	second := rec.Header().Get(irma.NextAuthorizationHeader)
+	require.NotEmpty(t, second)
+	require.NotEqual(t, "first", second)
+
+	// A retried request is answered from the cache, including the next authorization only if the
+	// retry presents the authorization of the cached request, and only once
+	rec = send(http.MethodGet, path+"/", "other")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Header().Get(irma.NextAuthorizationHeader))
+	rec = send(http.MethodGet, path+"/", "first")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Equal(t, second, rec.Header().Get(irma.NextAuthorizationHeader))
+	rec = send(http.MethodGet, path+"/", "first")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Header().Get(irma.NextAuthorizationHeader))
+
+	rec = send(http.MethodGet, path+"/request", second)
+	require.Equal(t, http.StatusOK, rec.Code)
+	third := rec.Header().Get(irma.NextAuthorizationHeader)
+	require.NotEmpty(t, third)
+	require.NotEqual(t, second, third)
+
+	// Previous authorizations can no longer be used
+	require.Equal(t, http.StatusForbidden, send(http.MethodPost, path+"/proofs", second).Code)
+	require.Equal(t, http.StatusForbidden, send(http.MethodPost, path+"/commitments", "first").Code)
+
+	// Rotation is disabled by default
+	s.conf.RotateClientAuth = false
+	qr, _, _, err = s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	path = sessionPath(qr)
+	rec = send(http.MethodGet, path+"/", "first")
+	require.Equal(t, http.StatusOK, rec.Code)
+	require.Empty(t, rec.Header().Get(irma.NextAuthorizationHeader))
+}
+
+func TestClientTLSBinding(t *testing.T) {
+	conf := sessionsConf(t)
+	s := newTestServer(t, conf)
+
+	srv := httptest.NewTLSServer(s.HandlerFunc())
+	defer srv.Close()
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	irma.SetTLSClientConfig(&tls.Config{RootCAs: roots})
+	defer irma.SetTLSClientConfig(nil)
+
+	qr, _, _, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	sessionURL := srv.URL + sessionPath(qr)
+
+	newTransport := func(binding bool) *irma.HTTPTransport {
+		transport := irma.NewHTTPTransport(sessionURL, false)
+		transport.SetHeader(irma.MinVersionHeader, "2.9")
+		transport.SetHeader(irma.MaxVersionHeader, "2.9")
+		transport.SetHeader(irma.AuthorizationHeader, "auth")
+		if binding {
+			require.NoError(t, transport.EnableTLSBinding())
+		}
+		return transport
+	}
+
+	var res string
+	client := newTransport(true)
+	require.NoError(t, client.Get("", &res))
+	require.NoError(t, client.Get("request", &res))
+
+	// The authorization cannot be used over connections that are not signed by the client's key
+	err = newTransport(false).Post("proofs", &res, struct{}{})
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, err.(*irma.SessionError).RemoteStatus)
+	err = newTransport(true).Post("commitments", &res, struct{}{})
+	require.Error(t, err)
+	require.Equal(t, http.StatusForbidden, err.(*irma.SessionError).RemoteStatus)
+
+	require.NoError(t, client.Get("request", &res))
+}
+
+func TestConcurrentRetries(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.URL = "https://example.com/irma/"
+	s := newTestServer(t, conf)
+
+	qr, _, _, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	path := sessionPath(qr)
+
+	// A slow endpoint behind the same middleware as the endpoints of the IRMA app, whose responses
+	// differ each time they are computed, as those of issuance sessions do
+	var computed atomic.Int32
+	r := chi.NewRouter()
+	r.Route("/session/{clientToken}", func(r chi.Router) {
+		r.Use(s.requestLockMiddleware)
+		r.Use(s.sessionMiddleware)
+		r.Use(s.cacheMiddleware)
+		r.Post("/proofs", func(w http.ResponseWriter, r *http.Request) {
+			n := computed.Add(1)
+			time.Sleep(50 * time.Millisecond)
+			server.WriteJson(w, n)
+		})
+	})
+
+	post := func(body string, responses chan<- *httptest.ResponseRecorder) {
+		rec := httptest.NewRecorder()
+		r.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, path+"/proofs", strings.NewReader(body)))
+		responses <- rec
+	}
+
+	// Interleaved duplicate POSTs are computed once, and all receive the same response
+	responses := make(chan *httptest.ResponseRecorder, 5)
+	for i := 0; i < 5; i++ {
+		go post("{}", responses)
+	}
+	var first string
+	for i := 0; i < 5; i++ {
+		rec := <-responses
+		require.Equal(t, http.StatusOK, rec.Code)
+		if first == "" {
+			first = rec.Body.String()
+		}
+		require.Equal(t, first, rec.Body.String())
+	}
+	require.Equal(t, int32(1), computed.Load())
+
+	// Concurrent POSTs of different messages are all computed, one at a time
+	for i := 0; i < 3; i++ {
+		go post(fmt.Sprintf(`{"n":%d}`, i), responses)
+	}
+	for i := 0; i < 3; i++ {
+		require.Equal(t, http.StatusOK, (<-responses).Code)
+	}
+	require.Equal(t, int32(4), computed.Load())
+	require.Empty(t, s.requestLocks)
+}
@@ -0,0 +1,175 @@
+package irmaserver
+
+import (
+	"context"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// sseDisconnectDelay is the time after the end of a session after which its server-sent events
+// connections are closed, giving clients the time to receive the final status.
+const sseDisconnectDelay = time.Second
+
+var errTooManySSEConnections = errors.New("too many server-sent events connections")
+
+// sseSubscriber is the kind of client of a server-sent events connection. The per-session limit
+// applies to each kind separately, so that e.g. requestors cannot lock out the IRMA app.
+type sseSubscriber int
+
+const (
+	sseSubscriberRevocation sseSubscriber = iota
+	sseSubscriberApp
+	sseSubscriberFrontend
+	sseSubscriberRequestor
+)
+
+type sseConnection struct {
+	token      irma.RequestorToken // empty for revocation connections
+	subscriber sseSubscriber
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// registerSSEConnection registers a new server-sent events connection of the specified subscriber
+// to the specified session, or to no session if token is empty, returning errTooManySSEConnections
+// if this exceeds the configured maximums. Must be called with activeSSEHandlersMutex locked.
+func (s *Server) registerSSEConnection(ctx context.Context, token irma.RequestorToken, subscriber sseSubscriber) (*sseConnection, error) {
+	if max := s.conf.MaxSSEConnections; max > 0 && s.sseConnectionCount >= max {
+		return nil, errTooManySSEConnections
+	}
+	if max := s.conf.MaxSSEConnectionsPerSession; max > 0 && token != "" && s.countSSEConnections(token, subscriber) >= max {
+		return nil, errTooManySSEConnections
+	}
+
+	conn := &sseConnection{token: token, subscriber: subscriber}
+	conn.ctx, conn.cancel = context.WithCancel(ctx)
+	if s.sseConnections[token] == nil {
+		s.sseConnections[token] = map[*sseConnection]struct{}{}
+	}
+	s.sseConnections[token][conn] = struct{}{}
+	s.sseConnectionCount++
+	return conn, nil
+}
+
+// countSSEConnections returns the number of connections of the specified subscriber to the session.
+// Must be called with activeSSEHandlersMutex locked.
+func (s *Server) countSSEConnections(token irma.RequestorToken, subscriber sseSubscriber) int {
+	count := 0
+	for conn := range s.sseConnections[token] {
+		if conn.subscriber == subscriber {
+			count++
+		}
+	}
+	return count
+}
+
+func (s *Server) unregisterSSEConnection(conn *sseConnection) {
+	conn.cancel()
+	s.activeSSEHandlersMutex.Lock()
+	defer s.activeSSEHandlersMutex.Unlock()
+	if _, ok := s.sseConnections[conn.token][conn]; !ok {
+		return
+	}
+	delete(s.sseConnections[conn.token], conn)
+	if len(s.sseConnections[conn.token]) == 0 {
+		delete(s.sseConnections, conn.token)
+	}
+	s.sseConnectionCount--
+}
+
+// closeSSEConnections closes the server-sent events connections of the specified session after
+// sseDisconnectDelay, as connections that subscribed just before the session finished would
+// otherwise remain open until the client disconnects. Must be called with activeSSEHandlersMutex locked.
+func (s *Server) closeSSEConnections(token irma.RequestorToken) {
+	var conns []*sseConnection
+	for conn := range s.sseConnections[token] {
+		conns = append(conns, conn)
+	}
+	if len(conns) == 0 {
+		return
+	}
+	time.AfterFunc(sseDisconnectDelay, func() {
+		for _, conn := range conns {
+			conn.cancel()
+		}
+	})
+}
+
+// serveSSE serves the server-sent events of the registered connection, sending heartbeats at the
+// configured interval, until the client disconnects or the connection is closed.
+func (s *Server) serveSSE(w http.ResponseWriter, r *http.Request, conn *sseConnection) {
+	defer s.unregisterSSEConnection(conn)
+
+	sw := &sseWriter{ResponseWriter: w}
+	if interval := s.conf.SSEHeartbeatInterval; interval > 0 {
+		done := make(chan struct{})
+		var wg sync.WaitGroup
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			sw.heartbeat(time.Duration(interval)*time.Second, done)
+		}()
+		defer func() {
+			close(done)
+			wg.Wait()
+		}()
+	}
+
+	s.serverSentEvents.ServeHTTP(sw, r.WithContext(conn.ctx))
+}
+
+// sseWriter serializes the writes of the server-sent events server and of the heartbeats.
+type sseWriter struct {
+	http.ResponseWriter
+	sync.Mutex
+	started bool
+}
+
+func (w *sseWriter) Write(b []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	return w.ResponseWriter.Write(b)
+}
+
+func (w *sseWriter) WriteHeader(status int) {
+	w.Lock()
+	defer w.Unlock()
+	w.ResponseWriter.WriteHeader(status)
+}
+
+func (w *sseWriter) Flush() {
+	w.Lock()
+	defer w.Unlock()
+	w.flush()
+	w.started = true
+}
+
+func (w *sseWriter) flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// heartbeat writes a comment, which clients ignore, at the specified interval once the event
+// stream has started, until done is closed.
+func (w *sseWriter) heartbeat(interval time.Duration, done <-chan struct{}) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			w.Lock()
+			if w.started {
+				_, _ = w.ResponseWriter.Write([]byte(": heartbeat\n\n"))
+				w.flush()
+			}
+			w.Unlock()
+		}
+	}
+}
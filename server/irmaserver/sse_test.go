@@ -0,0 +1,86 @@
+package irmaserver
+
+import (
+	"bufio"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestSSEConnections(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.URL = "https://example.com/irma/"
+	conf.EnableSSE = true
+	conf.MaxSSEConnectionsPerSession = 1
+	conf.SSEHeartbeatInterval = 1
+	s := newTestServer(t, conf)
+	srv := httptest.NewServer(s.HandlerFunc())
+	defer srv.Close()
+
+	qr, token, frontendRequest, err := s.StartSession(studentIDRequest(), nil)
+	require.NoError(t, err)
+	url := srv.URL + sessionPath(qr) + "/statusevents"
+
+	res, err := http.Get(url)
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	require.Equal(t, http.StatusOK, res.StatusCode)
+	lines := make(chan string)
+	go func() {
+		defer close(lines)
+		scanner := bufio.NewScanner(res.Body)
+		for scanner.Scan() {
+			lines <- scanner.Text()
+		}
+	}()
+
+	// Connections exceeding the maximum per session are refused
+	res2, err := http.Get(url)
+	require.NoError(t, err)
+	_ = res2.Body.Close()
+	require.Equal(t, http.StatusTooManyRequests, res2.StatusCode)
+
+	// The maximum applies to each kind of subscriber separately
+	req, err := http.NewRequest(http.MethodGet, srv.URL+sessionPath(qr)+"/frontend/statusevents", nil)
+	require.NoError(t, err)
+	req.Header.Set(irma.AuthorizationHeader, string(frontendRequest.Authorization))
+	res3, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer func() { _ = res3.Body.Close() }()
+	require.Equal(t, http.StatusOK, res3.StatusCode)
+
+	// Heartbeats are sent while the session is idle
+	timeout := time.After(3 * time.Second)
+	for heartbeat := false; !heartbeat; {
+		select {
+		case line := <-lines:
+			heartbeat = line == ": heartbeat"
+		case <-timeout:
+			t.Fatal("no heartbeat received")
+		}
+	}
+
+	// The connection receives the final status and is closed once the session is finished
+	require.NoError(t, s.CancelSession(token))
+	var received []string
+	timeout = time.After(3 * time.Second)
+	for closed := false; !closed; {
+		select {
+		case line, ok := <-lines:
+			received = append(received, line)
+			closed = !ok
+		case <-timeout:
+			t.Fatal("connection not closed")
+		}
+	}
+	require.Contains(t, received, `data: "CANCELLED"`)
+	require.Eventually(t, func() bool {
+		s.activeSSEHandlersMutex.Lock()
+		defer s.activeSSEHandlersMutex.Unlock()
+		return s.sseConnectionCount == 0 && len(s.sseConnections) == 0
+	}, time.Second, 10*time.Millisecond)
+}
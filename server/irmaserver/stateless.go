@@ -0,0 +1,279 @@
+package irmaserver
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base32"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// statelessSessionStore is a session store that keeps no state: the state of a new session is
+// serialized, compressed, and encrypted and authenticated with the stateless session key into its
+// client token, from which it is restored at each request of the IRMA app or the frontend.
+type statelessSessionStore struct {
+	conf *server.Configuration
+	aead cipher.AEAD
+
+	// Client tokens of sessions, so that tokens of finished sessions cannot be used again at this server
+	// instance. Other instances do not know of them, so that requestors must deduplicate callbacks
+	// (see server.IdempotencyKeyHeader).
+	sync.Mutex
+	tokens map[irma.RequestorToken]*statelessToken
+}
+
+// statelessToken keeps track of the use of a client token of the stateless session store.
+type statelessToken struct {
+	sync.Mutex
+	finished bool
+	expiry   time.Time
+}
+
+// Version of the format of stateless client tokens, prefixed to them and authenticated along with them
+const statelessTokenVersion byte = 1
+
+// Stateless client tokens are encoded using base32, whose alphabet is alphanumeric like that of
+// ordinary session tokens
+var statelessTokenEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+func newStatelessSessionStore(conf *server.Configuration) (*statelessSessionStore, error) {
+	block, err := aes.NewCipher(conf.StatelessSessionKey)
+	if err != nil {
+		return nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	return &statelessSessionStore{
+		conf:   conf,
+		aead:   aead,
+		tokens: make(map[irma.RequestorToken]*statelessToken),
+	}, nil
+}
+
+// validateStatelessRequest checks that the session request can be handled by the stateless session store,
+// which only supports disclosure sessions delivering their result to a callback URL, as the session
+// result is not available at the requestor endpoints.
+func validateStatelessRequest(request irma.RequestorRequest, pairingRequired bool) error {
+	base := request.Base()
+	switch {
+	case request.SessionRequest().Action() != irma.ActionDisclosing:
+		return errors.New("the stateless session store only supports disclosure sessions")
+	case base.CallbackURL == "":
+		return errors.New("the stateless session store requires a callbackUrl to deliver the session result to")
+	case base.NextSession != nil:
+		return errors.New("the stateless session store does not support chained sessions")
+	case len(request.SessionRequest().Base().Revocation) > 0:
+		return errors.New("the stateless session store does not support nonrevocation proofs")
+	case pairingRequired:
+		return errors.New("the stateless session store does not support pairing")
+	}
+	return nil
+}
+
+// add seals the session into its client token.
+func (s *statelessSessionStore) add(_ context.Context, session *sessionData) error {
+	token, err := s.seal(session)
+	if err != nil {
+		return err
+	}
+	session.ClientToken = token
+	s.conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken}).Debug("Session sealed into client token")
+	return nil
+}
+
+// transaction always fails, as requestor tokens do not contain the session state.
+func (s *statelessSessionStore) transaction(_ context.Context, t irma.RequestorToken, _ func(*sessionData) (bool, error)) error {
+	return &UnknownSessionError{t, ""}
+}
+
+// clientTransaction restores the session from the client token and passes it to the handler.
+// Changes made by the handler are not saved. Sessions that have timed out are unknown, so that
+// no callbacks are made for timed out sessions, and so are sessions that finished before.
+func (s *statelessSessionStore) clientTransaction(ctx context.Context, t irma.ClientToken, handler func(*sessionData) (bool, error)) error {
+	session, err := s.open(t)
+	if err != nil {
+		s.conf.Logger.WithError(err).Debug("Failed to open stateless client token")
+		return &UnknownSessionError{"", t}
+	}
+	if session.timedOut(s.conf) {
+		return &UnknownSessionError{"", t}
+	}
+
+	token := s.token(session)
+	token.Lock()
+	defer token.Unlock()
+	if token.finished {
+		return &UnknownSessionError{"", t}
+	}
+
+	session.requestID = server.RequestID(ctx)
+	_, err = handler(session)
+	if session.Status.Finished() {
+		token.finished = true
+	}
+	return err
+}
+
+// token returns the statelessToken of the session, which is kept until the session times out.
+func (s *statelessSessionStore) token(session *sessionData) *statelessToken {
+	s.Lock()
+	defer s.Unlock()
+	token, ok := s.tokens[session.RequestorToken]
+	if !ok {
+		token = &statelessToken{expiry: s.conf.Now().Add(session.timeout(s.conf))}
+		s.tokens[session.RequestorToken] = token
+	}
+	return token
+}
+
+// deleteExpired forgets the tokens of sessions that have timed out, as those are refused anyway.
+func (s *statelessSessionStore) deleteExpired() {
+	now := s.conf.Now()
+	s.Lock()
+	defer s.Unlock()
+	for requestorToken, token := range s.tokens {
+		if !now.Before(token.expiry) {
+			delete(s.tokens, requestorToken)
+		}
+	}
+}
+
+func (s *statelessSessionStore) subscribeUpdates(context.Context, irma.RequestorToken) (chan *sessionData, error) {
+	return nil, errors.New("session updates are not available in the stateless session store")
+}
+
+func (s *statelessSessionStore) requestorSessions(context.Context, string) ([]*sessionData, error) {
+	return nil, nil
+}
+
+func (s *statelessSessionStore) putOutbox(context.Context, *outboxEntry) error {
+	return errors.New("the stateless session store has no callback outbox")
+}
+
+func (s *statelessSessionStore) outbox(context.Context) ([]*outboxEntry, error) {
+	return nil, nil
+}
+
+func (s *statelessSessionStore) deleteOutbox(context.Context, irma.RequestorToken) error {
+	return nil
+}
+
+func (s *statelessSessionStore) stop() {}
+
+func (s *statelessSessionStore) seal(session *sessionData) (irma.ClientToken, error) {
+	// The client token is not part of the session state that is sealed into it
+	sealed := *session
+	sealed.ClientToken = ""
+	bts, err := json.Marshal(&sealed)
+	if err != nil {
+		return "", err
+	}
+
+	var compressed bytes.Buffer
+	w, err := flate.NewWriter(&compressed, flate.BestCompression)
+	if err != nil {
+		return "", err
+	}
+	if _, err = w.Write(bts); err != nil {
+		return "", err
+	}
+	if err = w.Close(); err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, s.aead.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	prefix := append([]byte{statelessTokenVersion}, nonce...)
+	token := s.aead.Seal(prefix, nonce, compressed.Bytes(), prefix[:1])
+	return irma.ClientToken(statelessTokenEncoding.EncodeToString(token)), nil
+}
+
+func (s *statelessSessionStore) open(t irma.ClientToken) (*sessionData, error) {
+	token, err := statelessTokenEncoding.DecodeString(string(t))
+	if err != nil {
+		return nil, err
+	}
+	nonceSize := s.aead.NonceSize()
+	if len(token) < 1+nonceSize || token[0] != statelessTokenVersion {
+		return nil, errors.New("not a stateless client token")
+	}
+	compressed, err := s.aead.Open(nil, token[1:1+nonceSize], token[1+nonceSize:], token[:1])
+	if err != nil {
+		return nil, err
+	}
+	bts, err := io.ReadAll(flate.NewReader(bytes.NewReader(compressed)))
+	if err != nil {
+		return nil, err
+	}
+
+	session := &sessionData{}
+	if err = json.Unmarshal(bts, session); err != nil {
+		return nil, err
+	}
+	session.ClientToken = t
+	return session, nil
+}
+
+// statelessMiddleware restores the state that a session of the stateless session store has after
+// the IRMA app retrieved the session request, as the store cannot save it. The protocol version is
+// negotiated again from the version headers that the IRMA app sends along with all its requests,
+// and the authorization header of the request is taken as the client authorization.
+func (s *Server) statelessMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		session := r.Context().Value("session").(*sessionData)
+		if session.Status == irma.ServerStatusInitialized {
+			var min, max irma.ProtocolVersion
+			if err := json.Unmarshal([]byte(r.Header.Get(irma.MinVersionHeader)), &min); err != nil {
+				server.WriteError(w, server.ErrorMalformedInput, err.Error())
+				return
+			}
+			if err := json.Unmarshal([]byte(r.Header.Get(irma.MaxVersionHeader)), &max); err != nil {
+				server.WriteError(w, server.ErrorMalformedInput, err.Error())
+				return
+			}
+			clientAuth := irma.ClientAuthorization(r.Header.Get(irma.AuthorizationHeader))
+			if rerr := session.restoreConnected(&min, &max, clientAuth, s.conf); rerr != nil {
+				server.WriteResponse(w, nil, rerr)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// restoreConnected puts the session in the state that handleGetClientRequest() leaves it in.
+func (session *sessionData) restoreConnected(min, max *irma.ProtocolVersion, clientAuth irma.ClientAuthorization, conf *server.Configuration) *irma.RemoteError {
+	sessionRequest := session.Rrequest.SessionRequest()
+	_, legacyErr := sessionRequest.Legacy()
+	session.LegacyCompatible = legacyErr == nil
+
+	var err error
+	if session.Version, err = session.chooseProtocolVersion(min, max); err != nil {
+		return server.RemoteError(server.ErrorProtocolVersion, "")
+	}
+	if clientAuth == "" && session.Version.Above(2, 7) {
+		return server.RemoteError(server.ErrorIrmaUnauthorized, "No authorization header provided")
+	}
+	session.ClientAuth = clientAuth
+	sessionRequest.Base().ProtocolVersion = session.Version
+	if err = session.setStatus(irma.ServerStatusConnected, conf); err != nil {
+		return server.RemoteError(server.ErrorUnexpectedRequest, err.Error())
+	}
+	return nil
+}
@@ -0,0 +1,61 @@
+package irmaserver
+
+import (
+	"context"
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStatelessSessionStore(t *testing.T) {
+	conf := sessionsConf(t)
+	conf.StoreType = "stateless"
+	conf.StatelessSessionKey = make([]byte, 31)
+	_, err := New(conf)
+	require.Error(t, err)
+	conf.StatelessSessionKey = make([]byte, 32)
+	s := newTestServer(t, conf)
+
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{CallbackURL: "http://localhost/callback"},
+		Request:              studentIDRequest(),
+	}
+	qr, token, _, err := s.StartSession(request, nil)
+	require.NoError(t, err)
+
+	// The session state is restored from the client token
+	clientToken := irma.ClientToken(qr.URL[strings.LastIndex(qr.URL, "/")+1:])
+	require.NoError(t, s.sessions.clientTransaction(context.Background(), clientToken, func(session *sessionData) (bool, error) {
+		require.Equal(t, token, session.RequestorToken)
+		require.Equal(t, clientToken, session.ClientToken)
+		require.Equal(t, irma.ServerStatusInitialized, session.Status)
+		require.Equal(t, request.CallbackURL, session.Rrequest.Base().CallbackURL)
+		return false, nil
+	}))
+
+	// Tampered or unknown tokens do not yield sessions
+	tampered := []byte(clientToken)
+	tampered[len(tampered)/2] ^= 1
+	for _, ct := range []irma.ClientToken{irma.ClientToken(tampered), "Sxqcpng37mAdBKgoAJXl"} {
+		err = s.sessions.clientTransaction(context.Background(), ct, func(*sessionData) (bool, error) { return false, nil })
+		require.IsType(t, &UnknownSessionError{}, err)
+	}
+
+	// Requestor tokens do not contain the session state
+	_, err = s.GetSessionResult(token)
+	require.IsType(t, &UnknownSessionError{}, err)
+
+	// Unsupported session requests are refused
+	_, _, _, err = s.StartSession(studentIDRequest(), nil)
+	require.Error(t, err)
+	_, _, _, err = s.StartSession(request, func(*server.SessionResult) {})
+	require.Error(t, err)
+	_, _, _, err = s.StartSession(&irma.IdentityProviderRequest{
+		RequestorBaseRequest: request.RequestorBaseRequest,
+		Request:              irma.NewIssuanceRequest(nil),
+	}, nil)
+	require.Error(t, err)
+}
@@ -0,0 +1,84 @@
+package irmaserver
+
+import (
+	"fmt"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/sirupsen/logrus"
+)
+
+// statusTransitions contains per session status the statuses that can follow it, as enforced by
+// setStatus() and transition(), through which all status changes go. Finished
+// statuses (see irma.ServerStatus.Finished()) cannot be followed by any status, so that e.g. the
+// result of a session cannot be overwritten once it is done.
+var statusTransitions = map[irma.ServerStatus][]irma.ServerStatus{
+	irma.ServerStatusInitialized: {irma.ServerStatusPairing, irma.ServerStatusConnected, irma.ServerStatusCancelled, irma.ServerStatusTimeout},
+	irma.ServerStatusPairing:     {irma.ServerStatusConnected, irma.ServerStatusCancelled, irma.ServerStatusTimeout},
+	irma.ServerStatusConnected:   {irma.ServerStatusDone, irma.ServerStatusCancelled, irma.ServerStatusTimeout},
+}
+
+// statusHook is invoked by setStatus() after each status change of a session.
+type statusHook func(session *sessionData, conf *server.Configuration)
+
+// statusHooks are invoked in order after each status change of a session.
+var statusHooks = []statusHook{
+	logStatusChange,
+	recordStatusChange,
+	func(session *sessionData, conf *server.Configuration) {
+		// Execute callback and handler if status is Finished
+		if session.Status.Finished() {
+			session.doResultCallback(conf)
+		}
+	},
+}
+
+// StatusTransitionError is returned when the status of a session is changed to a status that
+// cannot follow its current status.
+type StatusTransitionError struct {
+	From, To irma.ServerStatus
+}
+
+func (err *StatusTransitionError) Error() string {
+	return fmt.Sprintf("illegal session status transition from %s to %s", err.From, err.To)
+}
+
+// checkTransition returns a *StatusTransitionError if the specified status cannot follow the
+// current status of the session.
+func (session *sessionData) checkTransition(status irma.ServerStatus) error {
+	for _, s := range statusTransitions[session.Status] {
+		if s == status {
+			return nil
+		}
+	}
+	return &StatusTransitionError{From: session.Status, To: status}
+}
+
+// transition changes the status of the session to the specified status, if that can follow the
+// current status, without invoking the statusHooks.
+func (session *sessionData) transition(status irma.ServerStatus) error {
+	if err := session.checkTransition(status); err != nil {
+		return err
+	}
+	session.PrevStatus = session.Status
+	session.Status = status
+	session.Result.Status = status
+	return nil
+}
+
+// setStatus changes the status of the session to the specified status, if that can follow the
+// current status, and invokes the statusHooks.
+func (session *sessionData) setStatus(status irma.ServerStatus, conf *server.Configuration) error {
+	if err := session.transition(status); err != nil {
+		return err
+	}
+	for _, hook := range statusHooks {
+		hook(session, conf)
+	}
+	return nil
+}
+
+func logStatusChange(session *sessionData, conf *server.Configuration) {
+	conf.Logger.WithFields(logrus.Fields{"session": session.RequestorToken, "prevStatus": session.PrevStatus, "status": session.Status}).
+		Debug("Session status changed")
+}
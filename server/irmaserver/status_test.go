@@ -0,0 +1,120 @@
+package irmaserver
+
+import (
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+var allStatuses = []irma.ServerStatus{
+	irma.ServerStatusInitialized,
+	irma.ServerStatusPairing,
+	irma.ServerStatusConnected,
+	irma.ServerStatusCancelled,
+	irma.ServerStatusDone,
+	irma.ServerStatusTimeout,
+}
+
+func TestStatusTransitions(t *testing.T) {
+	legal := map[[2]irma.ServerStatus]bool{
+		{irma.ServerStatusInitialized, irma.ServerStatusPairing}:   true,
+		{irma.ServerStatusInitialized, irma.ServerStatusConnected}: true,
+		{irma.ServerStatusInitialized, irma.ServerStatusCancelled}: true,
+		{irma.ServerStatusInitialized, irma.ServerStatusTimeout}:   true,
+		{irma.ServerStatusPairing, irma.ServerStatusConnected}:     true,
+		{irma.ServerStatusPairing, irma.ServerStatusCancelled}:     true,
+		{irma.ServerStatusPairing, irma.ServerStatusTimeout}:       true,
+		{irma.ServerStatusConnected, irma.ServerStatusDone}:        true,
+		{irma.ServerStatusConnected, irma.ServerStatusCancelled}:   true,
+		{irma.ServerStatusConnected, irma.ServerStatusTimeout}:     true,
+	}
+
+	conf := sessionsConf(t)
+	for _, from := range allStatuses {
+		for _, to := range allStatuses {
+			session := &sessionData{Status: from, Result: &server.SessionResult{Status: from}, Rrequest: &irma.ServiceProviderRequest{}}
+			err := session.setStatus(to, conf)
+			if legal[[2]irma.ServerStatus{from, to}] {
+				require.NoError(t, err, "%s to %s", from, to)
+				require.Equal(t, to, session.Status)
+				require.Equal(t, to, session.Result.Status)
+				require.Equal(t, from, session.PrevStatus)
+				continue
+			}
+			var terr *StatusTransitionError
+			require.ErrorAs(t, err, &terr, "%s to %s", from, to)
+			require.Equal(t, &StatusTransitionError{From: from, To: to}, terr)
+			require.Equal(t, from, session.Status)
+			require.Equal(t, from, session.Result.Status)
+			require.Empty(t, session.PrevStatus)
+		}
+	}
+}
+
+func TestStatusHooks(t *testing.T) {
+	var changes [][2]irma.ServerStatus
+	defer func(hooks []statusHook) { statusHooks = hooks }(statusHooks)
+	statusHooks = append(statusHooks, func(session *sessionData, conf *server.Configuration) {
+		changes = append(changes, [2]irma.ServerStatus{session.PrevStatus, session.Status})
+	})
+
+	conf := sessionsConf(t)
+	session := &sessionData{Status: irma.ServerStatusInitialized, Result: &server.SessionResult{}, Rrequest: &irma.ServiceProviderRequest{}}
+	require.NoError(t, session.setStatus(irma.ServerStatusConnected, conf))
+	require.NoError(t, session.setStatus(irma.ServerStatusDone, conf))
+	require.Error(t, session.setStatus(irma.ServerStatusCancelled, conf))
+
+	// transition() changes the status without invoking the hooks
+	session = &sessionData{Status: irma.ServerStatusInitialized, Result: &server.SessionResult{}, Rrequest: &irma.ServiceProviderRequest{}}
+	require.NoError(t, session.transition(irma.ServerStatusTimeout))
+
+	require.Equal(t, [][2]irma.ServerStatus{
+		{irma.ServerStatusInitialized, irma.ServerStatusConnected},
+		{irma.ServerStatusConnected, irma.ServerStatusDone},
+	}, changes)
+}
+
+func TestFinishedSessionResultNotOverwritten(t *testing.T) {
+	conf := sessionsConf(t)
+	result := &server.SessionResult{Status: irma.ServerStatusDone, ProofStatus: irma.ProofStatusValid}
+	session := &sessionData{Status: irma.ServerStatusDone, Result: result, Rrequest: &irma.ServiceProviderRequest{}}
+
+	rerr := session.fail(server.ErrorUnknown, "", conf)
+	require.NotNil(t, rerr)
+	require.Equal(t, irma.ServerStatusDone, session.Status)
+	require.Same(t, result, session.Result)
+	require.Nil(t, session.Result.Err)
+
+	require.NoError(t, session.handleDelete(conf))
+	require.Equal(t, irma.ServerStatusDone, session.Status)
+	require.Same(t, result, session.Result)
+}
+
+func TestFrontendSessionStatusError(t *testing.T) {
+	conf := sessionsConf(t)
+	newSession := func() *sessionData {
+		return &sessionData{Status: irma.ServerStatusConnected, Result: &server.SessionResult{}, Rrequest: &irma.ServiceProviderRequest{}}
+	}
+
+	// Sessions cancelled due to an error carry its category, but not its details
+	for err, category := range map[server.Error]irma.SessionErrorCategory{
+		server.ErrorAttributesExpired: irma.SessionErrorAttributesExpired,
+		server.ErrorUnknownPublicKey:  irma.SessionErrorInvalidProofs,
+		server.ErrorProtocolVersion:   irma.SessionErrorClientUnsupported,
+		server.ErrorRevocation:        irma.SessionErrorServer,
+	} {
+		session := newSession()
+		session.fail(err, "details", conf)
+		status := session.frontendSessionStatus()
+		require.Equal(t, irma.ServerStatusCancelled, status.Status)
+		require.Equal(t, category, status.Error, err.Type)
+	}
+
+	// Sessions cancelled by the user or the requestor carry no error
+	session := newSession()
+	require.NoError(t, session.handleDelete(conf))
+	require.Empty(t, session.frontendSessionStatus().Error)
+	require.Empty(t, newSession().frontendSessionStatus().Error)
+}
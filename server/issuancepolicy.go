@@ -0,0 +1,127 @@
+package server
+
+import (
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/sirupsen/logrus"
+)
+
+// IssuancePolicy specifies default values and derived values for attributes of a credential type,
+// which the server fills in during issuance for attributes that are absent from the credential
+// request. This way requestors need not each implement the derivation of e.g. an over-18 flag
+// from a date of birth.
+type IssuancePolicy struct {
+	Credential irma.CredentialTypeIdentifier `json:"credential" mapstructure:"credential"`
+	// Default values of attributes, by attribute name
+	Defaults map[string]string `json:"defaults,omitempty" mapstructure:"defaults"`
+	// Attributes derived from other attributes of the same credential, applied after the defaults
+	Derivations []AttributeDerivation `json:"derivations,omitempty" mapstructure:"derivations"`
+}
+
+// AttributeDerivation derives the value of an attribute from another attribute of the credential.
+type AttributeDerivation struct {
+	Attribute string `json:"attribute" mapstructure:"attribute"`
+	From      string `json:"from" mapstructure:"from"`
+	// Transform applied to the value of the From attribute, see AttributeMappingRule
+	Transform string `json:"transform,omitempty" mapstructure:"transform"`
+}
+
+// IssuancePolicies contains the issuance policies of the server.
+type IssuancePolicies []IssuancePolicy
+
+// Validate checks that the policies refer to existing credential types and attributes that may be
+// specified in credential requests, and that the transforms of the derivations are valid.
+func (p IssuancePolicies) Validate(conf *irma.Configuration) error {
+	credentials := map[irma.CredentialTypeIdentifier]struct{}{}
+	for _, policy := range p {
+		credtype := conf.CredentialTypes[policy.Credential]
+		if credtype == nil {
+			return errors.Errorf("issuance policy for unknown credential type %s", policy.Credential)
+		}
+		if _, ok := credentials[policy.Credential]; ok {
+			return errors.Errorf("more than one issuance policy for credential type %s", policy.Credential)
+		}
+		credentials[policy.Credential] = struct{}{}
+
+		for name, value := range policy.Defaults {
+			attrtype, err := policyAttributeType(credtype, name)
+			if err != nil {
+				return err
+			}
+			if err = attrtype.DataType.Validate(value); err != nil {
+				return errors.WrapPrefix(err, "invalid default value for attribute "+name, 0)
+			}
+		}
+		for _, derivation := range policy.Derivations {
+			if _, err := policyAttributeType(credtype, derivation.Attribute); err != nil {
+				return err
+			}
+			if _, err := policyAttributeType(credtype, derivation.From); err != nil {
+				return err
+			}
+			if _, err := transformValue(derivation.Transform, "", false); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func policyAttributeType(credtype *irma.CredentialType, name string) (*irma.AttributeType, error) {
+	for _, attrtype := range credtype.AttributeTypes {
+		if attrtype.ID != name {
+			continue
+		}
+		if attrtype.RevocationAttribute || attrtype.RandomBlind {
+			return nil, errors.Errorf("attribute %s of credential type %s cannot be issued by the server", name, credtype.Identifier())
+		}
+		return attrtype, nil
+	}
+	return nil, errors.Errorf("credential type %s has no attribute %s", credtype.Identifier(), name)
+}
+
+// Apply fills in the absent attributes of the credential request for which the policy of its
+// credential type has a default or a derivation.
+func (p IssuancePolicies) Apply(conf *irma.Configuration, cred *irma.CredentialRequest, logger *logrus.Logger) error {
+	for _, policy := range p {
+		if policy.Credential != cred.CredentialTypeID {
+			continue
+		}
+		if cred.Attributes == nil {
+			cred.Attributes = map[string]string{}
+		}
+		log := logger.WithField("credential", cred.CredentialTypeID)
+
+		for name, value := range policy.Defaults {
+			if _, present := cred.Attributes[name]; !present {
+				log.WithField("attribute", name).Info("Issuing default attribute value")
+				cred.Attributes[name] = value
+			}
+		}
+		for _, derivation := range policy.Derivations {
+			if _, present := cred.Attributes[derivation.Attribute]; present {
+				continue
+			}
+			from, present := cred.Attributes[derivation.From]
+			if !present {
+				continue
+			}
+			value, err := transformValue(derivation.Transform, from, true)
+			if err != nil {
+				return errors.WrapPrefix(err, "failed to derive attribute "+derivation.Attribute, 0)
+			}
+			attrtype, err := policyAttributeType(conf.CredentialTypes[cred.CredentialTypeID], derivation.Attribute)
+			if err != nil {
+				return err
+			}
+			if boolean, ok := map[string]string{"yes": "true", "no": "false"}[value]; ok && attrtype.DataType == irma.AttributeDataTypeBoolean {
+				// The over:<n> transform yields "yes" or "no"
+				value = boolean
+			}
+			log.WithFields(logrus.Fields{"attribute": derivation.Attribute, "from": derivation.From}).
+				Info("Issuing derived attribute value")
+			cred.Attributes[derivation.Attribute] = value
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"path/filepath"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestIssuancePolicies(t *testing.T) {
+	conf, err := irma.NewConfiguration(
+		filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		irma.ConfigurationOptions{},
+	)
+	require.NoError(t, err)
+	require.NoError(t, conf.ParseFolder())
+
+	fullName := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+	policies := IssuancePolicies{{
+		Credential: fullName,
+		Defaults:   map[string]string{"prefix": "van"},
+		Derivations: []AttributeDerivation{
+			{Attribute: "firstname", From: "firstnames", Transform: "uppercase"},
+		},
+	}}
+	require.NoError(t, policies.Validate(conf))
+
+	cred := &irma.CredentialRequest{
+		CredentialTypeID: fullName,
+		Attributes:       map[string]string{"firstnames": "Johan Pieter", "familyname": "Stuivezand"},
+	}
+	require.NoError(t, policies.Apply(conf, cred, logrus.New()))
+	require.Equal(t, map[string]string{
+		"firstnames": "Johan Pieter",
+		"firstname":  "JOHAN PIETER",
+		"familyname": "Stuivezand",
+		"prefix":     "van",
+	}, cred.Attributes)
+
+	// Attributes present in the request are not overwritten
+	cred = &irma.CredentialRequest{
+		CredentialTypeID: fullName,
+		Attributes:       map[string]string{"firstnames": "Johan Pieter", "firstname": "Johan", "prefix": "de"},
+	}
+	require.NoError(t, policies.Apply(conf, cred, logrus.New()))
+	require.Equal(t, "Johan", cred.Attributes["firstname"])
+	require.Equal(t, "de", cred.Attributes["prefix"])
+
+	invalid := []IssuancePolicies{
+		{{Credential: irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.nonexisting")}},
+		{{Credential: fullName}, {Credential: fullName}},
+		{{Credential: fullName, Defaults: map[string]string{"nonexisting": "x"}}},
+		{{Credential: fullName, Derivations: []AttributeDerivation{{Attribute: "firstname", From: "firstnames", Transform: "reverse"}}}},
+		{{
+			Credential: irma.NewCredentialTypeIdentifier("irma-demo.stemmen.stempas"),
+			Defaults:   map[string]string{"votingnumber": "1"},
+		}},
+	}
+	for _, policies := range invalid {
+		require.Error(t, policies.Validate(conf))
+	}
+}
@@ -0,0 +1,147 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/sirupsen/logrus"
+)
+
+// IssuerKeyExpiry contains the expiry date of the public key of an issuer private key.
+type IssuerKeyExpiry struct {
+	Issuer  irma.IssuerIdentifier `json:"issuer"`
+	Counter uint                  `json:"counter"`
+	Expiry  time.Time             `json:"expiry"`
+}
+
+// IssuerKeyExpiries returns, for each issuer of which we have private keys, the expiry date of
+// the public key of its latest private key, and of its fallback key if configured.
+func (conf *Configuration) IssuerKeyExpiries() []IssuerKeyExpiry {
+	var expiries []IssuerKeyExpiry
+	irmaconf := conf.IrmaConfiguration.Snapshot()
+	for id := range irmaconf.Issuers {
+		sk, err := irmaconf.PrivateKeys.Latest(id)
+		if err != nil || sk == nil {
+			continue
+		}
+		counters := []uint{sk.Counter}
+		if fallback, ok := conf.FallbackKeys[id]; ok && fallback != sk.Counter {
+			counters = append(counters, fallback)
+		}
+		for _, counter := range counters {
+			pk, err := irmaconf.PublicKey(id, counter)
+			if err != nil || pk == nil {
+				continue
+			}
+			expiries = append(expiries, IssuerKeyExpiry{Issuer: id, Counter: counter, Expiry: time.Unix(pk.ExpiryDate, 0)})
+		}
+	}
+	sort.Slice(expiries, func(i, j int) bool {
+		if expiries[i].Issuer != expiries[j].Issuer {
+			return expiries[i].Issuer.String() < expiries[j].Issuer.String()
+		}
+		return expiries[i].Counter < expiries[j].Counter
+	})
+	return expiries
+}
+
+// keyExpiresSoon returns whether the key expires within the KeyExpiryWarning period.
+func (conf *Configuration) keyExpiresSoon(expiry time.Time) bool {
+	return conf.KeyExpiryWarning > 0 && conf.Now().AddDate(0, 0, conf.KeyExpiryWarning).After(expiry)
+}
+
+// CheckIssuerKeyExpiries logs a warning, and calls the KeyExpiryHandler if set, for each issuer key
+// whose public key expires within the KeyExpiryWarning period.
+func (conf *Configuration) CheckIssuerKeyExpiries() {
+	for _, expiry := range conf.IssuerKeyExpiries() {
+		if !conf.keyExpiresSoon(expiry.Expiry) {
+			continue
+		}
+		conf.Logger.WithFields(logrus.Fields{
+			"issuer":  expiry.Issuer,
+			"counter": expiry.Counter,
+			"expiry":  expiry.Expiry,
+		}).Warn("Public key of issuer private key expires soon, after which it can no longer be used for issuance")
+		if conf.KeyExpiryHandler != nil {
+			conf.KeyExpiryHandler(expiry)
+		}
+	}
+}
+
+// IssuanceKeyCounter returns the counter of the private key with which credentials of the issuer
+// are to be issued: its latest private key, or its fallback key if one is configured and the
+// public key of the latest key expires within the KeyExpiryWarning period.
+func (conf *Configuration) IssuanceKeyCounter(id irma.IssuerIdentifier) (uint, error) {
+	sk, err := conf.IrmaConfiguration.PrivateKeys.Latest(id)
+	if err != nil {
+		return 0, err
+	}
+	if sk == nil {
+		return 0, errors.Errorf("missing private key of issuer %s", id.String())
+	}
+	fallback, ok := conf.FallbackKeys[id]
+	if !ok || fallback == sk.Counter {
+		return sk.Counter, nil
+	}
+	pk, err := conf.IrmaConfiguration.Snapshot().PublicKey(id, sk.Counter)
+	if err != nil || pk == nil || !conf.keyExpiresSoon(time.Unix(pk.ExpiryDate, 0)) {
+		return sk.Counter, nil
+	}
+	conf.Logger.WithFields(logrus.Fields{"issuer": id, "counter": sk.Counter, "fallback": fallback}).
+		Debug("Latest issuer key expires soon, issuing with fallback key")
+	return fallback, nil
+}
+
+func (conf *Configuration) verifyFallbackKeys() error {
+	// viper lowercases configuration keys, so we have to un-lowercase them back.
+	for id := range conf.IrmaConfiguration.Issuers {
+		lc := irma.NewIssuerIdentifier(strings.ToLower(id.String()))
+		if lc == id {
+			continue
+		}
+		if counter, ok := conf.FallbackKeys[lc]; ok {
+			delete(conf.FallbackKeys, lc)
+			conf.FallbackKeys[id] = counter
+		}
+	}
+
+	if len(conf.FallbackKeys) > 0 && conf.KeyExpiryWarning == 0 {
+		return errors.New("fallback_keys requires key_expiry_warning to be set")
+	}
+	for id, counter := range conf.FallbackKeys {
+		if conf.IrmaConfiguration.Issuers[id] == nil {
+			return errors.Errorf("fallback key configured for unknown issuer %s", id)
+		}
+		if sk, err := conf.IrmaConfiguration.PrivateKeys.Get(id, counter); err != nil || sk == nil {
+			return errors.Errorf("missing private key %d of issuer %s configured as fallback key", counter, id)
+		}
+		pk, err := conf.IrmaConfiguration.PublicKey(id, counter)
+		if err != nil {
+			return err
+		}
+		if pk == nil {
+			return errors.Errorf("missing public key %d of issuer %s configured as fallback key", counter, id)
+		}
+	}
+	return nil
+}
+
+// WriteIssuerKeyExpiriesPrometheus writes the expiry dates of the issuer keys to w in the
+// Prometheus text exposition format.
+func WriteIssuerKeyExpiriesPrometheus(w io.Writer, expiries []IssuerKeyExpiry) error {
+	const name = "irma_issuer_public_key_expiry_timestamp_seconds"
+	if _, err := fmt.Fprintf(w, "# HELP %s Expiry date of the public key of issuer private keys.\n# TYPE %s gauge\n", name, name); err != nil {
+		return err
+	}
+	for _, expiry := range expiries {
+		if _, err := fmt.Fprintf(w, "%s{issuer=%q,counter=\"%d\"} %d\n", name, expiry.Issuer.String(), expiry.Counter, expiry.Expiry.Unix()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestIssuerKeyExpiry(t *testing.T) {
+	irmaconf, err := irma.NewConfiguration(
+		filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		irma.ConfigurationOptions{},
+	)
+	require.NoError(t, err)
+	require.NoError(t, irmaconf.ParseFolder())
+
+	// The public keys 1 and 2 of this issuer expire at 2030-01-01
+	issuer := irma.NewIssuerIdentifier("irma-demo.MijnOverheid")
+	var expiring []IssuerKeyExpiry
+	conf := &Configuration{
+		IrmaConfiguration: irmaconf,
+		Logger:            logrus.New(),
+		Clock:             fixedClock(time.Date(2029, 11, 1, 0, 0, 0, 0, time.UTC)),
+		KeyExpiryWarning:  30,
+		FallbackKeys:      map[irma.IssuerIdentifier]uint{issuer: 1},
+		KeyExpiryHandler:  func(expiry IssuerKeyExpiry) { expiring = append(expiring, expiry) },
+	}
+	require.NoError(t, conf.verifyFallbackKeys())
+
+	// Not yet within the warning period
+	counter, err := conf.IssuanceKeyCounter(issuer)
+	require.NoError(t, err)
+	require.Equal(t, uint(2), counter)
+	conf.CheckIssuerKeyExpiries()
+	require.Empty(t, expiring)
+
+	// Within the warning period, so issue with the fallback key
+	conf.Clock = fixedClock(time.Date(2029, 12, 15, 0, 0, 0, 0, time.UTC))
+	counter, err = conf.IssuanceKeyCounter(issuer)
+	require.NoError(t, err)
+	require.Equal(t, uint(1), counter)
+	conf.CheckIssuerKeyExpiries()
+	require.Contains(t, expiring, IssuerKeyExpiry{Issuer: issuer, Counter: 2, Expiry: time.Unix(1893456000, 0)})
+	require.Contains(t, expiring, IssuerKeyExpiry{Issuer: issuer, Counter: 1, Expiry: time.Unix(1893456000, 0)})
+
+	var buf bytes.Buffer
+	require.NoError(t, WriteIssuerKeyExpiriesPrometheus(&buf, conf.IssuerKeyExpiries()))
+	require.Contains(t, buf.String(), `irma_issuer_public_key_expiry_timestamp_seconds{issuer="irma-demo.MijnOverheid",counter="2"} 1893456000`)
+
+	// Fallback keys must exist
+	conf.FallbackKeys = map[irma.IssuerIdentifier]uint{issuer: 42}
+	require.Error(t, conf.verifyFallbackKeys())
+}
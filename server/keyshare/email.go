@@ -21,6 +21,38 @@ type EmailConfiguration struct {
 	EmailFrom       string `json:"email_from" mapstructure:"email_from"`
 	DefaultLanguage string `json:"default_language" mapstructure:"default_language"`
 	EmailAuth       smtp.Auth
+	// Number of times an EmailQueue retries delivering an email after it failed, with exponential backoff
+	EmailRetries int `json:"email_retries" mapstructure:"email_retries"`
+	// Delivers emails (if nil, emails are sent to the EmailServer using SMTP)
+	EmailSender EmailSender `json:"-"`
+}
+
+// EmailSender delivers composed email messages, allowing other providers than the SMTP server
+// of the EmailConfiguration to be plugged in.
+type EmailSender interface {
+	SendEmail(from string, to []string, message []byte) error
+}
+
+// SMTPSender is an EmailSender delivering emails to an SMTP server.
+type SMTPSender struct {
+	Server string
+	Auth   smtp.Auth
+}
+
+func (s SMTPSender) SendEmail(from string, to []string, message []byte) error {
+	return smtp.SendMail(s.Server, s.Auth, from, to, message)
+}
+
+// EmailEnabled returns whether emails can be sent, i.e. whether an email server or sender is configured.
+func (conf EmailConfiguration) EmailEnabled() bool {
+	return conf.EmailServer != "" || conf.EmailSender != nil
+}
+
+func (conf EmailConfiguration) sender() EmailSender {
+	if conf.EmailSender != nil {
+		return conf.EmailSender
+	}
+	return SMTPSender{Server: conf.EmailServer, Auth: conf.EmailAuth}
 }
 
 func ParseEmailTemplates(files, subjects map[string]string, defaultLanguage string) (map[string]*template.Template, error) {
@@ -65,6 +97,7 @@ func (conf EmailConfiguration) translateTemplate(templates map[string]*template.
 
 // SendEmail sends a templated email to the supplied email address(es).
 // When multiple recipients are specified, the email is sent as a BCC email.
+// Failed deliveries are not retried; use an EmailQueue for that.
 func (conf EmailConfiguration) SendEmail(
 	templates map[string]*template.Template,
 	subjects map[string]string,
@@ -72,25 +105,43 @@ func (conf EmailConfiguration) SendEmail(
 	to []string,
 	lang string,
 ) error {
+	from, message, err := conf.composeEmail(templates, subjects, templateData, to, lang)
+	if err != nil {
+		return err
+	}
+	if err = conf.sender().SendEmail(from, to, message); err != nil {
+		server.Logger.WithField("error", err).Error("Could not send email")
+	}
+	return err
+}
+
+// composeEmail renders the email in the given language, returning the sender address and the message.
+func (conf EmailConfiguration) composeEmail(
+	templates map[string]*template.Template,
+	subjects map[string]string,
+	templateData map[string]string,
+	to []string,
+	lang string,
+) (string, []byte, error) {
 	var content bytes.Buffer
 	if err := conf.translateTemplate(templates, lang).Execute(&content, templateData); err != nil {
 		server.Logger.WithField("error", err).Error("Could not generate email from template")
-		return err
+		return "", nil, err
 	}
 
 	from, err := ParseEmailAddress(conf.EmailFrom)
 	if err != nil {
 		// Email address comes from configuration, so this is a server error.
 		server.Logger.WithField("error", err).Error("From address in configuration is invalid")
-		return err
+		return "", nil, err
 	}
 
 	if len(to) == 0 {
-		return errors.New("no to address specified")
+		return "", nil, errors.New("no to address specified")
 	}
 
 	if _, err = mail.ParseAddressList(strings.Join(to, ",")); err != nil {
-		return ErrInvalidEmail
+		return "", nil, ErrInvalidEmail
 	}
 
 	message := bytes.Buffer{}
@@ -106,12 +157,7 @@ func (conf EmailConfiguration) SendEmail(
 	fmt.Fprintf(&message, "\r\n")
 	fmt.Fprint(&message, content.String())
 
-	if err := smtp.SendMail(conf.EmailServer, conf.EmailAuth, from.Address, to, message.Bytes()); err != nil {
-		server.Logger.WithField("error", err).Error("Could not send email")
-		return err
-	}
-
-	return nil
+	return from.Address, message.Bytes(), nil
 }
 
 // ParseEmailAddress parses a single RFC 5322 address, e.g. "Barry Gibbs <bg@example.com>"
@@ -125,7 +171,7 @@ func ParseEmailAddress(email string) (*mail.Address, error) {
 }
 
 func (conf EmailConfiguration) VerifyEmailServer() error {
-	if conf.EmailServer == "" {
+	if conf.EmailServer == "" || conf.EmailSender != nil {
 		return nil
 	}
 
@@ -2,8 +2,13 @@ package keyshare
 
 import (
 	"bytes"
+	"html/template"
 	"path/filepath"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
 
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/stretchr/testify/require"
@@ -46,3 +51,84 @@ func TestParseEmailTemplates(t *testing.T) {
 	require.NoError(t, templ[lang].Execute(&msg, map[string]string{"VerificationURL": "123"}))
 	require.Equal(t, "This is a test template 123", msg.String())
 }
+
+type failingEmailSender struct {
+	sync.Mutex
+	failures int
+	sent     [][]byte
+}
+
+func (s *failingEmailSender) SendEmail(_ string, _ []string, message []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	if s.failures > 0 {
+		s.failures--
+		return errors.New("temporary failure")
+	}
+	s.sent = append(s.sent, message)
+	return nil
+}
+
+func (s *failingEmailSender) sentCount() int {
+	s.Lock()
+	defer s.Unlock()
+	return len(s.sent)
+}
+
+func testEmailTemplates() (map[string]*template.Template, map[string]string) {
+	return map[string]*template.Template{"en": template.Must(template.New("en").Parse("Hello {{.Name}}"))},
+		map[string]string{"en": "subject"}
+}
+
+func TestSendEmail(t *testing.T) {
+	templates, subjects := testEmailTemplates()
+
+	sender := &failingEmailSender{}
+	conf := EmailConfiguration{EmailFrom: "test@example.com", DefaultLanguage: "en", EmailSender: sender, EmailRetries: 2}
+	require.NoError(t, conf.SendEmail(templates, subjects, map[string]string{"Name": "Alice"}, []string{"alice@example.com"}, "en"))
+	require.Equal(t, 1, sender.sentCount())
+	require.Contains(t, string(sender.sent[0]), "Hello Alice")
+
+	// Sending emails synchronously is not retried, so that callers do not wait for the backoff
+	sender = &failingEmailSender{failures: 1}
+	conf.EmailSender = sender
+	require.Error(t, conf.SendEmail(templates, subjects, map[string]string{"Name": "Alice"}, []string{"alice@example.com"}, "en"))
+	require.Equal(t, 0, sender.sentCount())
+}
+
+func TestEmailQueue(t *testing.T) {
+	defer func(backoff time.Duration) { emailRetryBackoff = backoff }(emailRetryBackoff)
+	emailRetryBackoff = time.Millisecond
+	templates, subjects := testEmailTemplates()
+
+	sender := &failingEmailSender{failures: 2}
+	conf := EmailConfiguration{EmailFrom: "test@example.com", DefaultLanguage: "en", EmailSender: sender, EmailRetries: 2}
+	q := NewEmailQueue(conf, 1)
+	require.NoError(t, q.SendEmail(templates, subjects, map[string]string{"Name": "Alice"}, []string{"alice@example.com"}, "en"))
+	require.Eventually(t, func() bool { return sender.sentCount() == 1 }, 5*time.Second, time.Millisecond)
+	require.Contains(t, string(sender.sent[0]), "Hello Alice")
+
+	// Errors in composing the email are returned immediately
+	require.ErrorIs(t, q.SendEmail(templates, subjects, nil, []string{"invalid"}, "en"), ErrInvalidEmail)
+
+	// Delivery is given up after EmailRetries retries
+	sender.Lock()
+	sender.failures = 3
+	sender.Unlock()
+	require.NoError(t, q.SendEmail(templates, subjects, nil, []string{"bob@example.com"}, "en"))
+	require.Eventually(t, func() bool {
+		sender.Lock()
+		defer sender.Unlock()
+		return sender.failures == 0
+	}, 5*time.Second, time.Millisecond)
+	require.Equal(t, 1, sender.sentCount())
+
+	// Queued emails are delivered when stopping the queue
+	require.NoError(t, q.SendEmail(templates, subjects, nil, []string{"bob@example.com"}, "en"))
+	q.Stop()
+	require.Equal(t, 2, sender.sentCount())
+
+	// Afterwards emails are refused, and stopping again has no effect
+	require.ErrorIs(t, q.SendEmail(templates, subjects, nil, []string{"bob@example.com"}, "en"), ErrEmailQueueStopped)
+	q.Stop()
+}
@@ -0,0 +1,126 @@
+package keyshare
+
+import (
+	"html/template"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server"
+)
+
+// Initial amount of time waited before retrying to deliver an email; doubled on each retry.
+// var so that tests may change it.
+var emailRetryBackoff = time.Second
+
+var (
+	ErrEmailQueueFull    = errors.New("email queue is full")
+	ErrEmailQueueStopped = errors.New("email queue is stopped")
+)
+
+// EmailQueue sends emails in the background, so that requests need not wait for the email server,
+// retrying failed deliveries as configured in the EmailConfiguration. Emails are kept in memory
+// only, so queued emails are lost when the process stops without invoking Stop().
+type EmailQueue struct {
+	conf   EmailConfiguration
+	emails chan queuedEmail
+	stop   chan struct{}
+	wg     sync.WaitGroup
+
+	// Guards closing the emails channel in Stop() against concurrent SendEmail() calls
+	mutex   sync.RWMutex
+	stopped bool
+}
+
+type queuedEmail struct {
+	from    string
+	to      []string
+	message []byte
+}
+
+// NewEmailQueue starts a new EmailQueue holding at most size emails awaiting delivery.
+func NewEmailQueue(conf EmailConfiguration, size int) *EmailQueue {
+	q := &EmailQueue{
+		conf:   conf,
+		emails: make(chan queuedEmail, size),
+		stop:   make(chan struct{}),
+	}
+	q.wg.Add(1)
+	go q.run()
+	return q
+}
+
+func (q *EmailQueue) run() {
+	defer q.wg.Done()
+	for email := range q.emails {
+		// already logged
+		_ = q.deliver(email)
+	}
+}
+
+// deliver sends the email using the EmailSender, retrying EmailRetries times if that fails.
+// Retrying is aborted when the queue is stopped.
+func (q *EmailQueue) deliver(email queuedEmail) error {
+	sender := q.conf.sender()
+	backoff := emailRetryBackoff
+	for attempt := 0; ; attempt++ {
+		err := sender.SendEmail(email.from, email.to, email.message)
+		if err == nil {
+			return nil
+		}
+		if attempt >= q.conf.EmailRetries {
+			server.Logger.WithField("error", err).Error("Could not send email")
+			return err
+		}
+		server.Logger.WithField("error", err).Warnf("Could not send email, retrying in %s", backoff)
+		select {
+		case <-time.After(backoff):
+		case <-q.stop:
+			server.Logger.WithField("error", err).Error("Could not send email, not retrying as sending emails is stopped")
+			return err
+		}
+		backoff *= 2
+	}
+}
+
+// SendEmail composes a templated email like EmailConfiguration.SendEmail() and queues it for
+// delivery. Errors in composing the email are returned immediately; delivery errors are only logged.
+// After Stop() has been called, ErrEmailQueueStopped is returned.
+func (q *EmailQueue) SendEmail(
+	templates map[string]*template.Template,
+	subjects map[string]string,
+	templateData map[string]string,
+	to []string,
+	lang string,
+) error {
+	from, message, err := q.conf.composeEmail(templates, subjects, templateData, to, lang)
+	if err != nil {
+		return err
+	}
+	q.mutex.RLock()
+	defer q.mutex.RUnlock()
+	if q.stopped {
+		return ErrEmailQueueStopped
+	}
+	select {
+	case q.emails <- queuedEmail{from: from, to: to, message: message}:
+		return nil
+	default:
+		return ErrEmailQueueFull
+	}
+}
+
+// Stop delivers the emails still in the queue, without retrying failed deliveries, and waits
+// until this is done. Calling Stop() more than once has no effect.
+func (q *EmailQueue) Stop() {
+	q.mutex.Lock()
+	if q.stopped {
+		q.mutex.Unlock()
+		return
+	}
+	q.stopped = true
+	close(q.stop)
+	close(q.emails)
+	q.mutex.Unlock()
+	q.wg.Wait()
+}
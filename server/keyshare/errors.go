@@ -12,6 +12,7 @@ var (
 	// Database errors:
 
 	ErrUserNotFound = errors.New("could not find specified user")
+	ErrUserChanged  = errors.New("user secrets were changed concurrently")
 	ErrDB           = errors.New("database error")
 
 	// Email errors:
@@ -32,6 +33,8 @@ func WriteError(w http.ResponseWriter, err error) {
 	switch err {
 	case ErrUserNotFound:
 		serverError = server.ErrorUserNotRegistered
+	case ErrUserChanged:
+		serverError = server.ErrorUserChanged
 	case ErrDB:
 		serverError = server.ErrorInternal
 	case ErrInvalidEmail:
@@ -59,6 +62,8 @@ func WriteError(w http.ResponseWriter, err error) {
 		serverError = server.ErrorUnexpectedRequest
 	case keysharecore.ErrWrongChallenge:
 		serverError = server.ErrorUnexpectedRequest
+	case keysharecore.ErrInvalidMigration:
+		serverError = server.ErrorInvalidRequest
 	default:
 		serverError = server.ErrorInternal
 	}
@@ -53,6 +53,35 @@ type Configuration struct {
 	// Decryption keys used for user secrets
 	StorageFallbackKeysDir string `json:"storage_fallback_keys_dir" mapstructure:"storage_fallback_keys_dir"`
 	StoragePrimaryKeyFile  string `json:"storage_primary_key_file" mapstructure:"storage_primary_key_file"`
+	// Key shared with the operator of another keyshare server, used to encrypt user secrets when
+	// users migrate from one to the other (migration is disabled if not present)
+	MigrationKeyFile string `json:"migration_key_file" mapstructure:"migration_key_file"`
+	migrationKey     *keysharecore.MigrationKey
+
+	// Policy for the PINs of new users and changed PINs, published at /client/pin_policy and
+	// enforced by IRMA apps, as the keyshare server only receives hashes of PINs (a zero minimum
+	// length means the default, a zero maximum length means no maximum)
+	PinMinLength             int `json:"pin_min_length" mapstructure:"pin_min_length"`
+	PinMaxLength             int `json:"pin_max_length" mapstructure:"pin_max_length"`
+	PinMinDistinctCharacters int `json:"pin_min_distinct_chars" mapstructure:"pin_min_distinct_chars"`
+	// Argon2id parameters with which PINs are hashed (all zero means the defaults). The PIN hashes
+	// of existing users are upgraded to these parameters when they next enter their PIN.
+	PinHashMemory      uint32 `json:"pin_hash_memory" mapstructure:"pin_hash_memory"` // in KiB
+	PinHashIterations  uint32 `json:"pin_hash_iterations" mapstructure:"pin_hash_iterations"`
+	PinHashParallelism uint8  `json:"pin_hash_parallelism" mapstructure:"pin_hash_parallelism"`
+
+	// If specified, the data stored about users can be exported at /admin/users/{username}/export,
+	// and migrated users imported without their PIN, by requests bearing this token in their
+	// Authorization header (leave empty to disable)
+	AdminToken string `json:"admin_token" mapstructure:"admin_token"`
+
+	// If specified, the keyshare secrets of new users are split with the cosigner at this URL, being
+	// a keyshare server of another operator, authenticating using CosignerToken
+	CosignerURL   string `json:"cosigner_url" mapstructure:"cosigner_url"`
+	CosignerToken string `json:"cosigner_token" mapstructure:"cosigner_token"`
+	// If specified, this keyshare server acts as cosigner for the keyshare server that authenticates
+	// using this token in the Authorization header of its requests to /cosigner (leave empty to disable)
+	CosigningToken string `json:"cosigning_token" mapstructure:"cosigning_token"`
 
 	// Keyshare attribute to issue during registration
 	KeyshareAttribute irma.AttributeTypeIdentifier `json:"keyshare_attribute" mapstructure:"keyshare_attribute"`
@@ -65,6 +94,19 @@ type Configuration struct {
 	registrationEmailTemplates map[string]*template.Template
 
 	VerificationURL map[string]string `json:"verification_url" mapstructure:"verification_url"`
+
+	// Translated notification emails sent to the email addresses of users when their account is
+	// blocked after too many wrong PINs, and when a device key is registered for their account
+	// (each of these notifications is disabled if not present)
+	PinBlockedEmailFiles         map[string]string `json:"pin_blocked_email_files" mapstructure:"pin_blocked_email_files"`
+	PinBlockedEmailSubjects      map[string]string `json:"pin_blocked_email_subjects" mapstructure:"pin_blocked_email_subjects"`
+	pinBlockedEmailTemplates     map[string]*template.Template
+	DeviceEnrolledEmailFiles     map[string]string `json:"device_enrolled_email_files" mapstructure:"device_enrolled_email_files"`
+	DeviceEnrolledEmailSubjects  map[string]string `json:"device_enrolled_email_subjects" mapstructure:"device_enrolled_email_subjects"`
+	deviceEnrolledEmailTemplates map[string]*template.Template
+	// Maximum number of notification emails awaiting delivery
+	EmailQueueSize int `json:"email_queue_size" mapstructure:"email_queue_size"`
+
 	// Amount of time user's email validation token is valid (in hours)
 	EmailTokenValidity int `json:"email_token_validity" mapstructure:"email_token_validity"`
 }
@@ -87,7 +129,7 @@ func readAESKey(filename string) (uint32, keysharecore.AESKey, error) {
 func validateConf(conf *Configuration) error {
 	// Setup email templates
 	var err error
-	if conf.EmailServer != "" {
+	if conf.EmailEnabled() {
 		conf.registrationEmailTemplates, err = keyshare.ParseEmailTemplates(
 			conf.RegistrationEmailFiles,
 			conf.RegistrationEmailSubjects,
@@ -99,6 +141,29 @@ func validateConf(conf *Configuration) error {
 		if _, ok := conf.VerificationURL[conf.DefaultLanguage]; !ok {
 			return server.LogError(errors.Errorf("Missing verification base url for default language"))
 		}
+		if len(conf.PinBlockedEmailFiles) > 0 {
+			conf.pinBlockedEmailTemplates, err = keyshare.ParseEmailTemplates(
+				conf.PinBlockedEmailFiles,
+				conf.PinBlockedEmailSubjects,
+				conf.DefaultLanguage,
+			)
+			if err != nil {
+				return server.LogError(errors.WrapPrefix(err, "PIN blocked email", 0))
+			}
+		}
+		if len(conf.DeviceEnrolledEmailFiles) > 0 {
+			conf.deviceEnrolledEmailTemplates, err = keyshare.ParseEmailTemplates(
+				conf.DeviceEnrolledEmailFiles,
+				conf.DeviceEnrolledEmailSubjects,
+				conf.DefaultLanguage,
+			)
+			if err != nil {
+				return server.LogError(errors.WrapPrefix(err, "device enrolled email", 0))
+			}
+		}
+		if conf.EmailQueueSize == 0 {
+			conf.EmailQueueSize = 100
+		}
 	}
 
 	if err = conf.VerifyEmailServer(); err != nil {
@@ -119,6 +184,32 @@ func validateConf(conf *Configuration) error {
 	}
 	conf.URL += "irma/"
 
+	if conf.MigrationKeyFile != "" {
+		id, key, err := readAESKey(conf.MigrationKeyFile)
+		if err != nil {
+			return server.LogError(errors.WrapPrefix(err, "failed to load migration key", 0))
+		}
+		conf.migrationKey = &keysharecore.MigrationKey{ID: id, Key: key}
+	}
+
+	if policy := conf.pinPolicy(); policy.MinLength < 0 || policy.MaxLength < 0 || policy.MinDistinctCharacters < 0 ||
+		policy.MaxLength != 0 && policy.MaxLength < policy.MinLength {
+		return server.LogError(errors.Errorf("Invalid PIN policy (minimum length %d, maximum length %d, minimum distinct characters %d)",
+			policy.MinLength, policy.MaxLength, policy.MinDistinctCharacters))
+	}
+	if params := conf.pinHashParameters(); params != (keysharecore.PinHashParameters{}) {
+		if err = params.Validate(); err != nil {
+			return server.LogError(errors.WrapPrefix(err, "invalid PIN hash parameters", 0))
+		}
+		if params.Memory < keysharecore.PinHashParametersDefault.Memory || params.Iterations < keysharecore.PinHashParametersDefault.Iterations {
+			conf.Logger.Warn("PIN hash parameters are weaker than the defaults")
+		}
+	}
+
+	if conf.CosignerURL != "" && conf.CosignerToken == "" {
+		return server.LogError(errors.New("cosigner_url requires cosigner_token"))
+	}
+
 	if conf.EmailTokenValidity == 0 {
 		conf.EmailTokenValidity = 168 // set default of 7 days
 	}
@@ -128,6 +219,26 @@ func validateConf(conf *Configuration) error {
 	return nil
 }
 
+func (conf *Configuration) pinPolicy() irma.KeysharePinPolicy {
+	policy := irma.KeysharePinPolicy{
+		MinLength:             conf.PinMinLength,
+		MaxLength:             conf.PinMaxLength,
+		MinDistinctCharacters: conf.PinMinDistinctCharacters,
+	}
+	if policy.MinLength == 0 {
+		policy.MinLength = irma.KeysharePinPolicyDefault.MinLength
+	}
+	return policy
+}
+
+func (conf *Configuration) pinHashParameters() keysharecore.PinHashParameters {
+	return keysharecore.PinHashParameters{
+		Memory:      conf.PinHashMemory,
+		Iterations:  conf.PinHashIterations,
+		Parallelism: conf.PinHashParallelism,
+	}
+}
+
 func setupDatabase(conf *Configuration) (DB, error) {
 	var db DB
 	switch conf.DBType {
@@ -172,13 +283,20 @@ func setupCore(conf *Configuration) (*keysharecore.Core, error) {
 		return nil, server.LogError(errors.WrapPrefix(err, "failed to load primary storage key", 0))
 	}
 
+	var cosigner keysharecore.Cosigner
+	if conf.CosignerURL != "" {
+		cosigner = newCosignerClient(conf.HTTPClient(), conf.CosignerURL, conf.CosignerToken)
+	}
+
 	core := keysharecore.NewKeyshareCore(&keysharecore.Configuration{
-		DecryptionKeyID: decKeyID,
-		DecryptionKey:   decKey,
-		JWTPrivateKeyID: conf.JwtKeyID,
-		JWTPrivateKey:   jwtPrivateKey,
-		JWTIssuer:       conf.JwtIssuer,
-		JWTPinExpiry:    conf.JwtPinExpiry,
+		DecryptionKeyID:   decKeyID,
+		DecryptionKey:     decKey,
+		JWTPrivateKeyID:   conf.JwtKeyID,
+		JWTPrivateKey:     jwtPrivateKey,
+		JWTIssuer:         conf.JwtIssuer,
+		JWTPinExpiry:      conf.JwtPinExpiry,
+		PinHashParameters: conf.pinHashParameters(),
+		Cosigner:          cosigner,
 	})
 	if conf.StorageFallbackKeysDir != "" {
 		dirEntries, err := os.ReadDir(conf.StorageFallbackKeysDir)
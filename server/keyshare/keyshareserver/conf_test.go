@@ -72,4 +72,15 @@ func TestConf(t *testing.T) {
 	conf.IssuerPrivateKeysPath = testdataPath // no private keys here
 	_, err = New(conf)
 	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.PinMinLength = 8
+	conf.PinMaxLength = 6
+	_, err = New(conf)
+	assert.Error(t, err)
+
+	conf = validConf(t)
+	conf.PinMinDistinctCharacters = -1
+	_, err = New(conf)
+	assert.Error(t, err)
 }
@@ -0,0 +1,257 @@
+package keyshareserver
+
+import (
+	"crypto/ecdsa"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/gabi/signed"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/keysharecore"
+	"github.com/privacybydesign/irmago/server"
+)
+
+var errCosigningDisabled = errors.New("cosigning is not enabled")
+
+type (
+	cosignerRequest struct {
+		Share     keysharecore.CosignerShare `json:"share,omitempty"`
+		PublicKey []byte                     `json:"publickey,omitempty"`
+		AuthJWT   string                     `json:"auth_jwt,omitempty"`
+		Token     string                     `json:"token,omitempty"`
+		Keys      []irma.PublicKeyIdentifier `json:"keys,omitempty"`
+		CommitID  uint64                     `json:"commit_id,omitempty"`
+		Challenge *big.Int                   `json:"challenge,omitempty"`
+	}
+
+	cosignerShareResponse struct {
+		Share keysharecore.CosignerShare `json:"share"`
+	}
+
+	cosignerChallengeResponse struct {
+		Challenge []byte `json:"challenge"`
+	}
+
+	cosignerAuthorizeResponse struct {
+		Token string `json:"token"`
+	}
+
+	cosignerPsResponse struct {
+		Ps []*big.Int `json:"ps"`
+	}
+
+	cosignerCommitmentsResponse struct {
+		Commitments []*gabi.ProofPCommitment `json:"commitments"`
+		CommitID    uint64                   `json:"commit_id"`
+	}
+
+	cosignerResponseResponse struct {
+		Response *big.Int `json:"response"`
+	}
+
+	// cosignerClient implements keysharecore.Cosigner by invoking the /cosigner endpoints of a
+	// remote cosigner.
+	cosignerClient struct {
+		transport *irma.HTTPTransport
+	}
+)
+
+func newCosignerClient(client *irma.HTTPClient, url, token string) *cosignerClient {
+	transport := client.NewTransport(url, false)
+	transport.SetHeader("Authorization", "Bearer "+token)
+	return &cosignerClient{transport: transport}
+}
+
+func (c *cosignerClient) NewShare(pk *ecdsa.PublicKey) (keysharecore.CosignerShare, error) {
+	pkBts, err := signed.MarshalPublicKey(pk)
+	if err != nil {
+		return nil, err
+	}
+	var res cosignerShareResponse
+	if err := c.transport.Post("cosigner/share", &res, cosignerRequest{PublicKey: pkBts}); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to request share from cosigner", 0)
+	}
+	return res.Share, nil
+}
+
+func (c *cosignerClient) Challenge(share keysharecore.CosignerShare) ([]byte, error) {
+	var res cosignerChallengeResponse
+	if err := c.transport.Post("cosigner/challenge", &res, cosignerRequest{Share: share}); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to request challenge from cosigner", 0)
+	}
+	return res.Challenge, nil
+}
+
+func (c *cosignerClient) Authorize(share keysharecore.CosignerShare, jwt string) (string, error) {
+	var res cosignerAuthorizeResponse
+	if err := c.transport.Post("cosigner/authorize", &res, cosignerRequest{Share: share, AuthJWT: jwt}); err != nil {
+		return "", errors.WrapPrefix(err, "failed to obtain authorization of cosigner", 0)
+	}
+	return res.Token, nil
+}
+
+func (c *cosignerClient) Ps(share keysharecore.CosignerShare, token string, keyIDs []irma.PublicKeyIdentifier) ([]*big.Int, error) {
+	var res cosignerPsResponse
+	req := cosignerRequest{Share: share, Token: token, Keys: keyIDs}
+	if err := c.transport.Post("cosigner/ps", &res, req); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to request Ps from cosigner", 0)
+	}
+	return res.Ps, nil
+}
+
+func (c *cosignerClient) Commitments(share keysharecore.CosignerShare, token string, keyIDs []irma.PublicKeyIdentifier) ([]*gabi.ProofPCommitment, uint64, error) {
+	var res cosignerCommitmentsResponse
+	req := cosignerRequest{Share: share, Token: token, Keys: keyIDs}
+	if err := c.transport.Post("cosigner/commitments", &res, req); err != nil {
+		return nil, 0, errors.WrapPrefix(err, "failed to request commitments from cosigner", 0)
+	}
+	return res.Commitments, res.CommitID, nil
+}
+
+func (c *cosignerClient) Response(share keysharecore.CosignerShare, token string, commitID uint64, challenge *big.Int) (*big.Int, error) {
+	var res cosignerResponseResponse
+	req := cosignerRequest{Share: share, Token: token, CommitID: commitID, Challenge: challenge}
+	if err := c.transport.Post("cosigner/response", &res, req); err != nil {
+		return nil, errors.WrapPrefix(err, "failed to request response from cosigner", 0)
+	}
+	if res.Response == nil {
+		return nil, errors.New("cosigner sent no response")
+	}
+	return res.Response, nil
+}
+
+// /cosigner/share
+func (s *Server) handleCosignerShare(w http.ResponseWriter, r *http.Request) {
+	var req cosignerRequest
+	if err := server.ParseBody(r, &req); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	pk, err := signed.UnmarshalPublicKey(req.PublicKey)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, "invalid public key")
+		return
+	}
+	share, err := s.core.NewCosignerShare(pk)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not generate cosigner share")
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteJson(w, cosignerShareResponse{Share: share})
+}
+
+// /cosigner/challenge
+func (s *Server) handleCosignerChallenge(w http.ResponseWriter, r *http.Request) {
+	var req cosignerRequest
+	if err := server.ParseBody(r, &req); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	challenge, err := s.core.CosignerChallenge(req.Share)
+	if err != nil {
+		s.writeCosignerError(w, "Could not generate cosigner challenge", err)
+		return
+	}
+	server.WriteJson(w, cosignerChallengeResponse{Challenge: challenge})
+}
+
+// /cosigner/authorize
+func (s *Server) handleCosignerAuthorize(w http.ResponseWriter, r *http.Request) {
+	var req cosignerRequest
+	if err := server.ParseBody(r, &req); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	token, err := s.core.CosignerAuthorize(req.Share, req.AuthJWT)
+	if err != nil {
+		s.writeCosignerError(w, "Could not authorize cosigner", err)
+		return
+	}
+	server.WriteJson(w, cosignerAuthorizeResponse{Token: token})
+}
+
+// /cosigner/ps
+func (s *Server) handleCosignerPs(w http.ResponseWriter, r *http.Request) {
+	var req cosignerRequest
+	if err := server.ParseBody(r, &req); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	ps, err := s.core.CosignerPs(req.Share, req.Token, req.Keys)
+	if err != nil {
+		s.writeCosignerError(w, "Could not generate cosigner Ps", err)
+		return
+	}
+	server.WriteJson(w, cosignerPsResponse{Ps: ps})
+}
+
+// /cosigner/commitments
+func (s *Server) handleCosignerCommitments(w http.ResponseWriter, r *http.Request) {
+	var req cosignerRequest
+	if err := server.ParseBody(r, &req); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	commitments, commitID, err := s.core.CosignerCommitments(req.Share, req.Token, req.Keys)
+	if err != nil {
+		s.writeCosignerError(w, "Could not generate cosigner commitments", err)
+		return
+	}
+	server.WriteJson(w, cosignerCommitmentsResponse{Commitments: commitments, CommitID: commitID})
+}
+
+// /cosigner/response
+func (s *Server) handleCosignerResponse(w http.ResponseWriter, r *http.Request) {
+	var req cosignerRequest
+	if err := server.ParseBody(r, &req); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if req.Challenge == nil {
+		server.WriteError(w, server.ErrorInvalidRequest, "missing challenge")
+		return
+	}
+	response, err := s.core.CosignerResponse(req.Share, req.Token, req.CommitID, req.Challenge)
+	if err != nil {
+		s.writeCosignerError(w, "Could not generate cosigner response", err)
+		return
+	}
+	server.WriteJson(w, cosignerResponseResponse{Response: response})
+}
+
+func (s *Server) writeCosignerError(w http.ResponseWriter, msg string, err error) {
+	s.conf.Logger.WithField("error", err).Warn(msg)
+	switch err {
+	case keysharecore.ErrInvalidJWT, keysharecore.ErrExpiredJWT, keysharecore.ErrWrongChallenge,
+		keysharecore.ErrChallengeResponseRequired:
+		server.WriteError(w, server.ErrorUnauthorized, err.Error())
+	case keysharecore.ErrInvalidCosignerShare, keysharecore.ErrKeyNotFound, keysharecore.ErrUnknownCommit,
+		keysharecore.ErrInvalidChallenge, keysharecore.ErrNoSuchKey:
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+	default:
+		server.WriteError(w, server.ErrorInternal, err.Error())
+	}
+}
+
+// cosigningAuthMiddleware restricts the /cosigner endpoints, served by this keyshare server when it
+// acts as the cosigner of another, to that keyshare server using the CosigningToken. Additionally,
+// the cosigner only contributes to the proofs of a user after the user's device authorized it.
+func (s *Server) cosigningAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.conf.CosigningToken == "" {
+			server.WriteError(w, server.ErrorUnsupported, errCosigningDisabled.Error())
+			return
+		}
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.CosigningToken)) != 1 {
+			server.WriteError(w, server.ErrorUnauthorized, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
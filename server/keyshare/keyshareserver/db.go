@@ -21,6 +21,9 @@ const (
 	eventTypePinCheckFailed  eventType = "PIN_CHECK_FAILED"
 	eventTypePinCheckBlocked eventType = "PIN_CHECK_BLOCKED"
 	eventTypeIRMASession     eventType = "IRMA_SESSION"
+	eventTypeMigrationExport eventType = "MIGRATION_EXPORT"
+	eventTypeMigrationImport eventType = "MIGRATION_IMPORT"
+	eventTypeDataExport      eventType = "DATA_EXPORT"
 )
 
 // DB is an interface used by server to manage data storage.
@@ -30,6 +33,8 @@ const (
 type DB interface {
 	AddUser(ctx context.Context, user *User) error
 	user(ctx context.Context, username string) (*User, error)
+	// updateUser stores the user, provided that its secrets were not changed since the user was
+	// read, and returns keyshare.ErrUserChanged otherwise.
 	updateUser(ctx context.Context, user *User) error
 
 	// reservePinTry reserves a pin check attempt, and additionally it returns:
@@ -45,6 +50,18 @@ type DB interface {
 	// default values (0 past attempts, no unblock date).
 	resetPinTries(ctx context.Context, user *User) error
 
+	// reserveMigrationPinTry is like reservePinTry, but for the PIN with which the user secrets of
+	// the specified username exported by another keyshare server are imported, the attempts of which
+	// are counted until the expiry of the export.
+	reserveMigrationPinTry(ctx context.Context, username string, expiry int64) (allowed bool, tries int, wait int64, err error)
+
+	// resetMigrationPinTries removes the attempts counted by reserveMigrationPinTry.
+	resetMigrationPinTries(ctx context.Context, username string) error
+
+	// setMigrated removes the secrets of the user after they were exported to another keyshare
+	// server, so that the enrollment can no longer be used here, and schedules the user for deletion.
+	setMigrated(ctx context.Context, user *User) error
+
 	// User activity registration.
 	// setSeen calls are used to track when a users account was last active, for deleting old accounts.
 	setSeen(ctx context.Context, user *User) error
@@ -52,6 +69,13 @@ type DB interface {
 
 	// Store email verification tokens on registration
 	addEmailVerification(ctx context.Context, user *User, emailAddress, token string, validity int) error
+
+	// emailAddresses returns the verified email addresses of the user that are not being deleted.
+	emailAddresses(ctx context.Context, user *User) ([]string, error)
+
+	// userData returns all data stored about the user, including users that deleted their account
+	// but have not yet been removed, for answering data access requests.
+	userData(ctx context.Context, username string) (*UserData, error)
 }
 
 // UserSecrets is a keysharecore.UserSecrets with DB (un)marshaling methods.
@@ -63,6 +87,8 @@ type User struct {
 	Language string
 	Secrets  UserSecrets
 	id       int64
+	// Secrets as stored when the user was read, to detect concurrent changes in updateUser
+	storedSecrets UserSecrets
 }
 
 // Scan implements sql/driver Scanner interface.
@@ -0,0 +1,108 @@
+package keyshareserver
+
+import (
+	"context"
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/keyshare"
+)
+
+var errAdminDisabled = errors.New("admin endpoints are not enabled")
+
+type (
+	// UserData contains all data stored about a user, as returned by the data export endpoint.
+	UserData struct {
+		Username string `json:"username"`
+		Language string `json:"language"`
+		// Whether the user is enrolled; false if the user deleted the account and it is awaiting removal
+		Enrolled     bool   `json:"enrolled"`
+		LastSeen     int64  `json:"last_seen"`
+		PinCounter   int    `json:"pin_counter"`
+		PinBlockDate int64  `json:"pin_block_date"`
+		DeleteOn     *int64 `json:"delete_on,omitempty"`
+
+		Emails             []UserDataEmail             `json:"emails"`
+		EmailVerifications []UserDataEmailVerification `json:"email_verifications"`
+		Logs               []UserDataLogEntry          `json:"logs"`
+	}
+
+	UserDataEmail struct {
+		Email        string `json:"email"`
+		RevalidateOn *int64 `json:"revalidate_on,omitempty"`
+		DeleteOn     *int64 `json:"delete_on,omitempty"`
+	}
+
+	// UserDataEmailVerification is a pending verification of an email address of the user. The
+	// verification token itself is not included.
+	UserDataEmailVerification struct {
+		Email  string `json:"email"`
+		Expiry int64  `json:"expiry"`
+	}
+
+	UserDataLogEntry struct {
+		Timestamp int64   `json:"timestamp"`
+		Event     string  `json:"event"`
+		Param     *string `json:"param,omitempty"`
+	}
+)
+
+// /admin/users/{username}/export
+func (s *Server) handleUserDataExport(w http.ResponseWriter, r *http.Request) {
+	data, err := s.exportUserData(r.Context(), chi.URLParam(r, "username"))
+	if err != nil {
+		// already logged
+		keyshare.WriteError(w, err)
+		return
+	}
+	server.WriteJson(w, data)
+}
+
+// exportUserData returns all data stored about the user, e.g. to answer data access requests under
+// the GDPR. The user secrets are not included, as they are encrypted with the storage key.
+func (s *Server) exportUserData(ctx context.Context, username string) (*UserData, error) {
+	data, err := s.db.userData(ctx, username)
+	if err != nil {
+		// already logged
+		return nil, err
+	}
+	// Users that deleted their account are not available as User, so for them no log entry is added
+	if data.Enrolled {
+		user, err := s.db.user(ctx, username)
+		if err != nil {
+			return nil, err
+		}
+		if err = s.db.addLog(ctx, user, eventTypeDataExport, nil); err != nil {
+			return nil, err
+		}
+	}
+	s.conf.Logger.WithField("username", username).Info("User data exported")
+	return data, nil
+}
+
+func (s *Server) adminAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if s.conf.AdminToken == "" {
+			server.WriteError(w, server.ErrorUnsupported, errAdminDisabled.Error())
+			return
+		}
+		if !s.adminAuthorized(r) {
+			server.WriteError(w, server.ErrorUnauthorized, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminAuthorized returns whether the request is authorized with the AdminToken of the operator.
+func (s *Server) adminAuthorized(r *http.Request) bool {
+	if s.conf.AdminToken == "" {
+		return false
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.AdminToken)) == 1
+}
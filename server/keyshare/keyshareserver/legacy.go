@@ -3,7 +3,6 @@ package keyshareserver
 import (
 	"context"
 	"crypto/ecdsa"
-	"fmt"
 	"net/http"
 
 	"github.com/go-errors/errors"
@@ -61,16 +60,16 @@ func (s *Server) registerPublicKey(ctx context.Context, user *User, pin string,
 		return irma.KeysharePinStatus{}, err
 	}
 	if !ok {
-		return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+		return irma.NewKeysharePinBlocked(wait), nil
 	}
 
 	var jwtt string
 	jwtt, secrets, err := s.core.SetUserPublicKey(keysharecore.UserSecrets(user.Secrets), pin, pk)
 	if err == keysharecore.ErrInvalidPin {
 		if tries == 0 {
-			return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+			return irma.NewKeysharePinBlocked(wait), nil
 		} else {
-			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", tries)}, nil
+			return irma.NewKeysharePinFailure(tries), nil
 		}
 	} else if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Could not set user public key")
@@ -88,7 +87,9 @@ func (s *Server) registerPublicKey(ctx context.Context, user *User, pin string,
 		return irma.KeysharePinStatus{}, err
 	}
 
-	return irma.KeysharePinStatus{Status: "success", Message: jwtt}, nil
+	s.notifyUser(ctx, user, s.conf.deviceEnrolledEmailTemplates, s.conf.DeviceEnrolledEmailSubjects)
+
+	return irma.KeysharePinStatus{Status: irma.KeysharePinStatusSuccess, Message: jwtt}, nil
 }
 
 func parseLegacyRegistrationMessage(msg irma.KeyshareEnrollment) (*irma.KeyshareEnrollmentData, *ecdsa.PublicKey, error) {
@@ -105,16 +106,16 @@ func (s *Server) updatePinLegacy(ctx context.Context, user *User, oldPin, newPin
 		return irma.KeysharePinStatus{}, err
 	}
 	if !ok {
-		return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+		return irma.NewKeysharePinBlocked(wait), nil
 	}
 
 	// Try to do the update
 	secrets, err := s.core.ChangePinLegacy(keysharecore.UserSecrets(user.Secrets), oldPin, newPin)
 	if err == keysharecore.ErrInvalidPin {
 		if tries == 0 {
-			return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+			return irma.NewKeysharePinBlocked(wait), nil
 		} else {
-			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", tries)}, nil
+			return irma.NewKeysharePinFailure(tries), nil
 		}
 	} else if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Could not change pin")
@@ -132,7 +133,7 @@ func (s *Server) updatePinLegacy(ctx context.Context, user *User, oldPin, newPin
 		return irma.KeysharePinStatus{}, err
 	}
 
-	return irma.KeysharePinStatus{Status: "success"}, nil
+	return irma.KeysharePinStatus{Status: irma.KeysharePinStatusSuccess}, nil
 }
 
 func (s *Server) handleChangePinLegacy(ctx context.Context, w http.ResponseWriter, msg irma.KeyshareChangePinData) {
@@ -1,9 +1,11 @@
 package keyshareserver
 
 import (
+	"bytes"
 	"context"
 	"sync"
 
+	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/keyshare"
 )
 
@@ -30,7 +32,7 @@ func (db *memoryDB) user(_ context.Context, username string) (*User, error) {
 	if !ok {
 		return nil, keyshare.ErrUserNotFound
 	}
-	return &User{Username: username, Secrets: UserSecrets(secrets)}, nil
+	return &User{Username: username, Secrets: secrets, storedSecrets: secrets}, nil
 }
 
 func (db *memoryDB) AddUser(_ context.Context, user *User) error {
@@ -44,6 +46,7 @@ func (db *memoryDB) AddUser(_ context.Context, user *User) error {
 		return errUserAlreadyExists
 	}
 	db.users[user.Username] = user.Secrets
+	user.storedSecrets = user.Secrets
 	return nil
 }
 
@@ -53,11 +56,16 @@ func (db *memoryDB) updateUser(_ context.Context, user *User) error {
 	defer db.Unlock()
 
 	// Check and update user.
-	_, exists := db.users[user.Username]
+	secrets, exists := db.users[user.Username]
 	if !exists {
 		return keyshare.ErrUserNotFound
 	}
+	if !bytes.Equal(secrets, user.storedSecrets) {
+		_ = server.LogWarning(keyshare.ErrUserChanged, "Failed to update user")
+		return keyshare.ErrUserChanged
+	}
 	db.users[user.Username] = user.Secrets
+	user.storedSecrets = user.Secrets
 	return nil
 }
 
@@ -71,6 +79,32 @@ func (db *memoryDB) resetPinTries(_ context.Context, _ *User) error {
 	return nil
 }
 
+func (db *memoryDB) reserveMigrationPinTry(_ context.Context, _ string, _ int64) (bool, int, int64, error) {
+	// Since this is a testing DB, implementing anything more than always allow creates hastle
+	return true, 1, 0, nil
+}
+
+func (db *memoryDB) resetMigrationPinTries(_ context.Context, _ string) error {
+	return nil
+}
+
+func (db *memoryDB) setMigrated(_ context.Context, user *User) error {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	secrets, exists := db.users[user.Username]
+	if !exists {
+		return keyshare.ErrUserNotFound
+	}
+	if !bytes.Equal(secrets, user.storedSecrets) {
+		_ = server.LogWarning(keyshare.ErrUserChanged, "Failed to mark user as migrated")
+		return keyshare.ErrUserChanged
+	}
+	delete(db.users, user.Username)
+	return nil
+}
+
 func (db *memoryDB) setSeen(_ context.Context, _ *User) error {
 	// We don't need to do anything here, as this information cannot be extracted locally
 	return nil
@@ -85,3 +119,26 @@ func (db *memoryDB) addEmailVerification(_ context.Context, _ *User, _, _ string
 	// We don't need to do anything here, as this information cannot be extracted locally
 	return nil
 }
+
+func (db *memoryDB) emailAddresses(_ context.Context, _ *User) ([]string, error) {
+	// Email addresses are not stored here, as they are only added using the myirmaserver
+	return nil, nil
+}
+
+func (db *memoryDB) userData(_ context.Context, username string) (*UserData, error) {
+	// Ensure access to database is single-threaded
+	db.Lock()
+	defer db.Unlock()
+
+	// Only the existence of the user is known here, as nothing else is stored
+	if _, ok := db.users[username]; !ok {
+		return nil, keyshare.ErrUserNotFound
+	}
+	return &UserData{
+		Username:           username,
+		Enrolled:           true,
+		Emails:             []UserDataEmail{},
+		EmailVerifications: []UserDataEmailVerification{},
+		Logs:               []UserDataLogEntry{},
+	}, nil
+}
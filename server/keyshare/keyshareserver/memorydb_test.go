@@ -4,6 +4,7 @@ import (
 	"context"
 	"testing"
 
+	"github.com/privacybydesign/irmago/server/keyshare"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -30,6 +31,16 @@ func TestMemoryDBUserManagement(t *testing.T) {
 	err = db.updateUser(context.Background(), nuser)
 	assert.NoError(t, err)
 
+	// Updates based on secrets that were changed in the meantime are refused
+	concurrent, err := db.user(context.Background(), "testuser")
+	require.NoError(t, err)
+	nuser.Secrets = UserSecrets{1}
+	require.NoError(t, db.updateUser(context.Background(), nuser))
+	concurrent.Secrets = UserSecrets{2}
+	assert.Equal(t, keyshare.ErrUserChanged, db.updateUser(context.Background(), concurrent))
+	nuser.Secrets = UserSecrets{3}
+	assert.NoError(t, db.updateUser(context.Background(), nuser))
+
 	err = db.addEmailVerification(context.Background(), nuser, "test@example.com", "testtoken", 168)
 	assert.NoError(t, err)
 
@@ -0,0 +1,155 @@
+package keyshareserver
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/keysharecore"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/keyshare"
+)
+
+var (
+	errMigrationDisabled   = errors.New("keyshare server migration is not enabled")
+	errMigrationPinBlocked = errors.New("too many incorrect PINs for migrated user secrets")
+)
+
+const (
+	// Validity of exported user secrets, after which they can no longer be imported
+	migrationValidity = 24 * time.Hour
+
+	// Maximum number of imports of migrated users per client IP address per minute
+	migrationImportRateLimit = 10
+)
+
+// /users/migrate/export
+func (s *Server) handleMigrationExport(w http.ResponseWriter, r *http.Request) {
+	if s.conf.migrationKey == nil {
+		server.WriteError(w, server.ErrorUnsupported, errMigrationDisabled.Error())
+		return
+	}
+
+	// Fetch from context
+	user := r.Context().Value("user").(*User)
+	authorization := r.Context().Value("authorization").(string)
+
+	msg, err := s.exportUser(r.Context(), user, authorization)
+	if err != nil {
+		// already logged
+		keyshare.WriteError(w, err)
+		return
+	}
+	server.WriteJson(w, msg)
+}
+
+// exportUser exports the user secrets, encrypted with the migration key shared with the operator of
+// the keyshare server to which the user migrates, so that the user keeps their PIN and credentials.
+// Afterwards the user is marked as migrated, so that the secrets are not kept by both operators.
+func (s *Server) exportUser(ctx context.Context, user *User, authorization string) (*irma.KeyshareMigration, error) {
+	expiry := time.Now().Add(migrationValidity)
+	secrets, err := s.core.ExportUserSecrets(keysharecore.UserSecrets(user.Secrets), authorization, user.Username, expiry, *s.conf.migrationKey)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Warn("Could not export user secrets for migration")
+		return nil, err
+	}
+	if err = s.db.addLog(ctx, user, eventTypeMigrationExport, nil); err != nil {
+		// already logged
+		return nil, err
+	}
+	if err = s.db.setMigrated(ctx, user); err != nil {
+		// already logged
+		return nil, err
+	}
+	s.conf.Logger.WithField("username", user.Username).Info("User secrets exported for migration to another keyshare server")
+	return &irma.KeyshareMigration{
+		Username: user.Username,
+		Language: user.Language,
+		Secrets:  secrets,
+		Expiry:   expiry.Unix(),
+	}, nil
+}
+
+// /client/migrate
+func (s *Server) handleMigrationImport(w http.ResponseWriter, r *http.Request) {
+	if s.conf.migrationKey == nil {
+		server.WriteError(w, server.ErrorUnsupported, errMigrationDisabled.Error())
+		return
+	}
+
+	var msg irma.KeyshareMigration
+	if err := server.ParseBody(r, &msg); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if msg.Username == "" || len(msg.Username) > 64 {
+		server.WriteError(w, server.ErrorInvalidRequest, "invalid username")
+		return
+	}
+
+	tries, wait, err := s.importUser(r.Context(), msg, s.adminAuthorized(r))
+	if err == keysharecore.ErrInvalidPin {
+		server.WriteError(w, server.ErrorUnauthorized, strconv.Itoa(tries))
+		return
+	}
+	if err == errMigrationPinBlocked {
+		server.WriteError(w, server.ErrorTooManyRequests, strconv.FormatInt(wait, 10))
+		return
+	}
+	if err == errUserAlreadyExists || err == keysharecore.ErrMigrationExpired {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if err != nil {
+		// already logged
+		keyshare.WriteError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// importUser imports the user secrets exported by another keyshare server. Unless the operator
+// imports them, the user must authenticate with the PIN contained in the message, the attempts of
+// which are limited like those of normal PIN checks. If the PIN is incorrect, the number of tries
+// left is returned; if the user is blocked for too many incorrect PINs, errMigrationPinBlocked is
+// returned along with the number of seconds the user must wait.
+func (s *Server) importUser(ctx context.Context, msg irma.KeyshareMigration, operator bool) (int, int64, error) {
+	secrets, err := s.core.ImportUserSecrets(msg.Secrets, msg.Username, time.Unix(msg.Expiry, 0), *s.conf.migrationKey)
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Warn("Could not import migrated user secrets")
+		return 0, 0, err
+	}
+	if !operator {
+		ok, tries, wait, err := s.db.reserveMigrationPinTry(ctx, msg.Username, msg.Expiry)
+		if err != nil {
+			// already logged
+			return 0, 0, err
+		}
+		if !ok {
+			return 0, wait, errMigrationPinBlocked
+		}
+		if err = s.core.VerifyPin(secrets, msg.Pin); err != nil {
+			s.conf.Logger.WithField("username", msg.Username).Warn("Invalid PIN for migrated user secrets")
+			if err == keysharecore.ErrInvalidPin && tries == 0 {
+				return 0, wait, errMigrationPinBlocked
+			}
+			return tries, 0, err
+		}
+		// Do not send error to user; the attempts are removed anyway once the export expires
+		_ = s.db.resetMigrationPinTries(ctx, msg.Username)
+	}
+	user := &User{Username: msg.Username, Language: msg.Language, Secrets: UserSecrets(secrets)}
+	if err = s.db.AddUser(ctx, user); err != nil {
+		// already logged
+		return 0, 0, err
+	}
+	if err = s.db.addLog(ctx, user, eventTypeMigrationImport, nil); err != nil {
+		// already logged
+		return 0, 0, err
+	}
+	s.conf.Logger.WithField("username", user.Username).Info("User migrated from another keyshare server")
+	return 0, 0, nil
+}
@@ -0,0 +1,30 @@
+package keyshareserver
+
+import (
+	"context"
+	"html/template"
+
+	"github.com/sirupsen/logrus"
+)
+
+// notifyUser sends the notification email with the specified templates to the email addresses
+// of the user, if any, in the background. Users are not bothered with failures, so errors are
+// only logged.
+func (s *Server) notifyUser(ctx context.Context, user *User, templates map[string]*template.Template, subjects map[string]string) {
+	if templates == nil || s.emailQueue == nil {
+		return
+	}
+	addresses, err := s.db.emailAddresses(ctx, user)
+	if err != nil || len(addresses) == 0 {
+		// already logged
+		return
+	}
+
+	lang := user.Language
+	if lang == "" {
+		lang = s.conf.DefaultLanguage
+	}
+	if err = s.emailQueue.SendEmail(templates, subjects, map[string]string{}, addresses, lang); err != nil {
+		s.conf.Logger.WithFields(logrus.Fields{"username": user.Username, "error": err}).Error("Could not send notification email")
+	}
+}
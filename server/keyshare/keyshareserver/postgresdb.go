@@ -80,6 +80,7 @@ func (db *postgresDB) AddUser(ctx context.Context, user *User) error {
 		return keyshare.ErrDB
 	}
 	user.id = id
+	user.storedSecrets = user.Secrets
 	return nil
 }
 
@@ -98,31 +99,44 @@ func (db *postgresDB) user(ctx context.Context, username string) (*User, error)
 		}
 		return nil, keyshare.ErrDB
 	}
+	result.storedSecrets = result.Secrets
 	return &result, nil
 }
 
 func (db *postgresDB) updateUser(ctx context.Context, user *User) error {
-	if err := db.db.ExecUserContext(
+	c, err := db.db.ExecCountContext(
 		ctx,
-		"UPDATE irma.users SET username = $1, language = $2, coredata = $3 WHERE id=$4",
+		"UPDATE irma.users SET username = $1, language = $2, coredata = $3 WHERE id = $4 AND coredata = $5",
 		user.Username,
 		user.Language,
 		user.Secrets,
 		user.id,
-	); err != nil {
+		user.storedSecrets,
+	)
+	if err != nil {
 		server.LogError(err, "Failed to update user")
-		if err == keyshare.ErrUserNotFound {
+		return keyshare.ErrDB
+	}
+	if c != 1 {
+		// Either the user was deleted or its secrets were changed in the meantime
+		if err = db.db.QueryUserContext(ctx, "SELECT id FROM irma.users WHERE id = $1", nil, user.id); err != nil {
+			if err != keyshare.ErrUserNotFound {
+				server.LogError(err, "Failed to query user")
+				return keyshare.ErrDB
+			}
 			return err
 		}
-		return keyshare.ErrDB
+		_ = server.LogWarning(keyshare.ErrUserChanged, "Failed to update user")
+		return keyshare.ErrUserChanged
 	}
+	user.storedSecrets = user.Secrets
 	return nil
 }
 
 func (db *postgresDB) reservePinTry(ctx context.Context, user *User) (bool, int, int64, error) {
 	// Check that account is not blocked already, and if not,
 	//  update pinCounter and pinBlockDate
-	uprows, err := db.db.QueryContext(ctx, `
+	return db.reservePinTryQuery(ctx, `
 		UPDATE irma.users
 		SET pin_counter = pin_counter+1,
 			pin_block_date = $1 + CASE WHEN pin_counter-$3 < 0 THEN 0
@@ -130,10 +144,45 @@ func (db *postgresDB) reservePinTry(ctx context.Context, user *User) (bool, int,
 			                      END
 		WHERE id=$4 AND pin_block_date<=$1 AND coredata IS NOT NULL
 		RETURNING pin_counter, pin_block_date`,
+		"SELECT pin_block_date FROM irma.users WHERE id=$1 AND coredata IS NOT NULL",
+		user.id,
+	)
+}
+
+func (db *postgresDB) reserveMigrationPinTry(ctx context.Context, username string, expiry int64) (bool, int, int64, error) {
+	// Start counting attempts for this username if we did not already, and keep counting them
+	// until the expiry of the latest export
+	if _, err := db.db.ExecContext(ctx, `
+		INSERT INTO irma.migration_pin_tries (username, pin_counter, pin_block_date, expiry) VALUES ($1, 0, 0, $2)
+		ON CONFLICT (username) DO UPDATE SET expiry = GREATEST(irma.migration_pin_tries.expiry, EXCLUDED.expiry)`,
+		username,
+		expiry,
+	); err != nil {
+		server.LogError(err, "Failed to register migration pin tries")
+		return false, 0, 0, keyshare.ErrDB
+	}
+	return db.reservePinTryQuery(ctx, `
+		UPDATE irma.migration_pin_tries
+		SET pin_counter = pin_counter+1,
+			pin_block_date = $1 + CASE WHEN pin_counter-$3 < 0 THEN 0
+			                           ELSE $2*2^GREATEST(0, pin_counter-$3)
+			                      END
+		WHERE username=$4 AND pin_block_date<=$1
+		RETURNING pin_counter, pin_block_date`,
+		"SELECT pin_block_date FROM irma.migration_pin_tries WHERE username=$1",
+		username,
+	)
+}
+
+// reservePinTryQuery reserves a pin try using the specified update query, which must increase the
+// pin counter and block date of the row having the specified key if it is not blocked, and return
+// them; and if it is blocked, obtains the block date using the specified block date query.
+func (db *postgresDB) reservePinTryQuery(ctx context.Context, updateQuery, blockDateQuery string, key interface{}) (bool, int, int64, error) {
+	uprows, err := db.db.QueryContext(ctx, updateQuery,
 		time.Now().Unix(),
 		backoffStart,
 		maxPinTries-1,
-		user.id)
+		key)
 	if err != nil {
 		server.LogError(err, "Failed to reserve pin try")
 		return false, 0, 0, keyshare.ErrDB
@@ -152,7 +201,7 @@ func (db *postgresDB) reservePinTry(ctx context.Context, user *User) (bool, int,
 		}
 		// if no results, then account either does not exist (which would be weird here) or is blocked
 		// so request wait timeout
-		pinrows, err := db.db.QueryContext(ctx, "SELECT pin_block_date FROM irma.users WHERE id=$1 AND coredata IS NOT NULL", user.id)
+		pinrows, err := db.db.QueryContext(ctx, blockDateQuery, key)
 		if err != nil {
 			server.LogError(err, "Failed to query pin block date")
 			return false, 0, 0, keyshare.ErrDB
@@ -207,6 +256,35 @@ func (db *postgresDB) resetPinTries(ctx context.Context, user *User) error {
 	return nil
 }
 
+func (db *postgresDB) resetMigrationPinTries(ctx context.Context, username string) error {
+	if _, err := db.db.ExecContext(ctx, "DELETE FROM irma.migration_pin_tries WHERE username = $1", username); err != nil {
+		server.LogError(err, "Failed to reset migration pin tries")
+		return keyshare.ErrDB
+	}
+	return nil
+}
+
+func (db *postgresDB) setMigrated(ctx context.Context, user *User) error {
+	// Like a user deleting their account in the myIRMA website, except that this takes effect
+	// immediately, so that the secrets of the user are no longer kept by two keyshare servers
+	c, err := db.db.ExecCountContext(
+		ctx,
+		"UPDATE irma.users SET coredata = NULL, delete_on = $2 WHERE id = $1 AND coredata = $3",
+		user.id,
+		time.Now().Unix(),
+		user.storedSecrets,
+	)
+	if err != nil {
+		server.LogError(err, "Failed to mark user as migrated")
+		return keyshare.ErrDB
+	}
+	if c != 1 {
+		_ = server.LogWarning(keyshare.ErrUserChanged, "Failed to mark user as migrated")
+		return keyshare.ErrUserChanged
+	}
+	return nil
+}
+
 func (db *postgresDB) setSeen(ctx context.Context, user *User) error {
 	// If the user is scheduled for deletion (delete_on is not null), undo that by resetting
 	// delete_on back to null, but only if the user did not explicitly delete her account herself
@@ -284,3 +362,103 @@ func (db *postgresDB) addEmailVerification(ctx context.Context, user *User, emai
 	}
 	return err
 }
+
+func (db *postgresDB) emailAddresses(ctx context.Context, user *User) ([]string, error) {
+	var addresses []string
+	err := db.db.QueryIterateContext(
+		ctx,
+		"SELECT email FROM irma.emails WHERE user_id = $1 AND (delete_on >= $2 OR delete_on IS NULL)",
+		func(rows *sql.Rows) error {
+			var email string
+			err := rows.Scan(&email)
+			addresses = append(addresses, email)
+			return err
+		},
+		user.id, time.Now().Unix())
+	if err != nil {
+		server.LogError(err, "Failed to query user email addresses")
+		return nil, keyshare.ErrDB
+	}
+	return addresses, nil
+}
+
+func (db *postgresDB) userData(ctx context.Context, username string) (*UserData, error) {
+	result := &UserData{
+		Emails:             []UserDataEmail{},
+		EmailVerifications: []UserDataEmailVerification{},
+		Logs:               []UserDataLogEntry{},
+	}
+	var id int64
+	err := db.db.QueryUserContext(
+		ctx,
+		`SELECT id, username, language, (coredata IS NOT NULL) AS enrolled, last_seen, pin_counter, pin_block_date, delete_on
+		 FROM irma.users WHERE username = $1`,
+		[]interface{}{&id, &result.Username, &result.Language, &result.Enrolled, &result.LastSeen,
+			&result.PinCounter, &result.PinBlockDate, &result.DeleteOn},
+		username,
+	)
+	if err != nil {
+		server.LogError(err, "Failed to query user data")
+		if err == keyshare.ErrUserNotFound {
+			return nil, err
+		}
+		return nil, keyshare.ErrDB
+	}
+
+	revalidation := db.db.EmailRevalidation(ctx)
+	query := "SELECT email, delete_on FROM irma.emails WHERE user_id = $1"
+	if revalidation {
+		query = "SELECT email, delete_on, revalidate_on FROM irma.emails WHERE user_id = $1"
+	}
+	err = db.db.QueryIterateContext(
+		ctx,
+		query,
+		func(rows *sql.Rows) error {
+			var email UserDataEmail
+			var err error
+			if revalidation {
+				err = rows.Scan(&email.Email, &email.DeleteOn, &email.RevalidateOn)
+			} else {
+				err = rows.Scan(&email.Email, &email.DeleteOn)
+			}
+			result.Emails = append(result.Emails, email)
+			return err
+		},
+		id)
+	if err != nil {
+		server.LogError(err, "Failed to query user emails")
+		return nil, keyshare.ErrDB
+	}
+
+	err = db.db.QueryIterateContext(
+		ctx,
+		"SELECT email, expiry FROM irma.email_verification_tokens WHERE user_id = $1",
+		func(rows *sql.Rows) error {
+			var verification UserDataEmailVerification
+			err := rows.Scan(&verification.Email, &verification.Expiry)
+			result.EmailVerifications = append(result.EmailVerifications, verification)
+			return err
+		},
+		id)
+	if err != nil {
+		server.LogError(err, "Failed to query user email verifications")
+		return nil, keyshare.ErrDB
+	}
+
+	err = db.db.QueryIterateContext(
+		ctx,
+		"SELECT time, event, param FROM irma.log_entry_records WHERE user_id = $1 ORDER BY time",
+		func(rows *sql.Rows) error {
+			var entry UserDataLogEntry
+			err := rows.Scan(&entry.Timestamp, &entry.Event, &entry.Param)
+			result.Logs = append(result.Logs, entry)
+			return err
+		},
+		id)
+	if err != nil {
+		server.LogError(err, "Failed to query user logs")
+		return nil, keyshare.ErrDB
+	}
+
+	return result, nil
+}
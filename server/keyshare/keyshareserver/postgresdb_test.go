@@ -12,6 +12,7 @@ import (
 	"time"
 
 	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server/keyshare"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -38,6 +39,16 @@ func TestPostgresDBUserManagement(t *testing.T) {
 	err = db.updateUser(context.Background(), nuser)
 	assert.NoError(t, err)
 
+	// Updates based on secrets that were changed in the meantime are refused
+	concurrent, err := db.user(context.Background(), "testuser")
+	require.NoError(t, err)
+	nuser.Secrets = UserSecrets{1}
+	require.NoError(t, db.updateUser(context.Background(), nuser))
+	concurrent.Secrets = UserSecrets{2}
+	assert.Equal(t, keyshare.ErrUserChanged, db.updateUser(context.Background(), concurrent))
+	nuser.Secrets = UserSecrets{3}
+	assert.NoError(t, db.updateUser(context.Background(), nuser))
+
 	user = &User{Username: "testuser", Secrets: []byte{123}}
 	err = db.AddUser(context.Background(), user)
 	assert.Error(t, err)
@@ -55,6 +66,25 @@ func TestPostgresDBUserManagement(t *testing.T) {
 
 	err = db.setSeen(context.Background(), nuser)
 	assert.NoError(t, err)
+
+	data, err := db.userData(context.Background(), "testuser")
+	require.NoError(t, err)
+	assert.Equal(t, "testuser", data.Username)
+	assert.True(t, data.Enrolled)
+	assert.Empty(t, data.Emails)
+	assert.Len(t, data.EmailVerifications, emailTokenRateLimit)
+	require.Len(t, data.Logs, 1)
+	assert.Equal(t, string(eventTypePinCheckFailed), data.Logs[0].Event)
+	assert.Equal(t, "15", *data.Logs[0].Param)
+
+	_, err = db.userData(context.Background(), "notexist")
+	assert.ErrorIs(t, err, keyshare.ErrUserNotFound)
+
+	// Updates of users deleted in the meantime are refused as such
+	_, err = db.(*postgresDB).db.ExecContext(context.Background(), "DELETE FROM irma.users WHERE id = $1", nuser.id)
+	require.NoError(t, err)
+	nuser.Secrets = UserSecrets{4}
+	assert.Equal(t, keyshare.ErrUserNotFound, db.updateUser(context.Background(), nuser))
 }
 
 func TestPostgresDBPinReservation(t *testing.T) {
@@ -137,6 +167,50 @@ func TestPostgresDBPinReservation(t *testing.T) {
 	assert.Equal(t, int64(0), wait)
 }
 
+func TestPostgresDBMigrationPinReservation(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := newPostgresDB(test.PostgresTestUrl, 2, 0, 0, 0)
+	require.NoError(t, err)
+
+	expiry := time.Now().Add(time.Hour).Unix()
+	ok, tries, wait, err := db.reserveMigrationPinTry(context.Background(), "testuser", expiry)
+	require.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, maxPinTries-1, tries)
+	assert.Equal(t, int64(0), wait)
+
+	// Try until we have no tries left
+	for tries != 0 {
+		ok, tries, wait, err = db.reserveMigrationPinTry(context.Background(), "testuser", expiry)
+		require.NoError(t, err)
+		assert.True(t, ok)
+	}
+	assert.Equal(t, backoffStart, wait)
+
+	// We are now blocked
+	ok, tries, _, err = db.reserveMigrationPinTry(context.Background(), "testuser", expiry)
+	assert.NoError(t, err)
+	assert.False(t, ok)
+	assert.Equal(t, 0, tries)
+
+	// Other usernames are not affected
+	ok, tries, _, err = db.reserveMigrationPinTry(context.Background(), "otheruser", expiry)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, maxPinTries-1, tries)
+
+	err = db.resetMigrationPinTries(context.Background(), "testuser")
+	assert.NoError(t, err)
+
+	ok, tries, wait, err = db.reserveMigrationPinTry(context.Background(), "testuser", expiry)
+	assert.NoError(t, err)
+	assert.True(t, ok)
+	assert.Equal(t, maxPinTries-1, tries)
+	assert.Equal(t, int64(0), wait)
+}
+
 func TestPostgresDBTimeout(t *testing.T) {
 	SetupDatabase(t)
 	defer TeardownDatabase(t)
@@ -217,6 +291,27 @@ func (db *testPostgresDB) resetPinTries(ctx context.Context, user *User) error {
 	return db.wrapped.resetPinTries(ctx, user)
 }
 
+func (db *testPostgresDB) reserveMigrationPinTry(ctx context.Context, username string, expiry int64) (bool, int, int64, error) {
+	if _, err := db.wrapped.db.ExecContext(ctx, "SELECT pg_sleep($1)", db.delay); err != nil {
+		return false, 0, 0, err
+	}
+	return db.wrapped.reserveMigrationPinTry(ctx, username, expiry)
+}
+
+func (db *testPostgresDB) resetMigrationPinTries(ctx context.Context, username string) error {
+	if _, err := db.wrapped.db.ExecContext(ctx, "SELECT pg_sleep($1)", db.delay); err != nil {
+		return err
+	}
+	return db.wrapped.resetMigrationPinTries(ctx, username)
+}
+
+func (db *testPostgresDB) setMigrated(ctx context.Context, user *User) error {
+	if _, err := db.wrapped.db.ExecContext(ctx, "SELECT pg_sleep($1)", db.delay); err != nil {
+		return err
+	}
+	return db.wrapped.setMigrated(ctx, user)
+}
+
 func (db *testPostgresDB) setSeen(ctx context.Context, user *User) error {
 	if _, err := db.wrapped.db.ExecContext(ctx, "SELECT pg_sleep($1)", db.delay); err != nil {
 		return err
@@ -237,3 +332,17 @@ func (db *testPostgresDB) addEmailVerification(ctx context.Context, user *User,
 	}
 	return db.wrapped.addEmailVerification(ctx, user, emailAddress, token, validity)
 }
+
+func (db *testPostgresDB) emailAddresses(ctx context.Context, user *User) ([]string, error) {
+	if _, err := db.wrapped.db.ExecContext(ctx, "SELECT pg_sleep($1)", db.delay); err != nil {
+		return nil, err
+	}
+	return db.wrapped.emailAddresses(ctx, user)
+}
+
+func (db *testPostgresDB) userData(ctx context.Context, username string) (*UserData, error) {
+	if _, err := db.wrapped.db.ExecContext(ctx, "SELECT pg_sleep($1)", db.delay); err != nil {
+		return nil, err
+	}
+	return db.wrapped.userData(ctx, username)
+}
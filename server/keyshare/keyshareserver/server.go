@@ -3,7 +3,6 @@ package keyshareserver
 import (
 	"context"
 	"crypto/ecdsa"
-	"fmt"
 	"net/http"
 	"strings"
 	"time"
@@ -39,8 +38,14 @@ type Server struct {
 	// Scheduler used to clean sessions
 	scheduler *gocron.Scheduler
 
+	// Sends notification emails in the background (nil if there are no notifications to send)
+	emailQueue *keyshare.EmailQueue
+
 	// Session data, keeping track of current keyshare protocol session state for each user
 	store sessionStore
+
+	// Limits the rate of imports of migrated users, shared between the API versions
+	migrationRateLimit func(http.Handler) http.Handler
 }
 
 var errMissingCommitment = errors.New("missing previous call to getCommitments")
@@ -76,6 +81,10 @@ func New(conf *Configuration) (*Server, error) {
 	if err != nil {
 		return nil, err
 	}
+	s.migrationRateLimit = server.ClientRateLimitMiddleware(conf.Configuration, migrationImportRateLimit, time.Minute)
+	if conf.pinBlockedEmailTemplates != nil || conf.deviceEnrolledEmailTemplates != nil {
+		s.emailQueue = keyshare.NewEmailQueue(conf.EmailConfiguration, conf.EmailQueueSize)
+	}
 
 	// Load Idemix keys into core, and ensure that new keys added in the future will be loaded as well.
 	if err = s.loadIdemixKeys(conf.IrmaConfiguration); err != nil {
@@ -101,6 +110,9 @@ func New(conf *Configuration) (*Server, error) {
 func (s *Server) Stop() {
 	s.scheduler.Stop()
 	s.irmaserv.Stop()
+	if s.emailQueue != nil {
+		s.emailQueue.Stop()
+	}
 }
 
 func (s *Server) Handler() http.Handler {
@@ -108,6 +120,7 @@ func (s *Server) Handler() http.Handler {
 
 	router.Group(func(router chi.Router) {
 
+		router.Use(server.RequestIDMiddleware)
 		router.Use(server.RecoverMiddleware)
 
 		router.Use(server.SizeLimitMiddleware)
@@ -115,6 +128,7 @@ func (s *Server) Handler() http.Handler {
 
 		opts := server.LogOptions{Response: true, Headers: true, From: false, EncodeBinary: true}
 		router.Use(server.LogMiddleware("keyshareserver", opts))
+		router.Use(server.LocalizationMiddleware(s.conf.Configuration))
 
 		s.routeHandler(router)
 
@@ -122,10 +136,27 @@ func (s *Server) Handler() http.Handler {
 			server.WriteString(w, "OK")
 		})
 
+		router.Get(irma.KeyshareJWKSPath, s.handleJWKS)
+
 		router.Route("/api/v1", func(r chi.Router) {
 			s.routeHandler(r)
 		})
 
+		router.Route("/admin", func(r chi.Router) {
+			r.Use(s.adminAuthMiddleware)
+			r.Get("/users/{username}/export", s.handleUserDataExport)
+		})
+
+		router.Route("/cosigner", func(r chi.Router) {
+			r.Use(s.cosigningAuthMiddleware)
+			r.Post("/share", s.handleCosignerShare)
+			r.Post("/challenge", s.handleCosignerChallenge)
+			r.Post("/authorize", s.handleCosignerAuthorize)
+			r.Post("/ps", s.handleCosignerPs)
+			r.Post("/commitments", s.handleCosignerCommitments)
+			r.Post("/response", s.handleCosignerResponse)
+		})
+
 		router.Route("/api/v2", func(r chi.Router) {
 			// Keyshare sessions with provably secure keyshare protocol
 			r.Use(s.userMiddleware)
@@ -146,6 +177,8 @@ func (s *Server) routeHandler(r chi.Router) http.Handler {
 
 	// Registration
 	r.Post("/client/register", s.handleRegister)
+	r.Get("/client/pin_policy", s.handlePinPolicy)
+	r.With(s.migrationRateLimit).Post("/client/migrate", s.handleMigrationImport)
 
 	// Authentication
 	r.Post("/users/verify_start", s.handleVerifyStart)
@@ -170,6 +203,7 @@ func (s *Server) routeHandler(r chi.Router) http.Handler {
 
 		// User management
 		router.Get("/users/renewKeyshareAttribute", s.handleRenewKeyshareAttribute)
+		router.Post("/users/migrate/export", s.handleMigrationExport)
 	})
 
 	return r
@@ -196,6 +230,12 @@ func (s *Server) loadIdemixKeys(conf *irma.Configuration) error {
 	return errs.ErrorOrNil()
 }
 
+// /.well-known/jwks.json
+func (s *Server) handleJWKS(w http.ResponseWriter, r *http.Request) {
+	id, pk := s.core.JWTPublicKey()
+	server.WriteJson(w, irma.JWKS{Keys: []irma.JWK{irma.NewRSAJWK(id, pk)}})
+}
+
 // /prove/getPs
 func (s *Server) handlePs(w http.ResponseWriter, r *http.Request) {
 	// Fetch from context
@@ -547,9 +587,15 @@ func (s *Server) startAuth(user *User, jwtt string) (irma.KeyshareAuthChallenge,
 	if err != nil {
 		return irma.KeyshareAuthChallenge{}, err
 	}
+	cosignerChallenge, err := s.core.GenerateCosignerChallenge(keysharecore.UserSecrets(user.Secrets))
+	if err != nil {
+		s.conf.Logger.WithField("error", err).Error("Could not obtain cosigner challenge")
+		return irma.KeyshareAuthChallenge{}, err
+	}
 	return irma.KeyshareAuthChallenge{
-		Candidates: []string{irma.KeyshareAuthMethodChallengeResponse},
-		Challenge:  challenge,
+		Candidates:        []string{irma.KeyshareAuthMethodChallengeResponse},
+		Challenge:         challenge,
+		CosignerChallenge: cosignerChallenge,
 	}, nil
 }
 
@@ -611,15 +657,18 @@ func (s *Server) verifyAuth(ctx context.Context, user *User, msg irma.KeyshareAu
 		return irma.KeysharePinStatus{}, err
 	}
 	if !ok {
-		return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+		return irma.NewKeysharePinBlocked(wait), nil
 	}
 
 	// At this point, we are allowed to do an actual check (we have successfully reserved a spot for it), so do it.
-	var jwtt string
+	var (
+		jwtt    string
+		secrets keysharecore.UserSecrets
+	)
 	if msg.AuthResponseJWT == "" {
-		jwtt, err = s.core.ValidateAuthLegacy(keysharecore.UserSecrets(user.Secrets), msg.Pin)
+		jwtt, secrets, err = s.core.ValidateAuthLegacy(keysharecore.UserSecrets(user.Secrets), msg.Pin)
 	} else {
-		jwtt, err = s.core.ValidateAuth(keysharecore.UserSecrets(user.Secrets), msg.AuthResponseJWT)
+		jwtt, secrets, err = s.core.ValidateAuth(keysharecore.UserSecrets(user.Secrets), msg.AuthResponseJWT)
 	}
 
 	if err != nil && err != keysharecore.ErrInvalidPin {
@@ -641,9 +690,10 @@ func (s *Server) verifyAuth(ctx context.Context, user *User, msg irma.KeyshareAu
 				// Already logged
 				return irma.KeysharePinStatus{}, err
 			}
-			return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+			s.notifyUser(ctx, user, s.conf.pinBlockedEmailTemplates, s.conf.PinBlockedEmailSubjects)
+			return irma.NewKeysharePinBlocked(wait), nil
 		} else {
-			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", tries)}, nil
+			return irma.NewKeysharePinFailure(tries), nil
 		}
 	}
 
@@ -653,12 +703,19 @@ func (s *Server) verifyAuth(ctx context.Context, user *User, msg irma.KeyshareAu
 	// Do not send error to user.
 	_ = s.db.setSeen(ctx, user)
 
+	// Store the user secrets if the PIN hash was upgraded. Do not send error to user; if this
+	// fails, the PIN hash is upgraded again on the next login.
+	if secrets != nil {
+		user.Secrets = UserSecrets(secrets)
+		_ = s.db.updateUser(ctx, user)
+	}
+
 	err = s.db.addLog(ctx, user, eventTypePinCheckSuccess, nil)
 	if err != nil {
 		return irma.KeysharePinStatus{}, err
 	}
 
-	return irma.KeysharePinStatus{Status: "success", Message: jwtt}, err
+	return irma.KeysharePinStatus{Status: irma.KeysharePinStatusSuccess, Message: jwtt}, err
 }
 
 // /users/change/pin
@@ -730,16 +787,16 @@ func (s *Server) updatePin(ctx context.Context, user *User, jwtt string) (irma.K
 		return irma.KeysharePinStatus{}, err
 	}
 	if !ok {
-		return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+		return irma.NewKeysharePinBlocked(wait), nil
 	}
 
 	// Try to do the update
 	secrets, err := s.core.ChangePin(keysharecore.UserSecrets(user.Secrets), jwtt)
 	if err == keysharecore.ErrInvalidPin {
 		if tries == 0 {
-			return irma.KeysharePinStatus{Status: "error", Message: fmt.Sprintf("%v", wait)}, nil
+			return irma.NewKeysharePinBlocked(wait), nil
 		} else {
-			return irma.KeysharePinStatus{Status: "failure", Message: fmt.Sprintf("%v", tries)}, nil
+			return irma.NewKeysharePinFailure(tries), nil
 		}
 	} else if err != nil {
 		s.conf.Logger.WithField("error", err).Error("Could not change pin")
@@ -757,7 +814,12 @@ func (s *Server) updatePin(ctx context.Context, user *User, jwtt string) (irma.K
 		return irma.KeysharePinStatus{}, err
 	}
 
-	return irma.KeysharePinStatus{Status: "success"}, nil
+	return irma.KeysharePinStatus{Status: irma.KeysharePinStatusSuccess}, nil
+}
+
+// /client/pin_policy
+func (s *Server) handlePinPolicy(w http.ResponseWriter, r *http.Request) {
+	server.WriteJson(w, s.conf.pinPolicy())
 }
 
 // /client/register
@@ -806,7 +868,10 @@ func (s *Server) parseRegistrationMessage(msg irma.KeyshareEnrollment) (*irma.Ke
 
 func (s *Server) register(ctx context.Context, msg irma.KeyshareEnrollment) (*irma.Qr, error) {
 	// Generate keyshare server account
-	username := common.NewRandomString(12, common.AlphanumericChars)
+	username, err := common.NewRandomString(12, common.AlphanumericChars)
+	if err != nil {
+		return nil, err
+	}
 
 	data, pk, err := s.parseRegistrationMessage(msg)
 	if err != nil {
@@ -825,7 +890,7 @@ func (s *Server) register(ctx context.Context, msg irma.KeyshareEnrollment) (*ir
 	}
 
 	// Send email if user specified email address
-	if data.Email != nil && *data.Email != "" && s.conf.EmailServer != "" {
+	if data.Email != nil && *data.Email != "" && s.conf.EmailEnabled() {
 		err = s.sendRegistrationEmail(ctx, user, data.Language, *data.Email)
 		if err != nil {
 			// already logged in sendRegistrationEmail
@@ -850,10 +915,13 @@ func (s *Server) sendRegistrationEmail(ctx context.Context, user *User, language
 	}
 
 	// Generate token
-	token := common.NewSessionToken()
+	token, err := common.NewSessionToken()
+	if err != nil {
+		return err
+	}
 
 	// Add it to the database
-	err := s.db.addEmailVerification(ctx, user, email, token, s.conf.EmailTokenValidity)
+	err = s.db.addEmailVerification(ctx, user, email, token, s.conf.EmailTokenValidity)
 	if err != nil {
 		// Already logged
 		return err
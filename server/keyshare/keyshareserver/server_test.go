@@ -3,6 +3,7 @@ package keyshareserver
 import (
 	"context"
 	"crypto/ecdsa"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
 	"fmt"
@@ -13,8 +14,10 @@ import (
 	"time"
 
 	"github.com/golang-jwt/jwt/v4"
+	"github.com/privacybydesign/gabi/big"
 	"github.com/privacybydesign/gabi/signed"
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/keysharecore"
 	"github.com/privacybydesign/irmago/internal/test"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/keyshare"
@@ -69,6 +72,15 @@ func TestServerInvalidMessage(t *testing.T) {
 	)
 }
 
+func TestServerPinPolicy(t *testing.T) {
+	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var policy irma.KeysharePinPolicy
+	test.HTTPGet(t, nil, "http://localhost:8080/api/v1/client/pin_policy", nil, 200, &policy)
+	assert.Equal(t, irma.KeysharePinPolicyDefault, policy)
+}
+
 func TestServerHandleRegisterLegacy(t *testing.T) {
 	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
 	defer StopKeyshareServer(t, keyshareServer, httpServer)
@@ -148,6 +160,7 @@ func TestPinTries(t *testing.T) {
 	)
 	require.Equal(t, "failure", jwtMsg.Status)
 	require.Equal(t, "1", jwtMsg.Message)
+	require.Equal(t, 1, jwtMsg.Attempts)
 
 	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/change/pin",
 		`{"id":"legacyuser","oldpin":"puZGbaLDmFywGhFDi4vW2G87Zh","newpin":"ljaksdfj;alkf"}`, nil,
@@ -155,6 +168,7 @@ func TestPinTries(t *testing.T) {
 	)
 	require.Equal(t, "failure", jwtMsg.Status)
 	require.Equal(t, "1", jwtMsg.Message)
+	require.Equal(t, 1, jwtMsg.Attempts)
 }
 
 func TestPinTryChallengeResponse(t *testing.T) {
@@ -341,6 +355,7 @@ func TestPinNoRemainingTries(t *testing.T) {
 		)
 		require.Equal(t, "error", jwtMsg.Status)
 		require.Equal(t, "5", jwtMsg.Message)
+		require.Equal(t, int64(5), jwtMsg.Blocked)
 
 		test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/change/pin",
 			`{"id":"testusername","oldpin":"puZGbaLDmFywGhFDi4vW2G87Zh","newpin":"ljaksdfj;alkf"}`, nil,
@@ -348,11 +363,57 @@ func TestPinNoRemainingTries(t *testing.T) {
 		)
 		require.Equal(t, "error", jwtMsg.Status)
 		require.Equal(t, "5", jwtMsg.Message)
+		require.Equal(t, int64(5), jwtMsg.Blocked)
 
 		StopKeyshareServer(t, keyshareServer, httpServer)
 	}
 }
 
+type testEmailSender struct {
+	messages chan string
+}
+
+func (s *testEmailSender) SendEmail(_ string, _ []string, message []byte) error {
+	s.messages <- string(message)
+	return nil
+}
+
+func TestPinBlockedNotification(t *testing.T) {
+	db := &testDB{db: createDB(t), ok: true, tries: 0, wait: 5, emails: []string{"test@example.com"}}
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	templates, err := keyshare.ParseEmailTemplates(
+		map[string]string{"en": filepath.Join(test.FindTestdataFolder(t), "emailtemplate.html")},
+		map[string]string{"en": "Your account is blocked"},
+		"en",
+	)
+	require.NoError(t, err)
+	sender := &testEmailSender{messages: make(chan string, 1)}
+	keyshareServer.conf.pinBlockedEmailTemplates = templates
+	keyshareServer.conf.PinBlockedEmailSubjects = map[string]string{"en": "Your account is blocked"}
+	keyshareServer.emailQueue = keyshare.NewEmailQueue(keyshare.EmailConfiguration{
+		EmailFrom:       "test@example.com",
+		DefaultLanguage: "en",
+		EmailSender:     sender,
+	}, 1)
+
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/verify/pin",
+		`{"id":"testusername","pin":"puZGbaLDmFywGhFDi4vW2G87Zh"}`, nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "error", jwtMsg.Status)
+
+	select {
+	case message := <-sender.messages:
+		require.Contains(t, message, "To: test@example.com")
+		require.Contains(t, message, "Subject: Your account is blocked")
+	case <-time.After(5 * time.Second):
+		t.Fatal("no notification email sent")
+	}
+}
+
 func TestMissingUser(t *testing.T) {
 	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
 	defer StopKeyshareServer(t, keyshareServer, httpServer)
@@ -466,6 +527,223 @@ func TestKeyshareSessions(t *testing.T) {
 	}
 }
 
+func TestMigration(t *testing.T) {
+	db := createDB(t)
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	sk := loadClientPrivateKey(t)
+	pin := "puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"
+	authenticate := func() string {
+		var jwtMsg irma.KeysharePinStatus
+		test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/verify/pin_challengeresponse",
+			marshalJSON(t, irma.KeyshareAuthResponse{AuthResponseJWT: doChallengeResponse(t, sk, "testusername", pin)}), nil,
+			200, &jwtMsg,
+		)
+		require.Equal(t, "success", jwtMsg.Status)
+		return jwtMsg.Message
+	}
+	auth := authenticate()
+	header := http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{auth},
+	}
+
+	// Migration is disabled without migration key
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/migrate/export", "", header, 501, nil)
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", "{}", nil, 501, nil)
+
+	var key keysharecore.AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	keyshareServer.conf.migrationKey = &keysharecore.MigrationKey{ID: 1, Key: key}
+
+	// Exporting requires authorization
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/migrate/export", "", http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{"fakeauthorization"},
+	}, 400, nil)
+
+	var migration irma.KeyshareMigration
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/migrate/export", "", header, 200, &migration)
+	require.Equal(t, "testusername", migration.Username)
+	require.NotEmpty(t, migration.Secrets)
+	require.NotZero(t, migration.Expiry)
+	migration.Pin = pin
+
+	// The exported user no longer exists at this keyshare server
+	_, err = keyshareServer.db.user(context.Background(), "testusername")
+	require.ErrorIs(t, err, keyshare.ErrUserNotFound)
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/migrate/export", "", header, 403, nil)
+
+	// The user already exists at this keyshare server
+	keyshareServer.db = createDB(t)
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", marshalJSON(t, migration), nil, 400, nil)
+
+	// Import at an empty keyshare server, after which the user can authenticate there with the same PIN
+	keyshareServer.db = NewMemoryDB()
+	tampered := migration
+	tampered.Secrets = append([]byte{}, migration.Secrets...)
+	tampered.Secrets[20] ^= 1
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", marshalJSON(t, tampered), nil, 400, nil)
+	renamed := migration
+	renamed.Username = "otherusername"
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", marshalJSON(t, renamed), nil, 400, nil)
+	extended := migration
+	extended.Expiry += 3600
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", marshalJSON(t, extended), nil, 400, nil)
+
+	// Importing requires the PIN of the user, or the admin token of the operator
+	unauthenticated := migration
+	unauthenticated.Pin = ""
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", marshalJSON(t, unauthenticated), nil, 403, nil)
+	unauthenticated.Pin = "wrongpin"
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", marshalJSON(t, unauthenticated), nil, 403, nil)
+	keyshareServer.conf.AdminToken = "admintoken"
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", marshalJSON(t, unauthenticated),
+		http.Header{"Authorization": []string{"Bearer wrongtoken"}}, 403, nil)
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", marshalJSON(t, unauthenticated),
+		http.Header{"Authorization": []string{"Bearer admintoken"}}, 204, nil)
+	keyshareServer.db = NewMemoryDB()
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", marshalJSON(t, migration), nil, 204, nil)
+	auth = authenticate()
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/prove/getCommitments",
+		`["test.test-3"]`, http.Header{
+			"X-IRMA-Keyshare-Username": []string{"testusername"},
+			"Authorization":            []string{auth},
+		},
+		200, nil,
+	)
+}
+
+func TestMigrationRateLimit(t *testing.T) {
+	keyshareServer, httpServer := StartKeyshareServer(t, NewMemoryDB(), "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	for i := 0; i < migrationImportRateLimit; i++ {
+		test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", "{}", nil, 501, nil)
+	}
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", "{}", nil, 429, nil)
+}
+
+func TestMigrationPinBlocked(t *testing.T) {
+	db := &testDB{db: createDB(t), ok: true, tries: 1, wait: 0, err: nil}
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	var key keysharecore.AESKey
+	_, err := rand.Read(key[:])
+	require.NoError(t, err)
+	keyshareServer.conf.migrationKey = &keysharecore.MigrationKey{ID: 1, Key: key}
+
+	pin := "puZGbaLDmFywGhFDi4vW2G87ZhXpaUsvymZwNJfB/SU=\n"
+	var jwtMsg irma.KeysharePinStatus
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/verify/pin_challengeresponse",
+		marshalJSON(t, irma.KeyshareAuthResponse{AuthResponseJWT: doChallengeResponse(t, loadClientPrivateKey(t), "testusername", pin)}), nil,
+		200, &jwtMsg,
+	)
+	require.Equal(t, "success", jwtMsg.Status)
+	var migration irma.KeyshareMigration
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/users/migrate/export", "", http.Header{
+		"X-IRMA-Keyshare-Username": []string{"testusername"},
+		"Authorization":            []string{jwtMsg.Message},
+	}, 200, &migration)
+	migration.Pin = pin
+
+	// Even the correct PIN is refused while the migrated user is blocked
+	db.ok, db.tries, db.wait = false, 0, 5
+	var msg irma.RemoteError
+	test.HTTPPost(t, nil, "http://localhost:8080/api/v1/client/migrate", marshalJSON(t, migration), nil, 429, &msg)
+	require.Equal(t, "5", msg.Message)
+}
+
+func TestUserDataExport(t *testing.T) {
+	db := createDB(t)
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	url := "http://localhost:8080/admin/users/testusername/export"
+	header := http.Header{"Authorization": []string{"Bearer admintoken"}}
+
+	// Export is disabled without admin token
+	test.HTTPGet(t, nil, url, header, 501, nil)
+
+	keyshareServer.conf.AdminToken = "admintoken"
+	test.HTTPGet(t, nil, url, nil, 403, nil)
+	test.HTTPGet(t, nil, url, http.Header{"Authorization": []string{"Bearer wrongtoken"}}, 403, nil)
+
+	var data UserData
+	test.HTTPGet(t, nil, url, header, 200, &data)
+	require.Equal(t, "testusername", data.Username)
+	require.True(t, data.Enrolled)
+
+	test.HTTPGet(t, nil, "http://localhost:8080/admin/users/nonexisting/export", header, 403, nil)
+}
+
+func TestCosigner(t *testing.T) {
+	db := createDB(t)
+	keyshareServer, httpServer := StartKeyshareServer(t, db, "")
+	defer StopKeyshareServer(t, keyshareServer, httpServer)
+
+	client := newCosignerClient(nil, "http://localhost:8080/", "cosigningtoken")
+	keyIDs := []irma.PublicKeyIdentifier{{Issuer: irma.NewIssuerIdentifier("test.test"), Counter: 3}}
+	sk := loadClientPrivateKey(t)
+
+	// Cosigning is disabled without cosigning token
+	_, err := client.NewShare(&sk.PublicKey)
+	require.Error(t, err)
+
+	keyshareServer.conf.CosigningToken = "cosigningtoken"
+	_, err = newCosignerClient(nil, "http://localhost:8080/", "wrongtoken").NewShare(&sk.PublicKey)
+	require.Error(t, err)
+
+	share, err := client.NewShare(&sk.PublicKey)
+	require.NoError(t, err)
+
+	// Without the authorization of the user, the cosigner does not contribute
+	_, err = client.Ps(share, "", keyIDs)
+	require.Error(t, err)
+	challenge, err := client.Challenge(share)
+	require.NoError(t, err)
+	otherSk, err := signed.GenerateKey()
+	require.NoError(t, err)
+	_, err = client.Authorize(share, cosignerAuthJWT(t, otherSk, challenge))
+	require.Error(t, err)
+
+	challenge, err = client.Challenge(share)
+	require.NoError(t, err)
+	token, err := client.Authorize(share, cosignerAuthJWT(t, sk, challenge))
+	require.NoError(t, err)
+
+	ps, err := client.Ps(share, token, keyIDs)
+	require.NoError(t, err)
+	require.Len(t, ps, 1)
+
+	commitments, commitID, err := client.Commitments(share, token, keyIDs)
+	require.NoError(t, err)
+	require.Len(t, commitments, 1)
+	require.Equal(t, 0, ps[0].Cmp(commitments[0].P))
+	response, err := client.Response(share, token, commitID, big.NewInt(12345))
+	require.NoError(t, err)
+	require.NotNil(t, response)
+
+	// Commitments are used only once
+	_, err = client.Response(share, token, commitID, big.NewInt(12345))
+	require.Error(t, err)
+
+	// Shares are encrypted and authenticated
+	share[len(share)-1] ^= 1
+	_, err = client.Ps(share, token, keyIDs)
+	require.Error(t, err)
+}
+
+func cosignerAuthJWT(t *testing.T, sk *ecdsa.PrivateKey, challenge []byte) string {
+	token := jwt.NewWithClaims(jwt.SigningMethodES256, irma.KeyshareCosignerAuthClaims{Challenge: challenge})
+	jwtt, err := token.SignedString(sk)
+	require.NoError(t, err)
+	return jwtt
+}
+
 func StartKeyshareServer(t *testing.T, db DB, emailserver string) (*Server, *http.Server) {
 	testdataPath := test.FindTestdataFolder(t)
 	s, err := New(&Configuration{
@@ -521,11 +799,12 @@ func StopKeyshareServer(t *testing.T, keyshareServer *Server, httpServer *http.S
 }
 
 type testDB struct {
-	db    DB
-	ok    bool
-	tries int
-	wait  int64
-	err   error
+	db     DB
+	ok     bool
+	tries  int
+	wait   int64
+	err    error
+	emails []string
 }
 
 func (db *testDB) AddUser(ctx context.Context, user *User) error {
@@ -548,6 +827,18 @@ func (db *testDB) resetPinTries(ctx context.Context, user *User) error {
 	return db.db.resetPinTries(ctx, user)
 }
 
+func (db *testDB) reserveMigrationPinTry(_ context.Context, _ string, _ int64) (bool, int, int64, error) {
+	return db.ok, db.tries, db.wait, db.err
+}
+
+func (db *testDB) resetMigrationPinTries(ctx context.Context, username string) error {
+	return db.db.resetMigrationPinTries(ctx, username)
+}
+
+func (db *testDB) setMigrated(ctx context.Context, user *User) error {
+	return db.db.setMigrated(ctx, user)
+}
+
 func (db *testDB) setSeen(ctx context.Context, user *User) error {
 	return db.db.setSeen(ctx, user)
 }
@@ -560,6 +851,17 @@ func (db *testDB) addEmailVerification(ctx context.Context, user *User, email, t
 	return db.db.addEmailVerification(ctx, user, email, token, validity)
 }
 
+func (db *testDB) emailAddresses(ctx context.Context, user *User) ([]string, error) {
+	if db.emails != nil {
+		return db.emails, nil
+	}
+	return db.db.emailAddresses(ctx, user)
+}
+
+func (db *testDB) userData(ctx context.Context, username string) (*UserData, error) {
+	return db.db.userData(ctx, username)
+}
+
 func createDB(t *testing.T) DB {
 	db := NewMemoryDB()
 	err := db.AddUser(context.Background(), &User{
@@ -98,7 +98,7 @@ func processConfiguration(conf *Configuration) error {
 
 	// Setup email templates
 	var err error
-	if conf.EmailServer != "" {
+	if conf.EmailEnabled() {
 		if conf.loginEmailTemplates, err = keyshare.ParseEmailTemplates(
 			conf.LoginEmailFiles,
 			conf.LoginEmailSubjects,
@@ -99,6 +99,7 @@ func (s *Server) Handler() http.Handler {
 	}).Handler)
 
 	router.Group(func(router chi.Router) {
+		router.Use(server.RequestIDMiddleware)
 		router.Use(server.RecoverMiddleware)
 
 		router.Use(server.SizeLimitMiddleware)
@@ -249,7 +250,7 @@ func (s *Server) handleDeleteUser(w http.ResponseWriter, r *http.Request) {
 	session := r.Context().Value("session").(*session)
 
 	// First, send emails
-	if s.conf.EmailServer != "" {
+	if s.conf.EmailEnabled() {
 		if err := s.sendDeleteEmails(r.Context(), session); err != nil {
 
 			if (err == keyshare.ErrInvalidEmail || err == keyshare.ErrInvalidEmailDomain) && s.db.hasEmailRevalidation(r.Context()) {
@@ -302,8 +303,11 @@ func (s *Server) sendLoginEmail(ctx context.Context, request emailLoginRequest)
 		return keyshare.ErrInvalidEmailDomain
 	}
 
-	token := common.NewSessionToken()
-	err := s.db.addLoginToken(ctx, request.Email, token)
+	token, err := common.NewSessionToken()
+	if err != nil {
+		return err
+	}
+	err = s.db.addLoginToken(ctx, request.Email, token)
 	if err == errEmailNotFound || err == errTooManyTokens {
 		return err
 	} else if err != nil {
@@ -322,7 +326,7 @@ func (s *Server) sendLoginEmail(ctx context.Context, request emailLoginRequest)
 }
 
 func (s *Server) handleEmailLogin(w http.ResponseWriter, r *http.Request) {
-	if s.conf.EmailServer == "" {
+	if !s.conf.EmailEnabled() {
 		server.WriteError(w, server.ErrorInternal, "not enabled in configuration")
 		return
 	}
@@ -381,8 +385,12 @@ func (s *Server) processTokenLogin(ctx context.Context, request tokenLoginReques
 		return "", err
 	}
 
+	token, err := common.NewSessionToken()
+	if err != nil {
+		return "", err
+	}
 	session := session{
-		Token:  common.NewSessionToken(),
+		Token:  token,
 		UserID: &id,
 		Expiry: time.Now().Add(time.Duration(s.conf.SessionLifetime) * time.Second),
 	}
@@ -475,8 +483,13 @@ func (s *Server) handleIrmaLogin(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	token, err := common.NewSessionToken()
+	if err != nil {
+		keyshare.WriteError(w, err)
+		return
+	}
 	session := session{
-		Token:             common.NewSessionToken(),
+		Token:             token,
 		LoginSessionToken: loginToken,
 		Expiry:            time.Now().Add(time.Duration(s.conf.SessionLifetime) * time.Second),
 	}
@@ -510,8 +523,13 @@ func (s *Server) handleVerifyEmail(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	sessionToken, err := common.NewSessionToken()
+	if err != nil {
+		keyshare.WriteError(w, err)
+		return
+	}
 	session := session{
-		Token:  common.NewSessionToken(),
+		Token:  sessionToken,
 		UserID: &id,
 		Expiry: time.Now().Add(time.Duration(s.conf.SessionLifetime) * time.Second),
 	}
@@ -627,7 +645,7 @@ func (s *Server) processRemoveEmail(ctx context.Context, session *session, email
 		return err
 	}
 
-	if s.conf.EmailServer != "" {
+	if s.conf.EmailEnabled() {
 		if err = s.conf.SendEmail(
 			s.conf.deleteEmailTemplates,
 			s.conf.DeleteEmailSubjects,
@@ -13,6 +13,14 @@ CREATE TABLE IF NOT EXISTS irma.users
 );
 CREATE UNIQUE INDEX username_index ON irma.users (username);
 
+CREATE TABLE IF NOT EXISTS irma.migration_pin_tries
+(
+    username text PRIMARY KEY,
+    pin_counter int NOT NULL,
+    pin_block_date bigint NOT NULL,
+    expiry bigint NOT NULL
+);
+
 CREATE TABLE IF NOT EXISTS irma.log_entry_records
 (
     id serial PRIMARY KEY,
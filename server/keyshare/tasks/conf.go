@@ -45,7 +45,7 @@ func processConfiguration(conf *Configuration) error {
 	irma.Logger = conf.Logger
 
 	// Setup email templates
-	if conf.EmailServer != "" {
+	if conf.EmailEnabled() {
 		var err error
 		conf.deleteExpiredAccountTemplate, err = keyshare.ParseEmailTemplates(
 			conf.DeleteExpiredAccountFiles,
@@ -50,11 +50,12 @@ func Do(conf *Configuration) error {
 	}
 
 	tasks := map[string]func(context.Context){
-		"cleanupEmails":   task.cleanupEmails,
-		"cleanupTokens":   task.cleanupTokens,
-		"cleanupAccounts": task.cleanupAccounts,
-		"expireAccounts":  task.expireAccounts,
-		"revalidateMails": task.revalidateMails,
+		"cleanupEmails":            task.cleanupEmails,
+		"cleanupTokens":            task.cleanupTokens,
+		"cleanupAccounts":          task.cleanupAccounts,
+		"cleanupMigrationPinTries": task.cleanupMigrationPinTries,
+		"expireAccounts":           task.expireAccounts,
+		"revalidateMails":          task.revalidateMails,
 	}
 
 	for taskName, taskFunc := range tasks {
@@ -102,6 +103,14 @@ func (t *taskHandler) cleanupTokens(ctx context.Context) {
 	}
 }
 
+// Remove the PIN attempts of imports of migrated users whose export has expired
+func (t *taskHandler) cleanupMigrationPinTries(ctx context.Context) {
+	_, err := t.db.ExecContext(ctx, "DELETE FROM irma.migration_pin_tries WHERE expiry < $1", time.Now().Unix())
+	if err != nil {
+		t.conf.Logger.WithField("error", err).Error("Could not remove PIN attempts of expired migrations")
+	}
+}
+
 // Cleanup accounts disabled long enough ago.
 func (t *taskHandler) cleanupAccounts(ctx context.Context) {
 	_, err := t.db.ExecContext(ctx, "DELETE FROM irma.users WHERE delete_on < $1 AND (coredata IS NULL OR last_seen < delete_on - $2)",
@@ -176,7 +185,7 @@ func (t *taskHandler) sendExpiryEmails(ctx context.Context, id int64, username,
 // because these will be processed separately inside revalidateEmails.
 func (t *taskHandler) expireAccounts(ctx context.Context) {
 	// Disable this task when email server is not given
-	if t.conf.EmailServer == "" {
+	if !t.conf.EmailEnabled() {
 		t.conf.Logger.Warning("Expiring accounts is disabled, as no email server is configured")
 		return
 	}
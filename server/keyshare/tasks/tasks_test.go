@@ -109,6 +109,23 @@ func TestCleanupTokens(t *testing.T) {
 	assert.Equal(t, 1, countRows(t, db, "email_login_tokens", ""))
 }
 
+func TestCleanupMigrationPinTries(t *testing.T) {
+	SetupDatabase(t)
+	defer TeardownDatabase(t)
+
+	db, err := sql.Open("pgx", test.PostgresTestUrl)
+	require.NoError(t, err)
+	_, err = db.Exec("INSERT INTO irma.migration_pin_tries (username, pin_counter, pin_block_date, expiry) VALUES ('u1', 1, 0, 0), ('u2', 1, 0, $1)", time.Now().Add(time.Hour).Unix())
+	require.NoError(t, err)
+
+	th, err := newHandler(&Configuration{DBConnStr: test.PostgresTestUrl, Logger: irma.Logger})
+	require.NoError(t, err)
+
+	require.NoError(t, runWithTimeout(th.cleanupMigrationPinTries))
+
+	assert.Equal(t, 1, countRows(t, db, "migration_pin_tries", ""))
+}
+
 func TestCleanupAccounts(t *testing.T) {
 	SetupDatabase(t)
 	defer TeardownDatabase(t)
@@ -0,0 +1,120 @@
+package server
+
+import (
+	"crypto/rsa"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// KeyshareKey is a public key with which JWTs of the keyshare server of a scheme are accepted in
+// addition to the keys of the scheme, e.g. of a new keyshare server deployment during a migration.
+type KeyshareKey struct {
+	// Name of the key, used in logs
+	Name string `json:"name" mapstructure:"name"`
+	// If set, the key is only used for JWTs having this key ID
+	KeyID *int `json:"kid,omitempty" mapstructure:"kid"`
+	// PEM-encoded RSA public key, or path to a file containing it
+	PublicKey     string `json:"public_key,omitempty" mapstructure:"public_key"`
+	PublicKeyFile string `json:"public_key_file,omitempty" mapstructure:"public_key_file"`
+	// Validity window of the key (zero for no bound)
+	NotBefore time.Time `json:"not_before,omitempty" mapstructure:"not_before"`
+	NotAfter  time.Time `json:"not_after,omitempty" mapstructure:"not_after"`
+
+	pk *rsa.PublicKey
+}
+
+func (k *KeyshareKey) validAt(t time.Time) bool {
+	return (k.NotBefore.IsZero() || !t.Before(k.NotBefore)) && (k.NotAfter.IsZero() || t.Before(k.NotAfter))
+}
+
+func (conf *Configuration) verifyKeyshareKeys() error {
+	// viper lowercases configuration keys, so we have to un-lowercase them back.
+	for id := range conf.IrmaConfiguration.SchemeManagers {
+		lc := irma.NewSchemeManagerIdentifier(strings.ToLower(id.String()))
+		if lc == id {
+			continue
+		}
+		if keys, ok := conf.KeyshareKeys[lc]; ok {
+			delete(conf.KeyshareKeys, lc)
+			conf.KeyshareKeys[id] = keys
+		}
+	}
+
+	for id, keys := range conf.KeyshareKeys {
+		scheme := conf.IrmaConfiguration.SchemeManagers[id]
+		if scheme == nil {
+			return errors.Errorf("keyshare keys configured for unknown scheme %s", id)
+		}
+		if !scheme.Distributed() {
+			return errors.Errorf("keyshare keys configured for scheme %s, which has no keyshare server", id)
+		}
+		for i := range keys {
+			key := &keys[i]
+			if key.Name == "" {
+				key.Name = strconv.Itoa(i)
+			}
+			bts, err := common.ReadKey(key.PublicKey, key.PublicKeyFile)
+			if err != nil {
+				return errors.WrapPrefix(err, "failed to read keyshare key "+key.Name+" of scheme "+id.String(), 0)
+			}
+			if key.pk, err = jwt.ParseRSAPublicKeyFromPEM(bts); err != nil {
+				return errors.WrapPrefix(err, "failed to parse keyshare key "+key.Name+" of scheme "+id.String(), 0)
+			}
+			if !key.NotBefore.IsZero() && !key.NotAfter.IsZero() && !key.NotBefore.Before(key.NotAfter) {
+				return errors.Errorf("keyshare key %s of scheme %s: not_before must precede not_after", key.Name, id)
+			}
+		}
+	}
+	return nil
+}
+
+// ParseKeyshareJWT parses and verifies a JWT of the keyshare server of the scheme into the claims.
+// The JWT is accepted if it is signed with a keyshare server key of the scheme or with one of the
+// KeyshareKeys configured for the scheme that is currently within its validity window. The name
+// of the key that was used is logged.
+func (conf *Configuration) ParseKeyshareJWT(str string, scheme irma.SchemeManagerIdentifier, claims jwt.Claims) error {
+	token, err := jwt.ParseWithClaims(str, claims, conf.IrmaConfiguration.KeyshareServerKeyFunc(scheme))
+	if err == nil && token.Valid {
+		conf.Logger.WithField("scheme", scheme).Debug("Keyshare server JWT verified with scheme key")
+		return nil
+	}
+	if err == nil {
+		err = errors.Errorf("invalid keyshare server JWT for scheme %s", scheme)
+	}
+	if len(conf.KeyshareKeys[scheme]) == 0 {
+		return err
+	}
+
+	now := conf.Now()
+	for i := range conf.KeyshareKeys[scheme] {
+		key := &conf.KeyshareKeys[scheme][i]
+		if !key.validAt(now) {
+			continue
+		}
+		token, e := jwt.ParseWithClaims(str, claims, func(t *jwt.Token) (interface{}, error) {
+			if _, ok := t.Method.(*jwt.SigningMethodRSA); !ok {
+				return nil, errors.Errorf("unexpected signing method %v", t.Header["alg"])
+			}
+			if key.KeyID != nil {
+				kid, _ := t.Header["kid"].(string)
+				if kid != strconv.Itoa(*key.KeyID) {
+					return nil, errors.New("key ID does not match")
+				}
+			}
+			return key.pk, nil
+		})
+		if e == nil && token.Valid {
+			conf.Logger.WithFields(logrus.Fields{"scheme": scheme, "key": key.Name}).
+				Info("Keyshare server JWT verified with configured keyshare key")
+			return nil
+		}
+	}
+	return errors.WrapPrefix(err, "keyshare server JWT not signed by any acceptable key", 0)
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestKeyshareKeys(t *testing.T) {
+	irmaconf, err := irma.NewConfiguration(
+		filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		irma.ConfigurationOptions{},
+	)
+	require.NoError(t, err)
+	require.NoError(t, irmaconf.ParseFolder())
+
+	newKey := func() (*rsa.PrivateKey, string) {
+		sk, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		bts, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+		require.NoError(t, err)
+		return sk, string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: bts}))
+	}
+	oldSk, oldPk := newKey()
+	newSk, newPk := newKey()
+	otherSk, _ := newKey()
+	sign := func(sk *rsa.PrivateKey, kid string) string {
+		token := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.StandardClaims{Issuer: "keyshare"})
+		token.Header["kid"] = kid
+		str, err := token.SignedString(sk)
+		require.NoError(t, err)
+		return str
+	}
+
+	scheme := irma.NewSchemeManagerIdentifier("test")
+	migration := time.Date(2024, 6, 1, 0, 0, 0, 0, time.UTC)
+	kid := 3
+	conf := &Configuration{
+		IrmaConfiguration: irmaconf,
+		Logger:            logrus.New(),
+		Clock:             fixedClock(migration.Add(-time.Hour)),
+		KeyshareKeys: map[irma.SchemeManagerIdentifier][]KeyshareKey{
+			scheme: {
+				{Name: "old", PublicKey: oldPk, NotAfter: migration.Add(24 * time.Hour)},
+				{Name: "new", PublicKey: newPk, KeyID: &kid, NotBefore: migration},
+			},
+		},
+	}
+	require.NoError(t, conf.verifyKeyshareKeys())
+
+	// Before the migration only the old key is accepted
+	require.NoError(t, conf.ParseKeyshareJWT(sign(oldSk, "1"), scheme, &jwt.StandardClaims{}))
+	require.Error(t, conf.ParseKeyshareJWT(sign(newSk, "3"), scheme, &jwt.StandardClaims{}))
+
+	// During the migration both keys are accepted, the new one only with its key ID
+	conf.Clock = fixedClock(migration.Add(time.Hour))
+	require.NoError(t, conf.ParseKeyshareJWT(sign(oldSk, "1"), scheme, &jwt.StandardClaims{}))
+	require.NoError(t, conf.ParseKeyshareJWT(sign(newSk, "3"), scheme, &jwt.StandardClaims{}))
+	require.Error(t, conf.ParseKeyshareJWT(sign(newSk, "4"), scheme, &jwt.StandardClaims{}))
+	require.Error(t, conf.ParseKeyshareJWT(sign(otherSk, "3"), scheme, &jwt.StandardClaims{}))
+
+	// Afterwards only the new key is accepted
+	conf.Clock = fixedClock(migration.Add(48 * time.Hour))
+	require.Error(t, conf.ParseKeyshareJWT(sign(oldSk, "1"), scheme, &jwt.StandardClaims{}))
+	require.NoError(t, conf.ParseKeyshareJWT(sign(newSk, "3"), scheme, &jwt.StandardClaims{}))
+
+	// Keys of other schemes are not accepted
+	require.Error(t, conf.ParseKeyshareJWT(sign(newSk, "3"), irma.NewSchemeManagerIdentifier("irma-demo"), &jwt.StandardClaims{}))
+
+	// Invalid configurations
+	conf.KeyshareKeys = map[irma.SchemeManagerIdentifier][]KeyshareKey{
+		irma.NewSchemeManagerIdentifier("irma-demo"): {{PublicKey: newPk}},
+	}
+	require.Error(t, conf.verifyKeyshareKeys())
+	conf.KeyshareKeys = map[irma.SchemeManagerIdentifier][]KeyshareKey{scheme: {{PublicKey: "invalid"}}}
+	require.Error(t, conf.verifyKeyshareKeys())
+	conf.KeyshareKeys = map[irma.SchemeManagerIdentifier][]KeyshareKey{
+		scheme: {{PublicKey: newPk, NotBefore: migration, NotAfter: migration}},
+	}
+	require.Error(t, conf.verifyKeyshareKeys())
+}
@@ -0,0 +1,701 @@
+package server
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+)
+
+// kmsClient signs SHA-256 digests using RSASSA-PKCS1-v1_5 with an RSA key kept in a key management service.
+type kmsClient interface {
+	publicKey() (*rsa.PublicKey, error)
+	sign(digest []byte) ([]byte, error)
+}
+
+// kmsSigner is a crypto.Signer whose private key is kept in a key management service.
+type kmsSigner struct {
+	client kmsClient
+	public *rsa.PublicKey
+}
+
+var kmsHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// NewKMSSigner returns a signer of RS256 JWTs whose RSA private key is kept in a key management
+// service, specified by one of the following URIs:
+//   - awskms://<region>/<key ID, key ARN or alias>: AWS KMS, authenticating using the first credentials
+//     found in the AWS_ACCESS_KEY_ID, AWS_SECRET_ACCESS_KEY and (optional) AWS_SESSION_TOKEN environment
+//     variables; the web identity token of AWS_WEB_IDENTITY_TOKEN_FILE for the role AWS_ROLE_ARN (as
+//     in EKS); the AWS_PROFILE profile (or default) of the shared credentials file; the container
+//     credentials endpoint (as in ECS); or the role of the EC2 instance. Temporary credentials are
+//     refreshed before they expire.
+//   - gcpkms://projects/<project>/locations/<location>/keyRings/<key ring>/cryptoKeys/<key>/cryptoKeyVersions/<version>:
+//     Google Cloud KMS, authenticating as the service account of the instance using the metadata server.
+//   - azurekv://<vault host>/keys/<key>/<version>: Azure Key Vault, authenticating as the managed
+//     identity of the instance using the instance metadata service.
+//
+// The key must be an RSA key for PKCS #1 v1.5 signatures with SHA-256. Its public key is retrieved
+// when the signer is created.
+func NewKMSSigner(uri string) (crypto.Signer, error) {
+	scheme, key, ok := strings.Cut(uri, "://")
+	if !ok || key == "" {
+		return nil, errors.Errorf("invalid key management service key URI %s", uri)
+	}
+
+	var client kmsClient
+	switch scheme {
+	case "awskms":
+		region, keyID, _ := strings.Cut(key, "/")
+		if region == "" || keyID == "" {
+			return nil, errors.New("AWS KMS key URI must be of the form awskms://<region>/<key ID>")
+		}
+		c, err := newAWSKMSClient(region, keyID)
+		if err != nil {
+			return nil, err
+		}
+		client = c
+	case "gcpkms":
+		if !strings.HasPrefix(key, "projects/") || !strings.Contains(key, "/cryptoKeyVersions/") {
+			return nil, errors.New("Google Cloud KMS key URI must specify the resource name of a key version")
+		}
+		client = newGCPKMSClient(key)
+	case "azurekv":
+		vault, path, _ := strings.Cut(key, "/")
+		if vault == "" || !strings.HasPrefix(path, "keys/") || strings.Count(path, "/") != 2 {
+			return nil, errors.New("Azure Key Vault key URI must be of the form azurekv://<vault host>/keys/<key>/<version>")
+		}
+		client = newAzureKVClient(vault, path)
+	default:
+		return nil, errors.Errorf("unsupported key management service %s", scheme)
+	}
+
+	return newKMSSigner(client)
+}
+
+func newKMSSigner(client kmsClient) (*kmsSigner, error) {
+	pk, err := client.publicKey()
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to retrieve public key", 0)
+	}
+	return &kmsSigner{client: client, public: pk}, nil
+}
+
+func (s *kmsSigner) Public() crypto.PublicKey {
+	return s.public
+}
+
+func (s *kmsSigner) Sign(_ io.Reader, digest []byte, opts crypto.SignerOpts) ([]byte, error) {
+	if _, pss := opts.(*rsa.PSSOptions); pss || opts.HashFunc() != crypto.SHA256 {
+		return nil, errors.New("key management service signers only support PKCS #1 v1.5 signatures with SHA-256")
+	}
+	sig, err := s.client.sign(digest)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "key management service failed to sign", 0)
+	}
+	return sig, nil
+}
+
+// kmsRequest performs the request and unmarshals the JSON response into result.
+func kmsRequest(req *http.Request, result interface{}) error {
+	body, err := kmsResponse(req)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(body, result)
+}
+
+// kmsResponse performs the request and returns the body of the response.
+func kmsResponse(req *http.Request) ([]byte, error) {
+	res, err := kmsHTTPClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer common.Close(res.Body)
+	body, err := io.ReadAll(io.LimitReader(res.Body, 1<<20))
+	if err != nil {
+		return nil, err
+	}
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.Errorf("%s %s returned status %d: %s", req.Method, req.URL.Path, res.StatusCode, body)
+	}
+	return body, nil
+}
+
+func newKMSRequest(method, url string, body interface{}) (*http.Request, error) {
+	var reader io.Reader
+	if body != nil {
+		bts, err := json.Marshal(body)
+		if err != nil {
+			return nil, err
+		}
+		reader = bytes.NewReader(bts)
+	}
+	req, err := http.NewRequest(method, url, reader)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+func parsePKIXRSAPublicKey(der []byte) (*rsa.PublicKey, error) {
+	pk, err := x509.ParsePKIXPublicKey(der)
+	if err != nil {
+		return nil, err
+	}
+	rsapk, ok := pk.(*rsa.PublicKey)
+	if !ok {
+		return nil, errors.New("key is not an RSA key")
+	}
+	return rsapk, nil
+}
+
+// accessToken caches an OAuth access token obtained from the metadata service of a cloud instance.
+type accessToken struct {
+	sync.Mutex
+	fetch  func() (string, time.Duration, error)
+	token  string
+	expiry time.Time
+}
+
+func (t *accessToken) get() (string, error) {
+	t.Lock()
+	defer t.Unlock()
+	// Refresh tokens a minute before they expire, so that they don't expire while in use
+	if t.token != "" && time.Now().Add(time.Minute).Before(t.expiry) {
+		return t.token, nil
+	}
+	token, lifetime, err := t.fetch()
+	if err != nil {
+		return "", errors.WrapPrefix(err, "failed to obtain access token", 0)
+	}
+	t.token, t.expiry = token, time.Now().Add(lifetime)
+	return token, nil
+}
+
+// fetchMetadataToken retrieves an access token from the metadata service of a cloud instance.
+// The lifetime of the token is a number or a string containing a number, depending on the service.
+func fetchMetadataToken(url, header, value string) (string, time.Duration, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return "", 0, err
+	}
+	req.Header.Set(header, value)
+	var res struct {
+		AccessToken string      `json:"access_token"`
+		ExpiresIn   json.Number `json:"expires_in"`
+	}
+	if err = kmsRequest(req, &res); err != nil {
+		return "", 0, err
+	}
+	seconds, err := res.ExpiresIn.Int64()
+	if err != nil {
+		return "", 0, errors.WrapPrefix(err, "invalid access token lifetime", 0)
+	}
+	return res.AccessToken, time.Duration(seconds) * time.Second, nil
+}
+
+// AWS KMS
+
+type awsKMSClient struct {
+	endpoint, region, keyID string
+	credentials             *awsCredentialProvider
+	now                     func() time.Time
+}
+
+func newAWSKMSClient(region, keyID string) (*awsKMSClient, error) {
+	credentials, err := newAWSCredentialProvider(region)
+	if err != nil {
+		return nil, err
+	}
+	return &awsKMSClient{
+		endpoint:    "https://kms." + region + ".amazonaws.com/",
+		region:      region,
+		keyID:       keyID,
+		credentials: credentials,
+		now:         time.Now,
+	}, nil
+}
+
+func (c *awsKMSClient) publicKey() (*rsa.PublicKey, error) {
+	var res struct {
+		PublicKey         []byte
+		SigningAlgorithms []string
+	}
+	if err := c.do("GetPublicKey", map[string]string{"KeyId": c.keyID}, &res); err != nil {
+		return nil, err
+	}
+	if !slices.Contains(res.SigningAlgorithms, "RSASSA_PKCS1_V1_5_SHA_256") {
+		return nil, errors.New("key does not support RSASSA_PKCS1_V1_5_SHA_256 signatures")
+	}
+	return parsePKIXRSAPublicKey(res.PublicKey)
+}
+
+func (c *awsKMSClient) sign(digest []byte) ([]byte, error) {
+	var res struct{ Signature []byte }
+	err := c.do("Sign", map[string]string{
+		"KeyId":            c.keyID,
+		"Message":          base64.StdEncoding.EncodeToString(digest),
+		"MessageType":      "DIGEST",
+		"SigningAlgorithm": "RSASSA_PKCS1_V1_5_SHA_256",
+	}, &res)
+	return res.Signature, err
+}
+
+func (c *awsKMSClient) do(action string, body, result interface{}) error {
+	req, err := newKMSRequest(http.MethodPost, c.endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-amz-json-1.1")
+	req.Header.Set("X-Amz-Target", "TrentService."+action)
+	if err = c.signRequest(req, "kms"); err != nil {
+		return err
+	}
+	return kmsRequest(req, result)
+}
+
+// signRequest adds an AWS Signature Version 4 to the request. The query of the request, if any,
+// must already be in canonical form.
+func (c *awsKMSClient) signRequest(req *http.Request, service string) error {
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return err
+		}
+		req.Body = io.NopCloser(bytes.NewReader(body))
+	}
+
+	creds, err := c.credentials.get()
+	if err != nil {
+		return err
+	}
+	now := c.now().UTC()
+	date := now.Format("20060102")
+	req.Header.Set("X-Amz-Date", now.Format("20060102T150405Z"))
+	if creds.Token != "" {
+		req.Header.Set("X-Amz-Security-Token", creds.Token)
+	}
+
+	headers := map[string]string{"host": req.URL.Host}
+	for name, values := range req.Header {
+		headers[strings.ToLower(name)] = strings.TrimSpace(strings.Join(values, ","))
+	}
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var canonicalHeaders strings.Builder
+	for _, name := range names {
+		canonicalHeaders.WriteString(name + ":" + headers[name] + "\n")
+	}
+	signedHeaders := strings.Join(names, ";")
+
+	path := req.URL.EscapedPath()
+	if path == "" {
+		path = "/"
+	}
+	bodyHash := sha256.Sum256(body)
+	canonicalRequest := strings.Join([]string{
+		req.Method, path, req.URL.RawQuery, canonicalHeaders.String(), signedHeaders, hex.EncodeToString(bodyHash[:]),
+	}, "\n")
+	canonicalRequestHash := sha256.Sum256([]byte(canonicalRequest))
+
+	scope := date + "/" + c.region + "/" + service + "/aws4_request"
+	stringToSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" +
+		hex.EncodeToString(canonicalRequestHash[:])
+
+	key := []byte("AWS4" + creds.SecretAccessKey)
+	for _, part := range []string{date, c.region, service, "aws4_request", stringToSign} {
+		mac := hmac.New(sha256.New, key)
+		mac.Write([]byte(part))
+		key = mac.Sum(nil)
+	}
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential="+creds.AccessKeyID+"/"+scope+
+		", SignedHeaders="+signedHeaders+", Signature="+hex.EncodeToString(key))
+	return nil
+}
+
+// awsCredentials are credentials with which requests to AWS are signed. Temporary credentials
+// expire at Expiration; the JSON field names are those of the container and instance endpoints.
+type awsCredentials struct {
+	AccessKeyID     string    `json:"AccessKeyId"`
+	SecretAccessKey string    `json:"SecretAccessKey"`
+	Token           string    `json:"Token"`
+	Expiration      time.Time `json:"Expiration"`
+}
+
+// awsCredentialProvider caches AWS credentials, refreshing temporary credentials before they expire.
+type awsCredentialProvider struct {
+	sync.Mutex
+	fetch       func() (*awsCredentials, error)
+	credentials *awsCredentials
+}
+
+func staticAWSCredentials(accessKeyID, secretKey, token string) *awsCredentialProvider {
+	return &awsCredentialProvider{credentials: &awsCredentials{
+		AccessKeyID:     accessKeyID,
+		SecretAccessKey: secretKey,
+		Token:           token,
+	}}
+}
+
+// newAWSCredentialProvider looks for AWS credentials in the same places as the AWS SDKs, see NewKMSSigner().
+// The credentials themselves are retrieved from the web identity, container or instance endpoints when first used.
+func newAWSCredentialProvider(region string) (*awsCredentialProvider, error) {
+	if id, key := os.Getenv("AWS_ACCESS_KEY_ID"), os.Getenv("AWS_SECRET_ACCESS_KEY"); id != "" && key != "" {
+		return staticAWSCredentials(id, key, os.Getenv("AWS_SESSION_TOKEN")), nil
+	}
+
+	if tokenFile, role := os.Getenv("AWS_WEB_IDENTITY_TOKEN_FILE"), os.Getenv("AWS_ROLE_ARN"); tokenFile != "" && role != "" {
+		sessionName := os.Getenv("AWS_ROLE_SESSION_NAME")
+		if sessionName == "" {
+			sessionName = "irma"
+		}
+		endpoint := "https://sts." + region + ".amazonaws.com/"
+		return &awsCredentialProvider{fetch: func() (*awsCredentials, error) {
+			return fetchAWSWebIdentityCredentials(endpoint, role, sessionName, tokenFile)
+		}}, nil
+	}
+
+	if creds, err := readAWSSharedCredentials(); err != nil {
+		return nil, err
+	} else if creds != nil {
+		return &awsCredentialProvider{credentials: creds}, nil
+	}
+
+	if relative, full := os.Getenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI"), os.Getenv("AWS_CONTAINER_CREDENTIALS_FULL_URI"); relative != "" || full != "" {
+		endpoint := full
+		if relative != "" {
+			endpoint = "http://169.254.170.2" + relative
+		}
+		return &awsCredentialProvider{fetch: func() (*awsCredentials, error) {
+			return fetchAWSContainerCredentials(endpoint)
+		}}, nil
+	}
+
+	if strings.EqualFold(os.Getenv("AWS_EC2_METADATA_DISABLED"), "true") {
+		return nil, errors.New("no AWS credentials found for AWS KMS")
+	}
+	return &awsCredentialProvider{fetch: func() (*awsCredentials, error) {
+		return fetchAWSInstanceCredentials("http://169.254.169.254")
+	}}, nil
+}
+
+func (p *awsCredentialProvider) get() (*awsCredentials, error) {
+	p.Lock()
+	defer p.Unlock()
+	// Refresh temporary credentials a minute before they expire, so that they don't expire while in use
+	if p.credentials != nil && (p.credentials.Expiration.IsZero() || time.Now().Add(time.Minute).Before(p.credentials.Expiration)) {
+		return p.credentials, nil
+	}
+	creds, err := p.fetch()
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to obtain AWS credentials", 0)
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, errors.New("failed to obtain AWS credentials: response contains no credentials")
+	}
+	p.credentials = creds
+	return creds, nil
+}
+
+// readAWSSharedCredentials reads the credentials of the AWS_PROFILE profile, or the default profile,
+// from the shared credentials file. It returns nil if the file or the profile does not exist.
+func readAWSSharedCredentials() (*awsCredentials, error) {
+	path := os.Getenv("AWS_SHARED_CREDENTIALS_FILE")
+	if path == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil
+		}
+		path = filepath.Join(home, ".aws", "credentials")
+	}
+	profile := os.Getenv("AWS_PROFILE")
+	if profile == "" {
+		profile = "default"
+	}
+
+	bts, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to read AWS shared credentials file", 0)
+	}
+	var creds awsCredentials
+	var section string
+	for _, line := range strings.Split(string(bts), "\n") {
+		line = strings.TrimSpace(line)
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+		key, value, ok := strings.Cut(line, "=")
+		if !ok || section != profile {
+			continue
+		}
+		switch strings.TrimSpace(key) {
+		case "aws_access_key_id":
+			creds.AccessKeyID = strings.TrimSpace(value)
+		case "aws_secret_access_key":
+			creds.SecretAccessKey = strings.TrimSpace(value)
+		case "aws_session_token":
+			creds.Token = strings.TrimSpace(value)
+		}
+	}
+	if creds.AccessKeyID == "" || creds.SecretAccessKey == "" {
+		return nil, nil
+	}
+	return &creds, nil
+}
+
+// fetchAWSWebIdentityCredentials exchanges the web identity token in the token file, which is
+// rotated by the environment (e.g. EKS), for temporary credentials of the role at AWS STS.
+func fetchAWSWebIdentityCredentials(endpoint, role, sessionName, tokenFile string) (*awsCredentials, error) {
+	token, err := os.ReadFile(tokenFile)
+	if err != nil {
+		return nil, err
+	}
+	form := url.Values{
+		"Action":           {"AssumeRoleWithWebIdentity"},
+		"Version":          {"2011-06-15"},
+		"RoleArn":          {role},
+		"RoleSessionName":  {sessionName},
+		"WebIdentityToken": {strings.TrimSpace(string(token))},
+	}
+	req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	body, err := kmsResponse(req)
+	if err != nil {
+		return nil, err
+	}
+	var res struct {
+		Credentials struct {
+			AccessKeyID     string    `xml:"AccessKeyId"`
+			SecretAccessKey string    `xml:"SecretAccessKey"`
+			SessionToken    string    `xml:"SessionToken"`
+			Expiration      time.Time `xml:"Expiration"`
+		} `xml:"AssumeRoleWithWebIdentityResult>Credentials"`
+	}
+	if err = xml.Unmarshal(body, &res); err != nil {
+		return nil, err
+	}
+	return &awsCredentials{
+		AccessKeyID:     res.Credentials.AccessKeyID,
+		SecretAccessKey: res.Credentials.SecretAccessKey,
+		Token:           res.Credentials.SessionToken,
+		Expiration:      res.Credentials.Expiration,
+	}, nil
+}
+
+// fetchAWSContainerCredentials retrieves the credentials of the task role from the container
+// credentials endpoint (e.g. ECS).
+func fetchAWSContainerCredentials(endpoint string) (*awsCredentials, error) {
+	req, err := http.NewRequest(http.MethodGet, endpoint, nil)
+	if err != nil {
+		return nil, err
+	}
+	authorization := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN")
+	if file := os.Getenv("AWS_CONTAINER_AUTHORIZATION_TOKEN_FILE"); file != "" {
+		bts, err := os.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		authorization = strings.TrimSpace(string(bts))
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	creds := &awsCredentials{}
+	return creds, kmsRequest(req, creds)
+}
+
+// fetchAWSInstanceCredentials retrieves the credentials of the role of the EC2 instance from the
+// instance metadata service, using IMDSv2.
+func fetchAWSInstanceCredentials(endpoint string) (*awsCredentials, error) {
+	req, err := http.NewRequest(http.MethodPut, endpoint+"/latest/api/token", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("X-aws-ec2-metadata-token-ttl-seconds", "300")
+	token, err := kmsResponse(req)
+	if err != nil {
+		return nil, err
+	}
+
+	get := func(path string) (*http.Request, error) {
+		req, err := http.NewRequest(http.MethodGet, endpoint+"/latest/meta-data/iam/security-credentials/"+path, nil)
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("X-aws-ec2-metadata-token", string(token))
+		return req, nil
+	}
+	req, err = get("")
+	if err != nil {
+		return nil, err
+	}
+	roles, err := kmsResponse(req)
+	if err != nil {
+		return nil, err
+	}
+	role, _, _ := strings.Cut(strings.TrimSpace(string(roles)), "\n")
+	if role == "" {
+		return nil, errors.New("EC2 instance has no role")
+	}
+	if req, err = get(url.PathEscape(role)); err != nil {
+		return nil, err
+	}
+	creds := &awsCredentials{}
+	return creds, kmsRequest(req, creds)
+}
+
+// Google Cloud KMS
+
+type gcpKMSClient struct {
+	endpoint, name string
+	token          *accessToken
+}
+
+func newGCPKMSClient(name string) *gcpKMSClient {
+	return &gcpKMSClient{
+		endpoint: "https://cloudkms.googleapis.com/v1/",
+		name:     name,
+		token: &accessToken{fetch: func() (string, time.Duration, error) {
+			return fetchMetadataToken(
+				"http://metadata.google.internal/computeMetadata/v1/instance/service-accounts/default/token",
+				"Metadata-Flavor", "Google",
+			)
+		}},
+	}
+}
+
+func (c *gcpKMSClient) publicKey() (*rsa.PublicKey, error) {
+	var res struct {
+		Pem       string `json:"pem"`
+		Algorithm string `json:"algorithm"`
+	}
+	if err := c.do(http.MethodGet, "/publicKey", nil, &res); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(res.Algorithm, "RSA_SIGN_PKCS1_") || !strings.HasSuffix(res.Algorithm, "_SHA256") {
+		return nil, errors.Errorf("key has unsupported algorithm %s", res.Algorithm)
+	}
+	block, _ := pem.Decode([]byte(res.Pem))
+	if block == nil {
+		return nil, errors.New("public key is not PEM encoded")
+	}
+	return parsePKIXRSAPublicKey(block.Bytes)
+}
+
+func (c *gcpKMSClient) sign(digest []byte) ([]byte, error) {
+	var res struct {
+		Signature []byte `json:"signature"`
+	}
+	body := map[string]map[string][]byte{"digest": {"sha256": digest}}
+	err := c.do(http.MethodPost, ":asymmetricSign", body, &res)
+	return res.Signature, err
+}
+
+func (c *gcpKMSClient) do(method, suffix string, body, result interface{}) error {
+	token, err := c.token.get()
+	if err != nil {
+		return err
+	}
+	req, err := newKMSRequest(method, c.endpoint+c.name+suffix, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return kmsRequest(req, result)
+}
+
+// Azure Key Vault
+
+const azureKVAPIVersion = "7.4"
+
+type azureKVClient struct {
+	endpoint string
+	token    *accessToken
+}
+
+func newAzureKVClient(vault, path string) *azureKVClient {
+	return &azureKVClient{
+		endpoint: "https://" + vault + "/" + path,
+		token: &accessToken{fetch: func() (string, time.Duration, error) {
+			return fetchMetadataToken(
+				"http://169.254.169.254/metadata/identity/oauth2/token?api-version=2018-02-01&resource="+
+					url.QueryEscape("https://vault.azure.net"),
+				"Metadata", "true",
+			)
+		}},
+	}
+}
+
+func (c *azureKVClient) publicKey() (*rsa.PublicKey, error) {
+	var res struct {
+		Key irma.JWK `json:"key"`
+	}
+	if err := c.do(http.MethodGet, "", nil, &res); err != nil {
+		return nil, err
+	}
+	// Keys protected by a hardware security module have key type RSA-HSM
+	if strings.HasPrefix(res.Key.Kty, "RSA") {
+		res.Key.Kty = "RSA"
+	}
+	return res.Key.RSAPublicKey()
+}
+
+func (c *azureKVClient) sign(digest []byte) ([]byte, error) {
+	var res struct {
+		Value string `json:"value"`
+	}
+	body := map[string]string{"alg": "RS256", "value": base64.RawURLEncoding.EncodeToString(digest)}
+	if err := c.do(http.MethodPost, "/sign", body, &res); err != nil {
+		return nil, err
+	}
+	return base64.RawURLEncoding.DecodeString(strings.TrimRight(res.Value, "="))
+}
+
+func (c *azureKVClient) do(method, suffix string, body, result interface{}) error {
+	token, err := c.token.get()
+	if err != nil {
+		return err
+	}
+	req, err := newKMSRequest(method, c.endpoint+suffix+"?api-version="+azureKVAPIVersion, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+token)
+	return kmsRequest(req, result)
+}
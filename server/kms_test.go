@@ -0,0 +1,202 @@
+package server
+
+import (
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAWSSignatureV4(t *testing.T) {
+	// Example from the AWS Signature Version 4 documentation
+	c := &awsKMSClient{
+		region:      "us-east-1",
+		credentials: staticAWSCredentials("AKIDEXAMPLE", "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY", ""),
+		now:         func() time.Time { return time.Date(2015, 8, 30, 12, 36, 0, 0, time.UTC) },
+	}
+	req, err := http.NewRequest(http.MethodGet, "https://iam.amazonaws.com/?Action=ListUsers&Version=2010-05-08", nil)
+	require.NoError(t, err)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded; charset=utf-8")
+	require.NoError(t, c.signRequest(req, "iam"))
+	require.Equal(t,
+		"AWS4-HMAC-SHA256 Credential=AKIDEXAMPLE/20150830/us-east-1/iam/aws4_request, "+
+			"SignedHeaders=content-type;host;x-amz-date, "+
+			"Signature=5d672d79c15b13162d9279b0855cfba6789a8edb4c82c400e06b5924a6f2b5d7",
+		req.Header.Get("Authorization"),
+	)
+}
+
+func TestKMSSigner(t *testing.T) {
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	pkbts, err := x509.MarshalPKIXPublicKey(&sk.PublicKey)
+	require.NoError(t, err)
+
+	// Mock of the Google Cloud KMS API
+	name := "projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1"
+	kms := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		require.Equal(t, "Bearer token", r.Header.Get("Authorization"))
+		switch r.URL.Path {
+		case "/v1/" + name + "/publicKey":
+			_ = json.NewEncoder(w).Encode(map[string]string{
+				"pem":       string(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pkbts})),
+				"algorithm": "RSA_SIGN_PKCS1_2048_SHA256",
+			})
+		case "/v1/" + name + ":asymmetricSign":
+			var req struct{ Digest struct{ Sha256 []byte } }
+			require.NoError(t, json.NewDecoder(r.Body).Decode(&req))
+			sig, err := rsa.SignPKCS1v15(nil, sk, crypto.SHA256, req.Digest.Sha256)
+			require.NoError(t, err)
+			_ = json.NewEncoder(w).Encode(map[string][]byte{"signature": sig})
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer kms.Close()
+
+	var fetched int
+	client := newGCPKMSClient(name)
+	client.endpoint = kms.URL + "/v1/"
+	client.token.fetch = func() (string, time.Duration, error) {
+		fetched++
+		return "token", time.Hour, nil
+	}
+	signer, err := newKMSSigner(client)
+	require.NoError(t, err)
+	require.Equal(t, &sk.PublicKey, signer.Public())
+
+	// JWTs signed by the KMS can be verified using the public key
+	conf := &Configuration{JwtCryptoSigner: signer}
+	j, err := ResultJwt(&SessionResult{Type: irma.ActionDisclosing}, "issuer", 60, conf.JwtSigningKey())
+	require.NoError(t, err)
+	claims := &jwt.StandardClaims{}
+	_, err = jwt.ParseWithClaims(j, claims, func(token *jwt.Token) (interface{}, error) {
+		require.Equal(t, jwt.SigningMethodRS256, token.Method)
+		return conf.JwtPublicKey(), nil
+	})
+	require.NoError(t, err)
+	require.Equal(t, "issuer", claims.Issuer)
+	require.Equal(t, 1, fetched)
+
+	_, err = signer.Sign(rand.Reader, make([]byte, 32), &rsa.PSSOptions{Hash: crypto.SHA256})
+	require.Error(t, err)
+}
+
+func TestAWSCredentials(t *testing.T) {
+	expiration := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+	var fetched int
+	metadata := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/latest/api/token":
+			require.Equal(t, http.MethodPut, r.Method)
+			_, _ = w.Write([]byte("imdstoken"))
+		case "/latest/meta-data/iam/security-credentials/":
+			require.Equal(t, "imdstoken", r.Header.Get("X-aws-ec2-metadata-token"))
+			_, _ = w.Write([]byte("role\n"))
+		case "/latest/meta-data/iam/security-credentials/role":
+			require.Equal(t, "imdstoken", r.Header.Get("X-aws-ec2-metadata-token"))
+			fetched++
+			_ = json.NewEncoder(w).Encode(map[string]interface{}{
+				"Code": "Success", "AccessKeyId": "ASIAINSTANCE", "SecretAccessKey": "secret", "Token": "session",
+				"Expiration": expiration,
+			})
+		case "/sts/":
+			require.NoError(t, r.ParseForm())
+			require.Equal(t, "AssumeRoleWithWebIdentity", r.Form.Get("Action"))
+			require.Equal(t, "arn:aws:iam::123456789012:role/irma", r.Form.Get("RoleArn"))
+			require.Equal(t, "webidentitytoken", r.Form.Get("WebIdentityToken"))
+			_, _ = w.Write([]byte(`<AssumeRoleWithWebIdentityResponse xmlns="https://sts.amazonaws.com/doc/2011-06-15/">
+  <AssumeRoleWithWebIdentityResult>
+    <Credentials>
+      <SessionToken>session</SessionToken>
+      <SecretAccessKey>secret</SecretAccessKey>
+      <Expiration>` + expiration.Format(time.RFC3339) + `</Expiration>
+      <AccessKeyId>ASIAWEBIDENTITY</AccessKeyId>
+    </Credentials>
+  </AssumeRoleWithWebIdentityResult>
+</AssumeRoleWithWebIdentityResponse>`))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer metadata.Close()
+
+	// Instance credentials are cached until they almost expire
+	provider := &awsCredentialProvider{fetch: func() (*awsCredentials, error) {
+		return fetchAWSInstanceCredentials(metadata.URL)
+	}}
+	creds, err := provider.get()
+	require.NoError(t, err)
+	require.Equal(t, &awsCredentials{AccessKeyID: "ASIAINSTANCE", SecretAccessKey: "secret", Token: "session", Expiration: expiration}, creds)
+	_, err = provider.get()
+	require.NoError(t, err)
+	require.Equal(t, 1, fetched)
+	provider.credentials.Expiration = time.Now().Add(30 * time.Second)
+	_, err = provider.get()
+	require.NoError(t, err)
+	require.Equal(t, 2, fetched)
+
+	// Web identity tokens are exchanged at STS
+	tokenFile := filepath.Join(t.TempDir(), "token")
+	require.NoError(t, os.WriteFile(tokenFile, []byte("webidentitytoken\n"), 0600))
+	creds, err = fetchAWSWebIdentityCredentials(metadata.URL+"/sts/", "arn:aws:iam::123456789012:role/irma", "irma", tokenFile)
+	require.NoError(t, err)
+	require.Equal(t, &awsCredentials{AccessKeyID: "ASIAWEBIDENTITY", SecretAccessKey: "secret", Token: "session", Expiration: expiration}, creds)
+
+	// Credentials are taken from the environment first, then from the shared credentials file
+	credentialsFile := filepath.Join(t.TempDir(), "credentials")
+	require.NoError(t, os.WriteFile(credentialsFile, []byte("[default]\naws_access_key_id = AKIADEFAULT\naws_secret_access_key = secret\n\n"+
+		"[irma]\naws_access_key_id = AKIAPROFILE\naws_secret_access_key = secret\naws_session_token = session\n"), 0600))
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", credentialsFile)
+	t.Setenv("AWS_PROFILE", "irma")
+	t.Setenv("AWS_ACCESS_KEY_ID", "AKIAENV")
+	t.Setenv("AWS_SECRET_ACCESS_KEY", "secret")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	provider, err = newAWSCredentialProvider("eu-west-1")
+	require.NoError(t, err)
+	creds, err = provider.get()
+	require.NoError(t, err)
+	require.Equal(t, "AKIAENV", creds.AccessKeyID)
+
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	provider, err = newAWSCredentialProvider("eu-west-1")
+	require.NoError(t, err)
+	creds, err = provider.get()
+	require.NoError(t, err)
+	require.Equal(t, &awsCredentials{AccessKeyID: "AKIAPROFILE", SecretAccessKey: "secret", Token: "session"}, creds)
+}
+
+func TestNewKMSSignerInvalidURI(t *testing.T) {
+	t.Setenv("AWS_ACCESS_KEY_ID", "")
+	t.Setenv("AWS_WEB_IDENTITY_TOKEN_FILE", "")
+	t.Setenv("AWS_SHARED_CREDENTIALS_FILE", filepath.Join(t.TempDir(), "credentials"))
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_RELATIVE_URI", "")
+	t.Setenv("AWS_CONTAINER_CREDENTIALS_FULL_URI", "")
+	t.Setenv("AWS_EC2_METADATA_DISABLED", "true")
+	for _, uri := range []string{
+		"",
+		"projects/p/locations/l/keyRings/r/cryptoKeys/k/cryptoKeyVersions/1",
+		"hsm://key",
+		"awskms://eu-west-1/",
+		"awskms://eu-west-1/alias/key",
+		"gcpkms://projects/p/locations/l/keyRings/r/cryptoKeys/k",
+		"azurekv://vault.vault.azure.net/secrets/key/1",
+	} {
+		_, err := NewKMSSigner(uri)
+		require.Error(t, err, uri)
+		require.False(t, strings.Contains(err.Error(), "public key"), uri)
+	}
+}
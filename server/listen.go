@@ -0,0 +1,161 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+
+	"github.com/go-errors/errors"
+)
+
+// Besides host addresses, the listen address of each of the servers may be one of the following,
+// in which case the port is ignored:
+//   - "unix:<path>": listen on a Unix domain socket at the specified path;
+//   - "systemd": use the socket passed by systemd socket activation, if exactly one was passed;
+//   - "systemd:<name>": use the socket passed by systemd socket activation having the specified
+//     name (i.e. the FileDescriptorName= of the socket unit).
+const (
+	unixAddressPrefix = "unix:"
+	systemdAddress    = "systemd"
+)
+
+// The first file descriptor passed by systemd socket activation, see sd_listen_fds(3)
+const listenFdsStart = 3
+
+type activatedSocket struct {
+	name  string
+	file  *os.File
+	taken bool
+}
+
+var (
+	activatedSocketsOnce  sync.Once
+	activatedSocketsMutex sync.Mutex
+	activatedSockets      []*activatedSocket
+)
+
+// IsSocketAddress returns whether the listen address refers to a Unix domain socket or to a socket
+// passed by systemd, instead of to a host address to be combined with a port.
+func IsSocketAddress(addr string) bool {
+	return strings.HasPrefix(addr, unixAddressPrefix) ||
+		addr == systemdAddress ||
+		strings.HasPrefix(addr, systemdAddress+":")
+}
+
+// FullListenAddress returns the address at which a server listens, for logging.
+func FullListenAddress(addr string, port int) string {
+	if IsSocketAddress(addr) {
+		return addr
+	}
+	return fmt.Sprintf("%s:%d", addr, port)
+}
+
+// removeStaleSocket removes the Unix domain socket at the specified path if it was left behind by
+// a previous process that was not shut down gracefully, i.e. if connecting to it is refused.
+func removeStaleSocket(path string) error {
+	info, err := os.Lstat(path)
+	if err != nil || info.Mode()&os.ModeSocket == 0 {
+		return nil // let net.Listen() report the problem, if any
+	}
+	conn, err := net.Dial("unix", path)
+	if err == nil {
+		_ = conn.Close()
+		return errors.Errorf("Unix domain socket %s is in use by another process", path)
+	}
+	if !errors.Is(err, syscall.ECONNREFUSED) {
+		return errors.WrapPrefix(err, "failed to check Unix domain socket "+path, 0)
+	}
+	return os.Remove(path)
+}
+
+// Listen returns a listener for the specified listen address and port.
+func Listen(addr string, port int) (net.Listener, error) {
+	switch {
+	case strings.HasPrefix(addr, unixAddressPrefix):
+		path := strings.TrimPrefix(addr, unixAddressPrefix)
+		if err := removeStaleSocket(path); err != nil {
+			return nil, err
+		}
+		return net.Listen("unix", path)
+	case IsSocketAddress(addr):
+		name := strings.TrimPrefix(strings.TrimPrefix(addr, systemdAddress), ":")
+		file, err := takeActivatedSocket(name)
+		if err != nil {
+			return nil, err
+		}
+		defer func() { _ = file.Close() }() // net.FileListener() uses a duplicate of the file descriptor
+		return net.FileListener(file)
+	default:
+		return net.Listen("tcp", FullListenAddress(addr, port))
+	}
+}
+
+// takeActivatedSocket returns the socket passed by systemd having the specified name, or the only
+// passed socket if name is empty. Each socket can be used by only one listener.
+func takeActivatedSocket(name string) (*os.File, error) {
+	activatedSocketsOnce.Do(loadActivatedSockets)
+	activatedSocketsMutex.Lock()
+	defer activatedSocketsMutex.Unlock()
+
+	if len(activatedSockets) == 0 {
+		return nil, errors.New("no sockets were passed by systemd socket activation")
+	}
+	var socket *activatedSocket
+	if name == "" {
+		if len(activatedSockets) != 1 {
+			return nil, errors.Errorf("%d sockets were passed by systemd socket activation, specify which one to use using systemd:<name>", len(activatedSockets))
+		}
+		socket = activatedSockets[0]
+	} else {
+		for _, s := range activatedSockets {
+			if s.name == name {
+				socket = s
+				break
+			}
+		}
+		if socket == nil {
+			return nil, errors.Errorf("no socket named %s was passed by systemd socket activation", name)
+		}
+	}
+	if socket.taken {
+		return nil, errors.Errorf("socket %s passed by systemd socket activation is already in use", socket.file.Name())
+	}
+	socket.taken = true
+	return socket.file, nil
+}
+
+// loadActivatedSockets reads the sockets passed by systemd socket activation from the environment,
+// as described in sd_listen_fds(3).
+func loadActivatedSockets() {
+	defer func() {
+		// Prevent child processes from thinking the sockets were passed to them
+		_ = os.Unsetenv("LISTEN_PID")
+		_ = os.Unsetenv("LISTEN_FDS")
+		_ = os.Unsetenv("LISTEN_FDNAMES")
+	}()
+
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return
+	}
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return
+	}
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	for i := 0; i < count; i++ {
+		fd := listenFdsStart + i
+		var name string
+		if i < len(names) {
+			name = names[i]
+		}
+		activatedSockets = append(activatedSockets, &activatedSocket{
+			name: name,
+			file: os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd)),
+		})
+	}
+}
@@ -0,0 +1,65 @@
+package server
+
+import (
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestListenUnixSocket(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "irma.sock")
+	addr := "unix:" + path
+	require.True(t, IsSocketAddress(addr))
+	require.Equal(t, addr, FullListenAddress(addr, 8088))
+
+	// A socket left behind by a previous process is replaced
+	stale, err := net.Listen("unix", path)
+	require.NoError(t, err)
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	require.NoError(t, stale.Close())
+
+	listener, err := Listen(addr, 0)
+	require.NoError(t, err)
+	serv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("ok"))
+	})}
+	go func() { _ = serv.Serve(listener) }()
+	defer func() { _ = serv.Close() }()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return (&net.Dialer{}).DialContext(ctx, "unix", path)
+		},
+	}}
+	res, err := client.Get("http://irma/")
+	require.NoError(t, err)
+	defer func() { _ = res.Body.Close() }()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(t, err)
+	require.Equal(t, "ok", string(body))
+
+	// A socket in use is not replaced
+	_, err = Listen(addr, 0)
+	require.Error(t, err)
+	res, err = client.Get("http://irma/")
+	require.NoError(t, err)
+	require.NoError(t, res.Body.Close())
+}
+
+func TestListenAddresses(t *testing.T) {
+	require.False(t, IsSocketAddress(""))
+	require.False(t, IsSocketAddress("127.0.0.1"))
+	require.False(t, IsSocketAddress("systemd.example.com"))
+	require.True(t, IsSocketAddress("systemd"))
+	require.True(t, IsSocketAddress("systemd:client"))
+	require.Equal(t, "127.0.0.1:8088", FullListenAddress("127.0.0.1", 8088))
+
+	// Without socket activation, no sockets have been passed by systemd
+	_, err := Listen("systemd", 0)
+	require.Error(t, err)
+}
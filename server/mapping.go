@@ -0,0 +1,143 @@
+package server
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// AttributeMapping specifies how disclosed attributes are presented to parties that consume them
+// as named values, such as the claims of the session result JWT or the headers that the reverse
+// proxy forwards to its upstream.
+type AttributeMapping []AttributeMappingRule
+
+// AttributeMappingRule maps the value of a disclosed attribute, optionally transformed, to a name.
+// The same attribute may occur in multiple rules, e.g. to derive both an age and an over-18 flag
+// from a date of birth.
+type AttributeMappingRule struct {
+	Attribute irma.AttributeTypeIdentifier `json:"attribute" mapstructure:"attribute"`
+	Name      string                       `json:"name" mapstructure:"name"`
+	// Transform applied to the attribute value, one of:
+	//  - "" (the default): the attribute value as is
+	//  - "lowercase", "uppercase": the attribute value in lower or upper case
+	//  - "sha256": the hex-encoded SHA-256 hash of the attribute value
+	//  - "age": the age in years, for attributes containing a date (e.g. a date of birth)
+	//  - "over:<n>": "yes" if the age is at least n years, "no" otherwise
+	Transform string `json:"transform,omitempty" mapstructure:"transform"`
+}
+
+// Date formats that are accepted by the "age" and "over" transforms.
+var mappingDateFormats = []string{"2006-01-02", "02-01-2006", "2006/01/02", "02/01/2006"}
+
+// Validate checks that all rules have a name and a known transform, and that no name is used twice.
+func (m AttributeMapping) Validate() error {
+	names := map[string]struct{}{}
+	for _, rule := range m {
+		if rule.Attribute.Empty() || rule.Name == "" {
+			return errors.New("attribute mapping rule must specify attribute and name")
+		}
+		if _, ok := names[rule.Name]; ok {
+			return errors.Errorf("attribute mapping name %s is used more than once", rule.Name)
+		}
+		names[rule.Name] = struct{}{}
+		if _, err := rule.transform("", false); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Apply returns the mapped values of the disclosed attributes. Rules whose attribute was not
+// disclosed, or was disclosed without a value, are skipped.
+func (m AttributeMapping) Apply(disclosed [][]*irma.DisclosedAttribute) (map[string]string, error) {
+	values := map[irma.AttributeTypeIdentifier]string{}
+	for _, con := range disclosed {
+		for _, attr := range con {
+			if attr.RawValue != nil {
+				values[attr.Identifier] = *attr.RawValue
+			}
+		}
+	}
+
+	result := make(map[string]string, len(m))
+	for _, rule := range m {
+		value, ok := values[rule.Attribute]
+		if !ok {
+			continue
+		}
+		transformed, err := rule.transform(value, true)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to map attribute "+rule.Attribute.String(), 0)
+		}
+		result[rule.Name] = transformed
+	}
+	return result, nil
+}
+
+// transform applies the rule's transform to the value. If apply is false, only the transform
+// itself is checked.
+func (rule AttributeMappingRule) transform(value string, apply bool) (string, error) {
+	return transformValue(rule.Transform, value, apply)
+}
+
+// transformValue applies the transform (see AttributeMappingRule) to the value. If apply is false,
+// only the transform itself is checked.
+func transformValue(transform, value string, apply bool) (string, error) {
+	name, arg, _ := strings.Cut(transform, ":")
+	switch name {
+	case "":
+		return value, nil
+	case "lowercase":
+		return strings.ToLower(value), nil
+	case "uppercase":
+		return strings.ToUpper(value), nil
+	case "sha256":
+		hash := sha256.Sum256([]byte(value))
+		return hex.EncodeToString(hash[:]), nil
+	case "age", "over":
+		var min int
+		if name == "over" {
+			var err error
+			if min, err = strconv.Atoi(arg); err != nil || min < 0 {
+				return "", errors.Errorf("transform %s must be of the form over:<age>", transform)
+			}
+		}
+		if !apply {
+			return "", nil
+		}
+		age, err := mappingAge(value)
+		if err != nil {
+			return "", err
+		}
+		if name == "age" {
+			return strconv.Itoa(age), nil
+		}
+		if age >= min {
+			return "yes", nil
+		}
+		return "no", nil
+	default:
+		return "", errors.Errorf("unknown attribute mapping transform %s", transform)
+	}
+}
+
+func mappingAge(value string) (int, error) {
+	for _, format := range mappingDateFormats {
+		date, err := time.Parse(format, value)
+		if err != nil {
+			continue
+		}
+		now := time.Now()
+		age := now.Year() - date.Year()
+		if now.Month() < date.Month() || now.Month() == date.Month() && now.Day() < date.Day() {
+			age--
+		}
+		return age, nil
+	}
+	return 0, errors.Errorf("value %s is not a date", value)
+}
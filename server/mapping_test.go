@@ -0,0 +1,62 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func disclosedAttribute(id, value string) *irma.DisclosedAttribute {
+	return &irma.DisclosedAttribute{Identifier: irma.NewAttributeTypeIdentifier(id), RawValue: &value}
+}
+
+func TestAttributeMappingValidate(t *testing.T) {
+	attr := irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+	require.NoError(t, AttributeMapping{{Attribute: attr, Name: "name", Transform: "over:18"}}.Validate())
+	require.Error(t, AttributeMapping{{Attribute: attr}}.Validate())
+	require.Error(t, AttributeMapping{{Attribute: attr, Name: "name", Transform: "base64"}}.Validate())
+	require.Error(t, AttributeMapping{{Attribute: attr, Name: "name", Transform: "over:x"}}.Validate())
+	require.Error(t, AttributeMapping{
+		{Attribute: attr, Name: "name"},
+		{Attribute: attr, Name: "name", Transform: "uppercase"},
+	}.Validate())
+}
+
+func TestAttributeMappingApply(t *testing.T) {
+	dob := time.Now().AddDate(-20, 0, -1).Format("2006-01-02")
+	disclosed := [][]*irma.DisclosedAttribute{{
+		disclosedAttribute("irma-demo.MijnOverheid.fullName.firstname", "Alice"),
+		disclosedAttribute("irma-demo.MijnOverheid.root.BSN", "12345"),
+	}, {
+		disclosedAttribute("irma-demo.MijnOverheid.birthCertificate.dateofbirth", dob),
+	}}
+
+	mapping := AttributeMapping{
+		{Attribute: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"), Name: "given_name"},
+		{Attribute: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"), Name: "upper", Transform: "uppercase"},
+		{Attribute: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN"), Name: "bsn", Transform: "sha256"},
+		{Attribute: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.birthCertificate.dateofbirth"), Name: "age", Transform: "age"},
+		{Attribute: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.birthCertificate.dateofbirth"), Name: "over18", Transform: "over:18"},
+		{Attribute: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.birthCertificate.dateofbirth"), Name: "over21", Transform: "over:21"},
+		{Attribute: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname"), Name: "family_name"},
+	}
+	require.NoError(t, mapping.Validate())
+
+	result, err := mapping.Apply(disclosed)
+	require.NoError(t, err)
+	require.Equal(t, map[string]string{
+		"given_name": "Alice",
+		"upper":      "ALICE",
+		"bsn":        "5994471abb01112afcc18159f6cc74b4f511b99806da59b3caf5a9c173cacfc5",
+		"age":        "20",
+		"over18":     "yes",
+		"over21":     "no",
+	}, result)
+
+	_, err = AttributeMapping{
+		{Attribute: irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname"), Name: "age", Transform: "age"},
+	}.Apply(disclosed)
+	require.Error(t, err)
+}
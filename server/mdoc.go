@@ -0,0 +1,235 @@
+package server
+
+import (
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"os"
+	"strconv"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+// MdocMapping specifies the data elements of mdocs (ISO/IEC 18013-5) that may be presented
+// instead of disclosing IRMA attributes, in sessions in which the requestor enables this.
+type MdocMapping []MdocMappingRule
+
+// MdocMappingRule maps a data element of an mdoc to the IRMA attribute containing the same value,
+// such as the family_name of a mobile driving licence to the family name of a personal data credential.
+type MdocMappingRule struct {
+	Attribute irma.AttributeTypeIdentifier `json:"attribute" mapstructure:"attribute"`
+	DocType   string                       `json:"doctype" mapstructure:"doctype"`
+	NameSpace string                       `json:"namespace" mapstructure:"namespace"`
+	Element   string                       `json:"element" mapstructure:"element"`
+}
+
+// MdocDocumentInfo describes an mdoc that was presented in a session.
+type MdocDocumentInfo struct {
+	DocType    string         `json:"doctype"`
+	Issuer     string         `json:"issuer"` // subject of the document signer certificate
+	Signed     irma.Timestamp `json:"signed"`
+	ValidUntil irma.Timestamp `json:"validUntil"`
+}
+
+func (conf *Configuration) verifyMdoc() error {
+	if conf.MdocIssuerCertificates == nil && conf.MdocIssuerCertificatesFile != "" {
+		bts, err := os.ReadFile(conf.MdocIssuerCertificatesFile)
+		if err != nil {
+			return errors.WrapPrefix(err, "failed to read mdoc issuer certificates", 0)
+		}
+		for block, rest := pem.Decode(bts); block != nil; block, rest = pem.Decode(rest) {
+			cert, err := x509.ParseCertificate(block.Bytes)
+			if err != nil {
+				return errors.WrapPrefix(err, "failed to parse mdoc issuer certificate", 0)
+			}
+			conf.MdocIssuerCertificates = append(conf.MdocIssuerCertificates, cert)
+		}
+	}
+	if len(conf.MdocMapping) > 0 && len(conf.MdocIssuerCertificates) == 0 {
+		return errors.New("mdoc_mapping requires mdoc issuer certificates")
+	}
+
+	attrs := map[irma.AttributeTypeIdentifier]struct{}{}
+	for _, rule := range conf.MdocMapping {
+		if rule.DocType == "" || rule.NameSpace == "" || rule.Element == "" {
+			return errors.New("mdoc mapping rule must specify doctype, namespace and element")
+		}
+		if _, ok := conf.IrmaConfiguration.AttributeTypes[rule.Attribute]; !ok {
+			return errors.Errorf("Unknown attribute %s in mdoc_mapping", rule.Attribute)
+		}
+		if _, ok := attrs[rule.Attribute]; ok {
+			return errors.Errorf("attribute %s is mapped more than once in mdoc_mapping", rule.Attribute)
+		}
+		attrs[rule.Attribute] = struct{}{}
+	}
+
+	conf.mdocRoots = x509.NewCertPool()
+	for _, cert := range conf.MdocIssuerCertificates {
+		conf.mdocRoots.AddCert(cert)
+	}
+	return nil
+}
+
+// MdocRoots returns the pool of mdoc issuer certificates against which mdocs are verified.
+func (conf *Configuration) MdocRoots() *x509.CertPool {
+	return conf.mdocRoots
+}
+
+// rule returns the rule mapping a data element to the specified attribute, if any.
+func (m MdocMapping) rule(attr irma.AttributeTypeIdentifier) *MdocMappingRule {
+	for i := range m {
+		if m[i].Attribute == attr {
+			return &m[i]
+		}
+	}
+	return nil
+}
+
+// ItemsRequests returns the data elements to request for the attributes of the condiscon that are
+// mapped to data elements, and whether each disjunction contains an inner conjunction of which all
+// attributes are mapped, i.e. whether the condiscon can be satisfied by presenting mdocs.
+func (m MdocMapping) ItemsRequests(condiscon irma.AttributeConDisCon) ([]*irma.MdocItemsRequest, bool) {
+	var items []*irma.MdocItemsRequest
+	doctypes := map[string]*irma.MdocItemsRequest{}
+	satisfiable := true
+	for _, discon := range condiscon {
+		mapped := false
+		for _, con := range discon {
+			all := true
+			for _, attr := range con {
+				rule := m.rule(attr.Type)
+				if rule == nil {
+					all = false
+					continue
+				}
+				item, ok := doctypes[rule.DocType]
+				if !ok {
+					item = &irma.MdocItemsRequest{DocType: rule.DocType, NameSpaces: map[string]map[string]bool{}}
+					doctypes[rule.DocType] = item
+					items = append(items, item)
+				}
+				if item.NameSpaces[rule.NameSpace] == nil {
+					item.NameSpaces[rule.NameSpace] = map[string]bool{}
+				}
+				item.NameSpaces[rule.NameSpace][rule.Element] = false
+			}
+			mapped = mapped || all
+		}
+		satisfiable = satisfiable && mapped
+	}
+	return items, satisfiable
+}
+
+// Disclosed returns the attributes to which the data elements of the verified mdocs are mapped,
+// matched to the condiscon like the attributes of an Idemix disclosure (see irma.Disclosure.DisclosedAttributes()),
+// and the resulting proof status.
+func (m MdocMapping) Disclosed(
+	conf *irma.Configuration, condiscon irma.AttributeConDisCon, docs []*irma.MdocVerifiedDocument,
+) ([][]*irma.DisclosedAttribute, irma.ProofStatus, error) {
+	attrs := map[irma.AttributeTypeIdentifier]*irma.DisclosedAttribute{}
+	var order []irma.AttributeTypeIdentifier
+	for _, doc := range docs {
+		for _, rule := range m {
+			value, ok := doc.Elements[rule.NameSpace][rule.Element]
+			if !ok || rule.DocType != doc.DocType {
+				continue
+			}
+			if _, ok = attrs[rule.Attribute]; ok {
+				return nil, irma.ProofStatusInvalid, errors.Errorf("attribute %s presented more than once", rule.Attribute)
+			}
+			str, err := mdocElementValue(value)
+			if err != nil {
+				return nil, irma.ProofStatusInvalid, errors.WrapPrefix(err, "failed to map data element "+rule.Element, 0)
+			}
+			attr := &irma.DisclosedAttribute{
+				Identifier:   rule.Attribute,
+				RawValue:     &str,
+				Value:        irma.NewTranslatedString(&str),
+				Status:       irma.AttributeProofStatusPresent,
+				IssuanceTime: irma.Timestamp(doc.Signed),
+			}
+			if typ := conf.AttributeTypes[rule.Attribute]; typ != nil {
+				attr.DataType = typ.DataType
+			}
+			attrs[rule.Attribute] = attr
+			order = append(order, rule.Attribute)
+		}
+	}
+
+	status := irma.ProofStatusValid
+	used := map[irma.AttributeTypeIdentifier]struct{}{}
+	list := make([][]*irma.DisclosedAttribute, len(condiscon))
+	for i, discon := range condiscon {
+		for _, con := range discon {
+			if l, ok := mdocSatisfy(con, attrs); ok {
+				list[i] = l
+				for _, attr := range l {
+					used[attr.Identifier] = struct{}{}
+				}
+				break
+			}
+		}
+		if list[i] == nil {
+			status = irma.ProofStatusMissingAttributes
+		}
+	}
+
+	var extra []*irma.DisclosedAttribute
+	for _, id := range order {
+		if _, ok := used[id]; !ok {
+			attrs[id].Status = irma.AttributeProofStatusExtra
+			extra = append(extra, attrs[id])
+		}
+	}
+	if len(extra) > 0 {
+		list = append(list, extra)
+	}
+	return list, status, nil
+}
+
+// mdocSatisfy returns the attributes satisfying the inner conjunction, if they were presented.
+func mdocSatisfy(con irma.AttributeCon, attrs map[irma.AttributeTypeIdentifier]*irma.DisclosedAttribute) ([]*irma.DisclosedAttribute, bool) {
+	l := make([]*irma.DisclosedAttribute, 0, len(con))
+	for _, req := range con {
+		attr, ok := attrs[req.Type]
+		if !ok || !req.Satisfy(attr.Identifier, attr.RawValue) {
+			return nil, false
+		}
+		l = append(l, attr)
+	}
+	return l, true
+}
+
+// mdocElementValue converts the value of a data element to an attribute value. Booleans, such as
+// the age_over_NN elements of mobile driving licences, are converted to "yes" or "no", and byte
+// strings are base64-encoded. Dates are decoded as strings in full-date or RFC 3339 format.
+func mdocElementValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case bool:
+		if v {
+			return "yes", nil
+		}
+		return "no", nil
+	case uint64:
+		return strconv.FormatUint(v, 10), nil
+	case int64:
+		return strconv.FormatInt(v, 10), nil
+	case []byte:
+		return base64.StdEncoding.EncodeToString(v), nil
+	default:
+		return "", errors.Errorf("unsupported value type %T", value)
+	}
+}
+
+// NewMdocDocumentInfo returns the description of the verified mdoc for in session results.
+func NewMdocDocumentInfo(doc *irma.MdocVerifiedDocument) *MdocDocumentInfo {
+	return &MdocDocumentInfo{
+		DocType:    doc.DocType,
+		Issuer:     doc.Issuer.Subject.String(),
+		Signed:     irma.Timestamp(doc.Signed),
+		ValidUntil: irma.Timestamp(doc.ValidUntil),
+	}
+}
@@ -0,0 +1,91 @@
+package server
+
+import (
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+var (
+	mdocFirstname   = irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.firstname")
+	mdocFamilyname  = irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.fullName.familyname")
+	mdocBSN         = irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.root.BSN")
+	mdocOver18      = irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over18")
+	mdocTestMapping = MdocMapping{
+		{Attribute: mdocFirstname, DocType: irma.MdocDocTypeMDL, NameSpace: "org.iso.18013.5.1", Element: "given_name"},
+		{Attribute: mdocFamilyname, DocType: irma.MdocDocTypeMDL, NameSpace: "org.iso.18013.5.1", Element: "family_name"},
+		{Attribute: mdocOver18, DocType: irma.MdocDocTypeMDL, NameSpace: "org.iso.18013.5.1", Element: "age_over_18"},
+	}
+)
+
+func TestVerifyMdoc(t *testing.T) {
+	conf := &Configuration{
+		IrmaConfiguration: &irma.Configuration{AttributeTypes: map[irma.AttributeTypeIdentifier]*irma.AttributeType{
+			mdocFirstname: {}, mdocFamilyname: {}, mdocOver18: {},
+		}},
+	}
+	require.NoError(t, conf.verifyMdoc())
+
+	conf.MdocMapping = mdocTestMapping
+	require.Error(t, conf.verifyMdoc()) // no issuer certificates
+	conf.MdocIssuerCertificatesFile = "nonexisting.pem"
+	require.Error(t, conf.verifyMdoc())
+}
+
+func TestMdocItemsRequests(t *testing.T) {
+	items, ok := mdocTestMapping.ItemsRequests(irma.AttributeConDisCon{
+		{{irma.NewAttributeRequest(mdocFirstname.String()), irma.NewAttributeRequest(mdocFamilyname.String())}},
+		{{irma.NewAttributeRequest(mdocBSN.String())}, {irma.NewAttributeRequest(mdocOver18.String())}},
+	})
+	require.True(t, ok)
+	require.Len(t, items, 1)
+	require.Equal(t, irma.MdocDocTypeMDL, items[0].DocType)
+	require.Equal(t, map[string]map[string]bool{
+		"org.iso.18013.5.1": {"given_name": false, "family_name": false, "age_over_18": false},
+	}, items[0].NameSpaces)
+
+	_, ok = mdocTestMapping.ItemsRequests(irma.AttributeConDisCon{
+		{{irma.NewAttributeRequest(mdocFirstname.String()), irma.NewAttributeRequest(mdocBSN.String())}},
+	})
+	require.False(t, ok)
+}
+
+func TestMdocDisclosed(t *testing.T) {
+	docs := []*irma.MdocVerifiedDocument{{
+		DocType: irma.MdocDocTypeMDL,
+		Signed:  time.Now(),
+		Elements: map[string]map[string]interface{}{"org.iso.18013.5.1": {
+			"given_name":  "Alice",
+			"family_name": "Doe",
+			"age_over_18": true,
+			"portrait":    []byte{1, 2, 3},
+		}},
+	}}
+	conf := &irma.Configuration{}
+
+	disclosed, status, err := mdocTestMapping.Disclosed(conf, irma.AttributeConDisCon{
+		{{irma.NewAttributeRequest(mdocFamilyname.String())}},
+		{{irma.NewAttributeRequest(mdocBSN.String())}, {irma.NewAttributeRequest(mdocOver18.String()).WithValue("yes")}},
+	}, docs)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusValid, status)
+	require.Len(t, disclosed, 3)
+	require.Equal(t, "Doe", *disclosed[0][0].RawValue)
+	require.Equal(t, mdocOver18, disclosed[1][0].Identifier)
+	require.Equal(t, "yes", *disclosed[1][0].RawValue)
+	require.Equal(t, mdocFirstname, disclosed[2][0].Identifier)
+	require.Equal(t, irma.AttributeProofStatusExtra, disclosed[2][0].Status)
+
+	disclosed, status, err = mdocTestMapping.Disclosed(conf, irma.AttributeConDisCon{
+		{{irma.NewAttributeRequest(mdocFamilyname.String()).WithValue("Smith")}},
+	}, docs)
+	require.NoError(t, err)
+	require.Equal(t, irma.ProofStatusMissingAttributes, status)
+	require.Nil(t, disclosed[0])
+
+	docs[0].Elements["org.iso.18013.5.1"]["given_name"] = map[interface{}]interface{}{}
+	_, _, err = mdocTestMapping.Disclosed(conf, irma.AttributeConDisCon{}, docs)
+	require.Error(t, err)
+}
@@ -0,0 +1,83 @@
+package server
+
+import (
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+)
+
+func (conf *Configuration) verifyMockMode() error {
+	if !conf.MockMode {
+		if len(conf.MockAttributes) > 0 {
+			return errors.New("mock_attributes requires mock_mode")
+		}
+		return nil
+	}
+	if conf.Production {
+		return errors.New("mock_mode cannot be used in production mode")
+	}
+	if conf.StoreType == "stateless" {
+		return errors.New("mock_mode cannot be used with the stateless session store")
+	}
+	for id, value := range conf.MockAttributes {
+		typ := conf.IrmaConfiguration.AttributeTypes[irma.NewAttributeTypeIdentifier(id)]
+		if typ == nil {
+			return errors.Errorf("mock_attributes contains unknown attribute type %s", id)
+		}
+		if err := typ.DataType.Validate(value); err != nil {
+			return errors.WrapPrefix(err, "mock_attributes contains invalid value for "+id, 0)
+		}
+	}
+	conf.Logger.Warn("Mock mode enabled: sessions are completed with fake results without involving an IRMA app")
+	return nil
+}
+
+// MockDisclosed returns the fake disclosed attributes with which MockMode completes sessions
+// requesting the specified attributes: for each disjunction the first conjunction is disclosed.
+func (conf *Configuration) MockDisclosed(disclose irma.AttributeConDisCon) [][]*irma.DisclosedAttribute {
+	now := irma.Timestamp(conf.Now())
+	disclosed := make([][]*irma.DisclosedAttribute, 0, len(disclose))
+	for _, discon := range disclose {
+		attrs := []*irma.DisclosedAttribute{}
+		for _, attr := range discon[0] {
+			value, datatype := conf.mockValue(attr)
+			attrs = append(attrs, &irma.DisclosedAttribute{
+				RawValue:     &value,
+				Value:        irma.NewTranslatedString(&value),
+				Identifier:   attr.Type,
+				DataType:     datatype,
+				Status:       irma.AttributeProofStatusPresent,
+				IssuanceTime: now,
+			})
+		}
+		disclosed = append(disclosed, attrs)
+	}
+	return disclosed
+}
+
+func (conf *Configuration) mockValue(attr irma.AttributeRequest) (string, irma.AttributeDataType) {
+	if attr.Type.IsCredential() {
+		return "present", irma.AttributeDataTypeString
+	}
+	datatype := irma.AttributeDataTypeString
+	if attr.Type.IsMetadataAttribute() {
+		datatype = irma.AttributeDataTypeDate
+	} else if typ := conf.IrmaConfiguration.AttributeTypes[attr.Type]; typ != nil {
+		datatype = typ.DataType
+	}
+	if attr.Value != nil {
+		return *attr.Value, datatype
+	}
+	if value, ok := conf.MockAttributes[attr.Type.String()]; ok {
+		return value, datatype
+	}
+	switch datatype {
+	case irma.AttributeDataTypeDate:
+		return conf.Now().UTC().Format(irma.AttributeDateLayout), datatype
+	case irma.AttributeDataTypeInteger:
+		return "0", datatype
+	case irma.AttributeDataTypeBoolean:
+		return "true", datatype
+	default:
+		return "mock", datatype
+	}
+}
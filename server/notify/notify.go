@@ -0,0 +1,191 @@
+// Package notify sends the universal links of IRMA sessions to users by email or SMS, so that
+// requestors can distribute per-user session links (e.g. during issuance campaigns) without
+// having to run a separate mailer service.
+package notify
+
+import (
+	"bytes"
+	"encoding/json"
+	"html/template"
+	"net/url"
+	"strings"
+	texttemplate "text/template"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/keyshare"
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultUniversalLinkBase is the URL that the IRMA app claims as universal link (app link),
+// to which the session pointer is appended as URL fragment.
+const DefaultUniversalLinkBase = "https://irma.app/-/session"
+
+// Channel is a medium over which session links can be sent.
+type Channel string
+
+const (
+	ChannelEmail Channel = "email"
+	ChannelSMS   Channel = "sms"
+)
+
+// Configuration contains the configuration of the mail server and SMS gateway to use for sending
+// session links, and the templates of the messages. Either of them may be left empty to disable
+// the corresponding channel.
+type Configuration struct {
+	keyshare.EmailConfiguration `mapstructure:",squash"`
+
+	// Translated HTML email templates and subjects
+	EmailFiles     map[string]string `json:"notify_email_files" mapstructure:"notify_email_files"`
+	EmailSubjects  map[string]string `json:"notify_email_subjects" mapstructure:"notify_email_subjects"`
+	emailTemplates map[string]*template.Template
+
+	// URL of the SMS gateway. Messages are POSTed to it as JSON of the form {"to": ..., "message": ...}.
+	SMSGateway string `json:"notify_sms_gateway" mapstructure:"notify_sms_gateway"`
+	// Value of the Authorization header sent to the SMS gateway (optional)
+	SMSGatewayAuthorization string `json:"notify_sms_gateway_authorization" mapstructure:"notify_sms_gateway_authorization"`
+	// Translated SMS templates, in text/template syntax
+	SMSTemplates map[string]string `json:"notify_sms_templates" mapstructure:"notify_sms_templates"`
+	smsTemplates map[string]*texttemplate.Template
+
+	// Base of the universal links that are sent (default DefaultUniversalLinkBase)
+	UniversalLinkBase string `json:"notify_universal_link" mapstructure:"notify_universal_link"`
+
+	// Client with which messages are sent to the SMS gateway; if nil, the default settings are used
+	HTTPClient *irma.HTTPClient `json:"-"`
+}
+
+// Notifier sends session links to recipients.
+type Notifier struct {
+	conf *Configuration
+}
+
+// TemplateData is passed to the email and SMS templates when rendering them. It deliberately
+// does not contain the requestor token of the session, which gives access to its result and
+// must therefore not be sent to the user.
+type TemplateData struct {
+	// Universal link that starts the session in the IRMA app
+	SessionLink string
+}
+
+type smsMessage struct {
+	To      string `json:"to"`
+	Message string `json:"message"`
+}
+
+// New returns a new Notifier, after parsing the templates in the configuration.
+func New(conf *Configuration) (*Notifier, error) {
+	if !conf.EmailEnabled() && conf.SMSGateway == "" {
+		return nil, errors.New("neither an email server nor an SMS gateway is configured")
+	}
+	if conf.UniversalLinkBase == "" {
+		conf.UniversalLinkBase = DefaultUniversalLinkBase
+	}
+
+	var err error
+	if conf.EmailEnabled() {
+		conf.emailTemplates, err = keyshare.ParseEmailTemplates(conf.EmailFiles, conf.EmailSubjects, conf.DefaultLanguage)
+		if err != nil {
+			return nil, errors.WrapPrefix(err, "failed to parse session link email templates", 0)
+		}
+		if err = conf.VerifyEmailServer(); err != nil {
+			return nil, err
+		}
+	}
+
+	if conf.SMSGateway != "" {
+		if _, ok := conf.SMSTemplates[conf.DefaultLanguage]; !ok {
+			return nil, errors.New("missing SMS template for default language")
+		}
+		conf.smsTemplates = make(map[string]*texttemplate.Template, len(conf.SMSTemplates))
+		for lang, tmpl := range conf.SMSTemplates {
+			conf.smsTemplates[lang], err = texttemplate.New(lang).Parse(tmpl)
+			if err != nil {
+				return nil, errors.WrapPrefix(err, "failed to parse SMS template for language "+lang, 0)
+			}
+		}
+	}
+
+	return &Notifier{conf: conf}, nil
+}
+
+// UniversalLink returns the link that, when opened on a device having the IRMA app, starts the
+// session with the specified session pointer in the app.
+func UniversalLink(base string, qr *irma.Qr) (string, error) {
+	bts, err := json.Marshal(qr)
+	if err != nil {
+		return "", err
+	}
+	return base + "#" + url.QueryEscape(string(bts)), nil
+}
+
+// RecipientChannel returns the channel over which a link can be sent to the given recipient:
+// email if it looks like an email address, SMS otherwise.
+func RecipientChannel(recipient string) Channel {
+	if strings.Contains(recipient, "@") {
+		return ChannelEmail
+	}
+	return ChannelSMS
+}
+
+// Notify sends the universal link of the session to the recipient, which is either an email
+// address or a phone number, using the templates for the specified language.
+func (n *Notifier) Notify(pkg *server.SessionPackage, recipient, lang string) error {
+	if pkg.SessionPtr == nil {
+		return errors.New("session package contains no session pointer")
+	}
+	link, err := UniversalLink(n.conf.UniversalLinkBase, pkg.SessionPtr)
+	if err != nil {
+		return err
+	}
+	data := TemplateData{SessionLink: link}
+	if lang == "" {
+		lang = n.conf.DefaultLanguage
+	}
+
+	channel := RecipientChannel(recipient)
+	server.Logger.WithFields(logrus.Fields{"session": pkg.Token, "channel": channel}).Debug("Sending session link")
+	switch channel {
+	case ChannelEmail:
+		return n.sendEmail(data, recipient, lang)
+	default:
+		return n.sendSMS(data, recipient, lang)
+	}
+}
+
+func (n *Notifier) sendEmail(data TemplateData, to, lang string) error {
+	if !n.conf.EmailEnabled() {
+		return errors.New("no email server configured")
+	}
+	return n.conf.SendEmail(
+		n.conf.emailTemplates,
+		n.conf.EmailSubjects,
+		map[string]string{"SessionLink": data.SessionLink},
+		[]string{to},
+		lang,
+	)
+}
+
+func (n *Notifier) sendSMS(data TemplateData, to, lang string) error {
+	if n.conf.SMSGateway == "" {
+		return errors.New("no SMS gateway configured")
+	}
+	tmpl, ok := n.conf.smsTemplates[lang]
+	if !ok {
+		tmpl = n.conf.smsTemplates[n.conf.DefaultLanguage]
+	}
+	var message bytes.Buffer
+	if err := tmpl.Execute(&message, data); err != nil {
+		return errors.WrapPrefix(err, "failed to render SMS template", 0)
+	}
+
+	transport := n.conf.HTTPClient.NewTransport(n.conf.SMSGateway, false)
+	if n.conf.SMSGatewayAuthorization != "" {
+		transport.SetHeader("Authorization", n.conf.SMSGatewayAuthorization)
+	}
+	if err := transport.Post("", nil, &smsMessage{To: to, Message: message.String()}); err != nil {
+		return errors.WrapPrefix(err, "failed to POST message to SMS gateway", 0)
+	}
+	return nil
+}
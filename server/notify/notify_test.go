@@ -0,0 +1,88 @@
+package notify
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUniversalLink(t *testing.T) {
+	qr := &irma.Qr{URL: "https://example.com/irma/session/abc", Type: irma.ActionIssuing}
+	link, err := UniversalLink(DefaultUniversalLinkBase, qr)
+	require.NoError(t, err)
+	require.True(t, strings.HasPrefix(link, DefaultUniversalLinkBase+"#"))
+
+	fragment, err := url.QueryUnescape(strings.TrimPrefix(link, DefaultUniversalLinkBase+"#"))
+	require.NoError(t, err)
+	parsed := &irma.Qr{}
+	require.NoError(t, json.Unmarshal([]byte(fragment), parsed))
+	require.Equal(t, qr, parsed)
+}
+
+func TestRecipientChannel(t *testing.T) {
+	require.Equal(t, ChannelEmail, RecipientChannel("alice@example.com"))
+	require.Equal(t, ChannelSMS, RecipientChannel("+31612345678"))
+}
+
+func TestNewInvalidConfiguration(t *testing.T) {
+	_, err := New(&Configuration{})
+	require.Error(t, err)
+
+	_, err = New(&Configuration{SMSGateway: "http://localhost", SMSTemplates: map[string]string{"nl": "{{.SessionLink}}"}})
+	require.Error(t, err)
+}
+
+func TestNotifySMS(t *testing.T) {
+	var received smsMessage
+	var authorization string
+	gateway := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		authorization = r.Header.Get("Authorization")
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&received))
+	}))
+	defer gateway.Close()
+
+	conf := &Configuration{
+		SMSGateway:              gateway.URL,
+		SMSGatewayAuthorization: "secret",
+		SMSTemplates: map[string]string{
+			"en": "Get your credential: {{.SessionLink}}",
+			"nl": "Haal je credential op: {{.SessionLink}}",
+		},
+	}
+	conf.DefaultLanguage = "en"
+	notifier, err := New(conf)
+	require.NoError(t, err)
+
+	pkg := &server.SessionPackage{
+		SessionPtr: &irma.Qr{URL: "https://example.com/irma/session/abc", Type: irma.ActionIssuing},
+		Token:      "token",
+	}
+	link, err := UniversalLink(DefaultUniversalLinkBase, pkg.SessionPtr)
+	require.NoError(t, err)
+
+	require.NoError(t, notifier.Notify(pkg, "+31612345678", "nl"))
+	require.Equal(t, "secret", authorization)
+	require.Equal(t, "+31612345678", received.To)
+	require.Equal(t, "Haal je credential op: "+link, received.Message)
+
+	// Unknown languages fall back to the default language
+	require.NoError(t, notifier.Notify(pkg, "+31612345678", "de"))
+	require.Equal(t, "Get your credential: "+link, received.Message)
+
+	// No email server is configured
+	require.Error(t, notifier.Notify(pkg, "alice@example.com", ""))
+
+	// The requestor token is not available to templates
+	conf.SMSTemplates["en"] = "Get your credential: {{.SessionLink}} {{.Token}}"
+	notifier, err = New(conf)
+	require.NoError(t, err)
+	require.Error(t, notifier.Notify(pkg, "+31612345678", "en"))
+	require.NotContains(t, received.Message, "token")
+}
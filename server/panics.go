@@ -0,0 +1,91 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Number of recovered panics per source, exposed as the irma_panics_total metric
+var (
+	panicsMutex sync.Mutex
+	panics      = map[string]uint64{}
+)
+
+// RecoverMiddleware converts panics in the handlers of the request into ErrorPanic responses,
+// instead of having them take down the server process. Each panic is logged as a crash report,
+// including the stack trace, and counted in the irma_panics_total metric.
+func RecoverMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			res := recover()
+			if res == nil {
+				return
+			}
+			if res == http.ErrAbortHandler {
+				// Used by handlers to abort the response, see http.ErrAbortHandler
+				panic(res)
+			}
+			reportPanic(r.Context(), "http", res, logrus.Fields{"method": r.Method, "url": r.URL.String()})
+			WriteError(w, ErrorPanic, "")
+		}()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// RecoverPanic recovers from a panic in the calling goroutine, if any, and reports it like
+// RecoverMiddleware does. It must be deferred at the start of goroutines, e.g.
+//
+//	go func() {
+//		defer server.RecoverPanic("session handler")
+//		...
+//	}()
+func RecoverPanic(source string) {
+	if res := recover(); res != nil {
+		reportPanic(context.Background(), source, res, nil)
+	}
+}
+
+// reportPanic logs a crash report of the recovered panic and counts it.
+func reportPanic(ctx context.Context, source string, res interface{}, fields logrus.Fields) {
+	panicsMutex.Lock()
+	panics[source]++
+	panicsMutex.Unlock()
+
+	Logger.WithContext(ctx).WithFields(fields).WithFields(logrus.Fields{
+		"source":     source,
+		"panic":      fmt.Sprintf("%v", res),
+		"stacktrace": string(debug.Stack()),
+	}).Error("Recovered from panic")
+}
+
+// WritePanicsPrometheus writes the number of recovered panics per source to w in the Prometheus
+// text exposition format.
+func WritePanicsPrometheus(w io.Writer) error {
+	panicsMutex.Lock()
+	sources := make([]string, 0, len(panics))
+	counts := make(map[string]uint64, len(panics))
+	for source, count := range panics {
+		sources = append(sources, source)
+		counts[source] = count
+	}
+	panicsMutex.Unlock()
+	sort.Strings(sources)
+
+	const name = "irma_panics_total"
+	if _, err := fmt.Fprintf(w, "# HELP %s Number of recovered panics per source.\n# TYPE %s counter\n", name, name); err != nil {
+		return err
+	}
+	for _, source := range sources {
+		if _, err := fmt.Fprintf(w, "%s{source=%q} %d\n", name, source, counts[source]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,58 @@
+package server
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRecoverMiddleware(t *testing.T) {
+	var buf bytes.Buffer
+	logger := Logger
+	Logger = logrus.New()
+	Logger.Out = &buf
+	Logger.SetFormatter(&logrus.JSONFormatter{})
+	defer func() { Logger = logger }()
+
+	handler := RecoverMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("oops")
+	}))
+	rec := httptest.NewRecorder()
+	handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/session", nil))
+
+	require.Equal(t, http.StatusInternalServerError, rec.Code)
+	rerr := &irma.RemoteError{}
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), rerr))
+	require.Equal(t, irma.ErrorCodePanic, rerr.Code)
+
+	// The crash report contains the panic and the stack trace
+	var report map[string]interface{}
+	require.NoError(t, json.NewDecoder(&buf).Decode(&report))
+	require.Equal(t, "oops", report["panic"])
+	require.Equal(t, "http", report["source"])
+	require.Equal(t, "/session", report["url"])
+	require.Contains(t, report["stacktrace"], "TestRecoverMiddleware")
+
+	// Panics in goroutines are recovered as well
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		defer RecoverPanic("test")
+		panic("oops")
+	}()
+	wg.Wait()
+
+	var metrics bytes.Buffer
+	require.NoError(t, WritePanicsPrometheus(&metrics))
+	require.True(t, strings.Contains(metrics.String(), `irma_panics_total{source="http"} `))
+	require.True(t, strings.Contains(metrics.String(), `irma_panics_total{source="test"} 1`))
+}
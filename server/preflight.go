@@ -0,0 +1,50 @@
+package server
+
+import (
+	irma "github.com/privacybydesign/irmago"
+)
+
+// PreflightCheckType identifies a check performed on an issuance request during a preflight.
+type PreflightCheckType string
+
+const (
+	PreflightCheckAuthorization  PreflightCheckType = "authorization"   // Requestor may issue the credential types
+	PreflightCheckRequest        PreflightCheckType = "request"         // Request is valid as a whole
+	PreflightCheckCredentialType PreflightCheckType = "credential_type" // Credential type is known
+	PreflightCheckPrivateKey     PreflightCheckType = "private_key"     // Private key of the issuer is available
+	PreflightCheckPublicKey      PreflightCheckType = "public_key"      // Corresponding public key is present and not expired
+	PreflightCheckRevocation     PreflightCheckType = "revocation"      // Revocation is configured, if supported by the credential type
+	PreflightCheckAttributes     PreflightCheckType = "attributes"      // Attributes are consistent with the credential type
+	PreflightCheckValidity       PreflightCheckType = "validity"        // Credential would not be issued already expired
+)
+
+// PreflightReport is the result of checking an issuance request without starting a session,
+// listing the outcome of each check that was performed.
+type PreflightReport struct {
+	Valid  bool              `json:"valid"`
+	Checks []*PreflightCheck `json:"checks"`
+}
+
+// PreflightCheck is the outcome of a single check within a PreflightReport. Credential is nil
+// for checks that concern the request as a whole.
+type PreflightCheck struct {
+	Check      PreflightCheckType             `json:"check"`
+	Credential *irma.CredentialTypeIdentifier `json:"credential,omitempty"`
+	Passed     bool                           `json:"passed"`
+	Message    string                         `json:"message,omitempty"`
+}
+
+// NewPreflightReport returns an empty report, which is valid until a failed check is added.
+func NewPreflightReport() *PreflightReport {
+	return &PreflightReport{Valid: true, Checks: []*PreflightCheck{}}
+}
+
+// Add records the outcome of a check, which failed if err is not nil.
+func (r *PreflightReport) Add(check PreflightCheckType, credential *irma.CredentialTypeIdentifier, err error) {
+	c := &PreflightCheck{Check: check, Credential: credential, Passed: err == nil}
+	if err != nil {
+		c.Message = err.Error()
+		r.Valid = false
+	}
+	r.Checks = append(r.Checks, c)
+}
@@ -0,0 +1,110 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// ProfileCheckInterval is the interval in seconds at which the heap size is compared to the
+// ProfileHeapThreshold.
+const ProfileCheckInterval = 10
+
+// Minimum time between two writes of profiles, so that a heap hovering around the threshold
+// does not fill the profile directory.
+const profileCooldown = 5 * time.Minute
+
+// HeapProfiler writes heap and goroutine profiles to the ProfileDir when the heap size rises
+// above the ProfileHeapThreshold (the high watermark). Profiles are written again only after the
+// heap size has dropped below the threshold and risen above it again.
+type HeapProfiler struct {
+	sync.Mutex
+	conf     *Configuration
+	above    bool
+	last     time.Time
+	heapSize func() uint64
+}
+
+// NewHeapProfiler returns a HeapProfiler, whose Check() should be invoked every ProfileCheckInterval seconds.
+func NewHeapProfiler(conf *Configuration) *HeapProfiler {
+	return &HeapProfiler{
+		conf: conf,
+		heapSize: func() uint64 {
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			return stats.HeapAlloc
+		},
+	}
+}
+
+func (conf *Configuration) verifyProfiling() error {
+	if conf.ProfileDir == "" {
+		return nil
+	}
+	if conf.ProfileHeapThreshold <= 0 {
+		return errors.New("profile_dir requires a positive profile_heap_threshold")
+	}
+	if err := common.EnsureDirectoryExists(conf.ProfileDir); err != nil {
+		return errors.WrapPrefix(err, "failed to create profile_dir", 0)
+	}
+	return nil
+}
+
+// Check writes profiles if the heap size has risen above the threshold since the previous check.
+func (p *HeapProfiler) Check() {
+	p.Lock()
+	defer p.Unlock()
+
+	size := p.heapSize()
+	above := size > uint64(p.conf.ProfileHeapThreshold)*1024*1024
+	crossed := above && !p.above
+	p.above = above
+	now := p.conf.Now()
+	if !crossed || now.Sub(p.last) < profileCooldown {
+		return
+	}
+	p.last = now
+
+	files, err := p.WriteProfiles(now)
+	if err != nil {
+		_ = LogError(errors.WrapPrefix(err, "failed to write profiles", 0))
+		return
+	}
+	p.conf.Logger.WithFields(logrus.Fields{
+		"heap_size": size,
+		"files":     files,
+	}).Warn("Heap size exceeds profile_heap_threshold, wrote profiles")
+}
+
+// WriteProfiles writes the heap and goroutine profiles to the ProfileDir, named after the time,
+// and returns their paths.
+func (p *HeapProfiler) WriteProfiles(now time.Time) ([]string, error) {
+	var files []string
+	for _, name := range []string{"heap", "goroutine"} {
+		path := filepath.Join(p.conf.ProfileDir, name+"-"+now.UTC().Format("20060102T150405Z")+".pprof")
+		if err := writeProfile(name, path); err != nil {
+			return files, err
+		}
+		files = append(files, path)
+	}
+	return files, nil
+}
+
+func writeProfile(name, path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	if err = pprof.Lookup(name).WriteTo(f, 0); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
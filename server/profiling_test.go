@@ -0,0 +1,48 @@
+package server
+
+import (
+	"os"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHeapProfiler(t *testing.T) {
+	now := time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC)
+	conf := &Configuration{
+		Logger:               logrus.New(),
+		Clock:                fixedClock(now),
+		ProfileDir:           t.TempDir(),
+		ProfileHeapThreshold: 100,
+	}
+	require.NoError(t, conf.verifyProfiling())
+
+	var heapSize uint64
+	profiler := NewHeapProfiler(conf)
+	profiler.heapSize = func() uint64 { return heapSize }
+	check := func(megabytes uint64, after time.Duration) int {
+		heapSize = megabytes * 1024 * 1024
+		now = now.Add(after)
+		conf.Clock = fixedClock(now)
+		profiler.Check()
+		files, err := os.ReadDir(conf.ProfileDir)
+		require.NoError(t, err)
+		return len(files)
+	}
+
+	require.Equal(t, 0, check(50, 0))
+	// Rising above the threshold writes heap and goroutine profiles
+	require.Equal(t, 2, check(150, time.Second))
+	// Staying above the threshold does not
+	require.Equal(t, 2, check(200, time.Minute))
+	// Rising above it again only writes profiles after the cooldown
+	require.Equal(t, 2, check(50, time.Second))
+	require.Equal(t, 2, check(150, time.Second))
+	require.Equal(t, 2, check(50, time.Second))
+	require.Equal(t, 4, check(150, profileCooldown))
+
+	conf.ProfileHeapThreshold = 0
+	require.Error(t, conf.verifyProfiling())
+}
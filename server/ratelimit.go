@@ -0,0 +1,67 @@
+package server
+
+import (
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter counts the requests per client IP address in fixed windows of time.
+type rateLimiter struct {
+	sync.Mutex
+	clock    Clock
+	clientIP func(r *http.Request) string
+	limit    int
+	period   time.Duration
+	window   time.Time
+	counts   map[string]int
+}
+
+// RateLimitMiddleware refuses requests with ErrorTooManyRequests once a client IP address (taken
+// from the remote address of the connection) made more than limit requests in the current period.
+// Behind a reverse proxy, all requests come from the address of the proxy, so that the proxy
+// should limit the rate of requests itself instead, or ClientRateLimitMiddleware() can be used.
+func RateLimitMiddleware(clock Clock, limit int, period time.Duration) func(http.Handler) http.Handler {
+	return rateLimitMiddleware(&rateLimiter{clock: clock, clientIP: remoteIP, limit: limit, period: period})
+}
+
+// ClientRateLimitMiddleware is like RateLimitMiddleware(), but takes the client IP address from
+// the forwarded headers of the trusted proxies of the configuration (see Configuration.ClientIP()).
+func ClientRateLimitMiddleware(conf *Configuration, limit int, period time.Duration) func(http.Handler) http.Handler {
+	return rateLimitMiddleware(&rateLimiter{clock: conf, clientIP: conf.ClientIP, limit: limit, period: period})
+}
+
+func rateLimitMiddleware(limiter *rateLimiter) func(http.Handler) http.Handler {
+	limiter.counts = map[string]int{}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if retry, ok := limiter.allow(r); !ok {
+				w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(retry.Seconds()))))
+				WriteError(w, ErrorTooManyRequests, "")
+				return
+			}
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// allow counts the request, returning whether it is allowed, and if not, the time after which
+// requests are allowed again.
+func (l *rateLimiter) allow(r *http.Request) (time.Duration, bool) {
+	ip := l.clientIP(r)
+
+	l.Lock()
+	defer l.Unlock()
+	now := l.clock.Now()
+	if now.Sub(l.window) >= l.period {
+		l.window = now
+		l.counts = map[string]int{}
+	}
+	l.counts[ip]++
+	if l.counts[ip] > l.limit {
+		return l.window.Add(l.period).Sub(now), false
+	}
+	return 0, true
+}
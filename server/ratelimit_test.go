@@ -0,0 +1,69 @@
+package server
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRateLimitMiddleware(t *testing.T) {
+	clock := fixedClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	conf := &Configuration{Clock: clock}
+	handler := ClientRateLimitMiddleware(conf, 2, time.Minute)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	serve := func(remoteAddr string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = remoteAddr
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	require.Equal(t, http.StatusOK, serve("10.0.0.1:1234").Code)
+	require.Equal(t, http.StatusOK, serve("10.0.0.1:1235").Code)
+	rec := serve("10.0.0.1:1236")
+	require.Equal(t, http.StatusTooManyRequests, rec.Code)
+	require.Equal(t, "60", rec.Header().Get("Retry-After"))
+
+	// Other clients are counted separately
+	require.Equal(t, http.StatusOK, serve("10.0.0.2:1234").Code)
+
+	// In the next period, requests are allowed again
+	conf.Clock = fixedClock(time.Time(clock).Add(time.Minute))
+	require.Equal(t, http.StatusOK, serve("10.0.0.1:1234").Code)
+}
+
+func TestRateLimitMiddlewareRemoteAddress(t *testing.T) {
+	conf := &Configuration{Logger: logrus.New(), TrustedProxies: []string{"10.0.0.0/8"}}
+	require.NoError(t, conf.verifyTrustedProxies())
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	clock := fixedClock(time.Date(2030, 1, 1, 0, 0, 0, 0, time.UTC))
+	remote := RateLimitMiddleware(clock, 1, time.Minute)(ok)
+	client := ClientRateLimitMiddleware(conf, 1, time.Minute)(ok)
+
+	serve := func(handler http.Handler, forwardedFor string) int {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "10.0.0.1:1234"
+		req.Header.Set(ForwardedFor, forwardedFor)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// RateLimitMiddleware counts requests per remote address, ignoring forwarded headers
+	require.Equal(t, http.StatusOK, serve(remote, "1.2.3.4"))
+	require.Equal(t, http.StatusTooManyRequests, serve(remote, "5.6.7.8"))
+
+	// ClientRateLimitMiddleware counts them per client behind trusted proxies
+	require.Equal(t, http.StatusOK, serve(client, "1.2.3.4"))
+	require.Equal(t, http.StatusOK, serve(client, "5.6.7.8"))
+	require.Equal(t, http.StatusTooManyRequests, serve(client, "1.2.3.4"))
+}
@@ -0,0 +1,74 @@
+package server
+
+import (
+	"context"
+	"net/http"
+	"regexp"
+
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/sirupsen/logrus"
+)
+
+// RequestIDHeader is the HTTP header from which request IDs are taken if present, and in which they
+// are returned in responses and sent along with session result callbacks.
+const RequestIDHeader = "X-Request-ID"
+
+const requestIDLength = 20
+
+// Request IDs received from clients or reverse proxies are only used if they match this pattern.
+var requestIDPattern = regexp.MustCompile(`^[a-zA-Z0-9._:-]{1,128}$`)
+
+type requestIDKey struct{}
+
+// RequestIDMiddleware assigns each request an ID, taken from the X-Request-ID header if present and
+// otherwise generated, with which the request can be correlated across log lines, error responses
+// (as correlationId) and session result callbacks. The ID is returned in the X-Request-ID header
+// of the response. Requests that already have an ID are passed on unchanged.
+func RequestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if RequestID(r.Context()) != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		id := r.Header.Get(RequestIDHeader)
+		if !requestIDPattern.MatchString(id) {
+			var err error
+			if id, err = common.NewRandomString(requestIDLength, common.AlphanumericChars); err != nil {
+				WriteError(w, ErrorInternal, err.Error())
+				return
+			}
+		}
+		w.Header().Set(RequestIDHeader, id)
+		next.ServeHTTP(w, r.WithContext(WithRequestID(r.Context(), id)))
+	})
+}
+
+// WithRequestID returns a copy of the context having the specified request ID.
+func WithRequestID(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, requestIDKey{}, id)
+}
+
+// RequestID returns the request ID of the context, or the empty string if it has none.
+func RequestID(ctx context.Context) string {
+	if ctx == nil {
+		return ""
+	}
+	id, _ := ctx.Value(requestIDKey{}).(string)
+	return id
+}
+
+// RequestIDHook is a logrus hook that adds the request ID of the context of log entries (see
+// logrus.Entry.WithContext()) to the entries as the request_id field. It is installed in loggers
+// created by NewLogger(); custom loggers can install it using AddHook().
+type RequestIDHook struct{}
+
+func (RequestIDHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (RequestIDHook) Fire(entry *logrus.Entry) error {
+	if id := RequestID(entry.Context); id != "" {
+		entry.Data["request_id"] = id
+	}
+	return nil
+}
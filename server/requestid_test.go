@@ -0,0 +1,102 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/sirupsen/logrus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestIDMiddleware(t *testing.T) {
+	var requestID string
+	handler := RequestIDMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = RequestID(r.Context())
+		WriteError(w, ErrorInvalidRequest, "")
+	}))
+
+	serve := func(id string) (*httptest.ResponseRecorder, *irma.RemoteError) {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		if id != "" {
+			req.Header.Set(RequestIDHeader, id)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		rerr := &irma.RemoteError{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), rerr))
+		return rec, rerr
+	}
+
+	// A valid request ID is propagated to the context, the response header and the error
+	rec, rerr := serve("abc-123")
+	require.Equal(t, "abc-123", requestID)
+	require.Equal(t, "abc-123", rec.Header().Get(RequestIDHeader))
+	require.Equal(t, "abc-123", rerr.CorrelationID)
+
+	// Otherwise a request ID is generated
+	for _, id := range []string{"", "invalid id", strings.Repeat("a", 129)} {
+		rec, rerr = serve(id)
+		require.Len(t, requestID, requestIDLength)
+		require.NotEqual(t, id, requestID)
+		require.Equal(t, requestID, rec.Header().Get(RequestIDHeader))
+		require.Equal(t, requestID, rerr.CorrelationID)
+	}
+}
+
+func TestRequestIDHook(t *testing.T) {
+	var buf bytes.Buffer
+	logger := logrus.New()
+	logger.Out = &buf
+	logger.SetFormatter(&logrus.JSONFormatter{})
+	logger.AddHook(RequestIDHook{})
+
+	logger.WithContext(WithRequestID(context.Background(), "abc-123")).Info("test")
+	var entry map[string]interface{}
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.Equal(t, "abc-123", entry["request_id"])
+
+	buf.Reset()
+	logger.WithContext(context.Background()).Info("test")
+	entry = nil
+	require.NoError(t, json.Unmarshal(buf.Bytes(), &entry))
+	require.NotContains(t, entry, "request_id")
+}
+
+func TestResultCallbackRequestID(t *testing.T) {
+	var requestID string
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requestID = r.Header.Get(RequestIDHeader)
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer callbackServer.Close()
+
+	result := &SessionResult{Token: "token", Status: irma.ServerStatusDone}
+	ctx := WithRequestID(context.Background(), "abc-123")
+	require.NoError(t, DoResultCallback(ctx, nil, callbackServer.URL, result, "", 0, nil, "", nil))
+	require.Equal(t, "abc-123", requestID)
+}
+
+func TestResultCallbackIdempotencyKey(t *testing.T) {
+	var keys []string
+	callbackServer := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(IdempotencyKeyHeader))
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer callbackServer.Close()
+
+	for _, token := range []irma.RequestorToken{"token", "token", "other"} {
+		result := &SessionResult{Token: token, Status: irma.ServerStatusDone}
+		require.NoError(t, DoResultCallback(context.Background(), nil, callbackServer.URL, result, "", 0, nil, "", nil))
+	}
+	require.Len(t, keys, 3)
+	require.NotEmpty(t, keys[0])
+	require.NotContains(t, keys[0], "token")
+	require.Equal(t, keys[0], keys[1])
+	require.NotEqual(t, keys[0], keys[2])
+}
@@ -32,6 +32,12 @@ type Authenticator interface {
 	AuthenticateRevocation(
 		headers http.Header, body []byte,
 	) (applies bool, request *irma.RevocationRequest, requestor string, err *irma.RemoteError)
+
+	// AuthenticateRequestor checks, given the HTTP headers of a request without body (such as
+	// listing the open sessions of the requestor), if the requestor is known. For JWT-based
+	// authentication methods, the JWT is expected in the Authorization header as a bearer token
+	// and must have sessionListJwtSubject as subject.
+	AuthenticateRequestor(headers http.Header) (applies bool, requestor string, err *irma.RemoteError)
 }
 
 type AuthenticationMethod string
@@ -44,45 +50,84 @@ const (
 	AuthenticationMethodNone      = "none"
 )
 
+// sessionListJwtSubject is the subject of requestor JWTs authenticating listing open sessions.
+const sessionListJwtSubject = "session_list"
+
 type HmacAuthenticator struct {
 	hmackeys      map[string]interface{}
 	maxRequestAge int
+	clockSkew     int
+	clock         server.Clock
+	audience      string
+	requireIssuer bool
 }
 type PublicKeyAuthenticator struct {
 	publickeys    map[string]interface{}
 	maxRequestAge int
+	clockSkew     int
+	clock         server.Clock
+	audience      string
+	requireIssuer bool
 }
 type PresharedKeyAuthenticator struct {
 	presharedkeys map[string]string
+	strictJSON    strictJSON
+}
+type NilAuthenticator struct {
+	strictJSON strictJSON
+}
+
+// strictJSON determines whether the JSON session and revocation requests received by an
+// authenticator are parsed strictly, i.e. refusing unknown fields.
+type strictJSON struct {
+	sessionRequests, revocationRequests bool
+}
+
+func (s strictJSON) parseSessionRequest(body []byte) (irma.RequestorRequest, error) {
+	if s.sessionRequests {
+		return server.ParseSessionRequestStrict(body)
+	}
+	return server.ParseSessionRequest(body)
+}
+
+func (s strictJSON) parseRevocationRequest(body []byte) (*irma.RevocationRequest, error) {
+	r := &irma.RevocationRequest{}
+	if s.revocationRequests {
+		return r, irma.UnmarshalValidateStrict(body, r)
+	}
+	return r, irma.UnmarshalValidate(body, r)
 }
-type NilAuthenticator struct{}
 
 var authenticators map[AuthenticationMethod]Authenticator
 
-func (NilAuthenticator) AuthenticateSession(
+func (nauth NilAuthenticator) AuthenticateSession(
 	headers http.Header, body []byte,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
 	if headers.Get("Authorization") != "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
 		return false, nil, "", nil
 	}
-	request, err := server.ParseSessionRequest(body)
+	request, err := nauth.strictJSON.parseSessionRequest(body)
 	if err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+		return true, nil, "", server.RemoteError(server.InputError(err, server.ErrorInvalidRequest), err.Error())
 	}
 	return true, request, "", nil
 }
 
-func (NilAuthenticator) AuthenticateRevocation(headers http.Header, body []byte) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
+func (nauth NilAuthenticator) AuthenticateRevocation(headers http.Header, body []byte) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
 	if headers.Get("Authorization") != "" || !strings.HasPrefix(headers.Get("Content-Type"), "application/json") {
 		return false, nil, "", nil
 	}
-	r := &irma.RevocationRequest{}
-	if err := irma.UnmarshalValidate(body, r); err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	r, err := nauth.strictJSON.parseRevocationRequest(body)
+	if err != nil {
+		return true, nil, "", server.RemoteError(server.InputError(err, server.ErrorInvalidRequest), err.Error())
 	}
 	return true, r, "", nil
 }
 
+func (NilAuthenticator) AuthenticateRequestor(headers http.Header) (bool, string, *irma.RemoteError) {
+	return headers.Get("Authorization") == "", "", nil
+}
+
 func (NilAuthenticator) Initialize(name string, requestor Requestor) error {
 	return nil
 }
@@ -90,11 +135,19 @@ func (NilAuthenticator) Initialize(name string, requestor Requestor) error {
 func (hauth *HmacAuthenticator) AuthenticateSession(
 	headers http.Header, body []byte,
 ) (applies bool, request irma.RequestorRequest, requestor string, err *irma.RemoteError) {
-	return jwtAuthenticate(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge)
+	return jwtAuthenticate(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.validation())
 }
 
 func (hauth *HmacAuthenticator) AuthenticateRevocation(headers http.Header, body []byte) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
-	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.maxRequestAge)
+	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.validation())
+}
+
+func (hauth *HmacAuthenticator) AuthenticateRequestor(headers http.Header) (bool, string, *irma.RemoteError) {
+	return jwtAuthenticateRequestor(headers, jwt.SigningMethodHS256.Name, hauth.hmackeys, hauth.validation())
+}
+
+func (hauth *HmacAuthenticator) validation() jwtValidation {
+	return jwtValidation{hauth.maxRequestAge, hauth.clockSkew, hauth.clock, hauth.audience, hauth.requireIssuer}
 }
 
 func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) error {
@@ -117,11 +170,19 @@ func (hauth *HmacAuthenticator) Initialize(name string, requestor Requestor) err
 func (pkauth *PublicKeyAuthenticator) AuthenticateSession(
 	headers http.Header, body []byte,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
-	return jwtAuthenticate(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge)
+	return jwtAuthenticate(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.validation())
 }
 
 func (pkauth *PublicKeyAuthenticator) AuthenticateRevocation(headers http.Header, body []byte) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
-	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.maxRequestAge)
+	return jwtAutheticateRevocation(headers, body, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.validation())
+}
+
+func (pkauth *PublicKeyAuthenticator) AuthenticateRequestor(headers http.Header) (bool, string, *irma.RemoteError) {
+	return jwtAuthenticateRequestor(headers, jwt.SigningMethodRS256.Name, pkauth.publickeys, pkauth.validation())
+}
+
+func (pkauth *PublicKeyAuthenticator) validation() jwtValidation {
+	return jwtValidation{pkauth.maxRequestAge, pkauth.clockSkew, pkauth.clock, pkauth.audience, pkauth.requireIssuer}
 }
 
 func (pkauth *PublicKeyAuthenticator) Initialize(name string, requestor Requestor) error {
@@ -150,9 +211,9 @@ func (pskauth *PresharedKeyAuthenticator) AuthenticateSession(
 	if !ok {
 		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "")
 	}
-	request, err := server.ParseSessionRequest(body)
+	request, err := pskauth.strictJSON.parseSessionRequest(body)
 	if err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+		return true, nil, "", server.RemoteError(server.InputError(err, server.ErrorInvalidRequest), err.Error())
 	}
 	return true, request, requestor, nil
 }
@@ -166,13 +227,25 @@ func (pskauth *PresharedKeyAuthenticator) AuthenticateRevocation(headers http.He
 	if !ok {
 		return true, nil, "", server.RemoteError(server.ErrorUnauthorized, "")
 	}
-	r := &irma.RevocationRequest{}
-	if err := irma.UnmarshalValidate(body, r); err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+	r, err := pskauth.strictJSON.parseRevocationRequest(body)
+	if err != nil {
+		return true, nil, "", server.RemoteError(server.InputError(err, server.ErrorInvalidRequest), err.Error())
 	}
 	return true, r, requestor, nil
 }
 
+func (pskauth *PresharedKeyAuthenticator) AuthenticateRequestor(headers http.Header) (bool, string, *irma.RemoteError) {
+	auth := headers.Get("Authorization")
+	if auth == "" || strings.HasPrefix(auth, "Bearer ") {
+		return false, "", nil
+	}
+	requestor, ok := pskauth.presharedkeys[auth]
+	if !ok {
+		return true, "", server.RemoteError(server.ErrorUnauthorized, "")
+	}
+	return true, requestor, nil
+}
+
 func (pskauth *PresharedKeyAuthenticator) Initialize(name string, requestor Requestor) error {
 	bts, err := common.ReadKey(requestor.AuthenticationKey, requestor.AuthenticationKeyFile)
 	if err != nil {
@@ -184,8 +257,9 @@ func (pskauth *PresharedKeyAuthenticator) Initialize(name string, requestor Requ
 
 // Helper functions
 
-// Given an (unauthenticated) jwt, return the key against which it should be verified using the "kid" header
-func jwtKeyExtractor(publickeys map[string]interface{}) func(token *jwt.Token) (interface{}, error) {
+// Given an (unauthenticated) jwt, return the key against which it should be verified using the "kid" header.
+// If requireIssuer is set, the iss claim must equal the requestor specified by the "kid" header.
+func jwtKeyExtractor(publickeys map[string]interface{}, requireIssuer bool) func(token *jwt.Token) (interface{}, error) {
 	return func(token *jwt.Token) (interface{}, error) {
 		var ok bool
 		kid, ok := token.Header["kid"]
@@ -196,6 +270,9 @@ func jwtKeyExtractor(publickeys map[string]interface{}) func(token *jwt.Token) (
 		if !ok {
 			return nil, errors.New("requestor name was not a string")
 		}
+		if requireIssuer && token.Claims.(*jwt.StandardClaims).Issuer != requestor {
+			return nil, errors.New("jwt issuer does not match requestor")
+		}
 		token.Claims.(*jwt.StandardClaims).Issuer = requestor
 		if pk, ok := publickeys[requestor]; ok {
 			return pk, nil
@@ -206,13 +283,13 @@ func jwtKeyExtractor(publickeys map[string]interface{}) func(token *jwt.Token) (
 
 // jwtAuthenticate is a helper function for JWT-based authenticators that verifies and parses JWTs.
 func jwtAuthenticate(
-	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int,
+	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, validation jwtValidation,
 ) (bool, irma.RequestorRequest, string, *irma.RemoteError) {
 	if !jwtApplies(headers, body, signatureAlg) {
 		return false, nil, "", nil
 	}
 
-	validatedJwt, claims, validationErr := jwtValidateClaims(body, keys, maxRequestAge)
+	validatedJwt, claims, validationErr := jwtValidateClaims(body, keys, validation)
 	if validationErr != nil {
 		return true, nil, "", validationErr
 	}
@@ -220,7 +297,7 @@ func jwtAuthenticate(
 	// Read JWT contents
 	parsedJwt, err := irma.ParseRequestorJwt(claims.Subject, validatedJwt)
 	if err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
+		return true, nil, "", server.RemoteError(server.InputError(err, server.ErrorInvalidRequest), err.Error())
 	}
 
 	requestor := claims.Issuer // presence is ensured by jwtKeyExtractor
@@ -228,13 +305,13 @@ func jwtAuthenticate(
 }
 
 func jwtAutheticateRevocation(
-	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, maxRequestAge int,
+	headers http.Header, body []byte, signatureAlg string, keys map[string]interface{}, validation jwtValidation,
 ) (bool, *irma.RevocationRequest, string, *irma.RemoteError) {
 	if !jwtApplies(headers, body, signatureAlg) {
 		return false, nil, "", nil
 	}
 
-	validatedJwt, _, validationErr := jwtValidateClaims(body, keys, maxRequestAge)
+	validatedJwt, _, validationErr := jwtValidateClaims(body, keys, validation)
 	if validationErr != nil {
 		return true, nil, "", validationErr
 	}
@@ -245,27 +322,79 @@ func jwtAutheticateRevocation(
 		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
 	if err := revocationJwt.Request.Validate(); err != nil {
-		return true, nil, "", server.RemoteError(server.ErrorInvalidRequest, "Invalid JWT body")
+		return true, nil, "", server.RemoteError(server.InputError(err, server.ErrorInvalidRequest), "Invalid JWT body")
 	}
 	return true, revocationJwt.Request, revocationJwt.ServerName, nil
 }
 
+// jwtAuthenticateRequestor is a helper function for JWT-based authenticators that verifies a JWT
+// sent as bearer token in the Authorization header.
+func jwtAuthenticateRequestor(
+	headers http.Header, signatureAlg string, keys map[string]interface{}, validation jwtValidation,
+) (bool, string, *irma.RemoteError) {
+	auth := headers.Get("Authorization")
+	if !strings.HasPrefix(auth, "Bearer ") {
+		return false, "", nil
+	}
+	requestorJwt := strings.TrimPrefix(auth, "Bearer ")
+	if alg, err := jwtSignatureAlg(requestorJwt); err != nil || alg != signatureAlg {
+		return false, "", nil
+	}
+
+	_, claims, validationErr := jwtValidateClaims([]byte(requestorJwt), keys, validation)
+	if validationErr != nil {
+		return true, "", validationErr
+	}
+	if claims.Subject != sessionListJwtSubject {
+		return true, "", server.RemoteError(server.ErrorUnauthorized, "jwt has unexpected subject")
+	}
+	return true, claims.Issuer, nil
+}
+
+// jwtValidation contains the parameters for validating the time, audience and issuer claims of requestor JWTs.
+type jwtValidation struct {
+	maxRequestAge int          // in seconds
+	clockSkew     int          // in seconds, tolerated difference between the clocks of requestor and server
+	clock         server.Clock // if nil, the system time is used
+	audience      string       // if nonempty, the required aud claim
+	requireIssuer bool         // whether the iss claim must equal the requestor
+}
+
+func (v jwtValidation) now() time.Time {
+	if v.clock == nil {
+		return time.Now()
+	}
+	return v.clock.Now()
+}
+
 func jwtValidateClaims(
-	body []byte, keys map[string]interface{}, maxRequestAge int,
+	body []byte, keys map[string]interface{}, validation jwtValidation,
 ) (string, *jwt.StandardClaims, *irma.RemoteError) {
 	// Verify JWT signature. We do not yet store the JWT contents here, because we need to know the session type first
 	// before we can construct a struct instance of the appropriate type into which to unmarshal the JWT contents.
+	// The time claims are validated below, taking the clock skew into account.
 	claims := &jwt.StandardClaims{}
 	requestorJwt := string(body)
-	_, err := jwt.ParseWithClaims(requestorJwt, claims, jwtKeyExtractor(keys))
+	parser := &jwt.Parser{SkipClaimsValidation: true}
+	_, err := parser.ParseWithClaims(requestorJwt, claims, jwtKeyExtractor(keys, validation.requireIssuer))
 	if err != nil {
 		return "", nil, server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
-	if time.Unix(claims.IssuedAt, 0).Add(time.Duration(maxRequestAge) * time.Second).Before(time.Now()) {
+	now := validation.now()
+	skew := time.Duration(validation.clockSkew) * time.Second
+	if !claims.VerifyExpiresAt(now.Add(-skew).Unix(), false) {
+		return "", nil, server.RemoteError(server.ErrorInvalidRequest, "jwt expired")
+	}
+	maxAge := time.Duration(validation.maxRequestAge)*time.Second + skew
+	if time.Unix(claims.IssuedAt, 0).Add(maxAge).Before(now) {
 		return "", nil, server.RemoteError(server.ErrorUnauthorized, "jwt too old")
 	}
-	if !claims.VerifyIssuedAt(time.Now().Unix(), true) {
-		return "", nil, server.RemoteError(server.ErrorUnauthorized, "jwt not yet valid")
+	if !claims.VerifyIssuedAt(now.Add(skew).Unix(), true) || !claims.VerifyNotBefore(now.Add(skew).Unix(), false) {
+		return "", nil, server.RemoteError(server.ErrorInvalidRequest, "jwt not yet valid")
+	}
+	// JWTs intended for another server, e.g. a staging environment, are refused
+	if validation.audience != "" && strings.TrimSuffix(claims.Audience, "/") != strings.TrimSuffix(validation.audience, "/") {
+		return "", nil, server.RemoteError(server.ErrorUnauthorized, "jwt has unexpected audience")
 	}
 
 	return requestorJwt, claims, nil
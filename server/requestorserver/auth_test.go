@@ -260,6 +260,99 @@ func TestHmacAuthenticator_AuthenticateRevocation(t *testing.T) {
 	})
 }
 
+type fixedClock time.Time
+
+func (c fixedClock) Now() time.Time {
+	return time.Time(c)
+}
+
+func TestJwtClockSkew(t *testing.T) {
+	key := []byte("953BCAB6F25F3622619A9A16BE895")
+	now := time.Now().Add(time.Hour)
+	authenticator := HmacAuthenticator{
+		hmackeys:      map[string]interface{}{"my_requestor": key},
+		maxRequestAge: 60,
+		clockSkew:     30,
+		clock:         fixedClock(now),
+	}
+	disclosureRequest := irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"))
+	requestHeaders := map[string][]string{"Content-Type": {"text/plain"}}
+
+	authenticate := func(issuedAt time.Time) *irma.RemoteError {
+		j := irma.NewServiceProviderJwt("my_requestor", disclosureRequest)
+		j.IssuedAt = irma.Timestamp(issuedAt)
+		jwtData, err := j.Sign(jwt.SigningMethodHS256, key)
+		require.NoError(t, err)
+		applies, _, _, rerr := authenticator.AuthenticateSession(requestHeaders, []byte(jwtData))
+		require.True(t, applies)
+		return rerr
+	}
+
+	// Times are relative to the configured clock, with a tolerance of clockSkew
+	require.Nil(t, authenticate(now))
+	require.Nil(t, authenticate(now.Add(20*time.Second)))
+	require.Nil(t, authenticate(now.Add(-80*time.Second)))
+	require.NotNil(t, authenticate(now.Add(40*time.Second)))
+	require.NotNil(t, authenticate(now.Add(-100*time.Second)))
+}
+
+func TestJwtAudienceAndIssuer(t *testing.T) {
+	key := []byte("953BCAB6F25F3622619A9A16BE895")
+	otherKey := []byte("B2F3A1DE5C7C9A8B0E6F4D2C1A3B5")
+	authenticator := HmacAuthenticator{
+		hmackeys:      map[string]interface{}{"my_requestor": key, "other_requestor": otherKey},
+		maxRequestAge: 60,
+		audience:      "https://irma.example.com",
+		requireIssuer: true,
+	}
+	request := &irma.ServiceProviderRequest{
+		Request: irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	}
+	requestHeaders := map[string][]string{"Content-Type": {"text/plain"}}
+
+	authenticate := func(issuer, kid, audience string, key []byte) (string, *irma.RemoteError) {
+		j := irma.NewServiceProviderJwt(issuer, nil)
+		j.Request, j.Audience = request, audience
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, j)
+		if kid != "" {
+			token.Header["kid"] = kid
+		}
+		jwtData, err := token.SignedString(key)
+		require.NoError(t, err)
+		applies, _, requestor, rerr := authenticator.AuthenticateSession(requestHeaders, []byte(jwtData))
+		require.True(t, applies)
+		return requestor, rerr
+	}
+
+	requestor, rerr := authenticate("my_requestor", "", "https://irma.example.com/", key)
+	require.Nil(t, rerr)
+	require.Equal(t, "my_requestor", requestor)
+	requestor, rerr = authenticate("my_requestor", "my_requestor", "https://irma.example.com", key)
+	require.Nil(t, rerr)
+	require.Equal(t, "my_requestor", requestor)
+
+	// JWTs for other servers, or without audience, are refused
+	_, rerr = authenticate("my_requestor", "", "https://staging.irma.example.com", key)
+	require.NotNil(t, rerr)
+	_, rerr = authenticate("my_requestor", "", "", key)
+	require.NotNil(t, rerr)
+
+	// The issuer must be the requestor whose key is used
+	_, rerr = authenticate("my_requestor", "other_requestor", "https://irma.example.com", otherKey)
+	require.NotNil(t, rerr)
+	authenticator.requireIssuer = false
+	requestor, rerr = authenticate("my_requestor", "other_requestor", "https://irma.example.com", otherKey)
+	require.Nil(t, rerr)
+	require.Equal(t, "other_requestor", requestor)
+
+	// Requestors can sign requests for a specific server using SignRequestorRequestWithAudience()
+	jwtData, err := irma.SignRequestorRequestWithAudience(request, jwt.SigningMethodHS256, key, "my_requestor", "https://irma.example.com")
+	require.NoError(t, err)
+	_, _, requestor, rerr = authenticator.AuthenticateSession(requestHeaders, []byte(jwtData))
+	require.Nil(t, rerr)
+	require.Equal(t, "my_requestor", requestor)
+}
+
 func newRevocationJwt(servername string, rr *irma.RevocationRequest) *irma.RevocationJwt {
 	return &irma.RevocationJwt{
 		ServerJwt: irma.ServerJwt{
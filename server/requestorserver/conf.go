@@ -12,6 +12,7 @@ import (
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/notify"
 )
 
 type Configuration struct {
@@ -26,7 +27,8 @@ type Configuration struct {
 	// server configuration before the server accepts it.
 	DisableRequestorAuthentication bool `json:"no_auth" mapstructure:"no_auth"`
 
-	// Address to listen at
+	// Address to listen at, or "unix:<path>" for a Unix domain socket, or "systemd" or "systemd:<name>"
+	// for a socket passed by systemd socket activation (in which case Port is ignored)
 	ListenAddress string `json:"listen_addr" mapstructure:"listen_addr"`
 	// Port to listen at
 	Port int `json:"port" mapstructure:"port"`
@@ -41,7 +43,8 @@ type Configuration struct {
 
 	// If specified, start a separate server for the IRMA app at his port
 	ClientPort int `json:"client_port" mapstructure:"client_port"`
-	// If clientport is specified, the server for the IRMA app listens at this address
+	// If clientport is specified, the server for the IRMA app listens at this address. Like ListenAddress,
+	// this may be a socket address, in which case the separate server is started without clientport
 	ClientListenAddress string `json:"client_listen_addr" mapstructure:"client_listen_addr"`
 	// TLS configuration for irmaclient HTTP API
 	ClientTlsCertificate     string `json:"client_tls_cert" mapstructure:"client_tls_cert"`
@@ -49,16 +52,72 @@ type Configuration struct {
 	ClientTlsPrivateKey      string `json:"client_tls_privkey" mapstructure:"client_tls_privkey"`
 	ClientTlsPrivateKeyFile  string `json:"client_tls_privkey_file" mapstructure:"client_tls_privkey_file"`
 
+	// If specified, start a separate server for the frontend endpoints (used by browsers) at this port.
+	// Requires frontend_url to be set.
+	FrontendPort int `json:"frontend_port" mapstructure:"frontend_port"`
+	// If frontendport is specified, the server for the frontend listens at this address. Like ListenAddress,
+	// this may be a socket address, in which case the separate server is started without frontendport
+	FrontendListenAddress string `json:"frontend_listen_addr" mapstructure:"frontend_listen_addr"`
+	// TLS configuration for the frontend HTTP API
+	FrontendTlsCertificate     string `json:"frontend_tls_cert" mapstructure:"frontend_tls_cert"`
+	FrontendTlsCertificateFile string `json:"frontend_tls_cert_file" mapstructure:"frontend_tls_cert_file"`
+	FrontendTlsPrivateKey      string `json:"frontend_tls_privkey" mapstructure:"frontend_tls_privkey"`
+	FrontendTlsPrivateKeyFile  string `json:"frontend_tls_privkey_file" mapstructure:"frontend_tls_privkey_file"`
+
 	// Requestor-specific permission and authentication configuration
 	Requestors map[string]Requestor `json:"requestors"`
 
 	// Max age in seconds of a session request JWT (using iat field)
 	MaxRequestAge int `json:"max_request_age" mapstructure:"max_request_age"`
+	// Tolerated difference in seconds between the clocks of requestors and this server when
+	// validating the time claims of requestor JWTs
+	ClockSkew int `json:"clock_skew" mapstructure:"clock_skew"`
+	// If specified, requestor JWTs must have this aud claim, which should be the URL of this server
+	// as used by requestors, so that JWTs intended for other servers (e.g. staging) are refused
+	RequestorJwtAudience string `json:"requestor_jwt_aud" mapstructure:"requestor_jwt_aud"`
+	// Require the iss claim of requestor JWTs to equal the name of the requestor whose key
+	// verifies the JWT, also when the requestor is specified in the kid header of the JWT
+	RequireRequestorJwtIssuer bool `json:"requestor_jwt_require_iss" mapstructure:"requestor_jwt_require_iss"`
 
 	// Host files under this path as static files (leave empty to disable)
 	StaticPath string `json:"static_path" mapstructure:"static_path"`
 	// Host static files under this URL prefix
 	StaticPrefix string `json:"static_prefix" mapstructure:"static_prefix"`
+
+	// If specified, start a reverse proxy at ProxyPort that forwards requests to this URL once the
+	// user has disclosed the attributes in ProxyDisclose
+	ProxyUpstream string `json:"proxy_upstream" mapstructure:"proxy_upstream"`
+	// If ProxyUpstream is specified, the reverse proxy listens at this address and port
+	ProxyListenAddress string `json:"proxy_listen_addr" mapstructure:"proxy_listen_addr"`
+	ProxyPort          int    `json:"proxy_port" mapstructure:"proxy_port"`
+	// Attributes that users must disclose before their requests are forwarded to the upstream
+	ProxyDisclose irma.AttributeConDisCon `json:"proxy_disclose" mapstructure:"proxy_disclose"`
+	// Disclosed attributes are forwarded to the upstream in headers having this prefix
+	ProxyHeaderPrefix string `json:"proxy_header_prefix" mapstructure:"proxy_header_prefix"`
+	// Names (after the prefix) and transforms of the headers in which disclosed attributes are
+	// forwarded. By default each attribute of ProxyDisclose is forwarded as is, with the dots in its
+	// identifier replaced by dashes.
+	ProxyHeaders server.AttributeMapping `json:"proxy_headers" mapstructure:"proxy_headers"`
+	// Lifetime in minutes of the authentication of users at the reverse proxy
+	ProxySessionLifetime int `json:"proxy_session_lifetime" mapstructure:"proxy_session_lifetime"`
+	// Do not require users to enter a pairing code in their IRMA app, shown next to the QR code at
+	// the reverse proxy. Without pairing, an attacker can forward the QR code to a victim and be
+	// let through the reverse proxy with the attributes of the victim.
+	ProxyNoPairing bool `json:"proxy_no_pairing" mapstructure:"proxy_no_pairing"`
+
+	// Mail server, SMS gateway and templates for sending session links to users (leave nil to disable)
+	Notifications *notify.Configuration `json:"notifications,omitempty" mapstructure:"notifications"`
+
+	// If specified, usage statistics are served at /stats to requests bearing this token
+	// in their Authorization header (leave empty to disable)
+	StatsToken string `json:"stats_token" mapstructure:"stats_token"`
+	// If specified, the profiles of net/http/pprof are served at /debug/pprof/ to requests bearing
+	// the StatsToken, by a separate server listening at this port of 127.0.0.1 only.
+	PprofPort int `json:"pprof_port" mapstructure:"pprof_port"`
+
+	// Emulate the session endpoints of the irma_api_server under /api/v2, for integrations that
+	// have not yet migrated. Anyone knowing the session pointer can retrieve session results there.
+	LegacyApi bool `json:"legacy_api" mapstructure:"legacy_api"`
 }
 
 // Permissions specify which attributes or credential a requestor may verify or issue.
@@ -79,46 +138,97 @@ type Requestor struct {
 	AuthenticationMethod  AuthenticationMethod `json:"auth_method" mapstructure:"auth_method"`
 	AuthenticationKey     string               `json:"key" mapstructure:"key"`
 	AuthenticationKeyFile string               `json:"key_file" mapstructure:"key_file"`
+
+	// Always require pairing of the frontend and the IRMA app in sessions of this requestor
+	RequirePairing bool `json:"require_pairing" mapstructure:"require_pairing"`
+	// Attributes whose values are replaced by salted hashes in the result JWTs and callbacks of
+	// sessions of this requestor (see server.Configuration.HashedAttributes)
+	HashedAttributes []string `json:"hashed_attributes" mapstructure:"hashed_attributes"`
+	// Codes of the purposes that the sessions of this requestor may have (see irma.Purpose). If
+	// specified, the session requests of this requestor must specify one of these purposes.
+	Purposes []string `json:"purposes" mapstructure:"purposes"`
+
+	// Callback URL to which the session results of this requestor are posted, if its session
+	// request specifies none
+	CallbackURL string `json:"callback_url" mapstructure:"callback_url"`
+	// Validity in seconds of the result JWTs of this requestor, if its session request specifies none
+	JwtValidity int `json:"jwt_validity" mapstructure:"jwt_validity"`
+	// Key ID included in the kid header of the result JWTs and callback JWTs of this requestor
+	// (see server.Configuration.JwtKeyIDs)
+	JwtKeyID string `json:"jwt_kid" mapstructure:"jwt_kid"`
 }
 
-func (conf *Configuration) CanRequest(requestor string, request irma.SessionRequest) (bool, string) {
-	if request.Action() == irma.ActionIssuing {
-		if ok, reason := conf.CanIssue(requestor, request.(*irma.IssuanceRequest).Credentials); !ok {
-			return false, reason
-		}
+// applyRequestorSettings applies the settings of the requestor to its session request: pairing
+// is required if the requestor requires it, and its callback URL and result JWT validity are used
+// unless the request specifies them.
+func (conf *Configuration) applyRequestorSettings(requestor string, rrequest irma.RequestorRequest) {
+	settings, ok := conf.Requestors[requestor]
+	if !ok {
+		return
 	}
-
-	condiscon := request.Disclosure().Disclose
-	if len(condiscon) > 0 {
-		if ok, reason := conf.CanVerifyOrSign(requestor, request.Action(), condiscon); !ok {
-			return false, reason
-		}
+	base := rrequest.Base()
+	if settings.RequirePairing {
+		base.RequirePairing = true
 	}
-
-	defaultURL, err := url.Parse(conf.URL)
-	if err != nil {
-		return false, "default host is invalid"
+	if base.CallbackURL == "" {
+		base.CallbackURL = settings.CallbackURL
 	}
+	if settings.JwtValidity != 0 && !base.ResultJwtValiditySet() {
+		base.ResultJwtValidity = settings.JwtValidity
+	}
+}
 
-	// If no host is specified in the request, then the default URL from the configuration will be used.
-	// We should take this into account when checking the permissions.
-	host := request.Base().Host
-	if host == "" {
-		host = defaultURL.Host
+// validateRequestorSettings checks the result settings of the requestors.
+func (conf *Configuration) validateRequestorSettings() error {
+	for name, requestor := range conf.Requestors {
+		if requestor.CallbackURL != "" {
+			u, err := url.Parse(requestor.CallbackURL)
+			if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+				return errors.Errorf("Requestor %s has invalid callback_url %s", name, requestor.CallbackURL)
+			}
+			if conf.AirGapped {
+				return errors.Errorf("Requestor %s has a callback_url, which cannot be used in air-gapped mode", name)
+			}
+			if conf.JwtSigningKey() == nil && !conf.AllowUnsignedCallbacks {
+				return errors.Errorf("Requestor %s has a callback_url but no JWT private key is installed: either install JWT or enable allow_unsigned_callbacks in configuration", name)
+			}
+		}
+		if requestor.JwtValidity < 0 {
+			return errors.Errorf("Requestor %s has negative jwt_validity", name)
+		}
+		if requestor.JwtKeyID != "" && conf.JwtSigningKey() == nil {
+			return errors.Errorf("Requestor %s has a jwt_kid but no JWT private key is installed", name)
+		}
 	}
+	return nil
+}
 
-	// If no host is specified in the requestor configuration, then we only allow the default host.
-	if len(conf.Requestors[requestor].Hosts) == 0 && host == defaultURL.Host {
+// CanRequest returns whether or not the specified requestor may start the specified session
+// request, and if not, a message describing what it is not permitted to do
+// (see PermissionDenials).
+func (conf *Configuration) CanRequest(requestor string, request irma.SessionRequest) (bool, string) {
+	denials := conf.PermissionDenials(requestor, request)
+	if len(denials) == 0 {
 		return true, ""
 	}
+	return false, permissionDenialsMessage(denials)
+}
 
-	// For all host patterns being set in the requestor configuration, check whether the requested host matches it.
-	for _, hostPattern := range conf.Requestors[requestor].Hosts {
-		if match, _ := path.Match(hostPattern, host); match {
-			return true, ""
-		}
+// PermissionDenials returns, for each of the credential types to be issued, the attributes to be
+// disclosed and the host of the specified session request, which the requestor is not permitted
+// to use, why it is not permitted; or nil if the requestor may start the session.
+func (conf *Configuration) PermissionDenials(requestor string, request irma.SessionRequest) []*irma.PermissionDenial {
+	var denials []*irma.PermissionDenial
+	if request.Action() == irma.ActionIssuing {
+		denials = append(denials, conf.issuanceDenials(requestor, request.(*irma.IssuanceRequest).Credentials)...)
 	}
-	return false, "requestor not allowed to use the requested host"
+	if condiscon := request.Disclosure().Disclose; len(condiscon) > 0 {
+		denials = append(denials, conf.disclosureDenials(requestor, request.Action(), condiscon)...)
+	}
+	if denial := conf.hostDenial(requestor, request); denial != nil {
+		denials = append(denials, denial)
+	}
+	return denials
 }
 
 // CanIssue returns whether or not the specified requestor may issue the specified credentials.
@@ -126,57 +236,119 @@ func (conf *Configuration) CanRequest(requestor string, request irma.SessionRequ
 // the identity provider is allowed to verify the attributes being verified; use CanVerifyOrSign
 // for that).
 func (conf *Configuration) CanIssue(requestor string, creds []*irma.CredentialRequest) (bool, string) {
-	permissions := append(conf.Requestors[requestor].Issuing, conf.Issuing...)
-	if len(permissions) == 0 { // requestor is not present in the permissions
+	return permitted(conf.issuanceDenials(requestor, creds))
+}
+
+// CanVerifyOrSign returns whether or not the specified requestor may use the selected attributes
+// in any of the supported session types.
+func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action, disjunctions irma.AttributeConDisCon) (bool, string) {
+	return permitted(conf.disclosureDenials(requestor, action, disjunctions))
+}
+
+// permitted returns whether the denials are empty, and if not, the identifier of the first denial,
+// or an empty string if the requestor has no permissions of its kind at all.
+func permitted(denials []*irma.PermissionDenial) (bool, string) {
+	if len(denials) == 0 {
+		return true, ""
+	}
+	if denials[0].Reason == irma.PermissionDenialNoPermissions {
 		return false, ""
 	}
+	return false, denials[0].Identifier
+}
 
+func (conf *Configuration) issuanceDenials(requestor string, creds []*irma.CredentialRequest) []*irma.PermissionDenial {
+	permissions := append(conf.Requestors[requestor].Issuing, conf.Issuing...)
+	var denials []*irma.PermissionDenial
 	for _, cred := range creds {
 		id := cred.CredentialTypeID
-		if slices.Contains(permissions, "*") ||
-			slices.Contains(permissions, id.Root()+".*") ||
-			slices.Contains(permissions, id.IssuerIdentifier().String()+".*") ||
-			slices.Contains(permissions, id.String()) {
-			continue
-		} else {
-			return false, id.String()
+		if len(permissions) == 0 { // requestor is not present in the permissions
+			denials = appendDenial(denials, id.String(), "issue_perms", irma.PermissionDenialNoPermissions)
+		} else if !slices.Contains(permissions, "*") &&
+			!slices.Contains(permissions, id.Root()+".*") &&
+			!slices.Contains(permissions, id.IssuerIdentifier().String()+".*") &&
+			!slices.Contains(permissions, id.String()) {
+			denials = appendDenial(denials, id.String(), "issue_perms", irma.PermissionDenialNotPermitted)
 		}
 	}
-
-	return true, ""
+	return denials
 }
 
-// CanVerifyOrSign returns whether or not the specified requestor may use the selected attributes
-// in any of the supported session types.
-func (conf *Configuration) CanVerifyOrSign(requestor string, action irma.Action, disjunctions irma.AttributeConDisCon) (bool, string) {
-	var permissions []string
+func (conf *Configuration) disclosureDenials(requestor string, action irma.Action, disjunctions irma.AttributeConDisCon) []*irma.PermissionDenial {
+	var (
+		permissions []string
+		name        string
+	)
 	switch action {
-	case irma.ActionDisclosing:
-		permissions = append(conf.Requestors[requestor].Disclosing, conf.Disclosing...)
-	case irma.ActionIssuing:
+	case irma.ActionDisclosing, irma.ActionIssuing:
 		permissions = append(conf.Requestors[requestor].Disclosing, conf.Disclosing...)
+		name = "disclose_perms"
 	case irma.ActionSigning:
 		permissions = append(conf.Requestors[requestor].Signing, conf.Signing...)
+		name = "sign_perms"
+	}
+
+	var denials []*irma.PermissionDenial
+	_ = disjunctions.Iterate(func(attr *irma.AttributeRequest) error {
+		if len(permissions) == 0 { // requestor is not present in the permissions
+			denials = appendDenial(denials, attr.Type.String(), name, irma.PermissionDenialNoPermissions)
+		} else if !slices.Contains(permissions, "*") &&
+			!slices.Contains(permissions, attr.Type.Root()+".*") &&
+			!slices.Contains(permissions, attr.Type.CredentialTypeIdentifier().IssuerIdentifier().String()+".*") &&
+			!slices.Contains(permissions, attr.Type.CredentialTypeIdentifier().String()+".*") &&
+			!slices.Contains(permissions, attr.Type.String()) {
+			denials = appendDenial(denials, attr.Type.String(), name, irma.PermissionDenialNotPermitted)
+		}
+		return nil
+	})
+	return denials
+}
+
+// hostDenial returns a denial if the requestor may not use the host of the session request.
+func (conf *Configuration) hostDenial(requestor string, request irma.SessionRequest) *irma.PermissionDenial {
+	defaultURL, err := url.Parse(conf.URL)
+	if err != nil {
+		return &irma.PermissionDenial{Identifier: conf.URL, Permission: "url", Reason: irma.PermissionDenialNotPermitted}
 	}
-	if len(permissions) == 0 { // requestor is not present in the permissions
-		return false, ""
+
+	// If no host is specified in the request, then the default URL from the configuration will be used.
+	// We should take this into account when checking the permissions.
+	host := request.Base().Host
+	if host == "" {
+		host = defaultURL.Host
 	}
 
-	err := disjunctions.Iterate(func(attr *irma.AttributeRequest) error {
-		if slices.Contains(permissions, "*") ||
-			slices.Contains(permissions, attr.Type.Root()+".*") ||
-			slices.Contains(permissions, attr.Type.CredentialTypeIdentifier().IssuerIdentifier().String()+".*") ||
-			slices.Contains(permissions, attr.Type.CredentialTypeIdentifier().String()+".*") ||
-			slices.Contains(permissions, attr.Type.String()) {
+	// If no host is specified in the requestor configuration, then we only allow the default host.
+	if len(conf.Requestors[requestor].Hosts) == 0 && host == defaultURL.Host {
+		return nil
+	}
+
+	// For all host patterns being set in the requestor configuration, check whether the requested host matches it.
+	for _, hostPattern := range conf.Requestors[requestor].Hosts {
+		if match, _ := path.Match(hostPattern, host); match {
 			return nil
-		} else {
-			return errors.New(attr.Type.String())
 		}
-	})
-	if err != nil {
-		return false, err.Error()
 	}
-	return true, ""
+	return &irma.PermissionDenial{Identifier: host, Permission: "host_perms", Reason: irma.PermissionDenialNotPermitted}
+}
+
+// appendDenial appends the specified denial, unless the identifier was already denied, which
+// happens when an attribute occurs multiple times in a session request.
+func appendDenial(denials []*irma.PermissionDenial, id, permission string, reason irma.PermissionDenialReason) []*irma.PermissionDenial {
+	for _, denial := range denials {
+		if denial.Identifier == id {
+			return denials
+		}
+	}
+	return append(denials, &irma.PermissionDenial{Identifier: id, Permission: permission, Reason: reason})
+}
+
+func permissionDenialsMessage(denials []*irma.PermissionDenial) string {
+	msgs := make([]string, 0, len(denials))
+	for _, denial := range denials {
+		msgs = append(msgs, denial.String())
+	}
+	return "not permitted to use " + strings.Join(msgs, ", ")
 }
 
 func (conf *Configuration) CanRevoke(requestor string, cred irma.CredentialTypeIdentifier) (bool, string) {
@@ -198,8 +370,12 @@ func (conf *Configuration) CanRevoke(requestor string, cred irma.CredentialTypeI
 }
 
 func (conf *Configuration) initialize() error {
+	strict := strictJSON{
+		sessionRequests:    conf.StrictJSONEnabled(server.StrictJSONSessionRequests),
+		revocationRequests: conf.StrictJSONEnabled(server.StrictJSONRevocationRequests),
+	}
 	if conf.DisableRequestorAuthentication {
-		authenticators = map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{}}
+		authenticators = map[AuthenticationMethod]Authenticator{AuthenticationMethodNone: NilAuthenticator{strictJSON: strict}}
 		conf.Logger.Warn("Authentication of incoming session requests disabled: anyone who can reach this server can use it")
 		havekeys := conf.HavePrivateKeys()
 		if len(conf.Permissions.Issuing) > 0 && havekeys {
@@ -222,9 +398,23 @@ func (conf *Configuration) initialize() error {
 			}
 		}
 		authenticators = map[AuthenticationMethod]Authenticator{
-			AuthenticationMethodHmac:      &HmacAuthenticator{hmackeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{publickeys: map[string]interface{}{}, maxRequestAge: conf.MaxRequestAge},
-			AuthenticationMethodToken:     &PresharedKeyAuthenticator{presharedkeys: map[string]string{}},
+			AuthenticationMethodHmac: &HmacAuthenticator{
+				hmackeys:      map[string]interface{}{},
+				maxRequestAge: conf.MaxRequestAge,
+				clockSkew:     conf.ClockSkew,
+				clock:         conf.Clock,
+				audience:      conf.RequestorJwtAudience,
+				requireIssuer: conf.RequireRequestorJwtIssuer,
+			},
+			AuthenticationMethodPublicKey: &PublicKeyAuthenticator{
+				publickeys:    map[string]interface{}{},
+				maxRequestAge: conf.MaxRequestAge,
+				clockSkew:     conf.ClockSkew,
+				clock:         conf.Clock,
+				audience:      conf.RequestorJwtAudience,
+				requireIssuer: conf.RequireRequestorJwtIssuer,
+			},
+			AuthenticationMethodToken: &PresharedKeyAuthenticator{presharedkeys: map[string]string{}, strictJSON: strict},
 		}
 
 		// Initialize authenticators
@@ -240,7 +430,7 @@ func (conf *Configuration) initialize() error {
 		}
 	}
 
-	if conf.Port <= 0 || conf.Port > 65535 {
+	if !server.IsSocketAddress(conf.ListenAddress) && (conf.Port <= 0 || conf.Port > 65535) {
 		return errors.Errorf("Port must be between 1 and 65535 (was %d)", conf.Port)
 	}
 
@@ -250,8 +440,12 @@ func (conf *Configuration) initialize() error {
 	if conf.ClientPort < 0 || conf.ClientPort > 65535 {
 		return errors.Errorf("client_port must be between 0 and 65535 (was %d)", conf.ClientPort)
 	}
-	if conf.ClientListenAddress != "" && conf.ClientPort == 0 {
-		return errors.New("client_listen_addr must be combined with a nonzero client_port")
+	if conf.ClientListenAddress != "" && conf.ClientPort == 0 && !server.IsSocketAddress(conf.ClientListenAddress) {
+		return errors.New("client_listen_addr must be a socket address or be combined with a nonzero client_port")
+	}
+
+	if err := conf.verifyFrontendServer(); err != nil {
+		return err
 	}
 
 	tlsConf, err := conf.tlsConfig()
@@ -266,6 +460,9 @@ func (conf *Configuration) initialize() error {
 	if err := conf.validatePermissions(); err != nil {
 		return err
 	}
+	if err := conf.validateRequestorSettings(); err != nil {
+		return err
+	}
 
 	if conf.StaticPath != "" {
 		if err := common.AssertPathExists(conf.StaticPath); err != nil {
@@ -280,25 +477,10 @@ func (conf *Configuration) initialize() error {
 	}
 
 	if conf.URL != "" {
-		if !strings.HasSuffix(conf.URL, "/") {
-			conf.URL = conf.URL + "/"
-		}
-		if !strings.HasSuffix(conf.URL, "irma/") {
-			conf.URL = conf.URL + "irma/"
-		}
-		// replace "port" in url with actual port
-		port := conf.ClientPort
-		if port == 0 {
-			port = conf.Port
-		}
-		conf.URL = server.ReplacePortString(conf.URL, port)
-
-		separateClientServer := conf.separateClientServer()
-		if (separateClientServer && clientTlsConf != nil) || (!separateClientServer && tlsConf != nil) {
-			if strings.HasPrefix(conf.URL, "http://") {
-				conf.URL = "https://" + conf.URL[len("http://"):]
-			}
-		}
+		conf.URL = conf.clientURL(conf.URL, tlsConf, clientTlsConf)
+	}
+	for i, u := range conf.AlternativeURLs {
+		conf.AlternativeURLs[i] = conf.clientURL(u, tlsConf, clientTlsConf)
 	}
 
 	if !strings.HasSuffix(conf.ApiPrefix, "/") {
@@ -308,18 +490,92 @@ func (conf *Configuration) initialize() error {
 	if !strings.HasPrefix(conf.ApiPrefix, "/") {
 		return errors.Errorf("api_prefix must start with a slash, but doesn't: %s", conf.ApiPrefix)
 	}
+	if conf.PathPrefix != "" {
+		return errors.New("path_prefix is not supported by the IRMA server, use api_prefix instead")
+	}
 
 	if conf.URL != "" && !strings.HasSuffix(conf.URL, conf.ApiPrefix+"irma/") {
 		conf.Logger.Warnf("Are the URL and API-prefix set correctly?: %s does not end with %s.", conf.URL, conf.ApiPrefix+"irma/")
 	}
 
-	if len(conf.StaticSessions) != 0 && conf.JwtRSAPrivateKey == nil {
+	if err := conf.verifyProxy(); err != nil {
+		return err
+	}
+
+	if conf.pprofServer() && conf.StatsToken == "" {
+		return errors.New("pprof_port requires stats_token, with which the profiles are protected")
+	}
+	if conf.SessionHistory && conf.StatsToken == "" {
+		return errors.New("session_history requires stats_token, with which the session histories are protected")
+	}
+
+	if len(conf.StaticSessions) != 0 && conf.JwtSigningKey() == nil {
 		conf.Logger.Warn("Static sessions enabled and no JWT private key installed. Ensure that POSTs to the callback URLs of static sessions are trustworthy by keeping the callback URLs secret and by using HTTPS.")
 	}
 
 	return nil
 }
 
+// collectRequestorSettings copies the hashed attributes, purposes and JWT key IDs of the
+// requestors, and the schemes to which their permissions refer, to the configuration of the
+// irmaserver library, which applies them.
+func (conf *Configuration) collectRequestorSettings() {
+	if conf.LazySchemes {
+		conf.collectEagerSchemes()
+	}
+	for name, requestor := range conf.Requestors {
+		if requestor.JwtKeyID != "" {
+			if conf.JwtKeyIDs == nil {
+				conf.JwtKeyIDs = map[string]string{}
+			}
+			conf.JwtKeyIDs[name] = requestor.JwtKeyID
+		}
+		if len(requestor.Purposes) > 0 {
+			if conf.Purposes == nil {
+				conf.Purposes = map[string][]string{}
+			}
+			conf.Purposes[name] = requestor.Purposes
+		}
+		if len(requestor.HashedAttributes) == 0 {
+			continue
+		}
+		if conf.HashedAttributes == nil {
+			conf.HashedAttributes = map[string][]irma.AttributeTypeIdentifier{}
+		}
+		attrs := make([]irma.AttributeTypeIdentifier, 0, len(requestor.HashedAttributes))
+		for _, attr := range requestor.HashedAttributes {
+			attrs = append(attrs, irma.NewAttributeTypeIdentifier(attr))
+		}
+		conf.HashedAttributes[name] = attrs
+	}
+}
+
+// collectEagerSchemes sets the schemes that are parsed at startup when lazy_schemes is enabled
+// to the schemes referred to by the permissions; other schemes cannot be used in sessions anyway.
+func (conf *Configuration) collectEagerSchemes() {
+	schemes := map[irma.SchemeManagerIdentifier]struct{}{}
+	permissions := []Permissions{conf.Permissions}
+	for _, requestor := range conf.Requestors {
+		permissions = append(permissions, requestor.Permissions)
+	}
+	for _, perms := range permissions {
+		for _, typeperms := range [][]string{perms.Disclosing, perms.Signing, perms.Issuing, perms.Revoking} {
+			for _, permission := range typeperms {
+				scheme := strings.Split(permission, ".")[0]
+				if scheme == "*" { // all schemes are needed, so parse them all at startup
+					conf.LazySchemes = false
+					return
+				}
+				schemes[irma.NewSchemeManagerIdentifier(scheme)] = struct{}{}
+			}
+		}
+	}
+	conf.EagerSchemes = make([]irma.SchemeManagerIdentifier, 0, len(schemes))
+	for id := range schemes {
+		conf.EagerSchemes = append(conf.EagerSchemes, id)
+	}
+}
+
 func (conf *Configuration) validatePermissions() error {
 	if conf.DisableRequestorAuthentication && len(conf.Requestors) != 0 {
 		return errors.New("Requestors must not be configured when requestor authentication is disabled")
@@ -421,10 +677,128 @@ func (conf *Configuration) clientTlsConfig() (*tls.Config, error) {
 	return server.TLSConf(conf.ClientTlsCertificate, conf.ClientTlsCertificateFile, conf.ClientTlsPrivateKey, conf.ClientTlsPrivateKeyFile)
 }
 
+func (conf *Configuration) frontendTlsConfig() (*tls.Config, error) {
+	return server.TLSConf(conf.FrontendTlsCertificate, conf.FrontendTlsCertificateFile, conf.FrontendTlsPrivateKey, conf.FrontendTlsPrivateKeyFile)
+}
+
 func (conf *Configuration) tlsConfig() (*tls.Config, error) {
 	return server.TLSConf(conf.TlsCertificate, conf.TlsCertificateFile, conf.TlsPrivateKey, conf.TlsPrivateKeyFile)
 }
 
 func (conf *Configuration) separateClientServer() bool {
-	return conf.ClientPort != 0
+	return conf.ClientPort != 0 || server.IsSocketAddress(conf.ClientListenAddress)
+}
+
+// clientURL normalizes the specified (alternative) URL at which the IRMA app reaches this server:
+// it appends the irma/ path, replaces "port" with the actual port and switches to https if the
+// IRMA app endpoints are served over TLS.
+func (conf *Configuration) clientURL(u string, tlsConf, clientTlsConf *tls.Config) string {
+	if !strings.HasSuffix(u, "/") {
+		u = u + "/"
+	}
+	if !strings.HasSuffix(u, "irma/") {
+		u = u + "irma/"
+	}
+	// replace "port" in url with actual port
+	port := conf.ClientPort
+	if port == 0 {
+		port = conf.Port
+	}
+	u = server.ReplacePortString(u, port)
+
+	separateClientServer := conf.separateClientServer()
+	if (separateClientServer && clientTlsConf != nil) || (!separateClientServer && tlsConf != nil) {
+		if strings.HasPrefix(u, "http://") {
+			u = "https://" + u[len("http://"):]
+		}
+	}
+	return u
+}
+
+func (conf *Configuration) separateFrontendServer() bool {
+	return conf.FrontendPort != 0 || server.IsSocketAddress(conf.FrontendListenAddress)
+}
+
+func (conf *Configuration) verifyFrontendServer() error {
+	if !conf.separateFrontendServer() {
+		if conf.FrontendListenAddress != "" {
+			return errors.New("frontend_listen_addr must be a socket address or be combined with a nonzero frontend_port")
+		}
+		if conf.FrontendURL != "" {
+			return errors.New("frontend_url can only be used with a separate frontend server (frontend_port or frontend_listen_addr)")
+		}
+		return nil
+	}
+	if conf.FrontendPort < 0 || conf.FrontendPort > 65535 {
+		return errors.Errorf("frontend_port must be between 0 and 65535 (was %d)", conf.FrontendPort)
+	}
+	if conf.FrontendPort != 0 && (conf.FrontendPort == conf.Port || conf.FrontendPort == conf.ClientPort) {
+		return errors.New("If frontend_port is given it must be different from port and client_port")
+	}
+	if conf.FrontendURL == "" {
+		return errors.New("frontend_url must be specified when a separate frontend server is used")
+	}
+	frontendTlsConf, err := conf.frontendTlsConfig()
+	if err != nil {
+		return errors.WrapPrefix(err, "Failed to read frontend TLS configuration", 0)
+	}
+
+	if !strings.HasSuffix(conf.FrontendURL, "irma/") {
+		conf.FrontendURL = conf.FrontendURL + "irma/"
+	}
+	conf.FrontendURL = server.ReplacePortString(conf.FrontendURL, conf.FrontendPort)
+	if frontendTlsConf != nil && strings.HasPrefix(conf.FrontendURL, "http://") {
+		conf.FrontendURL = "https://" + conf.FrontendURL[len("http://"):]
+	}
+	return nil
+}
+
+func (conf *Configuration) pprofServer() bool {
+	return conf.PprofPort != 0
+}
+
+func (conf *Configuration) proxyServer() bool {
+	return conf.ProxyUpstream != ""
+}
+
+func (conf *Configuration) verifyProxy() error {
+	if !conf.proxyServer() {
+		return nil
+	}
+	if _, err := url.ParseRequestURI(conf.ProxyUpstream); err != nil {
+		return errors.WrapPrefix(err, "Invalid proxy_upstream", 0)
+	}
+	if !server.IsSocketAddress(conf.ProxyListenAddress) {
+		if conf.ProxyPort <= 0 || conf.ProxyPort > 65535 {
+			return errors.Errorf("proxy_port must be between 1 and 65535 (was %d)", conf.ProxyPort)
+		}
+		if conf.ProxyPort == conf.Port || conf.ProxyPort == conf.ClientPort || conf.ProxyPort == conf.FrontendPort {
+			return errors.New("proxy_port must be different from port, client_port and frontend_port")
+		}
+	}
+	if len(conf.ProxyDisclose) == 0 {
+		return errors.New("proxy_disclose must be specified when proxy_upstream is used")
+	}
+	if conf.JwtSigningKey() == nil {
+		return errors.New("proxy_upstream requires a JWT private key, with which the attributes forwarded to the upstream are signed")
+	}
+	if conf.ProxyHeaderPrefix == "" {
+		conf.ProxyHeaderPrefix = "X-Irma-"
+	}
+	if len(conf.ProxyHeaders) == 0 {
+		_ = conf.ProxyDisclose.Iterate(func(attr *irma.AttributeRequest) error {
+			conf.ProxyHeaders = append(conf.ProxyHeaders, server.AttributeMappingRule{
+				Attribute: attr.Type,
+				Name:      strings.ReplaceAll(attr.Type.String(), ".", "-"),
+			})
+			return nil
+		})
+	}
+	if err := conf.ProxyHeaders.Validate(); err != nil {
+		return errors.WrapPrefix(err, "Invalid proxy_headers", 0)
+	}
+	if conf.ProxySessionLifetime <= 0 {
+		conf.ProxySessionLifetime = 60
+	}
+	return nil
 }
@@ -6,6 +6,7 @@ import (
 	"time"
 
 	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
 	"github.com/stretchr/testify/require"
 )
 
@@ -219,3 +220,158 @@ func TestCanVerifyOrSign(t *testing.T) {
 		}
 	}
 }
+
+func TestPermissionDenials(t *testing.T) {
+	confJSON := `{
+		"url": "https://irma.example.com",
+		"requestors": {
+			"myapp": {
+				"disclose_perms": [ "irma-demo.MijnOverheid.ageLower.over18" ],
+				"issue_perms": [ "irma-demo.MijnOverheid.ageLower" ],
+				"auth_method": "token",
+				"key": "eGE2PSomOT84amVVdTU"
+			},
+			"issuer": {
+				"issue_perms": [ "irma-demo.*" ],
+				"host_perms": [ "*.example.com" ],
+				"auth_method": "token",
+				"key": "eGE2PSomOT84amVVdTU"
+			}
+		}
+	}`
+	var conf Configuration
+	require.NoError(t, json.Unmarshal([]byte(confJSON), &conf))
+
+	request := irma.NewIssuanceRequest(
+		append(
+			createCredentialRequest("irma-demo.MijnOverheid.ageLower", nil),
+			createCredentialRequest("irma-demo.MijnOverheid.fullName", nil)...,
+		),
+		irma.NewAttributeTypeIdentifier("irma-demo.MijnOverheid.ageLower.over18"),
+		irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"),
+	)
+	request.Disclose = append(request.Disclose, createAttributesConDisCon("irma-demo.RU.studentCard.studentID")...)
+	request.Host = "other.example.com"
+
+	// All denials of the combined issuance and disclosure request are reported, each only once
+	require.Equal(t, []*irma.PermissionDenial{
+		{Identifier: "irma-demo.MijnOverheid.fullName", Permission: "issue_perms", Reason: irma.PermissionDenialNotPermitted},
+		{Identifier: "irma-demo.RU.studentCard.studentID", Permission: "disclose_perms", Reason: irma.PermissionDenialNotPermitted},
+		{Identifier: "other.example.com", Permission: "host_perms", Reason: irma.PermissionDenialNotPermitted},
+	}, conf.PermissionDenials("myapp", request))
+
+	request.Credentials = request.Credentials[:1]
+	require.Equal(t, []*irma.PermissionDenial{
+		{Identifier: "irma-demo.MijnOverheid.ageLower.over18", Permission: "disclose_perms", Reason: irma.PermissionDenialNoPermissions},
+		{Identifier: "irma-demo.RU.studentCard.studentID", Permission: "disclose_perms", Reason: irma.PermissionDenialNoPermissions},
+	}, conf.PermissionDenials("issuer", request))
+
+	request.Disclose = nil
+	require.Empty(t, conf.PermissionDenials("issuer", request))
+	allowed, message := conf.CanRequest("myapp", request)
+	require.False(t, allowed)
+	require.Equal(t, "not permitted to use other.example.com (host_perms: NOT_PERMITTED)", message)
+}
+
+func TestCollectEagerSchemes(t *testing.T) {
+	confJSON := `{
+		"lazy_schemes": true,
+		"disclose_perms": [ "pbdf.pbdf.email.email" ],
+		"requestors": {
+			"myapp": {
+				"disclose_perms": [ "irma-demo.MijnOverheid.ageLower.over18" ],
+				"issue_perms": [ "irma-demo.*" ],
+				"auth_method": "token",
+				"key": "eGE2PSomOT84amVVdTU"
+			}
+		}
+	}`
+
+	var conf Configuration
+	require.NoError(t, json.Unmarshal([]byte(confJSON), &conf))
+	conf.collectRequestorSettings()
+	require.True(t, conf.LazySchemes)
+	require.ElementsMatch(t, []irma.SchemeManagerIdentifier{
+		irma.NewSchemeManagerIdentifier("pbdf"),
+		irma.NewSchemeManagerIdentifier("irma-demo"),
+	}, conf.EagerSchemes)
+
+	// If all schemes may be used, all schemes are parsed at startup
+	conf.Permissions.Signing = []string{"*"}
+	conf.collectRequestorSettings()
+	require.False(t, conf.LazySchemes)
+}
+
+func TestRequestorResultSettings(t *testing.T) {
+	confJSON := `{
+		"requestors": {
+			"myapp": {
+				"auth_method": "token",
+				"key": "eGE2PSomOT84amVVdTU",
+				"callback_url": "https://example.com/irma/callback",
+				"jwt_validity": 600,
+				"jwt_kid": "myapp-2024"
+			},
+			"other": {
+				"auth_method": "token",
+				"key": "c2VjcmV0c2VjcmV0c2Vj"
+			}
+		}
+	}`
+	conf := Configuration{Configuration: &server.Configuration{}}
+	require.NoError(t, json.Unmarshal([]byte(confJSON), &conf))
+	conf.collectRequestorSettings()
+	require.Equal(t, map[string]string{"myapp": "myapp-2024"}, conf.JwtKeyIDs)
+
+	// Without a JWT private key, callbacks are unsigned
+	require.Error(t, conf.validateRequestorSettings())
+	conf.AllowUnsignedCallbacks = true
+	require.Error(t, conf.validateRequestorSettings()) // jwt_kid requires a JWT private key
+	myapp := conf.Requestors["myapp"]
+	myapp.JwtKeyID = ""
+	conf.Requestors["myapp"] = myapp
+	require.NoError(t, conf.validateRequestorSettings())
+	myapp.CallbackURL = "example.com/irma/callback"
+	conf.Requestors["myapp"] = myapp
+	require.Error(t, conf.validateRequestorSettings())
+	myapp.CallbackURL = "https://example.com/irma/callback"
+	conf.Requestors["myapp"] = myapp
+	conf.AirGapped = true
+	require.Error(t, conf.validateRequestorSettings()) // callbacks are refused in air-gapped mode
+	conf.AirGapped = false
+
+	newRequest := func() irma.RequestorRequest {
+		rrequest, err := server.ParseSessionRequest(irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")))
+		require.NoError(t, err)
+		return rrequest
+	}
+
+	// The defaults of the requestor apply if the request does not specify them
+	rrequest := newRequest()
+	conf.applyRequestorSettings("myapp", rrequest)
+	require.Equal(t, "https://example.com/irma/callback", rrequest.Base().CallbackURL)
+	require.Equal(t, 600, rrequest.Base().ResultJwtValidity)
+
+	// The request overrides the defaults of the requestor
+	rrequest = newRequest()
+	rrequest.Base().CallbackURL = "https://example.com/other"
+	rrequest.Base().ResultJwtValidity = 60
+	conf.applyRequestorSettings("myapp", rrequest)
+	require.Equal(t, "https://example.com/other", rrequest.Base().CallbackURL)
+	require.Equal(t, 60, rrequest.Base().ResultJwtValidity)
+
+	// Also if the request specifies the default validity
+	rrequest, err := server.ParseSessionRequest(&irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{ResultJwtValidity: irma.DefaultJwtValidity},
+		Request:              irma.NewDisclosureRequest(irma.NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID")),
+	})
+	require.NoError(t, err)
+	conf.applyRequestorSettings("myapp", rrequest)
+	require.Equal(t, irma.DefaultJwtValidity, rrequest.Base().ResultJwtValidity)
+
+	// Other requestors are not affected
+	rrequest = newRequest()
+	conf.applyRequestorSettings("other", rrequest)
+	require.Empty(t, rrequest.Base().CallbackURL)
+	require.Equal(t, irma.DefaultJwtValidity, rrequest.Base().ResultJwtValidity)
+}
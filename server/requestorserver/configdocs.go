@@ -0,0 +1,65 @@
+package requestorserver
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sync"
+
+	"github.com/privacybydesign/irmago/server"
+)
+
+// ConfigOption documents a configuration option of the IRMA server, as it can be specified as
+// flag, environment variable and key in the configuration file of irma server, and/or as field
+// of Configuration when using the IRMA server as a library.
+type ConfigOption struct {
+	// Key in the configuration file, e.g. schemes_path
+	Key string `json:"key"`
+	// Command line flag, e.g. --schemes-path (empty for options only available to the library)
+	Flag string `json:"flag,omitempty"`
+	// Environment variable, e.g. IRMASERVER_SCHEMES_PATH
+	EnvVar string `json:"env_var,omitempty"`
+	// Type of the flag, e.g. string, int or stringSlice
+	Type string `json:"type,omitempty"`
+	// Field of Configuration to which the option is written, e.g. server.Configuration.SchemesPath
+	Field string `json:"field,omitempty"`
+	// Go type of Field
+	GoType string `json:"go_type,omitempty"`
+	// Default value in development mode
+	Default string `json:"default,omitempty"`
+	// Default value in production mode, if it differs from Default
+	ProductionDefault *string `json:"production_default,omitempty"`
+	Section           string  `json:"section,omitempty"`
+	Description       string  `json:"description,omitempty"`
+}
+
+// configDocs is generated by irma server config docs from the flags of irma server and the
+// struct tags of Configuration. A test in irma/cmd fails if it is out of date.
+//
+//go:generate go run ../../irma server config docs --format json --output configdocs.json
+//go:embed configdocs.json
+var configDocs []byte
+
+var (
+	configOptions     []*ConfigOption
+	configOptionsErr  error
+	configOptionsOnce sync.Once
+)
+
+// ConfigDocs returns the documentation of all configuration options of the IRMA server.
+func ConfigDocs() ([]*ConfigOption, error) {
+	configOptionsOnce.Do(func() {
+		configOptionsErr = json.Unmarshal(configDocs, &configOptions)
+	})
+	return configOptions, configOptionsErr
+}
+
+// HandleConfigDocs writes the documentation of all configuration options as JSON.
+func HandleConfigDocs(w http.ResponseWriter, _ *http.Request) {
+	options, err := ConfigDocs()
+	if err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteJson(w, options)
+}
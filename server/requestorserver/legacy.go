@@ -0,0 +1,122 @@
+package requestorserver
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"path"
+
+	"github.com/go-chi/chi/v5"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/common"
+	"github.com/privacybydesign/irmago/server"
+)
+
+const legacyApiPrefix = "/api/v2"
+
+// legacyQr is the response of the irma_api_server to a new session request, containing only the
+// session token instead of a session URL, and the protocol versions of the session.
+type legacyQr struct {
+	URL                string      `json:"u"`
+	ProtocolVersion    string      `json:"v"`
+	ProtocolMaxVersion string      `json:"vmax"`
+	Type               irma.Action `json:"irmaqr"`
+}
+
+// Protocol versions included in legacyQr, being those supported by the IRMA server
+const (
+	legacyProtocolVersion    = "2.4"
+	legacyProtocolMaxVersion = "2.9"
+)
+
+// Paths of the irma_api_server endpoints per session type
+var legacyActions = map[string]irma.Action{
+	"verification": irma.ActionDisclosing,
+	"signature":    irma.ActionSigning,
+	"issue":        irma.ActionIssuing,
+}
+
+// attachLegacyEndpoints emulates the endpoints of the irma_api_server, at which sessions are
+// identified by their client token, used both by the requestor and by the IRMA app.
+func (s *Server) attachLegacyEndpoints(r chi.Router) {
+	r.Route(legacyApiPrefix+"/{action:verification|signature|issue}", func(r chi.Router) {
+		r.Post("/", s.handleLegacyCreateSession)
+		r.Route("/{clientToken}", func(r chi.Router) {
+			r.Group(func(r chi.Router) {
+				r.Use(s.legacyTokenMiddleware)
+				r.Get("/status", s.handleStatus)
+				r.Get("/statusevents", s.handleStatusEvents)
+				r.Get("/getproof", s.handleJwtProofs)
+				r.Get("/getsignature", s.handleJwtProofs)
+			})
+			// All other requests are meant for the IRMA app endpoints of the session
+			r.Handle("/*", http.HandlerFunc(s.handleLegacyClient))
+		})
+	})
+}
+
+func (s *Server) handleLegacyCreateSession(w http.ResponseWriter, r *http.Request) {
+	defer common.Close(r.Body)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	rrequest, requestor, ok := s.authenticateSession(w, r, r.Header, body)
+	if !ok {
+		return
+	}
+	action := legacyActions[chi.URLParam(r, "action")]
+	if rrequest.SessionRequest().Action() != action {
+		server.WriteError(w, server.ErrorInvalidRequest, "session request is not a "+string(action)+" request")
+		return
+	}
+
+	pkg, rerr := s.startSession(requestor, rrequest)
+	if rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+	clientToken, err := irma.ParseClientToken(path.Base(pkg.SessionPtr.URL))
+	if err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	// The irma_api_server returned only the session token in the session pointer,
+	// which integrations append to the URL of the session type endpoint
+	server.WriteJson(w, &legacyQr{
+		URL:                string(clientToken),
+		ProtocolVersion:    legacyProtocolVersion,
+		ProtocolMaxVersion: legacyProtocolMaxVersion,
+		Type:               action,
+	})
+}
+
+// legacyTokenMiddleware looks up the requestor token of the session identified in the path by
+// its client token, so that the handlers of the requestor endpoints can be used.
+func (s *Server) legacyTokenMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		clientToken, err := irma.ParseClientToken(chi.URLParam(r, "clientToken"))
+		if err != nil {
+			server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+			return
+		}
+		requestorToken, err := s.irmaserv.GetRequestorToken(clientToken)
+		if err != nil {
+			mapToServerError(w, err)
+			return
+		}
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), "requestorToken", requestorToken)))
+	})
+}
+
+// handleLegacyClient forwards the request to the IRMA app endpoints of the session.
+func (s *Server) handleLegacyClient(w http.ResponseWriter, r *http.Request) {
+	// Route the request afresh within the IRMA app handler
+	forwarded := r.Clone(context.WithValue(r.Context(), chi.RouteCtxKey, chi.NewRouteContext()))
+	forwarded.URL.Path = "/session/" + chi.URLParam(r, "clientToken") + "/" + chi.URLParam(r, "*")
+	forwarded.URL.RawPath = ""
+	s.irmaserv.HandlerFunc()(w, forwarded)
+}
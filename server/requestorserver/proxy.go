@@ -0,0 +1,293 @@
+package requestorserver
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"html/template"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-errors/errors"
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/notify"
+	"github.com/sirupsen/logrus"
+	"rsc.io/qr"
+)
+
+// In reverse proxy mode, the endpoints of the proxy itself are hosted under this path,
+// all other paths are forwarded to the upstream.
+const proxyPrefix = "/.irma-proxy/"
+
+const (
+	proxySessionCookie = "irma-proxy-session"
+	proxyAuthCookie    = "irma-proxy-auth"
+	proxyJwtSubject    = "proxy_auth"
+)
+
+// proxyClaims are the contents of the JWT that the proxy stores in a cookie after the user
+// disclosed the required attributes, and which it forwards to the upstream.
+type proxyClaims struct {
+	jwt.StandardClaims
+	Attributes map[string]string `json:"attributes"`
+}
+
+var proxyPage = template.Must(template.New("proxy").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta name="viewport" content="width=device-width, initial-scale=1">
+<title>Log in with IRMA</title>
+</head>
+<body style="font-family: sans-serif; text-align: center">
+<h1>Log in with IRMA</h1>
+<p>Scan the QR code below with your IRMA app, or <a href="{{.Link}}">open the IRMA app</a> on this device.</p>
+<img src="data:image/png;base64,{{.QR}}" alt="IRMA QR code" width="300" height="300">
+<p id="pairing" hidden>Enter the pairing code <strong>{{.PairingCode}}</strong> in your IRMA app.</p>
+<p id="status"></p>
+<script>
+(function poll() {
+  fetch("status", {credentials: "same-origin"}).then(function (r) { return r.json(); }).then(function (s) {
+    if (s.status === "DONE") {
+      window.location.replace({{.Return}});
+    } else if (s.status === "PAIRING") {
+      document.getElementById("pairing").hidden = false;
+      setTimeout(poll, 1000);
+    } else if (s.status === "CANCELLED" || s.status === "TIMEOUT") {
+      document.getElementById("status").innerHTML = 'Session ended. <a href="">Try again</a>';
+    } else {
+      setTimeout(poll, 1000);
+    }
+  }).catch(function () { setTimeout(poll, 1000); });
+})();
+</script>
+</body>
+</html>
+`))
+
+// ProxyHandler returns a http.Handler that, in reverse proxy mode, forwards requests to the
+// upstream after the user has disclosed the configured attributes.
+func (s *Server) ProxyHandler() http.Handler {
+	upstream, _ := url.Parse(s.conf.ProxyUpstream) // already validated in initialize()
+	proxy := httputil.NewSingleHostReverseProxy(upstream)
+
+	mux := http.NewServeMux()
+	mux.HandleFunc(proxyPrefix+"start", s.handleProxyStart)
+	mux.HandleFunc(proxyPrefix+"status", s.handleProxyStatus)
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Never let clients supply headers that the upstream trusts to originate from us
+		for name := range r.Header {
+			if strings.HasPrefix(http.CanonicalHeaderKey(name), http.CanonicalHeaderKey(s.conf.ProxyHeaderPrefix)) {
+				r.Header.Del(name)
+			}
+		}
+
+		claims, jwtstr, err := s.proxyAuthentication(r)
+		if err != nil {
+			if r.Method != http.MethodGet {
+				server.WriteError(w, server.ErrorUnauthorized, "not authenticated")
+				return
+			}
+			http.Redirect(w, r, proxyPrefix+"start?return="+url.QueryEscape(r.URL.RequestURI()), http.StatusFound)
+			return
+		}
+
+		for name, value := range claims.Attributes {
+			r.Header.Set(s.conf.ProxyHeaderPrefix+name, value)
+		}
+		r.Header.Set(s.conf.ProxyHeaderPrefix+"Jwt", jwtstr)
+		proxy.ServeHTTP(w, r)
+	}))
+
+	log := server.LogOptions{Response: false, Headers: false, From: true, ClientIP: s.conf.ClientIP}
+	return server.LogMiddleware("proxy", log)(mux)
+}
+
+func (s *Server) startProxyServer() error {
+	tlsConf, _ := s.conf.tlsConfig()
+	return s.startServer(s.ProxyHandler(), "Proxy server", s.conf.ProxyListenAddress, s.conf.ProxyPort, tlsConf)
+}
+
+// proxyAuthentication returns the claims of the valid authentication cookie of the request, if present.
+func (s *Server) proxyAuthentication(r *http.Request) (*proxyClaims, string, error) {
+	cookie, err := r.Cookie(proxyAuthCookie)
+	if err != nil {
+		return nil, "", err
+	}
+	claims := &proxyClaims{}
+	_, err = jwt.ParseWithClaims(cookie.Value, claims, func(token *jwt.Token) (interface{}, error) {
+		if _, ok := token.Method.(*jwt.SigningMethodRSA); !ok {
+			return nil, errors.Errorf("unexpected signing method %v", token.Header["alg"])
+		}
+		return s.conf.JwtPublicKey(), nil
+	})
+	if err != nil {
+		return nil, "", err
+	}
+	if claims.Subject != proxyJwtSubject {
+		return nil, "", errors.New("JWT has unexpected subject")
+	}
+	return claims, cookie.Value, nil
+}
+
+// proxyReturnPath returns the path on the upstream to which the user is sent after authenticating,
+// if ret is a path on the same host outside of the proxy endpoints; otherwise it returns "/".
+// Browsers treat backslashes as slashes and ignore some control characters, so that a path
+// containing these might still point to another host.
+func proxyReturnPath(ret string) string {
+	u, err := url.Parse(ret)
+	if err != nil || u.Scheme != "" || u.Host != "" || !strings.HasPrefix(ret, "/") ||
+		strings.HasPrefix(u.Path, "//") || strings.HasPrefix(u.Path, proxyPrefix) ||
+		!safeReturnPath(ret) || !safeReturnPath(u.Path) {
+		return "/"
+	}
+	return ret
+}
+
+func safeReturnPath(path string) bool {
+	for _, c := range path {
+		if c == '\\' || unicode.IsControl(c) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *Server) handleProxyStart(w http.ResponseWriter, r *http.Request) {
+	ret := proxyReturnPath(r.URL.Query().Get("return"))
+
+	request := &irma.ServiceProviderRequest{
+		RequestorBaseRequest: irma.RequestorBaseRequest{RequirePairing: !s.conf.ProxyNoPairing},
+		Request:              irma.NewDisclosureRequest(),
+	}
+	request.Request.Disclose = s.conf.ProxyDisclose
+	qrptr, token, _, err := s.irmaserv.StartSession(request, nil)
+	if err != nil {
+		_ = server.LogError(err)
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	options, err := s.irmaserv.SetFrontendOptions(token, &irma.FrontendOptionsRequest{})
+	if err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	qrjson, err := json.Marshal(qrptr)
+	if err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	code, err := qr.Encode(string(qrjson), qr.M)
+	if err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	link, err := notify.UniversalLink(notify.DefaultUniversalLinkBase, qrptr)
+	if err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+
+	http.SetCookie(w, &http.Cookie{
+		Name:     proxySessionCookie,
+		Value:    string(token),
+		Path:     proxyPrefix,
+		HttpOnly: true,
+		Secure:   s.conf.RequestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	err = proxyPage.Execute(w, map[string]interface{}{
+		"QR":          base64.StdEncoding.EncodeToString(code.PNG()),
+		"Link":        template.URL(link),
+		"PairingCode": options.PairingCode,
+		"Return":      ret,
+	})
+	if err != nil {
+		_ = server.LogWarning(errors.WrapPrefix(err, "failed to write proxy page", 0))
+	}
+}
+
+func (s *Server) handleProxyStatus(w http.ResponseWriter, r *http.Request) {
+	cookie, err := r.Cookie(proxySessionCookie)
+	if err != nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	token, err := irma.ParseRequestorToken(cookie.Value)
+	if err != nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	result, err := s.irmaserv.GetSessionResult(token)
+	if err != nil || result == nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+
+	status := result.Status
+	if status == irma.ServerStatusPairing {
+		// The page shows the pairing code once it sees this status, after which the IRMA app may
+		// continue the session (like irma-frontend does)
+		if err = s.irmaserv.PairingCompleted(token); err != nil {
+			_ = server.LogWarning(err)
+		}
+	}
+	if status == irma.ServerStatusDone {
+		if result.ProofStatus != irma.ProofStatusValid {
+			status = irma.ServerStatusCancelled
+		} else if err = s.setProxyAuthCookie(w, r, result); err != nil {
+			_ = server.LogError(err)
+			server.WriteError(w, server.ErrorInternal, err.Error())
+			return
+		}
+	}
+	if status.Finished() {
+		http.SetCookie(w, &http.Cookie{Name: proxySessionCookie, Path: proxyPrefix, MaxAge: -1})
+	}
+	server.WriteJson(w, struct {
+		Status irma.ServerStatus `json:"status"`
+	}{status})
+}
+
+func (s *Server) setProxyAuthCookie(w http.ResponseWriter, r *http.Request, result *server.SessionResult) error {
+	attrs, err := s.conf.ProxyHeaders.Apply(result.Disclosed)
+	if err != nil {
+		return err
+	}
+
+	now := s.conf.Now()
+	lifetime := time.Duration(s.conf.ProxySessionLifetime) * time.Minute
+	claims := &proxyClaims{
+		StandardClaims: jwt.StandardClaims{
+			Issuer:    s.conf.JwtIssuer,
+			IssuedAt:  now.Unix(),
+			ExpiresAt: now.Add(lifetime).Unix(),
+			Subject:   proxyJwtSubject,
+		},
+		Attributes: attrs,
+	}
+	jwtstr, err := irma.SignJwt(claims, s.conf.JwtSigningKey())
+	if err != nil {
+		return errors.WrapPrefix(err, "failed to sign proxy authentication JWT", 0)
+	}
+
+	s.conf.Logger.WithFields(logrus.Fields{"session": result.Token}).Info("Proxy authentication succeeded")
+	http.SetCookie(w, &http.Cookie{
+		Name:     proxyAuthCookie,
+		Value:    jwtstr,
+		Path:     "/",
+		MaxAge:   int(lifetime.Seconds()),
+		HttpOnly: true,
+		Secure:   s.conf.RequestScheme(r) == "https",
+		SameSite: http.SameSiteLaxMode,
+	})
+	return nil
+}
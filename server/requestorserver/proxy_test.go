@@ -0,0 +1,145 @@
+package requestorserver
+
+import (
+	"crypto/rand"
+	"crypto/rsa"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v4"
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestProxyHandler(t *testing.T) {
+	var forwarded http.Header
+	upstream := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		forwarded = r.Header.Clone()
+	}))
+	defer upstream.Close()
+
+	sk, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	s := &Server{conf: &Configuration{
+		Configuration:        &server.Configuration{JwtRSAPrivateKey: sk, Logger: server.Logger},
+		ProxyUpstream:        upstream.URL,
+		ProxyHeaderPrefix:    "X-Irma-",
+		ProxySessionLifetime: 60,
+	}}
+	handler := s.ProxyHandler()
+
+	signed := func(t *testing.T, subject string, key *rsa.PrivateKey) string {
+		claims := &proxyClaims{
+			StandardClaims: jwt.StandardClaims{Subject: subject, ExpiresAt: time.Now().Add(time.Hour).Unix()},
+			Attributes:     map[string]string{"irma-demo-MijnOverheid-fullName-firstname": "Alice"},
+		}
+		jwtstr, err := jwt.NewWithClaims(jwt.SigningMethodRS256, claims).SignedString(key)
+		require.NoError(t, err)
+		return jwtstr
+	}
+
+	t.Run("unauthenticated GET is redirected", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/page?x=1", nil))
+		require.Equal(t, http.StatusFound, rec.Code)
+		require.Equal(t, proxyPrefix+"start?return=%2Fpage%3Fx%3D1", rec.Header().Get("Location"))
+	})
+
+	t.Run("unauthenticated POST is rejected", func(t *testing.T) {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/page", nil))
+		require.Equal(t, http.StatusForbidden, rec.Code)
+	})
+
+	t.Run("JWT signed by other key is rejected", func(t *testing.T) {
+		other, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.AddCookie(&http.Cookie{Name: proxyAuthCookie, Value: signed(t, proxyJwtSubject, other)})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusFound, rec.Code)
+	})
+
+	t.Run("JWT with other subject is rejected", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.AddCookie(&http.Cookie{Name: proxyAuthCookie, Value: signed(t, "disclosing_result", sk)})
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusFound, rec.Code)
+	})
+
+	t.Run("authenticated request is forwarded", func(t *testing.T) {
+		jwtstr := signed(t, proxyJwtSubject, sk)
+		req := httptest.NewRequest(http.MethodGet, "/page", nil)
+		req.AddCookie(&http.Cookie{Name: proxyAuthCookie, Value: jwtstr})
+		req.Header.Set("X-Irma-Spoofed", "value")
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		require.Equal(t, http.StatusOK, rec.Code)
+
+		require.Equal(t, "Alice", forwarded.Get("X-Irma-irma-demo-MijnOverheid-fullName-firstname"))
+		require.Equal(t, jwtstr, forwarded.Get("X-Irma-Jwt"))
+		require.Empty(t, forwarded.Get("X-Irma-Spoofed"))
+	})
+}
+
+func TestProxyReturnPath(t *testing.T) {
+	for ret, expected := range map[string]string{
+		"/page?x=1":               "/page?x=1",
+		"/a/b#c":                  "/a/b#c",
+		"":                        "/",
+		"page":                    "/",
+		"https://evil.com":        "/",
+		"//evil.com":              "/",
+		"/\\evil.com":             "/",
+		"/%5Cevil.com":            "/",
+		"/%5cevil.com":            "/",
+		"/\tevil.com":             "/",
+		"/%09/evil.com":           "/",
+		"/%2F/evil.com":           "/",
+		proxyPrefix + "start":     "/",
+		proxyPrefix + "status?x=": "/",
+	} {
+		require.Equal(t, expected, proxyReturnPath(ret), ret)
+	}
+}
+
+func TestProxyStart(t *testing.T) {
+	conf := &Configuration{
+		Configuration: &server.Configuration{
+			Logger:               server.Logger,
+			SchemesPath:          filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+			DisableSchemesUpdate: true,
+		},
+		ProxyUpstream: "http://localhost",
+		ProxyDisclose: irma.AttributeConDisCon{{{irma.NewAttributeRequest("irma-demo.MijnOverheid.fullName.firstname")}}},
+	}
+	irmaserv, err := irmaserver.New(conf.Configuration)
+	require.NoError(t, err)
+	defer irmaserv.Stop()
+	s := &Server{conf: conf, irmaserv: irmaserv}
+	handler := s.ProxyHandler()
+
+	for _, ret := range []string{"/\\evil.com", "/%5Cevil.com"} {
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, proxyPrefix+"start?return="+url.QueryEscape(ret), nil))
+		require.Equal(t, http.StatusOK, rec.Code)
+		require.NotContains(t, rec.Body.String(), "evil.com")
+
+		// Pairing is required by default
+		cookies := rec.Result().Cookies()
+		require.Len(t, cookies, 1)
+		options, err := irmaserv.SetFrontendOptions(irma.RequestorToken(cookies[0].Value), &irma.FrontendOptionsRequest{})
+		require.NoError(t, err)
+		require.EqualValues(t, irma.PairingMethodPin, options.PairingMethod)
+		require.Contains(t, rec.Body.String(), "<strong>"+options.PairingCode+"</strong>")
+	}
+}
@@ -6,30 +6,42 @@ package requestorserver
 
 import (
 	"context"
+	"crypto/subtle"
 	"crypto/tls"
 	"crypto/x509"
 	"encoding/json"
 	"encoding/pem"
-	"fmt"
 	"io"
 	"net/http"
+	"net/http/pprof"
 	"regexp"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/cors"
+	"github.com/go-errors/errors"
 	"github.com/golang-jwt/jwt/v4"
 	irma "github.com/privacybydesign/irmago"
 	"github.com/privacybydesign/irmago/internal/common"
 	"github.com/privacybydesign/irmago/server"
 	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/privacybydesign/irmago/server/notify"
 	"github.com/sirupsen/logrus"
 )
 
+// Default and maximum number of sessions returned when listing the open sessions of a requestor
+const (
+	defaultSessionListLimit = 100
+	maxSessionListLimit     = 1000
+)
+
 // Server is a requestor server instance.
 type Server struct {
 	conf     *Configuration
 	irmaserv *irmaserver.Server
+	notifier *notify.Notifier
 	stop     chan struct{}
 	stopped  chan struct{}
 }
@@ -43,18 +55,15 @@ func (s *Server) Start(config *Configuration) error {
 		s.conf.Logger.Debug("Configuration: ", string(bts), "\n")
 	}
 
-	// We start either one or two servers, depending on whether a separate client server is enabled, such that:
-	// - if any of them returns, the other is also stopped (neither of them is of use without the other)
+	// We start one or more servers, depending on whether separate client, frontend and proxy servers are enabled, such that:
+	// - if any of them returns, the others are also stopped (none of them is of use without the others)
 	// - if any of them returns an unexpected error (ie. other than http.ErrServerClosed), the error is logged and returned
 	// - we have a way of stopping all servers from outside (with Stop())
 	// - the function returns only after all servers have been stopped
 	// - any unexpected error is dealt with here instead of when stopping using Stop().
 	// Inspired by https://dave.cheney.net/practical-go/presentations/qcon-china.html#_never_start_a_goroutine_without_when_it_will_stop
 
-	count := 1
-	if s.conf.separateClientServer() {
-		count = 2
-	}
+	count := s.serverCount()
 	done := make(chan error, count)
 	s.stop = make(chan struct{})
 	s.stopped = make(chan struct{}, count)
@@ -64,6 +73,21 @@ func (s *Server) Start(config *Configuration) error {
 			done <- s.startClientServer()
 		}()
 	}
+	if s.conf.separateFrontendServer() {
+		go func() {
+			done <- s.startFrontendServer()
+		}()
+	}
+	if s.conf.proxyServer() {
+		go func() {
+			done <- s.startProxyServer()
+		}()
+	}
+	if s.conf.pprofServer() {
+		go func() {
+			done <- s.startPprofServer()
+		}()
+	}
 	go func() {
 		done <- s.startRequestorServer()
 	}()
@@ -93,12 +117,19 @@ func (s *Server) startClientServer() error {
 	return s.startServer(s.ClientHandler(), "Client server", s.conf.ClientListenAddress, s.conf.ClientPort, tlsConf)
 }
 
-func (s *Server) startServer(handler http.Handler, name, addr string, port int, tlsConf *tls.Config) error {
-	fulladdr := fmt.Sprintf("%s:%d", addr, port)
-	s.conf.Logger.Info(name, " listening at ", fulladdr, s.conf.ApiPrefix)
+func (s *Server) startFrontendServer() error {
+	tlsConf, _ := s.conf.frontendTlsConfig()
+	return s.startServer(s.FrontendHandler(), "Frontend server", s.conf.FrontendListenAddress, s.conf.FrontendPort, tlsConf)
+}
+
+// startPprofServer serves the profiles of net/http/pprof, which are only to be reached from the
+// host itself and therefore served on the loopback interface.
+func (s *Server) startPprofServer() error {
+	return s.startServer(s.PprofHandler(), "Pprof server", "127.0.0.1", s.conf.PprofPort, nil)
+}
 
+func (s *Server) startServer(handler http.Handler, name, addr string, port int, tlsConf *tls.Config) error {
 	serv := &http.Server{
-		Addr:      fulladdr,
 		Handler:   handler,
 		TLSConfig: tlsConf,
 		// See https://blog.cloudflare.com/the-complete-guide-to-golang-net-http-timeouts/
@@ -116,24 +147,48 @@ func (s *Server) startServer(handler http.Handler, name, addr string, port int,
 		s.stopped <- struct{}{}
 	}()
 
+	listener, err := server.Listen(addr, port)
+	if err != nil {
+		return err
+	}
+	s.conf.Logger.Info(name, " listening at ", server.FullListenAddress(addr, port), s.conf.ApiPrefix)
+
 	if tlsConf != nil {
 		s.conf.Logger.Info(name, " TLS enabled")
-		return server.FilterStopError(serv.ListenAndServeTLS("", ""))
+		return server.FilterStopError(serv.ServeTLS(listener, "", ""))
 	} else {
-		return server.FilterStopError(serv.ListenAndServe())
+		return server.FilterStopError(serv.Serve(listener))
 	}
 }
 
 func (s *Server) Stop() {
 	s.irmaserv.Stop()
 	s.stop <- struct{}{}
-	<-s.stopped
-	if s.conf.separateClientServer() {
+	for i := 0; i < s.serverCount(); i++ {
 		<-s.stopped
 	}
 }
 
+// serverCount returns the number of HTTP servers that Start() starts.
+func (s *Server) serverCount() int {
+	count := 1
+	if s.conf.separateClientServer() {
+		count++
+	}
+	if s.conf.separateFrontendServer() {
+		count++
+	}
+	if s.conf.proxyServer() {
+		count++
+	}
+	if s.conf.pprofServer() {
+		count++
+	}
+	return count
+}
+
 func New(config *Configuration) (*Server, error) {
+	config.collectRequestorSettings()
 	irmaserv, err := irmaserver.New(config.Configuration)
 	if err != nil {
 		return nil, err
@@ -141,9 +196,19 @@ func New(config *Configuration) (*Server, error) {
 	if err := config.initialize(); err != nil {
 		return nil, err
 	}
+	var notifier *notify.Notifier
+	if config.Notifications != nil {
+		if config.Notifications.HTTPClient == nil {
+			config.Notifications.HTTPClient = config.HTTPClient()
+		}
+		if notifier, err = notify.New(config.Notifications); err != nil {
+			return nil, err
+		}
+	}
 	return &Server{
 		conf:     config,
 		irmaserv: irmaserv,
+		notifier: notifier,
 	}, nil
 }
 
@@ -166,8 +231,41 @@ func (s *Server) ClientHandler() http.Handler {
 	return s.prefixRouter(router)
 }
 
+// FrontendHandler returns a http.Handler that handles the frontend endpoints, for when these are
+// served by a separate server.
+func (s *Server) FrontendHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Use(cors.New(corsOptions).Handler)
+	router.Mount("/irma/", s.irmaserv.FrontendHandlerFunc())
+	router.Get(irma.PublicConfigurationPath, s.irmaserv.PublicConfigurationHandlerFunc())
+	router.Head(irma.PublicConfigurationPath, s.irmaserv.PublicConfigurationHandlerFunc())
+	return s.prefixRouter(router)
+}
+
+// PprofHandler returns a http.Handler that serves the profiles of net/http/pprof (except the
+// command line of the server, which may contain secrets) to requests bearing the StatsToken.
+// Profiles are served without timeout, as CPU profiles and traces take 30 seconds by default.
+func (s *Server) PprofHandler() http.Handler {
+	router := chi.NewRouter()
+	router.Use(server.RecoverMiddleware)
+	router.Use(server.LogMiddleware("pprof", server.LogOptions{From: true}))
+	router.Use(s.statsAuthMiddleware)
+	router.Route("/debug/pprof", func(r chi.Router) {
+		r.Get("/", pprof.Index)
+		r.Get("/profile", pprof.Profile)
+		r.Get("/symbol", pprof.Symbol)
+		r.Get("/trace", pprof.Trace)
+		r.Get("/{profile}", func(w http.ResponseWriter, r *http.Request) {
+			pprof.Handler(chi.URLParam(r, "profile")).ServeHTTP(w, r)
+		})
+	})
+	return router
+}
+
 func (s *Server) attachClientEndpoints(router *chi.Mux) {
 	router.Mount("/irma/", s.irmaserv.HandlerFunc())
+	router.Get(irma.PublicConfigurationPath, s.irmaserv.PublicConfigurationHandlerFunc())
+	router.Head(irma.PublicConfigurationPath, s.irmaserv.PublicConfigurationHandlerFunc())
 	if s.conf.StaticPath != "" {
 		router.Mount(s.conf.StaticPrefix, s.StaticFilesHandler())
 	}
@@ -177,6 +275,7 @@ func (s *Server) attachClientEndpoints(router *chi.Mux) {
 // and IRMA client messages.
 func (s *Server) Handler() http.Handler {
 	router := chi.NewRouter()
+	router.Use(server.RequestIDMiddleware)
 	router.Use(server.RecoverMiddleware)
 	router.Use(cors.New(corsOptions).Handler)
 
@@ -185,7 +284,7 @@ func (s *Server) Handler() http.Handler {
 		s.attachClientEndpoints(router)
 	}
 
-	log := server.LogOptions{Response: true, Headers: true, From: true}
+	log := server.LogOptions{Response: true, Headers: true, From: true, ClientIP: s.conf.ClientIP}
 	router.NotFound(server.LogMiddleware("requestor", log)(router.NotFoundHandler()).ServeHTTP)
 	router.MethodNotAllowed(server.LogMiddleware("requestor", log)(router.MethodNotAllowedHandler()).ServeHTTP)
 
@@ -194,17 +293,23 @@ func (s *Server) Handler() http.Handler {
 
 	router.Group(func(r chi.Router) {
 		r.Use(server.SizeLimitMiddleware)
-		r.Use(server.TimeoutMiddleware([]string{"/statusevents"}, server.WriteTimeout))
+		r.Use(server.TimeoutMiddleware([]string{"/statusevents", "/bulk"}, server.WriteTimeout))
 		r.Use(cors.New(corsOptions).Handler)
 		r.Use(server.LogMiddleware("requestor", log))
 
 		router.Get("/health", func(w http.ResponseWriter, r *http.Request) {
 			server.WriteString(w, "OK")
 		})
+		r.Get("/errors", server.HandleErrorCatalog)
+		r.Get("/docs/config", HandleConfigDocs)
 
 		// Server routes
 		r.Route("/session", func(r chi.Router) {
 			r.Post("/", s.handleCreateSession)
+			r.Get("/", s.handleListSessions)
+			r.Get("/callbacks", s.handleListCallbacks)
+			r.Post("/bulk", s.handleCreateBulkSession)
+			r.Post("/preflight", s.handlePreflight)
 			r.Route("/{requestorToken}", func(r chi.Router) {
 				r.Use(s.tokenMiddleware)
 				r.Delete("/", s.handleDelete)
@@ -214,10 +319,22 @@ func (s *Server) Handler() http.Handler {
 				// Routes for getting signed JWTs containing the session result. Only work if configuration has a private key
 				r.Get("/result-jwt", s.handleJwtResult)
 				r.Get("/getproof", s.handleJwtProofs) // irma_api_server-compatible JWT
+				r.Post("/callback", s.handleRedeliverCallback)
 			})
 		})
 
 		r.Get("/publickey", s.handlePublicKey)
+
+		if s.conf.StatsToken != "" {
+			r.Route("/stats", func(r chi.Router) {
+				r.Use(s.statsAuthMiddleware)
+				r.Get("/", s.handleStats)
+				r.Get("/metrics", s.handleStatsMetrics)
+				if s.conf.SchemesLogPath != "" {
+					r.Get("/schemes/log", s.handleStatsSchemeLog)
+				}
+			})
+		}
 	})
 
 	router.Group(func(r chi.Router) {
@@ -228,6 +345,24 @@ func (s *Server) Handler() http.Handler {
 		r.Post("/revocation", s.handleRevocation)
 	})
 
+	if s.conf.SessionHistory {
+		router.Group(func(r chi.Router) {
+			r.Use(server.TimeoutMiddleware(nil, server.WriteTimeout))
+			r.Use(server.LogMiddleware("debug", log))
+			r.Use(s.statsAuthMiddleware)
+			r.Get("/debug/sessions/{requestorToken}/history", s.handleSessionHistory)
+		})
+	}
+
+	if s.conf.LegacyApi {
+		router.Group(func(r chi.Router) {
+			r.Use(server.SizeLimitMiddleware)
+			r.Use(server.TimeoutMiddleware([]string{"/statusevents"}, server.WriteTimeout))
+			r.Use(server.LogMiddleware("legacy", log))
+			s.attachLegacyEndpoints(r)
+		})
+	}
+
 	return s.prefixRouter(router)
 }
 
@@ -254,9 +389,49 @@ func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Authenticate request: check if the requestor is known and allowed to submit requests.
-	// We do this by feeding the HTTP POST details to all known authenticators, and see if
-	// one of them is applicable and able to authenticate the request.
+	rrequest, requestor, ok := s.authenticateSession(w, r, r.Header, body)
+	if !ok {
+		return
+	}
+
+	s.createSession(w, requestor, rrequest)
+}
+
+func (s *Server) handlePreflight(w http.ResponseWriter, r *http.Request) {
+	defer common.Close(r.Body)
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	rrequest, requestor, ok := s.authenticateSession(w, r, r.Header, body)
+	if !ok {
+		return
+	}
+	request, ok := rrequest.SessionRequest().(*irma.IssuanceRequest)
+	if !ok {
+		server.WriteError(w, server.ErrorInvalidRequest, "preflight is only supported for issuance requests")
+		return
+	}
+
+	report := server.NewPreflightReport()
+	var authErr error
+	if allowed, reason := s.conf.CanRequest(requestor, request); !allowed {
+		authErr = errors.Errorf("requestor %s not authorized for this request: %s", requestor, reason)
+	}
+	report.Add(server.PreflightCheckAuthorization, nil, authErr)
+	s.irmaserv.PreflightIssuanceRequest(request, report)
+
+	s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "valid": report.Valid}).Info("Issuance request preflight performed")
+	server.WriteJson(w, report)
+}
+
+// authenticateSession checks if the requestor of the session request is known and allowed to
+// submit requests. We do this by feeding the HTTP POST details to all known authenticators, and
+// see if one of them is applicable and able to authenticate the request. If not, an error is
+// written to w and false is returned.
+func (s *Server) authenticateSession(w http.ResponseWriter, r *http.Request, headers http.Header, body []byte,
+) (irma.RequestorRequest, string, bool) {
 	var (
 		rrequest  irma.RequestorRequest
 		requestor string
@@ -264,16 +439,15 @@ func (s *Server) handleCreateSession(w http.ResponseWriter, r *http.Request) {
 		applies   bool
 	)
 	for _, authenticator := range authenticators { // rrequest abbreviates "requestor request"
-		applies, rrequest, requestor, rerr = authenticator.AuthenticateSession(r.Header, body)
+		applies, rrequest, requestor, rerr = authenticator.AuthenticateSession(headers, body)
 		if applies || rerr != nil {
 			break
 		}
 	}
 	if ok := s.checkAuth(w, r, rerr, applies, body); !ok {
-		return
+		return nil, "", false
 	}
-
-	s.createSession(w, requestor, rrequest)
+	return rrequest, requestor, true
 }
 
 func (s *Server) tokenMiddleware(next http.Handler) http.Handler {
@@ -314,7 +488,105 @@ func (s *Server) handleRevocation(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	s.revoke(w, requestor, revreq)
+	s.revoke(w, r, requestor, revreq)
+}
+
+// handleListSessions lists the open sessions of the requestor, so that a requestor that lost track
+// of its sessions (e.g. after a restart) can reconcile them.
+func (s *Server) handleListSessions(w http.ResponseWriter, r *http.Request) {
+	requestor, ok := s.authenticateRequestor(w, r)
+	if !ok {
+		return
+	}
+
+	query := r.URL.Query()
+	status := irma.ServerStatus(strings.ToUpper(query.Get("status")))
+	offset, limit := 0, defaultSessionListLimit
+	var err error
+	if query.Get("offset") != "" {
+		if offset, err = strconv.Atoi(query.Get("offset")); err != nil || offset < 0 {
+			server.WriteError(w, server.ErrorInvalidRequest, "invalid offset")
+			return
+		}
+	}
+	if query.Get("limit") != "" {
+		if limit, err = strconv.Atoi(query.Get("limit")); err != nil || limit <= 0 || limit > maxSessionListLimit {
+			server.WriteError(w, server.ErrorInvalidRequest, "invalid limit")
+			return
+		}
+	}
+
+	list, err := s.irmaserv.OpenSessions(requestor, status, offset, limit)
+	if err != nil {
+		s.conf.Logger.WithError(err).Error("Failed to list open sessions")
+		server.WriteError(w, server.ErrorInternal, "")
+		return
+	}
+	server.WriteJson(w, list)
+}
+
+// handleListCallbacks lists the session results of the requestor whose callback failed and
+// that are kept in the callback outbox for redelivery.
+func (s *Server) handleListCallbacks(w http.ResponseWriter, r *http.Request) {
+	requestor, ok := s.authenticateRequestor(w, r)
+	if !ok {
+		return
+	}
+	callbacks, err := s.irmaserv.UndeliveredCallbacks(requestor)
+	if err != nil {
+		s.conf.Logger.WithError(err).Error("Failed to list undelivered callbacks")
+		server.WriteError(w, server.ErrorInternal, "")
+		return
+	}
+	server.WriteJson(w, callbacks)
+}
+
+// authenticateRequestor authenticates requests without body using the Authorization header,
+// returning the name of the requestor. If this fails, an error is written to w and false is returned.
+// As the requestor cannot be authenticated if requestor authentication is disabled, this always
+// fails in that case, so that the sessions of all requestors cannot be listed by anyone.
+func (s *Server) authenticateRequestor(w http.ResponseWriter, r *http.Request) (string, bool) {
+	if s.conf.DisableRequestorAuthentication {
+		server.WriteError(w, server.ErrorUnsupported, "requires requestor authentication, which is disabled")
+		return "", false
+	}
+	var (
+		requestor string
+		rerr      *irma.RemoteError
+		applies   bool
+	)
+	for _, authenticator := range authenticators {
+		applies, requestor, rerr = authenticator.AuthenticateRequestor(r.Header)
+		if applies || rerr != nil {
+			break
+		}
+	}
+	if rerr != nil {
+		_ = server.LogError(rerr)
+		server.WriteResponse(w, nil, rerr)
+		return "", false
+	}
+	if !applies {
+		server.WriteError(w, server.ErrorUnauthorized, "request could not be authenticated")
+		return "", false
+	}
+	return requestor, true
+}
+
+func (s *Server) handleRedeliverCallback(w http.ResponseWriter, r *http.Request) {
+	requestorToken := r.Context().Value("requestorToken").(irma.RequestorToken)
+	err := s.irmaserv.RedeliverCallback(requestorToken)
+	if _, ok := err.(*irmaserver.UnknownSessionError); ok {
+		server.WriteError(w, server.ErrorSessionUnknown, "session result not in callback outbox")
+		return
+	} else if _, ok := err.(*irmaserver.RedisError); ok {
+		server.WriteError(w, server.ErrorInternal, "")
+		return
+	} else if err != nil {
+		server.WriteError(w, server.ErrorCallbackFailed, err.Error())
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
 }
 
 func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
@@ -342,6 +614,7 @@ func (s *Server) handleStatusEvents(w http.ResponseWriter, r *http.Request) {
 			Status:      server.ErrorUnsupported.Status,
 			ErrorName:   string(server.ErrorUnsupported.Type),
 			Description: server.ErrorUnsupported.Description,
+			Code:        server.ErrorUnsupported.Code,
 		})
 	}
 }
@@ -372,7 +645,7 @@ func (s *Server) handleResult(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
-	if s.conf.JwtRSAPrivateKey == nil {
+	if s.conf.JwtSigningKey() == nil {
 		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
@@ -380,7 +653,7 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 
 	requestorToken := r.Context().Value("requestorToken").(irma.RequestorToken)
 
-	res, err := s.irmaserv.GetSessionResult(requestorToken)
+	res, err := s.irmaserv.GetHashedSessionResult(requestorToken)
 	if err != nil {
 		mapToServerError(w, err)
 		return
@@ -391,11 +664,18 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 		mapToServerError(w, err)
 		return
 	}
+	requestor, err := s.irmaserv.GetRequestor(res.Token)
+	if err != nil {
+		mapToServerError(w, err)
+		return
+	}
 
-	j, err := server.ResultJwt(res,
+	j, err := server.MappedResultJwt(res,
 		s.conf.JwtIssuer,
 		request.Base().ResultJwtValidity,
-		s.conf.JwtRSAPrivateKey,
+		s.conf.JwtSigningKey(),
+		s.conf.JwtKeyIDs[requestor],
+		s.conf.ResultJwtClaims,
 	)
 	if err != nil {
 		s.conf.Logger.Error("Failed to sign session result JWT")
@@ -407,14 +687,14 @@ func (s *Server) handleJwtResult(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
-	if s.conf.JwtRSAPrivateKey == nil {
+	if s.conf.JwtSigningKey() == nil {
 		s.conf.Logger.Warn("Session result JWT requested but no JWT private key is configured")
 		server.WriteError(w, server.ErrorUnknown, "JWT signing not supported")
 		return
 	}
 
 	requestorToken := r.Context().Value("requestorToken").(irma.RequestorToken)
-	res, err := s.irmaserv.GetSessionResult(requestorToken)
+	res, err := s.irmaserv.GetHashedSessionResult(requestorToken)
 	if err != nil {
 		mapToServerError(w, err)
 		return
@@ -434,7 +714,7 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 		server.WriteError(w, server.ErrorInvalidRequest, "")
 		return
 	}
-	claims["iat"] = time.Now().Unix()
+	claims["iat"] = s.conf.Now().Unix()
 	if s.conf.JwtIssuer != "" {
 		claims["iss"] = s.conf.JwtIssuer
 	}
@@ -447,7 +727,12 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 	}
 	validity := request.Base().ResultJwtValidity
 	if validity != 0 {
-		claims["exp"] = time.Now().Unix() + int64(validity)
+		claims["exp"] = s.conf.Now().Unix() + int64(validity)
+	}
+	requestor, err := s.irmaserv.GetRequestor(requestorToken)
+	if err != nil {
+		mapToServerError(w, err)
+		return
 	}
 
 	// Disclosed credentials and possibly signature
@@ -463,8 +748,7 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 	}
 
 	// Sign the jwt and return it
-	token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
-	resultJwt, err := token.SignedString(s.conf.JwtRSAPrivateKey)
+	resultJwt, err := irma.SignJwtWithKeyID(claims, s.conf.JwtSigningKey(), s.conf.JwtKeyIDs[requestor])
 	if err != nil {
 		s.conf.Logger.Error("Failed to sign session result JWT")
 		_ = server.LogError(err)
@@ -475,12 +759,12 @@ func (s *Server) handleJwtProofs(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
-	if s.conf.JwtRSAPrivateKey == nil {
+	if s.conf.JwtSigningKey() == nil {
 		server.WriteError(w, server.ErrorUnsupported, "")
 		return
 	}
 
-	bts, err := x509.MarshalPKIXPublicKey(&s.conf.JwtRSAPrivateKey.PublicKey)
+	bts, err := x509.MarshalPKIXPublicKey(s.conf.JwtPublicKey())
 	if err != nil {
 		server.WriteError(w, server.ErrorUnknown, err.Error())
 		return
@@ -492,22 +776,93 @@ func (s *Server) handlePublicKey(w http.ResponseWriter, r *http.Request) {
 	_, _ = w.Write(pubBytes)
 }
 
+func (s *Server) statsAuthMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(s.conf.StatsToken)) != 1 {
+			server.WriteError(w, server.ErrorUnauthorized, "")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) handleStats(w http.ResponseWriter, r *http.Request) {
+	server.WriteJson(w, s.irmaserv.UsageStatistics().Report())
+}
+
+func (s *Server) handleStatsMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := s.irmaserv.UsageStatistics().WritePrometheus(w); err != nil {
+		_ = server.LogWarning(errors.WrapPrefix(err, "failed to write metrics", 0))
+		return
+	}
+	if err := server.WriteIssuerKeyExpiriesPrometheus(w, s.conf.IssuerKeyExpiries()); err != nil {
+		_ = server.LogWarning(errors.WrapPrefix(err, "failed to write metrics", 0))
+		return
+	}
+	if err := s.irmaserv.StoreStatistics().WritePrometheus(w); err != nil {
+		_ = server.LogWarning(errors.WrapPrefix(err, "failed to write metrics", 0))
+		return
+	}
+	if err := server.WritePanicsPrometheus(w); err != nil {
+		_ = server.LogWarning(errors.WrapPrefix(err, "failed to write metrics", 0))
+	}
+}
+
+func (s *Server) handleStatsSchemeLog(w http.ResponseWriter, r *http.Request) {
+	entries, err := s.conf.IrmaConfiguration.SchemeLog(r.URL.Query().Get("scheme"))
+	if err != nil {
+		server.WriteError(w, server.ErrorInternal, err.Error())
+		return
+	}
+	server.WriteJson(w, entries)
+}
+
+func (s *Server) handleSessionHistory(w http.ResponseWriter, r *http.Request) {
+	requestorToken, err := irma.ParseRequestorToken(chi.URLParam(r, "requestorToken"))
+	if err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	history, err := s.irmaserv.GetSessionHistory(requestorToken)
+	if err != nil {
+		server.WriteError(w, server.ErrorSessionUnknown, "")
+		return
+	}
+	server.WriteJson(w, history)
+}
+
 func (s *Server) createSession(w http.ResponseWriter, requestor string, rrequest irma.RequestorRequest) {
+	pkg, rerr := s.startSession(requestor, rrequest)
+	if rerr != nil {
+		server.WriteResponse(w, nil, rerr)
+		return
+	}
+	server.WriteJson(w, pkg)
+}
+
+// startSession authorizes the specified request for the requestor and starts it,
+// returning either a session package for the requestor or an error.
+func (s *Server) startSession(requestor string, rrequest irma.RequestorRequest) (*server.SessionPackage, *irma.RemoteError) {
 	// Authorize request: check if the requestor is allowed to verify or issue
 	// the requested attributes or credentials
 	request := rrequest.SessionRequest()
-	if allowed, reason := s.conf.CanRequest(requestor, request); !allowed {
-		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "id": reason}).
+	if denials := s.conf.PermissionDenials(requestor, request); len(denials) > 0 {
+		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "denials": server.ToJson(denials)}).
 			Warn("Requestor not authorized to do session; full request: ", server.ToJson(request))
-		server.WriteError(w, server.ErrorUnauthorized, reason)
-		return
+		rerr := server.RemoteError(server.ErrorUnauthorized, permissionDenialsMessage(denials))
+		rerr.PermissionDenials = denials
+		return nil, rerr
 	}
 
+	s.conf.applyRequestorSettings(requestor, rrequest)
+
 	if rrequest.Base().NextSession != nil && rrequest.Base().NextSession.URL == "" {
 		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn("nextSession provided with empty URL")
-		server.WriteError(w, server.ErrorInvalidRequest, "nextSession provided with empty URL")
+		return nil, server.RemoteError(server.ErrorInvalidRequest, "nextSession provided with empty URL")
 	}
-	if s.conf.JwtRSAPrivateKey == nil && !s.conf.AllowUnsignedCallbacks {
+	if s.conf.JwtSigningKey() == nil && !s.conf.AllowUnsignedCallbacks {
 		var field string
 		if rrequest.Base().CallbackURL != "" {
 			field = "callbackUrl"
@@ -517,31 +872,110 @@ func (s *Server) createSession(w http.ResponseWriter, requestor string, rrequest
 		if field != "" {
 			errormsg := field + " provided but no JWT private key is installed: either install JWT or enable allow_unsigned_callbacks in configuration"
 			s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor}).Warn(errormsg)
-			server.WriteError(w, server.ErrorUnsupported, errormsg)
-			return
+			return nil, server.RemoteError(server.ErrorUnsupported, errormsg)
 		}
 	}
 
 	// Everything is authenticated and parsed, we're good to go!
-	qr, requestorToken, frontendRequest, err := s.irmaserv.StartSession(rrequest, nil)
+	qr, requestorToken, frontendRequest, err := s.irmaserv.StartRequestorSession(requestor, rrequest, nil)
 	if err != nil {
 		if _, ok := err.(*irmaserver.RedisError); ok {
 			s.conf.Logger.WithError(err).Error("Failed to start session")
-			server.WriteError(w, server.ErrorInternal, "")
-		} else {
-			server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+			return nil, server.RemoteError(server.ErrorInternal, "")
 		}
-		return
+		return nil, server.RemoteError(server.ErrorInvalidRequest, err.Error())
 	}
 
-	server.WriteJson(w, server.SessionPackage{
+	pkg := &server.SessionPackage{
 		SessionPtr:      qr,
 		Token:           requestorToken,
 		FrontendRequest: frontendRequest,
-	})
+	}
+	if rrequest.Base().CompactSessionPtr {
+		if pkg.CompactSessionPtr, err = qr.MarshalCompact(); err != nil {
+			return nil, server.RemoteError(server.ErrorInternal, err.Error())
+		}
+	}
+	return pkg, nil
 }
 
-func (s *Server) revoke(w http.ResponseWriter, requestor string, request *irma.RevocationRequest) {
+func (s *Server) handleCreateBulkSession(w http.ResponseWriter, r *http.Request) {
+	bulkRequest := &server.BulkIssuanceRequest{}
+	if err := server.ParseBody(r, bulkRequest); err != nil {
+		server.WriteError(w, server.ErrorInvalidRequest, err.Error())
+		return
+	}
+	if len(bulkRequest.Request) == 0 || len(bulkRequest.Rows) == 0 {
+		server.WriteError(w, server.ErrorInvalidRequest, "bulk issuance request must contain a request and at least one row")
+		return
+	}
+	if bulkRequest.RecipientColumn != "" && s.notifier == nil {
+		server.WriteError(w, server.ErrorUnsupported, "server is not configured to send session links")
+		return
+	}
+
+	// The template request is authenticated just like a request POSTed to /session, so we present
+	// it to the authenticators with the content type they would expect for it.
+	body := []byte(bulkRequest.Request)
+	headers := r.Header.Clone()
+	var jwtstr string
+	if err := json.Unmarshal(body, &jwtstr); err == nil {
+		body = []byte(jwtstr)
+		headers.Set("Content-Type", "text/plain")
+	} else {
+		headers.Set("Content-Type", "application/json")
+	}
+
+	rrequest, requestor, ok := s.authenticateSession(w, r, headers, body)
+	if !ok {
+		return
+	}
+
+	template, ok := rrequest.(*irma.IdentityProviderRequest)
+	if !ok {
+		server.WriteError(w, server.ErrorInvalidRequest, "bulk sessions must be issuance sessions")
+		return
+	}
+
+	results := make([]*server.BulkIssuanceResult, 0, len(bulkRequest.Rows))
+	for i, row := range bulkRequest.Rows {
+		result := &server.BulkIssuanceResult{Row: i + 1}
+		results = append(results, result)
+
+		recipient := row[bulkRequest.RecipientColumn]
+		if bulkRequest.RecipientColumn != "" && recipient == "" {
+			result.Err = server.RemoteError(server.ErrorInvalidRequest, "row contains no recipient")
+			continue
+		}
+		request, err := bulkRequest.RowRequest(s.conf.IrmaConfiguration.Snapshot(), template, row)
+		if err != nil {
+			result.Err = server.RemoteError(server.ErrorInvalidRequest, err.Error())
+			continue
+		}
+		pkg, rerr := s.startSession(requestor, request)
+		if rerr != nil {
+			result.Err = rerr
+			continue
+		}
+		result.Token = pkg.Token
+		result.SessionPtr = pkg.SessionPtr
+		result.Status = irma.ServerStatusInitialized
+
+		if recipient != "" {
+			if err = s.notifier.Notify(pkg, recipient, bulkRequest.Language); err != nil {
+				_ = server.LogWarning(errors.WrapPrefix(err, "Failed to send session link", 0))
+				result.Err = server.RemoteError(server.ErrorNotification, err.Error())
+				continue
+			}
+			result.Notified = true
+		}
+	}
+
+	s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "count": len(results)}).Info("Bulk issuance sessions started")
+	server.WriteJson(w, results)
+}
+
+func (s *Server) revoke(w http.ResponseWriter, r *http.Request, requestor string, request *irma.RevocationRequest) {
 	allowed, reason := s.conf.CanRevoke(requestor, request.CredentialType)
 	if !allowed {
 		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "message": reason}).
@@ -549,11 +983,19 @@ func (s *Server) revoke(w http.ResponseWriter, requestor string, request *irma.R
 		server.WriteError(w, server.ErrorUnauthorized, reason)
 		return
 	}
-	var issued time.Time
-	if request.Issued != 0 {
-		issued = time.Unix(0, request.Issued)
+	var err error
+	if request.Purge {
+		s.conf.Logger.WithFields(logrus.Fields{"requestor": requestor, "credtype": request.CredentialType, "ip": s.conf.ClientIP(r)}).
+			Info("Purging issuance records")
+		err = s.irmaserv.PurgeIssuanceRecords(request.CredentialType, request.Key)
+	} else {
+		var issued time.Time
+		if request.Issued != 0 {
+			issued = time.Unix(0, request.Issued)
+		}
+		err = s.irmaserv.Revoke(request.CredentialType, request.Key, issued)
 	}
-	if err := s.irmaserv.Revoke(request.CredentialType, request.Key, issued); err != nil {
+	if err != nil {
 		if err == irma.ErrUnknownRevocationKey {
 			server.WriteError(w, server.ErrorUnknownRevocationKey, "")
 		} else {
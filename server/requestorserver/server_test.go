@@ -0,0 +1,60 @@
+package requestorserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"testing"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/privacybydesign/irmago/server"
+	"github.com/privacybydesign/irmago/server/irmaserver"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPprofHandler(t *testing.T) {
+	s := &Server{conf: &Configuration{
+		Configuration: &server.Configuration{Logger: server.Logger},
+		StatsToken:    "token",
+		PprofPort:     6060,
+	}}
+	handler := s.PprofHandler()
+	get := func(path, token string) int {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	require.Equal(t, http.StatusOK, get("/debug/pprof/heap", "token"))
+	require.Equal(t, server.ErrorUnauthorized.Status, get("/debug/pprof/heap", ""))
+	require.Equal(t, server.ErrorUnauthorized.Status, get("/debug/pprof/heap", "other"))
+
+	// The command line of the server may contain secrets
+	require.Equal(t, http.StatusNotFound, get("/debug/pprof/cmdline", "token"))
+}
+
+func TestPublicConfigurationEndpoint(t *testing.T) {
+	conf := &Configuration{ApiPrefix: "/", Configuration: &server.Configuration{
+		Logger:               server.Logger,
+		SchemesPath:          filepath.Join(test.FindTestdataFolder(t), "irma_configuration"),
+		DisableSchemesUpdate: true,
+	}}
+	irmaserv, err := irmaserver.New(conf.Configuration)
+	require.NoError(t, err)
+	defer irmaserv.Stop()
+	s := &Server{conf: conf, irmaserv: irmaserv}
+
+	for _, handler := range []http.Handler{s.ClientHandler(), s.FrontendHandler()} {
+		for _, method := range []string{http.MethodGet, http.MethodHead} {
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, httptest.NewRequest(method, irma.PublicConfigurationPath, nil))
+			require.Equal(t, http.StatusOK, rec.Code, method)
+			require.NotEmpty(t, rec.Header().Get("ETag"), method)
+		}
+	}
+}
@@ -0,0 +1,163 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+)
+
+// UsageStatistics counts how often credential types are issued, and how often credential types
+// and their attributes are disclosed, in sessions that completed successfully. Only counts are
+// kept, never attribute values. The counts are kept in memory and start at zero when the server starts.
+type UsageStatistics struct {
+	mutex       sync.Mutex
+	since       time.Time
+	credentials map[irma.CredentialTypeIdentifier]*CredentialUsage
+}
+
+// UsageReport contains the usage counts per credential type since the moment in Since.
+type UsageReport struct {
+	Since       time.Time                                          `json:"since"`
+	Credentials map[irma.CredentialTypeIdentifier]*CredentialUsage `json:"credentials"`
+}
+
+// CredentialUsage contains the usage counts of a credential type.
+type CredentialUsage struct {
+	Issued uint64 `json:"issued"`
+	// Number of sessions in which one or more attributes of the credential type were disclosed
+	Disclosed uint64 `json:"disclosed"`
+	// Number of disclosures per attribute name
+	Attributes map[string]uint64 `json:"attributes,omitempty"`
+}
+
+func NewUsageStatistics() *UsageStatistics {
+	return &UsageStatistics{
+		since:       time.Now(),
+		credentials: map[irma.CredentialTypeIdentifier]*CredentialUsage{},
+	}
+}
+
+// Record updates the counts using the request and result of a finished session.
+// Sessions that did not complete, or whose proofs were not valid, are ignored.
+func (stats *UsageStatistics) Record(request irma.SessionRequest, result *SessionResult) {
+	if result == nil || result.Status != irma.ServerStatusDone {
+		return
+	}
+
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	if isreq, ok := request.(*irma.IssuanceRequest); ok {
+		for _, cred := range isreq.Credentials {
+			stats.usage(cred.CredentialTypeID).Issued++
+		}
+	}
+
+	if result.ProofStatus != irma.ProofStatusValid {
+		return
+	}
+	disclosed := map[irma.CredentialTypeIdentifier]struct{}{}
+	for _, con := range result.Disclosed {
+		for _, attr := range con {
+			credid := attr.Identifier.CredentialTypeIdentifier()
+			usage := stats.usage(credid)
+			if _, ok := disclosed[credid]; !ok {
+				disclosed[credid] = struct{}{}
+				usage.Disclosed++
+			}
+			if !attr.Identifier.IsCredential() {
+				usage.Attributes[attr.Identifier.Name()]++
+			}
+		}
+	}
+}
+
+func (stats *UsageStatistics) usage(id irma.CredentialTypeIdentifier) *CredentialUsage {
+	usage := stats.credentials[id]
+	if usage == nil {
+		usage = &CredentialUsage{Attributes: map[string]uint64{}}
+		stats.credentials[id] = usage
+	}
+	return usage
+}
+
+// Report returns a copy of the current counts.
+func (stats *UsageStatistics) Report() *UsageReport {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	report := &UsageReport{
+		Since:       stats.since,
+		Credentials: make(map[irma.CredentialTypeIdentifier]*CredentialUsage, len(stats.credentials)),
+	}
+	for id, usage := range stats.credentials {
+		c := &CredentialUsage{Issued: usage.Issued, Disclosed: usage.Disclosed, Attributes: make(map[string]uint64, len(usage.Attributes))}
+		for name, count := range usage.Attributes {
+			c.Attributes[name] = count
+		}
+		report.Credentials[id] = c
+	}
+	return report
+}
+
+// WritePrometheus writes the current counts to w in the Prometheus text exposition format.
+func (stats *UsageStatistics) WritePrometheus(w io.Writer) error {
+	report := stats.Report()
+	ids := make([]irma.CredentialTypeIdentifier, 0, len(report.Credentials))
+	for id := range report.Credentials {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i].String() < ids[j].String() })
+
+	metrics := []struct {
+		name, help string
+		write      func(w io.Writer, name string, id irma.CredentialTypeIdentifier, usage *CredentialUsage) error
+	}{
+		{
+			"irma_credentials_issued_total", "Number of issued credentials per credential type.",
+			func(w io.Writer, name string, id irma.CredentialTypeIdentifier, usage *CredentialUsage) error {
+				_, err := fmt.Fprintf(w, "%s{credential=%q} %d\n", name, id.String(), usage.Issued)
+				return err
+			},
+		},
+		{
+			"irma_credentials_disclosed_total", "Number of sessions in which attributes of the credential type were disclosed.",
+			func(w io.Writer, name string, id irma.CredentialTypeIdentifier, usage *CredentialUsage) error {
+				_, err := fmt.Fprintf(w, "%s{credential=%q} %d\n", name, id.String(), usage.Disclosed)
+				return err
+			},
+		},
+		{
+			"irma_attributes_disclosed_total", "Number of disclosures per attribute.",
+			func(w io.Writer, name string, id irma.CredentialTypeIdentifier, usage *CredentialUsage) error {
+				attrs := make([]string, 0, len(usage.Attributes))
+				for attr := range usage.Attributes {
+					attrs = append(attrs, attr)
+				}
+				sort.Strings(attrs)
+				for _, attr := range attrs {
+					if _, err := fmt.Fprintf(w, "%s{credential=%q,attribute=%q} %d\n", name, id.String(), attr, usage.Attributes[attr]); err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, metric := range metrics {
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n", metric.name, metric.help, metric.name); err != nil {
+			return err
+		}
+		for _, id := range ids {
+			if err := metric.write(w, metric.name, id, report.Credentials[id]); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
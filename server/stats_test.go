@@ -0,0 +1,45 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+)
+
+func TestUsageStatistics(t *testing.T) {
+	stats := NewUsageStatistics()
+	studentCard := irma.NewCredentialTypeIdentifier("irma-demo.RU.studentCard")
+	fullName := irma.NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName")
+
+	issuance := irma.NewIssuanceRequest([]*irma.CredentialRequest{{CredentialTypeID: studentCard}})
+	stats.Record(issuance, &SessionResult{Status: irma.ServerStatusDone, ProofStatus: irma.ProofStatusValid})
+
+	disclosed := [][]*irma.DisclosedAttribute{{
+		disclosedAttribute("irma-demo.MijnOverheid.fullName.firstname", "Alice"),
+		disclosedAttribute("irma-demo.MijnOverheid.fullName.familyname", "Doe"),
+	}, {
+		disclosedAttribute("irma-demo.RU.studentCard.studentID", "s1234567"),
+	}}
+	disclosure := irma.NewDisclosureRequest()
+	stats.Record(disclosure, &SessionResult{Status: irma.ServerStatusDone, ProofStatus: irma.ProofStatusValid, Disclosed: disclosed})
+	stats.Record(disclosure, &SessionResult{Status: irma.ServerStatusDone, ProofStatus: irma.ProofStatusValid, Disclosed: disclosed[:1]})
+
+	// Unsuccessful sessions are not counted
+	stats.Record(disclosure, &SessionResult{Status: irma.ServerStatusDone, ProofStatus: irma.ProofStatusInvalid, Disclosed: disclosed})
+	stats.Record(issuance, &SessionResult{Status: irma.ServerStatusCancelled})
+
+	report := stats.Report()
+	require.Equal(t, map[irma.CredentialTypeIdentifier]*CredentialUsage{
+		studentCard: {Issued: 1, Disclosed: 1, Attributes: map[string]uint64{"studentID": 1}},
+		fullName:    {Disclosed: 2, Attributes: map[string]uint64{"firstname": 2, "familyname": 2}},
+	}, report.Credentials)
+
+	var buf bytes.Buffer
+	require.NoError(t, stats.WritePrometheus(&buf))
+	require.Contains(t, buf.String(), "# TYPE irma_credentials_issued_total counter\n")
+	require.Contains(t, buf.String(), `irma_credentials_issued_total{credential="irma-demo.RU.studentCard"} 1`+"\n")
+	require.Contains(t, buf.String(), `irma_credentials_disclosed_total{credential="irma-demo.MijnOverheid.fullName"} 2`+"\n")
+	require.Contains(t, buf.String(), `irma_attributes_disclosed_total{credential="irma-demo.MijnOverheid.fullName",attribute="firstname"} 2`+"\n")
+}
@@ -0,0 +1,143 @@
+package server
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+)
+
+// storeDurationBuckets are the upper bounds in seconds of the buckets of the session store
+// operation duration histograms.
+var storeDurationBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5}
+
+// StoreStatistics measures the operations of a session store: per operation the number of calls
+// and errors and a histogram of their durations, and the number of session updates that failed
+// because the session was concurrently updated by another request (i.e., lock contention).
+// The time spent in the handlers of session transactions is measured separately as the "handler"
+// operation, so that slow stores can be distinguished from slow handlers.
+type StoreStatistics struct {
+	mutex      sync.Mutex
+	operations map[string]*StoreOperationStats
+	conflicts  uint64
+}
+
+// StoreOperationStats contains the measurements of a session store operation.
+type StoreOperationStats struct {
+	Count  uint64 `json:"count"`
+	Errors uint64 `json:"errors"`
+	// Total duration of the operations in seconds
+	Sum float64 `json:"sum"`
+	// Number of operations per bucket of storeDurationBuckets, not cumulative
+	Buckets []uint64 `json:"buckets"`
+}
+
+// StoreReport contains the session store measurements.
+type StoreReport struct {
+	Operations map[string]*StoreOperationStats `json:"operations"`
+	Conflicts  uint64                          `json:"conflicts"`
+}
+
+func NewStoreStatistics() *StoreStatistics {
+	return &StoreStatistics{operations: map[string]*StoreOperationStats{}}
+}
+
+// Record records a session store operation that took the specified duration.
+func (stats *StoreStatistics) Record(operation string, duration time.Duration, err error) {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	op := stats.operations[operation]
+	if op == nil {
+		op = &StoreOperationStats{Buckets: make([]uint64, len(storeDurationBuckets)+1)}
+		stats.operations[operation] = op
+	}
+	op.Count++
+	if err != nil {
+		op.Errors++
+	}
+	seconds := duration.Seconds()
+	op.Sum += seconds
+	i := sort.SearchFloat64s(storeDurationBuckets, seconds)
+	op.Buckets[i]++
+}
+
+// RecordConflict records a session update that failed because of a concurrent update.
+func (stats *StoreStatistics) RecordConflict() {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+	stats.conflicts++
+}
+
+// Report returns a copy of the current measurements.
+func (stats *StoreStatistics) Report() *StoreReport {
+	stats.mutex.Lock()
+	defer stats.mutex.Unlock()
+
+	report := &StoreReport{
+		Operations: make(map[string]*StoreOperationStats, len(stats.operations)),
+		Conflicts:  stats.conflicts,
+	}
+	for name, op := range stats.operations {
+		c := *op
+		c.Buckets = append([]uint64(nil), op.Buckets...)
+		report.Operations[name] = &c
+	}
+	return report
+}
+
+// WritePrometheus writes the current measurements to w in the Prometheus text exposition format.
+func (stats *StoreStatistics) WritePrometheus(w io.Writer) error {
+	report := stats.Report()
+	names := make([]string, 0, len(report.Operations))
+	for name := range report.Operations {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	const (
+		total     = "irma_session_store_operations_total"
+		errs      = "irma_session_store_errors_total"
+		duration  = "irma_session_store_operation_duration_seconds"
+		conflicts = "irma_session_store_conflicts_total"
+	)
+	if _, err := fmt.Fprintf(w, "# HELP %s Number of session store operations.\n# TYPE %s counter\n", total, total); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s{operation=%q} %d\n", total, name, report.Operations[name].Count); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "# HELP %s Number of failed session store operations.\n# TYPE %s counter\n", errs, errs); err != nil {
+		return err
+	}
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s{operation=%q} %d\n", errs, name, report.Operations[name].Errors); err != nil {
+			return err
+		}
+	}
+	if _, err := fmt.Fprintf(w, "# HELP %s Duration of session store operations.\n# TYPE %s histogram\n", duration, duration); err != nil {
+		return err
+	}
+	for _, name := range names {
+		op := report.Operations[name]
+		var cumulative uint64
+		for i, bound := range storeDurationBuckets {
+			cumulative += op.Buckets[i]
+			if _, err := fmt.Fprintf(w, "%s_bucket{operation=%q,le=\"%g\"} %d\n", duration, name, bound, cumulative); err != nil {
+				return err
+			}
+		}
+		if _, err := fmt.Fprintf(w, "%s_bucket{operation=%q,le=\"+Inf\"} %d\n", duration, name, op.Count); err != nil {
+			return err
+		}
+		if _, err := fmt.Fprintf(w, "%s_sum{operation=%q} %g\n%s_count{operation=%q} %d\n", duration, name, op.Sum, duration, name, op.Count); err != nil {
+			return err
+		}
+	}
+	_, err := fmt.Fprintf(w, "# HELP %s Number of session updates that failed because of a concurrent update.\n# TYPE %s counter\n%s %d\n",
+		conflicts, conflicts, conflicts, report.Conflicts)
+	return err
+}
@@ -0,0 +1,36 @@
+package server
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/go-errors/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestStoreStatistics(t *testing.T) {
+	stats := NewStoreStatistics()
+	stats.Record("transaction", 2*time.Millisecond, nil)
+	stats.Record("transaction", 300*time.Millisecond, errors.New("test"))
+	stats.Record("add", 10*time.Second, nil)
+	stats.RecordConflict()
+
+	report := stats.Report()
+	require.Equal(t, uint64(1), report.Conflicts)
+	require.Equal(t, uint64(2), report.Operations["transaction"].Count)
+	require.Equal(t, uint64(1), report.Operations["transaction"].Errors)
+	require.Equal(t, uint64(1), report.Operations["add"].Buckets[len(storeDurationBuckets)])
+
+	var buf bytes.Buffer
+	require.NoError(t, stats.WritePrometheus(&buf))
+	require.Contains(t, buf.String(), `irma_session_store_operations_total{operation="transaction"} 2`+"\n")
+	require.Contains(t, buf.String(), `irma_session_store_errors_total{operation="transaction"} 1`+"\n")
+	require.Contains(t, buf.String(), `irma_session_store_operation_duration_seconds_bucket{operation="transaction",le="0.001"} 0`+"\n")
+	require.Contains(t, buf.String(), `irma_session_store_operation_duration_seconds_bucket{operation="transaction",le="0.0025"} 1`+"\n")
+	require.Contains(t, buf.String(), `irma_session_store_operation_duration_seconds_bucket{operation="transaction",le="0.5"} 2`+"\n")
+	require.Contains(t, buf.String(), `irma_session_store_operation_duration_seconds_bucket{operation="add",le="2.5"} 0`+"\n")
+	require.Contains(t, buf.String(), `irma_session_store_operation_duration_seconds_bucket{operation="add",le="+Inf"} 1`+"\n")
+	require.Contains(t, buf.String(), `irma_session_store_operation_duration_seconds_count{operation="add"} 1`+"\n")
+	require.Contains(t, buf.String(), "irma_session_store_conflicts_total 1\n")
+}
@@ -0,0 +1,172 @@
+package server
+
+import (
+	"embed"
+	"encoding/json"
+	"net/http"
+	"path"
+	"strings"
+
+	"github.com/go-errors/errors"
+	irma "github.com/privacybydesign/irmago"
+	"golang.org/x/text/language"
+)
+
+// Translations of the descriptions of errors, per error code, for each supported language except
+// English (in which the descriptions in errors.go are written). The file name of each bundle is
+// its language tag.
+//
+//go:embed translations/*.json
+var translationBundles embed.FS
+
+// includedErrorTranslations contains the translations of translationBundles, and is not modified
+// after init(): custom translations are added to a copy by each Configuration.
+var includedErrorTranslations *errorTranslations
+
+func init() {
+	files, err := translationBundles.ReadDir("translations")
+	if err != nil {
+		panic(err)
+	}
+	bundles := map[string]map[irma.RemoteErrorCode]string{}
+	for _, file := range files {
+		bts, err := translationBundles.ReadFile(path.Join("translations", file.Name()))
+		if err != nil {
+			panic(err)
+		}
+		var translations map[irma.RemoteErrorCode]string
+		if err = json.Unmarshal(bts, &translations); err != nil {
+			panic(errors.Errorf("failed to parse error translations %s: %v", file.Name(), err))
+		}
+		bundles[strings.TrimSuffix(file.Name(), path.Ext(file.Name()))] = translations
+	}
+	english := &errorTranslations{languages: []language.Tag{language.English}}
+	if includedErrorTranslations, err = english.with(bundles); err != nil {
+		panic(err)
+	}
+}
+
+// errorTranslations contains translations of error descriptions per language and error code.
+type errorTranslations struct {
+	translations map[language.Tag]map[irma.RemoteErrorCode]string
+	// Supported languages, starting with English as the default
+	languages []language.Tag
+	matcher   language.Matcher
+}
+
+// with returns a copy of the translations to which the specified translations, per language tag
+// (e.g. "nl") and error code, are added, overriding existing translations.
+func (t *errorTranslations) with(translations map[string]map[irma.RemoteErrorCode]string) (*errorTranslations, error) {
+	cpy := &errorTranslations{
+		translations: make(map[language.Tag]map[irma.RemoteErrorCode]string, len(t.translations)),
+		languages:    append([]language.Tag(nil), t.languages...),
+	}
+	for tag, descriptions := range t.translations {
+		cpy.translations[tag] = make(map[irma.RemoteErrorCode]string, len(descriptions))
+		for code, description := range descriptions {
+			cpy.translations[tag][code] = description
+		}
+	}
+
+	for lang, descriptions := range translations {
+		tag, err := language.Parse(lang)
+		if err != nil {
+			return nil, errors.Errorf("invalid language %s in error translations: %v", lang, err)
+		}
+		if _, ok := cpy.translations[tag]; !ok {
+			cpy.translations[tag] = map[irma.RemoteErrorCode]string{}
+			cpy.languages = append(cpy.languages, tag)
+		}
+		for code, description := range descriptions {
+			cpy.translations[tag][code] = description
+		}
+	}
+	cpy.matcher = language.NewMatcher(cpy.languages)
+	return cpy, nil
+}
+
+// match returns the translations of the language that best matches the Accept-Language header,
+// or nil if that is English.
+func (t *errorTranslations) match(acceptLanguage string) (language.Tag, map[irma.RemoteErrorCode]string) {
+	if acceptLanguage == "" {
+		return language.English, nil
+	}
+	tags, _, err := language.ParseAcceptLanguage(acceptLanguage)
+	if err != nil || len(tags) == 0 {
+		return language.English, nil
+	}
+	_, index, confidence := t.matcher.Match(tags...)
+	if confidence == language.No {
+		return language.English, nil
+	}
+	return t.languages[index], t.translations[t.languages[index]]
+}
+
+// LocalizationMiddleware returns middleware that translates the descriptions of errors written by
+// WriteError() and WriteResponse() to the language, among those of the included translations and
+// the ErrorTranslations of the configuration, that best matches the Accept-Language header of
+// the request. Translated errors are sent along with a Content-Language header. As the
+// translations are passed along with the http.ResponseWriter, the middleware should come after
+// middleware replacing it, such as TimeoutMiddleware().
+func LocalizationMiddleware(conf *Configuration) func(http.Handler) http.Handler {
+	translations := conf.errorTranslations
+	if translations == nil {
+		translations = includedErrorTranslations
+	}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Add("Vary", "Accept-Language")
+			lang, descriptions := translations.match(r.Header.Get("Accept-Language"))
+			if descriptions == nil {
+				next.ServeHTTP(w, r)
+				return
+			}
+			next.ServeHTTP(&localizedResponseWriter{ResponseWriter: w, lang: lang, descriptions: descriptions}, r)
+		})
+	}
+}
+
+// localizedResponseWriter passes the translations determined by LocalizationMiddleware along to
+// WriteResponse().
+type localizedResponseWriter struct {
+	http.ResponseWriter
+	lang         language.Tag
+	descriptions map[irma.RemoteErrorCode]string
+}
+
+// Unwrap returns the wrapped http.ResponseWriter, for http.ResponseController.
+func (w *localizedResponseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Flush implements http.Flusher, for server-sent events.
+func (w *localizedResponseWriter) Flush() {
+	if flusher, ok := w.ResponseWriter.(http.Flusher); ok {
+		flusher.Flush()
+	}
+}
+
+// localize returns a copy of the error having its description translated to the language
+// determined by LocalizationMiddleware, if any, in which case it sets the Content-Language header.
+func localize(w http.ResponseWriter, rerr *irma.RemoteError) *irma.RemoteError {
+	if rerr == nil || rerr.Description == "" {
+		return rerr
+	}
+	for {
+		if lw, ok := w.(*localizedResponseWriter); ok {
+			description, ok := lw.descriptions[rerr.Code]
+			if !ok {
+				return rerr
+			}
+			w.Header().Set("Content-Language", lw.lang.String())
+			cpy := *rerr
+			cpy.Description = description
+			return &cpy
+		}
+		u, ok := w.(interface{ Unwrap() http.ResponseWriter })
+		if !ok {
+			return rerr
+		}
+		w = u.Unwrap()
+	}
+}
@@ -0,0 +1,104 @@
+package server
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	irma "github.com/privacybydesign/irmago"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/text/language"
+)
+
+func TestLocalizationMiddleware(t *testing.T) {
+	conf := &Configuration{}
+	var err error
+	conf.errorTranslations, err = includedErrorTranslations.with(map[string]map[irma.RemoteErrorCode]string{
+		"de": {irma.ErrorCodeSessionUnknown: "Unbekannte oder abgelaufene Sitzung"},
+	})
+	require.NoError(t, err)
+
+	serve := func(acceptLanguage string, object interface{}, rerr Error) (*httptest.ResponseRecorder, *irma.RemoteError) {
+		handler := TimeoutMiddleware(nil, time.Second)(LocalizationMiddleware(conf)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if object != nil {
+				WriteJson(w, object)
+			} else {
+				// As in sessions, in which responses are recorded during transactions
+				recorder := NewHTTPResponseRecorder(w)
+				WriteError(recorder, rerr, "")
+				recorder.Flush()
+			}
+		})))
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Accept-Language", acceptLanguage)
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		if object != nil {
+			return rec, nil
+		}
+		res := &irma.RemoteError{}
+		require.NoError(t, json.Unmarshal(rec.Body.Bytes(), res))
+		return rec, res
+	}
+
+	// Included translations
+	rec, rerr := serve("nl-NL,nl;q=0.9,en;q=0.8", nil, ErrorSessionUnknown)
+	require.Equal(t, "Onbekende of verlopen sessie", rerr.Description)
+	require.Equal(t, irma.ErrorCodeSessionUnknown, rerr.Code)
+	require.Equal(t, "nl", rec.Header().Get("Content-Language"))
+	require.Equal(t, ErrorSessionUnknown.Description, RemoteError(ErrorSessionUnknown, "").Description)
+
+	// Custom translations
+	rec, rerr = serve("de", nil, ErrorSessionUnknown)
+	require.Equal(t, "Unbekannte oder abgelaufene Sitzung", rerr.Description)
+	require.Equal(t, "de", rec.Header().Get("Content-Language"))
+
+	// Errors not translated to the language are sent in English
+	rec, rerr = serve("de", nil, ErrorInvalidRequest)
+	require.Equal(t, ErrorInvalidRequest.Description, rerr.Description)
+	require.Empty(t, rec.Header().Get("Content-Language"))
+
+	// Unsupported languages and absent Accept-Language headers
+	for _, acceptLanguage := range []string{"fr", "", "invalid;;"} {
+		rec, rerr = serve(acceptLanguage, nil, ErrorSessionUnknown)
+		require.Equal(t, ErrorSessionUnknown.Description, rerr.Description)
+		require.Empty(t, rec.Header().Get("Content-Language"))
+	}
+
+	// Responses other than errors are not marked as translated
+	rec, _ = serve("nl", "ok", Error{})
+	require.Empty(t, rec.Header().Get("Content-Language"))
+
+	// Custom translations are not shared with other configurations
+	handler := LocalizationMiddleware(&Configuration{})(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		WriteError(w, ErrorSessionUnknown, "")
+	}))
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Language", "de")
+	rec = httptest.NewRecorder()
+	handler.ServeHTTP(rec, req)
+	require.Empty(t, rec.Header().Get("Content-Language"))
+	require.Contains(t, rec.Body.String(), ErrorSessionUnknown.Description)
+
+	_, err = includedErrorTranslations.with(map[string]map[irma.RemoteErrorCode]string{"???": {}})
+	require.Error(t, err)
+	_, ok := includedErrorTranslations.translations[language.German]
+	require.False(t, ok)
+}
+
+func TestIncludedTranslations(t *testing.T) {
+	files, err := translationBundles.ReadDir("translations")
+	require.NoError(t, err)
+	require.NotEmpty(t, files)
+	for _, file := range files {
+		bts, err := translationBundles.ReadFile("translations/" + file.Name())
+		require.NoError(t, err)
+		var translations map[irma.RemoteErrorCode]string
+		require.NoError(t, json.Unmarshal(bts, &translations))
+		for _, e := range ErrorCatalog {
+			require.Contains(t, translations, e.Code, "error %s not translated in %s", e.Code, file.Name())
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package irma
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"maps"
+	"slices"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// configurationSnapshots keeps track of the snapshots of a Configuration (see Snapshot()).
+type configurationSnapshots struct {
+	// Serializes changes to the schemes of the configuration
+	sync.Mutex
+
+	current atomic.Pointer[Configuration]
+
+	// Snapshots that were replaced less than ConfigurationOptions.SnapshotRetention ago, by ID
+	retained      map[string]*Configuration
+	retainedMutex sync.RWMutex
+}
+
+// Snapshot returns a copy of the configuration as of its last parse or change of its schemes,
+// which is left untouched by later changes of the schemes, and which can therefore be used
+// concurrently with those without locking. Snapshots are read-only: they cannot themselves be
+// updated or downloaded into. Until the configuration is parsed, the configuration itself is
+// returned.
+func (conf *Configuration) Snapshot() *Configuration {
+	if conf.snapshots == nil { // conf is itself a snapshot
+		return conf
+	}
+	if snapshot := conf.snapshots.current.Load(); snapshot != nil {
+		return snapshot
+	}
+	return conf
+}
+
+// SnapshotOf returns the snapshot having the specified ID (see SnapshotID()), if it is current or
+// was replaced less than ConfigurationOptions.SnapshotRetention ago; otherwise the current
+// snapshot is returned.
+func (conf *Configuration) SnapshotOf(id string) *Configuration {
+	if conf.snapshots == nil {
+		return conf
+	}
+	conf.snapshots.retainedMutex.RLock()
+	defer conf.snapshots.retainedMutex.RUnlock()
+	if snapshot := conf.snapshots.retained[id]; snapshot != nil {
+		return snapshot
+	}
+	return conf.Snapshot()
+}
+
+// SnapshotID returns the ID of the current snapshot, which is derived from the versions of its
+// schemes, so that configurations having the same scheme versions have the same snapshot ID.
+func (conf *Configuration) SnapshotID() string {
+	return conf.Snapshot().snapshotID
+}
+
+// lockSchemes is to be invoked by all exported methods that change the schemes, so that these
+// changes are not interleaved.
+func (conf *Configuration) lockSchemes() func() {
+	if conf.snapshots == nil {
+		return func() {}
+	}
+	conf.snapshots.Lock()
+	return conf.snapshots.Unlock
+}
+
+// publishSnapshot makes a snapshot of the configuration in its present state the current snapshot,
+// retaining the previous one if configured.
+func (conf *Configuration) publishSnapshot() {
+	if conf.snapshots == nil {
+		return
+	}
+	snapshot := conf.snapshot()
+
+	s := conf.snapshots
+	s.retainedMutex.Lock()
+	defer s.retainedMutex.Unlock()
+	now := conf.now()
+	retention := conf.options.SnapshotRetention
+	if previous := s.current.Load(); previous != nil && previous.snapshotID != snapshot.snapshotID && retention > 0 {
+		previous.replaced = now
+		s.retained[previous.snapshotID] = previous
+	}
+	delete(s.retained, snapshot.snapshotID)
+	for id, retained := range s.retained {
+		if now.Sub(retained.replaced) > retention {
+			delete(s.retained, id)
+		}
+	}
+	s.current.Store(snapshot)
+}
+
+func (conf *Configuration) now() time.Time {
+	if conf.options.Now == nil {
+		return time.Now()
+	}
+	return conf.options.Now()
+}
+
+// snapshot returns a read-only copy of the configuration. The schemes, issuers, credential types
+// and other entities are not copied, as they are replaced instead of modified when the schemes
+// change; the revocation storage and private keys are shared with the configuration.
+func (conf *Configuration) snapshot() *Configuration {
+	snapshot := &Configuration{
+		SchemeManagers:           maps.Clone(conf.SchemeManagers),
+		Issuers:                  maps.Clone(conf.Issuers),
+		CredentialTypes:          maps.Clone(conf.CredentialTypes),
+		AttributeTypes:           maps.Clone(conf.AttributeTypes),
+		kssPublicKeys:            conf.kssPublicKeys.Clone(),
+		publicKeys:               conf.publicKeys.Clone(),
+		reverseHashes:            maps.Clone(conf.reverseHashes),
+		RequestorSchemes:         maps.Clone(conf.RequestorSchemes),
+		Requestors:               maps.Clone(conf.Requestors),
+		IssueWizards:             maps.Clone(conf.IssueWizards),
+		DisabledRequestorSchemes: maps.Clone(conf.DisabledRequestorSchemes),
+		DisabledSchemeManagers:   maps.Clone(conf.DisabledSchemeManagers),
+
+		Path:        conf.Path,
+		PrivateKeys: conf.PrivateKeys,
+		Revocation:  conf.Revocation,
+		Scheduler:   conf.Scheduler,
+		Warnings:    slices.Clone(conf.Warnings),
+		HTTPClient:  conf.HTTPClient,
+
+		kssJWKSMutex:   conf.kssJWKSMutex,
+		kssJWKSFetched: conf.kssJWKSFetched,
+		keyproofs:      conf.keyproofs,
+
+		options:     conf.options,
+		initialized: conf.initialized,
+		assets:      conf.assets,
+		readOnly:    true,
+	}
+	snapshot.snapshotID = snapshot.computeSnapshotID()
+	return snapshot
+}
+
+func (conf *Configuration) computeSnapshotID() string {
+	var versions []string
+	for id, scheme := range conf.SchemeManagers {
+		versions = append(versions, fmt.Sprintf("%s:%d", id, time.Time(scheme.Timestamp).Unix()))
+	}
+	for id, scheme := range conf.RequestorSchemes {
+		versions = append(versions, fmt.Sprintf("%s:%d", id, time.Time(scheme.Timestamp).Unix()))
+	}
+	sort.Strings(versions)
+	hash := sha256.New()
+	for _, version := range versions {
+		hash.Write([]byte(version + "\n"))
+	}
+	return hex.EncodeToString(hash.Sum(nil)[:8])
+}
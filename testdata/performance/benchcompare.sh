@@ -0,0 +1,64 @@
+#!/usr/bin/env bash
+# Runs the Go benchmarks of irmago at two revisions and compares them using benchstat. Exits with
+# a non-zero status if a benchmark became significantly slower by more than BENCH_THRESHOLD percent.
+#
+# Usage: benchcompare.sh <old-rev> [<new-rev>]
+# If <new-rev> is omitted, the benchmarks of the current working tree are used.
+#
+# Environment variables:
+#   BENCH_THRESHOLD  maximum allowed slowdown in percent (default 10)
+#   BENCH_COUNT      number of runs of each benchmark (default 6)
+#   BENCH_FILTER     regular expression selecting the benchmarks to run (default .)
+set -euo pipefail
+
+old=${1:?usage: $0 <old-rev> [<new-rev>]}
+new=${2:-}
+threshold=${BENCH_THRESHOLD:-10}
+count=${BENCH_COUNT:-6}
+filter=${BENCH_FILTER:-.}
+packages=(. ./irmaclient ./server/irmaserver)
+
+root=$(git rev-parse --show-toplevel)
+tmp=$(mktemp -d)
+cleanup() {
+  git -C "${root}" worktree remove --force "${tmp}/old" 2>/dev/null || true
+  git -C "${root}" worktree remove --force "${tmp}/new" 2>/dev/null || true
+  rm -rf "${tmp}"
+}
+trap cleanup EXIT
+
+# bench <dir> <output file> runs the benchmarks in the specified source tree
+bench() {
+  (cd "$1" && go test -run '^$' -bench "${filter}" -benchmem -count "${count}" "${packages[@]}") | tee "$2"
+}
+
+git -C "${root}" worktree add --detach "${tmp}/old" "${old}"
+bench "${tmp}/old" "${tmp}/old.txt"
+if [ -n "${new}" ]; then
+  git -C "${root}" worktree add --detach "${tmp}/new" "${new}"
+  bench "${tmp}/new" "${tmp}/new.txt"
+else
+  bench "${root}" "${tmp}/new.txt"
+fi
+
+if command -v benchstat >/dev/null; then
+  benchstat=(benchstat)
+else
+  benchstat=(go run golang.org/x/perf/cmd/benchstat@latest)
+fi
+"${benchstat[@]}" "old=${tmp}/old.txt" "new=${tmp}/new.txt" | tee "${tmp}/benchstat.txt"
+
+# In the sec/op table, benchstat reports significant changes as e.g. "+12.34% (p=0.002 n=6)"
+# and insignificant ones as "~ (p=0.240 n=6)".
+awk -v threshold="${threshold}" '
+  /sec\/op/ { timing = 1; next }
+  /^[[:space:]]*$/ { timing = 0 }
+  timing && match($0, /\+[0-9.]+% \(p=/) {
+    delta = substr($0, RSTART + 1, RLENGTH - 6) + 0
+    if (delta > threshold) {
+      print "Regression of more than " threshold "%: " $1
+      regressed = 1
+    }
+  }
+  END { exit regressed }
+' "${tmp}/benchstat.txt"
@@ -2,8 +2,11 @@ package irma
 
 import (
 	"crypto/sha256"
+	"crypto/x509"
 	"encoding/asn1"
 	gobig "math/big"
+	"slices"
+	"time"
 
 	"github.com/bwesterb/go-atum"
 	"github.com/go-errors/errors"
@@ -11,19 +14,74 @@ import (
 	"github.com/privacybydesign/gabi/big"
 )
 
+// SignatureTimestamp is a signed timestamp over an attribute-based signature (see GetTimestamp()),
+// created either by the atum timestamp server or by one of the RFC 3161 TSAs of the schemes
+// involved. At most one of its fields is set.
+type SignatureTimestamp struct {
+	Atum *atum.Timestamp
+	TSA  *TSATimestamp
+}
+
+var errMultipleTimestamps = errors.New("signed message contains both an atum and a TSA timestamp")
+
+// signature returns the data with which the timestamp is bound to the attribute-based signature
+// (see ASN1ConvertSignatureNonce()). Like VerifyTimestamp(), it prefers the TSA timestamp.
+func (ts *SignatureTimestamp) signature() []byte {
+	switch {
+	case ts == nil:
+		return nil
+	case ts.TSA != nil:
+		return ts.TSA.Token
+	case ts.Atum != nil:
+		return ts.Atum.Sig.Data
+	default:
+		return nil
+	}
+}
+
+// Time returns the time of the timestamp, which should have been verified before.
+// Like VerifyTimestamp(), it prefers the TSA timestamp.
+func (ts *SignatureTimestamp) Time() time.Time {
+	if ts.TSA == nil {
+		return time.Unix(ts.Atum.Time, 0)
+	}
+	token, err := ts.TSA.parse()
+	if err != nil {
+		return time.Time{}
+	}
+	return token.info.GenTime
+}
+
 // GetTimestamp GETs a signed timestamp (a signature over the current time and the parameters)
 // over the message to be signed, the randomized signatures over the attributes, and the disclosed
-// attributes, for in attribute-based signature sessions.
-func GetTimestamp(message string, sigs []*big.Int, disclosed [][]*big.Int, conf *Configuration) (*atum.Timestamp, error) {
-	nonce, timestampServerUrl, err := TimestampRequest(message, sigs, disclosed, true, conf)
+// attributes, for in attribute-based signature sessions. If all schemes involved specify RFC 3161
+// TSAs, then these are used; otherwise the timestamp server of the schemes is used.
+func GetTimestamp(message string, sigs []*big.Int, disclosed [][]*big.Int, conf *Configuration) (*SignatureTimestamp, error) {
+	nonce, schemes, err := timestampRequest(message, sigs, disclosed, true, conf)
+	if err != nil {
+		return nil, err
+	}
+	if tsas := timestampAuthorities(schemes, conf); tsas != nil {
+		ts, err := getTSATimestamp(conf.HTTPClient, nonce, tsas...)
+		if err != nil {
+			return nil, err
+		}
+		return &SignatureTimestamp{TSA: ts}, nil
+	}
+
+	timestampServerUrl, err := timestampServer(schemes, conf)
 	if err != nil {
 		return nil, err
 	}
 	alg := atum.Ed25519
-	return atum.SendRequest(timestampServerUrl, atum.Request{
+	ts, aerr := atum.SendRequest(timestampServerUrl, atum.Request{
 		Nonce:           nonce,
 		PreferredSigAlg: &alg,
 	})
+	if aerr != nil {
+		return nil, aerr
+	}
+	return &SignatureTimestamp{Atum: ts}, nil
 }
 
 // TimestampRequest computes the nonce to be signed by a timestamp server, given a message to be signed
@@ -32,6 +90,21 @@ func GetTimestamp(message string, sigs []*big.Int, disclosed [][]*big.Int, conf
 // request is returned as the second return value.
 func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int, new bool, conf *Configuration) (
 	[]byte, string, error) {
+	nonce, schemes, err := timestampRequest(message, sigs, disclosed, new, conf)
+	if err != nil {
+		return nil, "", err
+	}
+	timestampServerUrl, err := timestampServer(schemes, conf)
+	if err != nil {
+		return nil, "", err
+	}
+	return nonce, timestampServerUrl, nil
+}
+
+// timestampRequest computes the nonce to be signed by a timestamp server or TSA (see TimestampRequest()),
+// and returns it along with the schemes of the credentials involved.
+func timestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int, new bool, conf *Configuration) (
+	[]byte, []SchemeManagerIdentifier, error) {
 	msgHash := sha256.Sum256([]byte(message))
 
 	// Convert the sigs and disclosed (double) slices to (double) slices of gobig.Int's for asn1
@@ -40,14 +113,14 @@ func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int, n
 		sigsint[i] = k.Go()
 	}
 
-	timestampServerUrl := ""
+	var schemes []SchemeManagerIdentifier
 	disclosedint := make([][]*gobig.Int, len(disclosed))
 	dlreps := make([]*gobig.Int, len(disclosed))
 	var d interface{} = disclosedint
 	for i := range disclosed {
 		meta := MetadataFromInt(disclosed[i][1], conf)
 		if meta.CredentialType() == nil {
-			return nil, "", errors.New("Cannot compute timestamp request involving unknown credential types")
+			return nil, nil, errors.New("Cannot compute timestamp request involving unknown credential types")
 		}
 		if !new {
 			disclosedint[i] = make([]*gobig.Int, len(disclosed[i]))
@@ -56,29 +129,23 @@ func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int, n
 			}
 		} else {
 			if len(disclosed[i]) < 2 || disclosed[i][1].Cmp(bigZero) == 0 {
-				return nil, "", errors.Errorf("metadata attribute of credential %d not disclosed", i)
+				return nil, nil, errors.Errorf("metadata attribute of credential %d not disclosed", i)
 			}
 			pk, err := conf.PublicKey(meta.CredentialType().IssuerIdentifier(), meta.KeyCounter())
 			if err != nil {
-				return nil, "", err
+				return nil, nil, err
 			}
 			r, err := gabi.RepresentToPublicKey(pk, disclosed[i])
 			if err != nil {
-				return nil, "", err
+				return nil, nil, err
 			}
 			dlreps[i] = r.Go()
 		}
 
-		// Determine timestamp server that should be used
 		schemeId := meta.CredentialType().SchemeManagerIdentifier()
-		tss := conf.SchemeManagers[schemeId].TimestampServer
-		if tss == "" {
-			return nil, "", errors.Errorf("No timestamp server specified in scheme %s", schemeId.String())
+		if !slices.Contains(schemes, schemeId) {
+			schemes = append(schemes, schemeId)
 		}
-		if timestampServerUrl != "" && timestampServerUrl != tss {
-			return nil, "", errors.New("No support for multiple timestamp servers in timestamp format")
-		}
-		timestampServerUrl = tss
 	}
 	if new {
 		d = dlreps
@@ -92,16 +159,49 @@ func TimestampRequest(message string, sigs []*big.Int, disclosed [][]*big.Int, n
 		sigsint, msgHash[:], d,
 	})
 	if err != nil {
-		return nil, "", err
+		return nil, nil, err
 	}
 
 	hashed := sha256.Sum256(bts)
-	return hashed[:], timestampServerUrl, nil
+	return hashed[:], schemes, nil
+}
+
+// timestampServer determines the timestamp server that should be used for the specified schemes.
+func timestampServer(schemes []SchemeManagerIdentifier, conf *Configuration) (string, error) {
+	timestampServerUrl := ""
+	for _, schemeId := range schemes {
+		tss := conf.SchemeManagers[schemeId].TimestampServer
+		if tss == "" {
+			return "", errors.Errorf("No timestamp server specified in scheme %s", schemeId.String())
+		}
+		if timestampServerUrl != "" && timestampServerUrl != tss {
+			return "", errors.New("No support for multiple timestamp servers in timestamp format")
+		}
+		timestampServerUrl = tss
+	}
+	return timestampServerUrl, nil
+}
+
+// timestampAuthorities returns the RFC 3161 TSAs of the specified schemes, if all of them specify TSAs.
+func timestampAuthorities(schemes []SchemeManagerIdentifier, conf *Configuration) []*SchemeTSA {
+	var tsas []*SchemeTSA
+	for _, schemeId := range schemes {
+		tsa := conf.SchemeManagers[schemeId].TSA
+		if tsa == nil {
+			return nil
+		}
+		tsas = append(tsas, tsa)
+	}
+	return tsas
 }
 
 // VerifyTimestamp verifies the timestamp over the signed message, disclosed attributes,
 // and rerandomized CL-signatures of the given SignedMessage.
 func (sm *SignedMessage) VerifyTimestamp(message string, conf *Configuration) error {
+	if sm.Timestamp != nil && sm.TSATimestamp != nil {
+		return errMultipleTimestamps
+	}
+
 	// Extract the disclosed attributes and randomized CL-signatures from the proofs in order to
 	// construct the nonce that should be signed by the timestamp server.
 	zero := big.NewInt(0)
@@ -127,7 +227,27 @@ func (sm *SignedMessage) VerifyTimestamp(message string, conf *Configuration) er
 		}
 	}
 
-	bts, timestampServerUrl, err := TimestampRequest(message, sigs, disclosed, sm.Version() >= 2, conf)
+	bts, schemes, err := timestampRequest(message, sigs, disclosed, sm.Version() >= 2, conf)
+	if err != nil {
+		return err
+	}
+
+	if sm.TSATimestamp != nil {
+		tsas := timestampAuthorities(schemes, conf)
+		if tsas == nil {
+			return errors.New("Cannot verify TSA timestamp: not all schemes involved specify TSAs")
+		}
+		roots := make([]*x509.CertPool, len(tsas))
+		for i, tsa := range tsas {
+			if roots[i], err = tsa.Roots(); err != nil {
+				return err
+			}
+		}
+		_, err = sm.TSATimestamp.Verify(bts, roots...)
+		return err
+	}
+
+	timestampServerUrl, err := timestampServer(schemes, conf)
 	if err != nil {
 		return err
 	}
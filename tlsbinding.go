@@ -0,0 +1,83 @@
+package irma
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"strings"
+
+	"github.com/go-errors/errors"
+)
+
+const (
+	tlsBindingLabel  = "EXPORTER-IRMA-TLS-Binding"
+	tlsBindingLength = 32
+)
+
+// NewTLSBindingKey generates a key with which TLSBinding() binds an authorization to TLS connections.
+func NewTLSBindingKey() (*ecdsa.PrivateKey, error) {
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+// TLSBinding computes the value of the TLSBindingHeader for the TLS connection with the specified
+// state, signing its exported keying material (RFC 5705) with the specified key, in the style of
+// RFC 8471 (Token Binding). As the server binds the session to the key of the first request, a stolen
+// authorization cannot be replayed over another connection.
+func TLSBinding(key *ecdsa.PrivateKey, state tls.ConnectionState) (string, error) {
+	ekm, err := state.ExportKeyingMaterial(tlsBindingLabel, nil, tlsBindingLength)
+	if err != nil {
+		return "", errors.WrapPrefix(err, "failed to export TLS keying material", 0)
+	}
+	pk, err := x509.MarshalPKIXPublicKey(&key.PublicKey)
+	if err != nil {
+		return "", errors.WrapPrefix(err, "failed to marshal TLS binding key", 0)
+	}
+	hash := sha256.Sum256(ekm)
+	sig, err := ecdsa.SignASN1(rand.Reader, key, hash[:])
+	if err != nil {
+		return "", errors.WrapPrefix(err, "failed to sign TLS keying material", 0)
+	}
+	return base64.RawURLEncoding.EncodeToString(pk) + "." + base64.RawURLEncoding.EncodeToString(sig), nil
+}
+
+// VerifyTLSBinding verifies the specified value of the TLSBindingHeader against the TLS connection
+// with the specified state, and returns the (PKIX, ASN.1 DER encoded) public key that signed it.
+func VerifyTLSBinding(binding string, state *tls.ConnectionState) ([]byte, error) {
+	if state == nil {
+		return nil, errors.New("TLS binding requires a TLS connection")
+	}
+	encodedPk, encodedSig, ok := strings.Cut(binding, ".")
+	if !ok {
+		return nil, errors.New("malformed TLS binding")
+	}
+	pk, err := base64.RawURLEncoding.DecodeString(encodedPk)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "malformed TLS binding key", 0)
+	}
+	sig, err := base64.RawURLEncoding.DecodeString(encodedSig)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "malformed TLS binding signature", 0)
+	}
+	parsed, err := x509.ParsePKIXPublicKey(pk)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "malformed TLS binding key", 0)
+	}
+	key, ok := parsed.(*ecdsa.PublicKey)
+	if !ok {
+		return nil, errors.New("TLS binding key is not an ECDSA key")
+	}
+
+	ekm, err := state.ExportKeyingMaterial(tlsBindingLabel, nil, tlsBindingLength)
+	if err != nil {
+		return nil, errors.WrapPrefix(err, "failed to export TLS keying material", 0)
+	}
+	hash := sha256.Sum256(ekm)
+	if !ecdsa.VerifyASN1(key, hash[:], sig) {
+		return nil, errors.New("invalid TLS binding signature")
+	}
+	return pk, nil
+}
@@ -0,0 +1,192 @@
+package irma
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/privacybydesign/gabi"
+	"github.com/privacybydesign/gabi/big"
+	"github.com/privacybydesign/irmago/internal/test"
+	"github.com/stretchr/testify/require"
+)
+
+// vectorVersions are the protocol versions for which test vectors are maintained, i.e. those
+// supported by the irmaclient.
+var vectorVersions = []*ProtocolVersion{
+	NewVersion(2, 4), NewVersion(2, 5), NewVersion(2, 6), NewVersion(2, 7), NewVersion(2, 8), NewVersion(2, 9),
+}
+
+func vectorDisclosureRequest() *DisclosureRequest {
+	request := NewDisclosureRequest()
+	request.Context = big.NewInt(1)
+	request.Nonce = big.NewInt(1234567890)
+	request.AddSingle(NewAttributeTypeIdentifier("irma-demo.RU.studentCard.studentID"), nil, trivialTranslation("Student number"))
+	request.Disclose = append(request.Disclose, AttributeDisCon{
+		AttributeCon{NewAttributeRequest("irma-demo.MijnOverheid.ageLower.over18")},
+		AttributeCon{NewAttributeRequest("irma-demo.MijnOverheid.ageLimits.over18")},
+	})
+	return request
+}
+
+func vectorSignatureRequest() *SignatureRequest {
+	request := &SignatureRequest{DisclosureRequest: *vectorDisclosureRequest(), Message: "message to be signed"}
+	request.LDContext = LDContextSignatureRequest
+	return request
+}
+
+func vectorIssuanceRequest() *IssuanceRequest {
+	validity := Timestamp(time.Unix(1893456000, 0))
+	request := &IssuanceRequest{
+		DisclosureRequest: *vectorDisclosureRequest(),
+		Credentials: []*CredentialRequest{{
+			Validity:         &validity,
+			CredentialTypeID: NewCredentialTypeIdentifier("irma-demo.MijnOverheid.fullName"),
+			Attributes: map[string]string{
+				"firstnames": "Johan Pieter",
+				"firstname":  "Johan",
+				"familyname": "Stuivezand",
+				"prefix":     "van",
+			},
+		}},
+	}
+	request.LDContext = LDContextIssuanceRequest
+	return request
+}
+
+// vectorClientRequest returns the session request as sent by the server to a client using the
+// specified protocol version.
+func vectorClientRequest(t *testing.T, request SessionRequest, version *ProtocolVersion) interface{} {
+	request.Base().ProtocolVersion = version
+	if version.Below(2, 5) {
+		legacy, err := request.Legacy()
+		require.NoError(t, err)
+		legacy.Base().ProtocolVersion = version
+		return legacy
+	}
+	if !LDContextSupported(LDContextClientSessionRequest, version) {
+		return request
+	}
+	return &ClientSessionRequest{
+		LDContext:       LDContextClientSessionRequest,
+		ProtocolVersion: version,
+		Options:         &SessionOptions{LDContext: LDContextSessionOptions, PairingMethod: PairingMethodNone},
+		Request:         request,
+	}
+}
+
+func vectorIssueSignatures() []*gabi.IssueSignatureMessage {
+	return []*gabi.IssueSignatureMessage{{
+		Proof: &gabi.ProofS{C: big.NewInt(101), EResponse: big.NewInt(102)},
+		Signature: &gabi.CLSignature{
+			A: big.NewInt(103),
+			E: big.NewInt(104),
+			V: big.NewInt(105),
+		},
+	}}
+}
+
+func marshalVector(t *testing.T, message interface{}) []byte {
+	bts, err := json.Marshal(message)
+	require.NoError(t, err)
+	return bts
+}
+
+func TestSessionRequestVectors(t *testing.T) {
+	requests := map[string]func() SessionRequest{
+		"disclosure-request.json": func() SessionRequest { return vectorDisclosureRequest() },
+		"signature-request.json":  func() SessionRequest { return vectorSignatureRequest() },
+		"issuance-request.json":   func() SessionRequest { return vectorIssuanceRequest() },
+	}
+	for _, version := range vectorVersions {
+		for name, request := range requests {
+			t.Run(version.String()+"/"+name, func(t *testing.T) {
+				path := version.String() + "/" + name
+				test.CheckVector(t, path, marshalVector(t, vectorClientRequest(t, request(), version)))
+
+				// Parse the vector as the irmaclient does
+				expected := request()
+				parsed := &ClientSessionRequest{Request: reflect.New(reflect.TypeOf(expected).Elem()).Interface().(SessionRequest)}
+				require.NoError(t, json.Unmarshal(test.ReadVector(t, path), parsed))
+				require.Equal(t, version, parsed.ProtocolVersion)
+				require.Equal(t, expected.Disclosure().Disclose, parsed.Request.Disclosure().Disclose)
+				if issuance, ok := expected.(*IssuanceRequest); ok {
+					require.Equal(t, issuance.Credentials, parsed.Request.(*IssuanceRequest).Credentials)
+				}
+				if signature, ok := expected.(*SignatureRequest); ok {
+					require.Equal(t, signature.Message, parsed.Request.(*SignatureRequest).Message)
+				}
+			})
+		}
+	}
+}
+
+func TestServerSessionResponseVectors(t *testing.T) {
+	for _, version := range vectorVersions {
+		responses := map[string]*ServerSessionResponse{
+			"disclosure-response.json": {ProofStatus: ProofStatusValid, SessionType: ActionDisclosing},
+			"issuance-response.json":   {ProofStatus: ProofStatusValid, SessionType: ActionIssuing, IssueSignatures: vectorIssueSignatures()},
+		}
+		for name, response := range responses {
+			t.Run(version.String()+"/"+name, func(t *testing.T) {
+				path := version.String() + "/" + name
+				response.ProtocolVersion = version
+				test.CheckVector(t, path, marshalVector(t, response))
+
+				parsed := &ServerSessionResponse{ProtocolVersion: version, SessionType: response.SessionType}
+				require.NoError(t, json.Unmarshal(test.ReadVector(t, path), parsed))
+				if version.Below(2, 7) && response.SessionType == ActionIssuing {
+					parsed.ProofStatus = response.ProofStatus // not included in legacy issuance responses
+				}
+				require.Equal(t, response, parsed)
+			})
+		}
+	}
+}
+
+func TestMessageVectors(t *testing.T) {
+	t.Run("session pointer", func(t *testing.T) {
+		qr := &Qr{URL: "https://irma.example.com/irma/session/AbCdEfGhIjKlMnOpQrSt", Type: ActionDisclosing}
+		test.CheckVector(t, "common/session-pointer.json", marshalVector(t, qr))
+
+		parsed := &Qr{}
+		require.NoError(t, json.Unmarshal(test.ReadVector(t, "common/session-pointer.json"), parsed))
+		require.Equal(t, qr, parsed)
+	})
+
+	t.Run("disclosure", func(t *testing.T) {
+		conf, request, disclosure := parseDisclosure(t)
+		test.CheckVector(t, "common/disclosure-request.json", marshalVector(t, request))
+		test.CheckVector(t, "common/disclosure.json", marshalVector(t, disclosure))
+
+		// The vectors contain a valid disclosure of the request
+		request = &DisclosureRequest{}
+		require.NoError(t, json.Unmarshal(test.ReadVector(t, "common/disclosure-request.json"), request))
+		disclosure = &Disclosure{}
+		require.NoError(t, json.Unmarshal(test.ReadVector(t, "common/disclosure.json"), disclosure))
+		_, status, err := disclosure.Verify(conf, request)
+		require.NoError(t, err)
+		require.Equal(t, ProofStatusValid, status)
+	})
+
+	t.Run("issue commitment", func(t *testing.T) {
+		commitments := &IssueCommitmentMessage{
+			IssueCommitmentMessage: &gabi.IssueCommitmentMessage{
+				Nonce2: big.NewInt(201),
+				Proofs: gabi.ProofList{&gabi.ProofU{
+					U:              big.NewInt(202),
+					C:              big.NewInt(203),
+					VPrimeResponse: big.NewInt(204),
+					SResponse:      big.NewInt(205),
+				}},
+			},
+			Indices: DisclosedAttributeIndices{},
+		}
+		test.CheckVector(t, "common/issue-commitment.json", marshalVector(t, commitments))
+
+		parsed := &IssueCommitmentMessage{}
+		require.NoError(t, json.Unmarshal(test.ReadVector(t, "common/issue-commitment.json"), parsed))
+		require.Equal(t, marshalVector(t, commitments), marshalVector(t, parsed))
+	})
+}
@@ -37,6 +37,7 @@ type DisclosedAttribute struct {
 	RawValue         *string                 `json:"rawvalue"`
 	Value            TranslatedString        `json:"value"` // Value of the disclosed attribute
 	Identifier       AttributeTypeIdentifier `json:"id"`
+	DataType         AttributeDataType       `json:"datatype,omitempty"` // Datatype of the attribute type, see TypedValue()
 	Status           AttributeProofStatus    `json:"status"`
 	IssuanceTime     Timestamp               `json:"issuancetime"`
 	NotRevoked       bool                    `json:"notrevoked,omitempty"`
@@ -124,6 +125,23 @@ func extractAttribute(pl gabi.ProofList, index *DisclosedAttributeIndex, notrevo
 	return attr, str, nil
 }
 
+// extractMetadataAttribute extracts the specified metadata pseudo-attribute from the metadata
+// attribute at the index. If the index does not point to the metadata attribute of a credential of
+// the credential type of the pseudo-attribute, the attribute at the index is returned instead.
+func extractMetadataAttribute(pl gabi.ProofList, index *DisclosedAttributeIndex, id AttributeTypeIdentifier, notrevoked *time.Time, conf *Configuration) (*DisclosedAttribute, *string, error) {
+	attr, val, err := extractAttribute(pl, index, notrevoked, conf)
+	if err != nil || index.AttributeIndex != 1 || attr.Identifier.CredentialTypeIdentifier() != id.CredentialTypeIdentifier() {
+		return attr, val, err
+	}
+	metadata := MetadataFromInt(pl[index.CredentialIndex].(*gabi.ProofD).ADisclosed[1], conf)
+	val = metadata.PseudoAttribute(id.Name())
+	attr.Identifier = id
+	attr.DataType = AttributeDataTypeDate
+	attr.RawValue = val
+	attr.Value = NewTranslatedString(val)
+	return attr, val, nil
+}
+
 // VerifyProofs verifies the proofs cryptographically.
 func (pl ProofList) VerifyProofs(
 	configuration *Configuration,
@@ -320,6 +338,7 @@ func (d *Disclosure) DisclosedAttributes(configuration *Configuration, condiscon
 func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int) (*DisclosedAttribute, *string, error) {
 	var attrid AttributeTypeIdentifier
 	var attrval *string
+	var datatype AttributeDataType
 	credtype := metadata.CredentialType()
 	if credtype == nil {
 		return nil, nil, errors.New("ProofList contained a disclosure proof of an unknown credential type")
@@ -330,6 +349,7 @@ func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int) (*Dis
 		attrval = &p
 	} else {
 		attrid = credtype.AttributeTypes[index-2].GetAttributeTypeIdentifier()
+		datatype = credtype.AttributeTypes[index-2].DataType
 		if credtype.AttributeTypes[index-2].RandomBlind {
 			attrval = decodeRandomBlind(attr)
 		} else {
@@ -342,6 +362,7 @@ func parseAttribute(index int, metadata *MetadataAttribute, attr *big.Int) (*Dis
 	}
 	return &DisclosedAttribute{
 		Identifier:   attrid,
+		DataType:     datatype,
 		RawValue:     attrval,
 		Value:        NewTranslatedString(attrval),
 		Status:       status,
@@ -427,11 +448,11 @@ func (sm *SignedMessage) Verify(configuration *Configuration, request *Signature
 
 	// Next, verify the timestamp so we can safely use its time
 	t := time.Now()
-	if sm.Timestamp != nil {
+	if ts := sm.SignatureTimestamp(); ts != nil {
 		if err := sm.VerifyTimestamp(message, configuration); err != nil {
 			return nil, ProofStatusInvalidTimestamp, nil
 		}
-		t = time.Unix(sm.Timestamp.Time, 0)
+		t = ts.Time()
 	}
 
 	// Finally, cryptographically verify the IRMA disclosure proofs in the signature